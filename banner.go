@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"wunderbase/pkg/server"
+
+	"golang.org/x/exp/slog"
+)
+
+// readyInfo is what serve tells once it is ready: where to send requests
+// and a few facts to check it serves what was meant.
+type readyInfo struct {
+	GraphQL string
+	// GraphiQL, Metrics and Admin are empty when not served
+	GraphiQL string
+	Health   string
+	Ready    string
+	Metrics  string
+	Admin    string
+	// Database is the SQLite file served, Databases their count with
+	// WUNDERBASE_DATABASES
+	Database      string
+	DatabaseBytes int64
+	Databases     int
+	Models        int
+	EngineVersion string
+	// SleepAfter is 0 without sleep mode
+	SleepAfter time.Duration
+	Auth       []string
+}
+
+// newReadyInfo gathers the ready banner of a server that is ready.
+func newReadyInfo(config *config, srv *server.Server, engineVersion string) readyInfo {
+	base := strings.TrimSuffix(config.PublicURL, "/")
+	if base == "" {
+		base = strings.TrimSuffix(srv.GraphQLURL(), "/")
+	}
+	info := readyInfo{
+		GraphQL:       base + "/",
+		Health:        base + config.HealthEndpoint,
+		Ready:         base + config.HealthEndpoint + "?verbose=1",
+		EngineVersion: engineVersion,
+	}
+	if !config.Production {
+		info.GraphiQL = base + "/"
+	}
+	if config.MetricsEndpoint != "" {
+		info.Metrics = base + config.MetricsEndpoint
+	}
+	if config.AdminToken != "" {
+		info.Admin = base + "/admin/"
+	}
+	if config.EnableSleepMode {
+		info.SleepAfter = time.Duration(config.SleepAfterSeconds) * time.Second
+	}
+	if config.TrustedAuthHeader != "" {
+		info.Auth = append(info.Auth, "trusted header "+config.TrustedAuthHeader)
+	}
+	if config.AuthRulesFile != "" {
+		info.Auth = append(info.Auth, "auth rules "+config.AuthRulesFile)
+	}
+
+	// parseFlags refused a WUNDERBASE_DATABASES that doesn't parse
+	if specs, _ := parseDatabases(config.Databases); len(specs) > 0 {
+		info.GraphQL = base + "/t/{name}/"
+		info.GraphiQL = ""
+		info.Databases = len(specs)
+		return info
+	}
+	info.Database = srv.DatabasePath()
+	if stat, err := os.Stat(info.Database); err == nil {
+		info.DatabaseBytes = stat.Size()
+	}
+	models, err := srv.ModelCount()
+	if err != nil {
+		slog.Warn("Counting the models of the schema", slog.String("error", err.Error()))
+	}
+	info.Models = models
+	return info
+}
+
+// logReady prints the ready banner to w, or logs it as a single
+// server_ready event with JSON logs so dashboards can parse it.
+func logReady(config *config, srv *server.Server, engineVersion string, w io.Writer) {
+	if config.Quiet {
+		return
+	}
+	info := newReadyInfo(config, srv, engineVersion)
+	if config.LogFormat == "json" {
+		slog.Info("server_ready", info.attrs()...)
+		return
+	}
+	info.writeBanner(w)
+}
+
+func (i readyInfo) attrs() []interface{} {
+	return []interface{}{
+		slog.String("graphql", i.GraphQL),
+		slog.String("graphiql", i.GraphiQL),
+		slog.String("health", i.Health),
+		slog.String("ready", i.Ready),
+		slog.String("metrics", i.Metrics),
+		slog.String("admin", i.Admin),
+		slog.String("database", i.Database),
+		slog.Int64("databaseBytes", i.DatabaseBytes),
+		slog.Int("databases", i.Databases),
+		slog.Int("models", i.Models),
+		slog.String("engineVersion", i.EngineVersion),
+		slog.Bool("sleepMode", i.SleepAfter > 0),
+		slog.Duration("sleepAfter", i.SleepAfter),
+		slog.Bool("auth", len(i.Auth) > 0),
+		slog.String("authBy", strings.Join(i.Auth, ", ")),
+	}
+}
+
+func (i readyInfo) writeBanner(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "wunderbase is ready")
+	line := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(tw, "  %s\t%s\n", name, value)
+		}
+	}
+	line("GraphQL", i.GraphQL)
+	line("GraphiQL", i.GraphiQL)
+	line("Health", i.Health)
+	line("Ready", i.Ready)
+	line("Metrics", i.Metrics)
+	line("Admin", i.Admin)
+	if i.Databases > 0 {
+		line("Databases", fmt.Sprintf("%d, each under /t/{name}/", i.Databases))
+	} else {
+		line("Database", fmt.Sprintf("%s (%s)", i.Database, formatBytes(i.DatabaseBytes)))
+		line("Models", fmt.Sprint(i.Models))
+	}
+	line("Query engine", i.EngineVersion)
+	if i.SleepAfter > 0 {
+		line("Sleep mode", fmt.Sprintf("after %s without requests", i.SleepAfter))
+	} else {
+		line("Sleep mode", "off")
+	}
+	if len(i.Auth) > 0 {
+		line("Auth", strings.Join(i.Auth, ", "))
+	} else {
+		line("Auth", "none, every caller is served")
+	}
+	_ = tw.Flush()
+}
+
+// formatBytes formats a size for people, like 1.5 MB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 3 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "KMGT"[prefix])
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is an entry of the command registry that drives dispatch, the
+// usage overview and per-command help.
+type command struct {
+	name    string
+	summary string
+	// subcommands lists the usage of each subcommand of a command group
+	subcommands []string
+	examples    []string
+	run         func(ctx context.Context, config *config, args []string) error
+}
+
+// commands is filled in init because the run funcs print help from it.
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "migrate",
+			summary: "Migrate the database schema",
+			examples: []string{
+				"wunderbase migrate",
+				"wunderbase migrate --schema ./prisma/schema.prisma",
+				"WUNDERBASE_INIT_SQL_FILE=./dump.sql wunderbase migrate --force-init",
+			},
+			run: runMigrate,
+		},
+		{
+			name:    "serve",
+			summary: "Start the wunderbase server",
+			examples: []string{
+				"wunderbase serve",
+				"wunderbase serve --listen-addr 127.0.0.1:4466 --sleep-mode=false",
+				"wunderbase serve --ephemeral",
+			},
+			run: runServe,
+		},
+		{
+			name:    "branch",
+			summary: "Create, list and delete database copies",
+			subcommands: []string{
+				"create --to <name> [--from <database>]",
+				"list",
+				"delete <name>",
+			},
+			examples: []string{
+				"wunderbase branch create --to pr-42",
+				"wunderbase branch delete pr-42",
+			},
+			run: runBranch,
+		},
+		{
+			name:    "backup",
+			summary: "Create, restore and verify database backups",
+			subcommands: []string{
+				"create <file or s3://bucket/key>",
+				"restore [--force] <file or s3://bucket/key>",
+				"verify [--query <sql>] [--min <n>] <file or s3://bucket/key>",
+			},
+			examples: []string{
+				"wunderbase backup create s3://backups/wunderbase.sqlite",
+				"wunderbase backup verify --query 'SELECT count(*) FROM User' ./backup.sqlite",
+			},
+			run: runBackup,
+		},
+		{
+			name:    "replay",
+			summary: "Replay the mutation journal on a restored backup",
+			examples: []string{
+				"wunderbase replay --since 2024-05-01T03:00:00Z",
+				"wunderbase replay --since 2024-05-01T03:00:00Z --url http://localhost:4466/",
+			},
+			run: runReplay,
+		},
+		{
+			name:    "rekey",
+			summary: "Change the key of an encrypted database",
+			examples: []string{
+				"wunderbase rekey --new-key-file ./new.key",
+			},
+			run: runRekey,
+		},
+		{
+			name:    "schema",
+			summary: "Inspect the GraphQL schema generated from the prisma schema",
+			subcommands: []string{
+				"sdl [--out <file>] [--json]",
+			},
+			examples: []string{
+				"wunderbase schema sdl > schema.graphql",
+				"wunderbase schema sdl --json --out introspection.json",
+			},
+			run: runSchema,
+		},
+		{
+			name:    "lint",
+			summary: "Check GraphQL operations against the schema and the production rules",
+			examples: []string{
+				"wunderbase lint --manifest ops.json --schema-sdl schema.graphql",
+				"wunderbase lint --manifest ops.json --max-depth 8 --max-cost 10000 --json",
+			},
+			run: runLint,
+		},
+		{
+			name:    "bench",
+			summary: "Load-test an instance",
+			examples: []string{
+				"wunderbase bench --url http://localhost:4466/ --query users.graphql --concurrency 32 --duration 60s",
+				"wunderbase bench --against-self --seed seed.yaml --mix mix.yaml",
+			},
+			run: runBench,
+		},
+		{
+			name:    "healthcheck",
+			summary: "Probe the health endpoint of a running instance",
+			examples: []string{
+				"wunderbase healthcheck",
+				"wunderbase healthcheck --ready --url http://localhost:4466/health",
+			},
+			run: runHealthcheck,
+		},
+		{
+			name:    "doctor",
+			summary: "Diagnose the environment wunderbase runs in",
+			examples: []string{
+				"wunderbase doctor",
+				"wunderbase doctor --json",
+			},
+			run: runDoctor,
+		},
+		{
+			name:    "support-bundle",
+			summary: "Collect logs, config, versions and schema for a bug report",
+			examples: []string{
+				"wunderbase support-bundle --out bundle.tar.gz",
+				"wunderbase support-bundle --url http://localhost:4466 --hash-names",
+			},
+			run: runSupportBundle,
+		},
+		{
+			name:    "version",
+			summary: "Print version information",
+			examples: []string{
+				"wunderbase version",
+				"wunderbase version --json",
+			},
+			run: runVersion,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	fmt.Println(`
+wunderbase is is a Serverless SQLite database exposed through GraphQL. For more information,
+see https://github.com/wundergraph/wunderbase
+
+Usage:
+	wunderbase <command> [arguments]
+
+The commands are:`[1:])
+	for _, c := range commands {
+		fmt.Printf("\t%-15s %s\n", c.name, c.summary)
+	}
+	fmt.Println(`
+Use "wunderbase help <command>" for more information about a command.`)
+}
+
+// runHelp prints the help of a command. Commands with flags print it through
+// their flag set, so the flags shown are exactly the ones they accept.
+func runHelp(ctx context.Context, config *config, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return flag.ErrHelp
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		return unknownCommand("help topic", args[0], commandNames())
+	}
+	if len(c.subcommands) > 0 && len(args) == 1 {
+		printCommandHelp(os.Stderr, c)
+		return flag.ErrHelp
+	}
+	return c.run(ctx, config, append(args[1:len(args):len(args)], "--help"))
+}
+
+// printCommandHelp prints the overview of a command without its flags.
+func printCommandHelp(w io.Writer, c *command) {
+	if len(c.subcommands) > 0 {
+		fmt.Fprintf(w, "Usage: wunderbase %s <subcommand> [flags]\n\n%s.\n\nSubcommands:\n", c.name, c.summary)
+		for _, sub := range c.subcommands {
+			fmt.Fprintf(w, "  %s\n", sub)
+		}
+		fmt.Fprintf(w, "\nUse \"wunderbase help %s <subcommand>\" for its flags.\n", c.name)
+	}
+	printExamples(w, c)
+}
+
+func printExamples(w io.Writer, c *command) {
+	if len(c.examples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nExamples:\n")
+	for _, example := range c.examples {
+		fmt.Fprintf(w, "  %s\n", example)
+	}
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// unknownCommand returns the error for a mistyped command, suggesting the
+// closest known one.
+func unknownCommand(kind, name string, known []string) error {
+	if suggestion := closest(name, known); suggestion != "" {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: unknown %s %q, did you mean %s?", kind, name, suggestion))
+	}
+	return withExitCode(exitUsage, fmt.Errorf("wunderbase: unknown %s %q, expected one of %s", kind, name, strings.Join(known, ", ")))
+}
+
+// closest returns the candidate with the smallest edit distance to name, if
+// it is close enough to be a typo.
+func closest(name string, candidates []string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(name, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownCommandSuggestion(t *testing.T) {
+	err := Run(context.Background(), []string{"migrat"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "did you mean migrate?")
+
+	err = Run(context.Background(), []string{"backup", "verfy"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "did you mean verify?")
+
+	err = Run(context.Background(), []string{"frobnicate"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "expected one of migrate, serve")
+}
+
+func TestHelp(t *testing.T) {
+	for _, args := range [][]string{
+		{"help"},
+		{"help", "serve"},
+		{"help", "branch"},
+		{"help", "backup", "verify"},
+		{"doctor", "--help"},
+		{"lint", "--help"},
+		{"support-bundle", "--help"},
+	} {
+		assert.ErrorIs(t, Run(context.Background(), args), flag.ErrHelp, args)
+	}
+}
+
+func TestConfirmForceInit(t *testing.T) {
+	var prompt bytes.Buffer
+	require.NoError(t, confirmForceInit(strings.NewReader("app.db\n"), &prompt, "/data/app.db", "dump.sql"))
+	assert.Contains(t, prompt.String(), "This moves /data/app.db aside and creates it again from dump.sql")
+
+	err := confirmForceInit(strings.NewReader("yes\n"), &prompt, "/data/app.db", "dump.sql")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wasn't confirmed")
+	require.Error(t, confirmForceInit(strings.NewReader(""), &prompt, "/data/app.db", "dump.sql"))
+}
+
+func TestReadyBanner(t *testing.T) {
+	var out bytes.Buffer
+	readyInfo{
+		GraphQL:       "http://localhost:4466/",
+		Health:        "http://localhost:4466/health",
+		Ready:         "http://localhost:4466/health?verbose=1",
+		Database:      "data/app.db",
+		DatabaseBytes: 3 << 20,
+		Models:        4,
+		EngineVersion: "query-engine 4.16.2",
+		SleepAfter:    10 * time.Second,
+	}.writeBanner(&out)
+	banner := out.String()
+	assert.Contains(t, banner, "  GraphQL       http://localhost:4466/\n")
+	assert.Contains(t, banner, "  Database      data/app.db (3.0 MB)\n")
+	assert.Contains(t, banner, "  Models        4\n")
+	assert.Contains(t, banner, "  Sleep mode    after 10s without requests\n")
+	assert.Contains(t, banner, "  Auth          none, every caller is served\n")
+	assert.NotContains(t, banner, "GraphiQL", "not served in production")
+	assert.NotContains(t, banner, "Admin")
+
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KB", formatBytes(1536))
+}
@@ -0,0 +1,1455 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/journal"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/schedule"
+
+	"github.com/caarlos0/env/v6"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// config is parsed from the environment first; every field with a flag tag
+// can then be overridden on the command line. Env vars carry the WUNDERBASE_
+// prefix; the bare names are still read but deprecated. Fields tagged secret
+// can also be read from a file named by <ENV>_FILE, --<flag>-file or the
+// <flag>-file config key, and are never printed. Fields tagged reload are
+// applied on SIGHUP without a restart. Fields tagged profile can be set
+// apart for the internal endpoint, see internalProfile.
+type config struct {
+	ConfigFile            string `env:"WUNDERBASE_CONFIG" flag:"config" usage:"YAML or JSON file with settings, overridden by env vars and flags"`
+	Production            bool   `env:"WUNDERBASE_PRODUCTION" envDefault:"false" flag:"production" usage:"disable the playground and engine debug features"`
+	PrismaSchemaFilePath  string `env:"WUNDERBASE_PRISMA_SCHEMA_FILE" envDefault:"./schema.prisma" flag:"schema" usage:"path to the prisma schema"`
+	MigrationLockFilePath string `env:"WUNDERBASE_MIGRATION_LOCK_FILE" envDefault:"migration.lock" flag:"migration-lock-file" usage:"file recording the last migrated schema" template:"true"`
+	InitSQLFile           string `env:"WUNDERBASE_INIT_SQL_FILE" flag:"init-sql-file" usage:"SQL dump migrate creates the database from if it doesn't exist"`
+	EnableSleepMode       bool   `env:"WUNDERBASE_ENABLE_SLEEP_MODE" envDefault:"true" flag:"sleep-mode" usage:"exit after a period without requests"`
+	SleepAfterSeconds     int    `env:"WUNDERBASE_SLEEP_AFTER_SECONDS" envDefault:"10" flag:"sleep-after" usage:"seconds without requests before sleeping" reload:"true"`
+	KeepAliveMaxSeconds   int    `env:"WUNDERBASE_KEEPALIVE_MAX_SECONDS" envDefault:"3600" flag:"keepalive-max" usage:"longest a single POST /admin/keepalive keeps the instance awake, in seconds"`
+	SleepPreStopMs        int    `env:"WUNDERBASE_SLEEP_PRE_STOP_MS" envDefault:"0" flag:"sleep-pre-stop-ms" usage:"milliseconds new requests are refused with the stop header once the instance decided to sleep, before it drains and exits"`
+	SleepStopHeader       string `env:"WUNDERBASE_SLEEP_STOP_HEADER" envDefault:"fly-replay" flag:"sleep-stop-header" usage:"header set on the requests refused before sleeping, so the platform's proxy retries them elsewhere; empty sets none"`
+	SleepStopHeaderValue  string `env:"WUNDERBASE_SLEEP_STOP_HEADER_VALUE" envDefault:"elsewhere=true" flag:"sleep-stop-header-value" usage:"value of the sleep stop header"`
+	SleepExitCode         int    `env:"WUNDERBASE_SLEEP_EXIT_CODE" envDefault:"0" flag:"sleep-exit-code" usage:"exit code of the process after going to sleep"`
+	SleepResetOn          string `env:"WUNDERBASE_SLEEP_RESET_ON" envDefault:"all" flag:"sleep-reset-on" usage:"requests resetting the sleep timer: all, writes, or none to sleep after sleep-after from the start"`
+	EngineIdleSeconds     int    `env:"WUNDERBASE_ENGINE_IDLE_SECONDS" envDefault:"0" flag:"engine-idle" usage:"seconds without requests before only the query engine is stopped, the next request starts it again; 0 keeps it running"`
+	SleepResetExempt      string `env:"WUNDERBASE_SLEEP_RESET_EXEMPT" flag:"sleep-reset-exempt" usage:"comma separated operation names that never reset the sleep timer, such as dashboard queries"`
+	// I think that we should discard `EnablePlayground`, when we add `Production` flag.
+	// EnablePlayground      bool   `env:"WUNDERBASE_ENABLE_PLAYGROUND" envDefault:"true"`
+	MigrationEnginePath     string  `env:"WUNDERBASE_MIGRATION_ENGINE_PATH" envDefault:"./migration-engine" flag:"migration-engine" usage:"path to the prisma migration engine"`
+	SchemaDriftCheck        bool    `env:"WUNDERBASE_SCHEMA_DRIFT_CHECK" envDefault:"true" flag:"schema-drift-check" usage:"compare the database with the schema in the background once serving, warning about differences"`
+	RefuseWritesOnDrift     bool    `env:"WUNDERBASE_REFUSE_WRITES_ON_DRIFT" envDefault:"false" flag:"refuse-writes-on-drift" usage:"refuse writes while the database differs from the schema"`
+	RequestTimeoutMs        int     `env:"WUNDERBASE_REQUEST_TIMEOUT_MS" envDefault:"5000" flag:"request-timeout-ms" usage:"milliseconds a GraphQL request may take in the query engine, x-wunderbase-timeout-ms can only shorten it"`
+	MigrationWaitMs         int     `env:"WUNDERBASE_MIGRATION_WAIT_MS" envDefault:"0" flag:"migration-wait-ms" usage:"milliseconds requests wait for a migration run with POST /admin/migration before getting 503, 0 answers 503 right away"`
+	QueryEnginePath         string  `env:"WUNDERBASE_QUERY_ENGINE_PATH" envDefault:"./query-engine" flag:"query-engine" usage:"path to the prisma query engine"`
+	QueryEnginePort         string  `env:"WUNDERBASE_QUERY_ENGINE_PORT" envDefault:"4467" flag:"query-engine-port" usage:"port the query engine listens on"`
+	ExternalEngineURL       string  `env:"WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL" flag:"external-query-engine" usage:"URL of a query engine run by another supervisor, served instead of starting one; empty starts the query engine"`
+	ListenAddr              string  `env:"WUNDERBASE_LISTEN_ADDR" envDefault:"0.0.0.0:4466" flag:"listen-addr" usage:"address the server listens on"`
+	ManagementListenAddr    string  `env:"WUNDERBASE_MANAGEMENT_LISTEN_ADDR" flag:"management-listen-addr" usage:"address of the internal endpoint, a second API on the same query engine with the settings of the internal section of the config file and WUNDERBASE_INTERNAL_ env vars; empty disables it"`
+	PublicURL               string  `env:"WUNDERBASE_PUBLIC_URL" flag:"public-url" usage:"URL clients reach the server on, for the absolute URLs it emits; derived from each request if empty" template:"true"`
+	GraphiQLApiURL          string  `env:"WUNDERBASE_GRAPHIQL_API_URL" flag:"graphiql-api-url" usage:"API url used by the playground, the public URL if empty" template:"true"`
+	ReadLimitSeconds        int     `env:"WUNDERBASE_READ_LIMIT_SECONDS" envDefault:"10000" flag:"read-limit" usage:"reads allowed per second" reload:"true" profile:"true"`
+	WriteLimitSeconds       int     `env:"WUNDERBASE_WRITE_LIMIT_SECONDS" envDefault:"2000" flag:"write-limit" usage:"writes allowed per second" reload:"true" profile:"true"`
+	WriteQueue              int     `env:"WUNDERBASE_WRITE_QUEUE" envDefault:"0" flag:"write-queue" usage:"writes sent to the query engine at a time, the others wait in arrival order; 0 sends them as they come"`
+	WriteQueueTimeoutMs     int     `env:"WUNDERBASE_WRITE_QUEUE_TIMEOUT_MS" envDefault:"5000" flag:"write-queue-timeout-ms" usage:"milliseconds a write waits for the write queue before getting 503"`
+	EngineSlots             int     `env:"WUNDERBASE_ENGINE_SLOTS" envDefault:"0" flag:"engine-slots" usage:"requests sent to the query engine at a time, the others wait in arrival order; 0 sends them as they come"`
+	PrioritySlots           int     `env:"WUNDERBASE_PRIORITY_SLOTS" envDefault:"0" flag:"priority-slots" usage:"engine slots reserved for requests sent with x-wunderbase-priority: high by a caller with a priority scope"`
+	PriorityScopes          string  `env:"WUNDERBASE_PRIORITY_SCOPES" flag:"priority-scopes" usage:"comma separated scopes allowed to send requests with x-wunderbase-priority: high"`
+	EngineQueueTimeoutMs    int     `env:"WUNDERBASE_ENGINE_QUEUE_TIMEOUT_MS" envDefault:"5000" flag:"engine-queue-timeout-ms" usage:"milliseconds a request waits for an engine slot before getting 503"`
+	MutationJournal         string  `env:"WUNDERBASE_MUTATION_JOURNAL" flag:"mutation-journal" usage:"directory of the journal of the mutations made, replayed on a restored backup with wunderbase replay; empty disables it"`
+	JournalFsync            string  `env:"WUNDERBASE_JOURNAL_FSYNC" envDefault:"interval" flag:"journal-fsync" usage:"when the mutation journal is synced to disk: always after every batch of entries, interval every second, or never"`
+	JournalBuffer           int     `env:"WUNDERBASE_JOURNAL_BUFFER" envDefault:"1000" flag:"journal-buffer" usage:"mutations waiting to be written to the journal before journal-on-full applies"`
+	JournalOnFull           string  `env:"WUNDERBASE_JOURNAL_ON_FULL" envDefault:"wait" flag:"journal-on-full" usage:"what a mutation does when the journal buffer is full: wait for room, or drop its entry, leaving a gap replay stops at"`
+	HedgeReads              bool    `env:"WUNDERBASE_HEDGE_READS" envDefault:"false" flag:"hedge-reads" usage:"send a read again when the query engine hasn't answered it after the hedge delay, answering with the first response"`
+	HedgeAfterMs            int     `env:"WUNDERBASE_HEDGE_AFTER_MS" envDefault:"0" flag:"hedge-after-ms" usage:"milliseconds before a read is hedged, 0 derives the delay from the hedge percentile of recent reads"`
+	HedgePercentile         float64 `env:"WUNDERBASE_HEDGE_PERCENTILE" envDefault:"95" flag:"hedge-percentile" usage:"percentile of the durations of recent reads a read is hedged after, unless WUNDERBASE_HEDGE_AFTER_MS is set"`
+	CoalesceReads           bool    `env:"WUNDERBASE_COALESCE_READS" envDefault:"true" flag:"coalesce-reads" usage:"let identical GraphQL reads arriving while one of them waits for the query engine share its answer"`
+	CoalesceMaxWaiters      int     `env:"WUNDERBASE_COALESCE_MAX_WAITERS" envDefault:"100" flag:"coalesce-max-waiters" usage:"reads waiting for an identical read in flight before more are sent on their own"`
+	EngineMaxIdleConns      int     `env:"WUNDERBASE_ENGINE_MAX_IDLE_CONNS" envDefault:"64" flag:"engine-max-idle-conns" usage:"idle connections kept open to the query engine for reuse"`
+	EngineIdleConnSeconds   int     `env:"WUNDERBASE_ENGINE_IDLE_CONN_SECONDS" envDefault:"90" flag:"engine-idle-conn-timeout" usage:"seconds an idle connection to the query engine is kept open"`
+	EngineConnectRetries    int     `env:"WUNDERBASE_ENGINE_CONNECT_RETRIES" envDefault:"3" flag:"engine-connect-retries" usage:"times a request is sent again while the query engine refuses connections, 0 to 100"`
+	EngineConnectBackoffMs  int     `env:"WUNDERBASE_ENGINE_CONNECT_BACKOFF_MS" envDefault:"50" flag:"engine-connect-backoff" usage:"milliseconds between attempts to reach the query engine, also while waiting for it to start, 1 to 10000"`
+	WarmupRuns              int     `env:"WUNDERBASE_WARMUP_RUNS" envDefault:"0" flag:"warmup-runs" usage:"times the warm-up query is sent to a started query engine before it counts as ready, 0 disables the warm-up"`
+	WarmupQuery             string  `env:"WUNDERBASE_WARMUP_QUERY" flag:"warmup-query" usage:"GraphQL document sent to warm up the query engine, empty runs SELECT 1 as a raw query"`
+	OperationLimits         string  `env:"WUNDERBASE_OPERATION_LIMITS" flag:"operation-limits" usage:"comma separated operation=reads/writes per second replacing the read and write limits for an operation, or operation=exempt; an operation is named or sha256:<hex digest of the query>" profile:"true"`
+	ReadQuota               int     `env:"WUNDERBASE_READ_QUOTA" envDefault:"0" flag:"read-quota" usage:"requests allowed per quota window, 0 is unlimited" profile:"true"`
+	WriteQuota              int     `env:"WUNDERBASE_WRITE_QUOTA" envDefault:"0" flag:"write-quota" usage:"mutations allowed per quota window, 0 is unlimited" profile:"true"`
+	QuotaWindowSeconds      int     `env:"WUNDERBASE_QUOTA_WINDOW_SECONDS" envDefault:"86400" flag:"quota-window" usage:"length of the quota window in seconds, windows start at multiples of it since the Unix epoch"`
+	PersistQuota            bool    `env:"WUNDERBASE_PERSIST_QUOTA" envDefault:"false" flag:"persist-quota" usage:"keep the reads and writes of the quota window in a file next to the database across restarts"`
+	LimitWarningThresholds  string  `env:"WUNDERBASE_LIMIT_WARNING_THRESHOLDS" envDefault:"80,95" flag:"limit-warning-thresholds" usage:"comma separated percentages of the quotas, rate limits and database size limit at which a warning is logged once per window, empty disables them"`
+	ReportLimitWarnings     bool    `env:"WUNDERBASE_REPORT_LIMIT_WARNINGS" envDefault:"false" flag:"report-limit-warnings" usage:"also send limit warnings to WUNDERBASE_ERROR_REPORT_URL"`
+	SLOs                    string  `env:"WUNDERBASE_SLOS" flag:"slos" usage:"comma separated operation=pNN:threshold[:window] latency objectives of named operations, like Checkout=p95:100ms:1h; the window defaults to 1h"`
+	SLOBurnRate             float64 `env:"WUNDERBASE_SLO_BURN_RATE" envDefault:"2" flag:"slo-burn-rate" usage:"warn when an SLO spends its latency budget this many times faster than its window allows"`
+	ReportSLOBurns          bool    `env:"WUNDERBASE_REPORT_SLO_BURNS" envDefault:"false" flag:"report-slo-burns" usage:"also send SLO burn warnings to WUNDERBASE_ERROR_REPORT_URL"`
+	HealthEndpoint          string  `env:"WUNDERBASE_HEALTH_ENDPOINT" envDefault:"/health" flag:"health-endpoint" usage:"path of the health endpoint"`
+	SchemaViewer            string  `env:"WUNDERBASE_SCHEMA_VIEWER" envDefault:"auto" flag:"schema-viewer" usage:"serve the schema viewer on /schema/viewer: true, false, or auto to serve it outside production" profile:"true"`
+	IndexAdvice             bool    `env:"WUNDERBASE_INDEX_ADVICE" envDefault:"false" flag:"index-advice" usage:"explain the statements of slow requests and suggest indexes for the tables they scan, needs WUNDERBASE_DEBUG and WUNDERBASE_SLOW_REQUEST_MS"`
+	SafeMutations           string  `env:"WUNDERBASE_SAFE_MUTATIONS" envDefault:"auto" flag:"safe-mutations" usage:"refuse deleteMany and updateMany without a where: true, false, or auto to refuse them in production" profile:"true"`
+	DMMF                    string  `env:"WUNDERBASE_DMMF" envDefault:"auto" flag:"dmmf" usage:"serve the DMMF of the schema on /admin/dmmf: true, false, or auto to serve it outside production"`
+	Introspection           bool    `env:"WUNDERBASE_INTROSPECTION" envDefault:"true" flag:"introspection" usage:"answer introspection queries" profile:"true"`
+	RawQueries              bool    `env:"WUNDERBASE_RAW_QUERIES" envDefault:"true" flag:"raw-queries" usage:"accept the queryRaw, executeRaw and runCommandRaw mutations" profile:"true"`
+	EnableREST              bool    `env:"WUNDERBASE_ENABLE_REST" envDefault:"false" flag:"rest" usage:"serve CRUD endpoints per model under /rest/" profile:"true"`
+	Databases               string  `env:"WUNDERBASE_DATABASES" flag:"databases" usage:"comma separated name=schema:sqlite databases served under /t/{name}/ instead of the schema's, each by its own query engine started on demand"`
+	ReplicaMode             string  `env:"WUNDERBASE_REPLICA_MODE" flag:"replica-mode" usage:"read serves a read-only replica of the database refreshed from the replica source, empty serves the primary"`
+	ReplicaSource           string  `env:"WUNDERBASE_REPLICA_SOURCE" flag:"replica-source" usage:"snapshot the replica is refreshed from, as written by backup create: a path, http(s) or s3:// url" template:"true"`
+	ReplicaRefreshSeconds   int     `env:"WUNDERBASE_REPLICA_REFRESH_SECONDS" envDefault:"60" flag:"replica-refresh" usage:"seconds between checks for a new generation of the replica source"`
+	TimeTravelSources       string  `env:"WUNDERBASE_TIME_TRAVEL_SOURCES" flag:"time-travel-sources" usage:"comma separated backups POST /timetravel reads past states from: directories of backups, paths, http(s) or s3:// urls; empty disables it" template:"true"`
+	TimeTravelMaxEngines    int     `env:"WUNDERBASE_TIME_TRAVEL_MAX_ENGINES" envDefault:"2" flag:"time-travel-max-engines" usage:"time-travel query engines running at once, more reads are refused"`
+	TimeTravelCacheMB       int     `env:"WUNDERBASE_TIME_TRAVEL_CACHE_MB" envDefault:"1024" flag:"time-travel-cache-mb" usage:"megabytes of restored backups kept for the next time-travel reads"`
+	SchedulesFile           string  `env:"WUNDERBASE_SCHEDULES_FILE" flag:"schedules-file" usage:"YAML file listing GraphQL operations run on cron schedules"`
+	EnableCount             bool    `env:"WUNDERBASE_ENABLE_COUNT" envDefault:"false" flag:"count" usage:"serve the count and existence of the rows of a model matching a filter on /count/{model} and /exists/{model}"`
+	CountCacheMs            int     `env:"WUNDERBASE_COUNT_CACHE_MS" envDefault:"1000" flag:"count-cache-ms" usage:"milliseconds the answers of /count/ and /exists/ are cached until a write to the model, 0 disables the cache"`
+	EnableCDC               bool    `env:"WUNDERBASE_ENABLE_CDC" envDefault:"false" flag:"cdc" usage:"record changes with triggers installed when migrating and serve them on /changes"`
+	HealthRequired          string  `env:"WUNDERBASE_HEALTH_REQUIRED" envDefault:"http,query_engine" flag:"health-required" usage:"comma separated components that must be ok for <health-endpoint>?verbose=1 to answer 200"`
+	PeerURLs                string  `env:"WUNDERBASE_PEER_URLS" flag:"peer-urls" usage:"comma separated health endpoint urls of the other instances of a fleet, whose health <health-endpoint>?verbose=1 includes"`
+	MetricsEndpoint         string  `env:"WUNDERBASE_METRICS_ENDPOINT" envDefault:"/metrics" flag:"metrics-endpoint" usage:"path of the metrics endpoint, empty to disable"`
+	StartupTimeoutSeconds   int     `env:"WUNDERBASE_STARTUP_TIMEOUT_SECONDS" envDefault:"60" flag:"startup-timeout" usage:"seconds serve may take to become ready before giving up, 0 disables the limit"`
+	MaxResultRows           int     `env:"WUNDERBASE_MAX_RESULT_ROWS" envDefault:"0" flag:"max-result-rows" usage:"cap every paginated list field of a query at this many rows, 0 disables the cap" profile:"true"`
+	MaxResultRowsExempt     string  `env:"WUNDERBASE_MAX_RESULT_ROWS_EXEMPT" flag:"max-result-rows-exempt" usage:"comma separated operation names not capped by max-result-rows, such as export jobs" profile:"true"`
+	DefaultTake             int     `env:"WUNDERBASE_DEFAULT_TAKE" envDefault:"0" flag:"default-take" usage:"take added to root list fields queried without take or first, 0 disables it" profile:"true"`
+	DefaultNestedTake       int     `env:"WUNDERBASE_DEFAULT_NESTED_TAKE" envDefault:"0" flag:"default-nested-take" usage:"take added to nested relation list fields queried without take or first, 0 disables it" profile:"true"`
+	MaxUploadFileKB         int     `env:"WUNDERBASE_MAX_UPLOAD_FILE_KB" envDefault:"0" flag:"max-upload-file-kb" usage:"accept GraphQL multipart uploads to Bytes fields with files up to this size and serve them on /files/, 0 disables uploads"`
+	MaxUploadTotalKB        int     `env:"WUNDERBASE_MAX_UPLOAD_TOTAL_KB" envDefault:"0" flag:"max-upload-total-kb" usage:"size of a whole multipart upload, 0 is ten times max-upload-file-kb"`
+	FileContentTypes        string  `env:"WUNDERBASE_FILE_CONTENT_TYPES" flag:"file-content-types" usage:"comma separated Model.field=content/type the Bytes fields are served with on /files/, application/octet-stream if not listed"`
+	StaticDir               string  `env:"WUNDERBASE_STATIC_DIR" flag:"static-dir" usage:"directory of files, like a built frontend, served on GET requests under static-path-prefix, empty disables it"`
+	StaticPathPrefix        string  `env:"WUNDERBASE_STATIC_PATH_PREFIX" envDefault:"/static/" flag:"static-path-prefix" usage:"path the static files are served under, the routes of the API come first; / takes the place of the playground"`
+	StaticDotfiles          bool    `env:"WUNDERBASE_STATIC_DOTFILES" envDefault:"false" flag:"static-dotfiles" usage:"serve the static files and directories whose name starts with a dot"`
+	StaticKeepsAwake        bool    `env:"WUNDERBASE_STATIC_KEEPS_AWAKE" envDefault:"false" flag:"static-keeps-awake" usage:"let requests for static files reset the sleep timer"`
+	MaxDatabaseSizeMB       int     `env:"WUNDERBASE_MAX_DATABASE_SIZE_MB" envDefault:"0" flag:"max-database-size-mb" usage:"reject writes above this database size, 0 disables the limit" reload:"true"`
+	StorageFailureReads     bool    `env:"WUNDERBASE_STORAGE_FAILURE_READS" envDefault:"false" flag:"storage-failure-reads" usage:"keep serving reads while the volume of the database fails, writes are always refused"`
+	TrustedAuthHeader       string  `env:"WUNDERBASE_TRUSTED_AUTH_HEADER" flag:"trusted-auth-header" usage:"header carrying the caller identity set by an authenticating proxy, requests without it are rejected" profile:"true"`
+	TrustedProxies          string  `env:"WUNDERBASE_TRUSTED_PROXIES" flag:"trusted-proxies" usage:"comma separated CIDRs of the proxies allowed to set the trusted auth header" profile:"true"`
+	TrustedScopesHeader     string  `env:"WUNDERBASE_TRUSTED_SCOPES_HEADER" flag:"trusted-scopes-header" usage:"header carrying the comma or space separated scopes of the caller, set by the same proxy as the trusted auth header" profile:"true"`
+	ModelGrants             bool    `env:"WUNDERBASE_MODEL_GRANTS" envDefault:"false" flag:"model-grants" usage:"restrict callers with scopes like Product:read or Product:write to the models granted, and prune the schema they see to them" profile:"true"`
+	AuthRulesFile           string  `env:"WUNDERBASE_AUTH_RULES_FILE" flag:"auth-rules-file" usage:"YAML file of the scopes or authentication required by operation names, root fields and Model.action pairs, re-read on SIGHUP" reload:"true" profile:"true"`
+	RowFilters              string  `env:"WUNDERBASE_ROW_FILTERS" flag:"row-filters" usage:"JSON object of where filters by model merged into every query and mutation of the model, \"$claims.sub\" is replaced by the caller from the trusted auth header" profile:"true"`
+	HiddenModels            string  `env:"WUNDERBASE_HIDDEN_MODELS" flag:"hidden-models" usage:"comma separated models left out of the schema clients see, queries and mutations touching them are refused"`
+	HiddenFields            string  `env:"WUNDERBASE_HIDDEN_FIELDS" flag:"hidden-fields" usage:"comma separated Model.field left out of the schema clients see, requests selecting or filtering on them are refused"`
+	SoftDeleteModels        string  `env:"WUNDERBASE_SOFT_DELETE_MODELS" flag:"soft-delete-models" usage:"comma separated models whose deletes set the soft delete field instead, reads only see the rows where it is null"`
+	SoftDeleteField         string  `env:"WUNDERBASE_SOFT_DELETE_FIELD" envDefault:"deletedAt" flag:"soft-delete-field" usage:"nullable DateTime field of the soft deleted models set by their deletes"`
+	EnableServerTiming      bool    `env:"WUNDERBASE_ENABLE_SERVER_TIMING" envDefault:"false" flag:"server-timing" usage:"add a Server-Timing header with the time spent in the proxy, the query engine and the rate limit queue to every response"`
+	PlainTextErrors         bool    `env:"WUNDERBASE_PLAIN_TEXT_ERRORS" envDefault:"false" flag:"plain-text-errors" usage:"answer errors of the admin endpoints, unknown paths and the health endpoint as plain text like older versions instead of GraphQL errors"`
+	AdminToken              string  `env:"WUNDERBASE_ADMIN_TOKEN" flag:"admin-token" usage:"bearer token for the admin endpoints under /admin/, empty disables them" secret:"true" profile:"true"`
+	EnablePprof             bool    `env:"WUNDERBASE_ENABLE_PPROF" envDefault:"false" flag:"pprof" usage:"serve pprof, runtime stats and goroutine dumps on the admin endpoints, ignored in production unless forced"`
+	ForcePprof              bool    `env:"WUNDERBASE_FORCE_PPROF" envDefault:"false" flag:"force-pprof" usage:"enable pprof even in production"`
+	RecentRequests          int     `env:"WUNDERBASE_RECENT_REQUESTS" envDefault:"100" flag:"recent-requests" usage:"latest requests listed on /admin/requests, 0 disables it"`
+	CaptureBodies           bool    `env:"WUNDERBASE_CAPTURE_BODIES" envDefault:"false" flag:"capture-bodies" usage:"keep the query and variables of the requests listed on /admin/requests, ignored in production"`
+	DisableCapture          bool    `env:"WUNDERBASE_DISABLE_CAPTURE" envDefault:"false" flag:"disable-capture" usage:"refuse to arm captures of full requests and responses on /admin/capture"`
+	CaptureDir              string  `env:"WUNDERBASE_CAPTURE_DIR" flag:"capture-dir" usage:"directory captured requests and responses are written to, empty keeps them in memory for GET /admin/capture" template:"true"`
+	CaptureMaxKB            int     `env:"WUNDERBASE_CAPTURE_MAX_KB" envDefault:"1024" flag:"capture-max-kb" usage:"kilobytes a capture keeps before it disarms"`
+	CaptureRedact           string  `env:"WUNDERBASE_CAPTURE_REDACT" envDefault:"password,token,secret,authorization,apiKey" flag:"capture-redact" usage:"comma separated keys whose values are redacted in captures, at any depth of the variables and the response"`
+	StatsdAddr              string  `env:"WUNDERBASE_STATSD_ADDR" flag:"statsd-addr" usage:"host:port of a StatsD/DogStatsD agent to send metrics to over UDP"`
+	StatsdPrefix            string  `env:"WUNDERBASE_STATSD_PREFIX" flag:"statsd-prefix" usage:"prefix for StatsD metric names" template:"true"`
+	StatsdTags              string  `env:"WUNDERBASE_STATSD_TAGS" flag:"statsd-tags" usage:"comma separated key:value tags added to every StatsD metric" template:"true"`
+	ErrorReportURL          string  `env:"WUNDERBASE_ERROR_REPORT_URL" flag:"error-report-url" usage:"url panics, engine crashes, failed migrations and storage failures are posted to as Sentry compatible JSON events" secret:"true"`
+	ErrorReportMaxPerMinute int     `env:"WUNDERBASE_ERROR_REPORT_MAX_PER_MINUTE" envDefault:"10" flag:"error-report-max-per-minute" usage:"error reports sent per minute at most"`
+	BranchesDir             string  `env:"WUNDERBASE_BRANCHES_DIR" envDefault:"./data/branches" flag:"branches-dir" usage:"directory database branches are stored in" template:"true"`
+	SqlitePath              string  `env:"WUNDERBASE_SQLITE_PATH" envDefault:"sqlite3" flag:"sqlite" usage:"path to the sqlite3 CLI"`
+	BackupEncryptionKey     string  `env:"WUNDERBASE_BACKUP_ENCRYPTION_KEY" flag:"backup-encryption-key" usage:"comma separated backup keys, the first one encrypts" secret:"true"`
+	BackupVerifyCron        string  `env:"WUNDERBASE_BACKUP_VERIFY_CRON" flag:"backup-verify-cron" usage:"cron schedule the latest of the backup verify sources is restore-tested on, like backup verify; empty disables it"`
+	BackupVerifySources     string  `env:"WUNDERBASE_BACKUP_VERIFY_SOURCES" flag:"backup-verify-sources" usage:"comma separated backups the latest is verified of: directories of backups, paths, http(s) or s3:// urls" template:"true"`
+	BackupVerifyQuery       string  `env:"WUNDERBASE_BACKUP_VERIFY_QUERY" flag:"backup-verify-query" usage:"verification query of scheduled backup verification returning a single number, e.g. SELECT count(*) FROM User"`
+	BackupVerifyMin         int64   `env:"WUNDERBASE_BACKUP_VERIFY_MIN" envDefault:"1" flag:"backup-verify-min" usage:"minimum result of the backup verify query"`
+	DatabaseKey             string  `env:"WUNDERBASE_DATABASE_KEY" flag:"database-key" usage:"key of a database encrypted with SQLCipher, passed to query and migration engines built against SQLCipher" secret:"true"`
+	LogFormat               string  `env:"WUNDERBASE_LOG_FORMAT" envDefault:"text" flag:"log-format" usage:"log format: text, json, or pretty for colored output in a terminal"`
+	LogOutput               string  `env:"WUNDERBASE_LOG_OUTPUT" envDefault:"stderr" flag:"log-output" usage:"where logs are written: stderr, stdout or a file path" template:"true"`
+	LogMaxSizeMB            int     `env:"WUNDERBASE_LOG_MAX_SIZE_MB" envDefault:"100" flag:"log-max-size-mb" usage:"rotate the log file at this size, 0 disables rotation"`
+	LogMaxBackups           int     `env:"WUNDERBASE_LOG_MAX_BACKUPS" envDefault:"3" flag:"log-max-backups" usage:"rotated log files to keep"`
+	LogSampleRate           float64 `env:"WUNDERBASE_LOG_SAMPLE_RATE" envDefault:"1" flag:"log-sample-rate" usage:"fraction of successful requests whose log lines are kept, errors and slow requests are always logged"`
+	LogExcludePaths         string  `env:"WUNDERBASE_LOG_EXCLUDE_PATHS" envDefault:"auto" flag:"log-exclude-paths" usage:"comma separated paths left out of the access log, prefixes end with *; auto stands for the health and metrics endpoints, none excludes nothing"`
+	MetricsExcludePaths     string  `env:"WUNDERBASE_METRICS_EXCLUDE_PATHS" envDefault:"auto" flag:"metrics-exclude-paths" usage:"comma separated paths left out of the request metrics, prefixes end with *; auto stands for the health and metrics endpoints, none excludes nothing"`
+	ExcludeUserAgents       string  `env:"WUNDERBASE_EXCLUDE_USER_AGENTS" flag:"exclude-user-agents" usage:"comma separated User-Agent prefixes, like kube-probe, whose requests are left out of the access log and the request metrics"`
+	SlowRequestMs           int     `env:"WUNDERBASE_SLOW_REQUEST_MS" envDefault:"1000" flag:"slow-request-ms" usage:"log requests taking longer than this many milliseconds as slow, 0 disables it"`
+	Quiet                   bool    `env:"WUNDERBASE_QUIET" envDefault:"false" flag:"quiet" usage:"don't print the banner listing the endpoints once serve is ready"`
+	Timestamp               bool    `env:"WUNDERBASE_TIMESTAMP" envDefault:"false" flag:"timestamp" usage:"include timestamps in logs"`
+	Debug                   bool    `env:"WUNDERBASE_DEBUG" envDefault:"true" flag:"debug" usage:"enable debug logging and engine query logs" reload:"true"`
+
+	// sources records where each field's value came from, by field name
+	sources map[string]string
+	// deprecated lists the bare env vars that were used
+	deprecated []string
+	// internal are the settings of the internal endpoint by field name
+	internal map[string]profileSetting
+	// datasource is the datasource of the schema once databasePath read it
+	datasource *migrate.Datasource
+}
+
+// envPrefix is prepended to every env var so generic names like DEBUG don't
+// collide with other software sharing the environment.
+const envPrefix = "WUNDERBASE_"
+
+// parseEnv reads the config from the environment. The prefixed form of a
+// variable wins; the bare form is only used when the prefixed one is unset.
+func parseEnv(config *config) error {
+	environment := map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			environment[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	config.sources = map[string]string{}
+	t := reflect.TypeOf(config).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		if field.Tag.Get("secret") == "true" {
+			if err := readSecretEnv(environment, name, config); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if _, ok := environment[name]; ok {
+			if _, ok := config.sources[field.Name]; !ok {
+				config.sources[field.Name] = "env " + name
+			}
+			continue
+		}
+		legacy := legacyEnv(name)
+		if value, ok := environment[legacy]; ok && legacy != "" {
+			environment[name] = value
+			config.sources[field.Name] = "env " + legacy + " (deprecated)"
+			config.deprecated = append(config.deprecated, legacy)
+		}
+	}
+	if err := parseInternalEnv(environment, config); err != nil {
+		return err
+	}
+
+	return env.Parse(config, env.Options{Environment: environment})
+}
+
+// readSecretEnv resolves the <name>_FILE variant of a secret env var into
+// environment[name], so docker and kubernetes secret mounts can be used.
+func readSecretEnv(environment map[string]string, name string, config *config) error {
+	var fileVar string
+	for _, candidate := range []string{name + "_FILE", legacyEnv(name) + "_FILE"} {
+		if _, ok := environment[candidate]; ok && candidate != "_FILE" {
+			fileVar = candidate
+			break
+		}
+	}
+	if fileVar == "" {
+		return nil
+	}
+	for _, direct := range []string{name, legacyEnv(name)} {
+		if environment[direct] != "" {
+			return fmt.Errorf("%s and %s are both set, use only one", direct, fileVar)
+		}
+	}
+	value, err := readSecretFile(environment[fileVar])
+	if err != nil {
+		return err
+	}
+	environment[name] = value
+	config.setSource(fieldByEnv(name), "file from env "+fileVar)
+	if fileVar != name+"_FILE" {
+		config.deprecated = append(config.deprecated, fileVar)
+	}
+	return nil
+}
+
+// readSecretFile returns the contents of a secret file without the trailing
+// newline most editors and `kubectl create secret` add. The error never
+// includes the contents.
+func readSecretFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func fieldByEnv(name string) string {
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("env") == name {
+			return t.Field(i).Name
+		}
+	}
+	return ""
+}
+
+// legacyEnv returns the unprefixed name a variable had before the prefix was
+// introduced, or "" if it never had one.
+func legacyEnv(name string) string {
+	if name == "WUNDERBASE_CONFIG" {
+		return ""
+	}
+	return strings.TrimPrefix(name, envPrefix)
+}
+
+// source returns where the value of a field came from.
+func (c *config) source(field string) string {
+	if source, ok := c.sources[field]; ok {
+		return source
+	}
+	return "default"
+}
+
+func (c *config) setSource(field, source string) {
+	if c.sources == nil {
+		c.sources = map[string]string{}
+	}
+	c.sources[field] = source
+}
+
+// newFlagSet returns a flag set for a subcommand with a flag for every
+// config field. The config has already been parsed from the environment,
+// so flags take precedence over env vars, which take precedence over defaults.
+func newFlagSet(name string, config *config) *flag.FlagSet {
+	fs := flag.NewFlagSet("wunderbase "+name, flag.ContinueOnError)
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("flag")
+		if !ok {
+			continue
+		}
+		usage := fmt.Sprintf("%s (env %s", field.Tag.Get("usage"), field.Tag.Get("env"))
+		if def, ok := field.Tag.Lookup("envDefault"); ok {
+			usage += fmt.Sprintf(", default %q", def)
+		}
+		fs.Var(fieldValue{v.Field(i)}, name, usage+")")
+		if field.Tag.Get("secret") == "true" {
+			fs.Var(secretFileValue{fieldValue{v.Field(i)}}, name+"-file", fmt.Sprintf("file to read --%s from (env %s_FILE)", name, field.Tag.Get("env")))
+		}
+	}
+	fs.Usage = func() {
+		c := findCommand(strings.Fields(name)[0])
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\n", fs.Name())
+		if c != nil && len(c.subcommands) == 0 {
+			fmt.Fprintf(fs.Output(), "%s.\n\n", c.summary)
+		}
+		fmt.Fprintf(fs.Output(), "Flags:\n")
+		fs.VisitAll(func(f *flag.Flag) {
+			typ, usage := flag.UnquoteUsage(f)
+			if fv, ok := f.Value.(fieldValue); ok && !fv.IsBoolFlag() {
+				typ = fv.v.Kind().String()
+			} else if ok {
+				typ = ""
+			} else if _, ok := f.Value.(secretFileValue); ok {
+				typ = "string"
+			}
+			fmt.Fprintf(fs.Output(), "  --%s %s\n    \t%s\n", f.Name, typ, usage)
+		})
+		if c != nil {
+			printExamples(fs.Output(), c)
+		}
+	}
+	return fs
+}
+
+// parseFlags parses the command line, merges in the config file, validates
+// the result and initializes the logger, which depends on the final
+// configuration.
+func parseFlags(fs *flag.FlagSet, config *config, args []string) error {
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: invalid configuration:\n%w", err))
+	}
+	if err := initLogger(config); err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: init logger: %w", err))
+	}
+	for _, name := range config.deprecated {
+		slog.Warn("env var is deprecated, use the prefixed form", "name", name, "replacement", envPrefix+name)
+	}
+	return nil
+}
+
+// loadFlags parses the command line and merges in the config file without
+// validating, for commands that have to work with a broken configuration.
+func loadFlags(fs *flag.FlagSet, config *config, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return withExitCode(exitUsage, err)
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	t := reflect.TypeOf(config).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("flag")
+		if explicit[name] && explicit[name+"-file"] {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: --%s and --%s-file are both set, use only one", name, name))
+		}
+		if explicit[name] {
+			config.setSource(t.Field(i).Name, "flag --"+name)
+		} else if explicit[name+"-file"] {
+			config.setSource(t.Field(i).Name, "file from flag --"+name+"-file")
+		}
+	}
+	if config.ConfigFile != "" {
+		if err := loadConfigFile(fs, config); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: config file %s: %w", config.ConfigFile, err))
+		}
+	}
+	if err := expandTemplates(config); err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: expand config template: %w", err))
+	}
+	return nil
+}
+
+// validationErrors collects every configuration problem so they can be
+// fixed in one pass.
+type validationErrors []string
+
+func (v validationErrors) Error() string {
+	return "  " + strings.Join(v, "\n  ")
+}
+
+func (v *validationErrors) add(format string, args ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, args...))
+}
+
+// Validate checks the configuration and reports all problems together.
+func (c *config) Validate() error {
+	var errs validationErrors
+
+	if c.Databases == "" {
+		if _, err := os.Stat(c.PrismaSchemaFilePath); err != nil {
+			errs.add("WUNDERBASE_PRISMA_SCHEMA_FILE: %v", err)
+		}
+	} else if databases, err := parseDatabases(c.Databases); err != nil {
+		errs.add("WUNDERBASE_DATABASES: %v", err)
+	} else {
+		for _, db := range databases {
+			if _, err := os.Stat(db.SchemaPath); err != nil {
+				errs.add("WUNDERBASE_DATABASES: database %s: %v", db.Name, err)
+			}
+		}
+		if port, err := strconv.Atoi(c.QueryEnginePort); err == nil && port+len(databases)-1 > 65535 {
+			errs.add("WUNDERBASE_DATABASES: %d databases need the ports from WUNDERBASE_QUERY_ENGINE_PORT %d up", len(databases), port)
+		}
+	}
+	if c.SleepAfterSeconds < 0 || (c.EnableSleepMode && c.SleepAfterSeconds == 0) {
+		errs.add("WUNDERBASE_SLEEP_AFTER_SECONDS: must be positive when sleep mode is enabled, got %d", c.SleepAfterSeconds)
+	}
+	switch {
+	case c.SleepPreStopMs < 0:
+		errs.add("WUNDERBASE_SLEEP_PRE_STOP_MS: must not be negative, got %d", c.SleepPreStopMs)
+	case c.SleepPreStopMs > 0 && c.Databases != "":
+		errs.add("WUNDERBASE_SLEEP_PRE_STOP_MS: can't be combined with WUNDERBASE_DATABASES, whose databases sleep without the process stopping")
+	}
+	if strings.ContainsAny(c.SleepStopHeader, " \t\r\n:") {
+		errs.add("WUNDERBASE_SLEEP_STOP_HEADER: must be a header name, got %q", c.SleepStopHeader)
+	}
+	if strings.ContainsAny(c.SleepStopHeaderValue, "\r\n") {
+		errs.add("WUNDERBASE_SLEEP_STOP_HEADER_VALUE: must be a single line, got %q", c.SleepStopHeaderValue)
+	}
+	if c.SleepExitCode < 0 || c.SleepExitCode > 255 {
+		errs.add("WUNDERBASE_SLEEP_EXIT_CODE: must be between 0 and 255, got %d", c.SleepExitCode)
+	}
+	if c.RequestTimeoutMs < 1 {
+		errs.add("WUNDERBASE_REQUEST_TIMEOUT_MS: must be at least 1, got %d", c.RequestTimeoutMs)
+	}
+	if c.MigrationWaitMs < 0 || c.MigrationWaitMs > 60000 {
+		errs.add("WUNDERBASE_MIGRATION_WAIT_MS: must be between 0 and 60000, got %d", c.MigrationWaitMs)
+	}
+	switch {
+	case c.EngineIdleSeconds < 0:
+		errs.add("WUNDERBASE_ENGINE_IDLE_SECONDS: must not be negative, got %d", c.EngineIdleSeconds)
+	case c.EngineIdleSeconds == 0:
+	case c.EnableSleepMode && c.EngineIdleSeconds >= c.SleepAfterSeconds:
+		errs.add("WUNDERBASE_ENGINE_IDLE_SECONDS: must be below WUNDERBASE_SLEEP_AFTER_SECONDS %d, the whole process sleeps first", c.SleepAfterSeconds)
+	case c.Databases != "":
+		errs.add("WUNDERBASE_ENGINE_IDLE_SECONDS: can't be combined with WUNDERBASE_DATABASES, whose engines stop after WUNDERBASE_SLEEP_AFTER_SECONDS")
+	case c.ReplicaMode != "":
+		errs.add("WUNDERBASE_ENGINE_IDLE_SECONDS: can't be combined with WUNDERBASE_REPLICA_MODE, which restarts the engine for every generation")
+	}
+	if _, err := parseOperationLimits(c.OperationLimits); err != nil {
+		errs.add("WUNDERBASE_OPERATION_LIMITS: %v", err)
+	}
+	if c.ReadQuota < 0 {
+		errs.add("WUNDERBASE_READ_QUOTA: must not be negative, got %d", c.ReadQuota)
+	}
+	if c.WriteQuota < 0 {
+		errs.add("WUNDERBASE_WRITE_QUOTA: must not be negative, got %d", c.WriteQuota)
+	}
+	if c.QuotaWindowSeconds <= 0 {
+		errs.add("WUNDERBASE_QUOTA_WINDOW_SECONDS: must be positive, got %d", c.QuotaWindowSeconds)
+	}
+	if c.EngineMaxIdleConns <= 0 {
+		errs.add("WUNDERBASE_ENGINE_MAX_IDLE_CONNS: must be positive, got %d", c.EngineMaxIdleConns)
+	}
+	if c.EngineIdleConnSeconds <= 0 {
+		errs.add("WUNDERBASE_ENGINE_IDLE_CONN_SECONDS: must be positive, got %d", c.EngineIdleConnSeconds)
+	}
+	if _, err := parseThresholds(c.LimitWarningThresholds); err != nil {
+		errs.add("WUNDERBASE_LIMIT_WARNING_THRESHOLDS: %v", err)
+	}
+	if _, err := parseSLOs(c.SLOs); err != nil {
+		errs.add("WUNDERBASE_SLOS: %v", err)
+	}
+	if c.SLOBurnRate <= 0 {
+		errs.add("WUNDERBASE_SLO_BURN_RATE: must be positive")
+	}
+	if c.RecentRequests < 0 {
+		errs.add("WUNDERBASE_RECENT_REQUESTS: must not be negative, got %d", c.RecentRequests)
+	}
+	if c.EngineConnectRetries < 0 || c.EngineConnectRetries > 100 {
+		errs.add("WUNDERBASE_ENGINE_CONNECT_RETRIES: must be between 0 and 100, got %d", c.EngineConnectRetries)
+	}
+	if c.EngineConnectBackoffMs < 1 || c.EngineConnectBackoffMs > 10000 {
+		errs.add("WUNDERBASE_ENGINE_CONNECT_BACKOFF_MS: must be between 1 and 10000, got %d", c.EngineConnectBackoffMs)
+	}
+	if c.WarmupRuns < 0 || c.WarmupRuns > 100 {
+		errs.add("WUNDERBASE_WARMUP_RUNS: must be between 0 and 100, got %d", c.WarmupRuns)
+	}
+	switch c.SleepResetOn {
+	case api.SleepResetAll, api.SleepResetWrites, api.SleepResetNone:
+	default:
+		errs.add("WUNDERBASE_SLEEP_RESET_ON: must be all, writes or none, got %q", c.SleepResetOn)
+	}
+	if c.KeepAliveMaxSeconds <= 0 {
+		errs.add("WUNDERBASE_KEEPALIVE_MAX_SECONDS: must be positive, got %d", c.KeepAliveMaxSeconds)
+	}
+	if c.ReadLimitSeconds <= 0 {
+		errs.add("WUNDERBASE_READ_LIMIT_SECONDS: must be positive, got %d", c.ReadLimitSeconds)
+	}
+	if c.WriteLimitSeconds <= 0 {
+		errs.add("WUNDERBASE_WRITE_LIMIT_SECONDS: must be positive, got %d", c.WriteLimitSeconds)
+	}
+	if c.WriteQueue < 0 {
+		errs.add("WUNDERBASE_WRITE_QUEUE: must not be negative, got %d", c.WriteQueue)
+	}
+	if c.HedgeAfterMs < 0 {
+		errs.add("WUNDERBASE_HEDGE_AFTER_MS: must not be negative, got %d", c.HedgeAfterMs)
+	}
+	if c.HedgePercentile <= 0 || c.HedgePercentile >= 100 {
+		errs.add("WUNDERBASE_HEDGE_PERCENTILE: must be between 0 and 100, got %v", c.HedgePercentile)
+	}
+	if c.CoalesceMaxWaiters < 1 {
+		errs.add("WUNDERBASE_COALESCE_MAX_WAITERS: must be at least 1, got %d", c.CoalesceMaxWaiters)
+	}
+	if c.WriteQueueTimeoutMs < 1 {
+		errs.add("WUNDERBASE_WRITE_QUEUE_TIMEOUT_MS: must be at least 1, got %d", c.WriteQueueTimeoutMs)
+	}
+	if c.EngineSlots < 0 {
+		errs.add("WUNDERBASE_ENGINE_SLOTS: must not be negative, got %d", c.EngineSlots)
+	}
+	switch {
+	case c.PrioritySlots < 0:
+		errs.add("WUNDERBASE_PRIORITY_SLOTS: must not be negative, got %d", c.PrioritySlots)
+	case c.PrioritySlots > 0 && c.PrioritySlots >= c.EngineSlots:
+		errs.add("WUNDERBASE_PRIORITY_SLOTS: must be less than WUNDERBASE_ENGINE_SLOTS (%d) to leave slots to the general pool, got %d", c.EngineSlots, c.PrioritySlots)
+	case c.PrioritySlots > 0 && c.PriorityScopes == "":
+		errs.add("WUNDERBASE_PRIORITY_SLOTS: requires WUNDERBASE_PRIORITY_SCOPES, nobody could use the reserved slots")
+	}
+	if c.PriorityScopes != "" && c.TrustedScopesHeader == "" {
+		errs.add("WUNDERBASE_PRIORITY_SCOPES: requires WUNDERBASE_TRUSTED_SCOPES_HEADER, the priority is only given to authenticated callers")
+	}
+	if c.EngineQueueTimeoutMs < 1 {
+		errs.add("WUNDERBASE_ENGINE_QUEUE_TIMEOUT_MS: must be at least 1, got %d", c.EngineQueueTimeoutMs)
+	}
+	switch c.JournalFsync {
+	case journal.FsyncAlways, journal.FsyncInterval, journal.FsyncNever:
+	default:
+		errs.add("WUNDERBASE_JOURNAL_FSYNC: must be always, interval or never, got %q", c.JournalFsync)
+	}
+	if c.JournalBuffer < 1 {
+		errs.add("WUNDERBASE_JOURNAL_BUFFER: must be at least 1, got %d", c.JournalBuffer)
+	}
+	switch c.JournalOnFull {
+	case journal.OnFullWait, journal.OnFullDrop:
+	default:
+		errs.add("WUNDERBASE_JOURNAL_ON_FULL: must be wait or drop, got %q", c.JournalOnFull)
+	}
+	if c.MutationJournal != "" && c.Databases != "" {
+		errs.add("WUNDERBASE_MUTATION_JOURNAL: can't be combined with WUNDERBASE_DATABASES")
+	}
+	if c.StartupTimeoutSeconds < 0 {
+		errs.add("WUNDERBASE_STARTUP_TIMEOUT_SECONDS: must not be negative, got %d", c.StartupTimeoutSeconds)
+	}
+	if c.MaxResultRows < 0 {
+		errs.add("WUNDERBASE_MAX_RESULT_ROWS: must not be negative, got %d", c.MaxResultRows)
+	}
+	if c.DefaultTake < 0 {
+		errs.add("WUNDERBASE_DEFAULT_TAKE: must not be negative, got %d", c.DefaultTake)
+	}
+	if c.DefaultNestedTake < 0 {
+		errs.add("WUNDERBASE_DEFAULT_NESTED_TAKE: must not be negative, got %d", c.DefaultNestedTake)
+	}
+	if c.MaxUploadFileKB < 0 {
+		errs.add("WUNDERBASE_MAX_UPLOAD_FILE_KB: must not be negative, got %d", c.MaxUploadFileKB)
+	}
+	if c.MaxUploadTotalKB < 0 || (c.MaxUploadTotalKB > 0 && c.MaxUploadTotalKB < c.MaxUploadFileKB) {
+		errs.add("WUNDERBASE_MAX_UPLOAD_TOTAL_KB: must be 0 or at least WUNDERBASE_MAX_UPLOAD_FILE_KB, got %d", c.MaxUploadTotalKB)
+	}
+	if _, err := parseFileContentTypes(c.FileContentTypes); err != nil {
+		errs.add("WUNDERBASE_FILE_CONTENT_TYPES: %v", err)
+	}
+	if c.CountCacheMs < 0 {
+		errs.add("WUNDERBASE_COUNT_CACHE_MS: must not be negative, got %d", c.CountCacheMs)
+	}
+	if c.StaticDir != "" {
+		if info, err := os.Stat(c.StaticDir); err != nil {
+			errs.add("WUNDERBASE_STATIC_DIR: %v", err)
+		} else if !info.IsDir() {
+			errs.add("WUNDERBASE_STATIC_DIR: %s is not a directory", c.StaticDir)
+		}
+	}
+	if prefix := strings.TrimSuffix(c.StaticPathPrefix, "/"); c.StaticPathPrefix != "/" && (!strings.HasPrefix(prefix, "/") || path.Clean(prefix) != prefix) {
+		errs.add("WUNDERBASE_STATIC_PATH_PREFIX: must be a clean path starting with /, got %q", c.StaticPathPrefix)
+	}
+	if c.MaxDatabaseSizeMB < 0 {
+		errs.add("WUNDERBASE_MAX_DATABASE_SIZE_MB: must not be negative, got %d", c.MaxDatabaseSizeMB)
+	}
+	if _, port, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs.add("WUNDERBASE_LISTEN_ADDR: %v", err)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		// port 0 picks a free port, which is fine for tests
+		errs.add("WUNDERBASE_LISTEN_ADDR: invalid port %q", port)
+	}
+	if !validPort(c.QueryEnginePort) {
+		errs.add("WUNDERBASE_QUERY_ENGINE_PORT: invalid port %q", c.QueryEnginePort)
+	} else if c.ExternalEngineURL == "" {
+		engines := []string{""}
+		if databases, err := parseDatabases(c.Databases); err == nil && len(databases) > 0 {
+			engines = engines[:0]
+			for _, db := range databases {
+				engines = append(engines, db.Name)
+			}
+		}
+		first, _ := strconv.Atoi(c.QueryEnginePort)
+		if i, ok := engineListenConflict(c.ListenAddr, first, len(engines)); ok && engines[i] == "" {
+			errs.add("WUNDERBASE_LISTEN_ADDR: %s takes port %d of WUNDERBASE_QUERY_ENGINE_PORT, the query engine listens on it", c.ListenAddr, first)
+		} else if ok {
+			errs.add("WUNDERBASE_LISTEN_ADDR: %s takes port %d the query engine of database %s listens on, WUNDERBASE_QUERY_ENGINE_PORT plus its position in WUNDERBASE_DATABASES", c.ListenAddr, first+i, engines[i])
+		}
+	}
+	if c.ExternalEngineURL != "" {
+		// wunderbase neither starts nor stops an external engine
+		if !isAbsoluteURL(c.ExternalEngineURL) {
+			errs.add("WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL: must be an absolute http(s) url, got %q", c.ExternalEngineURL)
+		}
+		for _, name := range []string{"WUNDERBASE_QUERY_ENGINE_PATH", "WUNDERBASE_QUERY_ENGINE_PORT"} {
+			if _, ok := c.sources[fieldByEnv(name)]; ok {
+				errs.add("%s: can't be combined with WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL, the external query engine isn't started by wunderbase", name)
+			}
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL: can't be combined with WUNDERBASE_DATABASES, which starts a query engine per database")
+		}
+		if c.EngineIdleSeconds > 0 {
+			errs.add("WUNDERBASE_ENGINE_IDLE_SECONDS: can't be combined with WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL, the external query engine isn't stopped by wunderbase")
+		}
+		if c.ReplicaMode != "" {
+			errs.add("WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL: can't be combined with WUNDERBASE_REPLICA_MODE, which restarts the query engine for every generation")
+		}
+		if c.TimeTravelSources != "" {
+			errs.add("WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL: can't be combined with WUNDERBASE_TIME_TRAVEL_SOURCES, which starts query engines from WUNDERBASE_QUERY_ENGINE_PATH")
+		}
+	}
+	if c.PublicURL != "" && !isAbsoluteURL(c.PublicURL) {
+		errs.add("WUNDERBASE_PUBLIC_URL: must be an absolute http(s) url, got %q", c.PublicURL)
+	}
+	if c.GraphiQLApiURL != "" && !isAbsoluteURL(c.GraphiQLApiURL) {
+		errs.add("WUNDERBASE_GRAPHIQL_API_URL: must be an absolute http(s) url, got %q", c.GraphiQLApiURL)
+	}
+	if !strings.HasPrefix(c.HealthEndpoint, "/") {
+		errs.add("WUNDERBASE_HEALTH_ENDPOINT: must start with /, got %q", c.HealthEndpoint)
+	}
+	if c.MetricsEndpoint != "" && !strings.HasPrefix(c.MetricsEndpoint, "/") {
+		errs.add("WUNDERBASE_METRICS_ENDPOINT: must start with / or be empty, got %q", c.MetricsEndpoint)
+	}
+	switch c.ReplicaMode {
+	case "":
+	case "read":
+		if c.ReplicaSource == "" {
+			errs.add("WUNDERBASE_REPLICA_SOURCE: required in replica mode")
+		}
+		if c.ReplicaRefreshSeconds <= 0 {
+			errs.add("WUNDERBASE_REPLICA_REFRESH_SECONDS: must be positive, got %d", c.ReplicaRefreshSeconds)
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_REPLICA_MODE: can't be combined with WUNDERBASE_DATABASES")
+		}
+	default:
+		errs.add("WUNDERBASE_REPLICA_MODE: must be read or empty, got %q", c.ReplicaMode)
+	}
+	if c.TimeTravelSources != "" {
+		if c.AdminToken == "" {
+			errs.add("WUNDERBASE_TIME_TRAVEL_SOURCES: requires WUNDERBASE_ADMIN_TOKEN, time-travel reads are admin requests")
+		}
+		if c.TimeTravelMaxEngines <= 0 {
+			errs.add("WUNDERBASE_TIME_TRAVEL_MAX_ENGINES: must be positive, got %d", c.TimeTravelMaxEngines)
+		}
+		if c.TimeTravelCacheMB <= 0 {
+			errs.add("WUNDERBASE_TIME_TRAVEL_CACHE_MB: must be positive, got %d", c.TimeTravelCacheMB)
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_TIME_TRAVEL_SOURCES: can't be combined with WUNDERBASE_DATABASES")
+		}
+	}
+	if c.RefuseWritesOnDrift {
+		if !c.SchemaDriftCheck {
+			errs.add("WUNDERBASE_REFUSE_WRITES_ON_DRIFT: requires WUNDERBASE_SCHEMA_DRIFT_CHECK")
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_REFUSE_WRITES_ON_DRIFT: can't be combined with WUNDERBASE_DATABASES")
+		}
+	}
+	if c.SchedulesFile != "" {
+		if entries, err := schedule.LoadFile(c.SchedulesFile); err != nil {
+			errs.add("WUNDERBASE_SCHEDULES_FILE: %v", err)
+		} else if _, err := schedule.New(entries); err != nil {
+			errs.add("WUNDERBASE_SCHEDULES_FILE: %v", err)
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_SCHEDULES_FILE: can't be combined with WUNDERBASE_DATABASES")
+		}
+	}
+	if c.BackupVerifyCron != "" {
+		if _, err := schedule.ParseCron(c.BackupVerifyCron); err != nil {
+			errs.add("WUNDERBASE_BACKUP_VERIFY_CRON: %v", err)
+		}
+		if c.BackupVerifySources == "" {
+			errs.add("WUNDERBASE_BACKUP_VERIFY_SOURCES: required with WUNDERBASE_BACKUP_VERIFY_CRON")
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_BACKUP_VERIFY_CRON: can't be combined with WUNDERBASE_DATABASES")
+		}
+	}
+	for _, name := range splitList(c.HealthRequired) {
+		if !knownHealthComponent(name) {
+			errs.add("WUNDERBASE_HEALTH_REQUIRED: unknown component %q, expected one of %s", name, strings.Join(healthComponents(), ", "))
+		}
+	}
+	for _, peer := range splitList(c.PeerURLs) {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("WUNDERBASE_PEER_URLS: must be http or https urls, got %q", peer)
+		}
+	}
+	if c.MetricsEndpoint == c.HealthEndpoint {
+		errs.add("WUNDERBASE_METRICS_ENDPOINT and WUNDERBASE_HEALTH_ENDPOINT: must differ, both are %q", c.HealthEndpoint)
+	}
+	if (c.EnablePprof || c.ForcePprof) && c.AdminToken == "" {
+		errs.add("WUNDERBASE_ENABLE_PPROF: requires WUNDERBASE_ADMIN_TOKEN, pprof is only served on the admin endpoints")
+	}
+	if c.StatsdAddr != "" {
+		if _, _, err := net.SplitHostPort(c.StatsdAddr); err != nil {
+			errs.add("WUNDERBASE_STATSD_ADDR: %v", err)
+		}
+	}
+	if c.ErrorReportURL != "" {
+		if u, err := url.Parse(c.ErrorReportURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add("WUNDERBASE_ERROR_REPORT_URL: must be an absolute http(s) url")
+		}
+	}
+	if _, err := parseCIDRs(c.TrustedProxies); err != nil {
+		errs.add("WUNDERBASE_TRUSTED_PROXIES: %v", err)
+	}
+	if c.TrustedAuthHeader != "" && strings.TrimSpace(c.TrustedProxies) == "" {
+		errs.add("WUNDERBASE_TRUSTED_AUTH_HEADER: requires WUNDERBASE_TRUSTED_PROXIES, otherwise anyone can set the header")
+	}
+	if c.TrustedScopesHeader != "" && c.TrustedAuthHeader == "" {
+		errs.add("WUNDERBASE_TRUSTED_SCOPES_HEADER: requires WUNDERBASE_TRUSTED_AUTH_HEADER, the scopes are only believed from the trusted proxies")
+	}
+	if c.ModelGrants && c.TrustedScopesHeader == "" {
+		errs.add("WUNDERBASE_MODEL_GRANTS: requires WUNDERBASE_TRUSTED_SCOPES_HEADER, the grants are scopes of the caller")
+	}
+	if _, err := loadAuthRules(c.AuthRulesFile); err != nil {
+		errs.add("WUNDERBASE_AUTH_RULES_FILE: %v", err)
+	}
+	if _, err := parseRowFilters(c.RowFilters); err != nil {
+		errs.add("WUNDERBASE_ROW_FILTERS: %v", err)
+	}
+	if c.RowFilters != "" && c.TrustedAuthHeader == "" {
+		errs.add("WUNDERBASE_ROW_FILTERS: requires WUNDERBASE_TRUSTED_AUTH_HEADER to know the caller")
+	}
+	if c.RowFilters != "" && c.EnableCDC {
+		errs.add("WUNDERBASE_ROW_FILTERS: the change feed isn't filtered, disable WUNDERBASE_ENABLE_CDC")
+	}
+	for _, field := range splitList(c.HiddenFields) {
+		if model, name, ok := strings.Cut(field, "."); !ok || model == "" || name == "" || strings.Contains(name, ".") {
+			errs.add("WUNDERBASE_HIDDEN_FIELDS: entries must be Model.field, got %q", field)
+		}
+	}
+	if (c.HiddenModels != "" || c.HiddenFields != "") && c.EnableCDC {
+		errs.add("WUNDERBASE_HIDDEN_MODELS and WUNDERBASE_HIDDEN_FIELDS: the change feed isn't pruned, disable WUNDERBASE_ENABLE_CDC")
+	}
+	if c.DatabaseKey != "" && c.EnableCDC {
+		errs.add("WUNDERBASE_DATABASE_KEY: the change feed reads the database with the sqlite3 CLI, disable WUNDERBASE_ENABLE_CDC")
+	}
+	if c.DatabaseKey != "" && c.Databases != "" {
+		errs.add("WUNDERBASE_DATABASE_KEY: not supported with WUNDERBASE_DATABASES")
+	}
+	if c.InitSQLFile != "" {
+		if _, err := os.Stat(c.InitSQLFile); err != nil {
+			errs.add("WUNDERBASE_INIT_SQL_FILE: %v", err)
+		}
+		if c.DatabaseKey != "" {
+			errs.add("WUNDERBASE_INIT_SQL_FILE: the dump is imported with the sqlite3 CLI, it can't create a database encrypted with WUNDERBASE_DATABASE_KEY")
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_INIT_SQL_FILE: can't be combined with WUNDERBASE_DATABASES")
+		}
+	}
+	if models := splitList(c.SoftDeleteModels); len(models) > 0 {
+		for _, name := range append(models, c.SoftDeleteField) {
+			if !graphQLName.MatchString(name) {
+				errs.add("WUNDERBASE_SOFT_DELETE_MODELS and WUNDERBASE_SOFT_DELETE_FIELD: %q is not a model or field name", name)
+			}
+		}
+	}
+	if c.LogMaxSizeMB < 0 {
+		errs.add("WUNDERBASE_LOG_MAX_SIZE_MB: must not be negative, got %d", c.LogMaxSizeMB)
+	}
+	if c.LogMaxBackups < 0 {
+		errs.add("WUNDERBASE_LOG_MAX_BACKUPS: must not be negative, got %d", c.LogMaxBackups)
+	}
+	for _, list := range []struct{ name, value string }{
+		{"WUNDERBASE_LOG_EXCLUDE_PATHS", c.LogExcludePaths},
+		{"WUNDERBASE_METRICS_EXCLUDE_PATHS", c.MetricsExcludePaths},
+	} {
+		for _, path := range splitList(list.value) {
+			if path != "auto" && path != "none" && !strings.HasPrefix(path, "/") {
+				errs.add("%s: paths must start with /, got %q", list.name, path)
+			}
+		}
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		errs.add("WUNDERBASE_LOG_SAMPLE_RATE: must be between 0 and 1, got %g", c.LogSampleRate)
+	}
+	if c.SlowRequestMs < 0 {
+		errs.add("WUNDERBASE_SLOW_REQUEST_MS: must not be negative, got %d", c.SlowRequestMs)
+	}
+	if c.SchemaViewer != "auto" && c.SchemaViewer != "true" && c.SchemaViewer != "false" {
+		errs.add("WUNDERBASE_SCHEMA_VIEWER: must be auto, true or false, got %q", c.SchemaViewer)
+	}
+	if c.CaptureMaxKB < 1 {
+		errs.add("WUNDERBASE_CAPTURE_MAX_KB: must be at least 1, got %d", c.CaptureMaxKB)
+	}
+	if c.IndexAdvice && (!c.Debug || c.SlowRequestMs == 0) {
+		errs.add("WUNDERBASE_INDEX_ADVICE: needs the engine query logs of WUNDERBASE_DEBUG and WUNDERBASE_SLOW_REQUEST_MS above 0")
+	}
+	if c.SafeMutations != "auto" && c.SafeMutations != "true" && c.SafeMutations != "false" {
+		errs.add("WUNDERBASE_SAFE_MUTATIONS: must be auto, true or false, got %q", c.SafeMutations)
+	}
+	if c.DMMF != "auto" && c.DMMF != "true" && c.DMMF != "false" {
+		errs.add("WUNDERBASE_DMMF: must be auto, true or false, got %q", c.DMMF)
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" && c.LogFormat != "pretty" {
+		errs.add("WUNDERBASE_LOG_FORMAT: must be text, json or pretty, got %q", c.LogFormat)
+	}
+	if c.ManagementListenAddr != "" {
+		first, _ := strconv.Atoi(c.QueryEnginePort)
+		if _, port, err := net.SplitHostPort(c.ManagementListenAddr); err != nil {
+			errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: %v", err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: invalid port %q", port)
+		} else if n != 0 && c.ManagementListenAddr == c.ListenAddr {
+			errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: must differ from WUNDERBASE_LISTEN_ADDR, got %s for both", c.ListenAddr)
+		} else if _, ok := engineListenConflict(c.ManagementListenAddr, first, 1); ok {
+			errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: %s takes port %d of WUNDERBASE_QUERY_ENGINE_PORT, the query engine listens on it", c.ManagementListenAddr, first)
+		}
+		if c.Databases != "" {
+			errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: the internal endpoint serves a single database, it can't be combined with WUNDERBASE_DATABASES")
+		}
+		c.validateInternal(&errs)
+	} else if len(c.internal) > 0 {
+		errs.add("WUNDERBASE_MANAGEMENT_LISTEN_ADDR: the internal endpoint has settings but no address to listen on")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// databaseSpec is an entry of WUNDERBASE_DATABASES.
+type databaseSpec struct {
+	Name         string
+	SchemaPath   string
+	DatabasePath string
+}
+
+// graphQLName matches the names of models and fields.
+var graphQLName = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+var databaseName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// parseDatabases parses a comma separated list of name=schema:sqlite
+// entries.
+func parseDatabases(list string) ([]databaseSpec, error) {
+	var databases []databaseSpec
+	seen := map[string]bool{}
+	for _, entry := range splitList(list) {
+		name, paths, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected name=schema:sqlite", entry)
+		}
+		schema, database, ok := strings.Cut(paths, ":")
+		if !ok || schema == "" || database == "" {
+			return nil, fmt.Errorf("%q: expected name=schema:sqlite", entry)
+		}
+		if !databaseName.MatchString(name) {
+			return nil, fmt.Errorf("%q: names may only contain lower case letters, digits, - and _", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%q: duplicate name", name)
+		}
+		seen[name] = true
+		databases = append(databases, databaseSpec{Name: name, SchemaPath: schema, DatabasePath: database})
+	}
+	return databases, nil
+}
+
+// parseOperationLimits parses operation=reads/writes entries, either side
+// may be empty to keep the global limit, and operation=exempt.
+func parseOperationLimits(list string) (map[string]api.OperationLimit, error) {
+	limits := map[string]api.OperationLimit{}
+	for _, entry := range splitList(list) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q: expected operation=reads/writes or operation=exempt", entry)
+		}
+		if _, ok := limits[name]; ok {
+			return nil, fmt.Errorf("%q: duplicate operation", name)
+		}
+		if value == "exempt" {
+			limits[name] = api.OperationLimit{Exempt: true}
+			continue
+		}
+		reads, writes, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("%q: expected operation=reads/writes or operation=exempt", entry)
+		}
+		var limit api.OperationLimit
+		for _, side := range []struct {
+			value string
+			limit *int
+		}{{reads, &limit.ReadLimitSeconds}, {writes, &limit.WriteLimitSeconds}} {
+			if side.value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(side.value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("%q: limits must be positive integers", entry)
+			}
+			*side.limit = n
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// parseThresholds parses comma separated percentages into ascending
+// fractions.
+func parseThresholds(list string) ([]float64, error) {
+	var thresholds []float64
+	for _, entry := range splitList(list) {
+		percent, err := strconv.ParseFloat(entry, 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return nil, fmt.Errorf("%q: thresholds must be percentages above 0 and at most 100", entry)
+		}
+		thresholds = append(thresholds, percent/100)
+	}
+	sort.Float64s(thresholds)
+	for i := 1; i < len(thresholds); i++ {
+		if thresholds[i] == thresholds[i-1] {
+			return nil, fmt.Errorf("%v: duplicate threshold", thresholds[i]*100)
+		}
+	}
+	return thresholds, nil
+}
+
+// parseSLOs parses operation=pNN:threshold[:window] entries, the window
+// being an hour if left out.
+func parseSLOs(list string) ([]api.SLO, error) {
+	var slos []api.SLO
+	seen := map[string]bool{}
+	for _, entry := range splitList(list) {
+		name, value, ok := strings.Cut(entry, "=")
+		parts := strings.Split(value, ":")
+		if !ok || name == "" || len(parts) < 2 || len(parts) > 3 || !strings.HasPrefix(parts[0], "p") {
+			return nil, fmt.Errorf("%q: expected operation=pNN:threshold[:window], like Checkout=p95:100ms:1h", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%q: duplicate operation", name)
+		}
+		seen[name] = true
+		percentile, err := strconv.ParseFloat(parts[0][1:], 64)
+		if err != nil || percentile <= 0 || percentile >= 100 {
+			return nil, fmt.Errorf("%q: the percentile must be above 0 and below 100", entry)
+		}
+		threshold, err := time.ParseDuration(parts[1])
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("%q: the threshold must be a positive duration like 100ms", entry)
+		}
+		window := time.Hour
+		if len(parts) == 3 {
+			if window, err = time.ParseDuration(parts[2]); err != nil || window < time.Minute {
+				return nil, fmt.Errorf("%q: the window must be a duration of at least 1m", entry)
+			}
+		}
+		slos = append(slos, api.SLO{Operation: name, Percentile: percentile / 100, Threshold: threshold, Window: window})
+	}
+	return slos, nil
+}
+
+// loadAuthRules reads the auth rules from a YAML file, nil if path is
+// empty. Unknown keys are rejected to catch typos.
+func loadAuthRules(path string) (*api.AuthRules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	rules := &api.AuthRules{}
+	if err := decoder.Decode(rules); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := rules.Validate(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// parseRowFilters parses a JSON object of where filters by model.
+func parseRowFilters(filters string) (map[string]json.RawMessage, error) {
+	if strings.TrimSpace(filters) == "" {
+		return nil, nil
+	}
+	var parsed map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(filters), &parsed); err != nil {
+		return nil, fmt.Errorf("must be a JSON object of filters by model: %w", err)
+	}
+	for model, filter := range parsed {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(filter, &fields); err != nil || fields == nil {
+			return nil, fmt.Errorf("%s: the filter must be a JSON object", model)
+		}
+	}
+	return parsed, nil
+}
+
+// parseFileContentTypes parses a list of Model.field=content/type.
+func parseFileContentTypes(list string) (map[string]string, error) {
+	types := map[string]string{}
+	for _, entry := range splitList(list) {
+		field, contentType, ok := strings.Cut(entry, "=")
+		model, name, isField := strings.Cut(strings.TrimSpace(field), ".")
+		if !ok || !isField || model == "" || name == "" {
+			return nil, fmt.Errorf("%q: entries must be Model.field=content/type", entry)
+		}
+		contentType = strings.TrimSpace(contentType)
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		types[strings.TrimSpace(field)] = contentType
+	}
+	return types, nil
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// healthComponents are the components of the verbose health endpoint: the
+// handler's own and the ones serve adds.
+func healthComponents() []string {
+	return append(append([]string(nil), api.HealthComponents...), "migration", "replica", "schema_drift")
+}
+
+func knownHealthComponent(name string) bool {
+	for _, known := range healthComponents() {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma separated list of CIDRs. Bare IPs are taken as
+// single hosts.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// pprofEnabled reports whether the diagnostics endpoints are served. They
+// stay off in production unless explicitly forced.
+// databasePath returns the SQLite file of the datasource of the schema,
+// read once for all the features of a command needing it. It fails with a
+// *migrate.DatasourceError if the datasource isn't a sqlite file.
+func (c *config) databasePath() (string, error) {
+	if c.datasource == nil {
+		ds, err := migrate.ReadDatasource(c.PrismaSchemaFilePath)
+		if err != nil {
+			return "", err
+		}
+		c.datasource = &ds
+	}
+	return c.datasource.File, nil
+}
+
+func (c *config) pprofEnabled() bool {
+	if c.Production {
+		return c.ForcePprof
+	}
+	return c.EnablePprof || c.ForcePprof
+}
+
+// schemaViewerEnabled reports whether the schema viewer is served. auto
+// keeps it out of production, like the playground.
+func (c *config) schemaViewerEnabled() bool {
+	if c.SchemaViewer == "auto" {
+		return !c.Production
+	}
+	return c.SchemaViewer == "true"
+}
+
+// safeMutationsEnabled reports whether mutations changing every row are
+// refused. auto refuses them in production.
+func (c *config) safeMutationsEnabled() bool {
+	if c.SafeMutations == "auto" {
+		return c.Production
+	}
+	return c.SafeMutations == "true"
+}
+
+// dmmfEnabled reports whether the DMMF is served on /admin/dmmf. auto keeps
+// it out of production, it describes the fields hidden from GraphQL too.
+func (c *config) dmmfEnabled() bool {
+	if c.DMMF == "auto" {
+		return !c.Production
+	}
+	return c.DMMF == "true"
+}
+
+// excludePaths expands the auto entry of an exclusion list to the health
+// and metrics endpoints. none excludes nothing.
+func (c *config) excludePaths(list string) []string {
+	var paths []string
+	for _, path := range splitList(list) {
+		switch path {
+		case "none":
+		case "auto":
+			paths = append(paths, c.HealthEndpoint)
+			if c.MetricsEndpoint != "" {
+				paths = append(paths, c.MetricsEndpoint)
+			}
+		default:
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// engineListenConflict reports whether listening on addr takes a port of
+// the query engines, which listen on the loopback interface on the ports
+// first to first+count-1, and which engine's. Port 0 is a free port. A
+// host listening on all interfaces or resolving to a loopback address
+// overlaps with the engines.
+func engineListenConflict(addr string, first, count int) (int, bool) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, false
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port == 0 || first == 0 || port < first || port >= first+count {
+		return 0, false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	switch {
+	case host == "" || host == "localhost":
+		return port - first, true
+	case ips[0] == nil:
+		if ips, err = net.LookupIP(host); err != nil {
+			return 0, false
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsUnspecified() || ip.IsLoopback() {
+			return port - first, true
+		}
+	}
+	return 0, false
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// reloadDiff returns the flag names of the settings that differ between
+// current and next, split into those a reload applies and those that only
+// take effect after a restart.
+func reloadDiff(current, next *config) (reload, restart []string) {
+	a := reflect.ValueOf(current).Elem()
+	b := reflect.ValueOf(next).Elem()
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, ok := t.Field(i).Tag.Lookup("flag")
+		if !ok || reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		if t.Field(i).Tag.Get("reload") == "true" {
+			reload = append(reload, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return reload, restart
+}
+
+// applyReload copies the reload-safe settings from next into current.
+func applyReload(current, next *config) {
+	a := reflect.ValueOf(current).Elem()
+	b := reflect.ValueOf(next).Elem()
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("reload") == "true" {
+			a.Field(i).Set(b.Field(i))
+			current.setSource(t.Field(i).Name, next.source(t.Field(i).Name))
+		}
+	}
+}
+
+// loadConfigFile applies the settings from the config file to every field
+// that was neither set through its env var nor through a flag. Keys are the
+// flag names, unknown keys are rejected to catch typos.
+func loadConfigFile(fs *flag.FlagSet, config *config) error {
+	data, err := ioutil.ReadFile(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	// JSON is valid YAML, so one decoder covers both formats
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		if name, ok := t.Field(i).Tag.Lookup("flag"); ok && name != "config" {
+			fields[name] = i
+			if t.Field(i).Tag.Get("secret") == "true" {
+				fields[name+"-file"] = i
+			}
+		}
+	}
+
+	var unknown []string
+	for key, value := range settings {
+		if key == "internal" {
+			internalUnknown, err := loadInternalSettings(value, config)
+			if err != nil {
+				return err
+			}
+			unknown = append(unknown, internalUnknown...)
+			continue
+		}
+		i, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+		flagName := t.Field(i).Tag.Get("flag")
+		if explicit[flagName] || explicit[flagName+"-file"] {
+			continue
+		}
+		source := config.source(t.Field(i).Name)
+		if strings.HasPrefix(source, "env ") || strings.HasPrefix(source, "file from env ") {
+			continue
+		}
+		if key != flagName {
+			if _, ok := settings[flagName]; ok {
+				return fmt.Errorf("%s and %s are both set, use only one", flagName, key)
+			}
+			if err := (secretFileValue{fieldValue{v.Field(i)}}).Set(fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			config.setSource(t.Field(i).Name, "file from "+key)
+			continue
+		}
+		if err := (fieldValue{v.Field(i)}).Set(fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		config.setSource(t.Field(i).Name, "file")
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// printConfig writes the effective configuration as YAML, which can be used
+// as a config file again. Secrets are redacted and every value is annotated
+// with where it came from.
+func printConfig(w io.Writer, config *config) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup("flag")
+		if !ok || name == "config" {
+			continue
+		}
+		value := &yaml.Node{}
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value.SetString("<redacted>")
+		} else if err := value.Encode(v.Field(i).Interface()); err != nil {
+			return err
+		}
+		value.LineComment = "from " + config.source(field.Name)
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, value)
+	}
+	if internal, err := printInternal(config); err != nil {
+		return err
+	} else if internal != nil {
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "internal"}, internal)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// secrets returns the values of the secret settings, and the database key
+// as written into datasource urls.
+func (c *config) secrets() []string {
+	var secrets []string
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			secrets = append(secrets, fmt.Sprint(v.Field(i).Interface()))
+		}
+	}
+	if c.DatabaseKey != "" {
+		secrets = append(secrets, url.QueryEscape(c.DatabaseKey))
+	}
+	return secrets
+}
+
+// fieldValue adapts a config struct field to flag.Value.
+type fieldValue struct {
+	v reflect.Value
+}
+
+func (f fieldValue) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+func (f fieldValue) Set(s string) error {
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(n))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetFloat(x)
+	default:
+		return fmt.Errorf("unsupported flag type %s", f.v.Kind())
+	}
+	return nil
+}
+
+func (f fieldValue) IsBoolFlag() bool {
+	return f.v.IsValid() && f.v.Kind() == reflect.Bool
+}
+
+// secretFileValue sets a secret field from the contents of a file.
+type secretFileValue struct {
+	field fieldValue
+}
+
+func (f secretFileValue) String() string {
+	return ""
+}
+
+func (f secretFileValue) Set(path string) error {
+	value, err := readSecretFile(path)
+	if err != nil {
+		return err
+	}
+	return f.field.Set(value)
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlagPrecedence(t *testing.T) {
+	t.Setenv("WUNDERBASE_LISTEN_ADDR", "127.0.0.1:5000")
+	t.Setenv("WUNDERBASE_SLEEP_AFTER_SECONDS", "30")
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+
+	fs := newFlagSet("serve", config)
+	require.NoError(t, fs.Parse([]string{"--sleep-after", "60", "--production", "--cdc"}))
+
+	assert.Equal(t, 60, config.SleepAfterSeconds, "flag overrides env")
+	assert.Equal(t, "127.0.0.1:5000", config.ListenAddr, "env overrides default")
+	assert.Equal(t, "./schema.prisma", config.PrismaSchemaFilePath, "default")
+	assert.True(t, config.Production)
+	assert.True(t, config.EnableCDC, "--cdc like --rest and --count")
+}
+
+func TestConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "wunderbase.yaml")
+	err := os.WriteFile(file, []byte("listen-addr: 127.0.0.1:6000\nsleep-after: 30\nread-limit: 50\nproduction: true\n"), 0644)
+	require.NoError(t, err)
+	t.Setenv("WUNDERBASE_CONFIG", file)
+	t.Setenv("WUNDERBASE_SLEEP_AFTER_SECONDS", "45")
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	fs := newFlagSet("serve", config)
+	require.NoError(t, parseFlags(fs, config, []string{"--read-limit", "70"}))
+
+	assert.Equal(t, "127.0.0.1:6000", config.ListenAddr, "file overrides default")
+	assert.Equal(t, 45, config.SleepAfterSeconds, "env overrides file")
+	assert.Equal(t, 70, config.ReadLimitSeconds, "flag overrides file")
+	assert.True(t, config.Production)
+}
+
+func TestConfigFileUnknownKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "wunderbase.json")
+	err := os.WriteFile(file, []byte(`{"listen-adr": "127.0.0.1:6000", "sleep-after": 30}`), 0644)
+	require.NoError(t, err)
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	fs := newFlagSet("serve", config)
+	err = parseFlags(fs, config, []string{"--config", file})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown keys: listen-adr")
+}
+
+func TestInternalProfile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "wunderbase.yaml")
+	err := os.WriteFile(file, []byte("introspection: false\nraw-queries: false\nread-limit: 50\ninternal:\n  introspection: true\n  raw-queries: true\n  read-limit: 1000\n"), 0644)
+	require.NoError(t, err)
+	t.Setenv("WUNDERBASE_CONFIG", file)
+	t.Setenv("WUNDERBASE_MANAGEMENT_LISTEN_ADDR", "127.0.0.1:6001")
+	t.Setenv("WUNDERBASE_INTERNAL_READ_LIMIT_SECONDS", "2000")
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	require.NoError(t, parseFlags(newFlagSet("serve", config), config, nil))
+	assert.False(t, config.Introspection)
+	assert.Equal(t, 50, config.ReadLimitSeconds, "the flat fields are the public endpoint's")
+
+	internal, err := config.internalProfile()
+	require.NoError(t, err)
+	assert.True(t, internal.Introspection)
+	assert.True(t, internal.RawQueries)
+	assert.Equal(t, 2000, internal.ReadLimitSeconds, "env overrides file")
+	assert.Equal(t, config.WriteLimitSeconds, internal.WriteLimitSeconds, "unset settings are the public ones")
+	assert.Equal(t, "env WUNDERBASE_INTERNAL_READ_LIMIT_SECONDS", internal.source("ReadLimitSeconds"))
+
+	var buf bytes.Buffer
+	require.NoError(t, printConfig(&buf, config))
+	assert.Contains(t, buf.String(), "internal:\n  read-limit: 2000")
+
+	config.internal["ReadLimitSeconds"] = profileSetting{"0", "env WUNDERBASE_INTERNAL_READ_LIMIT_SECONDS"}
+	assert.ErrorContains(t, config.Validate(), "internal endpoint: WUNDERBASE_READ_LIMIT_SECONDS")
+
+	t.Setenv("WUNDERBASE_INTERNAL_PRODUCTION", "true")
+	assert.ErrorContains(t, parseEnv(config), "WUNDERBASE_INTERNAL_PRODUCTION: not a setting of the internal endpoint")
+}
+
+func TestConfigTemplates(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	t.Setenv("FLY_APP_NAME", "shop")
+	t.Setenv("WUNDERBASE_STATSD_PREFIX", `{{.Env "FLY_APP_NAME"}}.{{.Hostname}}`)
+	t.Setenv("WUNDERBASE_LISTEN_ADDR", "{{.Hostname}}:4466")
+
+	expanded := &config{}
+	require.NoError(t, parseEnv(expanded))
+	fs := newFlagSet("serve", expanded)
+	require.NoError(t, loadFlags(fs, expanded, []string{"--branches-dir", "branches/{{.Timestamp}}"}))
+	assert.Equal(t, "shop."+hostname, expanded.StatsdPrefix)
+	assert.Equal(t, "branches/"+processStart.UTC().Format("20060102T150405Z"), expanded.BranchesDir)
+	assert.Equal(t, "{{.Hostname}}:4466", expanded.ListenAddr, "fields opt in")
+
+	var buf bytes.Buffer
+	require.NoError(t, printConfig(&buf, expanded))
+	assert.Contains(t, buf.String(), "statsd-prefix: shop."+hostname)
+
+	t.Setenv("WUNDERBASE_STATSD_PREFIX", `{{.Env "MISSING_APP_NAME"}}`)
+	broken := &config{}
+	require.NoError(t, parseEnv(broken))
+	err = loadFlags(newFlagSet("serve", broken), broken, nil)
+	assert.ErrorContains(t, err, "WUNDERBASE_STATSD_PREFIX")
+	assert.ErrorContains(t, err, "MISSING_APP_NAME is not set")
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	t.Setenv("WUNDERBASE_BACKUP_ENCRYPTION_KEY", "c2VjcmV0")
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+
+	var buf bytes.Buffer
+	require.NoError(t, printConfig(&buf, config))
+	assert.Contains(t, buf.String(), "backup-encryption-key: <redacted>")
+	assert.NotContains(t, buf.String(), "c2VjcmV0")
+	assert.Contains(t, buf.String(), "listen-addr: 0.0.0.0:4466")
+	assert.Contains(t, buf.String(), "engine-connect-retries: 3")
+	assert.Contains(t, buf.String(), "engine-connect-backoff: 50")
+}
+
+func TestValidate(t *testing.T) {
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	require.NoError(t, config.Validate())
+
+	config.ReadLimitSeconds = 0
+	config.ListenAddr = "localhost"
+	config.QueryEnginePort = "70000"
+	config.GraphiQLApiURL = "/graphql"
+	config.MetricsEndpoint = config.HealthEndpoint
+	config.LogFormat = "xml"
+	config.LogSampleRate = 1.5
+	config.EngineConnectRetries = 101
+	config.EngineConnectBackoffMs = 0
+	config.RowFilters = `{"Order": {"userId": {"equals": "$claims.sub"}}}`
+	config.DefaultNestedTake = -1
+	config.WarmupRuns = -1
+	config.SleepResetOn = "reads"
+	config.MaxUploadFileKB = 100
+	config.MaxUploadTotalKB = 50
+	config.FileContentTypes = "Attachment=image/png"
+	config.TrustedScopesHeader = "X-Auth-Request-Groups"
+	config.EngineIdleSeconds = config.SleepAfterSeconds
+	config.MigrationWaitMs = -1
+	config.RequestTimeoutMs = 0
+	config.DMMF = "always"
+	config.SafeMutations = "yes"
+	config.IndexAdvice, config.SlowRequestMs = true, 0
+	config.ManagementListenAddr = "127.0.0.1"
+	config.CaptureMaxKB = 0
+	config.HiddenFields = "User.password,secret"
+	config.WriteQueue = -1
+	config.HedgePercentile = 100
+	config.CoalesceMaxWaiters = 0
+	config.SleepPreStopMs, config.SleepStopHeader, config.SleepExitCode = -1, "fly replay", 256
+	config.MetricsExcludePaths = "auto,health"
+	config.DatabaseKey, config.EnableCDC = "secret", true
+	config.PeerURLs = "http://10.0.0.2:4466/health,10.0.0.3:4466"
+	config.SoftDeleteModels = "User,Order Item"
+	config.TimeTravelSources, config.TimeTravelMaxEngines = "./backups", 0
+	config.ExternalEngineURL = "http://engine:4467/"
+	config.StaticDir, config.StaticPathPrefix = "./config_test.go", "app/../"
+	config.CountCacheMs = -1
+	config.RefuseWritesOnDrift, config.SchemaDriftCheck = true, false
+	config.SLOs, config.SLOBurnRate = "Checkout=p95", 0
+	config.InitSQLFile = "./dump.sql"
+	config.EngineSlots, config.PrioritySlots, config.PriorityScopes = 4, 4, "interactive"
+	config.JournalFsync, config.JournalOnFull = "sometimes", "block"
+	config.BackupVerifyCron = "@often"
+	config.setSource("QueryEnginePath", "flag --query-engine")
+
+	err := config.Validate()
+	require.Error(t, err)
+	for _, name := range []string{
+		"READ_LIMIT_SECONDS",
+		"LISTEN_ADDR",
+		"QUERY_ENGINE_PORT",
+		"GRAPHIQL_API_URL",
+		"WUNDERBASE_METRICS_ENDPOINT and WUNDERBASE_HEALTH_ENDPOINT",
+		"LOG_FORMAT",
+		"LOG_SAMPLE_RATE",
+		"ENGINE_CONNECT_RETRIES",
+		"ENGINE_CONNECT_BACKOFF_MS",
+		"ROW_FILTERS: requires WUNDERBASE_TRUSTED_AUTH_HEADER",
+		"DEFAULT_NESTED_TAKE",
+		"WARMUP_RUNS",
+		"SLEEP_RESET_ON",
+		"MAX_UPLOAD_TOTAL_KB",
+		"FILE_CONTENT_TYPES",
+		"TRUSTED_SCOPES_HEADER",
+		"ENGINE_IDLE_SECONDS",
+		"MIGRATION_WAIT_MS",
+		"REQUEST_TIMEOUT_MS",
+		"WUNDERBASE_DMMF:",
+		"SAFE_MUTATIONS",
+		"INDEX_ADVICE",
+		"MANAGEMENT_LISTEN_ADDR",
+		"CAPTURE_MAX_KB",
+		"HIDDEN_FIELDS: entries must be Model.field, got \"secret\"",
+		"WRITE_QUEUE:",
+		"HEDGE_PERCENTILE",
+		"COALESCE_MAX_WAITERS",
+		"SLEEP_PRE_STOP_MS",
+		"SLEEP_STOP_HEADER: must be a header name",
+		"SLEEP_EXIT_CODE",
+		"METRICS_EXCLUDE_PATHS: paths must start with /, got \"health\"",
+		"DATABASE_KEY: the change feed",
+		"PEER_URLS: must be http or https urls, got \"10.0.0.3:4466\"",
+		"SOFT_DELETE_FIELD: \"Order Item\" is not a model or field name",
+		"TIME_TRAVEL_SOURCES: requires WUNDERBASE_ADMIN_TOKEN",
+		"TIME_TRAVEL_MAX_ENGINES",
+		"QUERY_ENGINE_PATH: can't be combined with WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL",
+		"EXTERNAL_QUERY_ENGINE_URL: can't be combined with WUNDERBASE_TIME_TRAVEL_SOURCES",
+		"STATIC_DIR: ./config_test.go is not a directory",
+		"STATIC_PATH_PREFIX",
+		"COUNT_CACHE_MS",
+		"REFUSE_WRITES_ON_DRIFT: requires WUNDERBASE_SCHEMA_DRIFT_CHECK",
+		"WUNDERBASE_SLOS: \"Checkout=p95\"",
+		"SLO_BURN_RATE",
+		"INIT_SQL_FILE: stat ./dump.sql",
+		"INIT_SQL_FILE: the dump is imported with the sqlite3 CLI",
+		"PRIORITY_SLOTS: must be less than WUNDERBASE_ENGINE_SLOTS (4)",
+		"JOURNAL_FSYNC: must be always, interval or never, got \"sometimes\"",
+		"JOURNAL_ON_FULL: must be wait or drop",
+		"BACKUP_VERIFY_CRON: cron \"@often\"",
+		"BACKUP_VERIFY_SOURCES: required",
+	} {
+		assert.Contains(t, err.Error(), name)
+	}
+	assert.NotContains(t, err.Error(), "WRITE_LIMIT_SECONDS")
+}
+
+func TestLoadAuthRules(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	rules, err := loadAuthRules(write(`
+default: deny
+rules:
+  deleteUser:
+    scopes: [admin]
+  Order.create:
+    authenticated: true
+  Order.read: {}
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "deny", rules.Default)
+	assert.Equal(t, []string{"admin"}, rules.Rules["deleteUser"].Scopes)
+	assert.True(t, rules.Rules["Order.create"].Authenticated)
+	assert.Contains(t, rules.Rules, "Order.read")
+
+	for content, message := range map[string]string{
+		"default: block":                        "default must be allow or deny",
+		"rules:\n  Order.write: {}":             `rule "Order.write"`,
+		"rules:\n  deleteUser:\n    scope: [a]": "field scope not found",
+	} {
+		_, err := loadAuthRules(write(content))
+		require.Error(t, err, content)
+		assert.Contains(t, err.Error(), message)
+	}
+	rules, err = loadAuthRules("")
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+}
+
+func TestPrefixedEnv(t *testing.T) {
+	t.Setenv("WUNDERBASE_DEBUG", "false")
+	t.Setenv("DEBUG", "true")
+	t.Setenv("PRODUCTION", "true")
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	fs := newFlagSet("serve", config)
+	require.NoError(t, loadFlags(fs, config, []string{"--sleep-after", "20"}))
+
+	assert.False(t, config.Debug, "prefixed form wins")
+	assert.True(t, config.Production, "bare form still works")
+	assert.Equal(t, []string{"PRODUCTION"}, config.deprecated)
+
+	var buf bytes.Buffer
+	require.NoError(t, printConfig(&buf, config))
+	assert.Contains(t, buf.String(), "debug: false # from env WUNDERBASE_DEBUG")
+	assert.Contains(t, buf.String(), "production: true # from env PRODUCTION (deprecated)")
+	assert.Contains(t, buf.String(), "sleep-after: 20 # from flag --sleep-after")
+	assert.Contains(t, buf.String(), "listen-addr: 0.0.0.0:4466 # from default")
+}
+
+func TestSecretFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(file, []byte("c2VjcmV0\n"), 0600))
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_BACKUP_ENCRYPTION_KEY_FILE", file)
+		config := &config{}
+		require.NoError(t, parseEnv(config))
+		assert.Equal(t, "c2VjcmV0", config.BackupEncryptionKey)
+	})
+	t.Run("flag", func(t *testing.T) {
+		config := &config{}
+		require.NoError(t, parseEnv(config))
+		fs := newFlagSet("backup", config)
+		require.NoError(t, loadFlags(fs, config, []string{"--backup-encryption-key-file", file}))
+		assert.Equal(t, "c2VjcmV0", config.BackupEncryptionKey)
+	})
+	t.Run("both set", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_BACKUP_ENCRYPTION_KEY_FILE", file)
+		t.Setenv("WUNDERBASE_BACKUP_ENCRYPTION_KEY", "other")
+		err := parseEnv(&config{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "are both set")
+		assert.NotContains(t, err.Error(), "other")
+	})
+	t.Run("unreadable", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_BACKUP_ENCRYPTION_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+		err := parseEnv(&config{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "read secret file")
+	})
+}
+
+func TestReloadDiff(t *testing.T) {
+	current := &config{}
+	require.NoError(t, parseEnv(current))
+	next := *current
+	next.ReadLimitSeconds = 5
+	next.Debug = !current.Debug
+	next.ListenAddr = "127.0.0.1:1234"
+
+	reload, restart := reloadDiff(current, &next)
+	assert.Equal(t, []string{"read-limit", "debug"}, reload)
+	assert.Equal(t, []string{"listen-addr"}, restart)
+
+	applyReload(current, &next)
+	assert.Equal(t, 5, current.ReadLimitSeconds)
+	assert.Equal(t, next.Debug, current.Debug)
+	assert.Equal(t, "0.0.0.0:4466", current.ListenAddr, "restart-only settings are not applied")
+}
+
+func TestTrustedAuthRequiresProxies(t *testing.T) {
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	config.TrustedAuthHeader = "X-Auth-Request-Email"
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "requires WUNDERBASE_TRUSTED_PROXIES")
+
+	config.TrustedProxies = "10.0.0.0/8, 192.168.1.1"
+	require.NoError(t, config.Validate())
+
+	config.TrustedProxies = "10.0.0.0/33"
+	require.Error(t, config.Validate())
+}
+
+func TestParseDatabases(t *testing.T) {
+	databases, err := parseDatabases("acme=schema.prisma:data/acme.sqlite, globex=schema.prisma:data/globex.sqlite")
+	require.NoError(t, err)
+	assert.Equal(t, []databaseSpec{
+		{Name: "acme", SchemaPath: "schema.prisma", DatabasePath: "data/acme.sqlite"},
+		{Name: "globex", SchemaPath: "schema.prisma", DatabasePath: "data/globex.sqlite"},
+	}, databases)
+
+	for _, invalid := range []string{
+		"acme",
+		"acme=schema.prisma",
+		"acme=:acme.sqlite",
+		"Acme=schema.prisma:acme.sqlite",
+		"a/b=schema.prisma:acme.sqlite",
+		"acme=schema.prisma:a.sqlite,acme=schema.prisma:b.sqlite",
+	} {
+		_, err := parseDatabases(invalid)
+		assert.Error(t, err, invalid)
+	}
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	config.PrismaSchemaFilePath = "missing.prisma"
+	config.Databases = "acme=schema.prisma:acme.sqlite"
+	require.NoError(t, config.Validate(), "the single schema is not used")
+	config.Databases = "acme=missing.prisma:acme.sqlite"
+	assert.ErrorContains(t, config.Validate(), "database acme")
+}
+
+func TestParseOperationLimits(t *testing.T) {
+	limits, err := parseOperationLimits("NightlyExport=exempt, Search=500/, sha256:ab12=/5, Import=100/20")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]api.OperationLimit{
+		"NightlyExport": {Exempt: true},
+		"Search":        {ReadLimitSeconds: 500},
+		"sha256:ab12":   {WriteLimitSeconds: 5},
+		"Import":        {ReadLimitSeconds: 100, WriteLimitSeconds: 20},
+	}, limits)
+
+	for _, invalid := range []string{
+		"Search",
+		"Search=500",
+		"=exempt",
+		"Search=0/",
+		"Search=many/",
+		"Search=exempt,Search=5/5",
+	} {
+		_, err := parseOperationLimits(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds("95, 80,50.5")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.505, 0.8, 0.95}, thresholds)
+	thresholds, err = parseThresholds("")
+	require.NoError(t, err)
+	assert.Empty(t, thresholds)
+	for _, invalid := range []string{"0", "101", "80%", "80,80"} {
+		_, err := parseThresholds(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := parseSLOs("Checkout=p95:100ms:30m, Search=p99:1s")
+	require.NoError(t, err)
+	assert.Equal(t, []api.SLO{
+		{Operation: "Checkout", Percentile: 0.95, Threshold: 100 * time.Millisecond, Window: 30 * time.Minute},
+		{Operation: "Search", Percentile: 0.99, Threshold: time.Second, Window: time.Hour},
+	}, slos)
+	for _, invalid := range []string{
+		"Checkout",
+		"Checkout=95:100ms",
+		"Checkout=p100:100ms",
+		"Checkout=p95:fast",
+		"Checkout=p95:100ms:10s",
+		"Checkout=p95:100ms:1h:1h",
+		"Checkout=p95:100ms,Checkout=p99:1s",
+	} {
+		_, err := parseSLOs(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseRowFilters(t *testing.T) {
+	filters, err := parseRowFilters(`{"Order": {"userId": {"equals": "$claims.sub"}}}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"userId": {"equals": "$claims.sub"}}`, string(filters["Order"]))
+	filters, err = parseRowFilters("")
+	require.NoError(t, err)
+	assert.Empty(t, filters)
+	for _, invalid := range []string{`Order: {userId: 1}`, `{"Order": "userId"}`, `{"Order": null}`} {
+		_, err := parseRowFilters(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestEngineListenConflict(t *testing.T) {
+	for _, test := range []struct {
+		addr     string
+		count    int
+		conflict bool
+	}{
+		{"0.0.0.0:4467", 1, true},
+		{"[::]:4467", 1, true},
+		{":4467", 1, true},
+		{"127.0.0.1:4467", 1, true},
+		{"localhost:4467", 1, true},
+		{"0.0.0.0:4466", 1, false},
+		{"10.0.0.1:4467", 1, false},
+		{"0.0.0.0:0", 1, false},
+		{"0.0.0.0:4469", 3, true},
+		{"0.0.0.0:4470", 3, false},
+	} {
+		_, conflict := engineListenConflict(test.addr, 4467, test.count)
+		assert.Equal(t, test.conflict, conflict, test.addr)
+	}
+
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	config.ListenAddr = "0.0.0.0:4467"
+	config.QueryEnginePort = "4467"
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WUNDERBASE_LISTEN_ADDR: 0.0.0.0:4467 takes port 4467 of WUNDERBASE_QUERY_ENGINE_PORT")
+}
+
+func TestPprofOffInProduction(t *testing.T) {
+	config := &config{EnablePprof: true}
+	assert.True(t, config.pprofEnabled())
+	config.Production = true
+	assert.False(t, config.pprofEnabled())
+	config.ForcePprof = true
+	assert.True(t, config.pprofEnabled())
+}
+
+func TestConfigGauges(t *testing.T) {
+	config := &config{}
+	require.NoError(t, parseEnv(config))
+	registry := metrics.NewRegistry()
+	setBuildInfo(registry, buildinfo.Info{Version: "v1", Commit: "abc", GoVersion: "go1.18", QueryEngineVersion: "e1"})
+	setBuildInfo(registry, buildinfo.Info{Version: "v1", Commit: "abc", GoVersion: "go1.18", QueryEngineVersion: "e2"})
+	setConfigGauges(registry, config)
+	config.EnableSleepMode = false
+	setConfigGauges(registry, config)
+
+	var buf bytes.Buffer
+	require.NoError(t, registry.Write(&buf))
+	assert.Contains(t, buf.String(), `wunderbase_build_info{version="v1",commit="abc",go_version="go1.18",engine_version="e2"} 1`)
+	assert.NotContains(t, buf.String(), `engine_version="e1"`)
+	assert.Contains(t, buf.String(), "wunderbase_config_sleep_after_seconds 0\n")
+	assert.Contains(t, buf.String(), "wunderbase_config_read_limit 10000\n")
+}
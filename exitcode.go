@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+)
+
+// Exit codes let supervisors tell apart failures worth retrying from ones
+// that need a human. A clean shutdown exits 0, going to sleep too unless
+// WUNDERBASE_SLEEP_EXIT_CODE says otherwise.
+const (
+	exitOK        = 0
+	exitFailure   = 1 // anything not covered below
+	exitUsage     = 2 // help was printed or the command line is invalid
+	exitConfig    = 3 // invalid configuration, retrying won't help
+	exitMigration = 4 // the schema could not be migrated
+	exitStartup   = 5 // the query engine failed to start or serve wasn't ready in time
+	exitListen    = 6 // the listen address could not be bound, retry after backoff
+	// the migration engine panicked, a bug in the engine rather than the
+	// schema
+	exitMigrationPanic = 7
+)
+
+// errSlept makes the process exit with WUNDERBASE_SLEEP_EXIT_CODE after
+// going to sleep, without logging an error.
+var errSlept = errors.New("wunderbase: went to sleep")
+
+// exitError attaches an exit code to an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode wraps err so main exits with code. A nil err stays nil.
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// exitCode maps an error returned by Run to the process exit code.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return exitUsage
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitFailure
+}
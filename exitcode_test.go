@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCodes(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	t.Run("usage", func(t *testing.T) {
+		assert.Equal(t, exitUsage, exitCode(Run(context.Background(), []string{"serv"})))
+		assert.Equal(t, exitUsage, exitCode(Run(context.Background(), []string{"serve", "--no-such-flag"})))
+	})
+	t.Run("config", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_READ_LIMIT_SECONDS", "0")
+		assert.Equal(t, exitConfig, exitCode(Run(context.Background(), []string{"serve"})))
+	})
+	t.Run("migration", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_MIGRATION_ENGINE_PATH", missing)
+		t.Setenv("WUNDERBASE_MIGRATION_LOCK_FILE", filepath.Join(t.TempDir(), "migration.lock"))
+		assert.Equal(t, exitMigration, exitCode(Run(context.Background(), []string{"migrate"})))
+	})
+	t.Run("migration engine panic", func(t *testing.T) {
+		engine := filepath.Join(t.TempDir(), "migration-engine")
+		response := `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"An error happened.","data":{"is_panic":true,"message":"boom","meta":{"full_error":"boom"}}}}`
+		require.NoError(t, os.WriteFile(engine, []byte("#!/bin/sh\nread request\necho '"+response+"'\n"), 0755))
+		t.Setenv("WUNDERBASE_MIGRATION_ENGINE_PATH", engine)
+		t.Setenv("WUNDERBASE_MIGRATION_LOCK_FILE", filepath.Join(t.TempDir(), "migration.lock"))
+		err := Run(context.Background(), []string{"migrate"})
+		assert.Equal(t, exitMigrationPanic, exitCode(err))
+		assert.EqualError(t, err, "wunderbase: migrate: migration engine panicked in schemaPush: boom")
+	})
+	t.Run("engine", func(t *testing.T) {
+		t.Setenv("WUNDERBASE_QUERY_ENGINE_PATH", missing)
+		t.Setenv("WUNDERBASE_LISTEN_ADDR", "127.0.0.1:0")
+		assert.Equal(t, exitStartup, exitCode(Run(context.Background(), []string{"serve"})))
+	})
+	t.Run("listen", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+		t.Setenv("WUNDERBASE_LISTEN_ADDR", l.Addr().String())
+		assert.Equal(t, exitListen, exitCode(Run(context.Background(), []string{"serve"})))
+	})
+}
+
+func TestStartupTimeout(t *testing.T) {
+	engine := filepath.Join(t.TempDir(), "query-engine")
+	require.NoError(t, os.WriteFile(engine, []byte("#!/bin/sh\n[ \"$1\" = --version ] && echo query-engine 1.0 && exit 0\nexec sleep 30\n"), 0755))
+	t.Setenv("WUNDERBASE_QUERY_ENGINE_PATH", engine)
+	t.Setenv("WUNDERBASE_QUERY_ENGINE_PORT", "1")
+	t.Setenv("WUNDERBASE_LISTEN_ADDR", "127.0.0.1:0")
+	t.Setenv("WUNDERBASE_STARTUP_TIMEOUT_SECONDS", "1")
+
+	start := time.Now()
+	err := Run(context.Background(), []string{"serve"})
+	require.Error(t, err)
+	assert.Equal(t, exitStartup, exitCode(err))
+	assert.Contains(t, err.Error(), `stuck in phase "wait for query engine"`)
+	assert.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestHealthcheck(t *testing.T) {
+	var status int32 = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("verbose") == "1" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	t.Setenv("WUNDERBASE_LISTEN_ADDR", strings.TrimPrefix(srv.URL, "http://"))
+
+	assert.Equal(t, exitOK, exitCode(Run(context.Background(), []string{"healthcheck"})))
+	assert.Equal(t, exitFailure, exitCode(Run(context.Background(), []string{"healthcheck", "--ready"})))
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	assert.Equal(t, exitFailure, exitCode(Run(context.Background(), []string{"healthcheck", "--url", srv.URL + "/health"})))
+
+	assert.Equal(t, "http://localhost:4466/health", healthcheckURL("0.0.0.0:4466", "/health"))
+	assert.Equal(t, "http://localhost:4466/healthz", healthcheckURL(":4466", "/healthz"))
+	assert.Equal(t, "http://10.0.0.1:4466/health", healthcheckURL("10.0.0.1:4466", "/health"))
+}
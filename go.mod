@@ -10,6 +10,7 @@ require (
 	github.com/wundergraph/graphql-go-tools v1.53.0
 	go.uber.org/ratelimit v0.2.0
 	golang.org/x/exp v0.0.0-20230519143937-03e91628a987
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -40,6 +41,5 @@ require (
 	github.com/yudai/golcs v0.0.0-20170316035057-ecda9a501e82 // indirect
 	golang.org/x/net v0.0.0-20220520000938-2e3eb7b945c2 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	moul.io/http2curl v1.0.1-0.20190925090545-5cd742060b0e // indirect
 )
@@ -1,59 +1,61 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"wunderbase/pkg/api"
+	"wunderbase/pkg/backup"
+	"wunderbase/pkg/bench"
+	"wunderbase/pkg/branch"
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/doctor"
+	"wunderbase/pkg/journal"
+	"wunderbase/pkg/logging"
+	"wunderbase/pkg/metrics"
 	"wunderbase/pkg/migrate"
 	"wunderbase/pkg/queryengine"
+	"wunderbase/pkg/report"
+	"wunderbase/pkg/schedule"
+	"wunderbase/pkg/server"
+	"wunderbase/pkg/support"
+	"wunderbase/pkg/systemd"
+	"wunderbase/pkg/upgrade"
 
-	"github.com/caarlos0/env/v6"
 	"golang.org/x/exp/slog"
 )
 
-type config struct {
-	Production            bool   `env:"PRODUCTION" envDefault:"false"`
-	PrismaSchemaFilePath  string `env:"PRISMA_SCHEMA_FILE" envDefault:"./schema.prisma"`
-	MigrationLockFilePath string `env:"MIGRATION_LOCK_FILE" envDefault:"migration.lock"`
-	EnableSleepMode       bool   `env:"ENABLE_SLEEP_MODE" envDefault:"true"`
-	SleepAfterSeconds     int    `env:"SLEEP_AFTER_SECONDS" envDefault:"10"`
-	// I think that we should discard `EnablePlayground`, when we add `Production` flag.
-	// EnablePlayground      bool   `env:"ENABLE_PLAYGROUND" envDefault:"true"`
-	MigrationEnginePath string `env:"MIGRATION_ENGINE_PATH" envDefault:"./migration-engine"`
-	QueryEnginePath     string `env:"QUERY_ENGINE_PATH" envDefault:"./query-engine"`
-	QueryEnginePort     string `env:"QUERY_ENGINE_PORT" envDefault:"4467"`
-	ListenAddr          string `env:"LISTEN_ADDR" envDefault:"0.0.0.0:4466"`
-	GraphiQLApiURL      string `env:"GRAPHIQL_API_URL" envDefault:"http://localhost:4466"`
-	ReadLimitSeconds    int    `env:"READ_LIMIT_SECONDS" envDefault:"10000"`
-	WriteLimitSeconds   int    `env:"WRITE_LIMIT_SECONDS" envDefault:"2000"`
-	HealthEndpoint      string `env:"HEALTH_ENDPOINT" envDefault:"/health"`
-	LogFormat           string `env:"LOG_FORMAT" envDefault:"text"`
-	Timestamp           bool   `env:"TIMESTAMP" envDefault:"false"`
-	Debug               bool   `env:"DEBUG" envDefault:"true"`
-}
-
 var LogLevel struct {
 	sync.Mutex
 	slog.LevelVar
 }
 
 func main() {
-	if err := Run(context.Background(), os.Args[1:]); err == flag.ErrHelp {
-		os.Exit(2)
-	} else if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		os.Exit(1)
+	err := Run(context.Background(), os.Args[1:])
+	if err != nil && !errors.Is(err, flag.ErrHelp) && !errors.Is(err, errSlept) {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", redact(err.Error()))
 	}
+	os.Exit(exitCode(err))
 }
 
 func Run(ctx context.Context, args []string) (err error) {
@@ -63,127 +65,1570 @@ func Run(ctx context.Context, args []string) (err error) {
 	}
 
 	config := &config{}
-	if err := env.Parse(config); err != nil {
-		return fmt.Errorf("wunderbase: parse env: %w", err)
+	if err := parseEnv(config); err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: parse env: %w", err))
+	}
+
+	switch {
+	case cmd == "" || cmd == "-h" || cmd == "-help" || cmd == "--help":
+		printUsage()
+		return flag.ErrHelp
+	case cmd == "help":
+		return runHelp(ctx, config, args[1:])
+	case cmd == "--version" || cmd == "-version":
+		cmd = "version"
+	}
+	c := findCommand(cmd)
+	if c == nil {
+		return unknownCommand("subcommand", cmd, commandNames())
+	}
+	return c.run(ctx, config, args[1:])
+}
+
+func runMigrate(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("migrate", config)
+	forceInit := fs.Bool("force-init", false, "create the database again from WUNDERBASE_INIT_SQL_FILE, moving the existing one aside, after confirmation")
+	yes := fs.Bool("yes", false, "confirm --force-init without asking")
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
+	}
+
+	if _, err := config.databasePath(); err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: load prisma schema: %w", err))
+	}
+	if *forceInit {
+		if config.InitSQLFile == "" {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: --force-init requires WUNDERBASE_INIT_SQL_FILE"))
+		}
+		// read above
+		database, _ := config.databasePath()
+		if !*yes {
+			if !isTerminal(os.Stdin) {
+				return withExitCode(exitConfig, fmt.Errorf("wunderbase: --force-init asks for confirmation on a terminal, pass --yes to confirm it otherwise"))
+			}
+			if err := confirmForceInit(os.Stdin, os.Stderr, database, config.InitSQLFile); err != nil {
+				return withExitCode(exitConfig, err)
+			}
+		}
+	}
+	err = server.Migrate(ctx, server.MigrateOptions{
+		MigrationEnginePath: config.MigrationEnginePath,
+		SchemaPath:          config.PrismaSchemaFilePath,
+		LockPath:            config.MigrationLockFilePath,
+		EnableCDC:           config.EnableCDC,
+		SqlitePath:          config.SqlitePath,
+		DatabaseKey:         config.DatabaseKey,
+		InitSQLFile:         config.InitSQLFile,
+		ForceInit:           *forceInit,
+	})
+	if err != nil {
+		reporter := newReporter(ctx, config)
+		reporter.Report(report.Event{Type: report.EventMigrationFailed, Message: err.Error()})
+		reporter.Close(5 * time.Second)
+		var migrationErr *migrate.Error
+		if errors.As(err, &migrationErr) && migrationErr.IsPanic {
+			return withExitCode(exitMigrationPanic, err)
+		}
+		return withExitCode(exitMigration, err)
+	}
+	return nil
+}
+
+// confirmForceInit asks on out to type the name of the database file
+// before it is replaced by an import of file.
+func confirmForceInit(in io.Reader, out io.Writer, database, file string) error {
+	name := filepath.Base(database)
+	fmt.Fprintf(out, "This moves %s aside and creates it again from %s.\nType %s to confirm: ", database, file, name)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("wunderbase: --force-init: %w", err)
+	}
+	if strings.TrimSpace(answer) != name {
+		return fmt.Errorf("wunderbase: --force-init wasn't confirmed, the database is left as it is")
+	}
+	return nil
+}
+
+func serveFlagSet(config *config) (fs *flag.FlagSet, ephemeral, printOnly *bool) {
+	fs = newFlagSet("serve", config)
+	ephemeral = fs.Bool("ephemeral", false, "serve a temporary copy of the database that is deleted at shutdown")
+	printOnly = fs.Bool("print-config", false, "print the effective configuration and exit")
+	return fs, ephemeral, printOnly
+}
+
+func runServe(ctx context.Context, config *config, args []string) (err error) {
+	fs, ephemeral, printOnly := serveFlagSet(config)
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
 	}
+	if *printOnly {
+		return printConfig(os.Stdout, config)
+	}
+	// keep the configuration as loaded for reloads
+	loaded := *config
 
-	if err := initLogger(config); err != nil {
-		return fmt.Errorf("wunderbase: init logger: %w", err)
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	startup := startStartup(time.Duration(config.StartupTimeoutSeconds)*time.Second, stop)
+
+	if *ephemeral && config.Databases != "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: --ephemeral serves a single database, it can't be combined with WUNDERBASE_DATABASES"))
+	}
+	if *ephemeral && config.ExternalEngineURL != "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: --ephemeral serves a copy of the database, the external query engine of WUNDERBASE_EXTERNAL_QUERY_ENGINE_URL can't read it"))
+	}
+
+	if config.Databases == "" {
+		if _, err := config.databasePath(); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: load prisma schema: %w", err))
+		}
+	}
+
+	if err := startup.enter("read engine versions"); err != nil {
+		return err
+	}
+	info := buildinfo.Get().WithEngines(ctx, config.QueryEnginePath, config.MigrationEnginePath)
+	reporter := report.New(config.ErrorReportURL, config.ErrorReportMaxPerMinute, info)
+	defer reporter.Close(5 * time.Second)
+
+	// parseFlags refused the config if any of these or the auth rules
+	// file doesn't parse
+	trustedProxies, _ := parseCIDRs(config.TrustedProxies)
+	operationLimits, _ := parseOperationLimits(config.OperationLimits)
+	thresholds, _ := parseThresholds(config.LimitWarningThresholds)
+	slos, _ := parseSLOs(config.SLOs)
+	rowFilters, _ := parseRowFilters(config.RowFilters)
+	fileContentTypes, _ := parseFileContentTypes(config.FileContentTypes)
+	authRules, _ := loadAuthRules(config.AuthRulesFile)
+
+	registry := metrics.NewRegistry()
+	setBuildInfo(registry, info)
+	setConfigGauges(registry, config)
+
+	mutations, err := journal.Open(journal.Options{
+		Dir:    config.MutationJournal,
+		Fsync:  config.JournalFsync,
+		Buffer: config.JournalBuffer,
+		OnFull: config.JournalOnFull,
+	})
+	if err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: open the mutation journal: %w", err))
+	}
+	// closed once the server stopped, writing the entries still buffered
+	defer mutations.Close()
+
+	handlerConfig := api.Config{
+		EnableSleepMode:           config.EnableSleepMode,
+		Production:                config.Production,
+		HealthEndpoint:            config.HealthEndpoint,
+		MetricsEndpoint:           config.MetricsEndpoint,
+		SleepAfterSeconds:         config.SleepAfterSeconds,
+		KeepAliveMax:              time.Duration(config.KeepAliveMaxSeconds) * time.Second,
+		SleepPreStop:              time.Duration(config.SleepPreStopMs) * time.Millisecond,
+		StopHeader:                config.SleepStopHeader,
+		StopHeaderValue:           config.SleepStopHeaderValue,
+		SleepResetOn:              config.SleepResetOn,
+		SleepResetExempt:          splitList(config.SleepResetExempt),
+		EngineIdleAfter:           time.Duration(config.EngineIdleSeconds) * time.Second,
+		MigrationWait:             time.Duration(config.MigrationWaitMs) * time.Millisecond,
+		RequestTimeout:            time.Duration(config.RequestTimeoutMs) * time.Millisecond,
+		ReadQuota:                 config.ReadQuota,
+		OperationLimits:           operationLimits,
+		WriteQuota:                config.WriteQuota,
+		QuotaWindow:               time.Duration(config.QuotaWindowSeconds) * time.Second,
+		PersistQuota:              config.PersistQuota,
+		LimitWarningThresholds:    thresholds,
+		ReportLimitWarnings:       config.ReportLimitWarnings,
+		SLOs:                      slos,
+		SLOBurnRate:               config.SLOBurnRate,
+		ReportSLOBurns:            config.ReportSLOBurns,
+		EngineMaxIdleConns:        config.EngineMaxIdleConns,
+		EngineIdleConnTimeout:     time.Duration(config.EngineIdleConnSeconds) * time.Second,
+		EngineConnectRetries:      config.EngineConnectRetries,
+		EngineConnectBackoff:      time.Duration(config.EngineConnectBackoffMs) * time.Millisecond,
+		WarmupRuns:                config.WarmupRuns,
+		WarmupQuery:               config.WarmupQuery,
+		ReadLimitSeconds:          config.ReadLimitSeconds,
+		WriteLimitSeconds:         config.WriteLimitSeconds,
+		WriteQueue:                config.WriteQueue,
+		WriteQueueTimeout:         time.Duration(config.WriteQueueTimeoutMs) * time.Millisecond,
+		EngineSlots:               config.EngineSlots,
+		PrioritySlots:             config.PrioritySlots,
+		PriorityScopes:            splitList(config.PriorityScopes),
+		EngineQueueTimeout:        time.Duration(config.EngineQueueTimeoutMs) * time.Millisecond,
+		Journal:                   mutations,
+		HedgeReads:                config.HedgeReads,
+		HedgeAfter:                time.Duration(config.HedgeAfterMs) * time.Millisecond,
+		HedgePercentile:           config.HedgePercentile,
+		CoalesceReads:             config.CoalesceReads,
+		CoalesceMaxWaiters:        config.CoalesceMaxWaiters,
+		MaxDatabaseSizeMB:         config.MaxDatabaseSizeMB,
+		ReadsOnStorageFailure:     config.StorageFailureReads,
+		MaxUploadFileBytes:        int64(config.MaxUploadFileKB) * 1024,
+		MaxUploadTotalBytes:       int64(config.MaxUploadTotalKB) * 1024,
+		FileContentTypes:          fileContentTypes,
+		StaticDir:                 config.StaticDir,
+		StaticPathPrefix:          config.StaticPathPrefix,
+		StaticDotfiles:            config.StaticDotfiles,
+		StaticKeepsAwake:          config.StaticKeepsAwake,
+		Metrics:                   registry,
+		TrustedAuthHeader:         config.TrustedAuthHeader,
+		TrustedProxies:            trustedProxies,
+		TrustedScopesHeader:       config.TrustedScopesHeader,
+		ModelGrants:               config.ModelGrants,
+		AuthRules:                 authRules,
+		RowFilters:                rowFilters,
+		HiddenModels:              splitList(config.HiddenModels),
+		HiddenFields:              splitList(config.HiddenFields),
+		SoftDeleteModels:          splitList(config.SoftDeleteModels),
+		SoftDeleteField:           config.SoftDeleteField,
+		PublicURL:                 config.PublicURL,
+		GraphiQLApiURL:            config.GraphiQLApiURL,
+		AdminToken:                config.AdminToken,
+		PlainTextErrors:           config.PlainTextErrors,
+		EnableServerTiming:        config.EnableServerTiming,
+		EnablePprof:               config.pprofEnabled(),
+		RecentRequests:            config.RecentRequests,
+		CaptureBodies:             config.CaptureBodies,
+		DisableCapture:            config.DisableCapture,
+		CaptureDir:                config.CaptureDir,
+		CaptureMaxBytes:           int64(config.CaptureMaxKB) << 10,
+		CaptureRedact:             splitList(config.CaptureRedact),
+		SlowRequestThreshold:      time.Duration(config.SlowRequestMs) * time.Millisecond,
+		LogExcludePaths:           config.excludePaths(config.LogExcludePaths),
+		MetricsExcludePaths:       config.excludePaths(config.MetricsExcludePaths),
+		ExcludeUserAgents:         splitList(config.ExcludeUserAgents),
+		Reporter:                  reporter,
+		RequiredHealthComponents:  splitList(config.HealthRequired),
+		BuildInfo:                 &info,
+		PeerURLs:                  splitList(config.PeerURLs),
+		EnableREST:                config.EnableREST,
+		EnableCDC:                 config.EnableCDC,
+		EnableCount:               config.EnableCount,
+		CountCacheTTL:             time.Duration(config.CountCacheMs) * time.Millisecond,
+		RefuseWritesOnSchemaDrift: config.RefuseWritesOnDrift,
+		SqlitePath:                config.SqlitePath,
+		EnableSchemaViewer:        config.schemaViewerEnabled(),
+		EnableDMMF:                config.dmmfEnabled(),
+		SafeMutations:             config.safeMutationsEnabled(),
+		DisableIntrospection:      !config.Introspection,
+		DisableRawQueries:         !config.RawQueries,
+		IndexAdvice:               config.IndexAdvice,
+		MaxResultRows:             config.MaxResultRows,
+		MaxResultRowsExempt:       splitList(config.MaxResultRowsExempt),
+		DefaultTake:               config.DefaultTake,
+		DefaultNestedTake:         config.DefaultNestedTake,
+		SupportBundle:             supportBundle(config, queryengine.RecentOutput),
+	}
+	if config.Production && config.pprofEnabled() {
+		slog.Warn("pprof is enabled in production")
+	}
+	if config.Production && config.CaptureBodies {
+		slog.Warn("WUNDERBASE_CAPTURE_BODIES is ignored in production")
+	}
+	if config.StatsdAddr != "" {
+		var tags []string
+		if config.StatsdTags != "" {
+			tags = strings.Split(config.StatsdTags, ",")
+		}
+		statsd, err := metrics.NewStatsD(config.StatsdAddr, config.StatsdPrefix, tags)
+		if err != nil {
+			return fmt.Errorf("wunderbase: statsd: %w", err)
+		}
+		defer statsd.Close()
+		handlerConfig.MetricsSinks = append(handlerConfig.MetricsSinks, statsd)
+	}
+
+	serverConfig, err := newServerConfig(config, handlerConfig, *ephemeral)
+	if err != nil {
+		return err
+	}
+	serverConfig.Phase = startup.enter
+	if config.ManagementListenAddr != "" {
+		// validateInternal refused internal settings that don't apply
+		internal, _ := config.internalProfile()
+		management := withProfile(handlerConfig, internal)
+		serverConfig.Management = &management
+		serverConfig.ManagementListenAddr = config.ManagementListenAddr
+	}
+	srv, err := server.New(serverConfig)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if err := srv.Start(ctx); err != nil {
+		if startupErr := startup.err(); startupErr != nil {
+			return startupErr
+		}
+		return withExitCode(startExitCode(err), err)
+	}
+
+	slog.InfoCtx(ctx, "Server Listening", slog.String("addr", srv.Addr()))
+	if addr := srv.ManagementAddr(); addr != "" {
+		slog.InfoCtx(ctx, "Internal endpoint listening", slog.String("addr", addr))
+	}
+	_ = startup.enter("wait for query engine")
+	go func() {
+		if err := srv.Ready(ctx); err != nil {
+			if ctx.Err() == nil {
+				startup.fail(withExitCode(startExitCode(err), err))
+			}
+			return
+		}
+		startup.done()
+		logReady(config, srv, info.QueryEngineVersion, logOutput)
+		if err := upgrade.Ready(); err != nil {
+			slog.Warn("Notifying the previous process", slog.String("error", err.Error()))
+		}
+		if err := systemd.Notify("READY=1"); err != nil {
+			slog.Warn("Notifying systemd", slog.String("error", err.Error()))
+		}
+	}()
+
+	upgraded := make(chan struct{})
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+	go func() {
+		for {
+			select {
+			case <-srv.Done():
+				return
+			case <-usr2:
+				if *ephemeral {
+					slog.Error("Upgrade rejected, an ephemeral database can't be handed over")
+					continue
+				}
+				if config.ManagementListenAddr != "" {
+					slog.Error("Upgrade rejected, only the socket of the public endpoint can be handed over, not the internal one")
+					continue
+				}
+				if err := handOver(srv, config); err != nil {
+					slog.Error("Upgrade failed, keeping serving", slog.String("error", err.Error()))
+					continue
+				}
+				close(upgraded)
+				return
+			}
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-srv.Done():
+				return
+			case <-hup:
+				if logFile != nil {
+					if err := logFile.Reopen(); err != nil {
+						slog.Error("Reopening log file", slog.String("error", err.Error()))
+					}
+				}
+				if err := reloadServe(&loaded, args, srv, handlerConfig); err != nil {
+					slog.Error("Config reload rejected, keeping the current configuration", slog.String("error", err.Error()))
+				}
+			}
+		}
+	}()
+
+	// done when ctx is, the server went to sleep or a new process took over.
+	// After an upgrade the query engine keeps serving the requests in flight.
+	select {
+	case <-srv.Done():
+	case <-upgraded:
+	}
+	if err := systemd.Notify("STOPPING=1"); err != nil {
+		slog.Warn("Notifying systemd", slog.String("error", err.Error()))
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("wunderbase: close server: %w", err)
+	}
+	log.Println("Server stopped")
+
+	if err := startup.err(); err != nil {
+		return err
+	}
+	if srv.Slept() && config.SleepExitCode != exitOK {
+		return withExitCode(config.SleepExitCode, errSlept)
+	}
+	return nil
+}
+
+// handOver starts the current binary with the same arguments on the
+// server's socket and returns once it is ready to take over.
+func handOver(srv *server.Server, config *config) error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(config.StartupTimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Minute
+	}
+	slog.Info("Upgrading", slog.String("binary", path))
+	process, err := upgrade.Start(srv.Listener(), path, os.Args[1:], timeout)
+	if err != nil {
+		return err
+	}
+	slog.Info("New process is ready, draining", slog.Int("pid", process.Pid))
+	if err := systemd.Notify(fmt.Sprintf("MAINPID=%d", process.Pid)); err != nil {
+		slog.Warn("Notifying systemd", slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+// newServerConfig translates the serve configuration for the server.
+func newServerConfig(config *config, handlerConfig api.Config, ephemeral bool) (server.Config, error) {
+	serverConfig := server.Config{
+		SchemaPath:             config.PrismaSchemaFilePath,
+		QueryEnginePath:        config.QueryEnginePath,
+		MigrationEnginePath:    config.MigrationEnginePath,
+		QueryEnginePort:        config.QueryEnginePort,
+		ExternalQueryEngineURL: config.ExternalEngineURL,
+		ListenAddr:             config.ListenAddr,
+		MigrationLockFilePath:  config.MigrationLockFilePath,
+		Ephemeral:              ephemeral,
+		Production:             config.Production,
+		Debug:                  config.Debug,
+		DatabaseKey:            config.DatabaseKey,
+		SchemaDriftCheck:       config.SchemaDriftCheck,
+		API:                    handlerConfig,
+	}
+	// take over the socket of the process this one replaces. Its query
+	// engines keep serving until this one is ready, so ours can't use the
+	// same ports.
+	inherited, err := upgrade.Listener()
+	if err != nil {
+		return server.Config{}, withExitCode(exitListen, fmt.Errorf("wunderbase: listen: %w", err))
+	}
+	if inherited != nil {
+		slog.Info("Using socket from the previous process", slog.String("addr", inherited.Addr().String()))
+		serverConfig.Listener = inherited
+		serverConfig.QueryEnginePort = ""
+	}
+	// adopt the socket passed by systemd socket activation. Together with
+	// sleep mode this lets systemd start wunderbase on the first connection
+	// and again after it went to sleep.
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return server.Config{}, withExitCode(exitListen, fmt.Errorf("wunderbase: listen: %w", err))
+	}
+	if len(listeners) > 0 && inherited == nil {
+		for _, l := range listeners[1:] {
+			l.Close()
+		}
+		slog.Info("Using socket from systemd", slog.String("addr", listeners[0].Addr().String()))
+		serverConfig.Listener = listeners[0]
+	}
+
+	// parseFlags refused a WUNDERBASE_DATABASES that doesn't parse
+	specs, _ := parseDatabases(config.Databases)
+	for _, spec := range specs {
+		serverConfig.Databases = append(serverConfig.Databases, server.Database{
+			Name:         spec.Name,
+			SchemaPath:   spec.SchemaPath,
+			DatabasePath: spec.DatabasePath,
+		})
+	}
+	if config.ReplicaMode != "" {
+		keys, err := backupKeys(config)
+		if err != nil {
+			return server.Config{}, withExitCode(exitConfig, fmt.Errorf("wunderbase: %w", err))
+		}
+		serverConfig.Replica = &server.Replica{
+			Source:  config.ReplicaSource,
+			Keys:    keys,
+			Refresh: time.Duration(config.ReplicaRefreshSeconds) * time.Second,
+		}
+	}
+	if config.TimeTravelSources != "" {
+		keys, err := backupKeys(config)
+		if err != nil {
+			return server.Config{}, withExitCode(exitConfig, fmt.Errorf("wunderbase: %w", err))
+		}
+		serverConfig.TimeTravel = &server.TimeTravel{
+			Sources:    splitList(config.TimeTravelSources),
+			Keys:       keys,
+			MaxEngines: config.TimeTravelMaxEngines,
+			CacheBytes: int64(config.TimeTravelCacheMB) << 20,
+		}
+	}
+	if config.BackupVerifyCron != "" {
+		keys, err := backupKeys(config)
+		if err != nil {
+			return server.Config{}, withExitCode(exitConfig, fmt.Errorf("wunderbase: %w", err))
+		}
+		serverConfig.BackupVerification = &server.BackupVerification{
+			Cron:    config.BackupVerifyCron,
+			Sources: splitList(config.BackupVerifySources),
+			Options: backup.VerifyOptions{
+				SqlitePath:          config.SqlitePath,
+				MigrationEnginePath: config.MigrationEnginePath,
+				SchemaPath:          config.PrismaSchemaFilePath,
+				Query:               config.BackupVerifyQuery,
+				MinResult:           config.BackupVerifyMin,
+				Keys:                keys,
+			},
+		}
+	}
+	if config.SchedulesFile != "" {
+		if serverConfig.Schedules, err = schedule.LoadFile(config.SchedulesFile); err != nil {
+			return server.Config{}, withExitCode(exitConfig, fmt.Errorf("wunderbase: schedules: %w", err))
+		}
+	}
+	return serverConfig, nil
+}
+
+// startExitCode maps a failure to start the server to the exit code.
+func startExitCode(err error) int {
+	var startErr *server.StartError
+	if !errors.As(err, &startErr) {
+		return exitFailure
+	}
+	switch startErr.Stage {
+	case server.StageConfig:
+		return exitConfig
+	case server.StageListen:
+		return exitListen
+	case server.StageMigrate:
+		return exitMigration
+	default:
+		return exitStartup
+	}
+}
+
+// newReporter returns the error reporter, nil if WUNDERBASE_ERROR_REPORT_URL
+// is not set.
+func newReporter(ctx context.Context, config *config) *report.Reporter {
+	if config.ErrorReportURL == "" {
+		return nil
+	}
+	info := buildinfo.Get().WithEngines(ctx, config.QueryEnginePath, config.MigrationEnginePath)
+	return report.New(config.ErrorReportURL, config.ErrorReportMaxPerMinute, info)
+}
+
+// setBuildInfo exports the build and query engine version. It replaces the
+// previous series, so it can be called again when the engine binary changes.
+func setBuildInfo(registry *metrics.Registry, info buildinfo.Info) {
+	buildInfo := registry.Gauge("wunderbase_build_info", "Build information, always 1.", "version", "commit", "go_version", "engine_version")
+	buildInfo.Reset()
+	buildInfo.With(info.Version, info.Commit, info.GoVersion, info.QueryEngineVersion).Set(1)
+}
+
+// setConfigGauges exports the settings that differ between instances of a
+// fleet, so misconfigured ones stand out on dashboards.
+func setConfigGauges(registry *metrics.Registry, config *config) {
+	registry.Gauge("wunderbase_config_sleep_after_seconds", "Configured seconds without requests before sleeping, 0 when sleep mode is off.").
+		With().Set(float64(sleepAfter(config)))
+	registry.Gauge("wunderbase_config_read_limit", "Configured reads allowed per second.").
+		With().Set(float64(config.ReadLimitSeconds))
+	registry.Gauge("wunderbase_config_write_limit", "Configured writes allowed per second.").
+		With().Set(float64(config.WriteLimitSeconds))
+}
+
+func sleepAfter(config *config) int {
+	if !config.EnableSleepMode {
+		return 0
+	}
+	return config.SleepAfterSeconds
+}
+
+// reloadServe re-reads env, config file and flags and applies the settings
+// that are safe to change while serving. An invalid configuration is
+// rejected as a whole.
+func reloadServe(current *config, args []string, handler interface{ Reload(api.Config) }, handlerConfig api.Config) error {
+	next := &config{}
+	if err := parseEnv(next); err != nil {
+		return err
+	}
+	fs, _, _ := serveFlagSet(next)
+	fs.SetOutput(ioutil.Discard)
+	if err := loadFlags(fs, next, args); err != nil {
+		return err
+	}
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	// the auth rules file may have changed without its path
+	authRules, err := loadAuthRules(next.AuthRulesFile)
+	if err != nil {
+		return fmt.Errorf("wunderbase: auth rules: %w", err)
+	}
+
+	reload, restart := reloadDiff(current, next)
+	if len(restart) > 0 {
+		slog.Warn("Ignoring changed settings that require a restart", slog.String("settings", strings.Join(restart, ", ")))
+	}
+	if len(reload) == 0 && authRules == nil && handlerConfig.AuthRules == nil {
+		slog.Info("Config reloaded, nothing to apply")
+		return nil
+	}
+	applyReload(current, next)
+	setLogLevel(current.Debug)
+	handlerConfig.SleepAfterSeconds = current.SleepAfterSeconds
+	handlerConfig.ReadLimitSeconds = current.ReadLimitSeconds
+	handlerConfig.WriteLimitSeconds = current.WriteLimitSeconds
+	handlerConfig.MaxDatabaseSizeMB = current.MaxDatabaseSizeMB
+	handlerConfig.AuthRules = authRules
+	handler.Reload(handlerConfig)
+	setConfigGauges(handlerConfig.Metrics, current)
+	slog.Info("Config reloaded", slog.String("changed", strings.Join(reload, ", ")))
+	return nil
+}
+
+func runSchema(ctx context.Context, config *config, args []string) (err error) {
+	var cmd string
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
 	}
 
 	switch cmd {
-	case "migrate":
-		return runMigrate(ctx, config)
-	case "serve":
-		return runServe(ctx, config)
+	case "sdl":
+		fs := newFlagSet("schema sdl", config)
+		out := fs.String("out", "", "write to this file instead of stdout")
+		jsonOutput := fs.Bool("json", false, "print the introspection result as JSON instead of the SDL")
+		if err := parseFlags(fs, config, args); err != nil {
+			return err
+		}
+		sdl, err := fetchSDL(ctx, config)
+		if err != nil {
+			return fmt.Errorf("wunderbase: schema sdl: %w", err)
+		}
+		if *jsonOutput {
+			if sdl, err = api.Introspect(sdl); err != nil {
+				return fmt.Errorf("wunderbase: schema sdl: %w", err)
+			}
+		}
+		if *out != "" {
+			return ioutil.WriteFile(*out, sdl, 0644)
+		}
+		_, err = os.Stdout.Write(sdl)
+		return err
+	case "", "help", "-h", "-help", "--help":
+		printCommandHelp(os.Stderr, findCommand("schema"))
+		return flag.ErrHelp
 	default:
-		if cmd == "" || cmd == "help" || strings.HasPrefix(cmd, "-") {
-			printUsage()
-			return flag.ErrHelp
+		return unknownCommand("schema subcommand", cmd, []string{"sdl"})
+	}
+}
+
+// fetchSDL starts a query engine on a free port against an empty scratch
+// database, since the SDL only depends on the datamodel, and returns the SDL
+// it serves.
+func fetchSDL(ctx context.Context, config *config) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "wunderbase-sdl-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	schemaPath, err := migrate.WriteSchemaForDatabase(config.PrismaSchemaFilePath, filepath.Join(dir, "scratch.sqlite"), dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	if config.StartupTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.StartupTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	if err := queryengine.Run(ctx, wg, config.QueryEnginePath, port, schemaPath, false, false, nil); err != nil {
+		return nil, err
+	}
+	// stop the engine and wait for it to exit before removing dir
+	defer func() {
+		stop()
+		wg.Wait()
+	}()
+
+	url := fmt.Sprintf("http://localhost:%s/", port)
+	if err := server.WaitForEngine(ctx, url); err != nil {
+		return nil, fmt.Errorf("query engine not ready: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"sdl", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("query engine returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// runLint lints the operations of a manifest against the schema and the
+// rules of the configuration, like /admin/lint, without a running instance.
+// The schema is read from --schema-sdl, or generated from the prisma schema
+// with the query engine.
+func runLint(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("lint", config)
+	manifest := fs.String("manifest", "", "documents to lint: an array of queries or operations, or a persisted operations manifest")
+	schemaSDL := fs.String("schema-sdl", "", "GraphQL schema to lint against, as printed by schema sdl, instead of generating it")
+	maxDepth := fs.Int("max-depth", 0, "fail operations nested deeper than this, 0 disables the check")
+	maxCost := fs.Int("max-cost", 0, "fail operations whose cost is over this, 0 disables the check")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+	if *manifest == "" {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: lint: --manifest is required"))
+	}
+	data, err := ioutil.ReadFile(*manifest)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: lint: %w", err))
+	}
+	operations, err := api.ParseLintOperations(data)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: lint: %s: %w", *manifest, err))
+	}
+	var sdl []byte
+	if *schemaSDL != "" {
+		sdl, err = ioutil.ReadFile(*schemaSDL)
+	} else {
+		sdl, err = fetchSDL(ctx, config)
+	}
+	if err != nil {
+		return fmt.Errorf("wunderbase: lint: read schema: %w", err)
+	}
+	report, err := api.Lint(sdl, operations, api.LintRules{
+		DisableIntrospection: !config.Introspection,
+		DisableRawQueries:    !config.RawQueries,
+		SafeMutations:        config.safeMutationsEnabled(),
+		ReadOnly:             config.ReplicaMode != "",
+		HiddenModels:         splitList(config.HiddenModels),
+		HiddenFields:         splitList(config.HiddenFields),
+		SoftDeleteModels:     splitList(config.SoftDeleteModels),
+		SoftDeleteField:      config.SoftDeleteField,
+		DefaultTake:          config.DefaultTake,
+		MaxResultRows:        config.MaxResultRows,
+		MaxDepth:             *maxDepth,
+		MaxCost:              *maxCost,
+	})
+	if err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: lint: %w", err))
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range report.Results {
+			status := "ok"
+			if !r.OK {
+				status = "FAIL"
+			}
+			name := r.OperationName
+			if r.ID != "" {
+				name = r.ID + " " + name
+			}
+			fmt.Printf("%-4s %s (depth %d, cost %d)\n", status, strings.TrimSpace(name), r.Depth, r.Cost)
+			for _, e := range r.Errors {
+				fmt.Printf("     %s: %s\n", e.Stage, e.Message)
+			}
+			for _, limit := range r.OverLimits {
+				fmt.Printf("     limit: %s\n", limit)
+			}
+			for _, e := range r.Blocked {
+				fmt.Printf("     blocked: %s: %s\n", e.Code, e.Message)
+			}
 		}
-		return fmt.Errorf("wunderbase: unknown subcommand %q", cmd)
 	}
+	if !report.OK {
+		return fmt.Errorf("wunderbase: lint: operations failed")
+	}
+	return nil
 }
 
-func printUsage() {
-	fmt.Println(`
-wunderbase is is a Serverless SQLite database exposed through GraphQL. For more information, 
-see https://github.com/wundergraph/wunderbase
+// runSupportBundle writes a support bundle for bug reports. With --url it
+// is downloaded from the admin endpoint of the running instance, which adds
+// its engine log, slow queries and error counts, otherwise it is collected
+// here without them.
+func runSupportBundle(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("support-bundle", config)
+	out := fs.String("out", "wunderbase-support.tar.gz", "file to write the bundle to")
+	url := fs.String("url", "", "base url of a running instance to download the bundle from, with the admin token")
+	hashNames := fs.Bool("hash-names", false, "replace the names of the models, enums and fields of the schema with hashes")
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: support bundle: %w", err))
+	}
+	defer f.Close()
+	if *url == "" {
+		if err := supportBundle(config, nil)(ctx, *hashNames).Write(f); err != nil {
+			return fmt.Errorf("wunderbase: support bundle: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", *out)
+		return f.Close()
+	}
 
-Usage:
-	wunderbase <command> [arguments]
+	if config.AdminToken == "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: support bundle: --url requires WUNDERBASE_ADMIN_TOKEN"))
+	}
+	u := strings.TrimSuffix(*url, "/") + "/admin/support-bundle?hashNames=" + strconv.FormatBool(*hashNames)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: support bundle: %w", err))
+	}
+	req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("wunderbase: support bundle: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wunderbase: support bundle: %s answered %s", u, resp.Status)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return fmt.Errorf("wunderbase: support bundle: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", *out)
+	return f.Close()
+}
 
-The commands are:
-	migrate     Migrate the database schema
-	serve       Start the wunderbase server
-`[1:])
+// supportBundle returns the collector of the support bundle parts known to
+// the process. engineLog returns the last lines of the query engine, nil if
+// it doesn't run in this process.
+func supportBundle(config *config, engineLog func() []string) api.SupportBundleFunc {
+	return func(ctx context.Context, hashNames bool) *support.Bundle {
+		var effective bytes.Buffer
+		if err := printConfig(&effective, config); err != nil {
+			fmt.Fprintf(&effective, "# %s\n", err)
+		}
+		opts := support.Options{
+			Config:                effective.Bytes(),
+			Build:                 buildinfo.Get().WithEngines(ctx, config.QueryEnginePath, config.MigrationEnginePath),
+			SchemaPath:            config.PrismaSchemaFilePath,
+			MigrationLockFilePath: config.MigrationLockFilePath,
+			SqlitePath:            config.SqlitePath,
+			Encrypted:             config.DatabaseKey != "",
+			HashNames:             hashNames,
+			Secrets:               config.secrets(),
+		}
+		if engineLog != nil {
+			opts.EngineLog = engineLog()
+		}
+		return support.Collect(ctx, opts)
+	}
 }
 
-func runMigrate(ctx context.Context, config *config) (err error) {
-	schema, err := ioutil.ReadFile(config.PrismaSchemaFilePath)
+func runVersion(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("version", config)
+	jsonOutput := fs.Bool("json", false, "print the version information as JSON")
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+
+	info := buildinfo.Get().WithEngines(ctx, config.QueryEnginePath, config.MigrationEnginePath)
+	if *jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(info)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "wunderbase %s\n", info.Version)
+	fmt.Fprintf(w, "  commit:\t%s\n", info.Commit)
+	fmt.Fprintf(w, "  built:\t%s\n", info.Date)
+	fmt.Fprintf(w, "  go:\t%s\n", info.GoVersion)
+	if info.QueryEngineVersion != "" {
+		fmt.Fprintf(w, "  query engine:\t%s\n", info.QueryEngineVersion)
+	}
+	if info.MigrationEngineVersion != "" {
+		fmt.Fprintf(w, "  migration engine:\t%s\n", info.MigrationEngineVersion)
+	}
+	return w.Flush()
+}
+
+// runHealthcheck probes the health endpoint of a running instance, for
+// HEALTHCHECK directives of images without curl. It exits 1 when the
+// instance is unhealthy or doesn't answer in time.
+func runHealthcheck(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("healthcheck", config)
+	url := fs.String("url", "", "health endpoint to probe, defaults to the health endpoint on the listen address")
+	ready := fs.Bool("ready", false, "probe readiness: every required health component must be ok")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for the answer")
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+	if *url == "" {
+		*url = healthcheckURL(config.ListenAddr, config.HealthEndpoint)
+	}
+	if *ready {
+		u, err := neturl.Parse(*url)
+		if err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("wunderbase: healthcheck: %w", err))
+		}
+		query := u.Query()
+		query.Set("verbose", "1")
+		u.RawQuery = query.Encode()
+		*url = u.String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *url, nil)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: healthcheck: %w", err))
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalln("load prisma schema", err)
+		return fmt.Errorf("wunderbase: healthcheck: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("wunderbase: healthcheck: %s answered %s", *url, resp.Status)
 	}
-	migrate.Database(config.MigrationEnginePath, config.MigrationLockFilePath, string(schema), config.PrismaSchemaFilePath)
 	return nil
 }
 
-func runServe(ctx context.Context, config *config) (err error) {
+// healthcheckURL returns the url of the health endpoint served on
+// listenAddr. An unspecified host is reached on localhost.
+func healthcheckURL(listenAddr, endpoint string) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "http://" + listenAddr + endpoint
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + endpoint
+}
+
+func runDoctor(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("doctor", config)
+	jsonOutput := fs.Bool("json", false, "print the results as JSON")
+	if err := loadFlags(fs, config, args); err != nil {
+		return err
+	}
+
+	configuration := doctor.Result{Name: "configuration", OK: true, Hard: true}
+	if err := config.Validate(); err != nil {
+		configuration.OK = false
+		configuration.Detail = "\n" + err.Error()
+		configuration.Hint = "fix the settings listed above"
+	}
+	results := append([]doctor.Result{configuration}, doctor.Run(ctx, doctor.Options{
+		QueryEnginePath:       config.QueryEnginePath,
+		MigrationEnginePath:   config.MigrationEnginePath,
+		SchemaPath:            config.PrismaSchemaFilePath,
+		MigrationLockFilePath: config.MigrationLockFilePath,
+		ListenAddr:            config.ListenAddr,
+		QueryEnginePort:       config.QueryEnginePort,
+	})...)
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			status := "ok"
+			switch {
+			case !r.OK && r.Hard:
+				status = "FAIL"
+			case !r.OK:
+				status = "WARN"
+			}
+			fmt.Printf("%-4s %-20s %s\n", status, r.Name, r.Detail)
+			if !r.OK && r.Hint != "" {
+				fmt.Printf("     %-20s hint: %s\n", "", r.Hint)
+			}
+		}
+	}
+	if doctor.Failed(results) {
+		return fmt.Errorf("wunderbase: doctor found problems")
+	}
+	return nil
+}
+
+// runBench load-tests an instance, or with --against-self one it starts on
+// a temporary copy of the schema's database.
+func runBench(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("bench", config)
+	url := fs.String("url", "http://localhost:4466/", "GraphQL endpoint of the instance")
+	queryFile := fs.String("query", "", "file with the GraphQL operation to send")
+	variables := fs.String("variables", "", "JSON object of variables for --query, string values are templates")
+	mixFile := fs.String("mix", "", "YAML file of weighted operations to send instead of --query")
+	concurrency := fs.Int("concurrency", 32, "requests in flight")
+	duration := fs.Duration("duration", 60*time.Second, "how long to send requests")
+	metricsURL := fs.String("metrics-url", "", "metrics endpoint to read rate limiting from, defaults to metrics on the --url host")
+	againstSelf := fs.Bool("against-self", false, "start an instance on a temporary database and bench it")
+	seedFile := fs.String("seed", "", "YAML file of operations run repeat times before the bench, e.g. to insert rows")
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
+	}
+
+	var ops []*bench.Operation
+	switch {
+	case *mixFile != "" && *queryFile != "":
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: bench: --query and --mix can't be combined"))
+	case *mixFile != "":
+		if ops, err = bench.LoadMix(*mixFile); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: bench: %w", err))
+		}
+	case *queryFile != "":
+		query, err := ioutil.ReadFile(*queryFile)
+		if err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: bench: %w", err))
+		}
+		op, err := bench.NewOperation(filepath.Base(*queryFile), string(query), *variables)
+		if err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: bench: %w", err))
+		}
+		ops = []*bench.Operation{op}
+	default:
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: bench: --query or --mix is required"))
+	}
+	var seed []*bench.Operation
+	if *seedFile != "" {
+		if seed, err = bench.LoadMix(*seedFile); err != nil {
+			return withExitCode(exitConfig, fmt.Errorf("wunderbase: bench: seed: %w", err))
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	if *againstSelf {
+		srv, stopServer, err := startBenchServer(ctx, config)
+		if err != nil {
+			return err
+		}
+		defer stopServer()
+		*url = srv.GraphQLURL()
+	}
+	if *metricsURL == "" && config.MetricsEndpoint != "" {
+		if u, err := neturl.Parse(*url); err == nil {
+			u.Path, u.RawQuery = config.MetricsEndpoint, ""
+			*metricsURL = u.String()
+		}
+	}
+	if len(seed) > 0 {
+		if err := bench.Seed(ctx, *url, seed); err != nil {
+			return fmt.Errorf("wunderbase: bench: seed: %w", err)
+		}
+	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-
-	err = queryengine.Run(ctx, wg,
-		config.QueryEnginePath,
-		config.QueryEnginePort,
-		config.PrismaSchemaFilePath,
-		config.Production,
-		config.Debug,
-	)
-	if err != nil {
-		return fmt.Errorf("wunderbase: run query engine: %w", err)
-	}
-
-	slog.InfoCtx(ctx, "Server Listening", slog.String("addr", config.ListenAddr))
-	handler := api.NewHandler(config.EnableSleepMode,
-		config.Production,
-		fmt.Sprintf("http://localhost:%s/", config.QueryEnginePort),
-		fmt.Sprintf("http://localhost:%s/sdl", config.QueryEnginePort),
-		config.HealthEndpoint,
-		config.SleepAfterSeconds,
-		config.ReadLimitSeconds,
-		config.WriteLimitSeconds,
-		stop,
-	)
-
-	srv := http.Server{
-		Addr:    config.ListenAddr,
-		Handler: handler,
+	slog.Info("Benchmarking", slog.String("url", *url), slog.Int("concurrency", *concurrency), slog.Duration("duration", *duration))
+	report, err := bench.Run(ctx, bench.Options{
+		URL:         *url,
+		Operations:  ops,
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		MetricsURL:  *metricsURL,
+	})
+	if err != nil {
+		return fmt.Errorf("wunderbase: bench: %w", err)
 	}
-	go func() {
-		err = srv.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			log.Fatalln("listen and serve", err)
+	report.Write(os.Stdout)
+	return nil
+}
+
+// startBenchServer serves the schema from a fresh database in a temporary
+// directory. The returned func shuts the server down and removes the
+// directory.
+func startBenchServer(ctx context.Context, config *config) (*server.Server, func(), error) {
+	dir, err := ioutil.TempDir("", "wunderbase-bench-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("wunderbase: bench: %w", err)
+	}
+	var srv *server.Server
+	stop := func() {
+		if srv != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = srv.Shutdown(ctx)
 		}
-	}()
-	<-ctx.Done()
-	err = srv.Close()
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("remove bench database", slog.String("error", err.Error()))
+		}
+	}
+	schemaPath, err := migrate.WriteSchemaForDatabase(config.PrismaSchemaFilePath, filepath.Join(dir, "bench.sqlite"), dir)
 	if err != nil {
-		return fmt.Errorf("wunderbase: close server: %w", err)
+		stop()
+		return nil, nil, withExitCode(exitConfig, fmt.Errorf("wunderbase: bench: %w", err))
 	}
-	log.Println("Server stopped")
-	wg.Done()
-	wg.Wait()
+	srv, err = server.New(server.Config{
+		SchemaPath:            schemaPath,
+		QueryEnginePath:       config.QueryEnginePath,
+		MigrationEnginePath:   config.MigrationEnginePath,
+		MigrationLockFilePath: filepath.Join(dir, "migration.lock"),
+		Migrate:               true,
+		Production:            config.Production,
+		Debug:                 config.Debug,
+		API: api.Config{
+			ReadLimitSeconds:  config.ReadLimitSeconds,
+			WriteLimitSeconds: config.WriteLimitSeconds,
+			MetricsEndpoint:   config.MetricsEndpoint,
+		},
+	})
+	if err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("wunderbase: bench: %w", err)
+	}
+	if err := srv.Start(ctx); err != nil {
+		stop()
+		return nil, nil, withExitCode(startExitCode(err), err)
+	}
+	readyCtx := ctx
+	if config.StartupTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		readyCtx, cancel = context.WithTimeout(ctx, time.Duration(config.StartupTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	if err := srv.Ready(readyCtx); err != nil {
+		stop()
+		return nil, nil, withExitCode(exitStartup, fmt.Errorf("wunderbase: bench: query engine not ready: %w", err))
+	}
+	return srv, stop, nil
+}
+
+func runBranch(ctx context.Context, config *config, args []string) (err error) {
+	var cmd string
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "create":
+		fs := newFlagSet("branch create", config)
+		from := fs.String("from", "", "database or backup file to copy, defaults to the schema's database")
+		to := fs.String("to", "", "branch name or path of the copy")
+		if err := parseFlags(fs, config, args); err != nil {
+			return err
+		}
+		if *to == "" {
+			return fmt.Errorf("wunderbase: branch create: --to is required")
+		}
+		if *from == "" {
+			if *from, err = config.databasePath(); err != nil {
+				return fmt.Errorf("wunderbase: resolve database path: %w", err)
+			}
+		}
+		b, err := branch.Create(config.BranchesDir, *from, *to)
+		if err != nil {
+			return fmt.Errorf("wunderbase: branch create: %w", err)
+		}
+		fmt.Println(b.DatasourceURL())
+		return nil
+	case "list":
+		if err := parseFlags(newFlagSet("branch list", config), config, args); err != nil {
+			return err
+		}
+		branches, err := branch.List(config.BranchesDir)
+		if err != nil {
+			return fmt.Errorf("wunderbase: branch list: %w", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tSIZE\tSOURCE")
+		for _, b := range branches {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", b.Name, b.CreatedAt.Format(time.RFC3339), b.Size, b.Source)
+		}
+		return w.Flush()
+	case "delete":
+		fs := newFlagSet("branch delete", config)
+		if err := parseFlags(fs, config, args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("wunderbase: branch delete: expected a branch name")
+		}
+		if err := branch.Delete(config.BranchesDir, fs.Arg(0)); err != nil {
+			return fmt.Errorf("wunderbase: branch delete: %w", err)
+		}
+		return nil
+	case "", "help", "-h", "-help", "--help":
+		printCommandHelp(os.Stderr, findCommand("branch"))
+		return flag.ErrHelp
+	default:
+		return unknownCommand("branch subcommand", cmd, []string{"create", "list", "delete"})
+	}
+}
+
+func runBackup(ctx context.Context, config *config, args []string) (err error) {
+	var cmd string
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "create":
+		fs := newFlagSet("backup create", config)
+		if err := parseFlags(fs, config, args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("wunderbase: backup create: expected a destination file or s3:// url")
+		}
+		keys, err := backupKeys(config)
+		if err != nil {
+			return fmt.Errorf("wunderbase: %w", err)
+		}
+		database, err := config.databasePath()
+		if err != nil {
+			return fmt.Errorf("wunderbase: resolve database path: %w", err)
+		}
+		opts := backup.CreateOptions{Database: database, Destination: fs.Arg(0)}
+		if len(keys) > 0 {
+			opts.Key = keys[0]
+		}
+		// the mutations of the journal made from now on are the ones to
+		// replay on this backup, they start a file of their own
+		if err := journal.Rotate(config.MutationJournal); err != nil {
+			slog.Warn("Rotating the mutation journal", slog.String("error", err.Error()))
+		}
+		since := time.Now().UTC()
+		if err := backup.Create(ctx, opts); err != nil {
+			return fmt.Errorf("wunderbase: backup create: %w", err)
+		}
+		attrs := []interface{}{slog.String("destination", fs.Arg(0)), slog.Bool("encrypted", opts.Key != nil)}
+		if config.MutationJournal != "" {
+			attrs = append(attrs, slog.String("replaySince", since.Format(time.RFC3339Nano)))
+		}
+		slog.Info("Backup created", attrs...)
+		return nil
+	case "restore":
+		fs := newFlagSet("backup restore", config)
+		force := fs.Bool("force", false, "overwrite an existing database")
+		if err := parseFlags(fs, config, args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("wunderbase: backup restore: expected a backup file or url")
+		}
+		keys, err := backupKeys(config)
+		if err != nil {
+			return fmt.Errorf("wunderbase: %w", err)
+		}
+		database, err := config.databasePath()
+		if err != nil {
+			return fmt.Errorf("wunderbase: resolve database path: %w", err)
+		}
+		if _, err := os.Stat(database); err == nil && !*force {
+			return fmt.Errorf("wunderbase: backup restore: %s exists, use --force to overwrite it", database)
+		}
+		if err := backup.Download(ctx, fs.Arg(0), database, keys); err != nil {
+			return fmt.Errorf("wunderbase: backup restore: %w", err)
+		}
+		slog.Info("Backup restored", slog.String("source", fs.Arg(0)), slog.String("database", database))
+		return nil
+	case "verify":
+		return runBackupVerify(ctx, config, args)
+	case "", "help", "-h", "-help", "--help":
+		printCommandHelp(os.Stderr, findCommand("backup"))
+		return flag.ErrHelp
+	default:
+		return unknownCommand("backup subcommand", cmd, []string{"create", "restore", "verify"})
+	}
+}
 
+// runReplay sends the mutations of the journal made after --since, the
+// time of the backup the database was restored from, to a server on the
+// restored database, stopping at the first that doesn't give the response
+// journaled.
+func runReplay(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("replay", config)
+	since := fs.String("since", "", "time the backup was created, RFC 3339, as logged by backup create; the mutations after it are replayed")
+	url := fs.String("url", "", "GraphQL endpoint to replay on, by default a server started on the database of the schema")
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
+	}
+	if config.MutationJournal == "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: replay: WUNDERBASE_MUTATION_JOURNAL is not set"))
+	}
+	if *since == "" {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: replay: --since is required"))
+	}
+	from, err := time.Parse(time.RFC3339Nano, *since)
+	if err != nil {
+		return withExitCode(exitUsage, fmt.Errorf("wunderbase: replay: --since: %w", err))
+	}
+	records, err := journal.Read(config.MutationJournal, from)
+	if err != nil {
+		return fmt.Errorf("wunderbase: replay: read the journal: %w", err)
+	}
+	if len(records) == 0 {
+		slog.Info("No mutations to replay", slog.String("since", from.Format(time.RFC3339Nano)))
+		return nil
+	}
+	if *url == "" {
+		srv, stop, err := startReplayServer(ctx, config)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		*url = srv.GraphQLURL()
+	}
+	slog.Info("Replaying", slog.String("url", *url), slog.Int("mutations", len(records)))
+	replayed, err := journal.Replay(ctx, &http.Client{Timeout: time.Minute}, *url, records)
+	if err != nil {
+		return fmt.Errorf("wunderbase: replay: stopped after %d of %d mutations: %w", replayed, len(records), err)
+	}
+	slog.Info("Replayed", slog.Int("mutations", replayed))
 	return nil
 }
 
-func initLogger(config *config) (err error) {
-	// Enable debug logging, if set by the config.
-	if config.Debug {
-		LogLevel.Set(slog.LevelDebug)
+// startReplayServer serves the database of the schema, as restored, without
+// migrating it. The returned func shuts the server down.
+func startReplayServer(ctx context.Context, config *config) (*server.Server, func(), error) {
+	srv, err := server.New(server.Config{
+		SchemaPath:            config.PrismaSchemaFilePath,
+		QueryEnginePath:       config.QueryEnginePath,
+		MigrationEnginePath:   config.MigrationEnginePath,
+		MigrationLockFilePath: config.MigrationLockFilePath,
+		Production:            true,
+		Debug:                 config.Debug,
+		DatabaseKey:           config.DatabaseKey,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("wunderbase: replay: %w", err)
+	}
+	stop := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}
+	if err := srv.Start(ctx); err != nil {
+		stop()
+		return nil, nil, withExitCode(startExitCode(err), err)
+	}
+	readyCtx := ctx
+	if config.StartupTimeoutSeconds > 0 {
+		var cancel context.CancelFunc
+		readyCtx, cancel = context.WithTimeout(ctx, time.Duration(config.StartupTimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+	if err := srv.Ready(readyCtx); err != nil {
+		stop()
+		return nil, nil, withExitCode(exitStartup, fmt.Errorf("wunderbase: replay: query engine not ready: %w", err))
+	}
+	return srv, stop, nil
+}
+
+func runBackupVerify(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("backup verify", config)
+	query := fs.String("query", "", "verification query returning a single number, e.g. SELECT count(*) FROM User")
+	minResult := fs.Int64("min", 1, "minimum result of the verification query")
+	skipDrift := fs.Bool("skip-drift", false, "don't compare the backup with the schema")
+	jsonOutput := fs.Bool("json", false, "print the report as JSON")
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("wunderbase: backup verify: expected a backup file or url")
+	}
+	keys, err := backupKeys(config)
+	if err != nil {
+		return fmt.Errorf("wunderbase: %w", err)
+	}
+
+	opts := backup.VerifyOptions{
+		Source:              fs.Arg(0),
+		SqlitePath:          config.SqlitePath,
+		MigrationEnginePath: config.MigrationEnginePath,
+		SchemaPath:          config.PrismaSchemaFilePath,
+		Query:               *query,
+		MinResult:           *minResult,
+		Keys:                keys,
+	}
+	if *skipDrift {
+		opts.SchemaPath = ""
+	}
+	report, err := backup.Verify(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("wunderbase: backup verify: %w", err)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(report)
 	}
+	if report.Failed() {
+		return fmt.Errorf("wunderbase: backup verification failed")
+	}
+	return nil
+}
 
+// runRekey changes the key of the encrypted database, after copying it
+// next to itself. wunderbase must not be serving the database meanwhile.
+func runRekey(ctx context.Context, config *config, args []string) (err error) {
+	fs := newFlagSet("rekey", config)
+	newKeyFile := fs.String("new-key-file", "", "file holding the new database key")
+	if err := parseFlags(fs, config, args); err != nil {
+		return err
+	}
+	if config.DatabaseKey == "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: rekey: WUNDERBASE_DATABASE_KEY is required"))
+	}
+	if *newKeyFile == "" {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: rekey: --new-key-file is required"))
+	}
+	newKey, err := readSecretFile(*newKeyFile)
+	if err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("wunderbase: rekey: %w", err))
+	}
+	database, err := config.databasePath()
+	if err != nil {
+		return fmt.Errorf("wunderbase: resolve database path: %w", err)
+	}
+	copied, err := backup.Rekey(ctx, backup.RekeyOptions{
+		SqlitePath: config.SqlitePath,
+		Database:   database,
+		Key:        config.DatabaseKey,
+		NewKey:     newKey,
+	})
+	if err != nil {
+		return fmt.Errorf("wunderbase: %w", err)
+	}
+	slog.Info("Database rekeyed, set WUNDERBASE_DATABASE_KEY to the new key",
+		slog.String("database", database), slog.String("copy", copied))
+	return nil
+}
+
+// backupKeys parses the backup encryption keys. A key file may list one key
+// per line.
+func backupKeys(config *config) ([][]byte, error) {
+	return backup.ParseKeys(strings.ReplaceAll(config.BackupEncryptionKey, "\n", ","))
+}
+
+// logFile is the file logs are written to, if WUNDERBASE_LOG_OUTPUT names one.
+// It is reopened on SIGHUP so logrotate can move it away.
+var logFile *logging.File
+
+// logOutput is where logs are written, for the ready banner.
+var logOutput io.Writer = os.Stderr
+
+func initLogger(config *config) error {
+	setLogLevel(config.Debug)
+
+	w, err := openLogOutput(config)
+	if err != nil {
+		return err
+	}
+	redactor = nil
+	if config.DatabaseKey != "" {
+		// the key is also logged as part of a datasource url
+		redactor = logging.NewRedactingWriter(w, config.DatabaseKey, neturl.QueryEscape(config.DatabaseKey))
+		w = redactor
+	}
+	handler, err := newLogHandler(w, config)
+	if err != nil {
+		return err
+	}
+	logOutput = w
+	if config.LogSampleRate < 1 {
+		handler = logging.NewSamplingHandler(handler, config.LogSampleRate)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// redactor removes secrets from the logs, and the error printed when a
+// command fails.
+var redactor *logging.RedactingWriter
+
+// redact removes secrets from s.
+func redact(s string) string {
+	if redactor == nil {
+		return s
+	}
+	return redactor.Redact(s)
+}
+
+// openLogOutput returns the writer logs go to, opening the log file if
+// configured. A previously opened log file is closed.
+func openLogOutput(config *config) (io.Writer, error) {
+	if logFile != nil {
+		_ = logFile.Close()
+		logFile = nil
+	}
+	switch config.LogOutput {
+	case "", "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	}
+	f, err := logging.OpenFile(config.LogOutput, config.LogMaxSizeMB, config.LogMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	logFile = f
+	return f, nil
+}
+
+// newLogHandler returns the handler for the configured log format writing
+// to w.
+func newLogHandler(w io.Writer, config *config) (slog.Handler, error) {
 	opts := slog.HandlerOptions{Level: &LogLevel}
 
 	if !config.Timestamp {
 		opts.ReplaceAttr = removeTime
 	}
 
-	var handler slog.Handler
 	switch format := config.LogFormat; format {
 	case "text":
-		handler = slog.NewTextHandler(os.Stderr, &opts)
+		return slog.NewTextHandler(w, &opts), nil
 	case "json":
-		handler = slog.NewJSONHandler(os.Stderr, &opts)
+		return slog.NewJSONHandler(w, &opts), nil
+	case "pretty":
+		if isTerminal(w) && os.Getenv("NO_COLOR") == "" {
+			return logging.NewPrettyHandler(w, logging.PrettyOptions{
+				Level: &LogLevel,
+				Time:  config.Timestamp,
+				Color: true,
+			}), nil
+		}
+		return slog.NewTextHandler(w, &opts), nil
 	default:
-		return fmt.Errorf("invalid log format: %q", format)
+		return nil, fmt.Errorf("invalid log format: %q", format)
 	}
+}
 
-	slog.SetDefault(slog.New(handler))
-	return
+// isTerminal reports whether w is a character device, i.e. a terminal.
+func isTerminal(w io.Writer) bool {
+	if r, ok := w.(*logging.RedactingWriter); ok {
+		w = r.Unwrap()
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// setLogLevel enables debug logging, if set by the config.
+func setLogLevel(debug bool) {
+	if debug {
+		LogLevel.Set(slog.LevelDebug)
+	} else {
+		LogLevel.Set(slog.LevelInfo)
+	}
 }
 
 func removeTime(groups []string, a slog.Attr) slog.Attr {
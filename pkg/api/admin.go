@@ -0,0 +1,135 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/migrate"
+)
+
+// adminPrefix is the path prefix of the admin surface. Admin requests are
+// answered before the sleep timer is touched, so operating on an instance
+// doesn't keep it awake.
+const adminPrefix = "/admin/"
+
+// newAdminMux registers the admin endpoints that are enabled by config.
+func (h *Handler) newAdminMux(config Config) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/stats", h.serveStats)
+	mux.HandleFunc("/admin/keepalive", h.serveKeepAlive)
+	mux.HandleFunc("/admin/sleep", h.serveSleep)
+	mux.HandleFunc("/admin/migration", h.serveMigration)
+	mux.HandleFunc("/admin/requests", h.serveRecentRequests)
+	mux.HandleFunc("/admin/capture", h.serveCapture)
+	mux.HandleFunc("/admin/lint", h.serveLint)
+	if config.SupportBundle != nil {
+		mux.HandleFunc("/admin/support-bundle", h.serveSupportBundle)
+	}
+	if config.EnableDMMF {
+		mux.HandleFunc("/admin/dmmf", h.serveDMMF)
+	}
+	if config.EnablePprof {
+		// the pprof handlers expect to be mounted at /debug/pprof/
+		debug := http.NewServeMux()
+		debug.HandleFunc("/debug/pprof/", pprof.Index)
+		debug.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debug.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debug.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debug.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debug.HandleFunc("/debug/vars", serveRuntimeStats)
+		mux.Handle("/admin/debug/", http.StripPrefix("/admin", debug))
+		mux.HandleFunc("/admin/goroutines", serveGoroutines)
+	}
+	return mux
+}
+
+// serveAdmin authenticates admin requests with the admin token. Without a
+// token the admin surface doesn't exist.
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.adminToken, h.plainTextErrors) {
+		return
+	}
+	if _, pattern := h.admin.Handler(r); pattern == "" {
+		writeNotFound(w, r, h.plainTextErrors)
+		return
+	}
+	h.admin.ServeHTTP(w, r)
+}
+
+// authorizeAdmin answers requests not bearing token and reports whether the
+// request may proceed. plain answers with plain text errors.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, token string, plain bool) bool {
+	if token == "" {
+		writeNotFound(w, r, plain)
+		return false
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wunderbase admin"`)
+		writeError(w, plain, http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized")
+		return false
+	}
+	return true
+}
+
+// runtimeStats is the JSON served on /admin/debug/vars.
+type runtimeStats struct {
+	Goroutines    int       `json:"goroutines"`
+	HeapAlloc     uint64    `json:"heapAlloc"`
+	HeapInuse     uint64    `json:"heapInuse"`
+	HeapObjects   uint64    `json:"heapObjects"`
+	Sys           uint64    `json:"sys"`
+	NumGC         uint32    `json:"numGC"`
+	PauseTotal    string    `json:"pauseTotal"`
+	RecentPauses  []string  `json:"recentPauses"`
+	LastGC        time.Time `json:"lastGC"`
+	GoMaxProcs    int       `json:"goMaxProcs"`
+	GCCPUFraction float64   `json:"gcCPUFraction"`
+}
+
+func serveRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := runtimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     m.HeapAlloc,
+		HeapInuse:     m.HeapInuse,
+		HeapObjects:   m.HeapObjects,
+		Sys:           m.Sys,
+		NumGC:         m.NumGC,
+		PauseTotal:    time.Duration(m.PauseTotalNs).String(),
+		RecentPauses:  []string{},
+		GoMaxProcs:    runtime.GOMAXPROCS(0),
+		GCCPUFraction: m.GCCPUFraction,
+	}
+	if m.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).UTC()
+	}
+	// PauseNs is a circular buffer, the most recent pause is at (NumGC+255)%256
+	for i := uint32(0); i < m.NumGC && i < 10; i++ {
+		pause := m.PauseNs[(m.NumGC-1-i)%uint32(len(m.PauseNs))]
+		stats.RecentPauses = append(stats.RecentPauses, time.Duration(pause).String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+// serveGoroutines dumps the stacks of all goroutines for quick deadlock
+// diagnosis.
+func serveGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// migrationStatus is the JSON served on /admin/migration.
+type migrationStatus struct {
+	Failed     bool           `json:"failed"`
+	Error      *migrate.Error `json:"error,omitempty"`
+	InProgress bool           `json:"inProgress"`
+}
@@ -2,140 +2,1389 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"wunderbase/pkg/buildinfo"
 	"wunderbase/pkg/graphiql"
+	"wunderbase/pkg/journal"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/report"
+	"wunderbase/pkg/schedule"
+	"wunderbase/pkg/tracing"
 
 	"github.com/buger/jsonparser"
 	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
 	"github.com/wundergraph/graphql-go-tools/pkg/asttransform"
 	"github.com/wundergraph/graphql-go-tools/pkg/introspection"
 	"go.uber.org/ratelimit"
+	"golang.org/x/exp/slog"
 )
 
+// Config holds the settings the handler is built from.
+type Config struct {
+	EnableSleepMode   bool
+	Production        bool
+	QueryEngineURL    string
+	QueryEngineSdlURL string
+	HealthEndpoint    string
+	MetricsEndpoint   string
+	SleepAfterSeconds int
+	// ReadQuota and WriteQuota cap the reads and writes of a QuotaWindow,
+	// 0 is unlimited. With PersistQuota the counts are kept in a file next
+	// to the database across restarts, and counted even without quotas.
+	ReadQuota    int
+	WriteQuota   int
+	QuotaWindow  time.Duration
+	PersistQuota bool
+	// OperationLimits override the rate limits for operations by name or
+	// by sha256:<hex digest of the query>. With TrustedAuthHeader they only
+	// apply to authenticated callers.
+	OperationLimits map[string]OperationLimit
+	// EngineMaxIdleConns and EngineIdleConnTimeout tune the connections
+	// kept open to the query engine, defaults are used if zero.
+	EngineMaxIdleConns    int
+	EngineIdleConnTimeout time.Duration
+	// EngineConnectRetries is how often a request is sent again while the
+	// query engine refuses connections, EngineConnectBackoff apart. The
+	// backoff also paces the probes waiting for the engine to start, 50ms
+	// if zero.
+	EngineConnectRetries int
+	EngineConnectBackoff time.Duration
+	// KeepAliveMax bounds how long one keepalive keeps the instance awake.
+	KeepAliveMax time.Duration
+	// SleepPreStop is how long the instance keeps running once it decided
+	// to sleep, refusing new requests with 503 and the StopHeader so the
+	// platform's proxy sends them to another instance, before it stops
+	// and drains the requests in flight. StopHeader is left out if empty.
+	SleepPreStop    time.Duration
+	StopHeader      string
+	StopHeaderValue string
+	// SleepResetOn is what resets the sleep timer, SleepResetAll if empty.
+	// Operations named in SleepResetExempt never reset it, like the
+	// queries of a health dashboard.
+	SleepResetOn      string
+	SleepResetExempt  []string
+	ReadLimitSeconds  int
+	WriteLimitSeconds int
+	// DatabaseFilePath is the SQLite file the query engine serves.
+	DatabaseFilePath string
+	// MaxDatabaseSizeMB rejects writes once the database reaches the limit, 0 disables it.
+	MaxDatabaseSizeMB int
+	Metrics           *metrics.Registry
+	// MetricsSinks receive the handler metrics in addition to Metrics.
+	MetricsSinks []MetricsSink
+	// TrustedAuthHeader, when set, requires every GraphQL request to carry
+	// this header and to come from one of TrustedProxies.
+	TrustedAuthHeader string
+	// TrustedScopesHeader carries the scopes granted to the caller, for
+	// the AuthRules. It is only read with TrustedAuthHeader.
+	TrustedScopesHeader string
+	// ModelGrants restricts callers granted scopes like Product:read or
+	// Product:write to the models granted, write granting read too. Callers
+	// without such scopes aren't restricted.
+	ModelGrants bool
+	// TrustedProxies are also believed with the X-Forwarded-Proto header.
+	TrustedProxies []*net.IPNet
+	// PublicURL is the URL clients reach the handler on, for the absolute
+	// URLs it emits. If empty it is derived from each request.
+	PublicURL string
+	// GraphiQLApiURL is the URL the playground sends queries to, the
+	// public URL if empty.
+	GraphiQLApiURL string
+	// AdminToken enables the admin surface under /admin/ for bearers of it.
+	AdminToken string
+	// EnablePprof mounts pprof, runtime stats and goroutine dumps on the
+	// admin surface.
+	EnablePprof bool
+	// RequestTimeout bounds a GraphQL request to the query engine, clients
+	// may only shorten it. 0 is 5 seconds.
+	RequestTimeout time.Duration
+	// SlowRequestThreshold logs requests taking longer as warnings, which
+	// log sampling never drops. Zero disables it.
+	SlowRequestThreshold time.Duration
+	// Reporter is sent panics recovered while serving requests.
+	Reporter *report.Reporter
+	// HealthChecks add components to the verbose health response. A check
+	// named like a built-in component is combined with it.
+	HealthChecks map[string]HealthCheck
+	// RequiredHealthComponents must be ok for the verbose health endpoint to
+	// answer 200, http and query_engine if nil.
+	RequiredHealthComponents []string
+	// BuildInfo is included in the verbose health response.
+	BuildInfo *buildinfo.Info
+	// PeerURLs are the health endpoints of the other instances of a fleet,
+	// whose plain health is included in the verbose health response.
+	PeerURLs []string
+	// ReplicaStaleness is reported on the health response of a replica, for
+	// its peers.
+	ReplicaStaleness func() time.Duration
+	// EnableREST serves CRUD endpoints per model under /rest/.
+	EnableREST bool
+	// Database names the database in metric labels and log lines when a
+	// Router serves several.
+	Database string
+	// ReadOnly rejects mutations, for read replicas.
+	ReadOnly bool
+	// Schedules adds the state of scheduled operations to the admin stats.
+	Schedules *schedule.Scheduler
+	// EnableCDC serves the changes recorded in the database on /changes.
+	// The changes table and its triggers are installed when migrating.
+	EnableCDC bool
+	// SqlitePath is the sqlite3 CLI the change feed is read with.
+	SqlitePath string
+	// EnableSchemaViewer serves a page rendering the models with their row
+	// counts on /schema/viewer, behind the same auth as the playground.
+	EnableSchemaViewer bool
+	// EnableDMMF serves the DMMF of the schema on /admin/dmmf, fetched from
+	// QueryEngineDmmfURL. It exposes the fields hidden from the GraphQL
+	// layer too.
+	EnableDMMF         bool
+	QueryEngineDmmfURL string
+	// IndexAdvice explains the statements of requests slower than
+	// SlowRequestThreshold, as logged by the query engine, and suggests
+	// indexes for the tables they scan.
+	IndexAdvice bool
+	// SafeMutations refuses deleteMany and updateMany mutations without a
+	// where, unless an admin-scoped caller names them in
+	// x-wunderbase-allow-dangerous.
+	SafeMutations bool
+	// MaxResultRows caps the rows of every paginated list field in a query,
+	// 0 disables it. Operations named in MaxResultRowsExempt aren't capped.
+	MaxResultRows       int
+	MaxResultRowsExempt []string
+	// DefaultTake is added as take to the paginated list fields at the
+	// root of an operation without take or first, DefaultNestedTake to the
+	// ones below. 0 disables them. The defaults are capped by
+	// MaxResultRows.
+	DefaultTake       int
+	DefaultNestedTake int
+	// RecentRequests is the number of requests kept for /admin/requests,
+	// 0 disables it. CaptureBodies keeps their query and variables too,
+	// ignored in production.
+	RecentRequests int
+	CaptureBodies  bool
+	// LimitWarningThresholds are the fractions of the quotas, the rate
+	// limits and the database size limit at which a warning is logged, in
+	// ascending order. Nil disables the warnings. With ReportLimitWarnings
+	// they are also sent to the Reporter.
+	LimitWarningThresholds []float64
+	ReportLimitWarnings    bool
+	// SLOs are latency objectives of operations, tracked over their
+	// window. A warning is logged when one burns its budget SLOBurnRate
+	// times faster than the window allows, and with ReportSLOBurns sent to
+	// the Reporter.
+	SLOs           []SLO
+	SLOBurnRate    float64
+	ReportSLOBurns bool
+	// MigrationError is the error the migration engine answered the
+	// migration on start with, served on /admin/migration.
+	MigrationError *migrate.Error
+	// RowFilters are filter templates by model merged into the where
+	// argument of every root field and list relation of the model, as JSON
+	// objects in the shape of the model's where input. Strings like
+	// "$claims.sub" are replaced by the claims of the caller, sub being the
+	// caller the request was authenticated as with TrustedAuthHeader.
+	RowFilters map[string]json.RawMessage
+	// WarmupRuns is how often WarmUp sends WarmupQuery to the query
+	// engine, 0 disables the warm-up. An empty WarmupQuery runs SELECT 1.
+	WarmupRuns  int
+	WarmupQuery string
+	// PlainTextErrors answers the errors of the admin endpoints, unknown
+	// paths and the health endpoint as plain text like before they were
+	// GraphQL errors, for clients depending on it.
+	PlainTextErrors bool
+	// EnableServerTiming adds a Server-Timing header to every response,
+	// with the time spent in the proxy, waiting for the query engine and
+	// queued by the rate limits.
+	EnableServerTiming bool
+	// MaxUploadFileBytes accepts GraphQL multipart requests with files up
+	// to this size, stored base64 encoded in Bytes fields, and serves those
+	// fields on /files/. 0 disables uploads and downloads.
+	// MaxUploadTotalBytes bounds a whole multipart request, ten files if 0.
+	MaxUploadFileBytes  int64
+	MaxUploadTotalBytes int64
+	// FileContentTypes are the content types /files/ serves Bytes fields
+	// with, by Model.field, application/octet-stream if not listed.
+	FileContentTypes map[string]string
+	// AuthRules decide which callers may run which root fields, nil allows
+	// everyone. They can change on Reload.
+	AuthRules *AuthRules
+	// EngineIdleAfter stops the query engine with StopEngine after this
+	// long without requests, while the process keeps listening; the next
+	// request starts it with StartEngine and waits until it answers. It is
+	// meant to be shorter than the sleep timeout. 0 keeps the engine
+	// running.
+	EngineIdleAfter time.Duration
+	StopEngine      func()
+	StartEngine     func() error
+	// Migrate migrates the database while serving, with the query engine
+	// stopped, and starts the engine again; POST /admin/migration runs it
+	// behind the migration gate. A *migrate.Error is the engine rejecting
+	// the schema. Nil disables live migrations.
+	Migrate func(ctx context.Context) error
+	// MigrationWait is how long requests arriving during a live migration
+	// wait for it, 0 turns them away with 503 right away.
+	MigrationWait time.Duration
+	// DisableIntrospection refuses introspection queries. The schema viewer
+	// and the DMMF have their own settings.
+	DisableIntrospection bool
+	// DisableRawQueries refuses queryRaw, executeRaw and runCommandRaw.
+	DisableRawQueries bool
+	// DisableCapture refuses to arm captures on /admin/capture, which keep
+	// full requests and responses of an operation.
+	DisableCapture bool
+	// CaptureDir is where captured exchanges are written as JSON files,
+	// empty keeps them in memory only.
+	CaptureDir string
+	// CaptureMaxBytes caps the bytes a capture keeps, 0 is 1 MiB.
+	CaptureMaxBytes int64
+	// CaptureRedact are the keys whose values are replaced in captured
+	// requests and responses, at any depth.
+	CaptureRedact []string
+	// StorageCheckInterval is how often DatabaseFilePath is stat'ed, 0 is
+	// 5 seconds. When it fails to, or the query engine answers with disk
+	// I/O errors, the instance leaves rotation and refuses writes, and
+	// reads too unless ReadsOnStorageFailure. Once the file stats
+	// again, RestartEngine restarts the query engine and it serves again.
+	StorageCheckInterval  time.Duration
+	ReadsOnStorageFailure bool
+	RestartEngine         func(ctx context.Context) error
+	// HiddenModels and HiddenFields, as Model.field, are left out of the
+	// schema clients see, with the types generated for them, and
+	// requests touching them are refused with FORBIDDEN_FIELD.
+	HiddenModels []string
+	HiddenFields []string
+	// SoftDeleteModels keep their deleted rows: deletes set
+	// SoftDeleteField, a nullable DateTime, deletedAt if empty, and reads
+	// only see the rows where it is null, unless a caller with the admin
+	// scope includes the deleted rows.
+	SoftDeleteModels []string
+	SoftDeleteField  string
+	// WriteQueue is how many writes are sent to the query engine at a
+	// time, the others waiting in arrival order for up to
+	// WriteQueueTimeout, 0 is 5 seconds. Without it writes are sent as
+	// they come. Reads never wait for it.
+	WriteQueue        int
+	WriteQueueTimeout time.Duration
+	// EngineSlots is how many requests are sent to the query engine at a
+	// time, the others waiting in arrival order for up to
+	// EngineQueueTimeout, 0 is 5 seconds. PrioritySlots of them are
+	// reserved for requests sent with X-Wunderbase-Priority: high by a
+	// caller with one of PriorityScopes. Without EngineSlots requests are
+	// sent as they come.
+	EngineSlots        int
+	PrioritySlots      int
+	PriorityScopes     []string
+	EngineQueueTimeout time.Duration
+	// Journal records the mutations answered without errors, with the id
+	// fields of their responses, so they can be replayed on a restored
+	// backup. Nil records none.
+	Journal *journal.Writer
+	// LogExcludePaths and MetricsExcludePaths are left out of the access
+	// log and the request metrics, exact paths or prefixes ending with *.
+	// Requests whose User-Agent starts with one of ExcludeUserAgents are
+	// left out of both. Failed requests are logged anyway.
+	LogExcludePaths     []string
+	MetricsExcludePaths []string
+	ExcludeUserAgents   []string
+	// HedgeReads sends a read again when the query engine hasn't answered
+	// it after HedgeAfter, or if zero after the HedgePercentile of the
+	// durations of recent reads, answering with the first response and
+	// canceling the other. Mutations are never hedged, and the copy waits
+	// for the read limit like any read.
+	HedgeReads      bool
+	HedgeAfter      time.Duration
+	HedgePercentile float64
+	// CoalesceReads makes identical GraphQL reads arriving while one of
+	// them waits for the query engine share its answer, each writing its
+	// own copy. At most CoalesceMaxWaiters, 100 if zero, wait for one
+	// read, more are sent on their own. Mutations are never coalesced, and
+	// reads aren't while one is in flight.
+	CoalesceReads      bool
+	CoalesceMaxWaiters int
+	// TimeTravel starts a query engine on the backup written closest
+	// before a time, for POST /timetravel with the admin token. It returns
+	// ErrNoSnapshot and ErrTimeTravelBusy as they are. Nil disables the
+	// endpoint.
+	TimeTravel func(ctx context.Context, at time.Time) (*TimeTravelEngine, error)
+	// SupportBundle collects the configuration, versions, engine log and
+	// database state for GET /admin/support-bundle, which adds what the
+	// handler knows. Nil disables the endpoint.
+	SupportBundle SupportBundleFunc
+	// StaticDir is a directory of files, like a built frontend, served on
+	// GET requests under StaticPathPrefix, /static/ if empty, with the
+	// index.html of the root for paths without an extension. The routes of
+	// the API come first. Files and directories starting with a dot are only
+	// served with StaticDotfiles, and the files only reset the sleep timer
+	// with StaticKeepsAwake.
+	StaticDir        string
+	StaticPathPrefix string
+	StaticDotfiles   bool
+	StaticKeepsAwake bool
+	// EnableCount serves GET /count/{model} and /exists/{model}, cached for
+	// CountCacheTTL, 0 disables the cache, until a write to the model.
+	EnableCount   bool
+	CountCacheTTL time.Duration
+	// RefuseWritesOnSchemaDrift refuses writes with SCHEMA_DRIFT while
+	// the database differs from the schema, see SetSchemaDrift.
+	RefuseWritesOnSchemaDrift bool
+	// Shared is the handler of another endpoint serving the same query
+	// engine, like the public endpoint next to the internal one. Its sleep
+	// timer, idle engine, migration gate, schema cache, admin surface,
+	// stats and metrics are used instead of the handler's own, while auth,
+	// limits, quotas and the feature toggles are the handler's own. Only
+	// the shared handler is paused, reloaded and closed for both.
+	Shared *Handler
+}
+
 type Handler struct {
-	enableSleepMode   bool
-	enablePlayground  bool
-	queryEngineURL    string
-	queryEngineSdlURL string
-	healthEndpoint    string
-	sleepAfterSeconds int
-	init              sync.Once
-	sleepCh           chan struct{}
-	client            *http.Client
-	readLimit         ratelimit.Limiter
-	writeLimit        ratelimit.Limiter
-	cancel            func()
-}
-
-func NewHandler(enableSleepMode bool, production bool, queryEngineURL string, queryEngineSdlURL, healthEndpoint string, sleepAfterSeconds, readLimitSeconds, writeLimitSeconds int, cancel func()) *Handler {
-	return &Handler{
-		enableSleepMode:   enableSleepMode,
-		enablePlayground:  !production,
-		queryEngineURL:    queryEngineURL,
-		queryEngineSdlURL: queryEngineSdlURL,
-		healthEndpoint:    healthEndpoint,
-		sleepCh:           make(chan struct{}),
-		sleepAfterSeconds: sleepAfterSeconds,
-		client: &http.Client{
-			Timeout: 5 * time.Second,
-		},
-		readLimit:  ratelimit.New(readLimitSeconds),
-		writeLimit: ratelimit.New(writeLimitSeconds),
-		cancel:     cancel,
+	// limits holds the *rateLimits, replaced as a whole on Reload so a
+	// request never sees the limiter of one config with the rate of another
+	limits atomic.Value
+	// sleep is the sleep timer, shared with the handlers sharing h
+	sleep              *sleepTimer
+	enableSleepMode    bool
+	enablePlayground   bool
+	queryEngineURL     string
+	queryEngineSdlURL  string
+	queryEngineDmmfURL string
+	healthEndpoint     string
+	metricsEndpoint    string
+	init               sync.Once
+	started            chan struct{} // closed once start returned
+	sleepNow           chan struct{}
+	sleepEvents        *sleepHistory
+	keepAliveMax       time.Duration
+	client             *http.Client
+	databaseSize       *sizeGuard
+	metrics            *metrics.Registry
+	sink               MetricsSink
+	auth               *trustedHeaderAuth
+	adminToken         string
+	admin              *http.ServeMux
+	slowRequest        time.Duration
+	requestTimeout     time.Duration
+	reporter           *report.Reporter
+	stats              *queryStats
+	healthChecks       map[string]HealthCheck
+	requiredHealth     []string
+	buildInfo          *buildinfo.Info
+	peers              *peerChecker
+	replicaStaleness   func() time.Duration
+	enableREST         bool
+	database           string
+	readOnly           bool
+	schedules          *schedule.Scheduler
+	enableCDC          bool
+	sqlitePath         string
+	databaseFile       string
+	// paused is set while the database file is swapped, accessed atomically
+	paused int32
+	// restModels is set once the engine is up, by model name in lower case
+	restModels         map[string]restModel
+	openAPI            []byte
+	enableSchemaViewer bool
+	// schemaCache holds a *schemaCache once the engine answered
+	schemaCache       *atomic.Value
+	maxResultRows     int
+	rowsExempt        map[string]bool
+	defaultTake       int
+	defaultNestedTake int
+	// quota is nil without quotas or their persistence
+	quota           *quota
+	operationLimits map[string]*operationLimiter
+	publicBaseURL   string
+	graphiQLApiURL  string
+	trustedProxies  []*net.IPNet
+	connectRetries  int
+	connectBackoff  time.Duration
+	// recent is nil if no requests are kept
+	recent        *recentRequests
+	errorRates    *errorRates
+	safeMutations bool
+	// indexAdvice is nil without index advice
+	indexAdvice   *indexAdvisor
+	captureBodies bool
+	// capture is nil with captures disabled
+	capture *capturer
+	// schemaWatchers are the streams of /schema/version
+	schemaWatchers *schemaWatchers
+	// storage is nil without a database file
+	storage       *storageGuard
+	storageReads  bool
+	restartEngine func(ctx context.Context) error
+	// visibility is nil without hidden models and fields
+	visibility *visibility
+	// modelGrants restricts the callers with model grants to their models
+	modelGrants bool
+	// softDelete is nil without soft deleted models
+	softDelete *softDelete
+	// writeQueue is nil without a write queue
+	writeQueue *writeQueue
+	// pools is nil without engine slots
+	pools *enginePools
+	// journal is nil without a mutation journal
+	journal *journal.Writer
+	// hedge is nil without hedged reads
+	hedge *hedger
+	// coalesce is nil without coalesced reads
+	coalesce *coalescer
+	// preStopping is set during the pre-stop delay, accessed atomically
+	preStopping     int32
+	sleepPreStop    time.Duration
+	stopHeader      string
+	stopHeaderValue string
+	// timeTravel is nil without time-travel reads
+	timeTravel func(ctx context.Context, at time.Time) (*TimeTravelEngine, error)
+	// exclusions is nil without exclusion rules
+	exclusions *exclusions
+	// incremental is whether the engine streams @defer and @stream,
+	// accessed atomically
+	incremental int32
+	// limitWarnings is nil without thresholds
+	limitWarnings *limitWarnings
+	// slos is nil without SLOs
+	slos                *slos
+	readRate, writeRate rateWindow
+	// rowFilters are the decoded RowFilters, nil without any
+	rowFilters map[string]interface{}
+	// warmingUp is set during WarmUp, accessed atomically; warmup holds
+	// the *warmupStats of the latest
+	warmingUp        int32
+	warmup           atomic.Value
+	warmupRuns       int
+	warmupQuery      string
+	sleepResetOn     string
+	sleepResetExempt map[string]bool
+	plainTextErrors  bool
+	serverTiming     bool
+	// maxUploadFile enables uploads and downloads of Bytes fields
+	maxUploadFile    int64
+	maxUploadTotal   int64
+	fileContentTypes map[string]string
+	// authRules holds the *AuthRules, nil without any
+	authRules atomic.Value
+	// engineIdle is nil if the engine isn't stopped when idle
+	engineIdle *engineIdle
+	// gate turns requests away during live migrations, which migrate runs
+	gate          *migrationGate
+	migrate       func(ctx context.Context) error
+	migrationWait time.Duration
+	cancel        func()
+	// shared is Config.Shared, nil if the handler owns its state
+	shared               *Handler
+	disableIntrospection bool
+	disableRawQueries    bool
+	supportBundle        SupportBundleFunc
+	// static is nil without a static directory
+	static *staticFiles
+	// counts caches the answers of /count/ and /exists/
+	enableCount bool
+	counts      *countCache
+	// drift is the latest comparison of the database with the schema
+	drift *schemaDrift
+	// lintRules are the rules /admin/lint checks operations against
+	lintRules LintRules
+}
+
+func NewHandler(config Config, cancel func()) *Handler {
+	registry := config.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	h := &Handler{
+		enableSleepMode:    config.EnableSleepMode,
+		enablePlayground:   !config.Production,
+		queryEngineURL:     config.QueryEngineURL,
+		queryEngineSdlURL:  config.QueryEngineSdlURL,
+		queryEngineDmmfURL: config.QueryEngineDmmfURL,
+		healthEndpoint:     config.HealthEndpoint,
+		metricsEndpoint:    config.MetricsEndpoint,
+		started:            make(chan struct{}),
+		sleepNow:           make(chan struct{}, 1),
+		sleepEvents:        &sleepHistory{},
+		keepAliveMax:       config.KeepAliveMax,
+		sleepPreStop:       config.SleepPreStop,
+		stopHeader:         config.StopHeader,
+		stopHeaderValue:    config.StopHeaderValue,
+		sleep:              newSleepTimer(time.Duration(config.SleepAfterSeconds) * time.Second),
+		databaseSize:       newSizeGuard(config.DatabaseFilePath, config.MaxDatabaseSizeMB),
+		metrics:            registry,
+		adminToken:         config.AdminToken,
+		slowRequest:        config.SlowRequestThreshold,
+		reporter:           config.Reporter,
+		stats:              newQueryStats(),
+		healthChecks:       config.HealthChecks,
+		buildInfo:          config.BuildInfo,
+		peers:              newPeerChecker(config.PeerURLs),
+		replicaStaleness:   config.ReplicaStaleness,
+		enableREST:         config.EnableREST,
+		database:           config.Database,
+		readOnly:           config.ReadOnly,
+		schedules:          config.Schedules,
+		enableCDC:          config.EnableCDC,
+		sqlitePath:         config.SqlitePath,
+		databaseFile:       config.DatabaseFilePath,
+		cancel:             cancel,
+
+		enableSchemaViewer: config.EnableSchemaViewer,
+		maxResultRows:      config.MaxResultRows,
+		rowsExempt:         map[string]bool{},
+		defaultTake:        config.DefaultTake,
+		defaultNestedTake:  config.DefaultNestedTake,
+		warmupRuns:         config.WarmupRuns,
+		warmupQuery:        config.WarmupQuery,
+		plainTextErrors:    config.PlainTextErrors,
+		serverTiming:       config.EnableServerTiming,
+		maxUploadFile:      config.MaxUploadFileBytes,
+		maxUploadTotal:     config.MaxUploadTotalBytes,
+		fileContentTypes:   config.FileContentTypes,
+		connectRetries:     config.EngineConnectRetries,
+		connectBackoff:     config.EngineConnectBackoff,
+	}
+	if h.connectBackoff <= 0 {
+		h.connectBackoff = defaultEngineConnectBackoff
+	}
+	if h.warmupQuery == "" {
+		h.warmupQuery = defaultWarmupQuery
+	}
+	if h.maxUploadTotal <= 0 {
+		h.maxUploadTotal = 10 * h.maxUploadFile
+	}
+	h.sleepResetOn, h.sleepResetExempt = config.SleepResetOn, map[string]bool{}
+	if h.sleepResetOn == "" {
+		h.sleepResetOn = SleepResetAll
 	}
+	for _, name := range config.SleepResetExempt {
+		h.sleepResetExempt[name] = true
+	}
+	if config.RecentRequests > 0 {
+		h.recent = newRecentRequests(config.RecentRequests)
+		h.captureBodies = config.CaptureBodies && !config.Production
+	}
+	for _, name := range config.MaxResultRowsExempt {
+		h.rowsExempt[name] = true
+	}
+	h.requiredHealth = append([]string(nil), config.RequiredHealthComponents...)
+	if config.RequiredHealthComponents == nil {
+		h.requiredHealth = []string{"http", "query_engine"}
+	}
+	sort.Strings(h.requiredHealth)
+	h.admin = h.newAdminMux(config)
+	h.limits.Store(newRateLimits(config))
+	if config.TrustedAuthHeader != "" {
+		h.auth = &trustedHeaderAuth{header: config.TrustedAuthHeader, scopesHeader: config.TrustedScopesHeader, proxies: config.TrustedProxies}
+	}
+
+	if h.database == "" {
+		h.sink = append(multiSink{newRegistrySink(registry)}, config.MetricsSinks...)
+	} else {
+		h.sink = databaseSink{h.database, append(multiSink{newRegistrySink(registry, "database")}, config.MetricsSinks...)}
+	}
+	h.operationLimits = newOperationLimiters(config.OperationLimits)
+	h.publicBaseURL, h.graphiQLApiURL, h.trustedProxies = config.PublicURL, config.GraphiQLApiURL, config.TrustedProxies
+	if config.ReadQuota > 0 || config.WriteQuota > 0 || config.PersistQuota {
+		var path string
+		if config.PersistQuota && config.DatabaseFilePath != "" {
+			path = config.DatabaseFilePath + "-limits.json"
+		}
+		var err error
+		if h.quota, err = newQuota(config.QuotaWindow, config.ReadQuota, config.WriteQuota, path); err != nil {
+			slog.Error("Starting a new limit window", slog.String("error", err.Error()))
+		}
+	}
+	var reporter *report.Reporter
+	if config.ReportLimitWarnings {
+		reporter = config.Reporter
+	}
+	h.limitWarnings = newLimitWarnings(config.LimitWarningThresholds, reporter, h.sink)
+	reporter = nil
+	if config.ReportSLOBurns {
+		reporter = config.Reporter
+	}
+	h.slos = newSLOs(config.SLOs, config.SLOBurnRate, reporter, h.sink)
+	h.rowFilters = newRowFilters(config.RowFilters)
+	h.authRules.Store(config.AuthRules)
+	h.engineIdle = newEngineIdle(config.EngineIdleAfter, config.StopEngine, config.StartEngine)
+	h.gate = &migrationGate{failed: config.MigrationError}
+	h.migrate, h.migrationWait = config.Migrate, config.MigrationWait
+	h.requestTimeout = config.RequestTimeout
+	if h.requestTimeout <= 0 {
+		h.requestTimeout = defaultRequestTimeout
+	}
+	h.client = &http.Client{
+		Timeout:   h.requestTimeout,
+		Transport: countingTransport{newEngineTransport(config.EngineMaxIdleConns, config.EngineIdleConnTimeout), h.sink},
+	}
+	h.errorRates = newErrorRates()
+	h.enableCount, h.counts = config.EnableCount, newCountCache(config.CountCacheTTL)
+	h.drift = &schemaDrift{refuseWrites: config.RefuseWritesOnSchemaDrift}
+	var err error
+	if h.static, err = newStaticFiles(config.StaticDir, config.StaticPathPrefix, config.StaticDotfiles, config.StaticKeepsAwake); err != nil {
+		slog.Error("Serving static files", slog.String("error", err.Error()))
+	}
+	h.safeMutations = config.SafeMutations
+	h.indexAdvice = newIndexAdvisor(config.IndexAdvice && config.SlowRequestThreshold > 0)
+	h.schemaCache = &atomic.Value{}
+	h.schemaWatchers = newSchemaWatchers()
+	h.capture = newCapturer(config)
+	h.storage = newStorageGuard(config.DatabaseFilePath, config.StorageCheckInterval)
+	h.storageReads, h.restartEngine = config.ReadsOnStorageFailure, config.RestartEngine
+	h.disableIntrospection, h.disableRawQueries = config.DisableIntrospection, config.DisableRawQueries
+	h.visibility = newVisibility(config.HiddenModels, config.HiddenFields)
+	h.modelGrants = config.ModelGrants
+	h.softDelete = newSoftDelete(config.SoftDeleteModels, config.SoftDeleteField)
+	h.writeQueue = newWriteQueue(config.WriteQueue, config.WriteQueueTimeout)
+	h.pools = newEnginePools(config.EngineSlots, config.PrioritySlots, config.PriorityScopes, config.EngineQueueTimeout)
+	h.journal = config.Journal
+	h.timeTravel = config.TimeTravel
+	h.supportBundle = config.SupportBundle
+	h.hedge = newHedger(config.HedgeReads, config.HedgeAfter, config.HedgePercentile)
+	h.coalesce = newCoalescer(config.CoalesceReads, config.CoalesceMaxWaiters)
+	h.exclusions = newExclusions(config.LogExcludePaths, config.MetricsExcludePaths, config.ExcludeUserAgents)
+	h.lintRules = LintRules{
+		DisableIntrospection: config.DisableIntrospection,
+		DisableRawQueries:    config.DisableRawQueries,
+		SafeMutations:        config.SafeMutations,
+		ReadOnly:             config.ReadOnly,
+		HiddenModels:         config.HiddenModels,
+		HiddenFields:         config.HiddenFields,
+		SoftDeleteModels:     config.SoftDeleteModels,
+		SoftDeleteField:      config.SoftDeleteField,
+		DefaultTake:          config.DefaultTake,
+		MaxResultRows:        config.MaxResultRows,
+	}
+	if config.Shared != nil {
+		h.share(config.Shared)
+		return h
+	}
+	h.registerGauges(registry)
+	return h
+}
+
+// share makes h use the state of shared, the handler of another endpoint
+// serving the same query engine.
+func (h *Handler) share(shared *Handler) {
+	h.shared = shared
+	h.enableSleepMode, h.sleep, h.sleepEvents = shared.enableSleepMode, shared.sleep, shared.sleepEvents
+	h.engineIdle, h.gate, h.schemaCache, h.schemaWatchers = shared.engineIdle, shared.gate, shared.schemaCache, shared.schemaWatchers
+	h.admin, h.metrics, h.sink = shared.admin, shared.metrics, shared.sink
+	h.stats, h.errorRates, h.recent, h.indexAdvice = shared.stats, shared.errorRates, shared.recent, shared.indexAdvice
+	h.databaseSize, h.capture, h.storage = shared.databaseSize, shared.capture, shared.storage
+	// the schema cache holds the schema pruned and indexed for the shared
+	// handler
+	h.visibility, h.softDelete, h.modelGrants = shared.visibility, shared.softDelete, shared.modelGrants
+	// both endpoints write to the same database through the same engine
+	h.writeQueue, h.pools = shared.writeQueue, shared.pools
+	h.journal = shared.journal
+	h.peers = shared.peers
+	// the delay is derived from the reads of both endpoints
+	h.hedge = shared.hedge
+	// reads of both endpoints wait for the writes of both
+	h.coalesce = shared.coalesce
+	h.slos = shared.slos
+}
+
+// owner is the handler holding the sleep timer and the pause state, the
+// shared one if any.
+func (h *Handler) owner() *Handler {
+	if h.shared != nil {
+		return h.shared
+	}
+	return h
+}
+
+func (h *Handler) registerGauges(registry *metrics.Registry) {
+	gauges := []struct {
+		name, help string
+		fn         func() float64
+	}{
+		{"wunderbase_database_size_bytes", "Size of the SQLite database including its WAL.",
+			func() float64 { return float64(h.databaseSize.Size()) }},
+		{"wunderbase_database_size_limit_bytes", "Configured database size limit, 0 when unlimited.",
+			func() float64 { return float64(h.databaseSize.Limit()) }},
+		{"wunderbase_database_size_used_ratio", "Fraction of the database size limit in use.",
+			h.databaseSize.UsedRatio},
+		{"wunderbase_graphql_error_ratio", "Fraction of the GraphQL responses of the last minute with errors.",
+			func() float64 { return h.errorRates.ratio(time.Now()) }},
+		{"wunderbase_write_queue_depth", "Writes waiting for their turn in the write queue.",
+			func() float64 { return float64(h.writeQueue.depth()) }},
+		{"wunderbase_journal_buffer_depth", "Mutations waiting to be written to the mutation journal.",
+			func() float64 { return float64(h.journal.Depth()) }},
+		{"wunderbase_schema_drift", "1 while the database differs from the schema, as last compared.",
+			func() float64 {
+				if h.owner().drift.drifted() {
+					return 1
+				}
+				return 0
+			}},
+	}
+	for _, g := range gauges {
+		if h.database == "" {
+			registry.GaugeFunc(g.name, g.help, g.fn)
+		} else {
+			registry.Gauge(g.name, g.help, "database").Func(g.fn, h.database)
+		}
+	}
+	if h.pools != nil {
+		labels := []string{"pool"}
+		if h.database != "" {
+			labels = []string{"database", "pool"}
+		}
+		inFlight := registry.Gauge("wunderbase_engine_pool_in_flight", "Requests in the query engine by engine pool, general or priority.", labels...)
+		depth := registry.Gauge("wunderbase_engine_pool_queue_depth", "Requests waiting for a slot of their engine pool, general or priority.", labels...)
+		for _, pool := range []struct {
+			name  string
+			queue *writeQueue
+		}{{poolGeneral, h.pools.general}, {poolPriority, h.pools.priority}} {
+			queue, values := pool.queue, []string{pool.name}
+			if h.database != "" {
+				values = []string{h.database, pool.name}
+			}
+			inFlight.Func(func() float64 { return float64(queue.busy()) }, values...)
+			depth.Func(func() float64 { return float64(queue.depth()) }, values...)
+		}
+	}
+	if h.slos == nil {
+		return
+	}
+	labels := []string{"operation"}
+	if h.database != "" {
+		labels = []string{"database", "operation"}
+	}
+	burn := registry.Gauge("wunderbase_slo_burn_rate", "How many times faster than its window allows an SLO spends its latency budget.", labels...)
+	compliance := registry.Gauge("wunderbase_slo_compliance", "Fraction of the requests of the window of an SLO answered within its threshold.", labels...)
+	for _, name := range h.slos.names {
+		tracker := h.slos.byOperation[name]
+		values := []string{name}
+		if h.database != "" {
+			values = []string{h.database, name}
+		}
+		burn.Func(func() float64 { return tracker.status(time.Now()).BurnRate }, values...)
+		compliance.Func(func() float64 { return tracker.status(time.Now()).Compliance }, values...)
+	}
+}
+
+// Pause answers requests with 503 until Resume is called, e.g. while the
+// database file is replaced. Health, metrics and admin endpoints are still
+// served.
+func (h *Handler) Pause() {
+	atomic.StoreInt32(&h.paused, 1)
+}
+
+// Resume serves requests again after Pause.
+func (h *Handler) Resume() {
+	// the new database may come with a new schema
+	h.schemaCache.Store((*schemaCache)(nil))
+	h.counts.invalidate(nil)
+	h.refreshSchema()
+	atomic.StoreInt32(&h.paused, 0)
+}
+
+// Reload applies the settings that are safe to change while serving: rate
+// limits, the sleep timeout, the database size limit and the auth rules.
+// Everything else in config is ignored.
+func (h *Handler) Reload(config Config) {
+	h.limits.Store(newRateLimits(config))
+	h.sleep.setAfter(time.Duration(config.SleepAfterSeconds) * time.Second)
+	h.databaseSize.SetLimit(config.MaxDatabaseSizeMB)
+	h.reloadAuthRules(config.AuthRules)
 }
 
 type IntrospectionResponse struct {
 	Data introspection.Data `json:"data"`
 }
 
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.init.Do(func() {
+// Introspect generates the JSON introspection response for a schema SDL as
+// served by the query engine on /sdl.
+func Introspect(schemaSDL []byte) ([]byte, error) {
+	doc, report := astparser.ParseGraphqlDocumentBytes(schemaSDL)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	if err := asttransform.MergeDefinitionWithBaseSchema(&doc); err != nil {
+		return nil, err
+	}
+	var response IntrospectionResponse
+	introspection.NewGenerator().Generate(&doc, &report, &response.Data)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("generate introspection: %s", report.Error())
+	}
+	return json.Marshal(response)
+}
+
+// start runs the sleep timer and waits for the engine, before the first
+// request is served.
+func (h *Handler) start() {
+	if h.shared != nil {
+		// the timers run in the shared handler
+		h.shared.begin()
+		<-h.shared.started
+	} else {
 		if h.enableSleepMode {
 			go h.runSleepMode()
 		}
-		for {
-			resp, err := http.Get(h.queryEngineURL)
-			if err != nil || resp.StatusCode != http.StatusOK {
-				time.Sleep(3 * time.Millisecond)
-				continue
-			}
-			break
+		if h.engineIdle != nil {
+			go h.runEngineIdle()
+		}
+		if h.indexAdvice != nil {
+			go h.runIndexAdvice()
+		}
+		if h.storage != nil {
+			go h.runStorageCheck()
+		}
+	}
+	for {
+		resp, err := h.client.Get(h.queryEngineURL)
+		if err == nil {
+			drain(resp)
 		}
+		if err != nil || resp.StatusCode != http.StatusOK {
+			time.Sleep(h.connectBackoff)
+			continue
+		}
+		break
+	}
+	if h.shared == nil {
+		// the version header is there from the first response
+		h.refreshSchema()
+	}
+	if h.enableREST {
+		h.loadREST()
+	}
+}
+
+// begin runs start in the background, once.
+func (h *Handler) begin() {
+	h.init.Do(func() {
+		go func() {
+			h.start()
+			close(h.started)
+		}()
 	})
+}
+
+// waitStarted starts the handler if it isn't yet and waits for it up to the
+// request timeout. It reports whether the handler started.
+func (h *Handler) waitStarted(ctx context.Context) bool {
+	h.begin()
+	select {
+	case <-h.started:
+		return true
+	default:
+	}
+	timer := time.NewTimer(h.requestTimeout)
+	defer timer.Stop()
+	select {
+	case <-h.started:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the first request starts the sleep timer, health checks included
+	h.begin()
+
+	trace := tracing.FromRequest(r)
+	r = r.WithContext(tracing.NewContext(r.Context(), trace))
+	w.Header().Set(tracing.RequestIDHeader, trace.RequestID)
+	r = h.excludeRequest(r)
+	if h.serverTiming {
+		w, r = withServerTiming(w, r)
+	}
+	defer h.recoverPanic(w, r)
 
 	if r.URL.Path == h.healthEndpoint {
 		// explicitly do this before the sleep mode check
 		// otherwise the sleep mode will never be triggered
-		resp, err := http.Get(h.queryEngineURL)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte("query engine not reachable"))
-			return
+		h.owner().serveHealth(w, r)
+		return
+	}
+
+	if h.metricsEndpoint != "" && r.URL.Path == h.metricsEndpoint {
+		h.metrics.Handler().ServeHTTP(w, r)
+		return
+	}
+
+	if h.stopping() {
+		h.refuseStopping(w, r)
+		return
+	}
+
+	// everything else depends on the state built once the engine answered
+	if !h.waitStarted(r.Context()) {
+		tracing.Logger(r.Context()).Warn("Rejecting a request before the query engine answered", slog.String("path", r.URL.Path))
+		h.sink.Count(metricStartingRejections, 1)
+		w.Header().Set("Retry-After", "1")
+		writeError(w, h.plainTextErrors, http.StatusServiceUnavailable, "STARTING", "the server is starting, retry shortly")
+		return
+	}
+	if cached, ok := h.schemaCache.Load().(*schemaCache); ok && cached != nil {
+		w.Header().Set(SchemaVersionHeader, cached.version)
+	}
+
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		h.serveAdmin(w, r)
+		return
+	}
+
+	if h.timeTravel != nil && r.URL.Path == timeTravelPath {
+		// an admin endpoint, on an engine of its own
+		h.serveTimeTravel(w, r)
+		return
+	}
+
+	if r.URL.Path == schemaVersionPath {
+		// served during swaps and migrations, whose changes its stream
+		// announces, and without keeping the instance awake
+		if h.auth != nil {
+			if r = h.auth.authenticate(w, r); r == nil {
+				return
+			}
 		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
+		h.serveSchemaVersion(w, r)
 		return
 	}
 
+	if h.static != nil && h.static.matches(r) && !h.apiRoute(r.URL.Path) {
+		// served during swaps and migrations, they don't touch the
+		// database, and without auth, the frontend logs in
+		if h.enableSleepMode && h.static.keepsAwake {
+			defer h.resetSleep(r.Context(), &sleepActivity{Type: "static"})
+		}
+		h.static.serve(w, r)
+		return
+	}
+
+	if atomic.LoadInt32(&h.owner().paused) == 1 {
+		w.Header().Set("Retry-After", "1")
+		if strings.HasPrefix(r.URL.Path, restPrefix) {
+			writeRESTError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the database is being replaced, retry shortly")
+		} else {
+			writeGraphQLError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the database is being replaced, retry shortly")
+		}
+		return
+	}
+
+	if !h.gate.enter(r.Context(), h.migrationWait) {
+		w.Header().Set("Retry-After", "1")
+		if strings.HasPrefix(r.URL.Path, restPrefix) {
+			writeRESTError(w, http.StatusServiceUnavailable, "MIGRATION_IN_PROGRESS", "the database is being migrated, retry shortly")
+		} else {
+			writeGraphQLError(w, http.StatusServiceUnavailable, "MIGRATION_IN_PROGRESS", "the database is being migrated, retry shortly")
+		}
+		return
+	}
+	defer h.gate.leave()
+
+	// activity is filled in as the request is served, it decides whether
+	// the request resets the sleep timer
+	var activity sleepActivity
 	if h.enableSleepMode {
-		defer func() {
-			h.sleepCh <- struct{}{}
-		}()
+		defer func() { h.resetSleep(r.Context(), &activity) }()
+	}
+
+	if h.auth != nil {
+		if r = h.auth.authenticate(w, r); r == nil {
+			return
+		}
+	}
+	r = h.withPriority(r)
+
+	if h.engineIdle != nil {
+		if err := h.acquireEngine(r.Context()); err != nil {
+			tracing.Logger(r.Context()).Error("Starting the idle query engine", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusServiceUnavailable, "ENGINE_UNAVAILABLE", "the query engine could not be started")
+			return
+		}
+		defer h.releaseEngine()
 	}
 
-	if h.enablePlayground && r.Header.Get("Content-Type") != "application/json" {
+	if h.enableREST && strings.HasPrefix(r.URL.Path, restPrefix) {
+		activity.Type, activity.Write = "rest", r.Method != http.MethodGet
+		h.serveREST(w, r)
+		return
+	}
+
+	if h.enableCount && (strings.HasPrefix(r.URL.Path, countPrefix) || strings.HasPrefix(r.URL.Path, existsPrefix)) {
+		activity.Type = "count"
+		h.serveCount(w, r)
+		return
+	}
+
+	if h.enableCDC && r.URL.Path == changesPath {
+		activity.Type = "changes"
+		h.serveChanges(w, r)
+		return
+	}
+
+	if h.enableSchemaViewer && strings.HasPrefix(r.URL.Path, schemaViewerPath) {
+		activity.Type = "schema_viewer"
+		h.serveSchemaViewer(w, r)
+		return
+	}
+
+	if h.maxUploadFile > 0 && strings.HasPrefix(r.URL.Path, filesPrefix) {
+		activity.Type = "file"
+		h.serveFile(w, r)
+		return
+	}
+
+	upload := h.maxUploadFile > 0 && isUpload(r)
+	if h.enablePlayground && !upload && r.Header.Get("Content-Type") != "application/json" {
+		activity.Type = "playground"
 		w.Header().Add("Content-Type", "text/html")
-		html := graphiql.GetGraphiqlPlaygroundHTML(r.RequestURI)
+		html := graphiql.GetGraphiqlPlaygroundHTML(h.playgroundAPIURL(r))
 		_, _ = w.Write([]byte(html))
 		return
 	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
+	var (
+		body []byte
+		err  error
+	)
+	if upload {
+		var files int
+		if body, files, err = h.readUpload(r); err != nil {
+			var uploadErr *uploadError
+			if !errors.As(err, &uploadErr) {
+				uploadErr = badUpload("%v", err)
+			}
+			writeGraphQLError(w, uploadErr.status, uploadErr.code, uploadErr.message)
+			return
+		}
+		h.sink.Count(metricUploadedFiles, float64(files))
+	} else if body, err = ioutil.ReadAll(r.Body); err != nil {
 		log.Fatalln(err)
 	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, captureErrors: true}
+	w = rec
+	// the operation name is only parsed while a capture is armed
+	var captured *captureRecorder
+	captureName := h.capture.armed()
+	if captureName != "" && requestOperationName(body, nil) == captureName {
+		if limit, ok := h.capture.take(captureName, start); ok {
+			captured = &captureRecorder{statusRecorder: rec, limit: limit}
+			w = captured
+		}
+	}
+	requestBody := body
+	kind := "query"
+	defer func() {
+		took := time.Since(start)
+		if captured != nil {
+			h.finishCapture(r, captureName, requestBody, captured, took)
+		}
+		if h.slos != nil {
+			operationName, _ := jsonparser.GetString(requestBody, "operationName")
+			h.slos.observe(cleanOperationName(operationName), took, time.Now())
+		}
+		h.recordRequest(r.Context(), kind, rec.status, took.Seconds())
+		if code := h.errorRates.record(rec.errorCode, rec.status, rec.flushed, time.Now()); code != "" {
+			h.sink.Count(metricGraphQLErrors, 1, "code", code)
+		}
+		h.logRequest(r, body, kind, rec, took)
+	}()
+
+	if invalid := checkOperationName(body); invalid != "" {
+		h.sink.Count(metricInvalidOperationNames, 1)
+		writeGraphQLError(w, http.StatusBadRequest, "INVALID_OPERATION_NAME", invalid)
+		return
+	}
+
 	// check if body is introspection query
 	if bytes.Contains(body, []byte("IntrospectionQuery")) {
-		// if so, return the schema
-		w.Header().Add("Content-Type", "application/json")
-		gen := introspection.NewGenerator()
-		// get the schema from the query engine on /sdl endpoint
-		resp, err := http.Get(h.queryEngineSdlURL)
+		kind = "introspection"
+		activity.Type = kind
+		if h.disableIntrospection {
+			writeGraphQLError(w, http.StatusForbidden, "INTROSPECTION_DISABLED", "introspection is disabled on this endpoint")
+			return
+		}
+		// if so, return the schema generated from the query engine's SDL
+		schema, err := h.schema()
 		if err != nil {
-			log.Fatalln(err)
+			tracing.Logger(r.Context()).Error("introspection", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
 		}
-		defer resp.Body.Close()
-		schemaSDL, err := ioutil.ReadAll(resp.Body)
+		introspection, err := h.introspection(r.Context(), schema)
 		if err != nil {
-			log.Fatalln(err)
+			tracing.Logger(r.Context()).Error("introspection", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "the schema could not be pruned to the granted models")
+			return
 		}
-		// generate the introspection result from the schema
-		doc, report := astparser.ParseGraphqlDocumentBytes(schemaSDL)
-		err = asttransform.MergeDefinitionWithBaseSchema(&doc)
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(introspection)
+		return
+	}
+	rules := h.currentAuthRules()
+	var op *operation
+	if rules != nil || bytes.Contains(body, []byte("mutation")) {
+		// the contains check is only a cheap pre-filter, the parsed
+		// operation is authoritative
+		op, _ = parseOperation(body)
+	}
+	if op != nil && op.isMutation() {
+		kind = "mutation"
+	}
+	activity.Type, activity.Write = kind, kind == "mutation"
+	if len(h.sleepResetExempt) > 0 {
+		activity.OperationName = requestOperationName(body, op)
+	}
+	if op != nil && op.isMutation() && h.readOnly {
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "READ_ONLY",
+			"this instance is a read replica, send mutations to the primary")
+		return
+	}
+	if h.storageRefuses(op != nil && op.isMutation()) {
+		writeStorageUnavailable(w, false)
+		return
+	}
+	if h.driftRefuses(op != nil && op.isMutation()) {
+		writeSchemaDrift(w, false)
+		return
+	}
+	if op != nil && op.isMutation() && !op.onlyDeletes() && h.databaseFull() {
+		h.sink.Count(metricDatabaseFull, 1)
+		writeGraphQLError(w, http.StatusInsufficientStorage, "DATABASE_FULL",
+			"database size limit reached, only reads and deletes are allowed")
+		return
+	}
+	if rules != nil {
+		if denied := rules.authorize(r.Context(), op); denied != nil {
+			h.sink.Count(metricAuthRuleDenials, 1)
+			writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", denied.Error())
+			return
+		}
+	}
+	if h.visibility != nil && h.refuseHidden(w, r, body) {
+		return
+	}
+	if grants := h.grants(r.Context()); grants != nil && h.refuseUngranted(w, r, body, grants, writeGraphQLError) {
+		return
+	}
+	if h.disableIntrospection && introspects(body) {
+		writeGraphQLError(w, http.StatusForbidden, "INTROSPECTION_DISABLED", "introspection is disabled on this endpoint")
+		return
+	}
+	if h.disableRawQueries && op != nil && op.runsRaw() {
+		writeGraphQLError(w, http.StatusForbidden, "RAW_QUERIES_DISABLED", "raw queries are disabled on this endpoint")
+		return
+	}
+	if h.safeMutations && op != nil && op.isMutation() && h.blockDangerousMutation(w, r, body, op) {
+		return
+	}
+	r = h.resolveOperationLimit(r, body, op)
+	if !h.takeQuota(w, r, kind) {
+		return
+	}
+	format, err := newResponseFormat(r, body)
+	if err != nil {
+		writeGraphQLError(w, http.StatusNotAcceptable, "NOT_ACCEPTABLE", err.Error())
+		return
+	}
+	r, cancel, timeout := h.withRequestTimeout(r)
+	defer cancel()
+	if h.rowFilters != nil {
+		schema, err := h.schema()
 		if err != nil {
-			log.Fatalln(err)
+			tracing.Logger(r.Context()).Error("row filters", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
+		}
+		if body, err = filterRows(body, h.rowFilters, requestClaims(r.Context()), schema.index); err != nil {
+			h.sink.Count(metricRowFilterRejections, 1)
+			writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", err.Error())
+			return
+		}
+	}
+	if h.softDelete != nil {
+		if body, err = h.softDeleteRows(r, body); err != nil {
+			var refused *softDeleteError
+			if errors.As(err, &refused) {
+				h.sink.Count(metricSoftDeleteRejections, 1)
+				writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", err.Error())
+				return
+			}
+			tracing.Logger(r.Context()).Error("soft delete", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
 		}
-		var response IntrospectionResponse
-		gen.Generate(&doc, &report, &response.Data)
-		// marshal the result
-		b, err := json.Marshal(response)
+	}
+	var (
+		defaultTake *defaultTakeExtension
+		rowLimit    *rowLimitExtension
+	)
+	if h.maxResultRows > 0 || h.defaultTake > 0 || h.defaultNestedTake > 0 {
+		schema, err := h.schema()
 		if err != nil {
-			log.Fatalln(err)
+			tracing.Logger(r.Context()).Error("row limit", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
+		}
+		// a default take above the row limit is capped like any other
+		body, defaultTake = injectDefaultTakes(body, h.defaultTake, h.defaultNestedTake, schema.fields)
+		if defaultTake != nil {
+			h.sink.Count(metricDefaultTakes, 1)
+			w.Header().Set(defaultTakeHeader, strings.Join(defaultTake.Fields, ","))
+		}
+		if h.maxResultRows > 0 {
+			body, rowLimit = limitRows(body, h.maxResultRows, h.rowsExempt, schema.fields)
+			if rowLimit != nil {
+				h.sink.Count(metricResultRowsCapped, 1)
+			}
+		}
+	}
+	// taken once, however often the engine request is retried
+	timing := timingOf(r.Context())
+	limited := timing.now()
+	h.takeLimits(r.Context(), bytes.Contains(body, []byte("mutation")))
+	timing.queued(limited)
+	if usesIncrementalDirectives(body) {
+		if acceptsMultipart(r) && h.serveIncremental(body, w, r) {
+			return
 		}
-		_, _ = w.Write(b)
+		h.sink.Count(metricIncrementalRequests, 1, "delivery", "stripped")
+		body = stripIncrementalDirectives(body)
+	}
+	h.proxyRequestToEngine(body, &proxyOptions{format: format, defaultTake: defaultTake, rowLimit: rowLimit, timeout: timeout}, w, r)
+	if op != nil && op.isMutation() {
+		h.databaseSize.Invalidate()
+		h.invalidateCounts(op)
+	}
+}
+
+// recoverPanic turns a panic into a 500 response and reports it.
+func (h *Handler) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	p := recover()
+	if p == nil {
 		return
 	}
-	h.proxyRequestToEngine(body, w, r)
+	if p == http.ErrAbortHandler {
+		panic(p)
+	}
+	stack := string(debug.Stack())
+	trace, _ := tracing.FromContext(r.Context())
+	tracing.Logger(r.Context()).Error("Panic serving request", slog.Any("panic", p), slog.String("stack", stack))
+	h.reporter.Report(report.Event{
+		Type:      report.EventPanic,
+		Message:   fmt.Sprint(p),
+		Stack:     stack,
+		RequestID: trace.RequestID,
+	})
+	writeGraphQLError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "internal server error")
 }
 
-func (h *Handler) proxyRequestToEngine(body []byte, w http.ResponseWriter, r *http.Request) {
+// logRequest writes the access log line of a GraphQL request and adds it to
+// the query statistics and the recent requests. Failed and slow requests are
+// logged as errors and warnings so sampling keeps them, and failed ones even
+// if excluded from the log.
+func (h *Handler) logRequest(r *http.Request, body []byte, kind string, rec *statusRecorder, took time.Duration) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status < 500 && excluded(r.Context(), excludeLog) {
+		return
+	}
+	slow := h.slowRequest > 0 && took > h.slowRequest
+	level, msg := slog.LevelInfo, "request"
+	switch {
+	case status >= 500:
+		level, msg = slog.LevelError, "request failed"
+	case slow:
+		level, msg = slog.LevelWarn, "slow request"
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	operationName = cleanOperationName(operationName)
+	query, _ := jsonparser.GetString(body, "query")
+	shape := fingerprint(query)
+	trace, _ := tracing.FromContext(r.Context())
+	h.stats.record(shape, operationName, kind, trace.RequestID, took, slow)
+	if slow && h.indexAdvice != nil {
+		h.adviseIndexes(shape, trace.RequestID)
+	}
+	if h.recent != nil {
+		entry := recentRequest{
+			Time:          time.Now().Add(-took).UTC(),
+			RequestID:     trace.RequestID,
+			Type:          kind,
+			OperationName: operationName,
+			Fingerprint:   shape,
+			Status:        status,
+			DurationMs:    float64(took.Microseconds()) / 1000,
+			ErrorCode:     rec.errorCode,
+			Caller:        Caller(r.Context()),
+		}
+		if h.captureBodies {
+			entry.Query = query
+			if variables, _, _, err := jsonparser.Get(body, "variables"); err == nil {
+				entry.Variables = append(json.RawMessage(nil), variables...)
+			}
+		}
+		h.recent.add(entry)
+	}
+
+	attrs := []slog.Attr{
+		slog.String("type", kind),
+		slog.String("operationName", operationName),
+		slog.String("fingerprint", shape),
+		slog.Int("status", status),
+		slog.Float64("durationMs", float64(took.Microseconds())/1000),
+	}
+	if timeout := requestTimeout(r.Context()); timeout > 0 {
+		attrs = append(attrs, slog.Int64("timeoutMs", timeout.Milliseconds()))
+	}
+	if h.database != "" {
+		attrs = append(attrs, slog.String("database", h.database))
+	}
+	tracing.Logger(r.Context()).LogAttrs(r.Context(), level, msg, attrs...)
+}
+
+// writeDatabaseSizeHeaders lets health probes alert before writes are rejected.
+func (h *Handler) writeDatabaseSizeHeaders(w http.ResponseWriter) {
+	if h.databaseSize.Limit() <= 0 {
+		return
+	}
+	w.Header().Set("X-Database-Size-Bytes", strconv.FormatInt(h.databaseSize.Size(), 10))
+	w.Header().Set("X-Database-Size-Used-Percent", strconv.FormatFloat(h.databaseSize.UsedRatio()*100, 'f', 1, 64))
+}
+
+// proxyOptions shape how a request is proxied to the query engine.
+type proxyOptions struct {
+	// format re-encodes the response if not nil.
+	format responseFormat
+	// defaultTake, rowLimit and timeout are added to the response
+	// extensions if set.
+	defaultTake *defaultTakeExtension
+	rowLimit    *rowLimitExtension
+	timeout     *timeoutExtension
+	// retriedBusy is set once a busy database was retried.
+	retriedBusy bool
+}
+
+// proxyRequestToEngine sends the request to the query engine and writes its
+// response.
+func (h *Handler) proxyRequestToEngine(body []byte, opts *proxyOptions, w http.ResponseWriter, r *http.Request) {
 	variables, _, _, _ := jsonparser.Get(body, "variables")
 	if variables == nil {
 		// if no variables are set, set an empty object
@@ -147,64 +1396,211 @@ func (h *Handler) proxyRequestToEngine(body []byte, w http.ResponseWriter, r *ht
 		body, _ = jsonparser.Set(body, []byte("null"), "operationName")
 	}
 	for i := 0; i < 3; i++ {
-		if h.sendRequest(body, w, r) {
+		if h.sendRequest(body, opts, w, r) {
+			return
+		}
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			writeGraphQLError(w, http.StatusGatewayTimeout, "TIMEOUT",
+				fmt.Sprintf("the query engine did not answer within %dms", requestTimeout(r.Context()).Milliseconds()))
 			return
 		}
 	}
-	w.WriteHeader(http.StatusInternalServerError)
+	if h.plainTextErrors {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeGraphQLError(w, http.StatusInternalServerError, "ENGINE_UNAVAILABLE", "the query engine did not answer")
 }
 
-func (h *Handler) sendRequest(body []byte, w http.ResponseWriter, r *http.Request) bool {
-
-	if bytes.Contains(body, []byte("mutation")) {
-		h.writeLimit.Take()
+func (h *Handler) sendRequest(body []byte, opts *proxyOptions, w http.ResponseWriter, r *http.Request) bool {
+	timing := timingOf(r.Context())
+	started := timing.now()
+	write := bytes.Contains(body, []byte("mutation"))
+	if write {
+		release, err := h.enqueueWrite(r.Context())
+		if errors.Is(err, errWriteQueueTimeout) {
+			writeWriteQueueTimeout(w)
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		defer release()
 	}
-	h.readLimit.Take()
+	started = timing.queued(started)
 
-	newRequest, err := http.NewRequestWithContext(r.Context(), r.Method, h.queryEngineURL, ioutil.NopCloser(bytes.NewBuffer(body)))
-	if err != nil {
-		log.Println(err)
-		return false
+	logger := tracing.Logger(r.Context())
+	var answer engineResponse
+	if h.coalesce != nil && !write {
+		// the read may outlive the request, whose timing only its own
+		// goroutine uses: the wait for it is timed as the engine's
+		ctx := context.WithValue(r.Context(), timingKey{}, (*requestTiming)(nil))
+		var result string
+		answer, result = h.coalesce.do(ctx, coalesceKey(r.Method, body), func(ctx context.Context) engineResponse {
+			return h.exchange(ctx, r.Method, body, write, started)
+		})
+		timing.answered(started)
+		h.sink.Count(metricReadCoalescing, 1, "result", result)
+	} else {
+		answer = h.exchange(r.Context(), r.Method, body, write, started)
 	}
-	// set the content type to application/json
-	newRequest.Header.Set("content-type", "application/json")
-	resp, err := h.client.Do(newRequest)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if errors.Is(answer.err, errEnginePoolTimeout) {
+		writeEnginePoolTimeout(w)
+		return true
+	}
+	if answer.err != nil {
+		if answer.resp != nil {
+			logger.Error("read engine response", slog.String("error", answer.err.Error()))
+		}
 		return false
 	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Println(err)
+	resp, data := answer.resp, answer.data
+	if isDatabaseBusy(data) {
+		// the engine reports a locked database with either status
+		return h.handleBusy(opts, w, r)
+	}
+	if reason, ok := storageFailure(data); ok {
+		h.storageFailed(reason)
+	}
+	if resp.StatusCode != http.StatusOK {
 		return false
 	}
 	if bytes.HasPrefix(data, []byte("{\"e")) && bytes.Contains(data, []byte("Timed out")) {
 		return false
 	}
+	if write {
+		h.journalMutation(body, data)
+	}
+	if opts.defaultTake != nil {
+		extension, _ := json.Marshal(opts.defaultTake)
+		if injected, err := jsonparser.Set(data, extension, "extensions", "defaultTake"); err == nil {
+			data = injected
+		}
+	}
+	if opts.rowLimit != nil {
+		extension, _ := json.Marshal(opts.rowLimit)
+		if capped, err := jsonparser.Set(data, extension, "extensions", "resultRowLimit"); err == nil {
+			data = capped
+		}
+	}
+	if opts.timeout != nil {
+		extension, _ := json.Marshal(opts.timeout)
+		if injected, err := jsonparser.Set(data, extension, "extensions", "timeout"); err == nil {
+			data = injected
+		}
+	}
+	if opts.format != nil {
+		// the response may be partly written, it can't be retried
+		if err := opts.format.write(w, data); err != nil {
+			logger.Error("write response", slog.String("error", err.Error()))
+		}
+		return true
+	}
 	w.Header().Add("Content-Type", "application/json")
-	_, err = w.Write(data)
-	if err != nil {
-		log.Println(err)
+	if _, err := w.Write(data); err != nil {
+		logger.Error("write response", slog.String("error", err.Error()))
 		return false
 	}
 	return true
 }
 
+// exchange sends body to the query engine in a slot of its engine pool, or
+// hedged for reads with hedged reads. started is when the request started
+// waiting for the engine.
+func (h *Handler) exchange(ctx context.Context, method string, body []byte, write bool, started time.Time) engineResponse {
+	timing := timingOf(ctx)
+	leave, err := h.enterPool(ctx)
+	if err != nil {
+		return engineResponse{err: err}
+	}
+	defer leave()
+	started = timing.queued(started)
+
+	trace, _ := tracing.FromContext(ctx)
+	end := tracing.Begin(trace)
+	defer end()
+	var answer engineResponse
+	if h.hedge != nil && !write {
+		answer = h.hedgedRoundTrip(ctx, method, body)
+	} else {
+		answer = h.roundTrip(ctx, method, body)
+	}
+	timing.answered(started)
+	return answer
+}
+
+// rateLimits are the read and write rate limits of a config.
+type rateLimits struct {
+	read, write                   ratelimit.Limiter
+	readPerSecond, writePerSecond int
+}
+
+func newRateLimits(config Config) *rateLimits {
+	return &rateLimits{
+		read:           ratelimit.New(config.ReadLimitSeconds),
+		write:          ratelimit.New(config.WriteLimitSeconds),
+		readPerSecond:  config.ReadLimitSeconds,
+		writePerSecond: config.WriteLimitSeconds,
+	}
+}
+
+// take waits for the read or write limit and counts the waits it caused,
+// so load tests can tell throttling from a slow engine.
+func (h *Handler) take(limit string) {
+	limits := h.limits.Load().(*rateLimits)
+	limiter, rate, perSecond := limits.read, &h.readRate, limits.readPerSecond
+	if limit == "write" {
+		limiter, rate, perSecond = limits.write, &h.writeRate, limits.writePerSecond
+	}
+	start := time.Now()
+	limiter.Take()
+	now := time.Now()
+	if waited := now.Sub(start); waited >= time.Millisecond {
+		h.sink.Count(metricRateLimitWaits, 1, "limit", limit)
+		h.sink.Count(metricRateLimitWaitSeconds, waited.Seconds(), "limit", limit)
+	}
+	if h.limitWarnings != nil {
+		// warned at most once a minute
+		h.limitWarnings.observe(limit+"_rate", now.Truncate(time.Minute), float64(rate.add(now)), float64(perSecond))
+	}
+}
+
+// databaseFull reports whether writes are rejected for the database size,
+// warning as it approaches the limit.
+func (h *Handler) databaseFull() bool {
+	if h.limitWarnings != nil {
+		h.limitWarnings.observe("database_size", time.Time{}, float64(h.databaseSize.Size()), float64(h.databaseSize.Limit()))
+	}
+	return h.databaseSize.Full()
+}
+
+func (h *Handler) sleepAfter() time.Duration {
+	return h.sleep.sleepAfter()
+}
+
 func (h *Handler) runSleepMode() {
-	timer := time.NewTimer(time.Duration(h.sleepAfterSeconds) * time.Second)
+	h.sleep.start(time.Now())
+	timer := time.NewTimer(h.sleepAfter())
+	kind := sleepEventIdle
 	defer func() {
-		fmt.Println("No requests for", h.sleepAfterSeconds, "seconds, cancelling context")
+		h.logSleep(kind)
+		h.preStop()
 		h.cancel()
-		return
 	}()
 	for {
 		select {
-		case <-h.sleepCh:
-			done := timer.Reset(time.Duration(h.sleepAfterSeconds) * time.Second)
-			if !done {
-				return
-			}
+		case <-h.sleep.changed:
+			// a timer that already fired is checked again below
+			timer.Reset(h.sleepIn())
 		case <-timer.C:
+			// the deadline may have moved since the timer was set
+			if remaining := h.sleepIn(); remaining > 0 {
+				timer.Reset(remaining)
+				continue
+			}
+			return
+		case <-h.sleepNow:
+			kind = sleepEventManual
 			return
 		}
 	}
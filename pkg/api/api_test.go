@@ -1,13 +1,46 @@
 package api
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/cdc"
+	"wunderbase/pkg/journal"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/report"
+	"wunderbase/pkg/schedule"
+	"wunderbase/pkg/support"
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
 	"github.com/gavv/httpexpect/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
 )
 
 func TestApi(t *testing.T) {
@@ -17,7 +50,13 @@ func TestApi(t *testing.T) {
 
 	_, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	handler := NewHandler(false, false, fakeDB.URL, fakeDB.URL+"/sdl", "/health", 0, 10000, 2000, cancel)
+	handler := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+	}, cancel)
 
 	fakeAPI := httptest.NewServer(handler)
 
@@ -33,3 +72,4338 @@ func TestApi(t *testing.T) {
 	e.GET(fakeAPI.URL).Expect().Status(http.StatusOK).Body().Contains("GraphQL").Contains(fakeAPI.URL)
 	e.GET(fakeAPI.URL + "/health").Expect().Status(http.StatusOK).Body().Equal("OK")
 }
+
+func TestDatabaseSizeLimit(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	err := os.WriteFile(dbFile, make([]byte, 2*1024*1024), 0644)
+	require.NoError(t, err)
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		DatabaseFilePath:  dbFile,
+		MaxDatabaseSizeMB: 1,
+	}, cancel)
+
+	fakeAPI := httptest.NewServer(handler)
+	defer fakeAPI.Close()
+
+	e := httpexpect.New(t, fakeAPI.URL)
+
+	e.POST("/").WithJSON(map[string]interface{}{
+		"query": `mutation { createOneUser(data: {email: "a@b.c"}) { id } }`,
+	}).Expect().Status(http.StatusInsufficientStorage).
+		JSON().Path("$.errors[0].extensions.code").Equal("DATABASE_FULL")
+
+	e.POST("/").WithJSON(map[string]interface{}{
+		"query": `mutation { deleteManyUser { count } }`,
+	}).Expect().Status(http.StatusOK)
+
+	e.POST("/").WithJSON(map[string]interface{}{
+		"query": `query { findManyUser { id } }`,
+	}).Expect().Status(http.StatusOK)
+
+	health := e.GET("/health").Expect().Status(http.StatusOK)
+	health.Header("X-Database-Size-Used-Percent").Equal("200.0")
+	health.JSON().Object().ValueEqual("status", HealthFailing).ValueEqual("sizeBytes", 2*1024*1024).
+		ValueEqual("limitBytes", 1024*1024).ValueEqual("usedPercent", 200)
+
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains("wunderbase_database_full_rejections_total 1").
+		Contains(`wunderbase_requests_total{type="mutation",code="507"} 1`).
+		Contains("wunderbase_database_size_bytes 2.097152e+06")
+}
+
+func TestResponseFormats(t *testing.T) {
+	engineResponse := `{"data":{"users":[{"id":1,"name":"Ann, \"A\"","author":{"email":"a@b.c"},"posts":[{"title":"x"},{"title":"y"}]},{"id":-2,"name":null,"author":null,"posts":[]}]}}`
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("broken")) {
+			_, _ = w.Write([]byte(`{"errors":[{"message":"broken"}]}`))
+			return
+		}
+		if bytes.Contains(body, []byte("small")) {
+			_, _ = w.Write([]byte(`{"data":{"a":1,"b":[true,null,1.5]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(engineResponse))
+	}))
+	defer fakeDB.Close()
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+	}, cancel)
+	fakeAPI := httptest.NewServer(handler)
+	defer fakeAPI.Close()
+	e := httpexpect.New(t, fakeAPI.URL)
+
+	query := map[string]interface{}{
+		"query": `query { users: findManyUser { id name author { email } posts { title } } }`,
+	}
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK).
+		ContentType("application/json").Body().Equal(engineResponse)
+
+	e.POST("/").WithHeader("Accept", "text/csv").WithJSON(query).Expect().Status(http.StatusOK).
+		ContentType("text/csv").Body().Equal("id,name,author.email,posts.title\n" +
+		"1,\"Ann, \"\"A\"\"\",a@b.c,\"[\"\"x\"\",\"\"y\"\"]\"\n" +
+		"-2,,,[]\n")
+
+	e.POST("/").WithHeader("Accept", "text/csv").WithJSON(map[string]interface{}{
+		"query": `query { findManyUser { id } findManyPost { id } }`,
+	}).Expect().Status(http.StatusNotAcceptable).
+		JSON().Path("$.errors[0].extensions.code").Equal("NOT_ACCEPTABLE")
+	e.POST("/").WithHeader("Accept", "text/csv").WithJSON(map[string]interface{}{
+		"query": `mutation { deleteManyUser { count } }`,
+	}).Expect().Status(http.StatusNotAcceptable)
+	e.POST("/").WithHeader("Accept", "text/csv").WithJSON(map[string]interface{}{
+		"query": `query { broken { id } }`,
+	}).Expect().Status(http.StatusOK).ContentType("application/json")
+
+	got := e.POST("/").WithHeader("Accept", "application/msgpack").WithJSON(map[string]interface{}{
+		"query": `query { small }`,
+	}).Expect().Status(http.StatusOK).ContentType("application/msgpack").Body().Raw()
+	want := []byte{0x81, 0xa4, 'd', 'a', 't', 'a', 0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x93, 0xc3, 0xc0,
+		0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}
+	require.Equal(t, want, []byte(got))
+
+	require.Equal(t, "", negotiateMediaType("application/json, text/csv;q=0.5"))
+	require.Equal(t, mediaTypeCSV, negotiateMediaType("application/json;q=0.5, text/csv"))
+	require.Equal(t, mediaTypeMsgpack, negotiateMediaType("application/x-msgpack"))
+	require.Equal(t, "", negotiateMediaType("application/graphql-response+json"))
+}
+
+func TestSchemaViewer(t *testing.T) {
+	var sdlFetches int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			atomic.AddInt32(&sdlFetches, 1)
+			_, _ = w.Write([]byte(restSDL))
+			return
+		}
+		if body, _ := io.ReadAll(r.Body); bytes.Contains(body, []byte("aggregateUser { _count { _all } }")) {
+			_, _ = w.Write([]byte(`{"data":{"aggregateUser":{"_count":{"_all":42}}}}`))
+		}
+	}))
+	defer fakeDB.Close()
+
+	newAPI := func(enable bool) *httpexpect.Expect {
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:     fakeDB.URL,
+			QueryEngineSdlURL:  fakeDB.URL + "/sdl",
+			HealthEndpoint:     "/health",
+			ReadLimitSeconds:   10000,
+			WriteLimitSeconds:  2000,
+			Production:         true,
+			EnableSchemaViewer: enable,
+		}, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+
+	e := newAPI(true)
+	e.GET("/schema/viewer").Expect().Status(http.StatusOK).ContentType("text/html").Body().Contains("viewer.json")
+	e.GET("/schema/viewer.json").Expect().Status(http.StatusOK).
+		JSON().Path("$.data.__schema.queryType.name").Equal("Query")
+	e.POST("/").WithJSON(map[string]interface{}{"query": "query IntrospectionQuery { __schema { types { name } } }"}).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.__schema.queryType.name").Equal("Query")
+	require.Equal(t, int32(1), atomic.LoadInt32(&sdlFetches), "the introspection response is cached")
+	e.GET("/schema/viewer/count").WithQuery("model", "User").Expect().Status(http.StatusOK).
+		JSON().Object().ValueEqual("model", "User").ValueEqual("count", 42)
+	e.GET("/schema/viewer/count").WithQuery("model", "Nope").Expect().Status(http.StatusNotFound)
+
+	newAPI(false).GET("/schema/viewer").Expect().Body().NotContains("viewer.json")
+}
+
+func TestResultRowLimit(t *testing.T) {
+	sdl := strings.Replace(restSDL, "posts: [Post!]!", "posts(take: Int, skip: Int): [Post!]!", 1)
+	var forwarded atomic.Value
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(sdl))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		forwarded.Store(string(body))
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:      fakeDB.URL,
+		QueryEngineSdlURL:   fakeDB.URL + "/sdl",
+		HealthEndpoint:      "/health",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		Production:          true,
+		MaxResultRows:       100,
+		MaxResultRowsExempt: []string{"Export"},
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	send := func(query string, variables map[string]interface{}) *httpexpect.Object {
+		return e.POST("/").WithJSON(map[string]interface{}{"query": query, "variables": variables}).
+			Expect().Status(http.StatusOK).JSON().Object()
+	}
+	forwardedQuery := func() string {
+		query, _ := jsonparser.GetString([]byte(forwarded.Load().(string)), "query")
+		return query
+	}
+
+	// a missing take is added, one above the limit lowered, on nested
+	// fields and through fragments too
+	send(`query { users: findManyUser(where: {id: {equals: 1}}) { id ...P } }
+fragment P on User { posts(take: 500) { id } }`, nil).
+		Path("$.extensions.resultRowLimit").Object().
+		ValueEqual("maxRows", 100).ValueEqual("fields", []string{"users", "users.posts"})
+	require.Equal(t, `query { users: findManyUser(take: 100, where: {id: {equals: 1}}) { id ...P } }
+fragment P on User { posts(take: 100) { id } }`, forwardedQuery())
+
+	// a negative take keeps reading backwards
+	send(`{ findManyUser(take: -500) { id } }`, nil)
+	require.Equal(t, `{ findManyUser(take: -100) { id } }`, forwardedQuery())
+
+	// takes within the limit and single results are left alone
+	send(`{ findManyUser(take: 10) { id posts(take: -5) { id } } findUniqueUser(where: {id: 1}) { id } }`, nil).
+		NotContainsKey("extensions")
+	require.Equal(t, `{ findManyUser(take: 10) { id posts(take: -5) { id } } findUniqueUser(where: {id: 1}) { id } }`, forwardedQuery())
+
+	// variables above the limit are lowered, missing ones use the default
+	query := `query Users($take: Int = 1000, $posts: Int) { findManyUser(take: $take) { id posts(take: $posts) { id } } }`
+	send(query, map[string]interface{}{"posts": 5}).
+		Path("$.extensions.resultRowLimit.fields").Array().ContainsOnly("findManyUser")
+	variables, _, _, _ := jsonparser.Get([]byte(forwarded.Load().(string)), "variables")
+	require.JSONEq(t, `{"take":100,"posts":5}`, string(variables))
+	require.Equal(t, query, forwardedQuery())
+
+	// exempt operations are forwarded as sent
+	send(`query Export { findManyUser { id } }`, nil).NotContainsKey("extensions")
+	require.Equal(t, `query Export { findManyUser { id } }`, forwardedQuery())
+}
+
+func TestDefaultTake(t *testing.T) {
+	sdl := strings.Replace(restSDL, "posts: [Post!]!", "posts(take: Int, skip: Int): [Post!]!", 1)
+	var forwarded atomic.Value
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(sdl))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		forwarded.Store(string(body))
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.QueryEngineURL, config.QueryEngineSdlURL = fakeDB.URL, fakeDB.URL+"/sdl"
+		config.HealthEndpoint, config.Production = "/health", true
+		config.ReadLimitSeconds, config.WriteLimitSeconds = 10000, 2000
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	forwardedQuery := func() string {
+		query, _ := jsonparser.GetString([]byte(forwarded.Load().(string)), "query")
+		return query
+	}
+	query := map[string]interface{}{"query": `{ users: findManyUser(where: {id: {equals: 1}}) { id posts { id } } findManyPost(take: 5) { id } }`}
+
+	// root and nested lists without take get their default
+	resp := newAPI(Config{DefaultTake: 50, DefaultNestedTake: 10}).POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	resp.Header(defaultTakeHeader).Equal("users,users.posts")
+	resp.JSON().Path("$.extensions.defaultTake").Object().
+		ValueEqual("take", 50).ValueEqual("nestedTake", 10).ValueEqual("fields", []string{"users", "users.posts"})
+	require.Equal(t, `{ users: findManyUser(take: 50, where: {id: {equals: 1}}) { id posts(take: 10) { id } } findManyPost(take: 5) { id } }`, forwardedQuery())
+
+	// without a nested default only the root is bounded
+	newAPI(Config{DefaultTake: 50}).POST("/").WithJSON(query).Expect().Status(http.StatusOK).
+		Header(defaultTakeHeader).Equal("users")
+	require.Equal(t, `{ users: findManyUser(take: 50, where: {id: {equals: 1}}) { id posts { id } } findManyPost(take: 5) { id } }`, forwardedQuery())
+
+	// the row limit caps the injected default
+	obj := newAPI(Config{DefaultTake: 500, MaxResultRows: 100}).POST("/").WithJSON(query).Expect().Status(http.StatusOK).JSON().Object()
+	obj.Path("$.extensions.defaultTake.fields").Array().ContainsOnly("users")
+	obj.Path("$.extensions.resultRowLimit.fields").Array().ContainsOnly("users", "users.posts")
+	require.Equal(t, `{ users: findManyUser(take: 100, where: {id: {equals: 1}}) { id posts(take: 100) { id } } findManyPost(take: 5) { id } }`, forwardedQuery())
+
+	// 0 disables it
+	newAPI(Config{}).POST("/").WithJSON(query).Expect().Status(http.StatusOK).
+		Header(defaultTakeHeader).Empty()
+	require.Equal(t, query["query"], forwardedQuery())
+}
+
+func TestIntrospect(t *testing.T) {
+	result, err := Introspect([]byte("type Query { users: [User] }\ntype User { id: Int! }"))
+	require.NoError(t, err)
+	require.Contains(t, string(result), `"queryType":{"name":"Query"}`)
+	require.Contains(t, string(result), `"name":"User"`)
+
+	_, err = Introspect([]byte("type Query {"))
+	require.Error(t, err)
+}
+
+func TestTrustedAuthHeader(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+
+	newAPI := func(proxy string) *httptest.Server {
+		_, trusted, err := net.ParseCIDR(proxy)
+		require.NoError(t, err)
+		return httptest.NewServer(NewHandler(Config{
+			Production:        true,
+			QueryEngineURL:    fakeDB.URL,
+			QueryEngineSdlURL: fakeDB.URL + "/sdl",
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			TrustedAuthHeader: "X-Auth-Request-Email",
+			TrustedProxies:    []*net.IPNet{trusted},
+		}, func() {}))
+	}
+	query := map[string]interface{}{"query": `query { findManyUser { id } }`}
+
+	trusted := newAPI("127.0.0.0/8")
+	defer trusted.Close()
+	e := httpexpect.New(t, trusted.URL)
+	e.POST("/").WithJSON(query).WithHeader("X-Auth-Request-Email", "a@b.c").
+		Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(query).
+		Expect().Status(http.StatusUnauthorized).
+		JSON().Path("$.errors[0].extensions.code").Equal("UNAUTHENTICATED")
+	e.GET("/health").Expect().Status(http.StatusOK)
+
+	untrusted := newAPI("10.0.0.0/8")
+	defer untrusted.Close()
+	httpexpect.New(t, untrusted.URL).POST("/").WithJSON(query).WithHeader("X-Auth-Request-Email", "a@b.c").
+		Expect().Status(http.StatusForbidden)
+}
+
+func TestRowFilters(t *testing.T) {
+	sdl := strings.NewReplacer(
+		"type Query {", "type Query {\n  findManyPayment: [Payment!]!",
+		"type User { id: Int! ", "type User { id: Int! _count: UserCountOutputType ",
+	).Replace(softDeleteSDL) + `
+type UserCountOutputType { orders: Int! }
+type Payment { id: Int! order: Order! }
+`
+	var forwarded atomic.Value
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(sdl))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		forwarded.Store(string(body))
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	api := httptest.NewServer(NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		TrustedAuthHeader: "X-Auth-Request-Email",
+		TrustedProxies:    []*net.IPNet{trusted},
+		RowFilters: map[string]json.RawMessage{
+			"Order":   json.RawMessage(`{"userId": {"equals": "$claims.sub"}}`),
+			"Invoice": json.RawMessage(`{"tenantId": {"equals": "$claims.tenant"}}`),
+		},
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	send := func(query string, status int) *httpexpect.Object {
+		return e.POST("/").WithJSON(map[string]interface{}{"query": query}).WithHeader("X-Auth-Request-Email", "a@b.c").
+			Expect().Status(status).JSON().Object()
+	}
+	forwardedQuery := func() string {
+		query, _ := jsonparser.GetString([]byte(forwarded.Load().(string)), "query")
+		return query
+	}
+
+	// the filter is merged with the where of the caller
+	send(`{ orders: findManyOrder(where: {total: {gt: 10}}, take: 5) { id } }`, http.StatusOK)
+	require.Equal(t, `{ orders: findManyOrder(where: {AND: [{total: {gt: 10}}, {userId: {equals: "a@b.c"}}]}, take: 5) { id } }`, forwardedQuery())
+	send(`query Orders($where: OrderWhereInput) { findFirstOrder(where: $where) { id } }`, http.StatusOK)
+	require.Equal(t, `query Orders($where: OrderWhereInput) { findFirstOrder(where: {AND: [$where, {userId: {equals: "a@b.c"}}]}) { id } }`, forwardedQuery())
+	send(`mutation { deleteManyOrder(where: null) { count } }`, http.StatusOK)
+	require.Equal(t, `mutation { deleteManyOrder(where: {userId: {equals: "a@b.c"}}) { count } }`, forwardedQuery())
+
+	// or becomes the where, other models are left alone
+	send(`{ findManyOrder { id } aggregateOrder(take: 1) { _count { _all } } findManyUser { id } }`, http.StatusOK)
+	require.Equal(t, `{ findManyOrder(where: {userId: {equals: "a@b.c"}}) { id } aggregateOrder(where: {userId: {equals: "a@b.c"}}, take: 1) { _count { _all } } findManyUser { id } }`, forwardedQuery())
+
+	// a unique lookup becomes a findFirst under the same response key
+	send(`{ findUniqueOrder(where: {id: 1}) { id } }`, http.StatusOK)
+	require.Equal(t, `{ findUniqueOrder: findFirstOrder(where: {AND: [{id: 1}, {userId: {equals: "a@b.c"}}]}) { id } }`, forwardedQuery())
+
+	// and so are the relations of the model selected below any field
+	send(`{ findManyUser { id orders(take: 2) { id } } }`, http.StatusOK)
+	require.Equal(t, `{ findManyUser { id orders(where: {userId: {equals: "a@b.c"}}, take: 2) { id } } }`, forwardedQuery())
+	send(`{ findManyOrder { user { ...Orders } } } fragment Orders on User { orders { id } }`, http.StatusOK)
+	require.Equal(t, `{ findManyOrder(where: {userId: {equals: "a@b.c"}}) { user { ...Orders } } } fragment Orders on User { orders(where: {userId: {equals: "a@b.c"}}) { id } }`, forwardedQuery())
+
+	// operations the filters can't restrict are refused
+	for _, query := range []string{
+		`{ findManyPayment { order { id } } }`,
+		`{ findManyUser { _count { orders } } }`,
+		`mutation { createOneOrder(data: {userId: "b@b.c"}) { id } }`,
+		`mutation { updateOneOrder(where: {id: 1}, data: {total: 0}) { id } }`,
+		`mutation { executeRaw(query: "DELETE FROM Order") }`,
+		`query Order($where: OrderWhereUniqueInput!) { findUniqueOrder(where: $where) { id } }`,
+		`{ ...Orders } fragment Orders on Query { findManyOrder { id } }`,
+	} {
+		send(query, http.StatusForbidden).Path("$.errors[0].extensions.code").Equal("FORBIDDEN")
+	}
+
+	// a filter referencing a claim the caller doesn't have fails closed
+	forwarded.Store("")
+	send(`{ findManyInvoice { id } }`, http.StatusForbidden).
+		Path("$.errors[0].message").String().Contains("tenant")
+	require.Empty(t, forwarded.Load())
+}
+
+const softDeleteSDL = `
+scalar DateTime
+type Query {
+  findUniqueOrder(where: OrderWhereUniqueInput!): Order
+  findManyOrder(where: OrderWhereInput, take: Int): [Order!]!
+  aggregateOrder(where: OrderWhereInput): AggregateOrder!
+  findUniqueUser(where: UserWhereUniqueInput!): User
+  findManyUser(where: UserWhereInput, take: Int): [User!]!
+}
+type Mutation {
+  deleteOneOrder(where: OrderWhereUniqueInput!): Order
+  deleteManyOrder(where: OrderWhereInput): AffectedRowsOutput!
+  updateOneUser(data: UserUpdateInput!, where: UserWhereUniqueInput!): User
+}
+type AffectedRowsOutput { count: Int! }
+type AggregateOrder { _count: OrderCountAggregateOutputType }
+type OrderCountAggregateOutputType { _all: Int! }
+type User { id: Int! orders(where: OrderWhereInput, take: Int): [Order!]! }
+type Order { id: Int! total: Int! deletedAt: DateTime user: User! }
+input UserWhereUniqueInput { id: Int }
+input OrderWhereUniqueInput { id: Int }
+input IntFilter { equals: Int gt: Int }
+input DateTimeNullableFilter { equals: DateTime }
+input UserWhereInput { AND: [UserWhereInput!] id: IntFilter orders: OrderListRelationFilter }
+input OrderWhereInput { AND: [OrderWhereInput!] id: IntFilter total: IntFilter deletedAt: DateTimeNullableFilter user: UserRelationFilter }
+input OrderListRelationFilter { every: OrderWhereInput some: OrderWhereInput none: OrderWhereInput }
+input UserRelationFilter { is: UserWhereInput isNot: UserWhereInput }
+input UserUpdateInput { orders: OrderUpdateManyWithoutUserNestedInput }
+input OrderUpdateManyWithoutUserNestedInput { delete: [OrderWhereUniqueInput!] }
+`
+
+func TestSoftDeleteRewrite(t *testing.T) {
+	doc, report := astparser.ParseGraphqlDocumentString(softDeleteSDL)
+	require.False(t, report.HasErrors(), report.Error())
+	index := indexSchema(&doc)
+	s := newSoftDelete([]string{"Order"}, "")
+	require.NoError(t, s.check(&index))
+	require.EqualError(t, newSoftDelete([]string{"Order", "User", "Invoice"}, "").check(&index),
+		"wunderbase: soft delete: User has no nullable DateTime field deletedAt, model Invoice is not in the schema")
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	rewrite := func(query string, variables interface{}) (string, string) {
+		body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+		require.NoError(t, err)
+		out, err := s.rewrite(body, &index, now)
+		require.NoError(t, err, query)
+		rewritten, _ := jsonparser.GetString(out, "query")
+		vars, _, _, _ := jsonparser.Get(out, "variables")
+		return rewritten, string(vars)
+	}
+
+	// deletes set the field
+	query, _ := rewrite(`mutation { deleteOneOrder(where: {id: 1}) { id } deleteManyOrder { count } }`, nil)
+	require.Equal(t, `mutation { deleteOneOrder: updateOneOrder(data: {deletedAt: {set: "2026-10-16T12:00:00Z"}}, where: {id: 1}) { id } `+
+		`deleteManyOrder: updateManyOrder(where: {deletedAt: null}, data: {deletedAt: {set: "2026-10-16T12:00:00Z"}}) { count } }`, query)
+	query, _ = rewrite(`mutation { gone: deleteManyOrder(where: {total: {gt: 10}}) { count } }`, nil)
+	require.Equal(t, `mutation { gone: updateManyOrder(data: {deletedAt: {set: "2026-10-16T12:00:00Z"}}, where: {AND: [{total: {gt: 10}}, {deletedAt: null}]}) { count } }`, query)
+
+	// reads only see the rows not deleted, down the list relations
+	query, _ = rewrite(`{ findUniqueOrder(where: {id: 1}) { id } aggregateOrder { _count { _all } } findManyUser { orders(take: 1) { id } } }`, nil)
+	require.Equal(t, `{ findUniqueOrder: findFirstOrder(where: {AND: [{id: 1}, {deletedAt: null}]}) { id } aggregateOrder(where: {deletedAt: null}) { _count { _all } } `+
+		`findManyUser { orders(where: {deletedAt: null}, take: 1) { id } } }`, query)
+
+	// and the relation filters too, inline and in the variables
+	query, _ = rewrite(`{ findManyUser(where: {orders: {some: {total: {gt: 10}}, every: {total: {gt: 1}}}}) { id } }`, nil)
+	require.Equal(t, `{ findManyUser(where: {orders: {some: {AND: [{total: {gt: 10}}, {deletedAt: null}]}, every: {OR: [{total: {gt: 1}}, {NOT: {deletedAt: null}}]}}}) { id } }`, query)
+	query, vars := rewrite(`query ($where: UserWhereInput) { findManyUser(where: $where) { id } }`,
+		map[string]interface{}{"where": map[string]interface{}{"orders": map[string]interface{}{"none": map[string]interface{}{"total": map[string]interface{}{"gt": 10}}}}})
+	require.Equal(t, `query ($where: UserWhereInput) { findManyUser(where: $where) { id } }`, query)
+	require.JSONEq(t, `{"where": {"orders": {"none": {"AND": [{"total": {"gt": 10}}, {"deletedAt": null}]}}}}`, vars)
+
+	// operations that can't be rewritten are refused
+	for _, query := range []string{
+		`query ($where: OrderWhereUniqueInput!) { findUniqueOrder(where: $where) { id } }`,
+		`mutation { updateOneUser(where: {id: 1}, data: {orders: {delete: [{id: 1}]}}) { id } }`,
+		`{ ...Orders } fragment Orders on Query { findManyOrder { id } }`,
+	} {
+		body, _ := json.Marshal(map[string]interface{}{"query": query})
+		_, err := s.rewrite(body, &index, now)
+		var refused *softDeleteError
+		require.ErrorAs(t, err, &refused, query)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	var forwarded atomic.Value
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(softDeleteSDL))
+			return
+		}
+		if body, _ := io.ReadAll(r.Body); len(body) > 0 {
+			forwarded.Store(string(body))
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	h := NewHandler(Config{
+		Production:          true,
+		QueryEngineURL:      fakeDB.URL,
+		QueryEngineSdlURL:   fakeDB.URL + "/sdl",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		TrustedAuthHeader:   "X-Auth-Request-Email",
+		TrustedScopesHeader: "X-Auth-Request-Groups",
+		TrustedProxies:      []*net.IPNet{trusted},
+		SoftDeleteModels:    []string{"Order"},
+	}, func() {})
+	require.NoError(t, h.CheckSoftDeleteSchema())
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	send := func(query, scopes, includeDeleted string, status int) *httpexpect.Response {
+		req := e.POST("/").WithJSON(map[string]interface{}{"query": query}).
+			WithHeader("X-Auth-Request-Email", "a@b.c").WithHeader("X-Auth-Request-Groups", scopes)
+		if includeDeleted != "" {
+			req = req.WithHeader("X-Wunderbase-Include-Deleted", includeDeleted)
+		}
+		return req.Expect().Status(status)
+	}
+	forwardedQuery := func() string {
+		query, _ := jsonparser.GetString([]byte(forwarded.Load().(string)), "query")
+		return query
+	}
+
+	send(`{ findManyOrder { id } }`, "", "", http.StatusOK)
+	require.Equal(t, `{ findManyOrder(where: {deletedAt: null}) { id } }`, forwardedQuery())
+
+	// admins see the deleted rows and delete for real
+	send(`{ findManyOrder { id } }`, "admin", "true", http.StatusOK)
+	require.Equal(t, `{ findManyOrder { id } }`, forwardedQuery())
+	send(`mutation Purge @includeDeleted { deleteManyOrder(where: {id: {equals: 1}}) { count } }`, "admin", "", http.StatusOK)
+	require.Equal(t, `mutation Purge  { deleteManyOrder(where: {id: {equals: 1}}) { count } }`, forwardedQuery())
+	send(`{ findManyOrder { id } }`, "ops", "true", http.StatusForbidden).JSON().Path("$.errors[0].message").String().Contains("admin scope")
+	send(`query @includeDeleted { findManyOrder { id } }`, "", "", http.StatusForbidden)
+}
+
+func TestAuthRules(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(restSDL))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	rules := &AuthRules{Default: "deny", Rules: map[string]AuthRule{
+		"deleteUser":   {Scopes: []string{"admin"}},
+		"User.read":    {},
+		"User.create":  {Authenticated: true},
+		"User.delete":  {Scopes: []string{"admin"}},
+		"executeRaw":   {Scopes: []string{"admin", "ops"}},
+		"findManyPost": {},
+	}}
+	h := NewHandler(Config{
+		Production:          true,
+		QueryEngineURL:      fakeDB.URL,
+		QueryEngineSdlURL:   fakeDB.URL + "/sdl",
+		HealthEndpoint:      "/health",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		TrustedAuthHeader:   "X-Auth-Request-Email",
+		TrustedScopesHeader: "X-Auth-Request-Groups",
+		TrustedProxies:      []*net.IPNet{trusted},
+		AuthRules:           rules,
+	}, func() {})
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	send := func(body map[string]interface{}, scopes string, status int) *httpexpect.Object {
+		return e.POST("/").WithJSON(body).WithHeader("X-Auth-Request-Email", "a@b.c").
+			WithHeader("X-Auth-Request-Groups", scopes).Expect().Status(status).JSON().Object()
+	}
+	query := func(q string) map[string]interface{} { return map[string]interface{}{"query": q} }
+
+	send(query(`{ findManyUser { id } findUniqueUser(where: {id: 1}) { id } }`), "", http.StatusOK)
+	send(query(`mutation { createOneUser(data: {email: "a@b.c"}) { id } }`), "", http.StatusOK)
+	send(query(`mutation { deleteOneUser(where: {id: 1}) { id } }`), "", http.StatusForbidden).
+		Path("$.errors[0].message").Equal(`rule "User.delete" requires the scope admin`)
+	send(query(`mutation { deleteOneUser(where: {id: 1}) { id } }`), "ops, admin", http.StatusOK)
+	send(query(`mutation { executeRaw(query: "DELETE FROM User", parameters: "[]") }`), "admin", http.StatusForbidden).
+		Path("$.errors[0].message").Equal(`rule "executeRaw" requires the scope ops`)
+
+	// default deny refuses what no rule covers
+	send(query(`mutation { updateOneUser(where: {id: 1}, data: {name: "b"}) { id } }`), "admin", http.StatusForbidden).
+		Path("$.errors[0].extensions.code").Equal("FORBIDDEN")
+
+	// operation names only restrict, a permissive name grants nothing
+	send(map[string]interface{}{"query": `query deleteUser { findManyUser { id } }`, "operationName": "deleteUser"}, "", http.StatusForbidden).
+		Path("$.errors[0].message").Equal(`rule "deleteUser" requires the scope admin`)
+	send(map[string]interface{}{"query": `mutation deleteUser { updateOneUser(where: {id: 1}, data: {name: "b"}) { id } }`}, "admin", http.StatusForbidden).
+		Path("$.errors[0].message").Equal("no rule allows updateOneUser")
+
+	// the models are checked against the schema, a reload naming unknown
+	// ones keeps the rules in place
+	require.NoError(t, h.CheckAuthRules())
+	h.Reload(Config{ReadLimitSeconds: 10000, WriteLimitSeconds: 2000, AuthRules: &AuthRules{Rules: map[string]AuthRule{"Usr.read": {}}}})
+	require.Same(t, rules, h.currentAuthRules())
+	h.Reload(Config{ReadLimitSeconds: 10000, WriteLimitSeconds: 2000, AuthRules: &AuthRules{Default: "allow"}})
+	send(query(`mutation { updateOneUser(where: {id: 1}, data: {name: "b"}) { id } }`), "", http.StatusOK)
+
+	typo := NewHandler(Config{QueryEngineSdlURL: fakeDB.URL + "/sdl", ReadLimitSeconds: 10000, WriteLimitSeconds: 2000, AuthRules: &AuthRules{Rules: map[string]AuthRule{"Usr.read": {}}}}, func() {})
+	require.EqualError(t, typo.CheckAuthRules(), "wunderbase: auth rules: unknown models in Usr.read")
+}
+
+func TestEngineIdle(t *testing.T) {
+	var up, starts int32 = 1, 0
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		EngineIdleAfter:   200 * time.Millisecond,
+		StopEngine:        func() { atomic.StoreInt32(&up, 0) },
+		StartEngine: func() error {
+			atomic.AddInt32(&starts, 1)
+			// the engine takes a moment to answer, requests must wait
+			time.AfterFunc(20*time.Millisecond, func() { atomic.StoreInt32(&up, 1) })
+			return nil
+		},
+	}, func() {})
+	defer h.Close()
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	query := map[string]interface{}{"query": `{ findManyUser { id } }`}
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	require.Eventually(t, h.engineStopped, 2*time.Second, 10*time.Millisecond)
+	e.GET("/health").Expect().Status(http.StatusOK)
+
+	// the requests after the stop queue until the engine answers again
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 1, atomic.LoadInt32(&starts))
+
+	events := h.sleepEvents.list()
+	require.Len(t, events, 2)
+	require.Equal(t, sleepEventEngineStart, events[0].Kind)
+	require.Equal(t, sleepEventEngineStop, events[1].Kind)
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_engine_idle_events_total{event="stop"} 1`).
+		Contains(`wunderbase_engine_idle_events_total{event="start"} 1`)
+}
+
+func TestLiveMigration(t *testing.T) {
+	release := make(chan struct{})
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "slow") {
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	var migrations int32
+	migrated := make(chan struct{})
+	newAPI := func(wait time.Duration) *httpexpect.Expect {
+		h := NewHandler(Config{
+			Production:        true,
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			AdminToken:        "secret",
+			MigrationWait:     wait,
+			Migrate: func(ctx context.Context) error {
+				atomic.AddInt32(&migrations, 1)
+				<-migrated
+				return nil
+			},
+		}, func() {})
+		t.Cleanup(h.Close)
+		api := httptest.NewServer(h)
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	e := newAPI(0)
+	query := map[string]interface{}{"query": `{ findManyUser { id } }`}
+
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		e.POST("/").WithJSON(map[string]interface{}{"query": `query slow { findManyUser { id } }`}).Expect().Status(http.StatusOK)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.POST("/admin/migration").WithHeader("Authorization", "Bearer secret").
+			Expect().Status(http.StatusOK).JSON().Object().ValueEqual("inProgress", false).ValueEqual("failed", false)
+	}()
+	require.Eventually(t, func() bool {
+		return e.GET("/health").Expect().Raw().StatusCode == http.StatusServiceUnavailable
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// new requests are turned away, the one in flight holds the migration off
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusServiceUnavailable).
+		Header("Retry-After").Equal("1")
+	e.POST("/admin/migration").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusConflict).Body().Contains("MIGRATION_IN_PROGRESS")
+	e.GET("/health").WithQuery("verbose", "true").Expect().Status(http.StatusServiceUnavailable).
+		JSON().Object().Value("components").Object().Value("migration").Object().ValueEqual("status", HealthFailing)
+	require.EqualValues(t, 0, atomic.LoadInt32(&migrations))
+
+	close(release)
+	<-slow
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&migrations) == 1 }, 2*time.Second, 10*time.Millisecond)
+	close(migrated)
+	<-done
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+
+	// with a wait, requests queue behind the migration instead
+	migrated = make(chan struct{})
+	e = newAPI(2 * time.Second)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		e.POST("/admin/migration").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusOK)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&migrations) == 2 }, 2*time.Second, 10*time.Millisecond)
+	time.AfterFunc(100*time.Millisecond, func() { close(migrated) })
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	<-done
+}
+
+func TestTimeoutHint(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		RequestTimeout:    time.Second,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	query := map[string]interface{}{"query": `{ findManyUser { id } }`}
+	slow := map[string]interface{}{"query": `query slow { findManyUser { id } }`}
+
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK).JSON().Object().NotContainsKey("extensions")
+	e.POST("/").WithJSON(query).WithHeader("X-Wunderbase-Timeout-Ms", "500").
+		Expect().Status(http.StatusOK).JSON().Path("$.extensions.timeout").Object().
+		ValueEqual("effectiveMs", 500).NotContainsKey("warning")
+	// the hint never exceeds the request timeout
+	e.POST("/").WithJSON(slow).WithHeader("X-Wunderbase-Timeout-Ms", "60000").
+		Expect().Status(http.StatusOK).JSON().Path("$.extensions.timeout.effectiveMs").Equal(1000)
+	e.POST("/").WithJSON(query).WithHeader("X-Wunderbase-Timeout-Ms", "soon").
+		Expect().Status(http.StatusOK).JSON().Path("$.extensions.timeout").Object().
+		ValueEqual("effectiveMs", 1000).Value("warning").String().Contains("invalid")
+
+	e.POST("/").WithJSON(slow).WithHeader("X-Wunderbase-Timeout-Ms", "50").
+		Expect().Status(http.StatusGatewayTimeout).
+		JSON().Path("$.errors[0].extensions.code").Equal("TIMEOUT")
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_timeout_hints_total{result="applied"} 2`).
+		Contains(`wunderbase_timeout_hints_total{result="capped"} 1`).
+		Contains(`wunderbase_timeout_hints_total{result="invalid"} 1`)
+}
+
+func TestDMMF(t *testing.T) {
+	var fetches int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdl":
+			_, _ = w.Write([]byte(restSDL))
+		case "/dmmf":
+			atomic.AddInt32(&fetches, 1)
+			_, _ = w.Write([]byte(`{"datamodel":{"models":[{"name":"User"}]}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	newHandler := func(enable bool) *Handler {
+		h := NewHandler(Config{
+			QueryEngineURL:     fakeDB.URL,
+			QueryEngineSdlURL:  fakeDB.URL + "/sdl",
+			QueryEngineDmmfURL: fakeDB.URL + "/dmmf",
+			ReadLimitSeconds:   10000,
+			WriteLimitSeconds:  2000,
+			AdminToken:         "secret",
+			EnableDMMF:         enable,
+		}, func() {})
+		t.Cleanup(h.Close)
+		return h
+	}
+	h := newHandler(true)
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.GET("/admin/dmmf").Expect().Status(http.StatusUnauthorized)
+	for i := 0; i < 2; i++ {
+		e.GET("/admin/dmmf").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusOK).
+			JSON().Path("$.datamodel.models[0].name").Equal("User")
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&fetches))
+	// a new engine may serve another schema
+	h.Pause()
+	h.Resume()
+	e.GET("/admin/dmmf").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusOK)
+	require.EqualValues(t, 2, atomic.LoadInt32(&fetches))
+
+	disabled := httptest.NewServer(newHandler(false))
+	defer disabled.Close()
+	httpexpect.New(t, disabled.URL).GET("/admin/dmmf").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusNotFound)
+}
+
+func TestErrorRates(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "createOneUser"):
+			_, _ = w.Write([]byte(`{"errors":[{"error":"Unique constraint failed","user_facing_error":{"error_code":"P2002"}}]}`))
+		case strings.Contains(string(body), "crash"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		AdminToken:        "secret",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	for i := 0; i < 2; i++ {
+		e.POST("/").WithJSON(map[string]interface{}{"query": `mutation { createOneUser(data: {}) { id } }`}).
+			Expect().Status(http.StatusOK)
+	}
+	e.POST("/").WithJSON(map[string]interface{}{"query": `query crash { findManyUser { id } }`}).
+		Expect().Status(http.StatusInternalServerError)
+	e.POST("/").WithJSON(map[string]interface{}{"query": `{ findManyUser { id } }`}).Expect().Status(http.StatusOK)
+
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_graphql_errors_total{code="P2002"} 2`).
+		Contains(`wunderbase_graphql_errors_total{code="ENGINE_UNAVAILABLE"} 1`).
+		Contains(`wunderbase_graphql_error_ratio 0.75`)
+	errors := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object().Value("errors").Object()
+	errors.ValueEqual("ratio", 0.75).NotContainsKey("note")
+	errors.Value("topCodes").Array().Element(0).Object().ValueEqual("code", "P2002").ValueEqual("count", 2)
+
+	// a streamed body isn't inspected, only its status counts
+	rates := newErrorRates()
+	now := time.Now()
+	require.Equal(t, "", rates.record("", http.StatusOK, true, now))
+	require.Equal(t, "HTTP_502", rates.record("", http.StatusBadGateway, true, now))
+	stats := rates.stats(defaultTopK, now)
+	require.Equal(t, 0.5, stats.Ratio)
+	require.EqualValues(t, 2, stats.Streamed)
+	require.NotEmpty(t, stats.Note)
+	require.Zero(t, rates.ratio(now.Add(time.Minute)))
+}
+
+func TestSafeMutations(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	api := httptest.NewServer(NewHandler(Config{
+		Production:          true,
+		QueryEngineURL:      fakeDB.URL,
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		TrustedAuthHeader:   "X-Auth-Request-Email",
+		TrustedScopesHeader: "X-Auth-Request-Groups",
+		TrustedProxies:      []*net.IPNet{trusted},
+		SafeMutations:       true,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	send := func(body map[string]interface{}, scopes, allow string, status int) *httpexpect.Response {
+		req := e.POST("/").WithJSON(body).WithHeader("X-Auth-Request-Email", "a@b.c").WithHeader("X-Auth-Request-Groups", scopes)
+		if allow != "" {
+			req = req.WithHeader("X-Wunderbase-Allow-Dangerous", allow)
+		}
+		return req.Expect().Status(status)
+	}
+
+	wipe := map[string]interface{}{"query": `mutation wipe { deleteManyUser { count } }`}
+	send(wipe, "", "", http.StatusBadRequest).JSON().Path("$.errors[0].extensions.code").Equal("DANGEROUS_MUTATION_BLOCKED")
+	send(wipe, "", "", http.StatusBadRequest).Body().Contains("x-wunderbase-allow-dangerous: wipe")
+	// only an admin-scoped caller may override, and only the operation named
+	send(wipe, "ops", "wipe", http.StatusBadRequest)
+	send(wipe, "admin", "other", http.StatusBadRequest)
+	send(wipe, "ops admin", "wipe", http.StatusOK)
+	send(map[string]interface{}{"query": `mutation { deleteManyUser { count } }`}, "admin", "wipe", http.StatusBadRequest)
+
+	for _, blocked := range []map[string]interface{}{
+		{"query": `mutation { updateManyUser(where: {}, data: {name: "x"}) { count } }`},
+		{"query": `mutation { deleteManyUser(where: null) { count } }`},
+		{"query": `mutation ($w: UserWhereInput) { deleteManyUser(where: $w) { count } }`},
+		{"query": `mutation ($w: UserWhereInput) { deleteManyUser(where: $w) { count } }`, "variables": map[string]interface{}{"w": map[string]interface{}{}}},
+		{"query": `mutation ($w: UserWhereInput) { deleteManyUser(where: $w) { count } }`, "variables": map[string]interface{}{"w": nil}},
+		{"query": `mutation ($w: UserWhereInput = {}) { deleteManyUser(where: $w) { count } }`},
+		{"query": `mutation { createOneUser(data: {}) { id } deleteManyPost { count } }`},
+		{"query": `mutation { ...Wipe } fragment Wipe on Mutation { deleteManyPost { count } }`},
+		{"query": `mutation { ... on Mutation { updateManyPost(data: {title: "x"}) { count } } }`},
+		{"query": `mutation { deleteManyUser(where: {AND: [], OR: []}) { count } }`},
+		{"query": `mutation ($w: UserWhereInput) { deleteManyUser(where: $w) { count } }`, "variables": map[string]interface{}{"w": map[string]interface{}{"AND": []interface{}{}}}},
+	} {
+		send(blocked, "", "", http.StatusBadRequest)
+	}
+	for _, allowed := range []map[string]interface{}{
+		{"query": `mutation { deleteManyUser(where: {id: {in: [1, 2]}}) { count } }`},
+		{"query": `mutation ($w: UserWhereInput) { updateManyUser(where: $w, data: {}) { count } }`, "variables": map[string]interface{}{"w": map[string]interface{}{"id": 1}}},
+		{"query": `mutation ($w: UserWhereInput = {id: 1}) { deleteManyUser(where: $w) { count } }`},
+		{"query": `mutation { deleteOneUser(where: {id: 1}) { id } }`},
+		{"query": `mutation { ...Prune } fragment Prune on Mutation { deleteManyPost(where: {AND: [{id: 1}]}) { count } }`},
+		{"query": `{ findManyUser { id } }`},
+	} {
+		send(allowed, "", "", http.StatusOK)
+	}
+}
+
+func TestIndexAdvice(t *testing.T) {
+	var explains int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "EXPLAIN QUERY PLAN"):
+			atomic.AddInt32(&explains, 1)
+			_, _ = w.Write([]byte(`{"data":{"queryRaw":[{"id":2,"parent":0,"notused":0,"detail":"SCAN Order"}]}}`))
+		case strings.Contains(string(body), "count(*)"):
+			_, _ = w.Write([]byte(`{"data":{"queryRaw":{"columns":["n"],"types":["bigint"],"rows":[["5000"]]}}}`))
+		default:
+			time.Sleep(30 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		Production:           true,
+		QueryEngineURL:       fakeDB.URL,
+		AdminToken:           "secret",
+		ReadLimitSeconds:     10000,
+		WriteLimitSeconds:    2000,
+		SlowRequestThreshold: 10 * time.Millisecond,
+		IndexAdvice:          true,
+	}, func() {})
+	defer h.Close()
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	sql := "SELECT `main`.`Order`.`id` FROM `main`.`Order` WHERE (`main`.`Order`.`customerId` = ? AND `main`.`Order`.`status` = ?) LIMIT ? OFFSET ?"
+	query := map[string]interface{}{"query": `{ findManyOrder(where: {customerId: 1, status: "open"}) { id } }`}
+	for _, id := range []string{"slow-1", "slow-2"} {
+		ObserveQuery(id, sql, `[1,"open",-1,0]`)
+		e.POST("/").WithHeader(tracing.RequestIDHeader, id).WithJSON(query).Expect().Status(http.StatusOK)
+	}
+
+	require.Eventually(t, func() bool {
+		stats := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").Expect().JSON().Object().Raw()
+		return stats["indexAdvice"] != nil
+	}, 2*time.Second, 10*time.Millisecond)
+	advice := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").Expect().JSON().Object().Value("indexAdvice").Array()
+	advice.Length().Equal(1)
+	suggestion := advice.Element(0).Object()
+	suggestion.ValueEqual("table", "Order").ValueEqual("columns", []string{"customerId", "status"}).ValueEqual("rows", 5000)
+	suggestion.Value("suggestion").String().Contains("consider @@index([customerId, status])")
+	// a fingerprint is explained once an hour at most
+	require.EqualValues(t, 1, atomic.LoadInt32(&explains))
+}
+
+func TestSharedHandler(t *testing.T) {
+	var engineRequests int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&engineRequests, 1)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	public := NewHandler(Config{
+		Production:           true,
+		QueryEngineURL:       fakeDB.URL,
+		ReadLimitSeconds:     10000,
+		WriteLimitSeconds:    2000,
+		DisableIntrospection: true,
+		DisableRawQueries:    true,
+	}, func() {})
+	internal := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Shared:            public,
+	}, func() {})
+	publicAPI, internalAPI := httptest.NewServer(public), httptest.NewServer(internal)
+	defer publicAPI.Close()
+	defer internalAPI.Close()
+
+	introspection := map[string]interface{}{"query": `{ __schema { types { name } } }`}
+	raw := map[string]interface{}{"query": `mutation { queryRaw(query: "SELECT 1", parameters: "[]") }`}
+	e := httpexpect.New(t, publicAPI.URL)
+	e.POST("/").WithJSON(introspection).Expect().Status(http.StatusForbidden).
+		JSON().Path("$.errors[0].extensions.code").Equal("INTROSPECTION_DISABLED")
+	e.POST("/").WithJSON(raw).Expect().Status(http.StatusForbidden).
+		JSON().Path("$.errors[0].extensions.code").Equal("RAW_QUERIES_DISABLED")
+	e.POST("/").WithJSON(map[string]interface{}{"query": `{ findManyUser { id __typename } }`}).Expect().Status(http.StatusOK)
+
+	internalE := httpexpect.New(t, internalAPI.URL)
+	internalE.POST("/").WithJSON(introspection).Expect().Status(http.StatusOK)
+	internalE.POST("/").WithJSON(raw).Expect().Status(http.StatusOK)
+	require.Equal(t, int32(3), atomic.LoadInt32(&engineRequests))
+
+	// the state of the public handler holds for both
+	public.Pause()
+	internalE.POST("/").WithJSON(raw).Expect().Status(http.StatusServiceUnavailable)
+	public.Resume()
+	internalE.POST("/").WithJSON(raw).Expect().Status(http.StatusOK)
+	require.Equal(t, public.stats, internal.stats)
+	require.Equal(t, public.sink, internal.sink)
+	internal.Close()
+	public.Close()
+}
+
+func TestRequestsDuringStartup(t *testing.T) {
+	var up int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	handler := NewHandler(Config{
+		Production:           true,
+		QueryEngineURL:       fakeDB.URL,
+		HealthEndpoint:       "/health",
+		MetricsEndpoint:      "/metrics",
+		AdminToken:           "secret",
+		RecentRequests:       10,
+		ReadLimitSeconds:     10000,
+		WriteLimitSeconds:    2000,
+		RequestTimeout:       20 * time.Millisecond,
+		EngineConnectBackoff: time.Millisecond,
+	}, func() {})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+
+	// hammer every kind of endpoint while the engine comes up, run with
+	// -race to catch state read before it is built
+	query := []byte(`{"query":"{ findManyUser { id } }"}`)
+	var wg sync.WaitGroup
+	statuses := make(chan int, 1000)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				var req *http.Request
+				switch (i + j) % 4 {
+				case 0:
+					req, _ = http.NewRequest(http.MethodPost, api.URL+"/", bytes.NewReader(query))
+					req.Header.Set("Content-Type", "application/json")
+				case 1:
+					req, _ = http.NewRequest(http.MethodGet, api.URL+"/health", nil)
+				case 2:
+					req, _ = http.NewRequest(http.MethodGet, api.URL+"/metrics", nil)
+				case 3:
+					req, _ = http.NewRequest(http.MethodGet, api.URL+"/admin/stats", nil)
+					req.Header.Set("Authorization", "Bearer secret")
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					continue
+				}
+				drain(resp)
+				statuses <- resp.StatusCode
+				if i == 0 && j == 10 {
+					atomic.StoreInt32(&up, 1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+	rejected := 0
+	for status := range statuses {
+		// the health endpoint reports the engine down with 500
+		require.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusInternalServerError}, status)
+		if status == http.StatusServiceUnavailable {
+			rejected++
+		}
+	}
+	require.NotZero(t, rejected, "requests before the engine answered are turned away")
+
+	e := httpexpect.New(t, api.URL)
+	e.POST("/").WithBytes(query).WithHeader("Content-Type", "application/json").Expect().Status(http.StatusOK)
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_starting_rejections_total")
+}
+
+func TestCapture(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"createOrder":{"id":1,"token":"t0k3n"}}}`))
+	}))
+	defer fakeDB.Close()
+	dir := t.TempDir()
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.Production = true
+		config.QueryEngineURL = fakeDB.URL
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.AdminToken = "secret"
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	post := func(e *httpexpect.Expect, body string) {
+		e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(body)).Expect().Status(http.StatusOK)
+	}
+	capture := func(e *httpexpect.Expect, method string) *httpexpect.Request {
+		return e.Request(method, "/admin/capture").WithHeader("Authorization", "Bearer secret")
+	}
+	createOrder := `{"query":"mutation createOrder($password: String) { createOrder { id token } }","operationName":"createOrder","variables":{"password":"hunter2","note":"gift"}}`
+
+	e := newAPI(Config{CaptureDir: dir, CaptureRedact: []string{"password", "token"}})
+	e.POST("/admin/capture").WithJSON(map[string]interface{}{"operationName": "createOrder", "count": 1}).
+		Expect().Status(http.StatusUnauthorized)
+	capture(e, http.MethodPost).WithJSON(map[string]interface{}{"operationName": "createOrder", "count": 0}).
+		Expect().Status(http.StatusBadRequest)
+	capture(e, http.MethodPost).WithJSON(map[string]interface{}{"operationName": "createOrder", "count": 2}).
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("armed", true).ValueEqual("remaining", 2)
+
+	post(e, `{"query":"query listOrders { findManyOrder { id } }","operationName":"listOrders"}`)
+	post(e, createOrder)
+	post(e, createOrder)
+	post(e, createOrder)
+
+	status := capture(e, http.MethodGet).Expect().Status(http.StatusOK).JSON().Object()
+	status.ValueEqual("armed", false).ValueEqual("operationName", "createOrder")
+	captures := status.Value("captures").Array()
+	captures.Length().Equal(2)
+	exchange := captures.Element(0).Object()
+	exchange.ValueEqual("status", http.StatusOK).ContainsKey("requestId")
+	exchange.Path("$.request.variables").Object().ValueEqual("password", "[REDACTED]").ValueEqual("note", "gift")
+	exchange.Path("$.response.data.createOrder").Object().ValueEqual("token", "[REDACTED]").ValueEqual("id", 1)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "hunter2")
+
+	capture(e, http.MethodDelete).Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("armed", false).Value("captures").Array().Empty()
+
+	// the byte cap disarms before the response is kept
+	e = newAPI(Config{CaptureMaxBytes: 100})
+	capture(e, http.MethodPost).WithJSON(map[string]interface{}{"operationName": "createOrder", "count": 5}).
+		Expect().Status(http.StatusOK)
+	post(e, createOrder)
+	capture(e, http.MethodGet).Expect().Status(http.StatusOK).JSON().Object().
+		ValueEqual("armed", false).Value("captures").Array().Empty()
+
+	e = newAPI(Config{DisableCapture: true})
+	capture(e, http.MethodPost).WithJSON(map[string]interface{}{"operationName": "createOrder", "count": 1}).
+		Expect().Status(http.StatusForbidden).JSON().Path("$.errors[0].extensions.code").Equal("CAPTURE_DISABLED")
+}
+
+func TestStorageFailure(t *testing.T) {
+	var ioErrors int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && atomic.LoadInt32(&ioErrors) == 1 {
+			_, _ = w.Write([]byte(`{"errors":[{"error":"Error occurred during query execution: disk I/O error","user_facing_error":{"is_panic":false,"message":"disk I/O error"}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	database := filepath.Join(t.TempDir(), "dev.db")
+	require.NoError(t, os.WriteFile(database, nil, 0600))
+	var restarts, restartFails int32
+	newAPI := func(reads bool) *httpexpect.Expect {
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:        fakeDB.URL,
+			HealthEndpoint:        "/health",
+			DatabaseFilePath:      database,
+			StorageCheckInterval:  10 * time.Millisecond,
+			ReadsOnStorageFailure: reads,
+			RestartEngine: func(ctx context.Context) error {
+				atomic.AddInt32(&restarts, 1)
+				if atomic.LoadInt32(&restartFails) == 1 {
+					return errors.New("engine not ready")
+				}
+				atomic.StoreInt32(&ioErrors, 0)
+				return nil
+			},
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			Production:        true,
+		}, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	query := map[string]interface{}{"query": "{ findManyUser { id } }"}
+	mutation := map[string]interface{}{"query": `mutation { createOneUser(data: {email: "a@b.c"}) { id } }`}
+	waitHealthy := func(e *httpexpect.Expect, healthy bool) {
+		require.Eventually(t, func() bool {
+			return (e.GET("/health").Expect().Raw().StatusCode == http.StatusOK) == healthy
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// the engine failing with disk I/O errors takes the instance out of
+	// rotation until it restarted
+	e := newAPI(false)
+	e.GET("/health").Expect().Status(http.StatusOK)
+	atomic.StoreInt32(&restartFails, 1)
+	atomic.StoreInt32(&ioErrors, 1)
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	e.GET("/health").Expect().Status(http.StatusServiceUnavailable).
+		JSON().Path("$.errors[0].extensions.code").Equal("STORAGE_UNAVAILABLE")
+	component := e.GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusServiceUnavailable).
+		JSON().Path("$.components.database").Object()
+	component.ValueEqual("status", HealthFailing).Path("$.details.condition").Equal("storage_unavailable")
+	component.Path("$.details.error").String().Contains("disk I/O error")
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusServiceUnavailable).
+		JSON().Path("$.errors[0].extensions.code").Equal("STORAGE_UNAVAILABLE")
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusServiceUnavailable)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&restarts) > 0 }, 5*time.Second, 10*time.Millisecond)
+	e.GET("/health").Expect().Status(http.StatusServiceUnavailable)
+	atomic.StoreInt32(&restartFails, 0)
+	waitHealthy(e, true)
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusOK)
+
+	// so does the database file going away, reads may still be served
+	e = newAPI(true)
+	require.NoError(t, os.Rename(database, database+".gone"))
+	waitHealthy(e, false)
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusServiceUnavailable)
+	require.NoError(t, os.Rename(database+".gone", database))
+	waitHealthy(e, true)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	var sdl atomic.Value
+	sdl.Store(restSDL)
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(sdl.Load().(string)))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+	}, func() {})
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	v1, v2 := schemaVersion([]byte(restSDL)), schemaVersion([]byte(restSDL+"\n"))
+
+	e.GET("/schema/version").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("version", v1)
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).Expect().
+		Status(http.StatusOK).Header(SchemaVersionHeader).Equal(v1)
+
+	req, err := http.NewRequest(http.MethodGet, api.URL+"/schema/version", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	events := bufio.NewReader(resp.Body)
+	next := func() string {
+		var event []string
+		for {
+			line, err := events.ReadString('\n')
+			require.NoError(t, err)
+			if line == "\n" {
+				return strings.Join(event, "")
+			}
+			event = append(event, line)
+		}
+	}
+	require.Equal(t, "event: schema_version\ndata: {\"version\":\""+v1+"\"}\n", next())
+
+	// a swap serving the same schema changes nothing, a new schema does
+	h.Pause()
+	h.Resume()
+	sdl.Store(restSDL + "\n")
+	h.Pause()
+	h.Resume()
+	require.Equal(t, "event: schema_changed\ndata: {\"version\":\""+v2+"\"}\n", next())
+	e.GET("/schema/version").Expect().Status(http.StatusOK).Header(SchemaVersionHeader).Equal(v2)
+
+	h.CloseStreams()
+	_, err = events.ReadString('\n')
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestWarmUp(t *testing.T) {
+	var queries []string
+	release := make(chan struct{})
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		query, _ := jsonparser.GetString(body, "query")
+		queries = append(queries, query)
+		if len(queries) == 1 {
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"data":{"queryRaw":"[]"}}`))
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		AdminToken:        "secret",
+		WarmupRuns:        3,
+	}, func() {})
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.WarmUp(context.Background())
+	}()
+	// the health endpoint fails until the warm-up is over
+	require.Eventually(t, func() bool {
+		return e.GET("/health").Expect().Raw().StatusCode == http.StatusInternalServerError
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	<-done
+	e.GET("/health").Expect().Status(http.StatusOK)
+
+	require.Equal(t, []string{defaultWarmupQuery, defaultWarmupQuery, defaultWarmupQuery}, queries)
+	warmup := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object().Value("warmup").Object()
+	warmup.ValueEqual("runs", 3).NotContainsKey("error")
+	warmup.Value("durationMs").Number().Gt(0)
+}
+
+func TestAdminDiagnostics(t *testing.T) {
+	newAPI := func(config Config) *httpexpect.Expect {
+		fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		t.Cleanup(fakeDB.Close)
+		config.QueryEngineURL = fakeDB.URL
+		config.HealthEndpoint = "/health"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+
+	e := newAPI(Config{AdminToken: "secret", EnablePprof: true})
+	e.GET("/admin/goroutines").Expect().Status(http.StatusUnauthorized)
+	e.GET("/admin/goroutines").WithHeader("Authorization", "Bearer wrong").Expect().Status(http.StatusUnauthorized)
+	e.GET("/admin/goroutines").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).Body().Contains("goroutine")
+	e.GET("/admin/debug/pprof/").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).Body().Contains("heap")
+	e.GET("/admin/debug/vars").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object().ContainsKey("goroutines")
+
+	e = newAPI(Config{AdminToken: "secret"})
+	e.GET("/admin/goroutines").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusNotFound)
+	e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object().ContainsKey("topByCount").ContainsKey("slowQueries")
+	e.GET("/admin/migration").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("failed", false).NotContainsKey("error")
+
+	e = newAPI(Config{AdminToken: "secret", MigrationError: &migrate.Error{Method: "schemaPush", Code: 4466, Message: "boom", IsPanic: true, FullError: "boom at schema.prisma:3"}})
+	migration := e.GET("/admin/migration").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Object()
+	migration.ValueEqual("failed", true)
+	migration.Value("error").Object().ValueEqual("code", 4466).ValueEqual("message", "boom").
+		ValueEqual("isPanic", true).ValueEqual("fullError", "boom at schema.prisma:3")
+
+	e = newAPI(Config{EnablePprof: true})
+	e.GET("/admin/goroutines").Expect().Status(http.StatusNotFound)
+}
+
+func TestKeepAlive(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fakeDB.Close()
+	slept := make(chan struct{})
+	handler := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		EnableSleepMode:   true,
+		SleepAfterSeconds: 1,
+		KeepAliveMax:      2 * time.Second,
+		AdminToken:        "secret",
+	}, func() { close(slept) })
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	admin := func(method, path string) *httpexpect.Request {
+		return e.Request(method, path).WithHeader("Authorization", "Bearer secret")
+	}
+
+	admin("GET", "/admin/keepalive").Expect().Status(http.StatusMethodNotAllowed)
+	admin("POST", "/admin/keepalive").WithQuery("for", "soon").Expect().Status(http.StatusBadRequest)
+	// the duration is bounded by KeepAliveMax
+	admin("POST", "/admin/keepalive").WithQuery("for", "1h").Expect().Status(http.StatusOK).
+		JSON().Object().Value("sleepInSeconds").Number().InRange(1.5, 2)
+	select {
+	case <-slept:
+		t.Fatal("slept despite the keepalive")
+	case <-time.After(1500 * time.Millisecond):
+	}
+	require.Empty(t, handler.stats.top(1, false), "keepalives aren't counted as requests")
+
+	admin("POST", "/admin/sleep").Expect().Status(http.StatusAccepted)
+	select {
+	case <-slept:
+	case <-time.After(time.Second):
+		t.Fatal("didn't sleep")
+	}
+	events := admin("GET", "/admin/stats").Expect().Status(http.StatusOK).JSON().Path("$.sleepEvents").Array()
+	events.Length().Equal(2)
+	events.Element(0).Object().ValueEqual("kind", "manual")
+	events.Element(1).Object().ValueEqual("kind", "keepalive").ContainsKey("until")
+
+	// without sleep mode there is nothing to keep awake
+	disabled := httptest.NewServer(NewHandler(Config{QueryEngineURL: fakeDB.URL, ReadLimitSeconds: 1, WriteLimitSeconds: 1, AdminToken: "secret"}, func() {}))
+	defer disabled.Close()
+	httpexpect.New(t, disabled.URL).POST("/admin/sleep").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusConflict)
+}
+
+func TestSleepPreStop(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	slept := make(chan struct{})
+	api := httptest.NewServer(NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		EnableSleepMode:   true,
+		SleepAfterSeconds: 60,
+		AdminToken:        "secret",
+		SleepPreStop:      time.Second,
+		StopHeader:        "fly-replay",
+		StopHeaderValue:   "elsewhere=true",
+	}, func() { close(slept) }))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	query := map[string]interface{}{"query": "{ findManyUser { id } }"}
+
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK).Header("fly-replay").Empty()
+	e.POST("/admin/sleep").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusAccepted)
+	require.Eventually(t, func() bool {
+		return e.POST("/").WithJSON(query).Expect().Raw().StatusCode == http.StatusServiceUnavailable
+	}, time.Second, 10*time.Millisecond)
+	// the platform retries new requests elsewhere until the process stops
+	resp := e.POST("/").WithJSON(query).Expect().Status(http.StatusServiceUnavailable)
+	resp.Header("fly-replay").Equal("elsewhere=true")
+	resp.Header("Retry-After").Equal("1")
+	resp.JSON().Path("$.errors[0].extensions.code").Equal("STOPPING")
+	e.GET("/health").Expect().Status(http.StatusServiceUnavailable)
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_stopping_rejections_total")
+	select {
+	case <-slept:
+		t.Fatal("stopped before the pre-stop delay")
+	default:
+	}
+	select {
+	case <-slept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't stop after the pre-stop delay")
+	}
+}
+
+func TestSleepResetOn(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	newAPI := func(resetOn string) (*Handler, *httpexpect.Expect, chan struct{}) {
+		slept := make(chan struct{})
+		handler := NewHandler(Config{
+			Production:        true,
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			EnableSleepMode:   true,
+			SleepAfterSeconds: 60,
+			AdminToken:        "secret",
+			SleepResetOn:      resetOn,
+			SleepResetExempt:  []string{"Dashboard"},
+		}, func() { close(slept) })
+		api := httptest.NewServer(handler)
+		t.Cleanup(api.Close)
+		return handler, httpexpect.New(t, api.URL), slept
+	}
+	send := func(e *httpexpect.Expect, query string) string {
+		return e.POST("/").WithJSON(map[string]interface{}{"query": query}).
+			Expect().Status(http.StatusOK).Header(tracing.RequestIDHeader).Raw()
+	}
+	lastReset := func(handler *Handler) *sleepActivity {
+		reset, _ := handler.sleep.state()
+		return reset
+	}
+
+	handler, e, slept := newAPI(SleepResetWrites)
+	send(e, `{ findManyUser { id } }`)
+	require.Nil(t, lastReset(handler), "reads don't reset the timer")
+	write := send(e, `mutation { deleteManyUser { count } }`)
+	send(e, `mutation Dashboard { updateManyUser(data: {}) { count } }`)
+	require.Equal(t, write, lastReset(handler).RequestID, "exempt operations don't reset the timer")
+	require.True(t, lastReset(handler).Write)
+
+	// the sleep event names the request that kept the instance awake
+	e.POST("/admin/sleep").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusAccepted)
+	select {
+	case <-slept:
+	case <-time.After(time.Second):
+		t.Fatal("didn't sleep")
+	}
+	e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusOK).
+		JSON().Path("$.sleepEvents[0].lastReset").Object().ValueEqual("requestId", write).ValueEqual("type", "mutation")
+
+	handler, e, _ = newAPI(SleepResetNone)
+	send(e, `mutation { deleteManyUser { count } }`)
+	require.Nil(t, lastReset(handler), "nothing resets the timer")
+
+	handler, e, _ = newAPI("")
+	read := send(e, `query Users { findManyUser { id } }`)
+	require.Equal(t, read, lastReset(handler).RequestID)
+	send(e, `query Dashboard { findManyUser { id } }`)
+	require.Equal(t, read, lastReset(handler).RequestID)
+	e.GET("/health").WithQuery("verbose", "1").Expect().
+		JSON().Path("$.components.sleep_mode.details").Object().
+		ValueEqual("resetOn", "all").Path("$.lastReset.operationName").Equal("Users")
+}
+
+func TestEngineConnectionReuse(t *testing.T) {
+	// load the handler with concurrent requests and count the connections
+	// the engine accepted
+	newConnections := func(maxIdleConns int) (int32, string) {
+		var accepted int32
+		fakeDB := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		}))
+		fakeDB.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}
+		fakeDB.Start()
+		defer fakeDB.Close()
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:     fakeDB.URL,
+			HealthEndpoint:     "/health",
+			MetricsEndpoint:    "/metrics",
+			ReadLimitSeconds:   100000,
+			WriteLimitSeconds:  100000,
+			Production:         true,
+			EngineMaxIdleConns: maxIdleConns,
+		}, func() {}))
+		defer api.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					resp, err := http.Post(api.URL, "application/json", strings.NewReader(`{"query":"{ findManyUser { id } }"}`))
+					if err == nil {
+						drain(resp)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		resp, err := http.Get(api.URL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		exposition, _ := io.ReadAll(resp.Body)
+		return atomic.LoadInt32(&accepted), string(exposition)
+	}
+
+	pooled, exposition := newConnections(0)
+	require.LessOrEqual(t, pooled, int32(9), "at most one connection per concurrent request, and the startup probe")
+	require.Contains(t, exposition, `wunderbase_engine_connections_total{reused="true"}`)
+	churned, _ := newConnections(1)
+	require.Greater(t, churned, 2*pooled, "with a single idle connection most are closed after use")
+}
+
+func TestEngineConnectRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	serve := func(l net.Listener) *http.Server {
+		engine := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		})}
+		go func() { _ = engine.Serve(l) }()
+		return engine
+	}
+	engine := serve(l)
+
+	newAPI := func(retries int) (*Handler, *httpexpect.Expect) {
+		handler := NewHandler(Config{
+			QueryEngineURL:       "http://" + addr + "/",
+			HealthEndpoint:       "/health",
+			MetricsEndpoint:      "/metrics",
+			ReadLimitSeconds:     10000,
+			WriteLimitSeconds:    2000,
+			Production:           true,
+			EngineConnectRetries: retries,
+			EngineConnectBackoff: 20 * time.Millisecond,
+		}, func() {})
+		api := httptest.NewServer(handler)
+		t.Cleanup(api.Close)
+		e := httpexpect.New(t, api.URL)
+		e.GET("/health").Expect().Status(http.StatusOK)
+		return handler, e
+	}
+	query := map[string]string{"query": "{ findManyUser { id } }"}
+	failing, noRetries := newAPI(0)
+	retrying, retries := newAPI(50)
+
+	// the engine restarts, refusing connections until it listens again
+	require.NoError(t, engine.Close())
+	failing.client.CloseIdleConnections()
+	retrying.client.CloseIdleConnections()
+	noRetries.POST("/").WithJSON(query).Expect().Status(http.StatusInternalServerError)
+
+	restarted := make(chan *http.Server, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			close(restarted)
+			return
+		}
+		restarted <- serve(l)
+	}()
+	retries.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	if engine := <-restarted; engine != nil {
+		defer engine.Close()
+	}
+	retries.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_engine_connect_retries_total")
+}
+
+func TestRecentRequests(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("createUser")) {
+			_, _ = w.Write([]byte(`{"errors":[{"error":"Unique constraint failed","user_facing_error":{"is_panic":false,"message":"Unique constraint failed","error_code":"P2002"}}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.QueryEngineURL = fakeDB.URL
+		config.HealthEndpoint = "/health"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.AdminToken = "secret"
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	post := func(e *httpexpect.Expect, body string) {
+		e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(body)).Expect()
+	}
+	requests := func(e *httpexpect.Expect, query string) *httpexpect.Array {
+		return e.GET("/admin/requests").WithQueryString(query).WithHeader("Authorization", "Bearer secret").
+			Expect().Status(http.StatusOK).JSON().Path("$.requests").Array()
+	}
+
+	e := newAPI(Config{Production: true, RecentRequests: 3, CaptureBodies: true})
+	post(e, `{"query":"query A { findManyUser { id } }","operationName":"A","variables":{"email":"a@b.c"}}`)
+	post(e, `{"query":"mutation B { createUser(data: {}) { id } }","operationName":"B"}`)
+	post(e, `{"query":"query C { findManyUser { id } }","operationName":"C"}`)
+	post(e, `{"query":"query D { findManyUser { id } }","operationName":"D"}`)
+
+	all := requests(e, "")
+	all.Length().Equal(3)
+	all.Element(0).Object().ValueEqual("operationName", "D").ValueEqual("status", http.StatusOK).
+		ContainsKey("fingerprint").ContainsKey("requestId").NotContainsKey("errorCode")
+	all.Element(2).Object().ValueEqual("operationName", "B").ValueEqual("type", "mutation")
+	for _, entry := range all.Iter() {
+		// production never keeps bodies
+		entry.Object().NotContainsKey("query").NotContainsKey("variables")
+	}
+	failed := requests(e, "status=error")
+	failed.Length().Equal(1)
+	failed.Element(0).Object().ValueEqual("operationName", "B").ValueEqual("errorCode", "P2002")
+	requests(e, "status=ok&limit=1").Length().Equal(1)
+	e.GET("/admin/requests").WithQuery("status", "slow").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusBadRequest)
+
+	e = newAPI(Config{RecentRequests: 3, CaptureBodies: true})
+	post(e, `{"query":"query A { findManyUser { id } }","variables":{"email":"a@b.c"}}`)
+	requests(e, "").Element(0).Object().ValueEqual("query", "query A { findManyUser { id } }").
+		ValueEqual("variables", map[string]string{"email": "a@b.c"})
+
+	e = newAPI(Config{Production: true})
+	e.GET("/admin/requests").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusNotFound)
+}
+
+// lockedBuffer is a log output written by the handlers of the requests.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestOperationNames(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	logs := &lockedBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		AdminToken:        "secret",
+		RecentRequests:    10,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	for _, name := range []interface{}{
+		"Checkout\nlevel=ERROR msg=forged",
+		"\x1b[31mCheckout",
+		// a cyrillic С
+		"Сheckout",
+		"1Checkout",
+		42,
+	} {
+		e.POST("/").WithJSON(map[string]interface{}{"query": "query Checkout { findManyUser { id } }", "operationName": name}).
+			Expect().Status(http.StatusBadRequest).
+			JSON().Path("$.errors[0].extensions.code").Equal("INVALID_OPERATION_NAME")
+	}
+	long := strings.Repeat("Checkout", 1000)
+	e.POST("/").WithJSON(map[string]interface{}{"query": "query " + long + " { findManyUser { id } }", "operationName": long}).
+		Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }", "operationName": nil}).
+		Expect().Status(http.StatusOK)
+
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_invalid_operation_names_total 5")
+	requests := e.GET("/admin/requests").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Path("$.requests").Array()
+	requests.Length().Equal(7)
+	requests.Element(1).Object().ValueEqual("operationName", long[:maxOperationNameLength])
+	for _, entry := range requests.Iter()[2:] {
+		entry.Object().NotContainsKey("operationName").ValueEqual("errorCode", "INVALID_OPERATION_NAME")
+	}
+
+	require.Eventually(t, func() bool { return strings.Count(logs.String(), "msg=request") == 7 }, 5*time.Second, 10*time.Millisecond)
+	output := logs.String()
+	require.Equal(t, 7, strings.Count(output, "\n"), "one line per request")
+	require.NotContains(t, output, "forged")
+	require.NotContains(t, output, "\x1b")
+	require.NotContains(t, output, "Сheckout")
+	require.Contains(t, output, "operationName="+long[:maxOperationNameLength]+" ")
+	require.NotContains(t, output, long[:maxOperationNameLength+1])
+
+	require.Equal(t, "", cleanOperationName("Checkout\n"))
+	require.Equal(t, "Checkout_2", cleanOperationName("Checkout_2"))
+}
+
+func TestIncrementalDelivery(t *testing.T) {
+	query := `{"query":"{ findManyUser { id ... @defer(label: \"posts\") { posts { id } } } }"}`
+	t.Run("streamed", func(t *testing.T) {
+		second := make(chan struct{})
+		fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Header.Get("Accept") != "multipart/mixed" {
+				_, _ = w.Write([]byte(`{"data":{}}`))
+				return
+			}
+			w.Header().Set("Content-Type", `multipart/mixed; boundary="-"; deferSpec=20220824`)
+			_, _ = io.WriteString(w, "\r\n---\r\nContent-Type: application/json\r\n\r\n{\"data\":{\"findManyUser\":[{\"id\":1}]},\"hasNext\":true}\r\n---")
+			w.(http.Flusher).Flush()
+			<-second
+			_, _ = io.WriteString(w, "\r\nContent-Type: application/json\r\n\r\n{\"incremental\":[{\"data\":{\"posts\":[]},\"path\":[\"findManyUser\",0]}],\"hasNext\":false}\r\n-----\r\n")
+		}))
+		defer fakeDB.Close()
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			MetricsEndpoint:   "/metrics",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			Production:        true,
+		}, func() {}))
+		defer api.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, api.URL, strings.NewReader(query))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "multipart/mixed")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, `multipart/mixed; boundary="-"; deferSpec=20220824`, resp.Header.Get("Content-Type"))
+		// the first part arrives before the engine sent the second
+		buf := make([]byte, 4096)
+		n, err := resp.Body.Read(buf)
+		require.NoError(t, err)
+		require.Contains(t, string(buf[:n]), `"hasNext":true`)
+		close(second)
+		rest, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(rest), `"hasNext":false`)
+		require.NotContains(t, string(rest), "extensions")
+	})
+	t.Run("stripped", func(t *testing.T) {
+		var queries []string
+		var mu sync.Mutex
+		fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			query, _ := jsonparser.GetString(body, "query")
+			if r.Method == http.MethodPost {
+				mu.Lock()
+				queries = append(queries, query)
+				mu.Unlock()
+			}
+			if strings.Contains(query, "@defer") {
+				_, _ = w.Write([]byte(`{"errors":[{"error":"Unknown directive \"defer\"."}]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+		}))
+		defer fakeDB.Close()
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			Production:        true,
+		}, func() {}))
+		defer api.Close()
+		e := httpexpect.New(t, api.URL)
+
+		for i := 0; i < 2; i++ {
+			e.POST("/").WithHeader("Content-Type", "application/json").WithHeader("Accept", "multipart/mixed").
+				WithBytes([]byte(query)).Expect().Status(http.StatusOK).
+				JSON().Path("$.data.findManyUser").Array().Empty()
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// only the first request is tried with the directives
+		require.Len(t, queries, 3)
+		require.Contains(t, queries[0], "@defer")
+		require.Equal(t, `{ findManyUser { id ...  { posts { id } } } }`, queries[1])
+		require.Equal(t, queries[1], queries[2])
+	})
+}
+
+func TestStripDirectives(t *testing.T) {
+	for query, want := range map[string]string{
+		`{ a @include(if: true) { id } }`:                             `{ a @include(if: true) { id } }`,
+		`{ a @stream(initialCount: 1, label: "a)") { id } }`:          `{ a  { id } }`,
+		`{ a { ... on A @defer { id } } }`:                            `{ a { ... on A  { id } } }`,
+		`{ a(where: "@defer") { id } } # @stream`:                     `{ a(where: "@defer") { id } } # @stream`,
+		`{ a(where: """@defer""") { id @deferred } }`:                 `{ a(where: """@defer""") { id @deferred } }`,
+		"{ a { ...F @defer(label: \"f\") } }\nfragment F on A { id }": "{ a { ...F  } }\nfragment F on A { id }",
+	} {
+		got, found := stripDirectives(query, "defer", "stream")
+		require.Equal(t, want, got, query)
+		require.Equal(t, want != query, found, query)
+	}
+}
+
+func TestLimitWarnings(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	events := make(chan map[string]interface{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer collector.Close()
+	reporter := report.New(collector.URL, 10, buildinfo.Info{})
+	defer reporter.Close(time.Second)
+
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:         fakeDB.URL,
+		HealthEndpoint:         "/health",
+		MetricsEndpoint:        "/metrics",
+		ReadLimitSeconds:       10000,
+		WriteLimitSeconds:      2000,
+		Production:             true,
+		ReadQuota:              10,
+		LimitWarningThresholds: []float64{0.5, 0.9},
+		ReportLimitWarnings:    true,
+		Reporter:               reporter,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	for i := 0; i < 10; i++ {
+		e.POST("/").WithJSON(map[string]string{"query": "{ findManyUser { id } }"}).Expect().Status(http.StatusOK)
+	}
+
+	// every threshold warns once, not on every request above it
+	metrics := e.GET("/metrics").Expect().Status(http.StatusOK).Body()
+	metrics.Contains(`wunderbase_limit_warnings_total{limit="read_quota",threshold="50"} 1`)
+	metrics.Contains(`wunderbase_limit_warnings_total{limit="read_quota",threshold="90"} 1`)
+	for _, threshold := range []string{"50", "90"} {
+		select {
+		case event := <-events:
+			require.Equal(t, "warning", event["level"])
+			require.Equal(t, "limit_warning", event["tags"].(map[string]interface{})["event_type"])
+			extra := event["extra"].(map[string]interface{})
+			require.Equal(t, "read_quota", extra["limit"])
+			require.Equal(t, threshold, extra["threshold"])
+			require.Equal(t, "10", extra["max"])
+		case <-time.After(5 * time.Second):
+			t.Fatal("no limit warning reported")
+		}
+	}
+}
+
+func TestSLOs(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); bytes.Contains(body, []byte("slow")) {
+			time.Sleep(30 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	events := make(chan map[string]interface{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer collector.Close()
+	reporter := report.New(collector.URL, 10, buildinfo.Info{})
+	defer reporter.Close(time.Second)
+
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		AdminToken:        "secret",
+		SLOs:              []SLO{{Operation: "Checkout", Percentile: 0.9, Threshold: 20 * time.Millisecond, Window: time.Hour}},
+		SLOBurnRate:       2,
+		ReportSLOBurns:    true,
+		Reporter:          reporter,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	send := func(operation, query string) {
+		e.POST("/").WithJSON(map[string]string{"query": query, "operationName": operation}).Expect().Status(http.StatusOK)
+	}
+	for i := 0; i < 7; i++ {
+		send("Checkout", "query Checkout { findManyUser { id } }")
+	}
+	for i := 0; i < 3; i++ {
+		send("Checkout", "query Checkout { slow: findManyUser { id } }")
+		send("Other", "query Other { slow: findManyPost { id } }")
+	}
+
+	// 3 of 10 requests above the threshold spend the 10% budget 3 times
+	// faster than the window allows
+	select {
+	case event := <-events:
+		require.Equal(t, "warning", event["level"])
+		require.Equal(t, "slo_burn", event["tags"].(map[string]interface{})["event_type"])
+		extra := event["extra"].(map[string]interface{})
+		require.Equal(t, "Checkout", extra["operation"])
+		require.Equal(t, "p90<20ms/1h", extra["objective"])
+		require.Equal(t, "3.0", extra["burn_rate"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("no SLO burn reported")
+	}
+	metrics := e.GET("/metrics").Expect().Status(http.StatusOK).Body()
+	metrics.Contains(`wunderbase_slo_burn_alerts_total{operation="Checkout"} 1`)
+	metrics.Contains(`wunderbase_slo_compliance{operation="Checkout"} 0.7`)
+	metrics.NotContains(`operation="Other"`)
+	slo := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Path("$.slos[0]").Object()
+	slo.ValueEqual("operation", "Checkout").ValueEqual("requests", 10).ValueEqual("slow", 3).
+		ValueEqual("meeting", false).ValueEqual("alerting", true)
+	slo.Value("observedMs").Number().Ge(20)
+}
+
+func TestQuota(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	database := filepath.Join(t.TempDir(), "data.db")
+	newAPI := func() (*Handler, *httpexpect.Expect) {
+		handler := NewHandler(Config{
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			Production:        true,
+			AdminToken:        "secret",
+			DatabaseFilePath:  database,
+			ReadQuota:         3,
+			WriteQuota:        1,
+			PersistQuota:      true,
+		}, func() {})
+		api := httptest.NewServer(handler)
+		t.Cleanup(api.Close)
+		return handler, httpexpect.New(t, api.URL)
+	}
+	query := map[string]interface{}{"query": "{ findManyUser { id } }"}
+	mutation := map[string]interface{}{"query": "mutation { deleteOneUser(where: {id: 1}) { id } }"}
+
+	handler, e := newAPI()
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusTooManyRequests).
+		JSON().Path("$.errors[0].extensions.code").Equal("QUOTA_EXCEEDED")
+	limits := e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Path("$.limits").Object()
+	limits.Path("$.read").Object().ValueEqual("consumed", 2).ValueEqual("remaining", 1)
+	limits.Path("$.write").Object().ValueEqual("consumed", 1).ValueEqual("remaining", 0)
+	handler.Close()
+
+	// a restart in the same window continues the counts
+	_, e = newAPI()
+	e.POST("/").WithJSON(query).Expect().Status(http.StatusOK)
+	resp := e.POST("/").WithJSON(query).Expect().Status(http.StatusTooManyRequests)
+	resp.Header("Retry-After").NotEmpty()
+
+	// the counts reset when the window rolls over
+	q, err := newQuota(50*time.Millisecond, 1, 0, "")
+	require.NoError(t, err)
+	ok, _ := q.take("read")
+	require.True(t, ok)
+	ok, retryAfter := q.take("read")
+	require.False(t, ok)
+	time.Sleep(retryAfter)
+	ok, _ = q.take("read")
+	require.True(t, ok)
+
+	// windows are aligned to the Unix epoch whatever their length
+	now := time.Date(2026, 10, 16, 12, 34, 0, 0, time.UTC)
+	require.Equal(t, time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), windowStart(now, 24*time.Hour).UTC())
+	start := windowStart(now, 7*time.Hour)
+	require.Zero(t, start.Unix()%(7*3600))
+	require.True(t, !start.After(now) && now.Sub(start) < 7*time.Hour)
+}
+
+func TestConcurrentLimitsAndSleep(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	var sleeps int32
+	slept := make(chan struct{})
+	config := Config{
+		QueryEngineURL:         fakeDB.URL,
+		HealthEndpoint:         "/health",
+		ReadLimitSeconds:       10000,
+		WriteLimitSeconds:      2000,
+		Production:             true,
+		AdminToken:             "secret",
+		WriteQuota:             10,
+		LimitWarningThresholds: []float64{0.5},
+		EnableSleepMode:        true,
+		SleepAfterSeconds:      1,
+		KeepAliveMax:           time.Second,
+	}
+	handler := NewHandler(config, func() {
+		if atomic.AddInt32(&sleeps, 1) == 1 {
+			close(slept)
+		}
+	})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	post := func(path, body string) (int, error) {
+		req, err := http.NewRequest(http.MethodPost, api.URL+path, strings.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+	query := `{"query":"{ findManyUser { id } }"}`
+	mutation := `{"query":"mutation { deleteManyUser { count } }"}`
+
+	// reads and writes race for the last write slots while the limits are
+	// reloaded and keepalives move the sleep timer
+	var wg sync.WaitGroup
+	var reads, writes, rejected, failed int64
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				body := query
+				if (i+j)%2 == 0 {
+					body = mutation
+				}
+				status, err := post("/", body)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&failed, 1)
+				case status == http.StatusTooManyRequests:
+					atomic.AddInt64(&rejected, 1)
+				case status != http.StatusOK:
+					atomic.AddInt64(&failed, 1)
+				case body == mutation:
+					atomic.AddInt64(&writes, 1)
+				default:
+					atomic.AddInt64(&reads, 1)
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			handler.Reload(config)
+			_, _ = post("/admin/keepalive?for=1ms", "")
+			if resp, err := client.Get(api.URL + "/health"); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	require.Zero(t, atomic.LoadInt64(&failed))
+	require.EqualValues(t, 10, writes, "only the quota of writes passes")
+	require.EqualValues(t, 40, rejected)
+	require.EqualValues(t, 50, reads)
+
+	select {
+	case <-slept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't sleep")
+	}
+	// requests still in flight once asleep don't wait for the sleep timer
+	status, err := post("/", query)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	time.Sleep(100 * time.Millisecond)
+	require.EqualValues(t, 1, atomic.LoadInt32(&sleeps))
+}
+
+func TestRetriesTakeLimitsOnce(t *testing.T) {
+	var requests int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.Contains(body, []byte("findManyUser")) {
+			_, _ = w.Write([]byte(`{"data":{}}`))
+			return
+		}
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	handler := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		ReadLimitSeconds:  1,
+		WriteLimitSeconds: 1,
+	}, func() {})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+
+	// each retry taking from the limits would wait a second for it
+	started := time.Now()
+	httpexpect.New(t, api.URL).POST("/").WithJSON(map[string]interface{}{
+		"query": `{ findManyUser { id } }`,
+	}).Expect().Status(http.StatusOK)
+	require.EqualValues(t, 3, atomic.LoadInt32(&requests))
+	require.Less(t, time.Since(started), 900*time.Millisecond)
+}
+
+func TestOperationLimits(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	exportQuery := "query NightlyExport { findManyUser { id } }"
+	digest := sha256.Sum256([]byte(exportQuery))
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.QueryEngineURL = fakeDB.URL
+		config.HealthEndpoint = "/health"
+		config.MetricsEndpoint = "/metrics"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.Production = true
+		config.ReadQuota = 1
+		config.OperationLimits = map[string]OperationLimit{
+			"NightlyExport": {Exempt: true},
+			"sha256:" + hex.EncodeToString(digest[:]): {ReadLimitSeconds: 5000},
+		}
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+
+	e := newAPI(Config{})
+	// exempt operations don't use up the quota
+	for i := 0; i < 3; i++ {
+		e.POST("/").WithJSON(map[string]interface{}{"query": exportQuery}).Expect().Status(http.StatusOK)
+	}
+	// under another name the query is matched by its digest, whose
+	// override still counts against the quota
+	e.POST("/").WithJSON(map[string]interface{}{"query": exportQuery, "operationName": "Other"}).
+		Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusTooManyRequests)
+	metrics := e.GET("/metrics").Expect().Status(http.StatusOK).Body()
+	metrics.Contains(`wunderbase_operation_limit_overrides_total{operation="NightlyExport",override="exempt"} 3`)
+	metrics.Contains(`wunderbase_operation_limit_overrides_total{operation="sha256:` + hex.EncodeToString(digest[:]) + `",override="override"} 1`)
+
+	// with authentication the caller must be authenticated, which the
+	// trusted header enforces before any override applies
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	e = newAPI(Config{TrustedAuthHeader: "X-User", TrustedProxies: []*net.IPNet{loopback}})
+	e.POST("/").WithJSON(map[string]interface{}{"query": exportQuery}).Expect().Status(http.StatusUnauthorized)
+	for i := 0; i < 2; i++ {
+		e.POST("/").WithHeader("X-User", "export-bot").WithJSON(map[string]interface{}{"query": exportQuery}).
+			Expect().Status(http.StatusOK)
+	}
+}
+
+func TestDatabaseBusy(t *testing.T) {
+	busy, err := os.ReadFile(filepath.Join("testdata", "engine_database_busy.json"))
+	require.NoError(t, err)
+	var calls, busyCalls int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		if atomic.AddInt32(&calls, 1) <= atomic.LoadInt32(&busyCalls) {
+			_, _ = w.Write(busy)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"createOneUser":{"id":1}}}`))
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	mutation := map[string]interface{}{"query": `mutation { createOneUser(data: {email: "a@b.c"}) { id } }`}
+	send := func(busy int32, idempotencyKey string) *httpexpect.Response {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&busyCalls, busy)
+		req := e.POST("/").WithJSON(mutation)
+		if idempotencyKey != "" {
+			req = req.WithHeader("Idempotency-Key", idempotencyKey)
+		}
+		return req.Expect()
+	}
+
+	resp := send(1, "")
+	resp.Status(http.StatusServiceUnavailable).Header("Retry-After").Equal("1")
+	resp.JSON().Path("$.errors[0].extensions.code").Equal("DATABASE_BUSY")
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls), "writes without an idempotency key aren't retried")
+
+	send(1, "key-1").Status(http.StatusOK).JSON().Path("$.data.createOneUser.id").Equal(1)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	send(3, "key-2").Status(http.StatusServiceUnavailable)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls), "retried only once")
+
+	e.GET("/metrics").Expect().Body().Contains("wunderbase_database_busy_total 4")
+}
+
+func TestWriteQueueOrder(t *testing.T) {
+	q := newWriteQueue(1, time.Second)
+	_, err := q.acquire(context.Background())
+	require.NoError(t, err)
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := q.acquire(context.Background())
+			require.NoError(t, err)
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			q.release()
+		}(i)
+		// the next write arrives once this one waits
+		require.Eventually(t, func() bool { return q.depth() == i+1 }, time.Second, time.Millisecond)
+	}
+	q.release()
+	wg.Wait()
+	require.Equal(t, []int{0, 1, 2, 3, 4}, order)
+
+	_, err = q.acquire(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = q.acquire(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, q.depth(), "a write giving up leaves the queue")
+	q.release()
+	_, err = q.acquire(context.Background())
+	require.NoError(t, err, "the slot was freed")
+}
+
+// TestWriteQueueLoad sends a burst of concurrent mutations to an engine
+// that, like SQLite, fails a write while another one runs, with and without
+// the write queue, and compares their throughput and busy errors.
+func TestWriteQueueLoad(t *testing.T) {
+	busy, err := os.ReadFile(filepath.Join("testdata", "engine_database_busy.json"))
+	require.NoError(t, err)
+	const writes = 50
+	run := func(queue int) (ok, busyErrors int, took time.Duration) {
+		var writing int32
+		fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				return
+			}
+			if !atomic.CompareAndSwapInt32(&writing, 0, 1) {
+				_, _ = w.Write(busy)
+				return
+			}
+			time.Sleep(2 * time.Millisecond)
+			atomic.StoreInt32(&writing, 0)
+			_, _ = w.Write([]byte(`{"data":{"createOneUser":{"id":1}}}`))
+		}))
+		defer fakeDB.Close()
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 10000,
+			Production:        true,
+			WriteQueue:        queue,
+			WriteQueueTimeout: 10 * time.Second,
+		}, func() {}))
+		defer api.Close()
+		e := httpexpect.New(t, api.URL)
+
+		var (
+			mu       sync.Mutex
+			wg       sync.WaitGroup
+			start    = make(chan struct{})
+			statuses []int
+		)
+		for i := 0; i < writes; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				status := e.POST("/").WithJSON(map[string]interface{}{
+					"query": `mutation { createOneUser(data: {email: "a@b.c"}) { id } }`,
+				}).Expect().Raw().StatusCode
+				mu.Lock()
+				statuses = append(statuses, status)
+				mu.Unlock()
+			}()
+		}
+		began := time.Now()
+		close(start)
+		wg.Wait()
+		took = time.Since(began)
+		for _, status := range statuses {
+			switch status {
+			case http.StatusOK:
+				ok++
+			case http.StatusServiceUnavailable:
+				busyErrors++
+			}
+		}
+		return ok, busyErrors, took
+	}
+
+	ok, busyErrors, took := run(0)
+	t.Logf("unqueued: %d of %d writes applied, %d busy, %.0f writes/s", ok, writes, busyErrors, float64(ok)/took.Seconds())
+	require.Positive(t, busyErrors, "concurrent writes fight over the lock")
+
+	ok, busyErrors, took = run(1)
+	t.Logf("queued: %d of %d writes applied, %d busy, %.0f writes/s", ok, writes, busyErrors, float64(ok)/took.Seconds())
+	require.Equal(t, writes, ok)
+	require.Zero(t, busyErrors)
+}
+
+func TestEnginePools(t *testing.T) {
+	var exporting int32
+	release := make(chan struct{})
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); bytes.Contains(body, []byte("Export")) {
+			atomic.AddInt32(&exporting, 1)
+			<-release
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:      fakeDB.URL,
+		MetricsEndpoint:     "/metrics",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		Production:          true,
+		TrustedAuthHeader:   "X-Auth-Request-Email",
+		TrustedScopesHeader: "X-Auth-Request-Groups",
+		TrustedProxies:      []*net.IPNet{trusted},
+		EngineSlots:         3,
+		PrioritySlots:       1,
+		PriorityScopes:      []string{"interactive"},
+		EngineQueueTimeout:  100 * time.Millisecond,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	send := func(priority, scopes string) *httpexpect.Response {
+		return e.POST("/").WithJSON(map[string]string{"query": "query Dashboard { findManyUser { id } }"}).
+			WithHeader("X-Auth-Request-Email", "ops@example.com").WithHeader("X-Auth-Request-Groups", scopes).
+			WithHeader("X-Wunderbase-Priority", priority).Expect()
+	}
+
+	// two exports take both slots of the general pool
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodPost, api.URL, strings.NewReader(`{"query":"query Export { findManyUser { id } }"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Auth-Request-Email", "batch@example.com")
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&exporting) == 2 }, 5*time.Second, time.Millisecond)
+
+	send("", "interactive").Status(http.StatusServiceUnavailable).
+		JSON().Path("$.errors[0].extensions.code").Equal("ENGINE_BUSY")
+	// the priority is only given to callers with a priority scope
+	send("high", "batch").Status(http.StatusServiceUnavailable)
+	send("high", "batch, interactive").Status(http.StatusOK)
+
+	metrics := e.GET("/metrics").Expect().Status(http.StatusOK).Body()
+	metrics.Contains(`wunderbase_engine_pool_in_flight{pool="general"} 2`)
+	metrics.Contains(`wunderbase_engine_pool_in_flight{pool="priority"} 0`)
+	metrics.Contains(`wunderbase_engine_pool_requests_total{pool="priority"} 1`)
+	metrics.Contains(`wunderbase_engine_pool_timeouts_total{pool="general"} 2`)
+	metrics.Contains(`wunderbase_engine_pool_request_duration_seconds_count{pool="priority"} 1`)
+	metrics.Contains(`wunderbase_priority_refusals_total 1`)
+
+	close(release)
+	wg.Wait()
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_engine_pool_in_flight{pool="general"} 0`).
+		Contains(`wunderbase_engine_pool_requests_total{pool="general"} 2`)
+}
+
+func TestMutationJournal(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case bytes.Contains(body, []byte("Duplicate")):
+			_, _ = w.Write([]byte(`{"errors":[{"error":"Unique constraint failed","user_facing_error":{"error_code":"P2002","message":"Unique constraint failed"}}]}`))
+		case bytes.Contains(body, []byte("mutation")):
+			_, _ = w.Write([]byte(`{"data":{"createOneUser":{"id":7,"email":"a@example.com"}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	dir := t.TempDir()
+	mutations, err := journal.Open(journal.Options{Dir: dir, Fsync: journal.FsyncAlways, Buffer: 10, OnFull: journal.OnFullWait})
+	require.NoError(t, err)
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		Journal:           mutations,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.POST("/").WithJSON(map[string]interface{}{
+		"operationName": "SignUp",
+		"query":         "mutation SignUp($email: String!) { createOneUser(data: {email: $email}) { id email } }",
+		"variables":     map[string]string{"email": "a@example.com"},
+	}).Expect().Status(http.StatusOK)
+	// reads and failed mutations aren't journaled
+	e.POST("/").WithJSON(map[string]string{"query": "{ findManyUser { id } }"}).Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(map[string]string{"query": "mutation Duplicate { createOneUser(data: {email: \"a@example.com\"}) { id } }"}).Expect()
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_journal_entries_total 1")
+	mutations.Close()
+
+	records, err := journal.Read(dir, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "SignUp", records[0].OperationName)
+	require.JSONEq(t, `{"email":"a@example.com"}`, string(records[0].Variables))
+	require.Equal(t, map[string]json.RawMessage{"createOneUser": json.RawMessage("7")}, records[0].IDs)
+}
+
+func TestWriteQueue(t *testing.T) {
+	var writes int32
+	hold := make(chan struct{})
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.Contains(body, []byte("mutation")) {
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+			return
+		}
+		if atomic.AddInt32(&writes, 1) == 1 {
+			<-hold
+		}
+		_, _ = w.Write([]byte(`{"data":{"createOneUser":{"id":1}}}`))
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		WriteQueue:        1,
+		WriteQueueTimeout: 100 * time.Millisecond,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	mutation := map[string]interface{}{"query": `mutation { createOneUser(data: {email: "a@b.c"}) { id } }`}
+
+	first := make(chan int)
+	go func() {
+		first <- e.POST("/").WithJSON(mutation).Expect().Raw().StatusCode
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&writes) == 1 }, time.Second, time.Millisecond)
+
+	e.POST("/").WithJSON(map[string]interface{}{"query": `{ findManyUser { id } }`}).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.findManyUser").Array().Empty()
+	resp := e.POST("/").WithJSON(mutation).Expect()
+	resp.Status(http.StatusServiceUnavailable).Header("Retry-After").Equal("1")
+	resp.JSON().Path("$.errors[0].extensions.code").Equal("WRITE_QUEUE_TIMEOUT")
+	require.Equal(t, int32(1), atomic.LoadInt32(&writes), "the write waiting too long never reached the engine")
+
+	close(hold)
+	require.Equal(t, http.StatusOK, <-first)
+	e.POST("/").WithJSON(mutation).Expect().Status(http.StatusOK)
+	body := e.GET("/metrics").Expect().Body()
+	body.Contains("wunderbase_write_queue_timeouts_total 1")
+	body.Contains("wunderbase_write_queue_depth 0")
+	body.Contains("wunderbase_write_queue_wait_seconds_count 3")
+}
+
+func TestExclusions(t *testing.T) {
+	var fail int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:      fakeDB.URL,
+		HealthEndpoint:      "/health",
+		MetricsEndpoint:     "/metrics",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		Production:          true,
+		AdminToken:          "secret",
+		RecentRequests:      10,
+		LogExcludePaths:     []string{"/health", "/metrics", "/internal/*"},
+		MetricsExcludePaths: []string{"/health", "/metrics"},
+		ExcludeUserAgents:   []string{"kube-probe", "ELB-HealthChecker"},
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	query := map[string]interface{}{"query": `{ findManyUser { id } }`}
+	recent := func() *httpexpect.Array {
+		return e.GET("/admin/requests").WithHeader("Authorization", "Bearer secret").
+			Expect().Status(http.StatusOK).JSON().Path("$.requests").Array()
+	}
+
+	e.GET("/health").Expect().Status(http.StatusOK)
+	e.POST("/").WithHeader("User-Agent", "kube-probe/1.27").WithJSON(query).Expect().Status(http.StatusOK)
+	e.POST("/internal/probe").WithHeader("User-Agent", "probe/1.0").WithJSON(query).Expect().Status(http.StatusOK)
+	recent().Length().Equal(0)
+	e.POST("/").WithHeader("User-Agent", "curl/8.0").WithJSON(query).Expect().Status(http.StatusOK)
+	recent().Length().Equal(1)
+
+	atomic.StoreInt32(&fail, 1)
+	e.POST("/").WithHeader("User-Agent", "ELB-HealthChecker/2.0").WithJSON(query).Expect().Status(http.StatusInternalServerError)
+	recent().Length().Equal(2)
+
+	body := e.GET("/metrics").Expect().Body()
+	// the probe on /internal/ is only left out of the log
+	body.Contains(`wunderbase_requests_total{type="query",code="200"} 2`)
+	body.NotContains(`code="500"`)
+	body.Contains("wunderbase_excluded_requests_total 5")
+}
+
+func TestPublicURL(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(restSDL))
+		}
+	}))
+	defer fakeDB.Close()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, elsewhere, _ := net.ParseCIDR("10.0.0.0/8")
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.QueryEngineURL = fakeDB.URL
+		config.QueryEngineSdlURL = fakeDB.URL + "/sdl"
+		config.HealthEndpoint = "/health"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.AdminToken = "secret"
+		config.EnableREST = true
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+
+	e := newAPI(Config{TrustedProxies: []*net.IPNet{loopback}})
+	e.GET("/").WithHost("db.example.com").WithHeader("X-Forwarded-Proto", "https").
+		Expect().Status(http.StatusOK).Body().Contains("fetch('https://db.example.com/'")
+	e.GET("/rest/openapi.json").WithHost("db.example.com:8080").
+		Expect().Status(http.StatusOK).JSON().Path("$.servers[0].url").Equal("http://db.example.com:8080")
+	e.GET("/admin/stats").WithHost("db.example.com").WithHeader("X-Forwarded-Proto", "https").
+		WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusOK).
+		JSON().Path("$.endpoints").Object().
+		ValueEqual("graphql", "https://db.example.com/").
+		ValueEqual("openapi", "https://db.example.com/rest/openapi.json")
+
+	// the forwarded scheme of other clients isn't believed
+	e = newAPI(Config{TrustedProxies: []*net.IPNet{elsewhere}})
+	e.GET("/").WithHost("db.example.com").WithHeader("X-Forwarded-Proto", "https").
+		Expect().Body().Contains("fetch('http://db.example.com/'")
+
+	// configured URLs win
+	e = newAPI(Config{PublicURL: "https://api.example.com/db/", GraphiQLApiURL: "https://graphql.example.com/"})
+	e.GET("/").Expect().Body().Contains("fetch('https://graphql.example.com/'")
+	e.GET("/rest/openapi.json").Expect().JSON().Path("$.servers[0].url").Equal("https://api.example.com/db")
+}
+
+func TestTracePropagation(t *testing.T) {
+	var traceparent string
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			traceparent = r.Header.Get("traceparent")
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+
+	api := httptest.NewServer(NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+	}, func() {}))
+	defer api.Close()
+
+	e := httpexpect.New(t, api.URL)
+	e.POST("/").WithJSON(map[string]interface{}{"query": `query { findManyUser { id } }`}).
+		WithHeader("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").
+		WithHeader("X-Request-Id", "req-1").
+		Expect().Status(http.StatusOK).Header("X-Request-Id").Equal("req-1")
+	require.Regexp(t, `^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$`, traceparent)
+
+	e.GET("/health").Expect().Header("X-Request-Id").NotEmpty()
+}
+
+func TestFingerprint(t *testing.T) {
+	base := fingerprint(`query Users { findManyUser(where: {email: {contains: "a"}}, take: 10) { id email } }`)
+	for _, variant := range []string{
+		"query Users {\n  findManyUser(where: {email: {contains: \"b\"}}, take: 20) {\n    id\n    email\n  }\n}",
+		`query Users { findManyUser(where: {email: {contains: """c"""}} take: 5) { id, email } } # comment`,
+		`query Users { users: findManyUser(where: {email: {contains: "a"}}, take: 10) { key: id email } }`,
+	} {
+		require.Equal(t, base, fingerprint(variant), variant)
+	}
+	for _, other := range []string{
+		`query Users { findManyUser(where: {email: {contains: "a"}}, take: 10) { id } }`,
+		`query Users { findManyUser(where: {name: {contains: "a"}}, take: 10) { id email } }`,
+		`query Users { findManyUser(where: {email: {contains: "a"}}, skip: 10) { id email } }`,
+	} {
+		require.NotEqual(t, base, fingerprint(other), other)
+	}
+	require.Equal(t,
+		fingerprint(`query($ids: [Int!] = [1, 2, 3]) { findManyUser(where: {id: {in: $ids}}, active: true) { id } }`),
+		fingerprint(`query($ids: [Int!] = [4]) { findManyUser(where: {id: {in: $ids}}, active: false) { id } }`))
+}
+
+func TestQueryStats(t *testing.T) {
+	stats := newQueryStats()
+	stats.record("a", "A", "query", "req-1", 10*time.Millisecond, false)
+	stats.record("a", "A", "query", "req-2", 10*time.Millisecond, false)
+	stats.record("b", "B", "mutation", "req-3", 50*time.Millisecond, true)
+	stats.record("c", "C", "query", "req-4", 20*time.Millisecond, true)
+	stats.record("b", "B", "mutation", "req-5", 30*time.Millisecond, true)
+
+	require.Equal(t, "a", stats.top(1, false)[0].Fingerprint)
+	require.Equal(t, "b", stats.top(1, true)[0].Fingerprint)
+	require.InDelta(t, 80, stats.top(1, true)[0].TotalMs, 0.001)
+
+	slow := stats.slowQueries()
+	require.Len(t, slow, 2, "one entry per fingerprint")
+	require.Equal(t, "req-5", slow[0].RequestID)
+	require.Equal(t, int64(2), slow[0].Count)
+	require.Equal(t, "c", slow[1].Fingerprint)
+}
+
+func TestVerboseHealth(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fakeDB.Close()
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, os.WriteFile(dbFile, make([]byte, 2*1024*1024), 0644))
+
+	newAPI := func(required []string) *httpexpect.Expect {
+		api := httptest.NewServer(NewHandler(Config{
+			QueryEngineURL:    fakeDB.URL,
+			HealthEndpoint:    "/health",
+			ReadLimitSeconds:  10000,
+			WriteLimitSeconds: 2000,
+			DatabaseFilePath:  dbFile,
+			MaxDatabaseSizeMB: 1,
+			HealthChecks: map[string]HealthCheck{
+				"migration": func() ComponentHealth { return ComponentHealth{Status: HealthDegraded} },
+			},
+			RequiredHealthComponents: required,
+		}, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+
+	health := newAPI(nil).GET("/health").WithQuery("verbose", "1").
+		Expect().Status(http.StatusOK).JSON().Object()
+	health.Value("status").Equal(HealthFailing)
+	health.Path("$.components.database.status").Equal(HealthFailing)
+	health.Path("$.components.migration.status").Equal(HealthDegraded)
+	health.Path("$.components.query_engine.status").Equal(HealthOK)
+
+	newAPI([]string{"query_engine", "migration"}).GET("/health").WithQuery("verbose", "true").
+		Expect().Status(http.StatusServiceUnavailable)
+	newAPI([]string{"query_engine", "migration"}).GET("/health").
+		Expect().Status(http.StatusOK).JSON().Path("$.status").Equal(HealthFailing)
+}
+
+func TestPeerHealth(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fakeDB.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	// a and b list each other, b is a replica
+	var a, b http.Handler
+	var bChecks, verboseChecks int32
+	serverA := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { a.ServeHTTP(w, r) }))
+	defer serverA.Close()
+	serverB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&bChecks, 1)
+		if r.URL.Query().Get("verbose") != "" {
+			atomic.AddInt32(&verboseChecks, 1)
+		}
+		b.ServeHTTP(w, r)
+	}))
+	defer serverB.Close()
+	a = NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		PeerURLs:          []string{serverB.URL + "/health?verbose=1", dead.URL + "/health"},
+	}, func() {})
+	b = NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		PeerURLs:          []string{serverA.URL + "/health"},
+		ReplicaStaleness:  func() time.Duration { return 30 * time.Second },
+	}, func() {})
+
+	e := httpexpect.New(t, serverA.URL)
+	health := e.GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusOK).JSON().Object()
+	health.Value("status").Equal(HealthOK)
+	peer := health.Path("$.peers").Object().Value(serverB.URL + "/health").Object()
+	peer.Value("status").Equal(HealthOK)
+	peer.Value("replicaStalenessSeconds").Equal(30)
+	health.Path("$.peers").Object().Value(dead.URL + "/health").Object().Value("status").Equal(HealthFailing)
+
+	e.GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusOK)
+	require.Equal(t, int32(1), atomic.LoadInt32(&bChecks), "checks are cached")
+	require.Zero(t, atomic.LoadInt32(&verboseChecks), "peers are asked for their plain health")
+
+	httpexpect.New(t, serverB.URL).GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusOK).
+		JSON().Path("$.peers").Object().Value(serverA.URL + "/health").Object().Value("status").Equal(HealthOK)
+}
+
+const restSDL = `
+type Query {
+  findManyUser(where: UserWhereInput, take: Int, skip: Int): [User!]!
+  findUniqueUser(where: UserWhereUniqueInput!): User
+}
+type Mutation {
+  createOneUser(data: UserCreateInput!): User!
+  updateOneUser(data: UserUpdateInput!, where: UserWhereUniqueInput!): User
+  deleteOneUser(where: UserWhereUniqueInput!): User
+}
+type User { id: Int! email: String! name: String posts: [Post!]! }
+type Post { id: Int! }
+input UserWhereInput { id: IntFilter email: StringFilter }
+input UserWhereUniqueInput { id: Int email: String }
+input UserCreateInput { email: String! name: String }
+input UserUpdateInput { email: String name: String }
+input IntFilter { equals: Int }
+input StringFilter { equals: String }
+`
+
+func TestRESTBridge(t *testing.T) {
+	var last map[string]interface{}
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(restSDL))
+			return
+		}
+		if r.Method != http.MethodPost {
+			return
+		}
+		last = nil
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&last))
+		query := last["query"].(string)
+		switch {
+		case strings.Contains(query, "findManyUser"):
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[{"id":1,"email":"a@b.c","name":null}]}}`))
+		case strings.Contains(query, "findUniqueUser"):
+			_, _ = w.Write([]byte(`{"data":{"findUniqueUser":null}}`))
+		case strings.Contains(query, "createOneUser"):
+			_, _ = w.Write([]byte(`{"errors":[{"error":"Unique constraint failed","user_facing_error":{"message":"Unique constraint failed on the fields: (email)","error_code":"P2002"}}]}`))
+		case strings.Contains(query, "deleteOneUser"):
+			_, _ = w.Write([]byte(`{"errors":[{"error":"not found","user_facing_error":{"message":"Record to delete does not exist.","error_code":"P2025"}}]}`))
+		case strings.Contains(query, "updateOneUser"):
+			_, _ = w.Write([]byte(`{"data":{"updateOneUser":{"id":1,"email":"new@b.c","name":null}}}`))
+		}
+	}))
+	defer fakeDB.Close()
+
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		EnableREST:        true,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.GET("/rest/user").WithQuery("limit", 5).WithQuery("email", "a@b.c").
+		Expect().Status(http.StatusOK).JSON().Array().Element(0).Object().ValueEqual("id", 1)
+	require.Contains(t, last["query"], "query($where: UserWhereInput, $take: Int, $skip: Int) { findManyUser(where: $where, take: $take, skip: $skip) { id email name } }")
+	require.Equal(t, map[string]interface{}{
+		"where": map[string]interface{}{"email": map[string]interface{}{"equals": "a@b.c"}},
+		"take":  float64(5),
+		"skip":  float64(0),
+	}, last["variables"])
+
+	e.GET("/rest/user/1").Expect().Status(http.StatusNotFound)
+	e.GET("/rest/user/abc").Expect().Status(http.StatusBadRequest)
+	e.GET("/rest/user").WithQuery("posts", "1").Expect().Status(http.StatusBadRequest)
+	e.GET("/rest/post").Expect().Status(http.StatusNotFound)
+	e.POST("/rest/user").WithJSON(map[string]interface{}{"email": "a@b.c"}).
+		Expect().Status(http.StatusConflict).JSON().Path("$.error.code").Equal("P2002")
+	e.DELETE("/rest/user/1").Expect().Status(http.StatusNotFound).JSON().Path("$.error.code").Equal("P2025")
+	e.PATCH("/rest/user/1").WithJSON(map[string]interface{}{"email": "new@b.c"}).
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("email", "new@b.c")
+	require.Equal(t, map[string]interface{}{"id": float64(1)}, last["variables"].(map[string]interface{})["where"])
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestOpenAPI(t *testing.T) {
+	models, err := parseRESTModels([]byte(restSDL))
+	require.NoError(t, err)
+	doc, err := generateOpenAPI(models, nil)
+	require.NoError(t, err)
+	golden := filepath.Join("testdata", "openapi.json")
+	if *update {
+		require.NoError(t, os.MkdirAll("testdata", 0o755))
+		require.NoError(t, os.WriteFile(golden, doc, 0o644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.JSONEq(t, string(want), string(doc))
+
+	secured, err := generateOpenAPI(models, &trustedHeaderAuth{header: "X-User"})
+	require.NoError(t, err)
+	require.Contains(t, string(secured), `"name": "X-User"`)
+
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(restSDL))
+		}
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		EnableREST:        true,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	resp := e.GET("/rest/openapi.json").Expect().Status(http.StatusOK)
+	resp.JSON().Path("$.paths").Object().ContainsKey("/rest/user").ContainsKey("/rest/user/{id}").NotContainsKey("/rest/post")
+	etag := resp.Header("ETag").NotEmpty().Raw()
+	e.GET("/rest/openapi.json").WithHeader("If-None-Match", etag).Expect().Status(http.StatusNotModified)
+}
+
+func TestPruneHiddenSchema(t *testing.T) {
+	sdl, err := os.ReadFile(filepath.Join("testdata", "blog.graphql"))
+	require.NoError(t, err)
+
+	pruned, err := newVisibility([]string{"Job"}, []string{"User.password"}).prune(sdl)
+	require.NoError(t, err)
+	golden := filepath.Join("testdata", "blog_hidden.graphql")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, pruned, 0o644))
+	}
+	want, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(pruned))
+	require.NotContains(t, string(pruned), "Job")
+	require.NotContains(t, string(pruned), "password")
+	require.NotContains(t, string(pruned), "DateTime", "only Job used it")
+	require.Contains(t, string(pruned), "findManyUser(")
+	_, err = Introspect(pruned)
+	require.NoError(t, err)
+
+	// a hidden model takes what can't be used without it along
+	pruned, err = newVisibility([]string{"User"}, nil).prune(sdl)
+	require.NoError(t, err)
+	fields := schemaFields(pruned)
+	inputs := schemaInputs(pruned)
+	require.NotContains(t, fields["Post"], "author")
+	require.Contains(t, fields["Post"], "authorId")
+	require.NotContains(t, fields["Mutation"], "createOnePost", "the author is required to create a post")
+	require.Contains(t, fields["Mutation"], "updateOnePost")
+	require.NotContains(t, inputs["PostWhereInput"], "author")
+	require.NotContains(t, inputs, "PostCreateInput")
+	require.NotContains(t, string(pruned), "User")
+	_, err = Introspect(pruned)
+	require.NoError(t, err)
+
+	require.NoError(t, newVisibility([]string{"Job"}, []string{"User.posts"}).check(sdl))
+	require.EqualError(t, newVisibility([]string{"Jobs", "SortOrder"}, []string{"User.secret"}).check(sdl),
+		"wunderbase: hidden field User.secret, model Jobs, model SortOrder not in the schema")
+}
+
+func TestHiddenModelsAndFields(t *testing.T) {
+	sdl, err := os.ReadFile(filepath.Join("testdata", "blog.graphql"))
+	require.NoError(t, err)
+	var forwarded int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write(sdl)
+			return
+		}
+		if r.Method != http.MethodPost {
+			return
+		}
+		atomic.AddInt32(&forwarded, 1)
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		EnableREST:        true,
+		HiddenModels:      []string{"Job"},
+		HiddenFields:      []string{"User.password"},
+	}, func() {})
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	require.NoError(t, h.CheckHiddenSchema())
+
+	for _, tc := range []struct {
+		query     string
+		variables map[string]interface{}
+		touched   string
+	}{
+		{query: "{ findManyUser { id password } }", touched: "User.password"},
+		{query: "{ findManyJob { id } }", touched: "Query.findManyJob"},
+		{query: "mutation { deleteManyJob { count } }", touched: "Mutation.deleteManyJob"},
+		{query: `{ findManyUser(where: {password: {startsWith: "a"}}) { id } }`, touched: "UserWhereInput.password"},
+		{query: "{ findManyUser(distinct: [password]) { id } }", touched: "UserScalarFieldEnum.password"},
+		{query: "{ aggregateUser { _max { password } } }", touched: "UserMaxAggregateOutputType.password"},
+		{query: "{ findManyPost { author { ...user } } } fragment user on User { password }", touched: "User.password"},
+		{
+			query:     "query($where: UserWhereInput) { findManyUser(where: $where) { id } }",
+			variables: map[string]interface{}{"where": map[string]interface{}{"OR": []interface{}{map[string]interface{}{"password": map[string]interface{}{"equals": "x"}}}}},
+			touched:   "UserWhereInput.password",
+		},
+		{
+			query:     "query($by: [UserScalarFieldEnum!]) { findManyUser(distinct: $by) { id } }",
+			variables: map[string]interface{}{"by": []interface{}{"email", "password"}},
+			touched:   "UserScalarFieldEnum.password",
+		},
+	} {
+		e.POST("/").WithJSON(map[string]interface{}{"query": tc.query, "variables": tc.variables}).
+			Expect().Status(http.StatusForbidden).
+			JSON().Path("$.errors[0].message").Equal(tc.touched + " is not exposed by this API")
+	}
+	e.POST("/").WithJSON(map[string]interface{}{"query": `{ __type(name: "Job") { name } }`}).
+		Expect().Status(http.StatusForbidden).JSON().Path("$.errors[0].extensions.code").Equal("FORBIDDEN_FIELD")
+	require.Zero(t, atomic.LoadInt32(&forwarded))
+
+	e.POST("/").WithJSON(map[string]interface{}{
+		"query":     `query($where: UserWhereInput) { findManyUser(where: $where, orderBy: [{email: asc}]) { id email posts { title } } }`,
+		"variables": map[string]interface{}{"where": map[string]interface{}{"email": map[string]interface{}{"equals": "a@b.c"}}},
+	}).Expect().Status(http.StatusOK)
+	require.Equal(t, int32(1), atomic.LoadInt32(&forwarded))
+
+	introspection := e.POST("/").WithJSON(map[string]interface{}{"query": "query IntrospectionQuery { __schema { types { name } } }"}).
+		Expect().Status(http.StatusOK).Body().Raw()
+	require.NotContains(t, introspection, "Job")
+	require.NotContains(t, introspection, "password")
+	require.Contains(t, introspection, "UserWhereInput")
+
+	e.GET("/rest/openapi.json").Expect().Status(http.StatusOK).JSON().Path("$.paths").Object().
+		ContainsKey("/rest/user").NotContainsKey("/rest/job")
+}
+
+func TestModelGrants(t *testing.T) {
+	sdl, err := os.ReadFile(filepath.Join("testdata", "blog.graphql"))
+	require.NoError(t, err)
+	var forwarded int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write(sdl)
+			return
+		}
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&forwarded, 1)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	h := NewHandler(Config{
+		Production:          true,
+		QueryEngineURL:      fakeDB.URL,
+		QueryEngineSdlURL:   fakeDB.URL + "/sdl",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		EnableCount:         true,
+		TrustedAuthHeader:   "X-Auth-Request-Email",
+		TrustedScopesHeader: "X-Auth-Request-Groups",
+		TrustedProxies:      []*net.IPNet{trusted},
+		ModelGrants:         true,
+	}, func() {})
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	send := func(query string, variables map[string]interface{}, scopes string) *httpexpect.Response {
+		return e.POST("/").WithJSON(map[string]interface{}{"query": query, "variables": variables}).
+			WithHeader("X-Auth-Request-Email", "partner@example.com").WithHeader("X-Auth-Request-Groups", scopes).Expect()
+	}
+
+	const partner = "Post:read, Job:write"
+	for _, tc := range []struct {
+		query     string
+		variables map[string]interface{}
+		scopes    string
+		message   string
+	}{
+		{query: "{ findManyUser { id } }", message: "findManyUser needs the grant User:read"},
+		{query: "mutation { deleteManyPost { count } }", message: "deleteManyPost needs the grant Post:write"},
+		{query: "{ findManyPost { id author { email } } }", message: "the operation needs the grant User:read"},
+		{query: "{ findManyPost { ...post } } fragment post on Post { author { id } }", message: "the operation needs the grant User:read"},
+		{query: `{ findManyPost(where: {author: {is: {email: {equals: "a@b.c"}}}}) { id } }`, message: "the operation needs the grant User:read"},
+		{
+			query:     "query($where: PostWhereInput) { findManyPost(where: $where) { id } }",
+			variables: map[string]interface{}{"where": map[string]interface{}{"author": map[string]interface{}{"is": map[string]interface{}{"name": map[string]interface{}{"equals": "a"}}}}},
+			message:   "the operation needs the grant User:read",
+		},
+		{query: `mutation { executeRaw(query: "DELETE FROM Post", parameters: "[]") }`, message: "executeRaw isn't an operation of a model, the model grants don't cover it"},
+		{query: `{ __type(name: "User") { name } }`, message: "only the IntrospectionQuery is answered to callers with model grants"},
+		{
+			query:   `mutation { createOneUser(data: {email: "a@b.c", password: "x", posts: {create: [{title: "t"}]}}) { id } }`,
+			scopes:  "User:write Post:read",
+			message: "the operation needs the grant Post:write",
+		},
+		{query: "{ findManyUser { _count { posts } } }", scopes: "User:read", message: "the operation needs the grant Post:read"},
+	} {
+		scopes := tc.scopes
+		if scopes == "" {
+			scopes = partner
+		}
+		send(tc.query, tc.variables, scopes).Status(http.StatusForbidden).
+			JSON().Path("$.errors[0].message").Equal(tc.message)
+	}
+	require.Zero(t, atomic.LoadInt32(&forwarded))
+
+	send("{ findManyPost(where: {title: {contains: \"go\"}}) { id title } }", nil, partner).Status(http.StatusOK)
+	send("mutation { deleteManyJob { count } }", nil, partner).Status(http.StatusOK)
+	send(`mutation { createOneUser(data: {email: "a@b.c", password: "x", posts: {connect: [{id: 1}]}}) { id posts { id } } }`, nil, "User:write Post:write").Status(http.StatusOK)
+	// callers without model grants aren't restricted
+	send("{ findManyUser { id posts { id } } }", nil, "admin").Status(http.StatusOK)
+	require.Equal(t, int32(4), atomic.LoadInt32(&forwarded))
+
+	introspection := send("query IntrospectionQuery { __schema { types { name } } }", nil, partner).Status(http.StatusOK).Body().Raw()
+	require.Contains(t, introspection, "PostWhereInput")
+	require.Contains(t, introspection, "JobCreateInput")
+	require.NotContains(t, introspection, "UserWhereInput")
+	require.Contains(t, send("query IntrospectionQuery { __schema { types { name } } }", nil, "").Status(http.StatusOK).Body().Raw(), "UserWhereInput")
+
+	e.GET("/count/User").WithHeader("X-Auth-Request-Email", "partner@example.com").WithHeader("X-Auth-Request-Groups", partner).
+		Expect().Status(http.StatusForbidden).JSON().Path("$.error.message").Equal("aggregateUser needs the grant User:read")
+}
+
+func TestRouter(t *testing.T) {
+	var mu sync.Mutex
+	starts := map[string]int{}
+	running := map[string]bool{}
+	database := func(name string) Database {
+		engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			up := running[name]
+			mu.Unlock()
+			if !up {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if r.Method == http.MethodPost {
+				_, _ = w.Write([]byte(`{"data":{"database":"` + name + `"}}`))
+			}
+		}))
+		t.Cleanup(engine.Close)
+		return Database{
+			Name: name,
+			Config: Config{
+				Production:        true,
+				QueryEngineURL:    engine.URL,
+				QueryEngineSdlURL: engine.URL + "/sdl",
+				HealthEndpoint:    "/health",
+				ReadLimitSeconds:  10000,
+				WriteLimitSeconds: 2000,
+			},
+			Start: func(exited func(err error)) (func(), error) {
+				mu.Lock()
+				defer mu.Unlock()
+				starts[name]++
+				running[name] = true
+				return func() {
+					mu.Lock()
+					running[name] = false
+					mu.Unlock()
+				}, nil
+			},
+		}
+	}
+	registry := metrics.NewRegistry()
+	router := NewRouter(RouterConfig{
+		Databases:       []Database{database("acme"), database("globex")},
+		HealthEndpoint:  "/health",
+		MetricsEndpoint: "/metrics",
+		Metrics:         registry,
+		AdminToken:      "secret",
+		SleepAfter:      100 * time.Millisecond,
+	})
+	defer router.Close()
+	api := httptest.NewServer(router)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.GET("/t/acme/health").Expect().Status(http.StatusOK).JSON().Object().ValueEqual("state", DatabaseIdle)
+	mu.Lock()
+	require.Empty(t, starts, "health checks don't start engines")
+	mu.Unlock()
+
+	e.POST("/t/acme/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.database").Equal("acme")
+	e.POST("/t/nope/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusNotFound)
+	e.GET("/t/acme/health").Expect().Status(http.StatusOK).Body().Equal("OK")
+	mu.Lock()
+	require.Equal(t, map[string]int{"acme": 1}, starts)
+	mu.Unlock()
+
+	e.GET("/health").WithQuery("verbose", 1).Expect().Status(http.StatusOK).
+		JSON().Path("$.databases").Object().
+		ContainsKey("acme").ContainsKey("globex").
+		Path("$.globex.state").Equal(DatabaseIdle)
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_requests_total{database="acme",type="query",code="200"} 1`).
+		Contains(`wunderbase_databases_running 1`)
+
+	e.GET("/admin/databases").Expect().Status(http.StatusUnauthorized)
+	list := e.GET("/admin/databases").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Array()
+	list.Length().Equal(2)
+	list.Element(0).Object().ValueEqual("name", "acme").ValueEqual("state", DatabaseRunning).ValueEqual("starts", 1)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !running["acme"]
+	}, 2*time.Second, 10*time.Millisecond, "the idle engine is stopped")
+	e.POST("/t/acme/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusOK)
+	mu.Lock()
+	require.Equal(t, 2, starts["acme"], "the next request starts it again")
+	mu.Unlock()
+}
+
+func TestReadOnly(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+		}
+	}))
+	defer fakeDB.Close()
+
+	handler := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		ReadOnly:          true,
+	}, func() {})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(map[string]interface{}{"query": "mutation { deleteManyUser { count } }"}).
+		Expect().Status(http.StatusMethodNotAllowed).JSON().Path("$.errors[0].extensions.code").Equal("READ_ONLY")
+
+	handler.Pause()
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusServiceUnavailable).Header("Retry-After").Equal("1")
+	e.GET("/health").Expect().Status(http.StatusOK)
+	handler.Resume()
+	e.POST("/").WithJSON(map[string]interface{}{"query": "{ findManyUser { id } }"}).
+		Expect().Status(http.StatusOK)
+}
+
+func TestExecute(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("broken")) {
+			_, _ = w.Write([]byte(`{"errors":[{"message":"Unknown field broken"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{"deleteManySession":{"count":2}}}`))
+	}))
+	defer fakeDB.Close()
+
+	config := Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		AdminToken:        "secret",
+	}
+	scheduler, err := schedule.New([]schedule.Entry{{Name: "expire", Cron: "@daily", Query: "mutation { deleteManySession { count } }"}})
+	require.NoError(t, err)
+	config.Schedules = scheduler
+	handler := NewHandler(config, func() {})
+
+	mutation := []byte(`{"query":"mutation { deleteManySession { count } }"}`)
+	data, err := handler.Execute(context.Background(), mutation, ExecuteOptions{RateLimited: true})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"data":{"deleteManySession":{"count":2}}}`, string(data))
+	_, err = handler.Execute(context.Background(), []byte(`{"query":"{ broken }"}`), ExecuteOptions{})
+	require.EqualError(t, err, "query engine: Unknown field broken")
+	_, started := handler.sleep.state()
+	require.False(t, started, "runs don't touch the sleep timer unless asked to")
+
+	handler.Pause()
+	_, err = handler.Execute(context.Background(), mutation, ExecuteOptions{})
+	require.Error(t, err)
+	handler.Resume()
+
+	config.ReadOnly = true
+	_, err = NewHandler(config, func() {}).Execute(context.Background(), mutation, ExecuteOptions{})
+	require.Error(t, err)
+
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	httpexpect.New(t, api.URL).GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Path("$.schedules[0].name").Equal("expire")
+}
+
+func TestChanges(t *testing.T) {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	database := filepath.Join(t.TempDir(), "db.sqlite")
+	run := func(statement string) {
+		out, err := exec.Command(sqlite, database, statement).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	run(`CREATE TABLE "User" (id INTEGER PRIMARY KEY, email TEXT);`)
+	require.NoError(t, cdc.Install(context.Background(), sqlite, database, 0))
+	run(`INSERT INTO "User" (id) VALUES (1), (2), (3);`)
+
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		AdminToken:        "secret",
+		DatabaseFilePath:  database,
+		EnableCDC:         true,
+		SqlitePath:        sqlite,
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	page := e.GET("/changes").WithQuery("limit", 2).Expect().Status(http.StatusOK).JSON().Object()
+	page.Value("changes").Array().Length().Equal(2)
+	page.Path("$.changes[0].model").Equal("User")
+	page.Path("$.changes[0].op").Equal("create")
+	page.Value("hasMore").Equal(true)
+	cursor := page.Value("cursor").String().Equal("2").Raw()
+
+	page = e.GET("/changes").WithQuery("since", cursor).Expect().Status(http.StatusOK).JSON().Object()
+	page.Path("$.changes[0].key[0]").Equal(3)
+	page.Value("hasMore").Equal(false)
+	page = e.GET("/changes").WithQuery("since", "3").Expect().Status(http.StatusOK).JSON().Object()
+	page.Value("changes").Array().Empty()
+	page.Value("cursor").Equal("3")
+
+	e.GET("/changes").WithQuery("since", "abc").Expect().Status(http.StatusBadRequest)
+	e.GET("/admin/stats").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).JSON().Path("$.changes.head").Equal("3")
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("Locked")) {
+			_, _ = w.Write([]byte(`{"errors":[{"error":"database is locked"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	// down answers until the handlers started, then drops every connection
+	var isDown int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&isDown) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer down.Close()
+	newAPI := func(engineURL string, plain bool) *httpexpect.Expect {
+		handler := NewHandler(Config{
+			Production:           true,
+			QueryEngineURL:       engineURL,
+			HealthEndpoint:       "/health",
+			ReadLimitSeconds:     10000,
+			WriteLimitSeconds:    2000,
+			AdminToken:           "secret",
+			RecentRequests:       10,
+			ReadQuota:            2,
+			EngineConnectRetries: 1,
+			EngineConnectBackoff: time.Millisecond,
+			PlainTextErrors:      plain,
+		}, func() {})
+		api := httptest.NewServer(handler)
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	e, unreachable := newAPI(fakeDB.URL, false), newAPI(down.URL, false)
+	plain, plainUnreachable := newAPI(fakeDB.URL, true), newAPI(down.URL, true)
+	e.POST("/").WithJSON(map[string]string{"query": "{ findManyUser { id } }"}).Expect().Status(http.StatusOK)
+	unreachable.GET("/health").Expect().Status(http.StatusOK)
+	plainUnreachable.GET("/health").Expect().Status(http.StatusOK)
+	atomic.StoreInt32(&isDown, 1)
+
+	tests := []struct {
+		name   string
+		e      *httpexpect.Expect
+		req    func(e *httpexpect.Expect) *httpexpect.Response
+		status int
+		code   string
+		text   string
+	}{
+		{"unknown admin path", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.GET("/admin/nope").WithHeader("Authorization", "Bearer secret").Expect()
+		}, http.StatusNotFound, "NOT_FOUND", "404 page not found"},
+		{"unauthorized", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.GET("/admin/stats").Expect()
+		}, http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized"},
+		{"bad request", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.GET("/admin/requests").WithQuery("limit", "x").WithHeader("Authorization", "Bearer secret").Expect()
+		}, http.StatusBadRequest, "BAD_REQUEST", "limit must be a positive number"},
+		{"method not allowed", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.GET("/admin/sleep").WithHeader("Authorization", "Bearer secret").Expect()
+		}, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed"},
+		{"conflict", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.POST("/admin/sleep").WithHeader("Authorization", "Bearer secret").Expect()
+		}, http.StatusConflict, "SLEEP_MODE_DISABLED", "sleep mode is disabled"},
+		{"busy", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.POST("/").WithJSON(map[string]string{"query": "query Locked { findManyUser { id } }"}).Expect()
+		}, http.StatusServiceUnavailable, "DATABASE_BUSY", ""},
+		{"quota", e, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.POST("/").WithJSON(map[string]string{"query": "{ findManyUser { id } }"}).Expect()
+		}, http.StatusTooManyRequests, "QUOTA_EXCEEDED", ""},
+		{"engine unreachable", unreachable, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.POST("/").WithJSON(map[string]string{"query": "{ findManyUser { id } }"}).Expect()
+		}, http.StatusInternalServerError, "ENGINE_UNAVAILABLE", ""},
+		{"health", unreachable, func(e *httpexpect.Expect) *httpexpect.Response {
+			return e.GET("/health").Expect()
+		}, http.StatusInternalServerError, "ENGINE_UNAVAILABLE", "query engine not reachable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := test.req(test.e).Status(test.status).ContentType("application/json")
+			requestID := resp.Header(tracing.RequestIDHeader).NotEmpty().Raw()
+			extensions := resp.JSON().Path("$.errors[0].extensions").Object()
+			extensions.ValueEqual("code", test.code)
+			extensions.ValueEqual("requestId", requestID)
+
+			if test.text == "" {
+				return
+			}
+			p := plain
+			if test.e == unreachable {
+				p = plainUnreachable
+			}
+			body := test.req(p).Status(test.status).ContentType("text/plain").Body().Raw()
+			require.Equal(t, test.text, strings.TrimSpace(body))
+		})
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			time.Sleep(20 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	newAPI := func(enabled bool) *httpexpect.Expect {
+		api := httptest.NewServer(NewHandler(Config{
+			Production:         true,
+			QueryEngineURL:     fakeDB.URL,
+			HealthEndpoint:     "/health",
+			ReadLimitSeconds:   20,
+			WriteLimitSeconds:  20,
+			EnableServerTiming: enabled,
+		}, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	entries := func(header string) map[string]float64 {
+		durations := map[string]float64{}
+		for _, entry := range strings.Split(header, ", ") {
+			name, dur, _ := strings.Cut(entry, ";dur=")
+			durations[name], _ = strconv.ParseFloat(dur, 64)
+		}
+		return durations
+	}
+	query := map[string]string{"query": "{ findManyUser { id } }"}
+
+	e := newAPI(true)
+	first := entries(e.POST("/").WithJSON(query).Expect().Status(http.StatusOK).Header("Server-Timing").Raw())
+	require.GreaterOrEqual(t, first["engine"], 20.0)
+	require.Contains(t, first, "proxy")
+	require.NotContains(t, first, "queue", "the first request isn't held by the rate limit")
+	// the read limit of 20 per second holds the second request for ~50ms
+	second := entries(e.POST("/").WithJSON(query).Expect().Status(http.StatusOK).Header("Server-Timing").Raw())
+	require.Greater(t, second["queue"], 10.0)
+
+	// errors of the proxy carry the header too
+	e.GET("/admin/stats").Expect().Status(http.StatusNotFound).Header("Server-Timing").Contains("proxy;dur=")
+
+	newAPI(false).POST("/").WithJSON(query).Expect().Status(http.StatusOK).Header("Server-Timing").Empty()
+}
+
+func TestUploads(t *testing.T) {
+	sdl := strings.NewReplacer(
+		"type Query {", "type Query {\n  findUniqueAttachment(where: AttachmentWhereUniqueInput!): Attachment",
+		"type Mutation {", "type Mutation {\n  createOneAttachment(data: AttachmentCreateInput!): Attachment!",
+	).Replace(restSDL) + `
+type Attachment { id: Int! name: String! data: Bytes }
+input AttachmentWhereUniqueInput { id: Int }
+input AttachmentCreateInput { name: String! data: Bytes }
+scalar Bytes
+`
+	var forwarded atomic.Value
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write([]byte(sdl))
+			return
+		}
+		if r.Method != http.MethodPost {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		forwarded.Store(body)
+		switch {
+		case bytes.Contains(body, []byte(`"id":2`)):
+			_, _ = w.Write([]byte(`{"data":{"findUniqueAttachment":null}}`))
+		case bytes.Contains(body, []byte("findUniqueAttachment")):
+			_, _ = w.Write([]byte(`{"data":{"findUniqueAttachment":{"data":"aGVsbG8="}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"data":{"createOneAttachment":{"id":1}}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	api := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:      fakeDB.URL,
+		QueryEngineSdlURL:   fakeDB.URL + "/sdl",
+		HealthEndpoint:      "/health",
+		ReadLimitSeconds:    10000,
+		WriteLimitSeconds:   2000,
+		MaxUploadFileBytes:  8,
+		MaxUploadTotalBytes: 1024,
+		FileContentTypes:    map[string]string{"Attachment.data": "text/plain"},
+	}, func() {}))
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	const create = `mutation ($data: AttachmentCreateInput!) { createOneAttachment(data: $data) { id } }`
+	upload := func(operations, paths string, files map[string]string) *httpexpect.Response {
+		req := e.POST("/").WithMultipart().
+			WithFormField("operations", operations).
+			WithFormField("map", paths)
+		for name, content := range files {
+			req = req.WithFile(name, name+".txt", strings.NewReader(content))
+		}
+		return req.Expect()
+	}
+	operations := `{"query":"` + create + `","variables":{"data":{"name":"a","data":null}}}`
+
+	upload(operations, `{"0":["variables.data.data"]}`, map[string]string{"0": "hello"}).
+		Status(http.StatusOK).JSON().Path("$.data.createOneAttachment.id").Equal(1)
+	data, _ := jsonparser.GetString(forwarded.Load().([]byte), "variables", "data", "data")
+	require.Equal(t, "aGVsbG8=", data, "the file is forwarded base64 encoded")
+
+	upload(operations, `{"0":["variables.data.data"]}`, map[string]string{"0": "too large a file"}).
+		Status(http.StatusRequestEntityTooLarge).JSON().Path("$.errors[0].extensions.code").Equal("UPLOAD_TOO_LARGE")
+	upload(operations, `{"0":["variables.data.name"]}`, map[string]string{"0": "hello"}).
+		Status(http.StatusBadRequest).JSON().Path("$.errors[0].message").String().Contains("isn't a Bytes input")
+	upload(operations, `{"0":["variables.data.data"]}`, nil).
+		Status(http.StatusBadRequest).JSON().Path("$.errors[0].message").String().Contains("missing")
+	upload(`[`+operations+`]`, `{"0":["0.variables.data.data"]}`, map[string]string{"0": "hello"}).
+		Status(http.StatusBadRequest).JSON().Path("$.errors[0].message").String().Contains("batches")
+	for _, path := range []string{"variables.data.data.", "variables.data.data.0", "variables..data"} {
+		upload(operations, `{"0":["`+path+`"]}`, map[string]string{"0": "hello"}).
+			Status(http.StatusBadRequest).JSON().Path("$.errors[0].extensions.code").Equal("BAD_UPLOAD")
+	}
+
+	e.GET("/files/Attachment/1/data").Expect().Status(http.StatusOK).
+		ContentType("text/plain").Body().Equal("hello")
+	e.GET("/files/Attachment/2/data").Expect().Status(http.StatusNotFound)
+	e.GET("/files/Attachment/1/name").Expect().Status(http.StatusNotFound)
+	e.GET("/files/Nope/1/data").Expect().Status(http.StatusNotFound)
+}
+
+func TestTimeTravel(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fakeDB.Close()
+	snapshotEngine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[{"id":1}]}}`))
+	}))
+	defer snapshotEngine.Close()
+
+	snapshot := time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC)
+	var released int32
+	busy := false
+	handler := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		AdminToken:        "secret",
+		TimeTravel: func(ctx context.Context, at time.Time) (*TimeTravelEngine, error) {
+			switch {
+			case busy:
+				return nil, ErrTimeTravelBusy
+			case at.Before(snapshot):
+				return nil, ErrNoSnapshot
+			}
+			return &TimeTravelEngine{URL: snapshotEngine.URL, Snapshot: snapshot, Release: func() { atomic.AddInt32(&released, 1) }}, nil
+		},
+	}, func() {})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+	query := map[string]interface{}{"query": "{ findManyUser { id } }"}
+
+	e.POST("/timetravel").WithQuery("at", "2024-05-01T00:00:00Z").WithJSON(query).
+		Expect().Status(http.StatusUnauthorized)
+	admin := func() *httpexpect.Request {
+		return e.POST("/timetravel").WithHeader("Authorization", "Bearer secret")
+	}
+	resp := admin().WithQuery("at", "2024-05-01T00:00:00Z").WithJSON(query).Expect().Status(http.StatusOK)
+	resp.Header(SnapshotTimeHeader).Equal("2024-04-30T22:00:00Z")
+	resp.JSON().Path("$.data.findManyUser[0].id").Equal(1)
+	require.Equal(t, int32(1), atomic.LoadInt32(&released))
+
+	admin().WithQuery("at", "yesterday").WithJSON(query).Expect().Status(http.StatusBadRequest)
+	admin().WithQuery("at", "2024-05-01T00:00:00Z").WithJSON(map[string]interface{}{"query": "mutation { deleteManyUser { count } }"}).
+		Expect().Status(http.StatusMethodNotAllowed).JSON().Path("$.errors[0].extensions.code").Equal("READ_ONLY")
+	admin().WithQuery("at", "2024-04-01T00:00:00Z").WithJSON(query).
+		Expect().Status(http.StatusNotFound).JSON().Path("$.errors[0].extensions.code").Equal("NO_SNAPSHOT")
+	busy = true
+	admin().WithQuery("at", "2024-05-01T00:00:00Z").WithJSON(query).
+		Expect().Status(http.StatusServiceUnavailable).Header("Retry-After").Equal("5")
+}
+
+func TestHedgedReads(t *testing.T) {
+	var reads, writes, canceled int32
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case bytes.Contains(body, []byte("mutation")):
+			atomic.AddInt32(&writes, 1)
+			time.Sleep(50 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"data":{"deleteManyUser":{"count":1}}}`))
+		case bytes.Contains(body, []byte("findManyUser")):
+			// the first read hangs until it is canceled, the hedge answers
+			if atomic.AddInt32(&reads, 1) == 1 {
+				<-r.Context().Done()
+				atomic.AddInt32(&canceled, 1)
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		Production:        true,
+		QueryEngineURL:    fakeDB.URL,
+		MetricsEndpoint:   "/metrics",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		HedgeReads:        true,
+		HedgeAfter:        20 * time.Millisecond,
+	}, func() {})
+	defer h.Close()
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	e.POST("/").WithJSON(map[string]interface{}{"query": `{ findManyUser { id } }`}).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.findManyUser").Array().Empty()
+	require.EqualValues(t, 2, atomic.LoadInt32(&reads))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&canceled) == 1 }, time.Second, time.Millisecond, "the slow read is canceled")
+
+	e.POST("/").WithJSON(map[string]interface{}{"query": `mutation { deleteManyUser { count } }`}).Expect().Status(http.StatusOK)
+	require.EqualValues(t, 1, atomic.LoadInt32(&writes), "mutations are never hedged")
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_hedged_reads_total{winner="hedge"} 1`).
+		NotContains(`winner="primary"`)
+}
+
+func TestReadCoalescing(t *testing.T) {
+	var reads, writes int32
+	release := make(chan struct{})
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case r.Method != http.MethodPost:
+			return
+		case bytes.Contains(body, []byte("mutation")):
+			atomic.AddInt32(&writes, 1)
+			_, _ = w.Write([]byte(`{"data":{"deleteManyUser":{"count":1}}}`))
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		<-release
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[{"id":1}]}}`))
+	}))
+	defer fakeDB.Close()
+	h := NewHandler(Config{
+		Production:         true,
+		QueryEngineURL:     fakeDB.URL,
+		MetricsEndpoint:    "/metrics",
+		ReadLimitSeconds:   10000,
+		WriteLimitSeconds:  2000,
+		CoalesceReads:      true,
+		CoalesceMaxWaiters: 3,
+	}, func() {})
+	defer h.Close()
+	api := httptest.NewServer(h)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+
+	// one read runs, three wait for it and two more run on their own
+	queries := []string{`{ findManyUser(where: {id: 1}) { id } }`, "{\n  findManyUser(where: {id: 1}) { id } # the users\n}"}
+	var wg sync.WaitGroup
+	answers := make([]string, 6)
+	for i := range answers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			answers[i] = e.POST("/").WithJSON(map[string]interface{}{"query": queries[i%2]}).
+				Expect().Status(http.StatusOK).Body().Raw()
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		h.coalesce.mu.Lock()
+		defer h.coalesce.mu.Unlock()
+		clients := 0
+		for _, f := range h.coalesce.flights {
+			clients += f.clients
+		}
+		return clients == 4 && atomic.LoadInt32(&reads) == 3
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.EqualValues(t, 3, atomic.LoadInt32(&reads))
+	for _, answer := range answers {
+		require.JSONEq(t, `{"data":{"findManyUser":[{"id":1}]}}`, answer)
+	}
+
+	e.POST("/").WithJSON(map[string]interface{}{"query": `mutation { deleteManyUser { count } }`}).Expect().Status(http.StatusOK)
+	e.POST("/").WithJSON(map[string]interface{}{"query": `mutation { deleteManyUser { count } }`}).Expect().Status(http.StatusOK)
+	require.EqualValues(t, 2, atomic.LoadInt32(&writes), "mutations are never coalesced")
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().
+		Contains(`wunderbase_read_coalescing_total{result="executed"} 1`).
+		Contains(`wunderbase_read_coalescing_total{result="shared"} 3`).
+		Contains(`wunderbase_read_coalescing_total{result="overflow"} 2`)
+
+	// literals and variables tell reads apart, layout doesn't
+	key := func(body string) string { return coalesceKey(http.MethodPost, []byte(body)) }
+	require.Equal(t, key(`{"query":"{ a(id: 1) { id } }","variables":{"a":1,"b":2}}`), key(`{"query":"{a(id:1){id}}","variables":{"b":2, "a":1}}`))
+	require.NotEqual(t, key(`{"query":"{ a(id: 1) { id } }"}`), key(`{"query":"{ a(id: 2) { id } }"}`))
+	require.NotEqual(t, key(`{"query":"{ a { id } }","variables":{"a":1}}`), key(`{"query":"{ a { id } }","variables":{"a":2}}`))
+
+	// a read doesn't join one started before a write
+	c := newCoalescer(true, 10)
+	started, finish := make(chan struct{}), make(chan struct{})
+	go c.do(context.Background(), "users", func(context.Context) engineResponse {
+		close(started)
+		<-finish
+		return engineResponse{data: []byte("before")}
+	})
+	<-started
+	c.beginWrite()
+	_, result := c.do(context.Background(), "users", func(context.Context) engineResponse { return engineResponse{data: []byte("during")} })
+	require.Equal(t, coalesceExecuted, result, "reads aren't coalesced during a write")
+	c.endWrite()
+	answer, result := c.do(context.Background(), "users", func(context.Context) engineResponse { return engineResponse{data: []byte("after")} })
+	require.Equal(t, coalesceExecuted, result)
+	require.Equal(t, "after", string(answer.data))
+	close(finish)
+
+	// the requests waiting for a read get its answer when the one which
+	// started it goes away, which no longer counts against the waiters
+	c = newCoalescer(true, 1)
+	sent, reply := make(chan context.Context, 1), make(chan struct{})
+	send := func(ctx context.Context) engineResponse {
+		sent <- ctx
+		select {
+		case <-reply:
+			return engineResponse{data: []byte("users")}
+		case <-ctx.Done():
+			return engineResponse{err: ctx.Err()}
+		}
+	}
+	clients := func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if f, ok := c.flights["users"]; ok {
+			return f.clients
+		}
+		return 0
+	}
+	type outcome struct {
+		answer engineResponse
+		result string
+	}
+	do := func(ctx context.Context) chan outcome {
+		done := make(chan outcome, 1)
+		go func() {
+			answer, result := c.do(ctx, "users", send)
+			done <- outcome{answer, result}
+		}()
+		return done
+	}
+	leader, cancelLeader := context.WithCancel(context.Background())
+	left := do(leader)
+	shared := <-sent
+	waiter := do(context.Background())
+	require.Eventually(t, func() bool { return clients() == 2 }, 5*time.Second, time.Millisecond)
+	cancelLeader()
+	require.ErrorIs(t, (<-left).answer.err, context.Canceled)
+	require.Equal(t, 1, clients())
+	require.NoError(t, shared.Err(), "the waiter still waits for the read")
+	late := do(context.Background())
+	require.Eventually(t, func() bool { return clients() == 2 }, 5*time.Second, time.Millisecond)
+	_, result = c.do(context.Background(), "users", func(context.Context) engineResponse { return engineResponse{} })
+	require.Equal(t, coalesceOverflow, result)
+	close(reply)
+	for _, done := range []chan outcome{waiter, late} {
+		got := <-done
+		require.Equal(t, coalesceShared, got.result)
+		require.NoError(t, got.answer.err)
+		require.Equal(t, "users", string(got.answer.data))
+	}
+
+	// a read nobody waits for any longer is canceled
+	c, reply = newCoalescer(true, 1), make(chan struct{})
+	leader, cancelLeader = context.WithCancel(context.Background())
+	left = do(leader)
+	shared = <-sent
+	cancelLeader()
+	require.ErrorIs(t, (<-left).answer.err, context.Canceled)
+	<-shared.Done()
+	require.Equal(t, 0, clients())
+}
+
+func TestHedgeDelay(t *testing.T) {
+	hedge := newHedger(true, 0, 90)
+	for i := 0; i < hedgeSamples-1; i++ {
+		hedge.observe(time.Duration(i%10+1) * time.Millisecond)
+	}
+	_, ok := hedge.delay()
+	require.False(t, ok, "too few reads to derive the delay")
+	hedge.observe(10 * time.Millisecond)
+	delay, ok := hedge.delay()
+	require.True(t, ok)
+	require.Equal(t, 9*time.Millisecond, delay)
+
+	delay, ok = newHedger(true, time.Second, 90).delay()
+	require.True(t, ok)
+	require.Equal(t, time.Second, delay)
+	require.Nil(t, newHedger(false, time.Second, 90))
+}
+
+func TestLint(t *testing.T) {
+	sdl, err := os.ReadFile(filepath.Join("testdata", "blog.graphql"))
+	require.NoError(t, err)
+
+	operations, err := ParseLintOperations([]byte(`{"operations":[
+		{"id":"a1","name":"Users","body":"query Users($take: Int) { findManyUser(take: 10) { id posts(take: $take) { id title } } }"},
+		{"id":"a2","body":"{ findManyUser {"},
+		{"id":"a3","body":"{ findManyUser { nope } }"},
+		{"id":"a4","body":"{ findManyUser { password } }"},
+		{"id":"a5","body":"mutation { deleteManyPost { count } }"},
+		{"id":"a6","body":"mutation Clear($where: PostWhereInput) { deleteManyPost(where: $where) { count } }"}
+	]}`))
+	require.NoError(t, err)
+	operations[0].Variables = json.RawMessage(`{"take":5}`)
+	report, err := Lint(sdl, operations, LintRules{SafeMutations: true, HiddenFields: []string{"User.password"}, MaxDepth: 2})
+	require.NoError(t, err)
+	require.False(t, report.OK)
+	require.Len(t, report.Results, 6)
+
+	users := report.Results[0]
+	require.True(t, users.Valid, "%v", users.Errors)
+	require.Equal(t, "Users", users.OperationName)
+	require.Equal(t, 3, users.Depth)
+	// findManyUser, 10 ids and post lists, 50 post ids and titles
+	require.Equal(t, 121, users.Cost)
+	require.Equal(t, []string{"depth 3 exceeds 2"}, users.OverLimits)
+	require.False(t, users.OK)
+
+	require.Equal(t, "syntax", report.Results[1].Errors[0].Stage)
+	require.False(t, report.Results[2].Valid)
+	require.Equal(t, "schema", report.Results[2].Errors[0].Stage)
+	require.Equal(t, "FORBIDDEN_FIELD", report.Results[3].Blocked[0].Code)
+	require.Equal(t, "DANGEROUS_MUTATION_BLOCKED", report.Results[4].Blocked[0].Code)
+	require.True(t, report.Results[5].OK, "%+v", report.Results[5])
+
+	// without a take a list counts the default take
+	operations, err = ParseLintOperations([]byte(`["{ findManyUser { id } }", {"query":"{ __schema { types { name } } }"}]`))
+	require.NoError(t, err)
+	report, err = Lint(sdl, operations, LintRules{DefaultTake: 20, DisableIntrospection: true})
+	require.NoError(t, err)
+	require.Equal(t, 21, report.Results[0].Cost)
+	require.True(t, report.Results[0].OK)
+	require.Equal(t, "INTROSPECTION_DISABLED", report.Results[1].Blocked[0].Code)
+
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write(sdl)
+		}
+	}))
+	defer fakeDB.Close()
+	server := httptest.NewServer(NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		QueryEngineSdlURL: fakeDB.URL + "/sdl",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		Production:        true,
+		AdminToken:        "secret",
+		DisableRawQueries: true,
+	}, func() {}))
+	defer server.Close()
+	e := httpexpect.New(t, server.URL)
+	lint := func() *httpexpect.Request {
+		return e.POST("/admin/lint").WithHeader("Authorization", "Bearer secret")
+	}
+	e.POST("/admin/lint").WithJSON([]string{"{ findManyUser { id } }"}).Expect().Status(http.StatusUnauthorized)
+	resp := lint().WithQuery("maxCost", 50).
+		WithJSON([]string{"{ findManyUser { id } }", `mutation { queryRaw(query: "SELECT 1") }`}).
+		Expect().Status(http.StatusOK).JSON()
+	resp.Path("$.ok").Equal(false)
+	resp.Path("$.results[0].overLimits[0]").Equal("cost 101 exceeds 50")
+	resp.Path("$.results[1].blocked[0].code").Equal("RAW_QUERIES_DISABLED")
+	lint().WithQuery("maxDepth", "deep").WithJSON([]string{"{ findManyUser { id } }"}).Expect().Status(http.StatusBadRequest)
+	lint().WithJSON(map[string]interface{}{"query": 1}).Expect().Status(http.StatusBadRequest)
+}
+
+func TestSupportBundle(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"errors":[{"error":"Unique constraint failed","user_facing_error":{"is_panic":false,"message":"Unique constraint failed","error_code":"P2002"}}]}`))
+	}))
+	defer fakeDB.Close()
+	var hashed bool
+	handler := NewHandler(Config{
+		QueryEngineURL:    fakeDB.URL,
+		HealthEndpoint:    "/health",
+		ReadLimitSeconds:  10000,
+		WriteLimitSeconds: 2000,
+		AdminToken:        "secret",
+		RecentRequests:    10,
+		CaptureBodies:     true,
+		SupportBundle: func(ctx context.Context, hashNames bool) *support.Bundle {
+			hashed = hashNames
+			b := &support.Bundle{Secrets: []string{"hunter2"}}
+			b.Add("config.yaml", []byte("admin-token: secret\ndatabase-key: hunter2\n"))
+			return b
+		},
+	}, func() {})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	e.POST("/").WithHeader("Content-Type", "application/json").
+		WithBytes([]byte(`{"query":"mutation B { createUser(data: {email: \"jane@example.com\"}) { id } }","operationName":"B"}`)).Expect()
+
+	e.GET("/admin/support-bundle").Expect().Status(http.StatusUnauthorized)
+	e.POST("/admin/support-bundle").WithHeader("Authorization", "Bearer secret").Expect().Status(http.StatusMethodNotAllowed)
+	resp := e.GET("/admin/support-bundle").WithQuery("hashNames", "true").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusOK).ContentType("application/gzip")
+	require.True(t, hashed)
+
+	gz, err := gzip.NewReader(strings.NewReader(resp.Body().Raw()))
+	require.NoError(t, err)
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[header.Name] = string(data)
+	}
+	for _, name := range []string{"config.yaml", "instance/slow-queries.json", "instance/errors.json", "instance/failed-requests.json", "instance/health.json"} {
+		require.Contains(t, files, "wunderbase-support/"+name)
+	}
+	for name, data := range files {
+		require.NotContains(t, data, "secret", name)
+		require.NotContains(t, data, "hunter2", name)
+		require.NotContains(t, data, "jane@example.com", name)
+	}
+	require.Contains(t, files["wunderbase-support/instance/failed-requests.json"], `"operationName": "B"`)
+}
+
+func TestStaticFiles(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{"findManyUser":[]}}`))
+	}))
+	defer fakeDB.Close()
+	dir := t.TempDir()
+	app := strings.Repeat("console.log('wunderbase');\n", 100)
+	for name, content := range map[string]string{
+		"index.html":        "<html>app</html>",
+		"assets/app.js":     app,
+		"docs/index.html":   "<html>docs</html>",
+		".env":              "SECRET=1",
+		".well-known/x.txt": "x",
+	} {
+		path := filepath.Join(dir, "public", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("outside"), 0644))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(dir, "public", "leak.txt")))
+
+	newAPI := func(config Config) (*Handler, string, *httpexpect.Expect) {
+		config.QueryEngineURL = fakeDB.URL
+		config.HealthEndpoint = "/health"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.AdminToken = "secret"
+		config.EnableSleepMode = true
+		config.SleepAfterSeconds = 3600
+		config.StaticDir = filepath.Join(dir, "public")
+		handler := NewHandler(config, func() {})
+		api := httptest.NewServer(handler)
+		t.Cleanup(api.Close)
+		return handler, api.URL, httpexpect.New(t, api.URL)
+	}
+
+	handler, url, e := newAPI(Config{StaticPathPrefix: "/"})
+	e.GET("/").Expect().Status(http.StatusOK).ContentType("text/html").Body().Equal("<html>app</html>")
+	e.GET("/orders/42").Expect().Status(http.StatusOK).Header("Cache-Control").Equal("no-cache")
+	e.GET("/docs/").Expect().Status(http.StatusOK).Body().Equal("<html>docs</html>")
+	e.GET("/missing.js").Expect().Status(http.StatusNotFound)
+	for _, path := range []string{"/.env", "/.well-known/x.txt", "/leak.txt", "/%2e%2e/secret.txt", "/assets/..%2f..%2fsecret.txt", "/..%5csecret.txt"} {
+		resp, err := http.Get(url + path)
+		require.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+		require.NotContains(t, string(body), "outside")
+		require.NotContains(t, string(body), "SECRET")
+	}
+
+	resp := e.GET("/assets/app.js").WithHeader("Accept-Encoding", "identity").Expect().Status(http.StatusOK)
+	resp.ContentType("text/javascript").Body().Equal(app)
+	etag := resp.Header("ETag").NotEmpty().Raw()
+	resp.Header("Last-Modified").NotEmpty()
+	e.GET("/assets/app.js").WithHeader("Accept-Encoding", "identity").WithHeader("If-None-Match", etag).
+		Expect().Status(http.StatusNotModified)
+	gzipped := e.GET("/assets/app.js").WithHeader("Accept-Encoding", "gzip").Expect().Status(http.StatusOK)
+	gzipped.Header("Content-Encoding").Equal("gzip")
+	gzipped.Header("ETag").NotEqual(etag)
+	gz, err := gzip.NewReader(strings.NewReader(gzipped.Body().Raw()))
+	require.NoError(t, err)
+	unzipped, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, app, string(unzipped))
+
+	reset, _ := handler.sleep.state()
+	require.Nil(t, reset, "static files don't reset the sleep timer")
+
+	// the API keeps its routes
+	e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{ findManyUser { id } }"}`)).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.findManyUser").Array().Empty()
+	e.GET("/health").Expect().Status(http.StatusOK).Body().NotContains("<html>")
+	e.GET("/admin/requests").Expect().Status(http.StatusUnauthorized)
+
+	// the default prefix keeps the playground
+	_, _, e = newAPI(Config{})
+	e.GET("/").Expect().Status(http.StatusOK).Body().Contains("graphiql")
+	e.GET("/static/").Expect().Status(http.StatusOK).Body().Equal("<html>app</html>")
+	e.GET("/static/assets/app.js").Expect().Status(http.StatusOK).ContentType("text/javascript")
+
+	handler, _, e = newAPI(Config{StaticPathPrefix: "/app", StaticDotfiles: true, StaticKeepsAwake: true})
+	e.GET("/app").Expect().Status(http.StatusOK).Body().Equal("<html>app</html>")
+	e.GET("/app/.well-known/x.txt").Expect().Status(http.StatusOK).Body().Equal("x")
+	e.GET("/app/leak.txt").Expect().Status(http.StatusNotFound)
+	reset, _ = handler.sleep.state()
+	require.Equal(t, "static", reset.Type)
+	e.GET("/").Expect().Status(http.StatusOK).Body().Contains("graphiql")
+}
+
+func TestCount(t *testing.T) {
+	sdl, err := os.ReadFile(filepath.Join("testdata", "blog.graphql"))
+	require.NoError(t, err)
+	var calls int32
+	var last map[string]interface{}
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdl" {
+			_, _ = w.Write(sdl)
+			return
+		}
+		var body map[string]interface{}
+		if json.NewDecoder(r.Body).Decode(&body) != nil {
+			_, _ = w.Write([]byte(`{"data":{}}`))
+			return
+		}
+		last = body
+		query, _ := last["query"].(string)
+		switch {
+		case strings.Contains(query, "aggregateUser"), strings.Contains(query, "aggregateJob"):
+			n := atomic.AddInt32(&calls, 1)
+			field := strings.Fields(strings.SplitN(query, "{ ", 2)[1])[0]
+			field = field[:strings.Index(field, "(")]
+			_, _ = fmt.Fprintf(w, `{"data":{"%s":{"_count":{"_all":%d}}}}`, field, n)
+		case strings.Contains(query, "findFirstUser"):
+			atomic.AddInt32(&calls, 1)
+			if strings.Contains(fmt.Sprint(last["variables"]), "nobody") {
+				_, _ = w.Write([]byte(`{"data":{"findFirstUser":null}}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"data":{"findFirstUser":{"id":1}}}`))
+		default:
+			_, _ = w.Write([]byte(`{"data":{"createOnePost":{"id":1}}}`))
+		}
+	}))
+	defer fakeDB.Close()
+	newAPI := func(config Config) *httpexpect.Expect {
+		config.QueryEngineURL = fakeDB.URL
+		config.QueryEngineSdlURL = fakeDB.URL + "/sdl"
+		config.HealthEndpoint = "/health"
+		config.ReadLimitSeconds = 10000
+		config.WriteLimitSeconds = 2000
+		config.EnableCount = true
+		config.CountCacheTTL = time.Minute
+		api := httptest.NewServer(NewHandler(config, func() {}))
+		t.Cleanup(api.Close)
+		return httpexpect.New(t, api.URL)
+	}
+	count := func(e *httpexpect.Expect, path, where, cache string) *httpexpect.Object {
+		req := e.GET(path)
+		if where != "" {
+			req = req.WithQuery("where", where)
+		}
+		resp := req.Expect().Status(http.StatusOK)
+		resp.Header("X-Wunderbase-Cache").Equal(cache)
+		resp.Header("Cache-Control").Equal("private, max-age=60")
+		return resp.JSON().Object()
+	}
+
+	e := newAPI(Config{HiddenFields: []string{"User.password"}})
+	count(e, "/count/user", "", "miss").Equal(map[string]interface{}{"count": 1})
+	require.Contains(t, last["query"], "aggregateUser(where: $where) { _count { _all } }")
+	count(e, "/count/User", "", "hit").Equal(map[string]interface{}{"count": 1})
+	count(e, "/count/user", `{"email":{"contains":"@"}}`, "miss").ValueEqual("count", 2)
+	require.Equal(t, map[string]interface{}{"where": map[string]interface{}{"email": map[string]interface{}{"contains": "@"}}}, last["variables"])
+	count(e, "/count/job", "", "miss").ValueEqual("count", 3)
+	count(e, "/exists/user", `{"email":{"equals":"nobody"}}`, "miss").Equal(map[string]interface{}{"exists": false})
+	count(e, "/exists/user", "", "miss").Equal(map[string]interface{}{"exists": true})
+	require.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+	// a post written changes the counts of its author's model too
+	e.POST("/").WithHeader("Content-Type", "application/json").
+		WithBytes([]byte(`{"query":"mutation { createOnePost(data: {title: \"a\", author: {connect: {id: 1}}}) { id } }"}`)).
+		Expect().Status(http.StatusOK)
+	count(e, "/count/user", "", "miss").ValueEqual("count", 6)
+	count(e, "/count/job", "", "hit").ValueEqual("count", 3)
+
+	e.GET("/count/comment").Expect().Status(http.StatusNotFound)
+	e.GET("/count/user").WithQuery("where", "email").Expect().Status(http.StatusBadRequest)
+	e.POST("/count/user").Expect().Status(http.StatusMethodNotAllowed)
+	e.GET("/count/user").WithQuery("where", `{"password":{"equals":"x"}}`).
+		Expect().Status(http.StatusForbidden).JSON().Path("$.error.code").Equal("FORBIDDEN_FIELD")
+
+	e = newAPI(Config{HiddenModels: []string{"Job"}, CountCacheTTL: 0})
+	e.GET("/count/job").Expect().Status(http.StatusNotFound)
+}
+
+func TestSchemaDrift(t *testing.T) {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer fakeDB.Close()
+	registry := metrics.NewRegistry()
+	handler := NewHandler(Config{
+		QueryEngineURL:            fakeDB.URL,
+		HealthEndpoint:            "/health",
+		MetricsEndpoint:           "/metrics",
+		ReadLimitSeconds:          10000,
+		WriteLimitSeconds:         2000,
+		Metrics:                   registry,
+		RefuseWritesOnSchemaDrift: true,
+	}, func() {})
+	api := httptest.NewServer(handler)
+	defer api.Close()
+	e := httpexpect.New(t, api.URL)
+	post := func(query string) *httpexpect.Response {
+		body, _ := json.Marshal(map[string]string{"query": query})
+		return e.POST("/").WithHeader("Content-Type", "application/json").WithBytes(body).Expect()
+	}
+
+	// not compared yet
+	e.GET("/health").WithQuery("verbose", "1").Expect().JSON().Path("$.components").Object().NotContainsKey("schema_drift")
+	post("mutation { createOneUser(data: {}) { id } }").Status(http.StatusOK)
+
+	handler.SetSchemaDrift(true, "[+] Added tables\n  - Invoice", nil)
+	post("mutation { createOneUser(data: {}) { id } }").Status(http.StatusConflict).
+		JSON().Path("$.errors[0].extensions.code").Equal("SCHEMA_DRIFT")
+	post("{ findManyUser { id } }").Status(http.StatusOK)
+	drift := e.GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusOK).JSON().Path("$.components.schema_drift").Object()
+	drift.ValueEqual("status", HealthDegraded)
+	drift.Path("$.details.schema_drift").Equal(true)
+	drift.Path("$.details.differences").String().Contains("Invoice")
+	e.GET("/metrics").Expect().Body().Contains("wunderbase_schema_drift 1")
+
+	handler.SetSchemaDrift(false, "", nil)
+	post("mutation { createOneUser(data: {}) { id } }").Status(http.StatusOK)
+	e.GET("/metrics").Expect().Body().Contains("wunderbase_schema_drift 0")
+
+	// a failed comparison doesn't refuse writes
+	handler.SetSchemaDrift(true, "", errors.New("migration engine not found"))
+	post("mutation { createOneUser(data: {}) { id } }").Status(http.StatusOK)
+	e.GET("/health").WithQuery("verbose", "1").Expect().JSON().Path("$.components.schema_drift.details.error").
+		Equal("migration engine not found")
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type (
+	callerKey struct{}
+	scopesKey struct{}
+)
+
+// Caller returns the identity the request was authenticated as, or "" when
+// no authentication is configured.
+func Caller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// Scopes returns the scopes granted to the caller by the trusted scopes
+// header, nil if there are none.
+func Scopes(ctx context.Context) []string {
+	scopes, _ := ctx.Value(scopesKey{}).([]string)
+	return scopes
+}
+
+// trustedHeaderAuth authenticates requests by a header set by an
+// authenticating proxy in front of wunderbase, e.g. oauth2-proxy. The header
+// is only believed when the request comes from one of the trusted proxies,
+// since anyone else could set it.
+type trustedHeaderAuth struct {
+	header string
+	// scopesHeader, if set, carries the scopes of the caller separated by
+	// commas or spaces, like the groups oauth2-proxy forwards
+	scopesHeader string
+	proxies      []*net.IPNet
+}
+
+// authenticate returns the request with the caller attached to its
+// context, or writes an error and returns nil.
+func (a *trustedHeaderAuth) authenticate(w http.ResponseWriter, r *http.Request) *http.Request {
+	if !fromTrustedProxy(r, a.proxies) {
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", "request did not come through a trusted proxy")
+		return nil
+	}
+	caller := r.Header.Get(a.header)
+	if caller == "" {
+		writeGraphQLError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "missing "+a.header+" header")
+		return nil
+	}
+	ctx := context.WithValue(r.Context(), callerKey{}, caller)
+	if a.scopesHeader != "" {
+		scopes := strings.FieldsFunc(r.Header.Get(a.scopesHeader), func(c rune) bool { return c == ',' || c == ' ' })
+		ctx = context.WithValue(ctx, scopesKey{}, scopes)
+	}
+	return r.WithContext(ctx)
+}
+
+// fromTrustedProxy reports whether the request comes from one of proxies,
+// whose headers can be believed.
+func fromTrustedProxy(r *http.Request, proxies []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// AuthRules decide which callers may run the root fields of an operation.
+type AuthRules struct {
+	// Default is allow or deny, what happens to a root field no rule
+	// allows. Empty allows.
+	Default string `yaml:"default" json:"default"`
+	// Rules are keyed by Model.action, action being read, create, update,
+	// delete or upsert, or by a root field or operation name. Operation
+	// names are chosen by the client, so their rules only restrict: they
+	// never allow a root field the default denies.
+	Rules map[string]AuthRule `yaml:"rules" json:"rules"`
+}
+
+// AuthRule is what a caller needs to run what the rule matches. A rule
+// requiring nothing allows everyone.
+type AuthRule struct {
+	Authenticated bool `yaml:"authenticated" json:"authenticated,omitempty"`
+	// Scopes must all be granted to the caller.
+	Scopes []string `yaml:"scopes" json:"scopes,omitempty"`
+}
+
+// authActions are the actions of Model.action rules by the prefix of the
+// root fields they cover.
+var authActions = []struct {
+	prefix, action string
+}{
+	{"findUnique", "read"},
+	{"findFirst", "read"},
+	{"findMany", "read"},
+	{"aggregate", "read"},
+	{"groupBy", "read"},
+	{"createOne", "create"},
+	{"createMany", "create"},
+	{"updateOne", "update"},
+	{"updateMany", "update"},
+	{"deleteOne", "delete"},
+	{"deleteMany", "delete"},
+	{"upsertOne", "upsert"},
+}
+
+// Validate checks the posture and the actions of the rules, the models are
+// checked against the schema served once the engine answers.
+func (r *AuthRules) Validate() error {
+	if r.Default != "" && r.Default != "allow" && r.Default != "deny" {
+		return fmt.Errorf("default must be allow or deny, not %q", r.Default)
+	}
+	for _, key := range r.sortedKeys() {
+		model, action, ok := strings.Cut(key, ".")
+		if !ok {
+			continue
+		}
+		if model == "" || !knownAuthAction(action) {
+			return fmt.Errorf("rule %q: expected Model.action with action read, create, update, delete or upsert", key)
+		}
+		for _, scope := range r.Rules[key].Scopes {
+			if strings.TrimSpace(scope) == "" {
+				return fmt.Errorf("rule %q: empty scope", key)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *AuthRules) sortedKeys() []string {
+	keys := make([]string, 0, len(r.Rules))
+	for key := range r.Rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func knownAuthAction(action string) bool {
+	for _, a := range authActions {
+		if a.action == action {
+			return true
+		}
+	}
+	return false
+}
+
+// authAction splits a root field like createOneOrder into its action and
+// model for the Model.action rules, empty if it isn't one of a model.
+func authAction(field string) (action, model string) {
+	for _, a := range authActions {
+		if strings.HasPrefix(field, a.prefix) && len(field) > len(a.prefix) {
+			return a.action, strings.TrimSuffix(field[len(a.prefix):], "OrThrow")
+		}
+	}
+	return "", ""
+}
+
+// authDenied is why the auth rules refused an operation.
+type authDenied struct {
+	message string
+}
+
+func (e *authDenied) Error() string {
+	return e.message
+}
+
+// authorize checks every root field of op against the rules, for the
+// caller and scopes of ctx. It returns nil if the operation may run.
+func (r *AuthRules) authorize(ctx context.Context, op *operation) *authDenied {
+	if op == nil {
+		return &authDenied{"the query could not be parsed, the auth rules can't check it"}
+	}
+	caller, scopes := Caller(ctx), Scopes(ctx)
+	if named, ok := r.Rules[op.name]; op.name != "" && ok {
+		if missing := named.missing(caller, scopes); missing != "" {
+			return &authDenied{fmt.Sprintf("rule %q requires %s", op.name, missing)}
+		}
+	}
+	for _, field := range op.rootFields {
+		if field == "" {
+			return &authDenied{"fragments on the root type can't be checked by the auth rules"}
+		}
+		if strings.HasPrefix(field, "__") {
+			continue
+		}
+		keys := []string{field}
+		if action, model := authAction(field); action != "" {
+			keys = append(keys, model+"."+action)
+		}
+		matched := false
+		for _, key := range keys {
+			rule, ok := r.Rules[key]
+			if !ok {
+				continue
+			}
+			matched = true
+			if missing := rule.missing(caller, scopes); missing != "" {
+				return &authDenied{fmt.Sprintf("rule %q requires %s", key, missing)}
+			}
+		}
+		if !matched && r.Default == "deny" {
+			return &authDenied{fmt.Sprintf("no rule allows %s", field)}
+		}
+	}
+	return nil
+}
+
+// missing returns what the caller lacks for the rule, empty if nothing.
+func (rule AuthRule) missing(caller string, scopes []string) string {
+	if rule.Authenticated && caller == "" {
+		return "an authenticated caller"
+	}
+	for _, scope := range rule.Scopes {
+		if !containsString(scopes, scope) {
+			return "the scope " + scope
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAuthRules reports the models of Model.action rules the schema
+// doesn't have.
+func checkAuthRules(rules *AuthRules, models map[string]restModel) error {
+	var unknown []string
+	for _, key := range rules.sortedKeys() {
+		if model, _, ok := strings.Cut(key, "."); ok {
+			if _, known := models[model]; !known {
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("wunderbase: auth rules: unknown models in %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// CheckAuthRules checks the models of the auth rules against the schema the
+// query engine serves, so a typo fails the start instead of a rule never
+// matching. It is called once the engine answers.
+func (h *Handler) CheckAuthRules() error {
+	rules := h.currentAuthRules()
+	if rules == nil {
+		return nil
+	}
+	schema, err := h.schema()
+	if err != nil {
+		return fmt.Errorf("wunderbase: auth rules: %w", err)
+	}
+	return checkAuthRules(rules, schema.models)
+}
+
+func (h *Handler) currentAuthRules() *AuthRules {
+	rules, _ := h.authRules.Load().(*AuthRules)
+	return rules
+}
+
+// reloadAuthRules replaces the auth rules. With the schema already loaded
+// rules naming unknown models are rejected and the current ones kept.
+func (h *Handler) reloadAuthRules(rules *AuthRules) {
+	if cached, ok := h.schemaCache.Load().(*schemaCache); ok && cached != nil && rules != nil {
+		if err := checkAuthRules(rules, cached.models); err != nil {
+			slog.Error("Reloading auth rules, keeping the current ones", slog.String("error", err.Error()))
+			return
+		}
+	}
+	h.authRules.Store(rules)
+}
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// defaultCaptureMaxBytes caps the bytes a capture stores without
+	// CaptureMaxBytes
+	defaultCaptureMaxBytes = 1 << 20
+	// maxCaptureCount bounds the exchanges one capture takes
+	maxCaptureCount = 100
+	// defaultCaptureTTL disarms a capture whose operation doesn't come
+	// by, maxCaptureTTL bounds what can be asked for
+	defaultCaptureTTL = 15 * time.Minute
+	maxCaptureTTL     = 24 * time.Hour
+	redacted          = "[REDACTED]"
+)
+
+// capturedExchange is a request of the captured operation with its
+// response, as served on /admin/capture and written to the capture
+// directory.
+type capturedExchange struct {
+	Time          time.Time       `json:"time"`
+	RequestID     string          `json:"requestId"`
+	OperationName string          `json:"operationName"`
+	Caller        string          `json:"caller,omitempty"`
+	Status        int             `json:"status"`
+	DurationMs    float64         `json:"durationMs"`
+	Request       json.RawMessage `json:"request"`
+	// Response is the body as JSON, ResponseText a body that isn't.
+	// Truncated is set if the response reached the byte cap.
+	Response     json.RawMessage `json:"response,omitempty"`
+	ResponseText string          `json:"responseText,omitempty"`
+	Truncated    bool            `json:"truncated,omitempty"`
+}
+
+// captureStatus is the answer of /admin/capture.
+type captureStatus struct {
+	Armed         bool               `json:"armed"`
+	OperationName string             `json:"operationName,omitempty"`
+	Remaining     int                `json:"remaining"`
+	ExpiresAt     *time.Time         `json:"expiresAt,omitempty"`
+	StoredBytes   int64              `json:"storedBytes"`
+	MaxBytes      int64              `json:"maxBytes"`
+	Dir           string             `json:"dir,omitempty"`
+	Captures      []capturedExchange `json:"captures"`
+}
+
+// capturer keeps the full requests and responses of the next runs of one
+// operation, armed on /admin/capture. It disarms itself once it took them
+// all, when it expires or reaches its byte cap.
+type capturer struct {
+	maxBytes int64
+	dir      string
+	redact   map[string]bool
+
+	mu        sync.Mutex
+	operation string
+	remaining int
+	expires   time.Time
+	used      int64
+	captures  []capturedExchange
+}
+
+func newCapturer(config Config) *capturer {
+	if config.DisableCapture {
+		return nil
+	}
+	c := &capturer{maxBytes: config.CaptureMaxBytes, dir: config.CaptureDir, redact: map[string]bool{}}
+	if c.maxBytes <= 0 {
+		c.maxBytes = defaultCaptureMaxBytes
+	}
+	for _, name := range config.CaptureRedact {
+		c.redact[name] = true
+	}
+	return c
+}
+
+// arm replaces the previous capture, and the exchanges it kept.
+func (c *capturer) arm(operation string, count int, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operation, c.remaining, c.expires = operation, count, now.Add(ttl)
+	c.used, c.captures = 0, nil
+}
+
+// disarm stops taking requests, the exchanges are kept. c.mu is held.
+func (c *capturer) disarm(reason string) {
+	slog.Warn("Capture disarmed", slog.String("operationName", c.operation), slog.String("reason", reason),
+		slog.Int("captured", len(c.captures)))
+	c.remaining = 0
+}
+
+// armed returns the operation captured, empty if none is.
+func (c *capturer) armed() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 {
+		return ""
+	}
+	return c.operation
+}
+
+// take reports whether a request of operation is to be captured, and counts
+// it if so. It returns the bytes its response may take.
+func (c *capturer) take(operation string, now time.Time) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 {
+		return 0, false
+	}
+	if now.After(c.expires) {
+		c.disarm("expired")
+		return 0, false
+	}
+	if operation != c.operation {
+		return 0, false
+	}
+	c.remaining--
+	return c.maxBytes - c.used, true
+}
+
+// store keeps an exchange within the byte cap, and persists it to the
+// capture directory if there is one.
+func (c *capturer) store(exchange capturedExchange) {
+	exchange.Request = redactJSON(exchange.Request, c.redact)
+	exchange.Response = redactJSON(exchange.Response, c.redact)
+	data, err := json.Marshal(exchange)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.used+int64(len(data)) > c.maxBytes {
+		c.disarm("byte cap reached")
+		return
+	}
+	c.used += int64(len(data))
+	c.captures = append(c.captures, exchange)
+	if c.dir != "" {
+		name := fmt.Sprintf("%s-%s.json", exchange.Time.Format("20060102T150405.000"), exchange.RequestID)
+		if err := ioutil.WriteFile(filepath.Join(c.dir, name), data, 0600); err != nil {
+			slog.Error("Writing a capture", slog.String("error", err.Error()))
+		}
+	}
+	if c.remaining == 0 {
+		c.disarm("done")
+	}
+}
+
+func (c *capturer) status(now time.Time) captureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining > 0 && now.After(c.expires) {
+		c.disarm("expired")
+	}
+	status := captureStatus{
+		Armed:         c.remaining > 0,
+		OperationName: c.operation,
+		Remaining:     c.remaining,
+		StoredBytes:   c.used,
+		MaxBytes:      c.maxBytes,
+		Dir:           c.dir,
+		Captures:      append([]capturedExchange{}, c.captures...),
+	}
+	if status.Armed {
+		expires := c.expires.UTC()
+		status.ExpiresAt = &expires
+	}
+	return status
+}
+
+// redactJSON replaces the values of the keys in names at any depth of a
+// JSON document. Anything else is returned as is.
+func redactJSON(data json.RawMessage, names map[string]bool) json.RawMessage {
+	if len(data) == 0 || len(names) == 0 {
+		return data
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if decoder.Decode(&doc) != nil {
+		return data
+	}
+	redactValue(doc, names)
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+func redactValue(value interface{}, names map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if names[key] {
+				v[key] = redacted
+				continue
+			}
+			redactValue(field, names)
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactValue(item, names)
+		}
+	}
+}
+
+// captureRecorder keeps the response of a captured request up to limit
+// bytes, next to the statusRecorder.
+type captureRecorder struct {
+	*statusRecorder
+	body      bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (r *captureRecorder) Write(b []byte) (int, error) {
+	if keep := r.limit - int64(r.body.Len()); keep < int64(len(b)) {
+		if keep > 0 {
+			r.body.Write(b[:keep])
+		}
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.statusRecorder.Write(b)
+}
+
+// finishCapture stores the exchange of a captured request.
+func (h *Handler) finishCapture(r *http.Request, operation string, body []byte, rec *captureRecorder, took time.Duration) {
+	exchange := capturedExchange{
+		Time:          time.Now().UTC(),
+		OperationName: operation,
+		Caller:        Caller(r.Context()),
+		Status:        rec.status,
+		DurationMs:    float64(took.Microseconds()) / 1000,
+		Request:       json.RawMessage(body),
+		Truncated:     rec.truncated,
+	}
+	if exchange.Status == 0 {
+		exchange.Status = http.StatusOK
+	}
+	if trace, ok := tracing.FromContext(r.Context()); ok {
+		exchange.RequestID = trace.RequestID
+	}
+	if !json.Valid(body) {
+		exchange.Request, _ = json.Marshal(string(body))
+	}
+	if response := rec.body.Bytes(); json.Valid(response) {
+		exchange.Response = append(json.RawMessage(nil), response...)
+	} else {
+		exchange.ResponseText = string(response)
+	}
+	h.capture.store(exchange)
+}
+
+// captureArm is the body of POST /admin/capture.
+type captureArm struct {
+	OperationName string `json:"operationName"`
+	Count         int    `json:"count"`
+	TTLSeconds    int    `json:"ttlSeconds"`
+}
+
+// serveCapture arms a capture of the next runs of an operation with POST,
+// lists what it captured with GET and disarms it with DELETE.
+func (h *Handler) serveCapture(w http.ResponseWriter, r *http.Request) {
+	if h.capture == nil {
+		writeError(w, h.plainTextErrors, http.StatusForbidden, "CAPTURE_DISABLED", "captures are disabled by WUNDERBASE_DISABLE_CAPTURE")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var arm captureArm
+		if err := json.NewDecoder(r.Body).Decode(&arm); err != nil {
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "the body must be a JSON object with operationName and count")
+			return
+		}
+		ttl := defaultCaptureTTL
+		if arm.TTLSeconds != 0 {
+			ttl = time.Duration(arm.TTLSeconds) * time.Second
+		}
+		switch {
+		case arm.OperationName == "":
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "operationName is required")
+			return
+		case arm.Count < 1 || arm.Count > maxCaptureCount:
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("count must be between 1 and %d", maxCaptureCount))
+			return
+		case ttl <= 0 || ttl > maxCaptureTTL:
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("ttlSeconds must be between 1 and %d", int(maxCaptureTTL.Seconds())))
+			return
+		}
+		if h.capture.dir != "" {
+			if err := os.MkdirAll(h.capture.dir, 0700); err != nil {
+				writeError(w, h.plainTextErrors, http.StatusInternalServerError, "CAPTURE_FAILED", "the capture directory could not be created")
+				return
+			}
+		}
+		h.capture.arm(arm.OperationName, arm.Count, ttl, time.Now())
+		// captures keep full bodies, which must never go unnoticed
+		slog.Warn("Capture armed, full requests and responses are stored", slog.String("operationName", arm.OperationName),
+			slog.Int("count", arm.Count), slog.Duration("ttl", ttl), slog.String("dir", h.capture.dir),
+			slog.String("remoteAddr", r.RemoteAddr))
+	case http.MethodDelete:
+		h.capture.mu.Lock()
+		if h.capture.remaining > 0 {
+			h.capture.disarm("disarmed on request")
+		}
+		h.capture.operation, h.capture.used, h.capture.captures = "", 0, nil
+		h.capture.mu.Unlock()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.capture.status(time.Now()))
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"wunderbase/pkg/cdc"
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	changesPath = "/changes"
+	// defaultChangesLimit and maxChangesLimit bound a page of the feed
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// changesPage is the JSON served on /changes. Cursor is the cursor to pass
+// as since for the next page, the last change's or since if there is none.
+type changesPage struct {
+	Changes []cdc.Change `json:"changes"`
+	Cursor  string       `json:"cursor"`
+	HasMore bool         `json:"hasMore"`
+}
+
+// serveChanges serves the changes recorded after ?since, oldest first.
+func (h *Handler) serveChanges(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, captureErrors: h.recent != nil}
+	w = rec
+	defer func() {
+		took := time.Since(start)
+		h.recordRequest(r.Context(), "changes", rec.status, took.Seconds())
+		h.logRequest(r, nil, "changes", rec, took)
+	}()
+
+	if r.Method != http.MethodGet {
+		writeRESTError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "the change feed is read with GET")
+		return
+	}
+	var since int64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			writeRESTError(w, http.StatusBadRequest, "INVALID_CURSOR", "since must be a cursor returned by the feed")
+			return
+		}
+	}
+	limit := defaultChangesLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeRESTError(w, http.StatusBadRequest, "INVALID_LIMIT", "limit must be a positive number")
+			return
+		}
+		if n < maxChangesLimit {
+			limit = n
+		} else {
+			limit = maxChangesLimit
+		}
+	}
+
+	// one more than the page tells whether there are more
+	changes, err := cdc.Read(r.Context(), h.sqlitePath, h.databaseFile, since, limit+1)
+	if err != nil {
+		tracing.Logger(r.Context()).Error("Reading changes", slog.String("error", err.Error()))
+		writeRESTError(w, http.StatusInternalServerError, "CHANGES_UNAVAILABLE", "the changes could not be read")
+		return
+	}
+	page := changesPage{Changes: changes, Cursor: strconv.FormatInt(since, 10)}
+	if len(changes) > limit {
+		page.Changes, page.HasMore = changes[:limit], true
+	}
+	if len(page.Changes) > 0 {
+		page.Cursor = page.Changes[len(page.Changes)-1].Cursor
+	}
+	// callers with model grants only see the changes of their models, the
+	// cursor still moves past the others
+	if grants := h.grants(r.Context()); grants != nil {
+		kept := page.Changes[:0]
+		for _, change := range page.Changes {
+			if grants.allows(change.Model, grantRead) {
+				kept = append(kept, change)
+			}
+		}
+		page.Changes = kept
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// defaultCoalesceWaiters is how many reads wait for one in flight if no
+// maximum is configured.
+const defaultCoalesceWaiters = 100
+
+// Results of a read in wunderbase_read_coalescing_total: executed by the
+// query engine, shared from an identical read in flight, or executed on its
+// own because enough reads waited for that one already.
+const (
+	coalesceExecuted = "executed"
+	coalesceShared   = "shared"
+	coalesceOverflow = "overflow"
+)
+
+// coalescer lets identical reads arriving while one of them waits for the
+// query engine share its answer, like the queries of a dashboard opened in
+// many tabs at once. Reads don't join one started before a write, nor
+// coalesce while a write is in flight, so a read never answers from before
+// a write its caller saw the response of.
+type coalescer struct {
+	maxWaiters int
+
+	mu      sync.Mutex
+	flights map[string]*flight
+	// writes is the number of writes in flight, generation counts the
+	// writes started and ended
+	writes     int
+	generation int64
+}
+
+// flight is a read waiting for the query engine. It is canceled once none
+// of the requests sharing it waits for it any longer.
+type flight struct {
+	done   chan struct{}
+	answer engineResponse
+	cancel context.CancelFunc
+	// clients is the number of requests waiting for the answer, the one
+	// which started the read included, readers the number still waiting
+	// when it arrived
+	clients    int
+	readers    int
+	generation int64
+}
+
+// newCoalescer returns nil unless enabled.
+func newCoalescer(enabled bool, maxWaiters int) *coalescer {
+	if !enabled {
+		return nil
+	}
+	if maxWaiters <= 0 {
+		maxWaiters = defaultCoalesceWaiters
+	}
+	return &coalescer{maxWaiters: maxWaiters, flights: map[string]*flight{}}
+}
+
+// do returns the answer of the read in flight under key, waiting for it,
+// or starts the read with send if there is none or the read is a new
+// generation. Reads are sent on their own, on ctx, while a write is in
+// flight or once maxWaiters wait for the read besides the request which
+// started it. A shared read is sent on a context without the cancellation
+// of ctx, so the requests waiting for it don't fail when the one which
+// started it goes away, and canceled when all of them did. Its answer,
+// failures included, is shared as is: the requests retry it like their
+// own. It also returns how the read was answered.
+func (c *coalescer) do(ctx context.Context, key string, send func(context.Context) engineResponse) (engineResponse, string) {
+	c.mu.Lock()
+	if c.writes > 0 {
+		c.mu.Unlock()
+		return send(ctx), coalesceExecuted
+	}
+	f, ok := c.flights[key]
+	result := coalesceShared
+	switch {
+	case ok && f.generation == c.generation && f.clients > c.maxWaiters:
+		c.mu.Unlock()
+		return send(ctx), coalesceOverflow
+	case ok && f.generation == c.generation:
+		f.clients++
+	default:
+		shared, cancel := context.WithCancel(detachedContext{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel, clients: 1, generation: c.generation}
+		c.flights[key] = f
+		result = coalesceExecuted
+		go c.run(shared, key, f, send)
+	}
+	c.mu.Unlock()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		c.leave(key, f)
+		return engineResponse{err: ctx.Err()}, result
+	}
+	if f.readers > 1 {
+		// the readers set their extensions in the answer
+		return f.answer.copy(), result
+	}
+	return f.answer, result
+}
+
+// run sends the read of f and hands its answer to the requests still
+// waiting for it.
+func (c *coalescer) run(ctx context.Context, key string, f *flight, send func(context.Context) engineResponse) {
+	answer := send(ctx)
+	f.cancel()
+	c.mu.Lock()
+	// a read of a later generation may have replaced it
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	f.answer, f.readers = answer, f.clients
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// leave stops a request waiting for f, canceling the read if it was the
+// last.
+func (c *coalescer) leave(key string, f *flight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f.clients--; f.clients > 0 {
+		return
+	}
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	f.cancel()
+}
+
+// beginWrite and endWrite surround every write.
+func (c *coalescer) beginWrite() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.writes++
+	c.generation++
+	c.mu.Unlock()
+}
+
+func (c *coalescer) endWrite() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.writes--
+	c.generation++
+	c.mu.Unlock()
+}
+
+// copy returns the answer with its own body: the requests sharing one set
+// their extensions in it.
+func (a engineResponse) copy() engineResponse {
+	if a.resp != nil {
+		resp := *a.resp
+		resp.Header = a.resp.Header.Clone()
+		a.resp = &resp
+	}
+	a.data = append([]byte(nil), a.data...)
+	return a
+}
+
+// coalesceKey identifies the reads answered alike: the same method,
+// operation name and variables, and the same document up to whitespace,
+// commas and comments.
+func coalesceKey(method string, body []byte) string {
+	query, _ := jsonparser.GetString(body, "query")
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	tokens := tokenize(query)
+	document := make([]string, len(tokens))
+	for i, tok := range tokens {
+		document[i] = tok.text
+		if tok.literal {
+			document[i] = tok.source
+		}
+	}
+	variables, _, _, _ := jsonparser.Get(body, "variables")
+	hash := sha256.New()
+	for _, part := range []string{method, operationName, strings.Join(document, " ")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(canonicalJSON(variables))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// canonicalJSON writes a JSON value with sorted keys and without
+// whitespace, or returns it as is if it isn't valid.
+func canonicalJSON(data []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return data
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return data
+	}
+	return canonical
+}
+
+// detachedContext has the values of a context, but neither its
+// cancellation nor its deadline.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,306 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// countPrefix and existsPrefix serve the count and the existence of the
+	// rows of a model matching a filter, for dashboards polling them.
+	countPrefix  = "/count/"
+	existsPrefix = "/exists/"
+	// countCacheEntries caps the answers kept, the oldest are dropped first
+	countCacheEntries = 1000
+)
+
+// mutationPrefixes are the prefixes of the mutation root fields writing the
+// model named after them.
+var mutationPrefixes = []string{"createOne", "createMany", "updateOne", "updateMany", "upsertOne", "deleteOne", "deleteMany"}
+
+// countCache keeps the answers of /count/ and /exists/ for a short time,
+// by model, until a write to the model or one related to it.
+type countCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]countEntry
+}
+
+type countEntry struct {
+	model   string
+	answer  []byte
+	expires time.Time
+}
+
+func newCountCache(ttl time.Duration) *countCache {
+	return &countCache{ttl: ttl, entries: map[string]countEntry{}}
+}
+
+func (c *countCache) get(key string, now time.Time) ([]byte, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return nil, false
+	}
+	return entry.answer, true
+}
+
+func (c *countCache) put(key, model string, answer []byte, now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= countCacheEntries {
+		oldest := ""
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			} else if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= countCacheEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = countEntry{model: model, answer: answer, expires: now.Add(c.ttl)}
+}
+
+// invalidate drops the answers of models, all of them if models is nil.
+func (c *countCache) invalidate(models map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if models == nil || models[entry.model] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// invalidateCounts drops the cached counts a mutation may change: those of
+// the models it writes and of the models related to them, which nested
+// writes and cascading deletes reach. Raw writes drop every count.
+func (h *Handler) invalidateCounts(op *operation) {
+	cache := h.owner().counts
+	if cache == nil {
+		return
+	}
+	schema, _ := h.schemaCache.Load().(*schemaCache)
+	if schema == nil || op == nil {
+		cache.invalidate(nil)
+		return
+	}
+	touched := map[string]bool{}
+	var queue []string
+	for _, field := range op.rootFields {
+		model := ""
+		for _, prefix := range mutationPrefixes {
+			if name := strings.TrimPrefix(field, prefix); name != field {
+				if _, ok := schema.models[name]; ok {
+					model = name
+				}
+				break
+			}
+		}
+		if model == "" {
+			cache.invalidate(nil)
+			return
+		}
+		if !touched[model] {
+			touched[model] = true
+			queue = append(queue, model)
+		}
+	}
+	for len(queue) > 0 {
+		model := queue[0]
+		queue = queue[1:]
+		for _, field := range schema.fields[model] {
+			if _, ok := schema.models[field.typ]; ok && !touched[field.typ] {
+				touched[field.typ] = true
+				queue = append(queue, field.typ)
+			}
+		}
+	}
+	cache.invalidate(touched)
+}
+
+// serveCount answers GET /count/{model}?where= with {"count": n} and GET
+// /exists/{model}?where= with {"exists": bool}, where is a JSON filter like
+// the where argument of GraphQL. They run as an aggregate and a findFirst
+// query, with the auth rules, hidden models and fields, row filters, soft
+// deletes and read limits of GraphQL requests, and are cached for a short
+// time.
+func (h *Handler) serveCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeRESTError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method+" is not supported on this path")
+		return
+	}
+	kind, prefix := "count", countPrefix
+	if strings.HasPrefix(r.URL.Path, existsPrefix) {
+		kind, prefix = "exists", existsPrefix
+	}
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("count: schema", slog.String("error", err.Error()))
+		writeRESTError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return
+	}
+	model, ok := schema.model(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"))
+	if !ok || h.visibility.hides(model.Name, "") {
+		writeRESTError(w, http.StatusNotFound, "NOT_FOUND", "unknown model")
+		return
+	}
+	where := map[string]interface{}{}
+	if raw := r.URL.Query().Get("where"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &where); err != nil {
+			writeRESTError(w, http.StatusBadRequest, "BAD_REQUEST", "where must be a JSON object: "+err.Error())
+			return
+		}
+	}
+	var query string
+	if kind == "count" {
+		query = fmt.Sprintf("query ($where: %sWhereInput) { aggregate%s(where: $where) { _count { _all } } }", model.Name, model.Name)
+	} else {
+		query = fmt.Sprintf("query ($where: %sWhereInput) { findFirst%s(where: $where) { %s } }", model.Name, model.Name, model.ID.Name)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": map[string]interface{}{"where": where}})
+
+	if rules := h.currentAuthRules(); rules != nil {
+		op, _ := parseOperation(body)
+		if denied := rules.authorize(r.Context(), op); denied != nil {
+			h.sink.Count(metricAuthRuleDenials, 1)
+			writeRESTError(w, http.StatusForbidden, "FORBIDDEN", denied.Error())
+			return
+		}
+	}
+	if grants := h.grants(r.Context()); grants != nil && h.refuseUngranted(w, r, body, grants, writeRESTError) {
+		return
+	}
+	if h.visibility != nil {
+		if touched := schema.hidden.touches(body); touched != "" {
+			h.sink.Count(metricHiddenFieldRejections, 1)
+			writeRESTError(w, http.StatusForbidden, "FORBIDDEN_FIELD", fmt.Sprintf("%s is not exposed by this API", touched))
+			return
+		}
+	}
+	if h.rowFilters != nil {
+		if body, err = filterRows(body, h.rowFilters, requestClaims(r.Context()), schema.index); err != nil {
+			h.sink.Count(metricRowFilterRejections, 1)
+			writeRESTError(w, http.StatusForbidden, "FORBIDDEN", err.Error())
+			return
+		}
+	}
+	if h.softDelete != nil {
+		if body, err = h.softDeleteRows(r, body); err != nil {
+			var refused *softDeleteError
+			if errors.As(err, &refused) {
+				h.sink.Count(metricSoftDeleteRejections, 1)
+				writeRESTError(w, http.StatusForbidden, "FORBIDDEN", err.Error())
+				return
+			}
+			tracing.Logger(r.Context()).Error("soft delete", slog.String("error", err.Error()))
+			writeRESTError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
+		}
+	}
+
+	cache := h.owner().counts
+	// the body after the rewrites is the key: callers whose row filters
+	// differ don't share answers
+	key := string(body)
+	if answer, ok := cache.get(key, time.Now()); ok {
+		h.sink.Count(metricCountRequests, 1, "kind", kind, "cache", "hit")
+		writeCount(w, cache.ttl, "hit", answer)
+		return
+	}
+	h.sink.Count(metricCountRequests, 1, "kind", kind, "cache", "miss")
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, captureErrors: h.recent != nil}
+	w = rec
+	defer func() {
+		took := time.Since(start)
+		h.recordRequest(r.Context(), kind, rec.status, took.Seconds())
+		h.logRequest(r, body, kind, rec, took)
+	}()
+	data, err := h.callEngine(r.Context(), body, false)
+	if errors.Is(err, errEnginePoolTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeRESTError(w, http.StatusServiceUnavailable, "ENGINE_BUSY", enginePoolTimeoutMessage)
+		return
+	}
+	if err != nil {
+		tracing.Logger(r.Context()).Error("count: query engine", slog.String("error", err.Error()))
+		writeRESTError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine could not be reached")
+		return
+	}
+	if errs, _, _, err := jsonparser.Get(data, "errors"); err == nil && len(errs) > 2 {
+		code, _ := jsonparser.GetString(errs, "[0]", "user_facing_error", "error_code")
+		message, _ := jsonparser.GetString(errs, "[0]", "user_facing_error", "message")
+		if message == "" {
+			message, _ = jsonparser.GetString(errs, "[0]", "error")
+		}
+		status := http.StatusBadRequest
+		if code == "" {
+			code, status = "INTERNAL_SERVER_ERROR", http.StatusInternalServerError
+		}
+		writeRESTError(w, status, code, message)
+		return
+	}
+	var answer []byte
+	if kind == "count" {
+		n, err := jsonparser.GetInt(data, "data", "aggregate"+model.Name, "_count", "_all")
+		if err != nil {
+			writeRESTError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine answered without a count")
+			return
+		}
+		answer = []byte(`{"count":` + strconv.FormatInt(n, 10) + "}\n")
+	} else {
+		_, dataType, _, err := jsonparser.Get(data, "data", "findFirst"+model.Name)
+		answer = []byte(`{"exists":` + strconv.FormatBool(err == nil && dataType != jsonparser.Null) + "}\n")
+	}
+	cache.put(key, model.Name, answer, time.Now())
+	writeCount(w, cache.ttl, "miss", answer)
+}
+
+func writeCount(w http.ResponseWriter, ttl time.Duration, cache string, answer []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if seconds := int(ttl / time.Second); seconds > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", seconds))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("X-Wunderbase-Cache", cache)
+	_, _ = w.Write(answer)
+}
+
+// model returns the model named name, ignoring case.
+func (c *schemaCache) model(name string) (restModel, bool) {
+	if m, ok := c.models[name]; ok {
+		return m, true
+	}
+	for _, m := range c.models {
+		if strings.EqualFold(m.Name, name) {
+			return m, true
+		}
+	}
+	return restModel{}, false
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
+)
+
+// allowDangerousHeader names the operation a caller with the admin scope
+// runs on purpose although it changes every row of a model.
+const allowDangerousHeader = "X-Wunderbase-Allow-Dangerous"
+
+// adminScope is the scope a caller needs for allowDangerousHeader.
+const adminScope = "admin"
+
+// dangerousMutations returns the deleteMany and updateMany root fields of
+// the selected mutation that change every row: their where argument is
+// missing, null or an object without conditions, inline or in the
+// variables. Root fields selected through fragments count too.
+func dangerousMutations(body []byte) []string {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return nil
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return nil
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 || doc.OperationDefinitions[op].OperationType != ast.OperationTypeMutation || !doc.OperationDefinitions[op].HasSelections {
+		return nil
+	}
+	var dangerous []string
+	for _, field := range rootFields(&doc, doc.OperationDefinitions[op].SelectionSet, map[string]bool{}) {
+		name := doc.FieldNameString(field)
+		if !strings.HasPrefix(name, "deleteMany") && !strings.HasPrefix(name, "updateMany") {
+			continue
+		}
+		where, ok := fieldArgument(&doc, field, "where")
+		if !ok || emptyWhere(&doc, op, body, doc.Arguments[where].Value) {
+			dangerous = append(dangerous, name)
+		}
+	}
+	return dangerous
+}
+
+// rootFields returns the fields of set, those of its inline fragments and
+// fragment spreads included.
+func rootFields(doc *ast.Document, set int, visited map[string]bool) []int {
+	var fields []int
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			fields = append(fields, selection.Ref)
+		case ast.SelectionKindInlineFragment:
+			if fragment := doc.InlineFragments[selection.Ref]; fragment.HasSelections {
+				fields = append(fields, rootFields(doc, fragment.SelectionSet, visited)...)
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || visited[name] {
+					continue
+				}
+				visited[name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					fields = append(fields, rootFields(doc, doc.FragmentDefinitions[i].SelectionSet, visited)...)
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// emptyWhere reports whether a where value matches every row: null, or an
+// object whose only conditions are empty AND and OR lists. A variable not
+// sent takes the default of its definition.
+func emptyWhere(doc *ast.Document, op int, body []byte, value ast.Value) bool {
+	switch value.Kind {
+	case ast.ValueKindNull:
+		return true
+	case ast.ValueKindObject:
+		for _, ref := range doc.ObjectValues[value.Ref].Refs {
+			name, value := doc.ObjectFieldNameString(ref), doc.ObjectFieldValue(ref)
+			if (name != "AND" && name != "OR") || value.Kind != ast.ValueKindList || len(doc.ListValues[value.Ref].Refs) > 0 {
+				return false
+			}
+		}
+		return true
+	case ast.ValueKindVariable:
+		name := doc.VariableValueNameString(value.Ref)
+		raw, typ, _, err := jsonparser.Get(body, "variables", name)
+		if err == jsonparser.KeyPathNotFoundError {
+			for _, ref := range doc.OperationDefinitions[op].VariableDefinitions.Refs {
+				def := doc.VariableDefinitions[ref]
+				if doc.VariableDefinitionNameString(ref) == name && def.DefaultValue.IsDefined {
+					return emptyWhere(doc, op, body, def.DefaultValue.Value)
+				}
+			}
+			return true
+		}
+		if err != nil || typ == jsonparser.Null {
+			return true
+		}
+		if typ != jsonparser.Object {
+			return false
+		}
+		empty := true
+		_ = jsonparser.ObjectEach(raw, func(key, value []byte, dataType jsonparser.ValueType, offset int) error {
+			if (string(key) != "AND" && string(key) != "OR") || dataType != jsonparser.Array || len(bytes.TrimSpace(value[1:len(value)-1])) > 0 {
+				empty = false
+			}
+			return nil
+		})
+		return empty
+	}
+	return false
+}
+
+// blockDangerousMutation answers a mutation changing every row of a model
+// with DANGEROUS_MUTATION_BLOCKED and reports whether it did. Callers with
+// the admin scope run it by naming the operation in allowDangerousHeader.
+func (h *Handler) blockDangerousMutation(w http.ResponseWriter, r *http.Request, body []byte, op *operation) bool {
+	fields := dangerousMutations(body)
+	if len(fields) == 0 {
+		return false
+	}
+	allowed := r.Header.Get(allowDangerousHeader)
+	if op.name != "" && allowed == op.name && containsString(Scopes(r.Context()), adminScope) {
+		tracing.Logger(r.Context()).Warn("Running a mutation changing every row",
+			slog.String("operationName", op.name), slog.String("caller", Caller(r.Context())), slog.String("fields", strings.Join(fields, ",")))
+		return false
+	}
+	h.sink.Count(metricDangerousMutations, 1)
+	name := op.name
+	if name == "" {
+		name = "<operation-name>"
+	}
+	message := fmt.Sprintf("%s without a where argument changes every row; to run it on purpose, name the operation and send %s: %s as a caller with the %s scope",
+		strings.Join(fields, ", "), strings.ToLower(allowDangerousHeader), name, adminScope)
+	writeGraphQLError(w, http.StatusBadRequest, "DANGEROUS_MUTATION_BLOCKED", message)
+	return true
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// databasePrefix is the path prefix of the databases served by a Router:
+// /t/{name}/... is served by the handler of database name as /... .
+const databasePrefix = "/t/"
+
+// States of a database served by a Router.
+const (
+	DatabaseIdle     = "idle"
+	DatabaseRunning  = "running"
+	DatabaseExited   = "exited"
+	DatabaseFailed   = "failed"
+	defaultStartWait = 30 * time.Second
+)
+
+// Database is one of the databases served by a Router.
+type Database struct {
+	Name string
+	// Config is the handler config of the database. Sleep mode is handled
+	// by the router and ignored here.
+	Config Config
+	// Start starts the query engine of the database and returns a func
+	// stopping it again. exited is called if the engine quits on its own.
+	// Start is called on the first request to the database and on the
+	// first one after its engine was stopped or exited.
+	Start func(exited func(err error)) (stop func(), err error)
+}
+
+// RouterConfig holds the settings a Router is built from.
+type RouterConfig struct {
+	Databases       []Database
+	HealthEndpoint  string
+	MetricsEndpoint string
+	Metrics         *metrics.Registry
+	// AdminToken enables /admin/databases for bearers of it.
+	AdminToken string
+	// SleepAfter stops the engine of a database without requests for that
+	// long, zero keeps engines running once started.
+	SleepAfter time.Duration
+	// StartTimeout bounds the wait for a started engine to answer, 30
+	// seconds if zero.
+	StartTimeout time.Duration
+	// PlainTextErrors answers the errors of the router like the handlers
+	// of PlainTextErrors.
+	PlainTextErrors bool
+}
+
+// Router serves several databases, each with its own query engine and
+// handler, under /t/{name}/. Engines are started on the first request to
+// their database and stopped when it is idle, so memory is bounded by the
+// databases in use rather than the ones configured.
+type Router struct {
+	sleepAfter      int64 // nanoseconds, accessed atomically
+	databases       map[string]*routedDatabase
+	names           []string
+	healthEndpoint  string
+	metricsEndpoint string
+	metrics         *metrics.Registry
+	adminToken      string
+	startTimeout    time.Duration
+	plainErrors     bool
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+type routedDatabase struct {
+	Database
+	handler *Handler
+	client  *http.Client
+
+	mu          sync.Mutex
+	state       string
+	stop        func()
+	started     time.Time
+	lastRequest time.Time
+	inFlight    int
+	starts      int
+	err         string
+}
+
+// NewRouter creates the handlers of the databases. No engine is started
+// before the first request.
+func NewRouter(config RouterConfig) *Router {
+	registry := config.Metrics
+	if registry == nil {
+		registry = metrics.NewRegistry()
+	}
+	rt := &Router{
+		sleepAfter:      int64(config.SleepAfter),
+		databases:       map[string]*routedDatabase{},
+		healthEndpoint:  config.HealthEndpoint,
+		metricsEndpoint: config.MetricsEndpoint,
+		metrics:         registry,
+		adminToken:      config.AdminToken,
+		startTimeout:    config.StartTimeout,
+		plainErrors:     config.PlainTextErrors,
+		done:            make(chan struct{}),
+	}
+	if rt.startTimeout == 0 {
+		rt.startTimeout = defaultStartWait
+	}
+	for _, db := range config.Databases {
+		handlerConfig := db.Config
+		handlerConfig.EnableSleepMode = false
+		handlerConfig.Database = db.Name
+		handlerConfig.Metrics = registry
+		handler := NewHandler(handlerConfig, func() {})
+		rt.databases[db.Name] = &routedDatabase{
+			Database: db,
+			handler:  handler,
+			client:   &http.Client{Timeout: time.Second, Transport: handler.client.Transport},
+			state:    DatabaseIdle,
+		}
+		rt.names = append(rt.names, db.Name)
+	}
+	sort.Strings(rt.names)
+	registry.GaugeFunc("wunderbase_databases_running", "Databases whose query engine is running.", func() float64 {
+		return float64(rt.countRunning())
+	})
+	go rt.stopIdle()
+	return rt
+}
+
+// Reload applies the reloadable settings of config to every database, and
+// its sleep timeout to the router.
+func (rt *Router) Reload(config Config) {
+	atomic.StoreInt64(&rt.sleepAfter, int64(time.Duration(config.SleepAfterSeconds)*time.Second))
+	if !config.EnableSleepMode {
+		atomic.StoreInt64(&rt.sleepAfter, 0)
+	}
+	for _, db := range rt.databases {
+		db.handler.Reload(config)
+	}
+}
+
+// Close stops all engines.
+func (rt *Router) Close() {
+	rt.closeOnce.Do(func() { close(rt.done) })
+	for _, name := range rt.names {
+		rt.databases[name].shutdown()
+		rt.databases[name].handler.Close()
+	}
+}
+
+// CloseStreams ends the schema version streams of every database.
+func (rt *Router) CloseStreams() {
+	for _, name := range rt.names {
+		rt.databases[name].handler.CloseStreams()
+	}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the router's own errors carry the request ID the handler of the
+	// database is passed on
+	requestID := tracing.FromRequest(r).RequestID
+	w.Header().Set(tracing.RequestIDHeader, requestID)
+	switch {
+	case r.URL.Path == rt.healthEndpoint:
+		rt.serveHealth(w, r)
+		return
+	case rt.metricsEndpoint != "" && r.URL.Path == rt.metricsEndpoint:
+		rt.metrics.Handler().ServeHTTP(w, r)
+		return
+	case r.URL.Path == adminPrefix+"databases":
+		if authorizeAdmin(w, r, rt.adminToken, rt.plainErrors) {
+			rt.serveDatabases(w, r)
+		}
+		return
+	case !strings.HasPrefix(r.URL.Path, databasePrefix):
+		writeNotFound(w, r, rt.plainErrors)
+		return
+	}
+
+	name, path := splitDatabasePath(r.URL.Path)
+	db, ok := rt.databases[name]
+	if !ok {
+		writeGraphQLError(w, http.StatusNotFound, "DATABASE_NOT_FOUND", fmt.Sprintf("database %q does not exist", name))
+		return
+	}
+	// the handler sees the path below the prefix, the playground keeps
+	// posting to the prefixed RequestURI
+	inner := new(http.Request)
+	*inner = *r
+	u := *r.URL
+	u.Path, u.RawPath = path, ""
+	inner.URL = &u
+	if r.Header.Get(tracing.RequestIDHeader) != requestID {
+		inner.Header = r.Header.Clone()
+		inner.Header.Set(tracing.RequestIDHeader, requestID)
+	}
+
+	if path == db.Config.HealthEndpoint && db.currentState() != DatabaseRunning {
+		// probing a database must neither start nor wake it
+		rt.serveIdleHealth(w, db)
+		return
+	}
+	if err := rt.acquire(db); err != nil {
+		writeGraphQLError(w, http.StatusServiceUnavailable, "DATABASE_UNAVAILABLE", err.Error())
+		return
+	}
+	defer db.release()
+	db.handler.ServeHTTP(w, inner)
+}
+
+// splitDatabasePath splits /t/{name}/rest into name and /rest.
+func splitDatabasePath(p string) (name, path string) {
+	name = strings.TrimPrefix(p, databasePrefix)
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[:i], name[i:]
+	}
+	return name, "/"
+}
+
+// acquire counts a request to db, starting its engine if it isn't running.
+func (rt *Router) acquire(db *routedDatabase) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.inFlight++
+	if db.state == DatabaseRunning {
+		return nil
+	}
+	if err := rt.start(db); err != nil {
+		db.inFlight--
+		db.state, db.err = DatabaseFailed, err.Error()
+		slog.Error("Starting database", slog.String("database", db.Name), slog.String("error", err.Error()))
+		return fmt.Errorf("database %q could not be started", db.Name)
+	}
+	return nil
+}
+
+func (db *routedDatabase) release() {
+	db.mu.Lock()
+	db.inFlight--
+	db.lastRequest = time.Now()
+	db.mu.Unlock()
+}
+
+// start starts the engine of db and waits for it to answer. db.mu is held.
+func (rt *Router) start(db *routedDatabase) error {
+	// an engine exiting while db.mu is held can't mark db as exited yet,
+	// crashed fails the start instead of waiting for the timeout
+	crashed := make(chan error, 1)
+	stop, err := db.Start(func(err error) {
+		select {
+		case crashed <- err:
+		default:
+		}
+		db.exited(err)
+	})
+	if err != nil {
+		return err
+	}
+	backoff := db.Config.EngineConnectBackoff
+	if backoff <= 0 {
+		backoff = defaultEngineConnectBackoff
+	}
+	deadline := time.Now().Add(rt.startTimeout)
+	for !db.engineAnswers() {
+		if time.Now().After(deadline) {
+			stop()
+			return fmt.Errorf("query engine not ready after %s", rt.startTimeout)
+		}
+		select {
+		case err := <-crashed:
+			stop()
+			return fmt.Errorf("query engine exited while starting: %w", err)
+		case <-time.After(backoff):
+		}
+	}
+	db.handler.WarmUp(context.Background())
+	if err := db.handler.CheckAuthRules(); err != nil {
+		stop()
+		return err
+	}
+	db.state, db.stop, db.err = DatabaseRunning, stop, ""
+	db.started, db.lastRequest = time.Now(), time.Now()
+	db.starts++
+	slog.Info("Database started", slog.String("database", db.Name))
+	return nil
+}
+
+func (db *routedDatabase) engineAnswers() bool {
+	resp, err := db.client.Get(db.Config.QueryEngineURL)
+	if err != nil {
+		return false
+	}
+	drain(resp)
+	return resp.StatusCode == http.StatusOK
+}
+
+// exited marks the engine of db as gone, the next request starts it again.
+func (db *routedDatabase) exited(err error) {
+	db.mu.Lock()
+	stop := db.stop
+	if db.state == DatabaseRunning {
+		db.state, db.stop, db.err = DatabaseExited, nil, err.Error()
+	}
+	db.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// shutdown stops the engine of db if it is running.
+func (db *routedDatabase) shutdown() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.state != DatabaseRunning {
+		return
+	}
+	db.stop()
+	db.state, db.stop = DatabaseIdle, nil
+}
+
+func (db *routedDatabase) currentState() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.state
+}
+
+func (rt *Router) countRunning() int {
+	running := 0
+	for _, db := range rt.databases {
+		if db.currentState() == DatabaseRunning {
+			running++
+		}
+	}
+	return running
+}
+
+// stopIdle stops the engines of databases without requests for sleepAfter.
+func (rt *Router) stopIdle() {
+	for {
+		interval := time.Second
+		sleepAfter := time.Duration(atomic.LoadInt64(&rt.sleepAfter))
+		if sleepAfter > 0 && sleepAfter/2 < interval {
+			interval = sleepAfter / 2
+		}
+		select {
+		case <-rt.done:
+			return
+		case <-time.After(interval):
+		}
+		if sleepAfter == 0 {
+			continue
+		}
+		for _, name := range rt.names {
+			db := rt.databases[name]
+			db.mu.Lock()
+			idle := db.state == DatabaseRunning && db.inFlight == 0 && time.Since(db.lastRequest) >= sleepAfter
+			if idle {
+				db.stop()
+				db.state, db.stop = DatabaseIdle, nil
+			}
+			db.mu.Unlock()
+			if idle {
+				db.handler.sink.Count(metricSleepEvents, 1)
+				slog.Info("Database idle, stopped its query engine", slog.String("database", db.Name), slog.Duration("idle", sleepAfter))
+			}
+		}
+	}
+}
+
+// databaseStatus is an entry of /admin/databases and of the verbose health
+// response of a router.
+type databaseStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	File        string     `json:"file,omitempty"`
+	SizeBytes   int64      `json:"sizeBytes"`
+	Started     *time.Time `json:"started,omitempty"`
+	LastRequest *time.Time `json:"lastRequest,omitempty"`
+	InFlight    int        `json:"inFlight"`
+	Starts      int        `json:"starts"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func (db *routedDatabase) status() databaseStatus {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	status := databaseStatus{
+		Name:      db.Name,
+		State:     db.state,
+		File:      db.Config.DatabaseFilePath,
+		SizeBytes: db.handler.databaseSize.Size(),
+		InFlight:  db.inFlight,
+		Starts:    db.starts,
+		Error:     db.err,
+	}
+	if !db.started.IsZero() {
+		started := db.started.UTC()
+		status.Started = &started
+	}
+	if !db.lastRequest.IsZero() {
+		last := db.lastRequest.UTC()
+		status.LastRequest = &last
+	}
+	return status
+}
+
+// serveDatabases lists the databases with their state.
+func (rt *Router) serveDatabases(w http.ResponseWriter, r *http.Request) {
+	databases := make([]databaseStatus, 0, len(rt.names))
+	for _, name := range rt.names {
+		databases = append(databases, rt.databases[name].status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(databases)
+}
+
+// databaseHealth is a database in the verbose health response of a router.
+type databaseHealth struct {
+	State  string `json:"state"`
+	Status string `json:"status"`
+	// Health is the verbose health of a running database.
+	Health *healthResponse `json:"health,omitempty"`
+}
+
+// serveHealth answers OK when the engines of all running databases answer.
+// Idle databases are healthy, failed ones degrade the router but don't
+// fail it, as other databases are still served. ?verbose=1 breaks the
+// status down by database.
+func (rt *Router) serveHealth(w http.ResponseWriter, r *http.Request) {
+	databases := map[string]databaseHealth{}
+	status, code := HealthOK, http.StatusOK
+	for _, name := range rt.names {
+		db := rt.databases[name]
+		health := databaseHealth{State: db.currentState(), Status: HealthOK}
+		switch health.State {
+		case DatabaseRunning:
+			response, _ := db.handler.verboseHealth(db.handler.probeEngine())
+			health.Status, health.Health = response.Status, &response
+			if response.Components["query_engine"].Status != HealthOK {
+				code = http.StatusServiceUnavailable
+			}
+		case DatabaseExited, DatabaseFailed:
+			health.Status = HealthDegraded
+		}
+		if worse(health.Status, status) {
+			status = health.Status
+		}
+		databases[name] = health
+	}
+
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    status,
+			"databases": databases,
+		})
+		return
+	}
+	w.WriteHeader(code)
+	if code != http.StatusOK {
+		_, _ = w.Write([]byte("query engine not reachable"))
+		return
+	}
+	_, _ = w.Write([]byte("OK"))
+}
+
+// serveIdleHealth answers the health endpoint of a database whose engine
+// isn't running, failing only if it could not be started.
+func (rt *Router) serveIdleHealth(w http.ResponseWriter, db *routedDatabase) {
+	status := db.status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.State == DatabaseFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// defaultTakeHeader lists the response paths of the fields a default take
+// was added to, for clients whose response format has no extensions.
+const defaultTakeHeader = "X-Default-Take"
+
+// defaultTakeExtension is added to the response extensions when a default
+// take was added to a field.
+type defaultTakeExtension struct {
+	Take       int      `json:"take,omitempty"`
+	NestedTake int      `json:"nestedTake,omitempty"`
+	Fields     []string `json:"fields"`
+}
+
+// injectDefaultTakes adds take: top to every paginated list field at the
+// root of the operation and take: nested to the ones below, if they have
+// neither take nor first. 0 leaves the fields alone. It returns the body
+// unchanged and no extension if no take was added or the document doesn't
+// parse, which the engine then reports.
+func injectDefaultTakes(body []byte, top, nested int, fields map[string]map[string]schemaField) ([]byte, *defaultTakeExtension) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return body, nil
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return body, nil
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 || !doc.OperationDefinitions[op].HasSelections {
+		return body, nil
+	}
+	root := "Query"
+	if doc.OperationDefinitions[op].OperationType == ast.OperationTypeMutation {
+		root = "Mutation"
+	}
+
+	edits := map[uint32]queryEdit{}
+	extension := &defaultTakeExtension{Take: top, NestedTake: nested}
+	walkListFields(&doc, fields, doc.OperationDefinitions[op].SelectionSet, root, "", map[string]bool{}, func(field int, path string) {
+		take := top
+		if strings.Contains(path, ".") {
+			take = nested
+		}
+		if take <= 0 {
+			return
+		}
+		if _, ok := fieldArgument(&doc, field, "take"); ok {
+			return
+		}
+		if _, ok := fieldArgument(&doc, field, "first"); ok {
+			return
+		}
+		f := doc.Fields[field]
+		if f.HasArguments && len(f.Arguments.Refs) > 0 {
+			start := doc.Arguments[f.Arguments.Refs[0]].Name.Start
+			edits[start] = queryEdit{end: start, text: "take: " + strconv.Itoa(take) + ", "}
+		} else {
+			edits[f.Name.End] = queryEdit{end: f.Name.End, text: "(take: " + strconv.Itoa(take) + ")"}
+		}
+		extension.Fields = append(extension.Fields, path)
+	})
+	if len(edits) == 0 {
+		return body, nil
+	}
+	// Set may write to the array of its input, body is kept for errors
+	out, err := jsonparser.Set(append([]byte(nil), body...), applyEdits(query, edits), "query")
+	if err != nil {
+		return body, nil
+	}
+	sort.Strings(extension.Fields)
+	return out, extension
+}
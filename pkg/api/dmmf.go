@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// dmmf returns the DMMF of the schema the query engine serves, fetched on
+// the first call and cached with the SDL, so it is read again when the
+// schema is.
+func (h *Handler) dmmf() ([]byte, error) {
+	cached, err := h.schema()
+	if err != nil {
+		return nil, err
+	}
+	if cached.dmmf != nil {
+		return cached.dmmf, nil
+	}
+	resp, err := h.client.Get(h.queryEngineDmmfURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch dmmf: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch dmmf: unexpected status %d", resp.StatusCode)
+	}
+	dmmf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read dmmf: %w", err)
+	}
+	withDMMF := *cached
+	withDMMF.dmmf = dmmf
+	// a schema read again meanwhile is kept, its DMMF fetched next time
+	h.schemaCache.CompareAndSwap(cached, &withDMMF)
+	return dmmf, nil
+}
+
+// serveDMMF serves the DMMF for code generators consuming Prisma's model
+// metadata rather than the GraphQL schema. It describes every field of the
+// datamodel, also those the GraphQL layer hides.
+func (h *Handler) serveDMMF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+	dmmf, err := h.dmmf()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("dmmf", slog.String("error", err.Error()))
+		writeError(w, h.plainTextErrors, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the dmmf could not be read from the query engine")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(dmmf)
+}
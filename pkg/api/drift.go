@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const schemaDriftMessage = "the database has drifted from the schema, writes are refused until it is migrated"
+
+// schemaDrift is the latest comparison of the database with the schema,
+// made in the background once the server is ready.
+type schemaDrift struct {
+	// refuseWrites refuses writes while the database drifted
+	refuseWrites bool
+
+	mu      sync.Mutex
+	checked time.Time
+	drift   bool
+	summary string
+	err     string
+}
+
+// SetSchemaDrift records the result of comparing the database with the
+// schema: whether they differ and the differences, or why they couldn't be
+// compared.
+func (h *Handler) SetSchemaDrift(drift bool, summary string, err error) {
+	d := h.owner().drift
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.checked, d.drift, d.summary, d.err = time.Now().UTC(), drift, summary, ""
+	if err != nil {
+		d.drift, d.summary, d.err = false, "", err.Error()
+	}
+}
+
+func (d *schemaDrift) drifted() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.drift
+}
+
+// driftRefuses reports whether a write is refused for the drift of the
+// database.
+func (h *Handler) driftRefuses(write bool) bool {
+	d := h.owner().drift
+	return write && d.refuseWrites && d.drifted()
+}
+
+func writeSchemaDrift(w http.ResponseWriter, plain bool) {
+	writeError(w, plain, http.StatusConflict, "SCHEMA_DRIFT", schemaDriftMessage)
+}
+
+// driftHealth is the schema_drift component of the verbose health, false
+// until the database was compared with the schema.
+func (h *Handler) driftHealth() (ComponentHealth, bool) {
+	d := h.owner().drift
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.checked.IsZero() {
+		return ComponentHealth{}, false
+	}
+	health := ComponentHealth{Status: HealthOK, Details: map[string]interface{}{"schema_drift": d.drift, "checkedAt": d.checked}}
+	switch {
+	case d.err != "":
+		health.Details["error"] = d.err
+	case d.drift:
+		health.Status = HealthDegraded
+		health.Details["differences"] = d.summary
+		health.Details["writesRefused"] = d.refuseWrites
+	}
+	return health, true
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Sleep event kinds of the first idle stage: the query engine was stopped
+// while the process keeps listening, and started again by a request.
+const (
+	sleepEventEngineStop  = "engine_stop"
+	sleepEventEngineStart = "engine_start"
+)
+
+// engineIdle stops the query engine after a shorter idle time than the
+// sleep timeout, like the router does for the databases it serves, and
+// starts it again for the next request. mu is held while the engine starts,
+// so the requests arriving meanwhile queue behind the first.
+type engineIdle struct {
+	after time.Duration
+	stop  func()
+	start func() error
+	done  chan struct{}
+
+	mu       sync.Mutex
+	stopped  bool
+	inFlight int
+	lastUse  time.Time
+}
+
+func newEngineIdle(after time.Duration, stop func(), start func() error) *engineIdle {
+	if after <= 0 || stop == nil || start == nil {
+		return nil
+	}
+	return &engineIdle{after: after, stop: stop, start: start, done: make(chan struct{}), lastUse: time.Now()}
+}
+
+// acquireEngine starts the query engine if it was stopped for being idle and
+// waits until it answers and is warmed up. Every successful call must be
+// followed by releaseEngine.
+func (h *Handler) acquireEngine(ctx context.Context) error {
+	idle := h.engineIdle
+	idle.mu.Lock()
+	defer idle.mu.Unlock()
+	if idle.stopped {
+		start := time.Now()
+		if err := idle.start(); err != nil {
+			return fmt.Errorf("start query engine: %w", err)
+		}
+		deadline := start.Add(defaultStartWait)
+		for !h.engineAnswers() {
+			if time.Now().After(deadline) {
+				idle.stop()
+				return fmt.Errorf("query engine not ready after %s", defaultStartWait)
+			}
+			time.Sleep(h.connectBackoff)
+		}
+		h.WarmUp(ctx)
+		idle.stopped = false
+		h.sleepEvents.add(sleepEvent{Time: time.Now().UTC(), Kind: sleepEventEngineStart})
+		h.sink.Count(metricEngineIdleEvents, 1, "event", "start")
+		slog.Info("Query engine started after being idle", slog.Duration("took", time.Since(start)))
+	}
+	idle.inFlight++
+	idle.lastUse = time.Now()
+	return nil
+}
+
+func (h *Handler) releaseEngine() {
+	idle := h.engineIdle
+	idle.mu.Lock()
+	idle.inFlight--
+	idle.lastUse = time.Now()
+	idle.mu.Unlock()
+}
+
+func (h *Handler) engineAnswers() bool {
+	resp, err := h.client.Get(h.queryEngineURL)
+	if err != nil {
+		return false
+	}
+	drain(resp)
+	return resp.StatusCode == http.StatusOK
+}
+
+// engineStopped reports whether the query engine is stopped for being idle.
+func (h *Handler) engineStopped() bool {
+	if h.engineIdle == nil {
+		return false
+	}
+	h.engineIdle.mu.Lock()
+	defer h.engineIdle.mu.Unlock()
+	return h.engineIdle.stopped
+}
+
+// runEngineIdle stops the query engine once no request used it for the
+// engine idle time, until the handler is closed.
+func (h *Handler) runEngineIdle() {
+	idle := h.engineIdle
+	interval := time.Second
+	if idle.after/2 < interval {
+		interval = idle.after / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-idle.done:
+			return
+		case <-ticker.C:
+		}
+		idle.mu.Lock()
+		stop := !idle.stopped && idle.inFlight == 0 && time.Since(idle.lastUse) >= idle.after
+		if stop {
+			idle.stop()
+			idle.stopped = true
+		}
+		idle.mu.Unlock()
+		if stop {
+			h.sleepEvents.add(sleepEvent{Time: time.Now().UTC(), Kind: sleepEventEngineStop})
+			h.sink.Count(metricEngineIdleEvents, 1, "event", "stop")
+			slog.Info("Idle, stopped the query engine", slog.Duration("idle", idle.after))
+		}
+	}
+}
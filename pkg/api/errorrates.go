@@ -0,0 +1,126 @@
+package api
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxErrorCodes bounds the error codes counted, later ones are counted
+	// as OTHER
+	maxErrorCodes = 100
+	// errorRatioWindow is the number of one second buckets of the error
+	// ratio
+	errorRatioWindow = 60
+)
+
+// errorRates counts the GraphQL responses carrying errors by the code of
+// their first error, which an HTTP status of 200 hides, and keeps the
+// ratio of failed responses over the last minute.
+type errorRates struct {
+	mu    sync.Mutex
+	codes map[string]int64
+	// buckets are indexed by the unix second modulo the window
+	buckets [errorRatioWindow]errorBucket
+	// streamed counts the responses only checked for their HTTP status,
+	// their body was flushed as it was written
+	streamed int64
+}
+
+type errorBucket struct {
+	second        int64
+	total, failed int64
+}
+
+func newErrorRates() *errorRates {
+	return &errorRates{codes: map[string]int64{}}
+}
+
+// record counts a response. code is the code of its first GraphQL error,
+// empty if it has none or the body wasn't inspected. It returns the code
+// counted, empty if the response didn't fail.
+func (e *errorRates) record(code string, status int, streamed bool, now time.Time) string {
+	if code == "" && status >= 500 {
+		code = "HTTP_" + strconv.Itoa(status)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if streamed {
+		e.streamed++
+	}
+	if code != "" {
+		if _, ok := e.codes[code]; !ok && len(e.codes) >= maxErrorCodes {
+			code = "OTHER"
+		}
+		e.codes[code]++
+	}
+	second := now.Unix()
+	bucket := &e.buckets[second%errorRatioWindow]
+	if bucket.second != second {
+		*bucket = errorBucket{second: second}
+	}
+	bucket.total++
+	if code != "" {
+		bucket.failed++
+	}
+	return code
+}
+
+// ratio returns the share of the responses of the last minute that failed.
+func (e *errorRates) ratio(now time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var total, failed int64
+	for _, bucket := range e.buckets {
+		if now.Unix()-bucket.second < errorRatioWindow {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(failed) / float64(total)
+}
+
+// errorCodeCount is an error code with the responses it failed.
+type errorCodeCount struct {
+	Code  string `json:"code"`
+	Count int64  `json:"count"`
+}
+
+// errorStats is the errors part of the admin stats.
+type errorStats struct {
+	// Ratio is the share of failed responses over the last minute.
+	Ratio    float64          `json:"ratio"`
+	TopCodes []errorCodeCount `json:"topCodes"`
+	// Streamed responses were only checked for their HTTP status, Note
+	// says so when there were any.
+	Streamed int64  `json:"streamed,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+func (e *errorRates) stats(k int, now time.Time) *errorStats {
+	ratio := e.ratio(now)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := &errorStats{Ratio: ratio, TopCodes: make([]errorCodeCount, 0, len(e.codes)), Streamed: e.streamed}
+	for code, count := range e.codes {
+		stats.TopCodes = append(stats.TopCodes, errorCodeCount{code, count})
+	}
+	sort.Slice(stats.TopCodes, func(i, j int) bool {
+		if stats.TopCodes[i].Count != stats.TopCodes[j].Count {
+			return stats.TopCodes[i].Count > stats.TopCodes[j].Count
+		}
+		return stats.TopCodes[i].Code < stats.TopCodes[j].Code
+	})
+	if len(stats.TopCodes) > k {
+		stats.TopCodes = stats.TopCodes[:k]
+	}
+	if e.streamed > 0 {
+		stats.Note = "streamed responses are counted by their HTTP status only, their GraphQL errors are not"
+	}
+	return stats
+}
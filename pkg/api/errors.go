@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"wunderbase/pkg/tracing"
+)
+
+// busyBackoff is the wait before a request that found the database locked
+// is retried.
+const busyBackoff = 100 * time.Millisecond
+
+// busyMarkers are the SQLite busy and locked errors as the query engine
+// reports them, by rusqlite error code and by SQLite message.
+var busyMarkers = [][]byte{
+	[]byte("DatabaseBusy"),
+	[]byte("DatabaseLocked"),
+	[]byte("database is locked"),
+	[]byte("database table is locked"),
+}
+
+type graphQLError struct {
+	Message    string                 `json:"message"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+type graphQLErrorResponse struct {
+	Errors []graphQLError `json:"errors"`
+}
+
+// writeGraphQLError responds with a GraphQL error generated by the proxy
+// itself, so clients can handle it like any engine error. The request ID
+// of the response, if set, is added to the extensions.
+func writeGraphQLError(w http.ResponseWriter, status int, code, message string) {
+	extensions := map[string]interface{}{"code": code}
+	if id := w.Header().Get(tracing.RequestIDHeader); id != "" {
+		extensions["requestId"] = id
+	}
+	body, _ := json.Marshal(graphQLErrorResponse{
+		Errors: []graphQLError{{
+			Message:    message,
+			Extensions: extensions,
+		}},
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// writeError responds with an error of the proxy outside of a GraphQL
+// request, like of the admin endpoints, in the GraphQL error format so
+// clients need a single error parser. plain answers with the message as
+// text instead, like versions before the format was unified.
+func writeError(w http.ResponseWriter, plain bool, status int, code, message string) {
+	if plain {
+		http.Error(w, message, status)
+		return
+	}
+	writeGraphQLError(w, status, code, message)
+}
+
+// writeNotFound responds to a request for a path that isn't served.
+func writeNotFound(w http.ResponseWriter, r *http.Request, plain bool) {
+	if plain {
+		http.NotFound(w, r)
+		return
+	}
+	writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", "no endpoint at "+r.URL.Path)
+}
+
+// isDatabaseBusy reports whether an engine response failed because another
+// connection held the SQLite lock.
+func isDatabaseBusy(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte(`{"errors"`)) {
+		return false
+	}
+	for _, marker := range busyMarkers {
+		if bytes.Contains(data, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleBusy retries a request that found the database locked once after
+// busyBackoff if it carries an Idempotency-Key, so a write applied despite
+// the error isn't repeated by accident. Otherwise it answers 503 for the
+// client to retry, and returns true.
+func (h *Handler) handleBusy(opts *proxyOptions, w http.ResponseWriter, r *http.Request) bool {
+	h.sink.Count(metricDatabaseBusy, 1)
+	if r.Header.Get("Idempotency-Key") != "" && !opts.retriedBusy {
+		opts.retriedBusy = true
+		tracing.Logger(r.Context()).Info("Database busy, retrying")
+		select {
+		case <-time.After(busyBackoff):
+			return false
+		case <-r.Context().Done():
+		}
+	}
+	w.Header().Set("Retry-After", "1")
+	writeGraphQLError(w, http.StatusServiceUnavailable, "DATABASE_BUSY",
+		"the database is locked by another write, retry shortly")
+	return true
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// What a request is left out of.
+const (
+	excludeLog = 1 << iota
+	excludeMetrics
+)
+
+// exclusions leave requests out of the access log and the request metrics,
+// like health probes that would drown everything else. Matching runs on
+// every request: a map lookup and a few prefix comparisons.
+type exclusions struct {
+	log, metrics pathSet
+	userAgents   []string
+}
+
+// pathSet matches exact paths, and path prefixes given with a trailing *.
+type pathSet struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func newPathSet(paths []string) pathSet {
+	set := pathSet{exact: map[string]bool{}}
+	for _, path := range paths {
+		if prefix := strings.TrimSuffix(path, "*"); prefix != path {
+			set.prefixes = append(set.prefixes, prefix)
+		} else {
+			set.exact[path] = true
+		}
+	}
+	return set
+}
+
+func (s pathSet) match(path string) bool {
+	if s.exact[path] {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func newExclusions(logPaths, metricsPaths, userAgents []string) *exclusions {
+	if len(logPaths) == 0 && len(metricsPaths) == 0 && len(userAgents) == 0 {
+		return nil
+	}
+	return &exclusions{log: newPathSet(logPaths), metrics: newPathSet(metricsPaths), userAgents: userAgents}
+}
+
+// match returns what r is left out of: user agents starting with one of
+// the prefixes are left out of both.
+func (e *exclusions) match(r *http.Request) int {
+	if e == nil {
+		return 0
+	}
+	if len(e.userAgents) > 0 {
+		userAgent := r.Header.Get("User-Agent")
+		for _, prefix := range e.userAgents {
+			if strings.HasPrefix(userAgent, prefix) {
+				return excludeLog | excludeMetrics
+			}
+		}
+	}
+	var excluded int
+	if e.log.match(r.URL.Path) {
+		excluded |= excludeLog
+	}
+	if e.metrics.match(r.URL.Path) {
+		excluded |= excludeMetrics
+	}
+	return excluded
+}
+
+type exclusionKey struct{}
+
+// excludeRequest marks r as left out of the log or the metrics, counting
+// it so the traffic stays visible.
+func (h *Handler) excludeRequest(r *http.Request) *http.Request {
+	excluded := h.exclusions.match(r)
+	if excluded == 0 {
+		return r
+	}
+	h.sink.Count(metricExcludedRequests, 1)
+	return r.WithContext(context.WithValue(r.Context(), exclusionKey{}, excluded))
+}
+
+// excluded reports whether the request of ctx is left out of what.
+func excluded(ctx context.Context, what int) bool {
+	excluded, _ := ctx.Value(exclusionKey{}).(int)
+	return excluded&what != 0
+}
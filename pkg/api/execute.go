@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/buger/jsonparser"
+)
+
+// ExecuteOptions control how an operation run outside of a request is
+// accounted for.
+type ExecuteOptions struct {
+	// RateLimited takes from the read and write limits like requests do.
+	RateLimited bool
+	// KeepAwake resets the sleep timer like a request does, following the
+	// same SleepResetOn and SleepResetExempt.
+	KeepAwake bool
+}
+
+// Execute runs a GraphQL request body on the query engine on behalf of the
+// server itself, as scheduled operations do. It applies the same admission
+// rules as requests and fails if the response carries errors.
+func (h *Handler) Execute(ctx context.Context, body []byte, opts ExecuteOptions) ([]byte, error) {
+	if atomic.LoadInt32(&h.owner().paused) == 1 {
+		return nil, errors.New("the database is being replaced")
+	}
+	if !h.gate.enter(ctx, h.migrationWait) {
+		return nil, errors.New("the database is being migrated")
+	}
+	defer h.gate.leave()
+	activity := sleepActivity{Type: "scheduled"}
+	if opts.KeepAwake {
+		h.begin()
+		select {
+		case <-h.started:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if h.enableSleepMode {
+			defer func() { h.resetSleep(ctx, &activity) }()
+		}
+	}
+
+	op, err := parseOperation(body)
+	if err != nil {
+		return nil, err
+	}
+	activity.OperationName, activity.Write = op.name, op.isMutation()
+	if op.isMutation() && h.readOnly {
+		return nil, errors.New("this instance is a read replica, mutations are not allowed")
+	}
+	if h.storageRefuses(op.isMutation()) {
+		return nil, errors.New(storageUnavailableMessage)
+	}
+	if h.driftRefuses(op.isMutation()) {
+		return nil, errors.New(schemaDriftMessage)
+	}
+	if op.isMutation() && !op.onlyDeletes() && h.databaseFull() {
+		h.sink.Count(metricDatabaseFull, 1)
+		return nil, errors.New("database size limit reached, only reads and deletes are allowed")
+	}
+
+	if h.engineIdle != nil {
+		if err := h.acquireEngine(ctx); err != nil {
+			return nil, err
+		}
+		defer h.releaseEngine()
+	}
+	var data []byte
+	switch {
+	case opts.RateLimited:
+		data, err = h.callEngine(ctx, body, op.isMutation())
+	case op.isMutation():
+		// not rate limited, but the write queue is still taken
+		var release func()
+		if release, err = h.enqueueWrite(ctx); err == nil {
+			if data, err = h.postPooled(ctx, body); err == nil {
+				h.journalMutation(body, data)
+			}
+			release()
+		}
+	default:
+		data, err = h.postPooled(ctx, body)
+	}
+	if op.isMutation() {
+		h.databaseSize.Invalidate()
+		h.invalidateCounts(op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if message, err := jsonparser.GetString(data, "errors", "[0]", "message"); err == nil {
+		return data, fmt.Errorf("query engine: %s", message)
+	}
+	return data, nil
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// fingerprint identifies the shape of a GraphQL document: two queries that
+// differ only in whitespace, comments, aliases or literal values share one.
+// It is safe to log and to use as a metrics key, unlike the query text.
+func fingerprint(query string) string {
+	sum := sha256.Sum256([]byte(normalizeQuery(query)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// normalizeQuery rewrites a document to its tokens separated by single
+// spaces, with literals replaced by ? and aliases removed. The document is
+// not validated, invalid documents are normalized as far as they tokenize.
+func normalizeQuery(query string) string {
+	tokens := tokenize(query)
+	out := make([]string, 0, len(tokens))
+	// arguments and variable definitions are the only parenthesized parts
+	// of a document; a colon outside of them follows an alias
+	depth := 0
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch {
+		case tok.text == "(":
+			depth++
+		case tok.text == ")":
+			depth--
+		case depth == 0 && tok.name && i+1 < len(tokens) && tokens[i+1].text == ":":
+			i++
+			continue
+		case tok.literal || (depth > 0 && tok.name && isValueKeyword(tok.text) && i > 0 && !tokens[i-1].name):
+			// a list of literals normalizes like a single one
+			if len(out) > 0 && out[len(out)-1] == "?" {
+				continue
+			}
+			out = append(out, "?")
+			continue
+		}
+		out = append(out, tok.text)
+	}
+	return strings.Join(out, " ")
+}
+
+func isValueKeyword(s string) bool {
+	return s == "true" || s == "false" || s == "null"
+}
+
+type token struct {
+	text    string
+	name    bool
+	literal bool
+	// source is the literal as written, text is ?
+	source string
+}
+
+// tokenize splits a GraphQL document into its lexical tokens, dropping
+// whitespace, commas and comments.
+func tokenize(s string) []token {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], `"""`):
+			start := i
+			end := strings.Index(s[i+3:], `"""`)
+			if end < 0 {
+				i = len(s)
+			} else {
+				i += 3 + end + 3
+			}
+			tokens = append(tokens, token{text: "?", literal: true, source: s[start:i]})
+		case c == '"':
+			start := i
+			i++
+			for i < len(s) && s[i] != '"' && s[i] != '\n' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if i > len(s) {
+				i = len(s)
+			}
+			tokens = append(tokens, token{text: "?", literal: true, source: s[start:i]})
+		case c == '-' || isDigit(c):
+			start := i
+			i++
+			for i < len(s) && (isDigit(s[i]) || s[i] == '.' || s[i] == 'e' || s[i] == 'E' || s[i] == '+' || s[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{text: "?", literal: true, source: s[start:i]})
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(s) && (s[i] == '_' || isLetter(s[i]) || isDigit(s[i])) {
+				i++
+			}
+			tokens = append(tokens, token{text: s[start:i], name: true})
+		case strings.HasPrefix(s[i:], "..."):
+			tokens = append(tokens, token{text: "..."})
+			i += 3
+		default:
+			tokens = append(tokens, token{text: string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool  { return '0' <= c && c <= '9' }
+func isLetter(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
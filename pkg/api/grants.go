@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	grantRead  = "read"
+	grantWrite = "write"
+)
+
+// modelGrants are the models a caller was granted by scopes like
+// Product:read or Product:write, write granting read as well. A caller
+// with any of them only reaches the models granted.
+type modelGrants map[string]string
+
+// callerGrants returns the model grants among the scopes of ctx, nil if
+// there are none and the caller isn't restricted to models.
+func callerGrants(ctx context.Context) modelGrants {
+	var grants modelGrants
+	for _, scope := range Scopes(ctx) {
+		model, access, ok := strings.Cut(scope, ":")
+		if !ok || model == "" || (access != grantRead && access != grantWrite) {
+			continue
+		}
+		if grants == nil {
+			grants = modelGrants{}
+		}
+		if grants[model] != grantWrite {
+			grants[model] = access
+		}
+	}
+	return grants
+}
+
+// grants returns the model grants of the caller, nil if model grants are
+// disabled or the caller has none.
+func (h *Handler) grants(ctx context.Context) modelGrants {
+	if !h.modelGrants {
+		return nil
+	}
+	return callerGrants(ctx)
+}
+
+// allows reports whether the model is granted at the access level.
+func (g modelGrants) allows(model, access string) bool {
+	granted, ok := g[model]
+	return ok && (access == grantRead || granted == grantWrite)
+}
+
+// key identifies the granted models, whatever the access level.
+func (g modelGrants) key() string {
+	models := make([]string, 0, len(g))
+	for model := range g {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	return strings.Join(models, ",")
+}
+
+// ungranted returns why the grants refuse the operation of a request body,
+// empty if every model it touches is granted: the model of each root field
+// at the access of its action, and the models reached through the
+// selections and the arguments. Arguments of mutations need write on their
+// models, except filters and orderings, so nested writes and connects need
+// write on the related model. Root fields that aren't of a model, like
+// raw queries, and introspection other than the introspection query are
+// refused.
+func (g modelGrants) ungranted(body []byte, schema *schemaCache) string {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return "the request has no query"
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return "the query could not be parsed, the model grants can't check it"
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 || !doc.OperationDefinitions[op].HasSelections {
+		return ""
+	}
+	root := "Query"
+	switch doc.OperationDefinitions[op].OperationType {
+	case ast.OperationTypeMutation:
+		root = "Mutation"
+	case ast.OperationTypeSubscription:
+		root = "Subscription"
+	}
+	models := make([]string, 0, len(schema.models))
+	for model := range schema.models {
+		models = append(models, model)
+	}
+	variables, _, _, _ := jsonparser.Get(body, "variables")
+	walk := &grantWalk{
+		grants:    g,
+		index:     schema.index,
+		models:    models,
+		doc:       &doc,
+		variables: variables,
+		mutation:  root == "Mutation",
+		visited:   map[string]bool{},
+	}
+	for _, ref := range doc.SelectionSets[doc.OperationDefinitions[op].SelectionSet].SelectionRefs {
+		if doc.Selections[ref].Kind != ast.SelectionKindField {
+			return "fragments on the root type can't be checked by the model grants"
+		}
+		name := doc.FieldNameString(doc.Selections[ref].Ref)
+		if name == "__typename" {
+			continue
+		}
+		if strings.HasPrefix(name, "__") {
+			return "only the IntrospectionQuery is answered to callers with model grants"
+		}
+		action, model := authAction(name)
+		if _, ok := schema.models[model]; action == "" || !ok {
+			return fmt.Sprintf("%s isn't an operation of a model, the model grants don't cover it", name)
+		}
+		access := grantWrite
+		if action == "read" {
+			access = grantRead
+		}
+		if !g.allows(model, access) {
+			return fmt.Sprintf("%s needs the grant %s:%s", name, model, access)
+		}
+	}
+	if missing := walk.selections(doc.OperationDefinitions[op].SelectionSet, root); missing != "" {
+		return "the operation needs the grant " + missing
+	}
+	return ""
+}
+
+// grantWalk looks for models not granted through the selections of an
+// operation, its fragments and the values of its arguments.
+type grantWalk struct {
+	grants    modelGrants
+	index     *schemaIndex
+	models    []string
+	doc       *ast.Document
+	variables []byte
+	mutation  bool
+	visited   map[string]bool
+}
+
+// touch returns the grant missing to reach the model of a type at the
+// access level, empty if there is none.
+func (w *grantWalk) touch(typeName, access string) string {
+	model := modelOf(typeName, w.models)
+	if model == "" || w.grants.allows(model, access) {
+		return ""
+	}
+	return model + ":" + access
+}
+
+// inputAccess is the access the arguments of the input type need.
+func (w *grantWalk) inputAccess(typeName string) string {
+	if !w.mutation || strings.Contains(typeName, "Where") || strings.Contains(typeName, "Filter") || strings.Contains(typeName, "OrderBy") {
+		return grantRead
+	}
+	return grantWrite
+}
+
+func (w *grantWalk) selections(set int, typeName string) string {
+	doc := w.doc
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			name := doc.FieldNameString(selection.Ref)
+			field, ok := w.index.fields[typeName][name]
+			if !ok {
+				continue
+			}
+			if missing := w.touch(field.typ, grantRead); missing != "" {
+				return missing
+			}
+			// the counts of _count are of the relations of the model
+			if strings.HasSuffix(typeName, "CountOutputType") {
+				if relation, ok := w.index.fields[modelOf(typeName, w.models)][name]; ok {
+					if missing := w.touch(relation.typ, grantRead); missing != "" {
+						return missing
+					}
+				}
+			}
+			for _, arg := range doc.Fields[selection.Ref].Arguments.Refs {
+				if argType, ok := field.args[doc.ArgumentNameString(arg)]; ok {
+					if missing := w.value(doc.ArgumentValue(arg), argType); missing != "" {
+						return missing
+					}
+				}
+			}
+			if doc.Fields[selection.Ref].HasSelections {
+				if missing := w.selections(doc.Fields[selection.Ref].SelectionSet, field.typ); missing != "" {
+					return missing
+				}
+			}
+		case ast.SelectionKindInlineFragment:
+			condition := typeName
+			if name := doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment := doc.InlineFragments[selection.Ref]; fragment.HasSelections {
+				if missing := w.selections(fragment.SelectionSet, condition); missing != "" {
+					return missing
+				}
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || w.visited[name] {
+					continue
+				}
+				w.visited[name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					if missing := w.selections(doc.FragmentDefinitions[i].SelectionSet, string(doc.FragmentDefinitionTypeName(i))); missing != "" {
+						return missing
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// value walks an argument value of the named type typeName.
+func (w *grantWalk) value(value ast.Value, typeName string) string {
+	doc := w.doc
+	if missing := w.touch(typeName, w.inputAccess(typeName)); missing != "" {
+		return missing
+	}
+	switch value.Kind {
+	case ast.ValueKindObject:
+		for _, ref := range doc.ObjectValues[value.Ref].Refs {
+			field, ok := w.index.fields[typeName][doc.ObjectFieldNameString(ref)]
+			if !ok {
+				continue
+			}
+			if missing := w.value(doc.ObjectFieldValue(ref), field.typ); missing != "" {
+				return missing
+			}
+		}
+	case ast.ValueKindList:
+		for _, ref := range doc.ListValues[value.Ref].Refs {
+			if missing := w.value(doc.Values[ref], typeName); missing != "" {
+				return missing
+			}
+		}
+	case ast.ValueKindVariable:
+		data, dataType, _, err := jsonparser.Get(w.variables, doc.VariableValueNameString(value.Ref))
+		if err == nil {
+			return w.variable(data, dataType, typeName)
+		}
+	}
+	return ""
+}
+
+// variable walks the JSON value of a variable passed as an argument of the
+// named type typeName.
+func (w *grantWalk) variable(data []byte, dataType jsonparser.ValueType, typeName string) string {
+	missing := w.touch(typeName, w.inputAccess(typeName))
+	if missing != "" {
+		return missing
+	}
+	switch dataType {
+	case jsonparser.Object:
+		_ = jsonparser.ObjectEach(data, func(key, value []byte, valueType jsonparser.ValueType, _ int) error {
+			if field, ok := w.index.fields[typeName][string(key)]; ok {
+				missing = w.variable(value, valueType, field.typ)
+			}
+			if missing != "" {
+				return errUngranted
+			}
+			return nil
+		})
+	case jsonparser.Array:
+		_, _ = jsonparser.ArrayEach(data, func(value []byte, valueType jsonparser.ValueType, _ int, _ error) {
+			if missing == "" {
+				missing = w.variable(value, valueType, typeName)
+			}
+		})
+	}
+	return missing
+}
+
+// errUngranted stops walking the keys of a variable.
+var errUngranted = fmt.Errorf("model not granted")
+
+// refuseUngranted answers 403 FORBIDDEN with writeErr, the error format of
+// the endpoint, to a request whose GraphQL body touches a model the caller
+// isn't granted.
+func (h *Handler) refuseUngranted(w http.ResponseWriter, r *http.Request, body []byte, grants modelGrants, writeErr func(http.ResponseWriter, int, string, string)) bool {
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("model grants", slog.String("error", err.Error()))
+		writeErr(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return true
+	}
+	missing := grants.ungranted(body, schema)
+	if missing == "" {
+		return false
+	}
+	h.sink.Count(metricModelGrantDenials, 1)
+	writeErr(w, http.StatusForbidden, "FORBIDDEN", missing)
+	return true
+}
+
+// grantedIntrospection returns the introspection response of the schema
+// pruned to the granted models, besides the hidden models and fields,
+// generated once per set of granted models.
+func (c *schemaCache) grantedIntrospection(grants modelGrants, hidden *visibility) ([]byte, error) {
+	key := grants.key()
+	if cached, ok := c.granted.Load(key); ok {
+		return cached.([]byte), nil
+	}
+	v := &visibility{models: map[string]bool{}, fields: map[string]map[string]bool{}}
+	if hidden != nil {
+		v.fields = hidden.fields
+	}
+	for model := range c.models {
+		if _, ok := grants[model]; !ok || hidden.hides(model, "") {
+			v.models[model] = true
+		}
+	}
+	pruned, err := v.prune(c.sdl)
+	if err != nil {
+		return nil, err
+	}
+	introspection, err := Introspect(pruned)
+	if err != nil {
+		return nil, err
+	}
+	c.granted.Store(key, introspection)
+	return introspection, nil
+}
+
+// introspection returns the introspection response served to the caller of
+// ctx, pruned to the models granted if it has model grants.
+func (h *Handler) introspection(ctx context.Context, schema *schemaCache) ([]byte, error) {
+	if grants := h.grants(ctx); grants != nil {
+		return schema.grantedIntrospection(grants, h.visibility)
+	}
+	return schema.introspection, nil
+}
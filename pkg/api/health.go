@@ -0,0 +1,265 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"wunderbase/pkg/buildinfo"
+)
+
+// Component states reported by the verbose health endpoint.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFailing  = "failing"
+)
+
+// HealthComponents lists the components the handler checks itself.
+var HealthComponents = []string{"http", "query_engine", "database", "sleep_mode"}
+
+// ComponentHealth is the state of one component in the verbose health
+// response.
+type ComponentHealth struct {
+	Status  string                 `json:"status"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// HealthCheck reports the state of a component.
+type HealthCheck func() ComponentHealth
+
+// healthResponse is served on <HealthEndpoint>?verbose=1.
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Build      *buildinfo.Info            `json:"build,omitempty"`
+	Components map[string]ComponentHealth `json:"components"`
+	// Required lists the components that must be ok for a 200 response.
+	Required []string `json:"required"`
+	// Peers are the other instances of the fleet by health url. They don't
+	// change the status of this one.
+	Peers map[string]PeerHealth `json:"peers,omitempty"`
+}
+
+// databaseSizeHealth is served on <HealthEndpoint> when the database size
+// is limited, the database component of the verbose response in short.
+type databaseSizeHealth struct {
+	Status      string  `json:"status"`
+	SizeBytes   int64   `json:"sizeBytes"`
+	LimitBytes  int64   `json:"limitBytes"`
+	UsedPercent float64 `json:"usedPercent"`
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	engine := h.probeEngine()
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); verbose {
+		h.serveVerboseHealth(w, engine)
+		return
+	}
+	if h.replicaStaleness != nil {
+		w.Header().Set(replicaStalenessHeader, strconv.FormatFloat(h.replicaStaleness().Seconds(), 'f', 1, 64))
+	}
+	if h.stopping() {
+		// out of rotation until the process exits
+		w.Header().Set("Retry-After", "1")
+		writeError(w, h.plainTextErrors, http.StatusServiceUnavailable, "STOPPING", "the instance is going to sleep")
+		return
+	}
+	if migrating, _ := h.gate.status(); migrating {
+		// out of rotation until the engine serves the migrated database
+		w.Header().Set("Retry-After", "1")
+		writeError(w, h.plainTextErrors, http.StatusServiceUnavailable, "MIGRATION_IN_PROGRESS", "the database is being migrated")
+		return
+	}
+	if failing, _, _ := h.storage.state(); failing {
+		// out of rotation until the database file is back
+		writeStorageUnavailable(w, h.plainTextErrors)
+		return
+	}
+	if engine.Status != HealthOK {
+		if h.plainTextErrors {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("query engine not reachable"))
+			return
+		}
+		writeGraphQLError(w, http.StatusInternalServerError, "ENGINE_UNAVAILABLE", "query engine not reachable")
+		return
+	}
+	h.writeDatabaseSizeHeaders(w)
+	if h.databaseSize.Limit() > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(databaseSizeHealth{
+			Status:      h.databaseHealth().Status,
+			SizeBytes:   h.databaseSize.Size(),
+			LimitBytes:  h.databaseSize.Limit(),
+			UsedPercent: math.Round(h.databaseSize.UsedRatio()*1000) / 10,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+func (h *Handler) serveVerboseHealth(w http.ResponseWriter, engine ComponentHealth) {
+	response, code := h.verboseHealth(engine)
+	h.writeDatabaseSizeHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// verboseHealth checks every component and returns the response with its
+// status code.
+func (h *Handler) verboseHealth(engine ComponentHealth) (healthResponse, int) {
+	components := map[string]ComponentHealth{
+		"http":         {Status: HealthOK},
+		"query_engine": engine,
+		"database":     h.storageHealth(h.databaseHealth()),
+		"sleep_mode":   h.sleepHealth(),
+	}
+	if migration, ok := h.migrationHealth(); ok {
+		components["migration"] = migration
+	}
+	if drift, ok := h.driftHealth(); ok {
+		components["schema_drift"] = drift
+	}
+	for name, check := range h.healthChecks {
+		if existing, ok := components[name]; ok {
+			components[name] = combineHealth(existing, check())
+		} else {
+			components[name] = check()
+		}
+	}
+
+	response := healthResponse{
+		Status:     HealthOK,
+		Build:      h.buildInfo,
+		Components: components,
+		Required:   h.requiredHealth,
+		Peers:      h.peers.check(),
+	}
+	code := http.StatusOK
+	for name, component := range components {
+		if worse(component.Status, response.Status) {
+			response.Status = component.Status
+		}
+		if component.Status != HealthOK && h.isRequired(name) {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	if migrating, _ := h.gate.status(); migrating {
+		// a live migration takes the instance out of rotation whatever is required
+		code = http.StatusServiceUnavailable
+	}
+	if failing, _, _ := h.storage.state(); failing {
+		// so does a failed volume
+		code = http.StatusServiceUnavailable
+	}
+	if h.stopping() {
+		// and going to sleep
+		code = http.StatusServiceUnavailable
+	}
+	return response, code
+}
+
+func (h *Handler) isRequired(name string) bool {
+	for _, required := range h.requiredHealth {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
+
+// probeEngine checks that the query engine answers. An engine stopped for
+// being idle is healthy, the next request starts it.
+func (h *Handler) probeEngine() ComponentHealth {
+	if h.engineStopped() {
+		return ComponentHealth{Status: HealthOK, Details: map[string]interface{}{"idle": true}}
+	}
+	start := time.Now()
+	resp, err := h.client.Get(h.queryEngineURL)
+	details := map[string]interface{}{
+		"lastProbe": start.UTC(),
+		"latencyMs": float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		details["error"] = err.Error()
+		return ComponentHealth{Status: HealthFailing, Details: details}
+	}
+	drain(resp)
+	if resp.StatusCode != http.StatusOK {
+		details["error"] = "unexpected status " + strconv.Itoa(resp.StatusCode)
+		return ComponentHealth{Status: HealthFailing, Details: details}
+	}
+	if atomic.LoadInt32(&h.warmingUp) == 1 {
+		details["error"] = "warming up"
+		return ComponentHealth{Status: HealthFailing, Details: details}
+	}
+	return ComponentHealth{Status: HealthOK, Details: details}
+}
+
+// databaseHealth degrades at 90% of the size limit and fails when writes are
+// rejected.
+func (h *Handler) databaseHealth() ComponentHealth {
+	health := ComponentHealth{Status: HealthOK, Details: map[string]interface{}{
+		"sizeBytes":  h.databaseSize.Size(),
+		"limitBytes": h.databaseSize.Limit(),
+	}}
+	switch ratio := h.databaseSize.UsedRatio(); {
+	case h.databaseSize.Full():
+		health.Status = HealthFailing
+	case ratio >= 0.9:
+		health.Status = HealthDegraded
+	}
+	return health
+}
+
+func (h *Handler) sleepHealth() ComponentHealth {
+	health := ComponentHealth{Status: HealthOK, Details: map[string]interface{}{"enabled": h.enableSleepMode}}
+	if !h.enableSleepMode {
+		return health
+	}
+	health.Details["sleepAfterSeconds"] = h.sleepAfter().Seconds()
+	if h.engineIdle != nil {
+		health.Details["engineIdleAfterSeconds"] = h.engineIdle.after.Seconds()
+		health.Details["engineStopped"] = h.engineStopped()
+	}
+	health.Details["resetOn"] = h.sleepResetOn
+	if h.stopping() {
+		health.Details["stopping"] = true
+	}
+	lastReset, started := h.sleep.state()
+	if lastReset != nil {
+		// what keeps the instance awake
+		health.Details["lastReset"] = lastReset
+	}
+	if started {
+		health.Details["sleepInSeconds"] = h.sleepIn().Seconds()
+	}
+	return health
+}
+
+// combineHealth merges two reports of the same component, keeping the worse
+// status.
+func combineHealth(a, b ComponentHealth) ComponentHealth {
+	combined := ComponentHealth{Status: a.Status, Details: map[string]interface{}{}}
+	if worse(b.Status, a.Status) {
+		combined.Status = b.Status
+	}
+	for k, v := range a.Details {
+		combined.Details[k] = v
+	}
+	for k, v := range b.Details {
+		combined.Details[k] = v
+	}
+	return combined
+}
+
+func worse(a, b string) bool {
+	rank := map[string]int{HealthOK: 0, HealthDegraded: 1, HealthFailing: 2}
+	return rank[a] > rank[b]
+}
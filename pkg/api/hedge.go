@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/tracing"
+)
+
+const (
+	// hedgeSamples is how many recent read durations the hedge delay is
+	// derived from, and how many are needed before reads are hedged.
+	hedgeSamples = 256
+	// hedgeRecompute is how many reads go by between recomputing the
+	// percentile.
+	hedgeRecompute = 32
+	minHedgeDelay  = time.Millisecond
+)
+
+// hedger decides when a read still waiting for the query engine is sent
+// again: after a fixed delay, or after the configured percentile of the
+// durations of recent reads.
+type hedger struct {
+	after      time.Duration
+	percentile float64
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	seen    int
+	derived time.Duration
+}
+
+func newHedger(enabled bool, after time.Duration, percentile float64) *hedger {
+	if !enabled {
+		return nil
+	}
+	return &hedger{after: after, percentile: percentile, samples: make([]time.Duration, 0, hedgeSamples)}
+}
+
+// delay returns how long a read waits before it is hedged, false while
+// too few reads were seen to derive it.
+func (hd *hedger) delay() (time.Duration, bool) {
+	if hd.after > 0 {
+		return hd.after, true
+	}
+	hd.mu.Lock()
+	defer hd.mu.Unlock()
+	return hd.derived, hd.derived > 0
+}
+
+// observe records the duration of an answered read.
+func (hd *hedger) observe(took time.Duration) {
+	if hd.after > 0 {
+		return
+	}
+	hd.mu.Lock()
+	defer hd.mu.Unlock()
+	if len(hd.samples) < hedgeSamples {
+		hd.samples = append(hd.samples, took)
+	} else {
+		hd.samples[hd.next] = took
+		hd.next = (hd.next + 1) % hedgeSamples
+	}
+	hd.seen++
+	if len(hd.samples) < hedgeSamples || hd.seen%hedgeRecompute != 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), hd.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	hd.derived = sorted[int(float64(len(sorted)-1)*hd.percentile/100)]
+	if hd.derived < minHedgeDelay {
+		hd.derived = minHedgeDelay
+	}
+}
+
+// engineResponse is an answer of the query engine read in full.
+type engineResponse struct {
+	resp *http.Response
+	data []byte
+	err  error
+	// hedge is set on the answer to the hedged copy
+	hedge bool
+	took  time.Duration
+}
+
+// roundTrip sends body to the query engine and reads the response.
+func (h *Handler) roundTrip(ctx context.Context, method string, body []byte) engineResponse {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, method, h.queryEngineURL, bytes.NewReader(body))
+	if err != nil {
+		return engineResponse{err: err}
+	}
+	// set the content type to application/json
+	req.Header.Set("content-type", "application/json")
+	trace, _ := tracing.FromContext(ctx)
+	req.Header.Set("traceparent", trace.Traceparent())
+	resp, err := h.doEngine(req)
+	if err != nil {
+		return engineResponse{err: err}
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return engineResponse{resp: resp, data: data, err: err, took: time.Since(start)}
+}
+
+// hedgedRoundTrip is roundTrip for reads: if the engine hasn't answered
+// after the hedge delay, the read is sent again, once it got past the read
+// limit like any read, and the first answer wins, canceling the other.
+func (h *Handler) hedgedRoundTrip(ctx context.Context, method string, body []byte) engineResponse {
+	delay, ok := h.hedge.delay()
+	if !ok {
+		answer := h.roundTrip(ctx, method, body)
+		if answer.err == nil {
+			h.hedge.observe(answer.took)
+		}
+		return answer
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	answers := make(chan engineResponse, 2)
+	go func() { answers <- h.roundTrip(ctx, method, body) }()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending, hedged := 1, false
+	for {
+		select {
+		case answer := <-answers:
+			pending--
+			if answer.err != nil && pending > 0 {
+				// the other copy may still answer
+				continue
+			}
+			if answer.err == nil {
+				h.hedge.observe(answer.took)
+			}
+			if hedged {
+				winner := "primary"
+				if answer.hedge {
+					winner = "hedge"
+				}
+				h.sink.Count(metricHedgedReads, 1, "winner", winner)
+			}
+			return answer
+		case <-timer.C:
+			pending, hedged = pending+1, true
+			go func() {
+				h.takeLimits(ctx, false)
+				answer := engineResponse{err: ctx.Err()}
+				if answer.err == nil {
+					answer = h.roundTrip(ctx, method, body)
+				}
+				answer.hedge = true
+				answers <- answer
+			}()
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/buger/jsonparser"
+	"golang.org/x/exp/slog"
+
+	"wunderbase/pkg/tracing"
+)
+
+// Whether the query engine delivers @defer and @stream incrementally, found
+// out by the first request using them.
+const (
+	incrementalUnknown int32 = iota
+	incrementalSupported
+	incrementalUnsupported
+)
+
+// acceptsMultipart reports whether the client accepts incremental delivery
+// as a multipart/mixed response.
+func acceptsMultipart(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "multipart/mixed" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIncremental passes a request using @defer or @stream through to the
+// query engine and streams its multipart response, flushing every part as
+// it arrives. Responses aren't re-encoded and get no extensions, neither
+// fits a multipart response. It reports whether the request was answered,
+// false if the engine doesn't know the directives or the request is a
+// mutation the journal must record: the caller strips them and serves a
+// normal response.
+func (h *Handler) serveIncremental(body []byte, w http.ResponseWriter, r *http.Request) bool {
+	if atomic.LoadInt32(&h.incremental) == incrementalUnsupported {
+		return false
+	}
+	write := bytes.Contains(body, []byte("mutation"))
+	if write && h.journal != nil {
+		// the journal needs the ids of the whole response
+		return false
+	}
+	if write {
+		release, err := h.enqueueWrite(r.Context())
+		if errors.Is(err, errWriteQueueTimeout) {
+			writeWriteQueueTimeout(w)
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		defer release()
+	}
+	leave, err := h.enterPool(r.Context())
+	if errors.Is(err, errEnginePoolTimeout) {
+		writeEnginePoolTimeout(w)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer leave()
+
+	logger := tracing.Logger(r.Context())
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, h.queryEngineURL, bytes.NewReader(body))
+	if err != nil {
+		logger.Error("create engine request", slog.String("error", err.Error()))
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", r.Header.Get("Accept"))
+	trace, _ := tracing.FromContext(r.Context())
+	req.Header.Set("traceparent", trace.Traceparent())
+	end := tracing.Begin(trace)
+	defer end()
+	// parts may arrive long after the first, the request timeout doesn't fit
+	resp, err := h.doEngineWith(&http.Client{Transport: h.client.Transport}, req)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine could not be reached")
+		return true
+	}
+	defer drain(resp)
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "multipart/mixed" {
+		atomic.StoreInt32(&h.incremental, incrementalSupported)
+		h.sink.Count(metricIncrementalRequests, 1, "delivery", "stream")
+		// the boundary is in the content type
+		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+		w.WriteHeader(resp.StatusCode)
+		flushParts(w, resp.Body)
+		return true
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("read engine response", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine response could not be read")
+		return true
+	}
+	atomic.StoreInt32(&h.incremental, incrementalUnsupported)
+	if bytes.HasPrefix(data, []byte(`{"errors"`)) && (bytes.Contains(data, []byte("defer")) || bytes.Contains(data, []byte("stream"))) {
+		// rejected for the directives, nothing was executed
+		return false
+	}
+	h.sink.Count(metricIncrementalRequests, 1, "delivery", "complete")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(data)
+	return true
+}
+
+// flushParts copies the body to w, flushing whatever arrived right away
+// instead of buffering until the final part.
+func flushParts(w http.ResponseWriter, body io.Reader) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stripIncrementalDirectives removes @defer and @stream from the query of
+// body, so an engine not knowing them serves the whole response at once. It
+// returns body unchanged if the query doesn't use them.
+func stripIncrementalDirectives(body []byte) []byte {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return body
+	}
+	stripped, found := stripDirectives(query, "defer", "stream")
+	if !found {
+		return body
+	}
+	value, _ := json.Marshal(stripped)
+	// Set may modify body in place
+	out, err := jsonparser.Set(append([]byte(nil), body...), value, "query")
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// usesIncrementalDirectives reports whether the query of body uses @defer or
+// @stream.
+func usesIncrementalDirectives(body []byte) bool {
+	if !bytes.Contains(body, []byte("@")) {
+		return false
+	}
+	query, _ := jsonparser.GetString(body, "query")
+	_, found := stripDirectives(query, "defer", "stream")
+	return found
+}
+
+// stripDirectives removes the directives named names, with their arguments,
+// from a GraphQL document. Strings and comments are left alone.
+func stripDirectives(s string, names ...string) (string, bool) {
+	var b strings.Builder
+	found := false
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '#':
+			end := strings.IndexAny(s[i:], "\r\n")
+			if end < 0 {
+				end = len(s) - i
+			}
+			b.WriteString(s[i : i+end])
+			i += end
+		case strings.HasPrefix(s[i:], `"""`), c == '"':
+			end := i + stringLength(s[i:])
+			b.WriteString(s[i:end])
+			i = end
+		case c == '@':
+			j := skipIgnored(s, i+1)
+			start := j
+			for j < len(s) && (s[j] == '_' || isLetter(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			if !contains(names, s[start:j]) {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+			found = true
+			if k := skipIgnored(s, j); k < len(s) && s[k] == '(' {
+				j = k + 1
+				for j < len(s) && s[j] != ')' {
+					if s[j] == '"' {
+						j += stringLength(s[j:])
+						continue
+					}
+					j++
+				}
+				j++
+			}
+			if j > len(s) {
+				j = len(s)
+			}
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), found
+}
+
+// stringLength is the length of the string or block string s starts with.
+func stringLength(s string) int {
+	if strings.HasPrefix(s, `"""`) {
+		end := strings.Index(s[3:], `"""`)
+		if end < 0 {
+			return len(s)
+		}
+		return 3 + end + 3
+	}
+	i := 1
+	for i < len(s) && s[i] != '"' && s[i] != '\n' {
+		if s[i] == '\\' {
+			i++
+		}
+		i++
+	}
+	if i < len(s) {
+		i++
+	}
+	if i > len(s) {
+		return len(s)
+	}
+	return i
+}
+
+// skipIgnored skips the whitespace and commas from i.
+func skipIgnored(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == ',') {
+		i++
+	}
+	return i
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// indexAdviceInterval is how often a fingerprint is explained at most,
+	// and how often the suggestions are logged
+	indexAdviceInterval = time.Hour
+	// indexAdviceMinRows is the size from which a scanned table deserves an
+	// index
+	indexAdviceMinRows = 1000
+	// maxLoggedRequests bounds the requests whose statements are kept until
+	// they are found slow or not
+	maxLoggedRequests = 256
+	// maxSuggestionFingerprints bounds the fingerprints listed by a
+	// suggestion
+	maxSuggestionFingerprints = 10
+)
+
+// loggedQuery is a statement the query engine logged for a request.
+type loggedQuery struct {
+	sql, params string
+}
+
+// loggedQueries are the statements of the latest requests by request ID,
+// shared by the handlers as the engines' output is.
+var loggedQueries = struct {
+	sync.Mutex
+	byRequest map[string][]loggedQuery
+	order     []string
+}{byRequest: map[string][]loggedQuery{}}
+
+// ObserveQuery records a statement the query engine ran for a request, for
+// the index advice. It is meant for queryengine.SetQueryObserver.
+func ObserveQuery(requestID, sql, params string) {
+	loggedQueries.Lock()
+	defer loggedQueries.Unlock()
+	if _, ok := loggedQueries.byRequest[requestID]; !ok {
+		if len(loggedQueries.order) >= maxLoggedRequests {
+			delete(loggedQueries.byRequest, loggedQueries.order[0])
+			loggedQueries.order = loggedQueries.order[1:]
+		}
+		loggedQueries.order = append(loggedQueries.order, requestID)
+	}
+	loggedQueries.byRequest[requestID] = append(loggedQueries.byRequest[requestID], loggedQuery{sql, params})
+}
+
+func takeLoggedQueries(requestID string) []loggedQuery {
+	loggedQueries.Lock()
+	defer loggedQueries.Unlock()
+	queries := loggedQueries.byRequest[requestID]
+	delete(loggedQueries.byRequest, requestID)
+	return queries
+}
+
+// indexSuggestion is a table slow queries scan, with the columns they
+// filter it by.
+type indexSuggestion struct {
+	Table        string    `json:"table"`
+	Columns      []string  `json:"columns,omitempty"`
+	Rows         int64     `json:"rows"`
+	Fingerprints []string  `json:"fingerprints"`
+	Suggestion   string    `json:"suggestion"`
+	LastSeen     time.Time `json:"lastSeen"`
+}
+
+// indexAdvisor explains the statements of slow requests and collects the
+// tables they scan.
+type indexAdvisor struct {
+	done chan struct{}
+
+	mu          sync.Mutex
+	explained   map[string]time.Time
+	suggestions map[string]*indexSuggestion
+}
+
+func newIndexAdvisor(enabled bool) *indexAdvisor {
+	if !enabled {
+		return nil
+	}
+	return &indexAdvisor{done: make(chan struct{}), explained: map[string]time.Time{}, suggestions: map[string]*indexSuggestion{}}
+}
+
+// due reports whether fingerprint may be explained, at most once an
+// interval, and records that it is.
+func (a *indexAdvisor) due(fingerprint string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last, ok := a.explained[fingerprint]; ok && now.Sub(last) < indexAdviceInterval {
+		return false
+	}
+	for fp, last := range a.explained {
+		if now.Sub(last) >= indexAdviceInterval {
+			delete(a.explained, fp)
+		}
+	}
+	a.explained[fingerprint] = now
+	return true
+}
+
+func (a *indexAdvisor) add(fingerprint, table string, columns []string, rows int64, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := table + "(" + strings.Join(columns, ",") + ")"
+	s, ok := a.suggestions[key]
+	if !ok {
+		s = &indexSuggestion{Table: table, Columns: columns}
+		a.suggestions[key] = s
+	}
+	s.Rows, s.LastSeen = rows, now.UTC()
+	if !containsString(s.Fingerprints, fingerprint) && len(s.Fingerprints) < maxSuggestionFingerprints {
+		s.Fingerprints = append(s.Fingerprints, fingerprint)
+	}
+	if len(columns) > 0 {
+		s.Suggestion = fmt.Sprintf("queries matching fingerprint %s scan %s.%s, consider @@index([%s])",
+			strings.Join(s.Fingerprints, ", "), table, strings.Join(columns, ", "), strings.Join(columns, ", "))
+	} else {
+		s.Suggestion = fmt.Sprintf("queries matching fingerprint %s scan %s without filtering it", strings.Join(s.Fingerprints, ", "), table)
+	}
+}
+
+// list returns the suggestions, most recent first.
+func (a *indexAdvisor) list() []indexSuggestion {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]indexSuggestion, 0, len(a.suggestions))
+	for _, s := range a.suggestions {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	return list
+}
+
+// adviseIndexes explains the statements of a slow request in the
+// background, unless its fingerprint was explained within the interval.
+func (h *Handler) adviseIndexes(fingerprint, requestID string) {
+	queries := takeLoggedQueries(requestID)
+	if len(queries) == 0 || !h.indexAdvice.due(fingerprint, time.Now()) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		rows := map[string]int64{}
+		for _, q := range queries {
+			if !strings.HasPrefix(strings.TrimSpace(q.sql), "SELECT") {
+				continue
+			}
+			tables, err := h.scannedTables(ctx, q)
+			if err != nil {
+				slog.Debug("Explaining a slow query", slog.String("fingerprint", fingerprint), slog.String("error", err.Error()))
+				return
+			}
+			for _, table := range tables {
+				n, ok := rows[table]
+				if !ok {
+					if n, err = h.countTable(ctx, table); err != nil {
+						slog.Debug("Counting a scanned table", slog.String("table", table), slog.String("error", err.Error()))
+						continue
+					}
+					rows[table] = n
+				}
+				if n >= indexAdviceMinRows {
+					h.indexAdvice.add(fingerprint, table, whereColumns(q.sql, table), n, time.Now())
+				}
+			}
+		}
+	}()
+}
+
+// scannedTables runs EXPLAIN QUERY PLAN for the statement and returns the
+// tables it reads in full.
+func (h *Handler) scannedTables(ctx context.Context, q loggedQuery) ([]string, error) {
+	rows, err := h.rawQuery(ctx, "EXPLAIN QUERY PLAN "+q.sql, q.params)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, row := range rows {
+		detail, _ := row["detail"].(string)
+		fields := strings.Fields(detail)
+		if len(fields) < 2 || fields[0] != "SCAN" || strings.Contains(detail, "USING") {
+			continue
+		}
+		table := fields[1]
+		if table == "TABLE" && len(fields) > 2 {
+			table = fields[2]
+		}
+		if table == "CONSTANT" || table == "SUBQUERY" || containsString(tables, table) {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func (h *Handler) countTable(ctx context.Context, table string) (int64, error) {
+	rows, err := h.rawQuery(ctx, `SELECT count(*) AS n FROM "`+strings.ReplaceAll(table, `"`, `""`)+`"`, "")
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 {
+		return 0, fmt.Errorf("count %s: %d rows", table, len(rows))
+	}
+	switch n := rows[0]["n"].(type) {
+	case float64:
+		return int64(n), nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	}
+	return 0, fmt.Errorf("count %s: unexpected value %v", table, rows[0]["n"])
+}
+
+// rawQuery runs sql with queryRaw and returns its rows by column, in the
+// array of objects older engines answer or the columns and rows of newer
+// ones, with typed values unwrapped.
+func (h *Handler) rawQuery(ctx context.Context, sql, params string) ([]map[string]interface{}, error) {
+	if params == "" {
+		params = "[]"
+	}
+	quotedSQL, _ := json.Marshal(sql)
+	quotedParams, _ := json.Marshal(params)
+	body, _ := json.Marshal(map[string]string{
+		"query": fmt.Sprintf("mutation { queryRaw(query: %s, parameters: %s) }", quotedSQL, quotedParams),
+	})
+	data, err := h.callEngine(ctx, body, false)
+	if err != nil {
+		return nil, err
+	}
+	if code := responseErrorCode(data); code != "" {
+		message, _ := jsonparser.GetString(data, "errors", "[0]", "error")
+		return nil, fmt.Errorf("queryRaw: %s %s", code, message)
+	}
+	raw, _, _, err := jsonparser.Get(data, "data", "queryRaw")
+	if err != nil {
+		return nil, fmt.Errorf("queryRaw: %w", err)
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		var table struct {
+			Columns []string        `json:"columns"`
+			Rows    [][]interface{} `json:"rows"`
+		}
+		if err := json.Unmarshal(raw, &table); err != nil {
+			return nil, fmt.Errorf("queryRaw: %w", err)
+		}
+		for _, values := range table.Rows {
+			row := map[string]interface{}{}
+			for i, column := range table.Columns {
+				if i < len(values) {
+					row[column] = values[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	for _, row := range rows {
+		for column, value := range row {
+			if typed, ok := value.(map[string]interface{}); ok {
+				row[column] = typed["prisma__value"]
+			}
+		}
+	}
+	return rows, nil
+}
+
+// whereColumns returns the columns of table the WHERE clause of sql filters
+// by, in order of appearance. Prisma quotes them as `main`.`Table`.`column`.
+func whereColumns(sql, table string) []string {
+	i := strings.Index(sql, " WHERE ")
+	if i < 0 {
+		return nil
+	}
+	where := sql[i:]
+	for _, clause := range []string{" GROUP BY ", " ORDER BY ", " LIMIT "} {
+		if j := strings.Index(where, clause); j >= 0 {
+			where = where[:j]
+		}
+	}
+	re := regexp.MustCompile("(?:[`\"]\\w+[`\"]\\.)?[`\"]" + regexp.QuoteMeta(table) + "[`\"]\\.[`\"](\\w+)[`\"]")
+	var columns []string
+	for _, match := range re.FindAllStringSubmatch(where, -1) {
+		if !containsString(columns, match[1]) {
+			columns = append(columns, match[1])
+		}
+	}
+	return columns
+}
+
+// runIndexAdvice logs the suggestions every interval, until the handler is
+// closed.
+func (h *Handler) runIndexAdvice() {
+	ticker := time.NewTicker(indexAdviceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.indexAdvice.done:
+			return
+		case <-ticker.C:
+		}
+		for _, s := range h.indexAdvice.list() {
+			slog.Info("Index advice", slog.String("table", s.Table), slog.String("columns", strings.Join(s.Columns, ",")),
+				slog.Int64("rows", s.Rows), slog.String("suggestion", s.Suggestion))
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"wunderbase/pkg/journal"
+
+	"github.com/buger/jsonparser"
+)
+
+// journalMutation appends a mutation of body the query engine answered
+// with data to the journal, unless the response has errors. It is called
+// before the write queue is released, so with a write queue the journal
+// has the order the mutations were made in.
+func (h *Handler) journalMutation(body, data []byte) {
+	if h.journal == nil {
+		return
+	}
+	if op, _ := parseOperation(body); op == nil || !op.isMutation() {
+		return
+	}
+	if _, _, _, err := jsonparser.Get(data, "errors"); err == nil {
+		return
+	}
+	entry := journal.Entry{Time: time.Now().UTC(), IDs: journal.IDs(data)}
+	entry.Query, _ = jsonparser.GetString(body, "query")
+	entry.OperationName, _ = jsonparser.GetString(body, "operationName")
+	if variables, dataType, _, err := jsonparser.Get(body, "variables"); err == nil && dataType == jsonparser.Object {
+		entry.Variables = append(json.RawMessage(nil), variables...)
+	}
+	if h.journal.Append(entry) {
+		h.sink.Count(metricJournalEntries, 1)
+	} else {
+		h.sink.Count(metricJournalDrops, 1)
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/report"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// limitSampleInterval and maxLimitSamples keep five minutes of the
+	// consumption of a limit to project when it's exhausted
+	limitSampleInterval = 10 * time.Second
+	maxLimitSamples     = 30
+)
+
+// limitWarnings warns when the consumption of a limit crosses one of the
+// thresholds: a WARN log line, a metric and, if enabled, an event to the
+// error reporter. Each threshold fires at most once per window of the
+// limit. Limits without a window fire again once the consumption dropped
+// below the threshold, like after a database shrank.
+type limitWarnings struct {
+	thresholds []float64
+	reporter   *report.Reporter
+	sink       MetricsSink
+
+	mu     sync.Mutex
+	limits map[string]*limitState
+}
+
+type limitState struct {
+	window time.Time
+	// fired is the number of thresholds crossed in the window
+	fired   int
+	samples []limitSample
+}
+
+type limitSample struct {
+	time time.Time
+	used float64
+}
+
+// newLimitWarnings returns nil without thresholds. reporter may be nil.
+func newLimitWarnings(thresholds []float64, reporter *report.Reporter, sink MetricsSink) *limitWarnings {
+	if len(thresholds) == 0 {
+		return nil
+	}
+	return &limitWarnings{thresholds: thresholds, reporter: reporter, sink: sink, limits: map[string]*limitState{}}
+}
+
+// observe records the consumption of limit in the window starting at
+// window, zero for limits without windows, and warns about the thresholds
+// it crossed.
+func (l *limitWarnings) observe(limit string, window time.Time, used, max float64) {
+	if l == nil || max <= 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	state := l.limits[limit]
+	if state == nil || !state.window.Equal(window) {
+		state = &limitState{window: window}
+		l.limits[limit] = state
+	}
+	if n := len(state.samples); n == 0 || now.Sub(state.samples[n-1].time) >= limitSampleInterval {
+		state.samples = append(state.samples, limitSample{time: now, used: used})
+		if len(state.samples) > maxLimitSamples {
+			state.samples = state.samples[1:]
+		}
+	}
+	crossed := 0
+	for crossed < len(l.thresholds) && used >= l.thresholds[crossed]*max {
+		crossed++
+	}
+	if crossed <= state.fired {
+		if window.IsZero() {
+			state.fired = crossed
+		}
+		l.mu.Unlock()
+		return
+	}
+	state.fired = crossed
+	exhaustedIn, projected := state.exhaustedIn(now, used, max)
+	l.mu.Unlock()
+
+	threshold := l.thresholds[crossed-1]
+	percent := strconv.FormatFloat(threshold*100, 'f', -1, 64)
+	l.sink.Count(metricLimitWarnings, 1, "limit", limit, "threshold", percent)
+	attrs := []slog.Attr{
+		slog.String("limit", limit),
+		slog.String("threshold", percent+"%"),
+		slog.Float64("used", used),
+		slog.Float64("max", max),
+	}
+	extra := map[string]string{
+		"limit":     limit,
+		"threshold": percent,
+		"used":      strconv.FormatFloat(used, 'f', -1, 64),
+		"max":       strconv.FormatFloat(max, 'f', -1, 64),
+	}
+	if projected {
+		attrs = append(attrs, slog.Duration("exhaustedIn", exhaustedIn))
+		extra["exhausted_in_seconds"] = strconv.FormatFloat(exhaustedIn.Seconds(), 'f', 0, 64)
+	}
+	slog.LogAttrs(context.Background(), slog.LevelWarn, "Limit nearly reached", attrs...)
+	l.reporter.Report(report.Event{
+		Type:    report.EventLimitWarning,
+		Level:   "warning",
+		Message: fmt.Sprintf("%s is at %s%% of its limit", limit, percent),
+		Extra:   extra,
+	})
+}
+
+// exhaustedIn projects when the limit is reached at the rate of the
+// samples. There is no projection without an increasing consumption.
+func (s *limitState) exhaustedIn(now time.Time, used, max float64) (time.Duration, bool) {
+	if len(s.samples) == 0 {
+		return 0, false
+	}
+	first := s.samples[0]
+	elapsed := now.Sub(first.time).Seconds()
+	if elapsed <= 0 || used <= first.used {
+		return 0, false
+	}
+	rate := (used - first.used) / elapsed
+	return time.Duration((max - used) / rate * float64(time.Second)), true
+}
+
+// rateWindow counts the requests of the current second, for warnings about
+// the rate limits.
+type rateWindow struct {
+	mu     sync.Mutex
+	second int64
+	count  int64
+}
+
+// add counts a request and returns the requests of the current second.
+func (w *rateWindow) add(now time.Time) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if second := now.Unix(); second != w.second {
+		w.second, w.count = second, 0
+	}
+	w.count++
+	return w.count
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/asttransform"
+	"github.com/wundergraph/graphql-go-tools/pkg/astvalidation"
+	"github.com/wundergraph/graphql-go-tools/pkg/operationreport"
+
+	"golang.org/x/exp/slog"
+)
+
+// lintListSize is the rows a list field without a take is assumed to
+// return when neither a default take nor a row limit bound it.
+const lintListSize = 100
+
+// LintRules are the rules of an endpoint operations are linted against,
+// and the depth and cost limits of the caller. The auth rules aren't
+// checked, they depend on the caller.
+type LintRules struct {
+	DisableIntrospection bool
+	DisableRawQueries    bool
+	SafeMutations        bool
+	ReadOnly             bool
+	HiddenModels         []string
+	HiddenFields         []string
+	SoftDeleteModels     []string
+	SoftDeleteField      string
+	// DefaultTake and MaxResultRows bound the list fields without a take
+	// in the cost, like they bound them when serving.
+	DefaultTake   int
+	MaxResultRows int
+	// MaxDepth and MaxCost are checked if positive.
+	MaxDepth int
+	MaxCost  int
+}
+
+// LintOperation is a GraphQL document as a client sends it.
+type LintOperation struct {
+	// ID identifies the document in a persisted operations manifest.
+	ID            string          `json:"id,omitempty"`
+	OperationName string          `json:"operationName,omitempty"`
+	Query         string          `json:"query"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+}
+
+// LintResult is the verdict on an operation of a document.
+type LintResult struct {
+	ID            string `json:"id,omitempty"`
+	OperationName string `json:"operationName,omitempty"`
+	// Valid reports whether the document parses and validates against the
+	// schema, Errors says why not.
+	Valid  bool        `json:"valid"`
+	Errors []LintError `json:"errors,omitempty"`
+	Depth  int         `json:"depth"`
+	Cost   int         `json:"cost"`
+	// OverLimits lists the limits depth and cost exceed.
+	OverLimits []string `json:"overLimits,omitempty"`
+	// Blocked lists the errors the endpoint would answer with.
+	Blocked []LintError `json:"blocked,omitempty"`
+	OK      bool        `json:"ok"`
+}
+
+// LintError is a problem of an operation: the stage failing, syntax or
+// schema, or for blocked operations the error code the endpoint answers
+// with.
+type LintError struct {
+	Stage   string `json:"stage,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// LintReport is the verdict on all operations, OK if every one is.
+type LintReport struct {
+	OK      bool         `json:"ok"`
+	Results []LintResult `json:"results"`
+}
+
+// ParseLintOperations reads the documents to lint: an array of queries or
+// of operations, a persisted operations manifest with operations[].body,
+// or an object of ids to queries.
+func ParseLintOperations(data []byte) ([]LintOperation, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("read documents: %w", err)
+		}
+		operations := make([]LintOperation, 0, len(raw))
+		for i, item := range raw {
+			var operation LintOperation
+			if err := json.Unmarshal(item, &operation.Query); err != nil {
+				if err := json.Unmarshal(item, &operation); err != nil {
+					return nil, fmt.Errorf("read document %d: %w", i, err)
+				}
+			}
+			if operation.Query == "" {
+				return nil, fmt.Errorf("read document %d: the query is empty", i)
+			}
+			operations = append(operations, operation)
+		}
+		return operations, nil
+	}
+	var manifest struct {
+		Operations []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			Body string `json:"body"`
+		} `json:"operations"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("read documents: expected an array of documents or a manifest: %w", err)
+	}
+	if manifest.Operations != nil {
+		operations := make([]LintOperation, 0, len(manifest.Operations))
+		for _, operation := range manifest.Operations {
+			operations = append(operations, LintOperation{ID: operation.ID, OperationName: operation.Name, Query: operation.Body})
+		}
+		return operations, nil
+	}
+	var byID map[string]string
+	if err := json.Unmarshal(data, &byID); err != nil {
+		return nil, fmt.Errorf("read documents: expected an array of documents or a manifest: %w", err)
+	}
+	operations := make([]LintOperation, 0, len(byID))
+	for id, query := range byID {
+		operations = append(operations, LintOperation{ID: id, Query: query})
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].ID < operations[j].ID })
+	return operations, nil
+}
+
+// serveLint lints the documents of the body, see ParseLintOperations,
+// against the schema served and the rules of the endpoint. The maxDepth and
+// maxCost parameters are the limits of the caller.
+func (h *Handler) serveLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+	rules := h.lintRules
+	for param, limit := range map[string]*int{"maxDepth": &rules.MaxDepth, "maxCost": &rules.MaxCost} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", param+" must be a non-negative integer")
+			return
+		}
+		*limit = n
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "the body could not be read")
+		return
+	}
+	operations, err := ParseLintOperations(body)
+	if err != nil {
+		writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("lint", slog.String("error", err.Error()))
+		writeError(w, h.plainTextErrors, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return
+	}
+	report, err := Lint(schema.sdl, operations, rules)
+	if err != nil {
+		tracing.Logger(r.Context()).Error("lint", slog.String("error", err.Error()))
+		writeError(w, h.plainTextErrors, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "internal server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// linter holds what linting needs of a schema.
+type linter struct {
+	rules      LintRules
+	definition ast.Document
+	fields     map[string]map[string]schemaField
+	listSize   int
+	// hidden is nil without hidden models and fields
+	hidden *hiddenSchema
+	// softDelete is nil without soft deleted models
+	softDelete *softDelete
+	index      schemaIndex
+}
+
+// Lint checks operations against the schema, the SDL the query engine
+// serves on /sdl, and rules without running them. A document with several
+// operations and no operation name gets a result per operation.
+func Lint(sdl []byte, operations []LintOperation, rules LintRules) (*LintReport, error) {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	l := &linter{rules: rules, fields: schemaFields(sdl), index: indexSchema(&doc)}
+	if l.definition, report = astparser.ParseGraphqlDocumentBytes(sdl); report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	if err := asttransform.MergeDefinitionWithBaseSchema(&l.definition); err != nil {
+		return nil, fmt.Errorf("parse sdl: %w", err)
+	}
+	switch {
+	case rules.DefaultTake > 0 && (rules.MaxResultRows <= 0 || rules.DefaultTake < rules.MaxResultRows):
+		l.listSize = rules.DefaultTake
+	case rules.MaxResultRows > 0:
+		l.listSize = rules.MaxResultRows
+	default:
+		l.listSize = lintListSize
+	}
+	if visibility := newVisibility(rules.HiddenModels, rules.HiddenFields); visibility != nil {
+		if err := visibility.check(sdl); err != nil {
+			return nil, err
+		}
+		pruned, err := visibility.prune(sdl)
+		if err != nil {
+			return nil, err
+		}
+		if l.hidden, err = newHiddenSchema(sdl, pruned); err != nil {
+			return nil, err
+		}
+	}
+	if l.softDelete = newSoftDelete(rules.SoftDeleteModels, rules.SoftDeleteField); l.softDelete != nil {
+		if err := l.softDelete.check(&l.index); err != nil {
+			return nil, err
+		}
+	}
+
+	lint := &LintReport{OK: true, Results: []LintResult{}}
+	for _, operation := range operations {
+		for _, result := range l.lint(operation) {
+			lint.OK = lint.OK && result.OK
+			lint.Results = append(lint.Results, result)
+		}
+	}
+	return lint, nil
+}
+
+func (l *linter) lint(operation LintOperation) []LintResult {
+	invalid := func(stage, message string) []LintResult {
+		return []LintResult{{ID: operation.ID, OperationName: operation.OperationName, Errors: []LintError{{Stage: stage, Message: message}}}}
+	}
+	doc, report := astparser.ParseGraphqlDocumentString(operation.Query)
+	if report.HasErrors() {
+		return invalid("syntax", report.Error())
+	}
+	var names []string
+	for i := range doc.OperationDefinitions {
+		name := doc.OperationDefinitionNameString(i)
+		if operation.OperationName == "" || name == operation.OperationName {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return invalid("syntax", fmt.Sprintf("operation %q not found", operation.OperationName))
+	}
+	var schemaErrors []LintError
+	astvalidation.DefaultOperationValidator().Validate(&doc, &l.definition, &report)
+	for _, message := range lintMessages(report) {
+		schemaErrors = append(schemaErrors, LintError{Stage: "schema", Message: message})
+	}
+
+	variables := operation.Variables
+	if len(variables) == 0 {
+		variables = json.RawMessage("{}")
+	}
+	var results []LintResult
+	for _, name := range names {
+		result := LintResult{ID: operation.ID, OperationName: name, Valid: len(schemaErrors) == 0, Errors: schemaErrors}
+		op := selectOperation(&doc, name)
+		if doc.OperationDefinitions[op].HasSelections {
+			walk := &lintWalk{doc: &doc, fields: l.fields, variables: variables, listSize: l.listSize, visited: map[string]bool{}}
+			root := map[ast.OperationType]string{ast.OperationTypeQuery: "Query", ast.OperationTypeMutation: "Mutation", ast.OperationTypeSubscription: "Subscription"}
+			result.Depth, result.Cost = walk.selections(doc.OperationDefinitions[op].SelectionSet, root[doc.OperationDefinitions[op].OperationType], 0, 1)
+		}
+		if l.rules.MaxDepth > 0 && result.Depth > l.rules.MaxDepth {
+			result.OverLimits = append(result.OverLimits, fmt.Sprintf("depth %d exceeds %d", result.Depth, l.rules.MaxDepth))
+		}
+		if l.rules.MaxCost > 0 && result.Cost > l.rules.MaxCost {
+			result.OverLimits = append(result.OverLimits, fmt.Sprintf("cost %d exceeds %d", result.Cost, l.rules.MaxCost))
+		}
+		body, _ := json.Marshal(map[string]interface{}{"query": operation.Query, "operationName": name, "variables": variables})
+		result.Blocked = l.blocked(body, &doc, op)
+		result.OK = result.Valid && len(result.OverLimits) == 0 && len(result.Blocked) == 0
+		results = append(results, result)
+	}
+	return results
+}
+
+// blocked returns the errors the endpoint answers the operation op of doc
+// with, checked in the order the endpoint checks them.
+func (l *linter) blocked(body []byte, doc *ast.Document, op int) []LintError {
+	var blocked []LintError
+	block := func(code, message string) {
+		blocked = append(blocked, LintError{Code: code, Message: message})
+	}
+	if bytes.Contains(body, []byte("IntrospectionQuery")) {
+		// answered from the SDL
+		if l.rules.DisableIntrospection {
+			block("INTROSPECTION_DISABLED", "introspection is disabled on this endpoint")
+		}
+		return blocked
+	}
+	mutation := doc.OperationDefinitions[op].OperationType == ast.OperationTypeMutation
+	if mutation && l.rules.ReadOnly {
+		block("READ_ONLY", "this instance is a read replica, send mutations to the primary")
+	}
+	if l.hidden != nil {
+		if introspects(body) {
+			block("FORBIDDEN_FIELD", "only the IntrospectionQuery is answered while models or fields are hidden")
+		} else if touched := l.hidden.touches(body); touched != "" {
+			block("FORBIDDEN_FIELD", fmt.Sprintf("%s is not exposed by this API", touched))
+		}
+	}
+	if l.rules.DisableIntrospection && introspects(body) {
+		block("INTROSPECTION_DISABLED", "introspection is disabled on this endpoint")
+	}
+	parsed, err := parseOperation(body)
+	if err != nil {
+		return blocked
+	}
+	if l.rules.DisableRawQueries && parsed.runsRaw() {
+		block("RAW_QUERIES_DISABLED", "raw queries are disabled on this endpoint")
+	}
+	if l.rules.SafeMutations && mutation {
+		if fields := dangerousMutations(withVariablesSent(body, doc, op)); len(fields) > 0 {
+			block("DANGEROUS_MUTATION_BLOCKED", strings.Join(fields, ", ")+" without a where argument changes every row")
+		}
+	}
+	if l.softDelete != nil {
+		var refused *softDeleteError
+		if _, err := l.softDelete.rewrite(body, &l.index, time.Now()); errors.As(err, &refused) {
+			block("FORBIDDEN", refused.Error())
+		}
+	}
+	return blocked
+}
+
+// withVariablesSent gives the variables of op the document comes without a
+// placeholder value, so a where passed in a variable counts as sent: the
+// document alone doesn't tell it matches every row.
+func withVariablesSent(body []byte, doc *ast.Document, op int) []byte {
+	for _, ref := range doc.OperationDefinitions[op].VariableDefinitions.Refs {
+		name := doc.VariableDefinitionNameString(ref)
+		if _, _, _, err := jsonparser.Get(body, "variables", name); err == jsonparser.KeyPathNotFoundError && !doc.VariableDefinitions[ref].DefaultValue.IsDefined {
+			body, _ = jsonparser.Set(body, []byte("true"), "variables", name)
+		}
+	}
+	return body
+}
+
+// lintMessages returns the messages of the errors of report.
+func lintMessages(report operationreport.Report) []string {
+	var messages []string
+	for _, err := range report.ExternalErrors {
+		messages = append(messages, err.Message)
+	}
+	for _, err := range report.InternalErrors {
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
+
+// lintWalk measures the selections of an operation: the depth of the
+// deepest field, and the cost, the fields the response may hold, each
+// counted once per row of the lists it is nested in.
+type lintWalk struct {
+	doc       *ast.Document
+	fields    map[string]map[string]schemaField
+	variables []byte
+	listSize  int
+	visited   map[string]bool
+}
+
+func (w *lintWalk) selections(set int, typeName string, depth, rows int) (maxDepth, cost int) {
+	add := func(d, c int) {
+		if d > maxDepth {
+			maxDepth = d
+		}
+		cost = saturatingAdd(cost, c)
+	}
+	for _, ref := range w.doc.SelectionSets[set].SelectionRefs {
+		selection := w.doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			name := w.doc.FieldNameString(selection.Ref)
+			if strings.HasPrefix(name, "__") {
+				continue
+			}
+			add(depth+1, rows)
+			field := w.doc.Fields[selection.Ref]
+			if !field.HasSelections {
+				continue
+			}
+			def := w.fields[typeName][name]
+			nested := rows
+			if def.list {
+				nested = saturatingMul(rows, w.take(selection.Ref))
+			}
+			add(w.selections(field.SelectionSet, def.typ, depth+1, nested))
+		case ast.SelectionKindInlineFragment:
+			fragment := w.doc.InlineFragments[selection.Ref]
+			condition := typeName
+			if name := w.doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment.HasSelections {
+				add(w.selections(fragment.SelectionSet, condition, depth, rows))
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := w.doc.FragmentSpreadNameString(selection.Ref)
+			for i := range w.doc.FragmentDefinitions {
+				if w.doc.FragmentDefinitionNameString(i) != name || w.visited[name] || !w.doc.FragmentDefinitions[i].HasSelections {
+					continue
+				}
+				// a fragment spreading itself is a schema error, not a cost
+				w.visited[name] = true
+				add(w.selections(w.doc.FragmentDefinitions[i].SelectionSet, string(w.doc.FragmentDefinitionTypeName(i)), depth, rows))
+				delete(w.visited, name)
+			}
+		}
+	}
+	return maxDepth, cost
+}
+
+// take returns the rows a list field returns at most: its take, inline or
+// in the variables, or the list size.
+func (w *lintWalk) take(field int) int {
+	arg, ok := fieldArgument(w.doc, field, "take")
+	if !ok {
+		return w.listSize
+	}
+	value := w.doc.Arguments[arg].Value
+	var take int64
+	switch value.Kind {
+	case ast.ValueKindInteger:
+		take = w.doc.IntValueAsInt(value.Ref)
+	case ast.ValueKindVariable:
+		var err error
+		if take, err = jsonparser.GetInt(w.variables, w.doc.VariableValueNameString(value.Ref)); err != nil {
+			return w.listSize
+		}
+	default:
+		return w.listSize
+	}
+	if take < 0 {
+		// a negative take counts from the end
+		take = -take
+	}
+	if take > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(take)
+}
+
+func saturatingAdd(a, b int) int {
+	if a > math.MaxInt32-b {
+		return math.MaxInt32
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if b != 0 && a > math.MaxInt32/b {
+		return math.MaxInt32
+	}
+	return a * b
+}
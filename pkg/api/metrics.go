@@ -0,0 +1,309 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+
+	"wunderbase/pkg/metrics"
+)
+
+// MetricsSink receives the metrics emitted by the handler. Tags are
+// alternating keys and values, always passed in the order of the metric's
+// labels. Implementations must not block.
+type MetricsSink interface {
+	Count(name string, value float64, tags ...string)
+	Observe(name string, value float64, tags ...string)
+}
+
+const (
+	metricRequests        = "wunderbase_requests_total"
+	metricRequestErrors   = "wunderbase_request_errors_total"
+	metricRequestDuration = "wunderbase_request_duration_seconds"
+	metricDatabaseFull    = "wunderbase_database_full_rejections_total"
+	metricDatabaseBusy    = "wunderbase_database_busy_total"
+	metricSleepEvents     = "wunderbase_sleep_events_total"
+	// metricRateLimitWaits and metricRateLimitWaitSeconds count requests
+	// held back by the read or write limit
+	metricRateLimitWaits       = "wunderbase_rate_limit_waits_total"
+	metricRateLimitWaitSeconds = "wunderbase_rate_limit_wait_seconds_total"
+	// metricResultRowsCapped counts queries whose take arguments were
+	// lowered or added by the row limit
+	metricResultRowsCapped = "wunderbase_result_rows_capped_total"
+	// metricDefaultTakes counts queries a default take was added to
+	metricDefaultTakes = "wunderbase_default_takes_total"
+	// metricEngineConnections counts the connections to the query engine
+	// requests got, by whether they were reused
+	metricEngineConnections = "wunderbase_engine_connections_total"
+	// metricEngineConnectRetries counts requests sent again because the
+	// query engine refused the connection
+	metricEngineConnectRetries = "wunderbase_engine_connect_retries_total"
+	// metricIncrementalRequests counts requests using @defer or @stream, by
+	// whether the engine streamed the response or answered it at once
+	metricIncrementalRequests = "wunderbase_incremental_requests_total"
+	// metricLimitWarnings counts the warnings about limits nearly reached,
+	// by limit and threshold percentage
+	metricLimitWarnings = "wunderbase_limit_warnings_total"
+	// metricRowFilterRejections counts GraphQL requests refused because the
+	// row filters couldn't restrict them
+	metricRowFilterRejections = "wunderbase_row_filter_rejections_total"
+	// metricOperationLimitOverrides counts requests served under an
+	// operation limit override, by the configured operation
+	metricOperationLimitOverrides = "wunderbase_operation_limit_overrides_total"
+	// metricUploadedFiles counts the files of GraphQL multipart requests
+	metricUploadedFiles = "wunderbase_uploaded_files_total"
+	// metricAuthRuleDenials counts requests refused by the auth rules
+	metricAuthRuleDenials = "wunderbase_auth_rule_denials_total"
+	// metricInvalidOperationNames counts requests refused for an
+	// operationName that isn't a GraphQL name
+	metricInvalidOperationNames = "wunderbase_invalid_operation_names_total"
+	// metricSLOBurnAlerts counts the SLOs found burning their latency
+	// budget, by operation
+	metricSLOBurnAlerts = "wunderbase_slo_burn_alerts_total"
+	// metricModelGrantDenials counts requests refused for touching a model
+	// the caller isn't granted
+	metricModelGrantDenials = "wunderbase_model_grant_denials_total"
+	// metricEngineIdleEvents counts the query engine stopped for being
+	// idle and started again, by event
+	metricEngineIdleEvents = "wunderbase_engine_idle_events_total"
+	// metricTimeoutHints counts the timeout hints of clients, by whether
+	// they were applied, capped by the request timeout or invalid
+	metricTimeoutHints = "wunderbase_timeout_hints_total"
+	// metricGraphQLErrors counts GraphQL responses by the code of their
+	// first error, HTTP_<status> for failures without one
+	metricGraphQLErrors = "wunderbase_graphql_errors_total"
+	// metricDangerousMutations counts mutations refused for changing every
+	// row of a model
+	metricDangerousMutations = "wunderbase_dangerous_mutations_blocked_total"
+	// metricStartingRejections counts requests turned away because the
+	// query engine didn't answer within the request timeout after start
+	metricStartingRejections = "wunderbase_starting_rejections_total"
+	// metricStoppingRejections counts requests turned away during the
+	// pre-stop delay before sleeping
+	metricStoppingRejections = "wunderbase_stopping_rejections_total"
+	// metricHiddenFieldRejections counts requests refused for touching a
+	// hidden model or field
+	metricHiddenFieldRejections = "wunderbase_hidden_field_rejections_total"
+	// metricWriteQueueWaitSeconds and metricWriteQueueTimeouts are the
+	// time writes waited for the write queue and the writes that gave up
+	metricWriteQueueWaitSeconds = "wunderbase_write_queue_wait_seconds"
+	metricWriteQueueTimeouts    = "wunderbase_write_queue_timeouts_total"
+	// metricEnginePoolRequests, metricEnginePoolWaitSeconds,
+	// metricEnginePoolSeconds and metricEnginePoolTimeouts are by engine
+	// pool the requests sent to the query engine, the time they waited for
+	// a slot and held it, and those that gave up waiting
+	metricEnginePoolRequests    = "wunderbase_engine_pool_requests_total"
+	metricEnginePoolWaitSeconds = "wunderbase_engine_pool_wait_seconds"
+	metricEnginePoolSeconds     = "wunderbase_engine_pool_request_duration_seconds"
+	metricEnginePoolTimeouts    = "wunderbase_engine_pool_timeouts_total"
+	// metricPriorityRefusals counts the requests asking for the priority
+	// pool without a priority scope, served by the general pool
+	metricPriorityRefusals = "wunderbase_priority_refusals_total"
+	// metricJournalEntries and metricJournalDrops count the mutations
+	// queued for the mutation journal and those dropped from a full buffer
+	metricJournalEntries = "wunderbase_journal_entries_total"
+	metricJournalDrops   = "wunderbase_journal_drops_total"
+	// metricExcludedRequests counts the requests left out of the access
+	// log or the request metrics
+	metricExcludedRequests = "wunderbase_excluded_requests_total"
+	// metricSoftDeleteRejections counts GraphQL requests refused because
+	// the soft deletes couldn't rewrite them, metricIncludeDeleted those
+	// run as written for an admin
+	metricSoftDeleteRejections = "wunderbase_soft_delete_rejections_total"
+	metricIncludeDeleted       = "wunderbase_include_deleted_total"
+	// metricHedgedReads counts the reads sent again for being slow, by
+	// which copy answered first
+	metricHedgedReads = "wunderbase_hedged_reads_total"
+	// metricReadCoalescing counts the GraphQL reads by whether they shared
+	// the answer of an identical read in flight
+	metricReadCoalescing = "wunderbase_read_coalescing_total"
+	// metricTimeTravelReads counts the time-travel reads by result
+	metricTimeTravelReads = "wunderbase_time_travel_reads_total"
+	// metricCountRequests counts the requests of /count/ and /exists/ by
+	// kind and whether the cache answered them
+	metricCountRequests = "wunderbase_count_requests_total"
+	// metricStorageFailures counts the failures of the database storage
+	// that took the instance out of rotation
+	metricStorageFailures = "wunderbase_storage_failures_total"
+	metricKindCounter     = "counter"
+	metricKindHistogram   = "histogram"
+)
+
+// handlerMetrics are the metrics the handler emits to every sink.
+var handlerMetrics = []struct {
+	name, kind, help string
+	labels           []string
+}{
+	{metricRequests, metricKindCounter, "GraphQL requests by operation type and status code.", []string{"type", "code"}},
+	{metricRequestErrors, metricKindCounter, "GraphQL requests answered with a server error.", []string{"type"}},
+	{metricRequestDuration, metricKindHistogram, "Duration of GraphQL requests in seconds.", []string{"type"}},
+	{metricDatabaseFull, metricKindCounter, "Mutations rejected because the database reached MAX_DATABASE_SIZE_MB.", nil},
+	{metricDatabaseBusy, metricKindCounter, "GraphQL requests that found the database locked by another write.", nil},
+	{metricSleepEvents, metricKindCounter, "Times the server went to sleep after being idle.", nil},
+	{metricRateLimitWaits, metricKindCounter, "Requests that waited for the read or write limit.", []string{"limit"}},
+	{metricRateLimitWaitSeconds, metricKindCounter, "Seconds requests waited for the read or write limit.", []string{"limit"}},
+	{metricResultRowsCapped, metricKindCounter, "Queries whose list fields were capped by the result row limit.", nil},
+	{metricDefaultTakes, metricKindCounter, "Queries whose unbounded list fields got the default take.", nil},
+	{metricEngineConnections, metricKindCounter, "Connections to the query engine taken by requests, new or reused.", []string{"reused"}},
+	{metricEngineConnectRetries, metricKindCounter, "Requests sent again because the query engine refused the connection.", nil},
+	{metricIncrementalRequests, metricKindCounter, "Requests using @defer or @stream, by whether the response was streamed.", []string{"delivery"}},
+	{metricLimitWarnings, metricKindCounter, "Warnings about a quota, rate limit or the database size limit nearly reached.", []string{"limit", "threshold"}},
+	{metricRowFilterRejections, metricKindCounter, "GraphQL requests refused because the row filters couldn't restrict them.", nil},
+	{metricOperationLimitOverrides, metricKindCounter, "Requests served under an operation limit override or exemption.", []string{"operation", "override"}},
+	{metricUploadedFiles, metricKindCounter, "Files uploaded to Bytes fields with GraphQL multipart requests.", nil},
+	{metricAuthRuleDenials, metricKindCounter, "Requests refused by the auth rules.", nil},
+	{metricInvalidOperationNames, metricKindCounter, "GraphQL requests refused because their operationName isn't a GraphQL name.", nil},
+	{metricSLOBurnAlerts, metricKindCounter, "Times an SLO started burning its latency budget faster than WUNDERBASE_SLO_BURN_RATE.", []string{"operation"}},
+	{metricModelGrantDenials, metricKindCounter, "Requests refused for touching a model the model grants of the caller don't cover.", nil},
+	{metricEngineIdleEvents, metricKindCounter, "Query engine stops after WUNDERBASE_ENGINE_IDLE_SECONDS and starts by the next request.", []string{"event"}},
+	{metricTimeoutHints, metricKindCounter, "Client timeout hints by result: applied, capped by WUNDERBASE_REQUEST_TIMEOUT_MS or invalid.", []string{"result"}},
+	{metricGraphQLErrors, metricKindCounter, "GraphQL responses with errors by the code of the first error, also with status 200.", []string{"code"}},
+	{metricDangerousMutations, metricKindCounter, "deleteMany and updateMany mutations without a where refused by WUNDERBASE_SAFE_MUTATIONS.", nil},
+	{metricStartingRejections, metricKindCounter, "Requests refused with 503 because the query engine hadn't answered yet after start.", nil},
+	{metricStoppingRejections, metricKindCounter, "Requests refused with 503 during WUNDERBASE_SLEEP_PRE_STOP_MS before going to sleep.", nil},
+	{metricStorageFailures, metricKindCounter, "Database storage failures, I/O errors of the query engine or the database file failing to stat.", nil},
+	{metricWriteQueueWaitSeconds, metricKindHistogram, "Seconds writes waited for their turn in the write queue.", nil},
+	{metricWriteQueueTimeouts, metricKindCounter, "Writes refused after waiting WUNDERBASE_WRITE_QUEUE_TIMEOUT_MS for the write queue.", nil},
+	{metricEnginePoolRequests, metricKindCounter, "Requests sent to the query engine by engine pool, general or priority.", []string{"pool"}},
+	{metricEnginePoolWaitSeconds, metricKindHistogram, "Seconds requests waited for a slot of their engine pool.", []string{"pool"}},
+	{metricEnginePoolSeconds, metricKindHistogram, "Seconds requests held a slot of their engine pool, their time in the query engine.", []string{"pool"}},
+	{metricEnginePoolTimeouts, metricKindCounter, "Requests refused after waiting WUNDERBASE_ENGINE_QUEUE_TIMEOUT_MS for a slot of their engine pool.", []string{"pool"}},
+	{metricPriorityRefusals, metricKindCounter, "Requests asking for the priority pool without a scope of WUNDERBASE_PRIORITY_SCOPES, served by the general pool.", nil},
+	{metricJournalEntries, metricKindCounter, "Mutations queued for the mutation journal.", nil},
+	{metricJournalDrops, metricKindCounter, "Mutations left out of the mutation journal because its buffer was full, recorded as a gap.", nil},
+	{metricExcludedRequests, metricKindCounter, "Requests left out of the access log or the request metrics by the exclusion rules.", nil},
+	{metricHiddenFieldRejections, metricKindCounter, "GraphQL requests refused for touching a model or field hidden by WUNDERBASE_HIDDEN_MODELS or WUNDERBASE_HIDDEN_FIELDS.", nil},
+	{metricSoftDeleteRejections, metricKindCounter, "GraphQL requests refused because they couldn't be rewritten for the soft deletes.", nil},
+	{metricIncludeDeleted, metricKindCounter, "GraphQL requests run with the soft deleted rows for a caller with the admin scope.", nil},
+	{metricHedgedReads, metricKindCounter, "Reads sent again because the query engine hadn't answered them after the hedge delay, by the copy answering first: primary or hedge.", []string{"winner"}},
+	{metricReadCoalescing, metricKindCounter, "GraphQL reads by result: executed by the query engine, shared from an identical read in flight, or overflow when WUNDERBASE_COALESCE_MAX_WAITERS waited for that one already.", []string{"result"}},
+	{metricTimeTravelReads, metricKindCounter, "Time-travel reads by result: served, no_snapshot, busy or failed.", []string{"result"}},
+	{metricCountRequests, metricKindCounter, "Requests of /count/ and /exists/ by kind, count or exists, and cache, hit or miss.", []string{"kind", "cache"}},
+}
+
+var requestDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// registrySink exposes the handler metrics through the Prometheus registry.
+type registrySink struct {
+	counters   map[string]*metrics.CounterVec
+	histograms map[string]*metrics.HistogramVec
+}
+
+// newRegistrySink registers the handler metrics. labels are prepended to the
+// labels of every metric.
+func newRegistrySink(registry *metrics.Registry, labels ...string) *registrySink {
+	s := &registrySink{
+		counters:   map[string]*metrics.CounterVec{},
+		histograms: map[string]*metrics.HistogramVec{},
+	}
+	for _, m := range handlerMetrics {
+		metricLabels := append(append([]string(nil), labels...), m.labels...)
+		switch m.kind {
+		case metricKindCounter:
+			s.counters[m.name] = registry.Counter(m.name, m.help, metricLabels...)
+		case metricKindHistogram:
+			s.histograms[m.name] = registry.Histogram(m.name, m.help, requestDurationBuckets, metricLabels...)
+		}
+	}
+	return s
+}
+
+func (s *registrySink) Count(name string, value float64, tags ...string) {
+	if c, ok := s.counters[name]; ok {
+		c.With(tagValues(tags)...).Add(value)
+	}
+}
+
+func (s *registrySink) Observe(name string, value float64, tags ...string) {
+	if h, ok := s.histograms[name]; ok {
+		h.With(tagValues(tags)...).Observe(value)
+	}
+}
+
+func tagValues(tags []string) []string {
+	values := make([]string, 0, len(tags)/2)
+	for i := 1; i < len(tags); i += 2 {
+		values = append(values, tags[i])
+	}
+	return values
+}
+
+// multiSink fans metrics out to several sinks.
+type multiSink []MetricsSink
+
+func (m multiSink) Count(name string, value float64, tags ...string) {
+	for _, s := range m {
+		s.Count(name, value, tags...)
+	}
+}
+
+func (m multiSink) Observe(name string, value float64, tags ...string) {
+	for _, s := range m {
+		s.Observe(name, value, tags...)
+	}
+}
+
+// databaseSink tags the metrics of a database served by a Router.
+type databaseSink struct {
+	name string
+	next MetricsSink
+}
+
+func (s databaseSink) Count(name string, value float64, tags ...string) {
+	s.next.Count(name, value, append([]string{"database", s.name}, tags...)...)
+}
+
+func (s databaseSink) Observe(name string, value float64, tags ...string) {
+	s.next.Observe(name, value, append([]string{"database", s.name}, tags...)...)
+}
+
+// statusRecorder remembers the status code written by the handler and, for
+// the recent requests, the code of the first GraphQL error.
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	errorCode string
+	// captureErrors looks for the error code in the first write
+	captureErrors bool
+	written       bool
+	// flushed is set once the response was streamed
+	flushed bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.captureErrors && !r.written && bytes.Contains(b, []byte(`"error`)) {
+		r.errorCode = responseErrorCode(b)
+	}
+	r.written = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	r.flushed = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (h *Handler) recordRequest(ctx context.Context, kind string, status int, seconds float64) {
+	if excluded(ctx, excludeMetrics) {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	h.sink.Count(metricRequests, 1, "type", kind, "code", strconv.Itoa(status))
+	h.sink.Observe(metricRequestDuration, seconds, "type", kind)
+	if status >= 500 {
+		h.sink.Count(metricRequestErrors, 1, "type", kind)
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"wunderbase/pkg/migrate"
+)
+
+// migrationDrainWait bounds how long a migration waits for the requests in
+// flight before giving up.
+const migrationDrainWait = 30 * time.Second
+
+// migrationGate keeps requests away from the query engine while the schema
+// is migrated: a migration closes it, waits for the requests in flight and
+// opens it again once the engine serves the migrated database.
+type migrationGate struct {
+	mu        sync.Mutex
+	migrating bool
+	inFlight  int
+	// opened is closed when the gate opens, drained when the last request
+	// in flight left a closed gate
+	opened  chan struct{}
+	drained chan struct{}
+	// failed is the error of the latest migration the engine rejected
+	failed *migrate.Error
+}
+
+// enter admits a request, waiting up to wait for a migration to finish. It
+// reports whether the request may proceed, leave must follow if so.
+func (g *migrationGate) enter(ctx context.Context, wait time.Duration) bool {
+	var timeout <-chan time.Time
+	for {
+		g.mu.Lock()
+		if !g.migrating {
+			g.inFlight++
+			g.mu.Unlock()
+			return true
+		}
+		opened := g.opened
+		g.mu.Unlock()
+		if wait <= 0 {
+			return false
+		}
+		if timeout == nil {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-opened:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (g *migrationGate) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight--
+	if g.inFlight == 0 && g.drained != nil {
+		close(g.drained)
+		g.drained = nil
+	}
+}
+
+// close turns new requests away and returns a channel closed once the
+// requests in flight are done. It fails if a migration is already running.
+func (g *migrationGate) close() (<-chan struct{}, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.migrating {
+		return nil, false
+	}
+	g.migrating = true
+	g.opened = make(chan struct{})
+	drained := make(chan struct{})
+	if g.inFlight == 0 {
+		close(drained)
+	} else {
+		g.drained = drained
+	}
+	return drained, true
+}
+
+func (g *migrationGate) open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.migrating, g.drained = false, nil
+	close(g.opened)
+}
+
+func (g *migrationGate) status() (migrating bool, failed *migrate.Error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.migrating, g.failed
+}
+
+// MigrateLive migrates the database while serving: new requests are turned
+// away with MIGRATION_IN_PROGRESS, or wait up to MigrationWait, the requests
+// in flight finish, and the Migrate hook migrates and restarts the query
+// engine before the gate opens again. The schema is read again afterwards.
+func (h *Handler) MigrateLive(ctx context.Context) error {
+	if h.migrate == nil {
+		return errors.New("the database is not migrated by this instance")
+	}
+	drained, ok := h.gate.close()
+	if !ok {
+		return errMigrationRunning
+	}
+	defer h.gate.open()
+	start := time.Now()
+	slog.Info("Migrating while serving, waiting for the requests in flight")
+	select {
+	case <-drained:
+	case <-time.After(migrationDrainWait):
+		return fmt.Errorf("requests still in flight after %s", migrationDrainWait)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if h.engineIdle != nil {
+		// the hook restarts the engine, it must not be stopped for being idle
+		if err := h.acquireEngine(ctx); err != nil {
+			return err
+		}
+		defer h.releaseEngine()
+	}
+	err := h.migrate(ctx)
+	var failed *migrate.Error
+	if err != nil && !errors.As(err, &failed) {
+		return err
+	}
+	h.gate.mu.Lock()
+	h.gate.failed = failed
+	h.gate.mu.Unlock()
+	h.schemaCache.Store((*schemaCache)(nil))
+	h.counts.invalidate(nil)
+	h.refreshSchema()
+	if h.enableREST {
+		h.loadREST()
+	}
+	h.WarmUp(ctx)
+	slog.Info("Migrated while serving", slog.Duration("took", time.Since(start)), slog.Bool("failed", failed != nil))
+	return err
+}
+
+var errMigrationRunning = errors.New("a migration is already running")
+
+// serveMigration serves the error the migration on start or the latest
+// live migration failed with, for post-mortems without the logs. POST runs
+// a live migration.
+func (h *Handler) serveMigration(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if h.migrate == nil {
+			writeError(w, h.plainTextErrors, http.StatusConflict, "MIGRATION_UNAVAILABLE", "the database is not migrated by this instance")
+			return
+		}
+		err := h.MigrateLive(r.Context())
+		var failed *migrate.Error
+		switch {
+		case errors.Is(err, errMigrationRunning):
+			writeError(w, h.plainTextErrors, http.StatusConflict, "MIGRATION_IN_PROGRESS", err.Error())
+			return
+		case err != nil && !errors.As(err, &failed):
+			slog.Error("Migrating while serving", slog.String("error", err.Error()))
+			writeError(w, h.plainTextErrors, http.StatusInternalServerError, "MIGRATION_FAILED", err.Error())
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+	migrating, failed := h.gate.status()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(migrationStatus{Failed: failed != nil, Error: failed, InProgress: migrating})
+}
+
+// migrationHealth fails the migration component while a live migration
+// runs, so readiness probes take the instance out of rotation.
+func (h *Handler) migrationHealth() (ComponentHealth, bool) {
+	if migrating, _ := h.gate.status(); migrating {
+		return ComponentHealth{Status: HealthFailing, Details: map[string]interface{}{"inProgress": true}}, true
+	}
+	return ComponentHealth{}, false
+}
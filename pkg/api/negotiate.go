@@ -0,0 +1,380 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// Media types a GraphQL response can be re-encoded to.
+const (
+	mediaTypeMsgpack = "application/msgpack"
+	mediaTypeCSV     = "text/csv"
+)
+
+// responseFormat re-encodes the JSON response of the query engine for a
+// client that asked for another format in its Accept header. It writes the
+// headers and the body, streaming the output as it encodes.
+type responseFormat interface {
+	write(w http.ResponseWriter, data []byte) error
+}
+
+// negotiateMediaType returns the media type of the Accept header with the
+// highest quality the handler can re-encode to, or "" for the engine's JSON.
+// Unknown types are ignored rather than refused, clients send all kinds of
+// Accept headers to GraphQL servers.
+func negotiateMediaType(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			mediaType = ""
+		case "application/x-msgpack":
+			mediaType = mediaTypeMsgpack
+		case mediaTypeMsgpack, mediaTypeCSV:
+		default:
+			continue
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
+
+// newResponseFormat returns the format of the Accept header of r for the
+// request body, nil for JSON. A CSV response is only possible for a query
+// selecting a single list, otherwise it fails with errNotAcceptable.
+func newResponseFormat(r *http.Request, body []byte) (responseFormat, error) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return nil, nil
+	}
+	switch negotiateMediaType(accept) {
+	case mediaTypeMsgpack:
+		return msgpackFormat{}, nil
+	case mediaTypeCSV:
+		format, err := newCSVFormat(body)
+		if format == nil {
+			return nil, err
+		}
+		return format, nil
+	}
+	return nil, nil
+}
+
+var errNotAcceptable = errors.New("text/csv is only available for a query selecting a single list")
+
+// msgpackFormat encodes the response as MessagePack.
+type msgpackFormat struct{}
+
+func (msgpackFormat) write(w http.ResponseWriter, data []byte) error {
+	value, typ, _, err := jsonparser.Get(data)
+	if err != nil {
+		return fmt.Errorf("msgpack: %w", err)
+	}
+	w.Header().Set("Content-Type", mediaTypeMsgpack)
+	bw := bufio.NewWriterSize(w, 32*1024)
+	if err := encodeMsgpack(bw, value, typ); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// encodeMsgpack writes the JSON value as MessagePack. Integers keep their
+// type, other numbers become float64.
+func encodeMsgpack(w *bufio.Writer, value []byte, typ jsonparser.ValueType) error {
+	switch typ {
+	case jsonparser.Null:
+		return w.WriteByte(0xc0)
+	case jsonparser.Boolean:
+		if bytes.Equal(value, []byte("true")) {
+			return w.WriteByte(0xc3)
+		}
+		return w.WriteByte(0xc2)
+	case jsonparser.Number:
+		if i, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			return writeMsgpackInt(w, i)
+		}
+		f, err := strconv.ParseFloat(string(value), 64)
+		if err != nil {
+			return fmt.Errorf("msgpack: %w", err)
+		}
+		_ = w.WriteByte(0xcb)
+		return binary.Write(w, binary.BigEndian, math.Float64bits(f))
+	case jsonparser.String:
+		s, err := jsonparser.ParseString(value)
+		if err != nil {
+			return fmt.Errorf("msgpack: %w", err)
+		}
+		return writeMsgpackString(w, s)
+	case jsonparser.Array:
+		n := 0
+		_, _ = jsonparser.ArrayEach(value, func([]byte, jsonparser.ValueType, int, error) { n++ })
+		writeMsgpackHeader(w, n, 0x90, 0xdc, 0xdd)
+		var err error
+		_, _ = jsonparser.ArrayEach(value, func(item []byte, typ jsonparser.ValueType, _ int, _ error) {
+			if err == nil {
+				err = encodeMsgpack(w, item, typ)
+			}
+		})
+		return err
+	case jsonparser.Object:
+		n := 0
+		_ = jsonparser.ObjectEach(value, func([]byte, []byte, jsonparser.ValueType, int) error { n++; return nil })
+		writeMsgpackHeader(w, n, 0x80, 0xde, 0xdf)
+		return jsonparser.ObjectEach(value, func(key, item []byte, typ jsonparser.ValueType, _ int) error {
+			k, err := jsonparser.ParseString(key)
+			if err != nil {
+				return fmt.Errorf("msgpack: %w", err)
+			}
+			if err := writeMsgpackString(w, k); err != nil {
+				return err
+			}
+			return encodeMsgpack(w, item, typ)
+		})
+	}
+	return fmt.Errorf("msgpack: unexpected JSON value %q", value)
+}
+
+func writeMsgpackInt(w *bufio.Writer, i int64) error {
+	switch {
+	case i >= 0 && i <= 127, i < 0 && i >= -32:
+		return w.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		_, err := w.Write([]byte{0xcc, byte(i)})
+		return err
+	case i >= 0 && i <= math.MaxUint16:
+		_ = w.WriteByte(0xcd)
+		return binary.Write(w, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		_ = w.WriteByte(0xce)
+		return binary.Write(w, binary.BigEndian, uint32(i))
+	case i >= 0:
+		_ = w.WriteByte(0xcf)
+		return binary.Write(w, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		_, err := w.Write([]byte{0xd0, byte(i)})
+		return err
+	case i >= math.MinInt16:
+		_ = w.WriteByte(0xd1)
+		return binary.Write(w, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		_ = w.WriteByte(0xd2)
+		return binary.Write(w, binary.BigEndian, int32(i))
+	default:
+		_ = w.WriteByte(0xd3)
+		return binary.Write(w, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackString(w *bufio.Writer, s string) error {
+	switch n := len(s); {
+	case n < 32:
+		_ = w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		_, _ = w.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		_ = w.WriteByte(0xda)
+		_ = binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		_ = w.WriteByte(0xdb)
+		_ = binary.Write(w, binary.BigEndian, uint32(n))
+	}
+	_, err := w.WriteString(s)
+	return err
+}
+
+// writeMsgpackHeader writes the length of an array or map: fixed holds
+// lengths below 16, the others 16 and 32 bit lengths.
+func writeMsgpackHeader(w *bufio.Writer, n int, fixed, len16, len32 byte) {
+	switch {
+	case n < 16:
+		_ = w.WriteByte(fixed | byte(n))
+	case n <= math.MaxUint16:
+		_ = w.WriteByte(len16)
+		_ = binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		_ = w.WriteByte(len32)
+		_ = binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+// csvFormat flattens the list selected by the single root field of a query
+// into rows. The columns are the leaf fields of its selection set, nested
+// objects named by their path like author.name. A column below a nested
+// list holds the JSON array of its values.
+type csvFormat struct {
+	// field is the response key of the root field
+	field   string
+	columns [][]string
+}
+
+// newCSVFormat derives the columns from the selection set of the query.
+func newCSVFormat(body []byte) (*csvFormat, error) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return nil, errNotAcceptable
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		// the engine reports the syntax error
+		return nil, nil
+	}
+	for i := range doc.OperationDefinitions {
+		if operationName != "" && doc.OperationDefinitionNameString(i) != operationName {
+			continue
+		}
+		def := doc.OperationDefinitions[i]
+		if def.OperationType != ast.OperationTypeQuery || !def.HasSelections {
+			return nil, errNotAcceptable
+		}
+		refs := doc.SelectionSets[def.SelectionSet].SelectionRefs
+		if len(refs) != 1 || doc.Selections[refs[0]].Kind != ast.SelectionKindField {
+			return nil, errNotAcceptable
+		}
+		field := doc.Selections[refs[0]].Ref
+		format := &csvFormat{field: doc.FieldAliasOrNameString(field)}
+		if !doc.Fields[field].HasSelections {
+			return nil, errNotAcceptable
+		}
+		if format.columns, err = csvColumns(&doc, doc.Fields[field].SelectionSet, nil); err != nil {
+			return nil, err
+		}
+		return format, nil
+	}
+	return nil, nil
+}
+
+func csvColumns(doc *ast.Document, set int, prefix []string) ([][]string, error) {
+	var columns [][]string
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		if doc.Selections[ref].Kind != ast.SelectionKindField {
+			return nil, errors.New("text/csv doesn't support fragments")
+		}
+		field := doc.Selections[ref].Ref
+		path := append(append([]string{}, prefix...), doc.FieldAliasOrNameString(field))
+		if !doc.Fields[field].HasSelections {
+			columns = append(columns, path)
+			continue
+		}
+		nested, err := csvColumns(doc, doc.Fields[field].SelectionSet, path)
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, nested...)
+	}
+	return columns, nil
+}
+
+func (f *csvFormat) write(w http.ResponseWriter, data []byte) error {
+	if _, _, _, err := jsonparser.Get(data, "errors"); err == nil {
+		// errors are only readable as JSON
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write(data)
+		return err
+	}
+	list, typ, _, err := jsonparser.Get(data, "data", f.field)
+	if err != nil || typ != jsonparser.Array {
+		writeGraphQLError(w, http.StatusNotAcceptable, "NOT_ACCEPTABLE", errNotAcceptable.Error())
+		return nil
+	}
+
+	w.Header().Set("Content-Type", mediaTypeCSV+"; charset=utf-8")
+	out := csv.NewWriter(w)
+	header := make([]string, len(f.columns))
+	for i, path := range f.columns {
+		header[i] = strings.Join(path, ".")
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, len(f.columns))
+	var writeErr error
+	_, _ = jsonparser.ArrayEach(list, func(item []byte, typ jsonparser.ValueType, _ int, _ error) {
+		if writeErr != nil {
+			return
+		}
+		for i, path := range f.columns {
+			row[i] = csvCell(lookup(item, typ, path))
+		}
+		writeErr = out.Write(row)
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// lookup returns the value at path. Below a list it collects the values of
+// every item into a JSON array.
+func lookup(value []byte, typ jsonparser.ValueType, path []string) ([]byte, jsonparser.ValueType) {
+	for i, key := range path {
+		if typ == jsonparser.Array {
+			var items [][]byte
+			_, _ = jsonparser.ArrayEach(value, func(item []byte, typ jsonparser.ValueType, _ int, _ error) {
+				items = append(items, rawJSON(lookup(item, typ, path[i:])))
+			})
+			return append(append([]byte("["), bytes.Join(items, []byte(","))...), ']'), jsonparser.Array
+		}
+		if typ != jsonparser.Object {
+			return nil, jsonparser.Null
+		}
+		v, t, _, err := jsonparser.Get(value, key)
+		if err != nil {
+			return nil, jsonparser.Null
+		}
+		value, typ = v, t
+	}
+	return value, typ
+}
+
+// rawJSON restores the JSON of a value returned by jsonparser, which strips
+// the quotes of strings.
+func rawJSON(value []byte, typ jsonparser.ValueType) []byte {
+	switch typ {
+	case jsonparser.String:
+		return append(append([]byte(`"`), value...), '"')
+	case jsonparser.Null, jsonparser.NotExist:
+		return []byte("null")
+	}
+	return value
+}
+
+func csvCell(value []byte, typ jsonparser.ValueType) string {
+	switch typ {
+	case jsonparser.String:
+		s, err := jsonparser.ParseString(value)
+		if err != nil {
+			return string(value)
+		}
+		return s
+	case jsonparser.Null, jsonparser.NotExist:
+		return ""
+	}
+	return string(value)
+}
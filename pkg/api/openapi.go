@@ -0,0 +1,233 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/buger/jsonparser"
+)
+
+// object is a JSON object of the OpenAPI document. Maps marshal with sorted
+// keys, so the document is stable for ETags and golden files.
+type object = map[string]interface{}
+
+// generateOpenAPI describes the REST bridge serving models as an OpenAPI 3
+// document.
+func generateOpenAPI(models []restModel, auth *trustedHeaderAuth) ([]byte, error) {
+	schemas := object{
+		"Error": object{
+			"type":     "object",
+			"required": []string{"error"},
+			"properties": object{
+				"error": object{
+					"type":     "object",
+					"required": []string{"code", "message"},
+					"properties": object{
+						"code":    object{"type": "string", "description": "Prisma error code such as P2002, or a wunderbase code such as DATABASE_FULL"},
+						"message": object{"type": "string"},
+					},
+				},
+			},
+		},
+	}
+	responses := object{}
+	for _, r := range []struct{ name, description string }{
+		{"BadRequest", "The request or its body is invalid"},
+		{"NotFound", "The record or model does not exist"},
+		{"Conflict", "A unique constraint failed"},
+		{"DatabaseFull", "The database size limit is reached, only reads and deletes are allowed"},
+		{"EngineUnavailable", "The query engine could not be reached"},
+	} {
+		responses[r.name] = object{
+			"description": r.description,
+			"content":     object{"application/json": object{"schema": ref("schemas", "Error")}},
+		}
+	}
+
+	paths := object{}
+	for _, m := range models {
+		schemas[m.Name] = m.schema(true)
+		schemas[m.Name+"Input"] = m.schema(false)
+		collection := restPrefix + strings.ToLower(m.Name)
+
+		list := []interface{}{
+			queryParameter("limit", object{"type": "integer", "minimum": 0, "maximum": maxRESTLimit, "default": defaultRESTLimit}, "Maximum number of records returned"),
+			queryParameter("offset", object{"type": "integer", "minimum": 0, "default": 0}, "Number of records skipped"),
+		}
+		for _, f := range m.Fields {
+			if f.List {
+				continue
+			}
+			schema := f.schema()
+			delete(schema, "nullable")
+			list = append(list, queryParameter(f.Name, schema, "Only return records whose "+f.Name+" equals the value"))
+		}
+		get := openAPIOperation("list"+m.Name, "List "+m.Name+" records", nil,
+			jsonResponse("200", "The records", object{"type": "array", "items": ref("schemas", m.Name)}),
+			"400", "BadRequest")
+		get["parameters"] = list
+		paths[collection] = object{
+			"get": get,
+			"post": openAPIOperation("create"+m.Name, "Create a "+m.Name, body(m.Name+"Input"),
+				jsonResponse("201", "The created record", ref("schemas", m.Name)),
+				"400", "BadRequest", "409", "Conflict", "507", "DatabaseFull"),
+		}
+
+		id := object{"name": m.ID.Name, "in": "path", "required": true, "schema": m.ID.schema()}
+		paths[collection+"/{"+m.ID.Name+"}"] = object{
+			"parameters": []interface{}{id},
+			"get": openAPIOperation("get"+m.Name, "Get a "+m.Name+" by "+m.ID.Name, nil,
+				jsonResponse("200", "The record", ref("schemas", m.Name)),
+				"400", "BadRequest", "404", "NotFound"),
+			"patch": openAPIOperation("update"+m.Name, "Update a "+m.Name, body(m.Name+"Input"),
+				jsonResponse("200", "The updated record", ref("schemas", m.Name)),
+				"400", "BadRequest", "404", "NotFound", "409", "Conflict", "507", "DatabaseFull"),
+			"delete": openAPIOperation("delete"+m.Name, "Delete a "+m.Name, nil,
+				jsonResponse("200", "The deleted record", ref("schemas", m.Name)),
+				"404", "NotFound"),
+		}
+	}
+
+	doc := object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "wunderbase REST bridge",
+			"version":     "1.0.0",
+			"description": "CRUD endpoints generated from the Prisma schema.",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas":   schemas,
+			"responses": responses,
+		},
+	}
+	if auth != nil {
+		doc["components"].(object)["securitySchemes"] = object{
+			"trustedHeader": object{
+				"type":        "apiKey",
+				"in":          "header",
+				"name":        auth.header,
+				"description": "Set by the authenticating proxy in front of wunderbase",
+			},
+		}
+		doc["security"] = []interface{}{object{"trustedHeader": []string{}}}
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// schema describes the model; records have their non-null fields required,
+// inputs require nothing and leave validation to the engine.
+func (m restModel) schema(record bool) object {
+	properties := object{}
+	var required []string
+	for _, f := range m.Fields {
+		properties[f.Name] = f.schema()
+		if record && f.Required {
+			required = append(required, f.Name)
+		}
+	}
+	schema := object{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (f restField) schema() object {
+	var schema object
+	switch {
+	case len(f.Enum) > 0:
+		schema = object{"type": "string", "enum": f.Enum}
+	case f.Type == "Int":
+		schema = object{"type": "integer", "format": "int32"}
+	case f.Type == "BigInt":
+		schema = object{"type": "integer", "format": "int64"}
+	case f.Type == "Float":
+		schema = object{"type": "number", "format": "double"}
+	case f.Type == "Boolean":
+		schema = object{"type": "boolean"}
+	case f.Type == "DateTime":
+		schema = object{"type": "string", "format": "date-time"}
+	case f.Type == "Bytes":
+		schema = object{"type": "string", "format": "byte"}
+	case f.Type == "Json":
+		schema = object{}
+	default:
+		// String, Decimal and anything unknown travel as strings
+		schema = object{"type": "string"}
+	}
+	if f.List {
+		schema = object{"type": "array", "items": schema}
+	}
+	if !f.Required {
+		schema["nullable"] = true
+	}
+	return schema
+}
+
+func ref(kind, name string) object {
+	return object{"$ref": "#/components/" + kind + "/" + name}
+}
+
+func queryParameter(name string, schema object, description string) object {
+	return object{"name": name, "in": "query", "schema": schema, "description": description}
+}
+
+func body(schema string) object {
+	return object{
+		"required": true,
+		"content":  object{"application/json": object{"schema": ref("schemas", schema)}},
+	}
+}
+
+type openAPIResponse struct {
+	status string
+	value  object
+}
+
+func jsonResponse(status, description string, schema object) openAPIResponse {
+	return openAPIResponse{status, object{
+		"description": description,
+		"content":     object{"application/json": object{"schema": schema}},
+	}}
+}
+
+// openAPIOperation builds an operation object. errors alternate status
+// codes and names of shared responses.
+func openAPIOperation(id, summary string, requestBody object, success openAPIResponse, errors ...string) object {
+	responses := object{
+		success.status: success.value,
+		"502":          ref("responses", "EngineUnavailable"),
+	}
+	for i := 0; i+1 < len(errors); i += 2 {
+		responses[errors[i]] = ref("responses", errors[i+1])
+	}
+	op := object{"operationId": id, "summary": summary, "responses": responses}
+	if requestBody != nil {
+		op["requestBody"] = requestBody
+	}
+	return op
+}
+
+// serveOpenAPI serves the document generated when the schema was loaded,
+// with the public URL of the request as its server.
+func (h *Handler) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	servers, _ := json.Marshal([]object{{"url": h.publicURL(r)}})
+	// Set may write to the array of its input, which other requests read
+	doc, err := jsonparser.Set(append([]byte(nil), h.openAPI...), servers, "servers")
+	if err != nil {
+		doc = h.openAPI
+	}
+	sum := sha256.Sum256(doc)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(doc)
+}
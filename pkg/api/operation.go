@@ -0,0 +1,141 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// operation is the subset of a GraphQL request the handler needs to make
+// admission decisions before the request reaches the query engine.
+type operation struct {
+	name       string
+	typ        ast.OperationType
+	rootFields []string
+}
+
+// parseOperation extracts the operation selected by the request body.
+func parseOperation(body []byte) (*operation, error) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return nil, fmt.Errorf("read query: %w", err)
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse query: %s", report.Error())
+	}
+
+	for i := range doc.OperationDefinitions {
+		name := doc.OperationDefinitionNameString(i)
+		if operationName != "" && name != operationName {
+			continue
+		}
+		op := &operation{
+			name: name,
+			typ:  doc.OperationDefinitions[i].OperationType,
+		}
+		if doc.OperationDefinitions[i].HasSelections {
+			set := doc.OperationDefinitions[i].SelectionSet
+			for _, ref := range doc.SelectionSets[set].SelectionRefs {
+				if doc.Selections[ref].Kind != ast.SelectionKindField {
+					// fragments on the root type are not resolved here
+					op.rootFields = append(op.rootFields, "")
+					continue
+				}
+				op.rootFields = append(op.rootFields, doc.FieldNameString(doc.Selections[ref].Ref))
+			}
+		}
+		return op, nil
+	}
+	return nil, fmt.Errorf("operation %q not found", operationName)
+}
+
+func (o *operation) isMutation() bool {
+	return o.typ == ast.OperationTypeMutation
+}
+
+// runsRaw reports whether a mutation runs one of the rawFields, or a
+// fragment on the root type that may hide one.
+func (o *operation) runsRaw() bool {
+	if !o.isMutation() {
+		return false
+	}
+	for _, field := range o.rootFields {
+		if field == "" || rawFields[field] {
+			return true
+		}
+	}
+	return false
+}
+
+// maxOperationNameLength is where operation names are cut in logs, metrics
+// and stats and for the rules keyed by operation name.
+const maxOperationNameLength = 100
+
+// operationNameGrammar is the grammar of GraphQL names, the only names an
+// operation can have.
+var operationNameGrammar = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// checkOperationName returns why the operationName of a request body can't
+// name an operation, empty if it can or there is none. Clients putting user
+// input there would otherwise reach the logs with newlines and escape
+// sequences, and the rules keyed by name with look-alike characters.
+func checkOperationName(body []byte) string {
+	value, dataType, _, err := jsonparser.Get(body, "operationName")
+	if err != nil || dataType == jsonparser.Null {
+		return ""
+	}
+	if dataType != jsonparser.String {
+		return "operationName must be a string"
+	}
+	name, err := jsonparser.ParseString(value)
+	if err != nil {
+		return "operationName is not a valid string"
+	}
+	if name != "" && !operationNameGrammar.MatchString(name) {
+		return "operationName must be a GraphQL name of letters, digits and underscores, not starting with a digit"
+	}
+	return ""
+}
+
+// cleanOperationName is an operation name as logs, metrics, stats and the
+// rules keyed by operation name see it: empty unless it is a GraphQL name,
+// cut at maxOperationNameLength.
+func cleanOperationName(name string) string {
+	if !operationNameGrammar.MatchString(name) {
+		return ""
+	}
+	if len(name) > maxOperationNameLength {
+		name = name[:maxOperationNameLength]
+	}
+	return name
+}
+
+// introspectionField matches the introspection fields other than
+// __typename.
+var introspectionField = regexp.MustCompile(`__schema\b|__type\s*\(`)
+
+// introspects reports whether a request body queries the schema beyond
+// the introspection query answered from the SDL.
+func introspects(body []byte) bool {
+	return introspectionField.Match(body)
+}
+
+// onlyDeletes reports whether every root field of a mutation removes data.
+func (o *operation) onlyDeletes() bool {
+	if !o.isMutation() || len(o.rootFields) == 0 {
+		return false
+	}
+	for _, field := range o.rootFields {
+		if !strings.HasPrefix(field, "deleteOne") && !strings.HasPrefix(field, "deleteMany") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/buger/jsonparser"
+	"go.uber.org/ratelimit"
+)
+
+// OperationLimit replaces the read and write limits for the requests of one
+// operation.
+type OperationLimit struct {
+	// Exempt skips the rate limits and quotas.
+	Exempt bool
+	// ReadLimitSeconds and WriteLimitSeconds replace the global limits
+	// when positive.
+	ReadLimitSeconds  int
+	WriteLimitSeconds int
+}
+
+// operationLimiter is the limiter of an operation limit override, its
+// limiters are nil where the global ones apply.
+type operationLimiter struct {
+	key         string
+	exempt      bool
+	read, write ratelimit.Limiter
+}
+
+type operationLimitKey struct{}
+
+func newOperationLimiters(limits map[string]OperationLimit) map[string]*operationLimiter {
+	limiters := map[string]*operationLimiter{}
+	for key, limit := range limits {
+		l := &operationLimiter{key: key, exempt: limit.Exempt}
+		if limit.ReadLimitSeconds > 0 {
+			l.read = ratelimit.New(limit.ReadLimitSeconds)
+		}
+		if limit.WriteLimitSeconds > 0 {
+			l.write = ratelimit.New(limit.WriteLimitSeconds)
+		}
+		limiters[key] = l
+	}
+	return limiters
+}
+
+// resolveOperationLimit attaches the limit override of the request's
+// operation to its context, looked up by the operation name, then by
+// sha256:<hex digest of the query> as persisted queries are identified. With
+// authentication only authenticated callers get an override, otherwise anyone
+// could name their operation like an exempt one.
+func (h *Handler) resolveOperationLimit(r *http.Request, body []byte, op *operation) *http.Request {
+	if len(h.operationLimits) == 0 || (h.auth != nil && Caller(r.Context()) == "") {
+		return r
+	}
+	name := requestOperationName(body, op)
+	limiter := h.operationLimits[name]
+	if limiter == nil || name == "" {
+		query, _ := jsonparser.GetString(body, "query")
+		digest := sha256.Sum256([]byte(query))
+		limiter = h.operationLimits["sha256:"+hex.EncodeToString(digest[:])]
+	}
+	if limiter == nil {
+		return r
+	}
+	override := "override"
+	if limiter.exempt {
+		override = "exempt"
+	}
+	h.sink.Count(metricOperationLimitOverrides, 1, "operation", limiter.key, "override", override)
+	return r.WithContext(context.WithValue(r.Context(), operationLimitKey{}, limiter))
+}
+
+// requestOperationName is the operation name of a GraphQL request, sent
+// next to the query or the name of its operation. op is the parsed
+// operation if the request was parsed already.
+func requestOperationName(body []byte, op *operation) string {
+	name, _ := jsonparser.GetString(body, "operationName")
+	if name == "" && op == nil {
+		op, _ = parseOperation(body)
+	}
+	if name == "" && op != nil {
+		name = op.name
+	}
+	return cleanOperationName(name)
+}
+
+// operationLimit returns the limit override resolved for a request, if any.
+func operationLimit(ctx context.Context) *operationLimiter {
+	limiter, _ := ctx.Value(operationLimitKey{}).(*operationLimiter)
+	return limiter
+}
+
+// takeLimits waits for the read limit and, for writes, the write limit that
+// apply to the request.
+func (h *Handler) takeLimits(ctx context.Context, write bool) {
+	limiter := operationLimit(ctx)
+	switch {
+	case limiter == nil:
+		if write {
+			h.take("write")
+		}
+		h.take("read")
+	case limiter.exempt:
+	default:
+		if write {
+			if limiter.write != nil {
+				limiter.write.Take()
+			} else {
+				h.take("write")
+			}
+		}
+		if limiter.read != nil {
+			limiter.read.Take()
+		} else {
+			h.take("read")
+		}
+	}
+}
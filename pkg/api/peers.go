@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// peerTimeout bounds the health check of a peer, so a peer that hangs
+	// doesn't hang the verbose health response.
+	peerTimeout = time.Second
+	// peerCacheTTL is how long the peer checks are reused, status pages
+	// polling every instance don't multiply the checks.
+	peerCacheTTL = 5 * time.Second
+)
+
+// replicaStalenessHeader carries the replica staleness on the health
+// response, for the peers of a replica.
+const replicaStalenessHeader = "X-Replica-Staleness-Seconds"
+
+// PeerHealth is the state of a peer in the verbose health response.
+type PeerHealth struct {
+	Status     string `json:"status"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	// ReplicaStalenessSeconds is only reported by replicas.
+	ReplicaStalenessSeconds *float64  `json:"replicaStalenessSeconds,omitempty"`
+	LatencyMs               float64   `json:"latencyMs"`
+	CheckedAt               time.Time `json:"checkedAt"`
+	Error                   string    `json:"error,omitempty"`
+}
+
+// peerChecker checks the plain health endpoint of the other instances of a
+// fleet, never the verbose one: peers listing each other would otherwise
+// check each other forever.
+type peerChecker struct {
+	urls   []string
+	client *http.Client
+
+	// mu is held during a check, concurrent verbose health requests wait
+	// for its result
+	mu      sync.Mutex
+	checked time.Time
+	peers   map[string]PeerHealth
+}
+
+func newPeerChecker(urls []string) *peerChecker {
+	if len(urls) == 0 {
+		return nil
+	}
+	checker := &peerChecker{client: &http.Client{Timeout: peerTimeout}}
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			// wunderbase refuses WUNDERBASE_PEER_URLS that don't parse
+			continue
+		}
+		query := u.Query()
+		query.Del("verbose")
+		u.RawQuery = query.Encode()
+		checker.urls = append(checker.urls, u.String())
+	}
+	return checker
+}
+
+// check returns the health of every peer, checked at most every
+// peerCacheTTL. The checks don't end with the request asking for them,
+// their results are cached for the next ones.
+func (c *peerChecker) check() map[string]PeerHealth {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < peerCacheTTL {
+		return c.peers
+	}
+	peers := make(map[string]PeerHealth, len(c.urls))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, u := range c.urls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			health := c.checkPeer(u)
+			mu.Lock()
+			peers[u] = health
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	c.peers, c.checked = peers, time.Now()
+	return peers
+}
+
+func (c *peerChecker) checkPeer(u string) (health PeerHealth) {
+	start := time.Now()
+	health = PeerHealth{Status: HealthFailing, CheckedAt: start.UTC()}
+	defer func() { health.LatencyMs = float64(time.Since(start).Microseconds()) / 1000 }()
+	resp, err := c.client.Get(u)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	drain(resp)
+	health.StatusCode = resp.StatusCode
+	if staleness, err := strconv.ParseFloat(resp.Header.Get(replicaStalenessHeader), 64); err == nil {
+		health.ReplicaStalenessSeconds = &staleness
+	}
+	if resp.StatusCode != http.StatusOK {
+		health.Error = "unexpected status " + strconv.Itoa(resp.StatusCode)
+		return health
+	}
+	health.Status = HealthOK
+	return health
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// priorityHeader asks for a request to be sent to the query engine in the
+// slots reserved for priority traffic.
+const priorityHeader = "X-Wunderbase-Priority"
+
+const (
+	poolGeneral  = "general"
+	poolPriority = "priority"
+)
+
+// errEnginePoolTimeout is returned for a request that waited for a slot of
+// its engine pool longer than the timeout of the pool.
+var errEnginePoolTimeout = errors.New("wunderbase: engine pool timeout")
+
+const enginePoolTimeoutMessage = "too many requests are waiting for the query engine, retry shortly"
+
+type priorityKey struct{}
+
+// enginePools split the requests the query engine runs at a time, in
+// parallel on its connection pool, between a general pool and a pool
+// reserved for priority requests, so batch traffic taking every general
+// slot can't starve interactive requests. Each pool is a queue like the
+// write queue with its own slots.
+type enginePools struct {
+	general *writeQueue
+	// priority is nil without reserved slots
+	priority *writeQueue
+	// scopes are the scopes allowed to ask for the priority pool
+	scopes map[string]bool
+}
+
+// newEnginePools returns nil without slots. reserved of the slots are kept
+// for priority requests, the general pool gets the others.
+func newEnginePools(slots, reserved int, scopes []string, timeout time.Duration) *enginePools {
+	if slots <= 0 {
+		return nil
+	}
+	p := &enginePools{general: newWriteQueue(slots-reserved, timeout), priority: newWriteQueue(reserved, timeout), scopes: map[string]bool{}}
+	for _, scope := range scopes {
+		p.scopes[scope] = true
+	}
+	return p
+}
+
+// withPriority marks a request sent with X-Wunderbase-Priority: high for the
+// priority pool, if its caller is authenticated with one of the priority
+// scopes. Others asking for it are served by the general pool.
+func (h *Handler) withPriority(r *http.Request) *http.Request {
+	if h.pools == nil || !strings.EqualFold(r.Header.Get(priorityHeader), "high") {
+		return r
+	}
+	allowed := false
+	for _, scope := range Scopes(r.Context()) {
+		allowed = allowed || h.pools.scopes[scope]
+	}
+	if h.pools.priority == nil || Caller(r.Context()) == "" || !allowed {
+		h.sink.Count(metricPriorityRefusals, 1)
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), priorityKey{}, true))
+}
+
+// enterPool waits for a slot of the engine pool of the request, if there
+// are pools, and returns the func freeing it.
+func (h *Handler) enterPool(ctx context.Context) (func(), error) {
+	if h.pools == nil {
+		return func() {}, nil
+	}
+	pool, queue := poolGeneral, h.pools.general
+	if priority, _ := ctx.Value(priorityKey{}).(bool); priority {
+		pool, queue = poolPriority, h.pools.priority
+	}
+	waited, err := queue.acquire(ctx)
+	h.sink.Observe(metricEnginePoolWaitSeconds, waited.Seconds(), "pool", pool)
+	if errors.Is(err, errWriteQueueTimeout) {
+		h.sink.Count(metricEnginePoolTimeouts, 1, "pool", pool)
+		return nil, errEnginePoolTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.sink.Count(metricEnginePoolRequests, 1, "pool", pool)
+	start := time.Now()
+	return func() {
+		h.sink.Observe(metricEnginePoolSeconds, time.Since(start).Seconds(), "pool", pool)
+		queue.release()
+	}, nil
+}
+
+// postPooled sends a GraphQL request to the query engine in a slot of its
+// engine pool.
+func (h *Handler) postPooled(ctx context.Context, body []byte) ([]byte, error) {
+	leave, err := h.enterPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	return h.postEngine(ctx, body)
+}
+
+// writeEnginePoolTimeout turns away a request that waited too long for a
+// slot of its engine pool.
+func writeEnginePoolTimeout(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeGraphQLError(w, http.StatusServiceUnavailable, "ENGINE_BUSY", enginePoolTimeoutMessage)
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// publicURL is the absolute URL clients reach the handler's root on, for
+// the URLs the handler emits. It is the configured public URL if set, and
+// otherwise derived from the request: the scheme from X-Forwarded-Proto if
+// the request comes through a trusted proxy, the host from the Host header,
+// and the path prefix a Router stripped, like /t/{name}.
+func (h *Handler) publicURL(r *http.Request) string {
+	prefix := requestPrefix(r)
+	if h.publicBaseURL != "" {
+		return strings.TrimSuffix(h.publicBaseURL, "/") + prefix
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && fromTrustedProxy(r, h.trustedProxies) {
+		// a chain of proxies lists the scheme the client used first
+		proto, _, _ = strings.Cut(proto, ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host + prefix
+}
+
+// requestPrefix is the part of the requested path that was stripped before
+// the request reached the handler.
+func requestPrefix(r *http.Request) string {
+	path := r.RequestURI
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if strings.HasSuffix(path, r.URL.Path) {
+		return strings.TrimSuffix(path, r.URL.Path)
+	}
+	return ""
+}
+
+// endpointURLs are the absolute URLs of the endpoints the handler serves,
+// as listed in the admin stats.
+func (h *Handler) endpointURLs(r *http.Request) map[string]string {
+	base := h.publicURL(r)
+	urls := map[string]string{
+		"graphql": base + "/",
+		"health":  base + h.healthEndpoint,
+	}
+	if h.metricsEndpoint != "" {
+		urls["metrics"] = base + h.metricsEndpoint
+	}
+	if h.enablePlayground {
+		urls["playground"] = h.playgroundAPIURL(r)
+	}
+	if h.enableREST {
+		urls["rest"] = base + restPrefix
+		urls["openapi"] = base + restPrefix + "openapi.json"
+	}
+	if h.enableSchemaViewer {
+		urls["schemaViewer"] = base + schemaViewerPath
+	}
+	return urls
+}
+
+// playgroundAPIURL is the URL the playground sends queries to, the
+// configured GraphiQL API URL if set.
+func (h *Handler) playgroundAPIURL(r *http.Request) string {
+	if h.graphiQLApiURL != "" {
+		return h.graphiQLApiURL
+	}
+	return h.publicURL(r) + "/"
+}
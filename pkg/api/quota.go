@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// defaultQuotaWindow is the quota window if none is configured.
+const defaultQuotaWindow = 24 * time.Hour
+
+// quota counts the reads and writes of a window and rejects them above the
+// configured quotas. Windows are aligned to the Unix epoch, so a day starts
+// at midnight UTC. With a state file the counts survive restarts, which on
+// platforms restarting instances from sleep would otherwise reset them.
+type quota struct {
+	window time.Duration
+	limits map[string]int64
+	path   string
+
+	mu       sync.Mutex
+	start    time.Time
+	consumed map[string]int64
+}
+
+// quotaState is the state file.
+type quotaState struct {
+	WindowStart   time.Time `json:"windowStart"`
+	WindowSeconds int64     `json:"windowSeconds"`
+	Reads         int64     `json:"reads"`
+	Writes        int64     `json:"writes"`
+}
+
+// newQuota loads the counts of the current window from path, if set. A
+// state file of an older window or a different window length is ignored.
+func newQuota(window time.Duration, reads, writes int, path string) (*quota, error) {
+	if window <= 0 {
+		window = defaultQuotaWindow
+	}
+	q := &quota{
+		window:   window,
+		limits:   map[string]int64{"read": int64(reads), "write": int64(writes)},
+		path:     path,
+		start:    windowStart(time.Now(), window),
+		consumed: map[string]int64{},
+	}
+	if path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return q, fmt.Errorf("wunderbase: read limit state: %w", err)
+	}
+	var state quotaState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return q, fmt.Errorf("wunderbase: parse limit state %s: %w", path, err)
+	}
+	if state.WindowStart.Equal(q.start) && state.WindowSeconds == int64(window/time.Second) {
+		q.consumed["read"], q.consumed["write"] = state.Reads, state.Writes
+	}
+	return q, nil
+}
+
+// take counts a request against the limits and reports whether it is
+// within their quotas, otherwise how long until the window rolls over.
+// Rejected requests aren't counted.
+func (q *quota) take(limits ...string) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	for _, limit := range limits {
+		if max := q.limits[limit]; max > 0 && q.consumed[limit] >= max {
+			return false, time.Until(q.start.Add(q.window))
+		}
+	}
+	for _, limit := range limits {
+		q.consumed[limit]++
+	}
+	return true, 0
+}
+
+// windowStart returns the start of the window of length window now is in:
+// now rounded down to a multiple of window since the Unix epoch.
+func windowStart(now time.Time, window time.Duration) time.Time {
+	unix := now.UnixNano()
+	return time.Unix(0, unix-unix%int64(window))
+}
+
+// roll starts a new window once the current one is over. q.mu is held.
+func (q *quota) roll() {
+	if start := windowStart(time.Now(), q.window); start.After(q.start) {
+		q.start = start
+		q.consumed = map[string]int64{}
+	}
+}
+
+// usage returns the window and the consumption and quota of limit.
+func (q *quota) usage(limit string) (window time.Time, used, max int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.start, q.consumed[limit], q.limits[limit]
+}
+
+// save writes the counts to the state file, replacing it atomically.
+func (q *quota) save() error {
+	if q.path == "" {
+		return nil
+	}
+	q.mu.Lock()
+	q.roll()
+	state := quotaState{WindowStart: q.start, WindowSeconds: int64(q.window / time.Second), Reads: q.consumed["read"], Writes: q.consumed["write"]}
+	q.mu.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return fmt.Errorf("wunderbase: write limit state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("wunderbase: write limit state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("wunderbase: write limit state: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		return fmt.Errorf("wunderbase: write limit state: %w", err)
+	}
+	return nil
+}
+
+// quotaStats is the state of the quotas in the admin stats.
+type quotaStats struct {
+	WindowStart time.Time    `json:"windowStart"`
+	WindowEnd   time.Time    `json:"windowEnd"`
+	Read        quotaCounter `json:"read"`
+	Write       quotaCounter `json:"write"`
+}
+
+type quotaCounter struct {
+	Consumed int64 `json:"consumed"`
+	// Limit and Remaining are omitted without a quota.
+	Limit     int64  `json:"limit,omitempty"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+func (q *quota) stats() *quotaStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.roll()
+	counter := func(limit string) quotaCounter {
+		c := quotaCounter{Consumed: q.consumed[limit], Limit: q.limits[limit]}
+		if c.Limit > 0 {
+			remaining := c.Limit - c.Consumed
+			if remaining < 0 {
+				remaining = 0
+			}
+			c.Remaining = &remaining
+		}
+		return c
+	}
+	return &quotaStats{
+		WindowStart: q.start.UTC(),
+		WindowEnd:   q.start.Add(q.window).UTC(),
+		Read:        counter("read"),
+		Write:       counter("write"),
+	}
+}
+
+// takeQuota counts a request of kind against the quotas, like the rate
+// limits a mutation is a write and a read. Requests above a quota are
+// answered with 429 and false is returned. Exempt operations aren't
+// counted.
+func (h *Handler) takeQuota(w http.ResponseWriter, r *http.Request, kind string) bool {
+	if h.quota == nil {
+		return true
+	}
+	if limiter := operationLimit(r.Context()); limiter != nil && limiter.exempt {
+		return true
+	}
+	limits := []string{"read"}
+	if kind == "mutation" {
+		limits = append(limits, "write")
+	}
+	ok, retryAfter := h.quota.take(limits...)
+	if ok {
+		if h.limitWarnings != nil {
+			for _, limit := range limits {
+				window, used, max := h.quota.usage(limit)
+				h.limitWarnings.observe(limit+"_quota", window, float64(used), float64(max))
+			}
+		}
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeGraphQLError(w, http.StatusTooManyRequests, "QUOTA_EXCEEDED",
+		"the "+kind+" quota of this window is used up, retry after "+retryAfter.Round(time.Second).String())
+	return false
+}
+
+// Close saves the state that outlives the process, the quota counts, and
+// stops the engine idle timer unless it is shared. The handler must not
+// serve requests afterwards.
+func (h *Handler) Close() {
+	if h.engineIdle != nil && h.shared == nil {
+		close(h.engineIdle.done)
+	}
+	if h.indexAdvice != nil && h.shared == nil {
+		close(h.indexAdvice.done)
+	}
+	if h.storage != nil && h.shared == nil {
+		close(h.storage.done)
+	}
+	if h.shared == nil {
+		h.schemaWatchers.close()
+	}
+	if h.quota == nil {
+		return
+	}
+	if err := h.quota.save(); err != nil {
+		slog.Error("Saving the limit state", slog.String("error", err.Error()))
+	}
+}
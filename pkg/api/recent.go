@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// defaultRecentLimit is the number of requests /admin/requests lists without
+// ?limit=.
+const defaultRecentLimit = 50
+
+// recentRequest is an entry of /admin/requests. The query and its variables
+// are only kept when bodies are captured, which production never does.
+type recentRequest struct {
+	Time          time.Time       `json:"time"`
+	RequestID     string          `json:"requestId"`
+	Type          string          `json:"type"`
+	OperationName string          `json:"operationName,omitempty"`
+	Fingerprint   string          `json:"fingerprint,omitempty"`
+	Status        int             `json:"status"`
+	DurationMs    float64         `json:"durationMs"`
+	ErrorCode     string          `json:"errorCode,omitempty"`
+	Caller        string          `json:"caller,omitempty"`
+	Query         string          `json:"query,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+}
+
+// failed reports whether the request was answered with an error, including
+// GraphQL errors answered with 200.
+func (r recentRequest) failed() bool {
+	return r.Status >= 400 || r.ErrorCode != ""
+}
+
+// recentRequests is a ring buffer of the latest requests.
+type recentRequests struct {
+	mu      sync.Mutex
+	entries []recentRequest
+	next    int
+	full    bool
+}
+
+func newRecentRequests(size int) *recentRequests {
+	return &recentRequests{entries: make([]recentRequest, size)}
+}
+
+func (b *recentRequests) add(entry recentRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns up to limit requests keep accepts, latest first.
+func (b *recentRequests) list(limit int, keep func(recentRequest) bool) []recentRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.next
+	if b.full {
+		n = len(b.entries)
+	}
+	requests := []recentRequest{}
+	for i := 1; i <= n && len(requests) < limit; i++ {
+		entry := b.entries[(b.next-i+len(b.entries))%len(b.entries)]
+		if keep(entry) {
+			requests = append(requests, entry)
+		}
+	}
+	return requests
+}
+
+// serveRecentRequests lists the latest requests. ?limit= bounds the number
+// listed and ?status=error or ?status=ok filters them.
+func (h *Handler) serveRecentRequests(w http.ResponseWriter, r *http.Request) {
+	if h.recent == nil {
+		writeNotFound(w, r, h.plainTextErrors)
+		return
+	}
+	limit := defaultRecentLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	var keep func(recentRequest) bool
+	switch r.URL.Query().Get("status") {
+	case "":
+		keep = func(recentRequest) bool { return true }
+	case "error":
+		keep = recentRequest.failed
+	case "ok":
+		keep = func(request recentRequest) bool { return !request.failed() }
+	default:
+		writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "status must be error or ok")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"requests": h.recent.list(limit, keep)})
+}
+
+// responseErrorCode is the code of the first error of a GraphQL response,
+// ours in the extensions or the query engine's, or of a REST error.
+func responseErrorCode(body []byte) string {
+	if code, err := jsonparser.GetString(body, "error", "code"); err == nil {
+		return code
+	}
+	if code, err := jsonparser.GetString(body, "errors", "[0]", "extensions", "code"); err == nil {
+		return code
+	}
+	if code, err := jsonparser.GetString(body, "errors", "[0]", "user_facing_error", "error_code"); err == nil {
+		return code
+	}
+	if _, _, _, err := jsonparser.Get(body, "errors", "[0]"); err == nil {
+		return "UNKNOWN"
+	}
+	return ""
+}
@@ -0,0 +1,530 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
+)
+
+// restPrefix is the path prefix of the REST bridge.
+const restPrefix = "/rest/"
+
+const (
+	defaultRESTLimit = 100
+	maxRESTLimit     = 1000
+)
+
+// restModel is a model served by the REST bridge, derived from the SDL of
+// the query engine.
+type restModel struct {
+	Name string
+	ID   restField
+	// Fields are the scalar and enum fields in SDL order, relations are not
+	// exposed.
+	Fields []restField
+	// args holds the GraphQL type of each argument of the root fields of
+	// the model, e.g. args["findManyUser"]["where"] = "UserWhereInput".
+	args map[string]map[string]string
+}
+
+type restField struct {
+	Name     string
+	Type     string
+	List     bool
+	Required bool
+	// Enum lists the values of an enum field.
+	Enum []string
+}
+
+// parseRESTModels finds the models in a Prisma query engine SDL: the object
+// types with a findUnique root field.
+func parseRESTModels(sdl []byte) ([]restModel, error) {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	objects := map[string]int{}
+	for i := range doc.ObjectTypeDefinitions {
+		objects[doc.ObjectTypeDefinitionNameString(i)] = i
+	}
+	enums := map[string][]string{}
+	for i := range doc.EnumTypeDefinitions {
+		values := []string{}
+		for _, ref := range doc.EnumTypeDefinitions[i].EnumValuesDefinition.Refs {
+			values = append(values, doc.EnumValueDefinitionNameString(ref))
+		}
+		enums[doc.EnumTypeDefinitionNameString(i)] = values
+	}
+	rootArgs := map[string]map[string]string{}
+	for _, root := range []string{"Query", "Mutation"} {
+		ref, ok := objects[root]
+		if !ok {
+			continue
+		}
+		for _, field := range doc.ObjectTypeDefinitions[ref].FieldsDefinition.Refs {
+			args := map[string]string{}
+			for _, arg := range doc.FieldDefinitions[field].ArgumentsDefinition.Refs {
+				typ, err := doc.PrintTypeBytes(doc.InputValueDefinitions[arg].Type, nil)
+				if err != nil {
+					return nil, err
+				}
+				args[doc.InputValueDefinitionNameString(arg)] = string(typ)
+			}
+			rootArgs[doc.FieldDefinitionNameString(field)] = args
+		}
+	}
+
+	var models []restModel
+	for i := range doc.ObjectTypeDefinitions {
+		name := doc.ObjectTypeDefinitionNameString(i)
+		if _, ok := rootArgs["findUnique"+name]; !ok {
+			continue
+		}
+		model := restModel{Name: name, args: map[string]map[string]string{}}
+		for _, op := range []string{"findMany", "findUnique", "createOne", "updateOne", "deleteOne"} {
+			model.args[op+name] = rootArgs[op+name]
+		}
+		for _, ref := range doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs {
+			typ := doc.FieldDefinitions[ref].Type
+			typeName := doc.ResolveTypeNameString(typ)
+			if _, isObject := objects[typeName]; isObject {
+				continue
+			}
+			model.Fields = append(model.Fields, restField{
+				Name:     doc.FieldDefinitionNameString(ref),
+				Type:     typeName,
+				List:     doc.TypeIsList(typ),
+				Required: doc.Types[typ].TypeKind == ast.TypeKindNonNull,
+				Enum:     enums[typeName],
+			})
+		}
+		id, ok := model.idField(&doc)
+		if !ok {
+			continue
+		}
+		model.ID = id
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// idField returns the field addressing single records: id if the model has
+// one, otherwise the first field of its unique where input.
+func (m restModel) idField(doc *ast.Document) (restField, bool) {
+	for _, f := range m.Fields {
+		if f.Name == "id" {
+			return f, true
+		}
+	}
+	for i := range doc.InputObjectTypeDefinitions {
+		if doc.InputObjectTypeDefinitionNameString(i) != m.Name+"WhereUniqueInput" {
+			continue
+		}
+		for _, ref := range doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs {
+			name := doc.InputValueDefinitionNameString(ref)
+			for _, f := range m.Fields {
+				if f.Name == name {
+					return f, true
+				}
+			}
+		}
+	}
+	return restField{}, false
+}
+
+// selection selects all fields of the model.
+func (m restModel) selection() string {
+	names := make([]string, len(m.Fields))
+	for i, f := range m.Fields {
+		names[i] = f.Name
+	}
+	return "{ " + strings.Join(names, " ") + " }"
+}
+
+// operation builds a GraphQL operation calling the root field op of the
+// model with the given arguments passed as variables of the same name.
+func (m restModel) operation(typ, op string, args ...string) (string, error) {
+	field := op + m.Name
+	types := m.args[field]
+	var defs, uses []string
+	for _, arg := range args {
+		argType, ok := types[arg]
+		if !ok {
+			return "", fmt.Errorf("%s has no argument %s", field, arg)
+		}
+		defs = append(defs, "$"+arg+": "+argType)
+		uses = append(uses, arg+": $"+arg)
+	}
+	return fmt.Sprintf("%s(%s) { %s(%s) %s }", typ, strings.Join(defs, ", "), field, strings.Join(uses, ", "), m.selection()), nil
+}
+
+// value converts a path or query parameter to the JSON value of the field.
+func (f restField) value(s string) (interface{}, error) {
+	switch f.Type {
+	case "Int":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer", f.Name)
+		}
+		return n, nil
+	case "Float":
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", f.Name)
+		}
+		return x, nil
+	case "Boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false", f.Name)
+		}
+		return b, nil
+	}
+	return s, nil
+}
+
+// loadREST reads the models from the query engine SDL. Until it succeeds the
+// REST bridge answers 503.
+func (h *Handler) loadREST() {
+	resp, err := h.client.Get(h.queryEngineSdlURL)
+	if err != nil {
+		slog.Error("REST bridge: fetch sdl", slog.String("error", err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	sdl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("REST bridge: read sdl", slog.String("error", err.Error()))
+		return
+	}
+	if h.visibility != nil {
+		if sdl, err = h.visibility.prune(sdl); err != nil {
+			slog.Error("REST bridge: hide models and fields", slog.String("error", err.Error()))
+			return
+		}
+	}
+	models, err := parseRESTModels(sdl)
+	if err != nil {
+		slog.Error("REST bridge: parse sdl", slog.String("error", err.Error()))
+		return
+	}
+	openAPI, err := generateOpenAPI(models, h.auth)
+	if err != nil {
+		slog.Error("REST bridge: generate openapi", slog.String("error", err.Error()))
+		return
+	}
+	h.openAPI = openAPI
+	h.restModels = map[string]restModel{}
+	for _, m := range models {
+		h.restModels[strings.ToLower(m.Name)] = m
+	}
+}
+
+// serveREST translates a REST call into a Prisma GraphQL operation:
+//
+//	GET    /rest/{model}?limit=&offset=&{field}=   findMany
+//	GET    /rest/{model}/{id}                      findUnique
+//	POST   /rest/{model}                           createOne
+//	PATCH  /rest/{model}/{id}                      updateOne
+//	DELETE /rest/{model}/{id}                      deleteOne
+func (h *Handler) serveREST(w http.ResponseWriter, r *http.Request) {
+	if h.restModels == nil {
+		writeRESTError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "the schema could not be loaded")
+		return
+	}
+	if r.URL.Path == restPrefix+"openapi.json" {
+		h.serveOpenAPI(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, restPrefix), "/"), "/")
+	model, ok := h.restModels[strings.ToLower(parts[0])]
+	if !ok || len(parts) > 2 {
+		writeRESTError(w, http.StatusNotFound, "NOT_FOUND", "unknown model")
+		return
+	}
+	if _, ok := h.rowFilters[model.Name]; ok {
+		// the REST queries aren't rewritten, use GraphQL for these models
+		writeRESTError(w, http.StatusForbidden, "FORBIDDEN", "the row filter of "+model.Name+" only applies to GraphQL requests")
+		return
+	}
+	if h.softDelete != nil && h.softDelete.models[model.Name] {
+		writeRESTError(w, http.StatusForbidden, "FORBIDDEN", "the soft deletes of "+model.Name+" only apply to GraphQL requests")
+		return
+	}
+	var id interface{}
+	if len(parts) == 2 {
+		var err error
+		if id, err = model.ID.value(parts[1]); err != nil {
+			writeRESTError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+			return
+		}
+	}
+
+	var (
+		query     string
+		variables = map[string]interface{}{}
+		write     = r.Method != http.MethodGet
+		err       error
+	)
+	switch {
+	case r.Method == http.MethodGet && id == nil:
+		query, err = restList(model, r, variables)
+	case r.Method == http.MethodGet:
+		variables["where"] = map[string]interface{}{model.ID.Name: id}
+		query, err = model.operation("query", "findUnique", "where")
+	case r.Method == http.MethodPost && id == nil:
+		if variables["data"], err = readRESTBody(r); err == nil {
+			query, err = model.operation("mutation", "createOne", "data")
+		}
+	case r.Method == http.MethodPatch && id != nil:
+		variables["where"] = map[string]interface{}{model.ID.Name: id}
+		if variables["data"], err = readRESTBody(r); err == nil {
+			query, err = model.operation("mutation", "updateOne", "data", "where")
+		}
+	case r.Method == http.MethodDelete && id != nil:
+		variables["where"] = map[string]interface{}{model.ID.Name: id}
+		query, err = model.operation("mutation", "deleteOne", "where")
+	default:
+		writeRESTError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method+" is not supported on this path")
+		return
+	}
+	if err != nil {
+		writeRESTError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if rules := h.currentAuthRules(); rules != nil {
+		op, _ := parseOperation(body)
+		if denied := rules.authorize(r.Context(), op); denied != nil {
+			h.sink.Count(metricAuthRuleDenials, 1)
+			writeRESTError(w, http.StatusForbidden, "FORBIDDEN", denied.Error())
+			return
+		}
+	}
+	if grants := h.grants(r.Context()); grants != nil && h.refuseUngranted(w, r, body, grants, writeRESTError) {
+		return
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, captureErrors: h.recent != nil}
+	w = rec
+	defer func() {
+		took := time.Since(start)
+		h.recordRequest(r.Context(), "rest", rec.status, took.Seconds())
+		h.logRequest(r, body, "rest", rec, took)
+	}()
+
+	if write && h.readOnly {
+		writeRESTError(w, http.StatusMethodNotAllowed, "READ_ONLY", "this instance is a read replica, send writes to the primary")
+		return
+	}
+	if h.storageRefuses(write) {
+		w.Header().Set("Retry-After", "5")
+		writeRESTError(w, http.StatusServiceUnavailable, "STORAGE_UNAVAILABLE", storageUnavailableMessage)
+		return
+	}
+	if h.driftRefuses(write) {
+		writeRESTError(w, http.StatusConflict, "SCHEMA_DRIFT", schemaDriftMessage)
+		return
+	}
+	if write && r.Method != http.MethodDelete && h.databaseFull() {
+		h.sink.Count(metricDatabaseFull, 1)
+		writeRESTError(w, http.StatusInsufficientStorage, "DATABASE_FULL", "database size limit reached, only reads and deletes are allowed")
+		return
+	}
+	data, err := h.callEngine(r.Context(), body, write)
+	if write {
+		h.databaseSize.Invalidate()
+		op, _ := parseOperation(body)
+		h.invalidateCounts(op)
+	}
+	if errors.Is(err, errWriteQueueTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeRESTError(w, http.StatusServiceUnavailable, "WRITE_QUEUE_TIMEOUT", writeQueueTimeoutMessage)
+		return
+	}
+	if errors.Is(err, errEnginePoolTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeRESTError(w, http.StatusServiceUnavailable, "ENGINE_BUSY", enginePoolTimeoutMessage)
+		return
+	}
+	if err != nil {
+		tracing.Logger(r.Context()).Error("REST bridge: query engine", slog.String("error", err.Error()))
+		writeRESTError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine could not be reached")
+		return
+	}
+	h.writeRESTResponse(w, r, data)
+}
+
+// restList builds a findMany query from the query parameters, which filter
+// by equality on scalar fields.
+func restList(model restModel, r *http.Request, variables map[string]interface{}) (string, error) {
+	take, skip := defaultRESTLimit, 0
+	where := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		value := values[0]
+		switch key {
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > maxRESTLimit {
+				return "", fmt.Errorf("limit must be between 0 and %d", maxRESTLimit)
+			}
+			take = n
+		case "offset":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return "", fmt.Errorf("offset must not be negative")
+			}
+			skip = n
+		default:
+			field, ok := model.field(key)
+			if !ok || field.List {
+				return "", fmt.Errorf("unknown filter %q", key)
+			}
+			v, err := field.value(value)
+			if err != nil {
+				return "", err
+			}
+			where[key] = map[string]interface{}{"equals": v}
+		}
+	}
+	variables["where"], variables["take"], variables["skip"] = where, take, skip
+	return model.operation("query", "findMany", "where", "take", "skip")
+}
+
+func (m restModel) field(name string) (restField, bool) {
+	for _, f := range m.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return restField{}, false
+}
+
+func readRESTBody(r *http.Request) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("body must be a JSON object: %v", err)
+	}
+	return data, nil
+}
+
+// callEngine sends a GraphQL request to the query engine, taking from the
+// same rate limits and write queue as GraphQL requests, and journals the
+// mutations.
+func (h *Handler) callEngine(ctx context.Context, body []byte, write bool) ([]byte, error) {
+	h.takeLimits(ctx, write)
+	if write {
+		release, err := h.enqueueWrite(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	data, err := h.postPooled(ctx, body)
+	if write && err == nil {
+		h.journalMutation(body, data)
+	}
+	return data, err
+}
+
+// postEngine sends a GraphQL request to the query engine and returns the
+// response body.
+func (h *Handler) postEngine(ctx context.Context, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.queryEngineURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	trace, _ := tracing.FromContext(ctx)
+	req.Header.Set("traceparent", trace.Traceparent())
+	end := tracing.Begin(trace)
+	defer end()
+	resp, err := h.doEngine(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if reason, ok := storageFailure(data); ok {
+		h.storageFailed(reason)
+	}
+	return data, err
+}
+
+// writeRESTResponse unwraps the result of the single root field, mapping
+// Prisma errors to status codes.
+func (h *Handler) writeRESTResponse(w http.ResponseWriter, r *http.Request, data []byte) {
+	if errs, _, _, err := jsonparser.Get(data, "errors"); err == nil && len(errs) > 2 {
+		code, _ := jsonparser.GetString(errs, "[0]", "user_facing_error", "error_code")
+		message, _ := jsonparser.GetString(errs, "[0]", "user_facing_error", "message")
+		if message == "" {
+			message, _ = jsonparser.GetString(errs, "[0]", "error")
+		}
+		status := http.StatusInternalServerError
+		switch {
+		case code == "P2025":
+			status = http.StatusNotFound
+		case code == "P2002":
+			status = http.StatusConflict
+		case code != "":
+			status = http.StatusBadRequest
+		default:
+			code = "INTERNAL_SERVER_ERROR"
+		}
+		writeRESTError(w, status, code, message)
+		return
+	}
+	var result json.RawMessage
+	_ = jsonparser.ObjectEach(data, func(_ []byte, value []byte, dataType jsonparser.ValueType, _ int) error {
+		if dataType == jsonparser.Null {
+			result = nil
+		} else {
+			result = value
+		}
+		return nil
+	}, "data")
+	if result == nil {
+		writeRESTError(w, http.StatusNotFound, "NOT_FOUND", "record not found")
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(result)
+}
+
+type restError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func writeRESTError(w http.ResponseWriter, status int, code, message string) {
+	var body restError
+	body.Error.Code, body.Error.Message = code, message
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,437 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// claimPrefix starts the strings of a row filter replaced by a claim of the
+// caller, like "$claims.sub".
+const claimPrefix = "$claims."
+
+// rowFilterActions are the prefixes of the root fields of a model, by what
+// the row filters do with them: "where" merges the filter into the where
+// argument, "unique" turns a findUnique into a findFirst with the merged
+// filter and "reject" refuses the operation, the filter can't restrict it.
+var rowFilterActions = []struct {
+	prefix, action string
+}{
+	{"findUnique", "unique"},
+	{"findFirst", "where"},
+	{"findMany", "where"},
+	{"aggregate", "where"},
+	{"groupBy", "where"},
+	{"updateMany", "where"},
+	{"deleteMany", "where"},
+	{"createOne", "reject"},
+	{"createMany", "reject"},
+	{"updateOne", "reject"},
+	{"deleteOne", "reject"},
+	{"upsertOne", "reject"},
+}
+
+// rawFields run SQL or database commands no filter can restrict.
+var rawFields = map[string]bool{"executeRaw": true, "queryRaw": true, "runCommandRaw": true}
+
+// rowFilterError is why an operation was refused by the row filters.
+type rowFilterError struct {
+	Message string
+}
+
+func (e *rowFilterError) Error() string {
+	return e.Message
+}
+
+// newRowFilters decodes the filter templates by model, numbers are kept as
+// written. A template that doesn't decode is kept as its error, which
+// refuses the operations of its model.
+func newRowFilters(templates map[string]json.RawMessage) map[string]interface{} {
+	if len(templates) == 0 {
+		return nil
+	}
+	filters := map[string]interface{}{}
+	for model, template := range templates {
+		decoder := json.NewDecoder(bytes.NewReader(template))
+		decoder.UseNumber()
+		var filter map[string]interface{}
+		if err := decoder.Decode(&filter); err != nil {
+			filters[model] = err
+			continue
+		}
+		filters[model] = filter
+	}
+	return filters
+}
+
+// requestClaims are the claims row filters can reference: sub is the
+// caller the request was authenticated as.
+func requestClaims(ctx context.Context) map[string]string {
+	claims := map[string]string{}
+	if caller := Caller(ctx); caller != "" {
+		claims["sub"] = caller
+	}
+	return claims
+}
+
+// filterRows rewrites the operation of body so every field of a model with
+// a row filter only sees the rows the filter matches: the filter is merged
+// into the where argument of root fields and of list relations selected
+// below any field as where: {AND: [<where>, <filter>]}, or becomes the
+// where argument if there is none. Operations that can't be rewritten
+// safely, like raw queries, creates of a filtered model, single relations
+// to one or relation counts of one, and filters referencing claims the
+// request doesn't carry are refused with a *rowFilterError. index is the
+// schema the relations are looked up in.
+func filterRows(body []byte, filters map[string]interface{}, claims map[string]string, index *schemaIndex) ([]byte, error) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return nil, &rowFilterError{"the request has no query"}
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return nil, &rowFilterError{"the query could not be parsed"}
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 {
+		return nil, &rowFilterError{fmt.Sprintf("operation %q not found", operationName)}
+	}
+	if !doc.OperationDefinitions[op].HasSelections {
+		return body, nil
+	}
+	root := "Query"
+	if doc.OperationDefinitions[op].OperationType == ast.OperationTypeMutation {
+		root = "Mutation"
+	}
+
+	w := &rowFilterWalk{
+		doc:      &doc,
+		query:    query,
+		index:    index,
+		filters:  filters,
+		claims:   claims,
+		rendered: map[string]string{},
+		edits:    map[uint32]queryEdit{},
+		visited:  map[string]bool{},
+	}
+	set := doc.OperationDefinitions[op].SelectionSet
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		if doc.Selections[ref].Kind != ast.SelectionKindField {
+			return nil, &rowFilterError{"fragments on the root type can't be restricted by the row filters"}
+		}
+		field := doc.Selections[ref].Ref
+		name := doc.FieldNameString(field)
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		action, model := splitRootField(name)
+		if rawFields[name] || (filters[model] == nil && strings.HasSuffix(model, "Raw") && filters[strings.TrimSuffix(model, "Raw")] != nil) {
+			return nil, &rowFilterError{name + " can't be restricted by the row filters"}
+		}
+		if _, ok := filters[model]; ok {
+			if action == "" || action == "reject" {
+				return nil, &rowFilterError{name + " can't be restricted by the row filter of " + model}
+			}
+			text, err := w.filter(model)
+			if err != nil {
+				return nil, err
+			}
+			if action == "unique" {
+				if !renameUnique(&doc, query, field, w.edits) {
+					return nil, &rowFilterError{name + " can only be restricted by the row filter of " + model + " with a literal where argument"}
+				}
+			}
+			mergeWhere(&doc, query, text, field, w.edits)
+		}
+		if typeName := index.fields[root][name].typ; doc.Fields[field].HasSelections && typeName != "" {
+			if err := w.selections(doc.Fields[field].SelectionSet, typeName); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(w.edits) == 0 {
+		return body, nil
+	}
+	// Set may write to the array of its input
+	return jsonparser.Set(append([]byte(nil), body...), applyEdits(query, w.edits), "query")
+}
+
+// rowFilterWalk rewrites an operation through the selections below its
+// root fields and their fragments.
+type rowFilterWalk struct {
+	doc      *ast.Document
+	query    string
+	index    *schemaIndex
+	filters  map[string]interface{}
+	claims   map[string]string
+	rendered map[string]string
+	edits    map[uint32]queryEdit
+	visited  map[string]bool
+}
+
+// filter returns the row filter of model rendered for the claims.
+func (w *rowFilterWalk) filter(model string) (string, error) {
+	if text, ok := w.rendered[model]; ok {
+		return text, nil
+	}
+	text, err := renderFilter(w.filters[model], w.claims)
+	if err != nil {
+		return "", &rowFilterError{fmt.Sprintf("the row filter of %s %v", model, err)}
+	}
+	w.rendered[model] = text
+	return text, nil
+}
+
+func (w *rowFilterWalk) selections(set int, typeName string) error {
+	doc := w.doc
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			field := selection.Ref
+			name := doc.FieldNameString(field)
+			def, ok := w.index.fields[typeName][name]
+			if !ok {
+				continue
+			}
+			if name == "_count" && doc.Fields[field].HasSelections {
+				if err := w.counts(doc.Fields[field].SelectionSet, typeName); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, ok := w.filters[def.typ]; ok {
+				// list relations take a where argument, single ones can't
+				// be filtered
+				if _, list := def.args["where"]; !list {
+					return &rowFilterError{"the relation " + typeName + "." + name + " can't be restricted by the row filter of " + def.typ}
+				}
+				text, err := w.filter(def.typ)
+				if err != nil {
+					return err
+				}
+				mergeWhere(doc, w.query, text, field, w.edits)
+			}
+			if doc.Fields[field].HasSelections {
+				if err := w.selections(doc.Fields[field].SelectionSet, def.typ); err != nil {
+					return err
+				}
+			}
+		case ast.SelectionKindInlineFragment:
+			condition := typeName
+			if name := doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment := doc.InlineFragments[selection.Ref]; fragment.HasSelections {
+				if err := w.selections(fragment.SelectionSet, condition); err != nil {
+					return err
+				}
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || w.visited[name] {
+					continue
+				}
+				w.visited[name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					if err := w.selections(doc.FragmentDefinitions[i].SelectionSet, string(doc.FragmentDefinitionTypeName(i))); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// counts refuses the relation counts of typeName selected in set that
+// would count the rows of a filtered model, the counts take no filter.
+func (w *rowFilterWalk) counts(set int, typeName string) error {
+	for _, ref := range w.doc.SelectionSets[set].SelectionRefs {
+		if w.doc.Selections[ref].Kind != ast.SelectionKindField {
+			return &rowFilterError{"fragments on the relation counts of " + typeName + " can't be restricted by the row filters"}
+		}
+		name := w.doc.FieldNameString(w.doc.Selections[ref].Ref)
+		model := w.index.fields[typeName][name].typ
+		if _, ok := w.filters[model]; ok {
+			return &rowFilterError{"the count of " + typeName + "." + name + " can't be restricted by the row filter of " + model}
+		}
+	}
+	return nil
+}
+
+// splitRootField splits a root field like findManyOrder into its action
+// and model, the action is empty if the field isn't one of a model.
+func splitRootField(name string) (action, model string) {
+	for _, a := range rowFilterActions {
+		if strings.HasPrefix(name, a.prefix) && len(name) > len(a.prefix) {
+			return a.action, strings.TrimSuffix(name[len(a.prefix):], "OrThrow")
+		}
+	}
+	return "", ""
+}
+
+// renameUnique turns a findUnique field into the findFirst of the model,
+// keeping its response key, so its where argument can take the filter. The
+// unique where must be an object literal, a variable is typed as the
+// unique input.
+func renameUnique(doc *ast.Document, query string, field int, edits map[uint32]queryEdit) bool {
+	where, ok := fieldArgument(doc, field, "where")
+	if !ok || doc.Arguments[where].Value.Kind != ast.ValueKindObject {
+		return false
+	}
+	name := doc.Fields[field].Name
+	text := "findFirst" + strings.TrimPrefix(query[name.Start:name.End], "findUnique")
+	if !doc.FieldAliasIsDefined(field) {
+		text = query[name.Start:name.End] + ": " + text
+	}
+	edits[name.Start] = queryEdit{end: name.End, text: text}
+	return true
+}
+
+// mergeWhere adds filter to the where argument of field.
+func mergeWhere(doc *ast.Document, query, filter string, field int, edits map[uint32]queryEdit) {
+	f := doc.Fields[field]
+	where, ok := fieldArgument(doc, field, "where")
+	if !ok {
+		if f.HasArguments && len(f.Arguments.Refs) > 0 {
+			start := doc.Arguments[f.Arguments.Refs[0]].Name.Start
+			edits[start] = queryEdit{end: start, text: "where: " + filter + ", "}
+			return
+		}
+		edits[f.Name.End] = queryEdit{end: f.Name.End, text: "(where: " + filter + ")"}
+		return
+	}
+	start, end := argumentValue(query, int(doc.Arguments[where].Name.End))
+	if doc.Arguments[where].Value.Kind == ast.ValueKindNull {
+		edits[uint32(start)] = queryEdit{end: uint32(end), text: filter}
+		return
+	}
+	edits[uint32(start)] = queryEdit{end: uint32(start), text: "{AND: ["}
+	edits[uint32(end)] = queryEdit{end: uint32(end), text: ", " + filter + "]}"}
+}
+
+func fieldArgument(doc *ast.Document, field int, name string) (int, bool) {
+	for _, arg := range doc.Fields[field].Arguments.Refs {
+		if doc.ArgumentNameString(arg) == name {
+			return arg, true
+		}
+	}
+	return -1, false
+}
+
+// argumentValue returns the byte range of the value of the argument whose
+// name ends at i.
+func argumentValue(query string, i int) (start, end int) {
+	i = skipIgnoredAndComments(query, i)
+	if i < len(query) && query[i] == ':' {
+		i = skipIgnoredAndComments(query, i+1)
+	}
+	start = i
+	if i < len(query) && (query[i] == '{' || query[i] == '[') {
+		depth := 0
+		for i < len(query) {
+			switch query[i] {
+			case '"':
+				i += stringLength(query[i:])
+				continue
+			case '#':
+				i = skipIgnoredAndComments(query, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return start, i + 1
+				}
+			}
+			i++
+		}
+		return start, i
+	}
+	if i < len(query) && query[i] == '"' {
+		return start, i + stringLength(query[i:])
+	}
+	for i < len(query) && !strings.ContainsRune(" \t\r\n,)#", rune(query[i])) {
+		i++
+	}
+	return start, i
+}
+
+// skipIgnoredAndComments skips whitespace, commas and comments from i.
+func skipIgnoredAndComments(s string, i int) int {
+	for {
+		i = skipIgnored(s, i)
+		if i >= len(s) || s[i] != '#' {
+			return i
+		}
+		for i < len(s) && s[i] != '\n' && s[i] != '\r' {
+			i++
+		}
+	}
+}
+
+// renderFilter writes a filter template as a GraphQL input value, with the
+// claims it references filled in.
+func renderFilter(value interface{}, claims map[string]string) (string, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := make([]string, 0, len(keys))
+		for _, key := range keys {
+			text, err := renderFilter(v[key], claims)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, key+": "+text)
+		}
+		return "{" + strings.Join(fields, ", ") + "}", nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			text, err := renderFilter(item, claims)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case string:
+		if strings.HasPrefix(v, claimPrefix) {
+			claim := strings.TrimPrefix(v, claimPrefix)
+			value, ok := claims[claim]
+			if !ok {
+				return "", fmt.Errorf("references the claim %s the request doesn't carry", claim)
+			}
+			v = value
+		}
+		out, _ := json.Marshal(v)
+		return string(out), nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "true", nil
+		}
+		return "false", nil
+	case nil:
+		return "null", nil
+	case error:
+		return "", fmt.Errorf("is invalid: %v", v)
+	}
+	return "", fmt.Errorf("has a value of unsupported type %T", value)
+}
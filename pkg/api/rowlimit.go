@@ -0,0 +1,303 @@
+package api
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// schemaField is a field of an object type in the query engine's SDL.
+type schemaField struct {
+	// typ is the named type, without list and non-null wrappers
+	typ  string
+	list bool
+	// take reports whether the field has the take pagination argument
+	take bool
+}
+
+// schemaFields indexes the fields of the object types in sdl by type and
+// field name.
+func schemaFields(sdl []byte) map[string]map[string]schemaField {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil
+	}
+	types := map[string]map[string]schemaField{}
+	for i := range doc.ObjectTypeDefinitions {
+		fields := map[string]schemaField{}
+		for _, ref := range doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs {
+			def := doc.FieldDefinitions[ref]
+			field := schemaField{typ: doc.ResolveTypeNameString(def.Type)}
+			for typ := def.Type; typ != -1; typ = doc.Types[typ].OfType {
+				if doc.Types[typ].TypeKind == ast.TypeKindList {
+					field.list = true
+				}
+			}
+			for _, arg := range def.ArgumentsDefinition.Refs {
+				if doc.InputValueDefinitionNameString(arg) == "take" {
+					field.take = true
+				}
+			}
+			fields[doc.FieldDefinitionNameString(ref)] = field
+		}
+		types[doc.ObjectTypeDefinitionNameString(i)] = fields
+	}
+	return types
+}
+
+// rowLimit caps the rows a request can return by rewriting the take
+// argument of every paginated list field it selects.
+type rowLimit struct {
+	max   int
+	query string
+	doc   *ast.Document
+	// edits replace byte ranges of query, by start offset
+	edits map[uint32]queryEdit
+	// variables passed as take, with the paths of the fields they're
+	// passed to
+	variables map[string][]string
+	// capped lists the response paths of the capped fields
+	capped []string
+}
+
+// queryEdit replaces the bytes of a query from the offset it is stored by
+// up to end with text.
+type queryEdit struct {
+	end  uint32
+	text string
+}
+
+// rowLimitExtension is added to the response extensions when fields were
+// capped.
+type rowLimitExtension struct {
+	MaxRows int      `json:"maxRows"`
+	Fields  []string `json:"fields"`
+}
+
+// limitRows rewrites the request body so no list field returns more than
+// max rows: a take argument above the limit is lowered to it, a missing one
+// is added, and a take variable is set to the limit if it exceeds it. It
+// returns the body unchanged and no extension if nothing had to be capped,
+// the operation is exempt or the document doesn't parse, which the engine
+// then reports.
+func limitRows(body []byte, max int, exempt map[string]bool, fields map[string]map[string]schemaField) ([]byte, *rowLimitExtension) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return body, nil
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return body, nil
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 || exempt[doc.OperationDefinitionNameString(op)] {
+		return body, nil
+	}
+	root := "Query"
+	if doc.OperationDefinitions[op].OperationType == ast.OperationTypeMutation {
+		root = "Mutation"
+	}
+
+	l := &rowLimit{
+		max:       max,
+		query:     query,
+		doc:       &doc,
+		edits:     map[uint32]queryEdit{},
+		variables: map[string][]string{},
+	}
+	if doc.OperationDefinitions[op].HasSelections {
+		walkListFields(&doc, fields, doc.OperationDefinitions[op].SelectionSet, root, "", map[string]bool{}, l.capTake)
+	}
+	values := l.variableValues(op, body)
+	for name := range values {
+		l.capped = append(l.capped, l.variables[name]...)
+	}
+	if len(l.capped) == 0 {
+		return body, nil
+	}
+
+	// Set may write to the array of its input, body is kept for errors
+	out := append([]byte(nil), body...)
+	if len(l.edits) > 0 {
+		if out, err = jsonparser.Set(out, l.rewrittenQuery(), "query"); err != nil {
+			return body, nil
+		}
+	}
+	for name, value := range values {
+		if out, err = jsonparser.Set(out, []byte(strconv.Itoa(value)), "variables", name); err != nil {
+			return body, nil
+		}
+	}
+	sort.Strings(l.capped)
+	return out, &rowLimitExtension{MaxRows: max, Fields: l.capped}
+}
+
+// selectOperation returns the operation named operationName, or the first
+// if it is empty. It returns -1 if there is no such operation.
+func selectOperation(doc *ast.Document, operationName string) int {
+	for i := range doc.OperationDefinitions {
+		if operationName == "" || doc.OperationDefinitionNameString(i) == operationName {
+			return i
+		}
+	}
+	return -1
+}
+
+// walkListFields calls visit with every paginated list field selected by
+// set on the type typeName, and its response path. path is the response
+// path of the selection set, visited keeps fragments from being walked
+// twice on one path.
+func walkListFields(doc *ast.Document, fields map[string]map[string]schemaField, set int, typeName, path string, visited map[string]bool, visit func(field int, path string)) {
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			field := doc.Fields[selection.Ref]
+			def, ok := fields[typeName][doc.FieldNameString(selection.Ref)]
+			if !ok {
+				continue
+			}
+			fieldPath := doc.FieldAliasOrNameString(selection.Ref)
+			if path != "" {
+				fieldPath = path + "." + fieldPath
+			}
+			if def.list && def.take {
+				visit(selection.Ref, fieldPath)
+			}
+			if field.HasSelections {
+				walkListFields(doc, fields, field.SelectionSet, def.typ, fieldPath, visited, visit)
+			}
+		case ast.SelectionKindInlineFragment:
+			fragment := doc.InlineFragments[selection.Ref]
+			condition := typeName
+			if name := doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment.HasSelections {
+				walkListFields(doc, fields, fragment.SelectionSet, condition, path, visited, visit)
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || visited[path+"/"+name] {
+					continue
+				}
+				visited[path+"/"+name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					walkListFields(doc, fields, doc.FragmentDefinitions[i].SelectionSet, string(doc.FragmentDefinitionTypeName(i)), path, visited, visit)
+				}
+			}
+		}
+	}
+}
+
+// capTake lowers or adds the take argument of a field.
+func (l *rowLimit) capTake(field int, path string) {
+	doc := l.doc
+	f := doc.Fields[field]
+	for _, arg := range f.Arguments.Refs {
+		if doc.ArgumentNameString(arg) != "take" {
+			continue
+		}
+		value := doc.Arguments[arg].Value
+		switch value.Kind {
+		case ast.ValueKindInteger:
+			raw := doc.IntValues[value.Ref].Raw
+			n, err := strconv.Atoi(l.query[raw.Start:raw.End])
+			if err != nil || n > l.max {
+				// a negative take counts backwards, the sign stays
+				l.edits[raw.Start] = queryEdit{end: raw.End, text: strconv.Itoa(l.max)}
+				l.capped = append(l.capped, path)
+			}
+		case ast.ValueKindVariable:
+			name := doc.VariableValueNameString(value.Ref)
+			l.variables[name] = append(l.variables[name], path)
+		case ast.ValueKindNull:
+			l.capped = append(l.capped, path)
+			pos := doc.Arguments[arg].Name
+			end := pos.End
+			// replace "take: null" as a whole
+			if i := strings.Index(l.query[end:], "null"); i >= 0 {
+				end += uint32(i + len("null"))
+			}
+			l.edits[pos.Start] = queryEdit{end: end, text: "take: " + strconv.Itoa(l.max)}
+		}
+		return
+	}
+	l.capped = append(l.capped, path)
+	if f.HasArguments && len(f.Arguments.Refs) > 0 {
+		start := doc.Arguments[f.Arguments.Refs[0]].Name.Start
+		l.edits[start] = queryEdit{end: start, text: "take: " + strconv.Itoa(l.max) + ", "}
+		return
+	}
+	end := f.Name.End
+	l.edits[end] = queryEdit{end: end, text: "(take: " + strconv.Itoa(l.max) + ")"}
+}
+
+// rewrittenQuery applies the edits and returns the query as a JSON string.
+func (l *rowLimit) rewrittenQuery() []byte {
+	return applyEdits(l.query, l.edits)
+}
+
+// applyEdits applies edits to query and returns it as a JSON string.
+func applyEdits(query string, edits map[uint32]queryEdit) []byte {
+	starts := make([]int, 0, len(edits))
+	for start := range edits {
+		starts = append(starts, int(start))
+	}
+	sort.Ints(starts)
+	var b strings.Builder
+	last := 0
+	for _, start := range starts {
+		edit := edits[uint32(start)]
+		b.WriteString(query[last:start])
+		b.WriteString(edit.text)
+		last = int(edit.end)
+	}
+	b.WriteString(query[last:])
+	out, _ := json.Marshal(b.String())
+	return out
+}
+
+// variableValues returns the take variables whose value, or default,
+// exceeds the limit, with the value to send instead. A negative value keeps
+// its sign.
+func (l *rowLimit) variableValues(op int, body []byte) map[string]int {
+	doc := l.doc
+	defaults := map[string]string{}
+	for _, ref := range doc.OperationDefinitions[op].VariableDefinitions.Refs {
+		def := doc.VariableDefinitions[ref]
+		if def.DefaultValue.IsDefined && def.DefaultValue.Value.Kind == ast.ValueKindInteger {
+			v := doc.IntValues[def.DefaultValue.Value.Ref]
+			value := l.query[v.Raw.Start:v.Raw.End]
+			if v.Negative {
+				value = "-" + value
+			}
+			defaults[doc.VariableDefinitionNameString(ref)] = value
+		}
+	}
+	values := map[string]int{}
+	for name := range l.variables {
+		raw, typ, _, err := jsonparser.Get(body, "variables", name)
+		value := string(raw)
+		if err != nil || typ == jsonparser.Null {
+			value = defaults[name]
+		}
+		n, err := strconv.Atoi(value)
+		switch {
+		case err != nil:
+			values[name] = l.max
+		case n > l.max:
+			values[name] = l.max
+		case n < -l.max:
+			values[name] = -l.max
+		}
+	}
+	return values
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// SchemaVersionHeader carries the version of the schema on every response,
+// for long-lived clients to notice it changed.
+const SchemaVersionHeader = "X-Wunderbase-Schema-Version"
+
+const (
+	schemaVersionPath = "/schema/version"
+	// schemaStreamPing keeps idle proxies from closing a stream
+	schemaStreamPing = 30 * time.Second
+)
+
+// schemaVersion is the version of a schema: the start of the SHA-256 of its
+// SDL, so it changes if and only if the SDL does.
+func schemaVersion(sdl []byte) string {
+	sum := sha256.Sum256(sdl)
+	return hex.EncodeToString(sum[:8])
+}
+
+// schemaWatchers are the streams waiting for the schema to change, and the
+// version they were last told about.
+type schemaWatchers struct {
+	mu       sync.Mutex
+	version  string
+	watchers map[chan string]struct{}
+	// done is closed to end the streams, when the server shuts down
+	done   chan struct{}
+	closed bool
+}
+
+func newSchemaWatchers() *schemaWatchers {
+	return &schemaWatchers{watchers: map[chan string]struct{}{}, done: make(chan struct{})}
+}
+
+// publish records the version of the schema just read and tells the
+// watchers if it isn't the one read before.
+func (s *schemaWatchers) publish(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.version
+	s.version = version
+	if previous == "" || previous == version {
+		return
+	}
+	slog.Info("Schema changed", slog.String("version", version), slog.String("previous", previous),
+		slog.Int("streams", len(s.watchers)))
+	for watcher := range s.watchers {
+		// a change the stream hasn't sent yet is replaced by the latest
+		select {
+		case <-watcher:
+		default:
+		}
+		watcher <- version
+	}
+}
+
+func (s *schemaWatchers) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.version
+}
+
+func (s *schemaWatchers) watch() chan string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watcher := make(chan string, 1)
+	s.watchers[watcher] = struct{}{}
+	return watcher
+}
+
+func (s *schemaWatchers) unwatch(watcher chan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watchers, watcher)
+}
+
+func (s *schemaWatchers) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// CloseStreams ends the schema version streams, which would otherwise hold
+// up a graceful shutdown. It is meant for http.Server.RegisterOnShutdown.
+func (h *Handler) CloseStreams() {
+	h.schemaWatchers.close()
+}
+
+// refreshSchema reads the schema again after it may have changed, so the
+// streams learn about it right away.
+func (h *Handler) refreshSchema() {
+	if _, err := h.schema(); err != nil {
+		slog.Debug("Reading the schema for its version", slog.String("error", err.Error()))
+	}
+}
+
+// schemaVersionInfo is the JSON served on /schema/version and sent by its
+// stream.
+type schemaVersionInfo struct {
+	Version string `json:"version"`
+}
+
+// serveSchemaVersion serves the version of the schema, or with Accept:
+// text/event-stream a stream sending schema_changed events with the new
+// version until the client leaves.
+func (h *Handler) serveSchemaVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "the schema version only answers GET")
+		return
+	}
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("schema version", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(schemaVersionInfo{Version: schema.version})
+		return
+	}
+
+	watcher := h.schemaWatchers.watch()
+	defer h.schemaWatchers.unwatch(watcher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	send := func(event, version string) {
+		data, _ := json.Marshal(schemaVersionInfo{Version: version})
+		_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+	// the version the stream starts from, a change may have come since
+	send("schema_version", schema.version)
+	if current := h.schemaWatchers.current(); current != "" && current != schema.version {
+		send("schema_changed", current)
+	}
+	ping := time.NewTicker(schemaStreamPing)
+	defer ping.Stop()
+	for {
+		select {
+		case version := <-watcher:
+			send("schema_changed", version)
+		case <-ping.C:
+			_, _ = fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.schemaWatchers.done:
+			return
+		}
+	}
+}
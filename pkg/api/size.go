@@ -0,0 +1,83 @@
+package api
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// sizeRefreshInterval bounds how stale the cached size may get when writes
+// happen outside of this process (e.g. litefs replication).
+const sizeRefreshInterval = 5 * time.Second
+
+// sizeGuard caches the on-disk size of the SQLite database so the write
+// path doesn't stat the file on every request.
+type sizeGuard struct {
+	path  string
+	limit int64
+
+	mu      sync.Mutex
+	size    int64
+	checked time.Time
+}
+
+func newSizeGuard(path string, limitMB int) *sizeGuard {
+	return &sizeGuard{
+		path:  path,
+		limit: int64(limitMB) * 1024 * 1024,
+	}
+}
+
+// Size returns the combined size of the database and its WAL file.
+func (g *sizeGuard) Size() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checked) < sizeRefreshInterval {
+		return g.size
+	}
+	var size int64
+	for _, path := range []string{g.path, g.path + "-wal"} {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	g.size = size
+	g.checked = time.Now()
+	return g.size
+}
+
+// Invalidate forces the next Size call to stat the files again.
+func (g *sizeGuard) Invalidate() {
+	g.mu.Lock()
+	g.checked = time.Time{}
+	g.mu.Unlock()
+}
+
+// Limit returns the limit in bytes, 0 means unlimited.
+func (g *sizeGuard) Limit() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limit
+}
+
+// SetLimit changes the limit at runtime.
+func (g *sizeGuard) SetLimit(limitMB int) {
+	g.mu.Lock()
+	g.limit = int64(limitMB) * 1024 * 1024
+	g.mu.Unlock()
+}
+
+// UsedRatio returns the fraction of the limit in use, or 0 without a limit.
+func (g *sizeGuard) UsedRatio() float64 {
+	limit := g.Limit()
+	if limit <= 0 {
+		return 0
+	}
+	return float64(g.Size()) / float64(limit)
+}
+
+// Full reports whether the database reached the configured limit.
+func (g *sizeGuard) Full() bool {
+	limit := g.Limit()
+	return limit > 0 && g.Size() >= limit
+}
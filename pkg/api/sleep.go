@@ -0,0 +1,308 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"wunderbase/pkg/tracing"
+)
+
+const (
+	// maxSleepEvents is the size of the sleep event ring buffer
+	maxSleepEvents = 50
+	// defaultKeepAlive is the keepalive duration without ?for=
+	defaultKeepAlive = 5 * time.Minute
+)
+
+// Sleep event kinds: keepalive extended the deadline, idle and manual put
+// the instance to sleep.
+const (
+	sleepEventKeepAlive = "keepalive"
+	sleepEventIdle      = "idle"
+	sleepEventManual    = "manual"
+)
+
+// What resets the sleep timer: every request, only writes, or nothing, so
+// the instance sleeps sleepAfter after it started unless kept alive.
+const (
+	SleepResetAll    = "all"
+	SleepResetWrites = "writes"
+	SleepResetNone   = "none"
+)
+
+// sleepEvent is an entry of the sleep event history.
+type sleepEvent struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Until is the deadline a keepalive extended the sleep timer to.
+	Until *time.Time `json:"until,omitempty"`
+	// LastReset is the request that last reset the sleep timer before the
+	// instance went to sleep.
+	LastReset *sleepActivity `json:"lastReset,omitempty"`
+}
+
+// sleepActivity is what a request did, filled in as the handler learns it,
+// to decide whether it resets the sleep timer.
+type sleepActivity struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"requestId,omitempty"`
+	Type          string    `json:"type,omitempty"`
+	OperationName string    `json:"operationName,omitempty"`
+	Caller        string    `json:"caller,omitempty"`
+	Write         bool      `json:"write"`
+}
+
+// sleepHistory keeps the latest sleep events.
+type sleepHistory struct {
+	mu     sync.Mutex
+	events []sleepEvent
+}
+
+func (s *sleepHistory) add(event sleepEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if len(s.events) > maxSleepEvents {
+		s.events = s.events[len(s.events)-maxSleepEvents:]
+	}
+}
+
+// list returns the events, latest first.
+func (s *sleepHistory) list() []sleepEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]sleepEvent, len(s.events))
+	for i, event := range s.events {
+		events[len(events)-1-i] = event
+	}
+	return events
+}
+
+// sleepTimer is when the instance goes to sleep: after sleepAfter without
+// requests resetting it, or later if a keepalive asked for it. Requests,
+// keepalives and reloads move it under mu while runSleepMode waits for it.
+type sleepTimer struct {
+	mu          sync.Mutex
+	after       time.Duration
+	lastRequest time.Time
+	keepAlive   time.Time
+	// lastReset is the request that last reset the timer, nil before one
+	lastReset *sleepActivity
+	// changed wakes runSleepMode up to read the deadline again. It holds a
+	// single wakeup, so moving the timer never blocks, not even once the
+	// instance went to sleep and nothing reads it anymore.
+	changed chan struct{}
+}
+
+func newSleepTimer(after time.Duration) *sleepTimer {
+	return &sleepTimer{after: after, changed: make(chan struct{}, 1)}
+}
+
+// notify wakes runSleepMode up unless a wakeup is already pending.
+func (t *sleepTimer) notify() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// start starts the timer when the instance starts.
+func (t *sleepTimer) start(now time.Time) {
+	t.mu.Lock()
+	t.lastRequest = now
+	t.mu.Unlock()
+}
+
+// reset restarts the timer after the request activity.
+func (t *sleepTimer) reset(now time.Time, activity *sleepActivity) {
+	t.mu.Lock()
+	t.lastRequest, t.lastReset = now, activity
+	t.mu.Unlock()
+	t.notify()
+}
+
+// keepAliveUntil moves the deadline to until, unless it is later already,
+// and returns the deadline kept.
+func (t *sleepTimer) keepAliveUntil(until time.Time) time.Time {
+	t.mu.Lock()
+	if t.keepAlive.After(until) {
+		until = t.keepAlive
+	}
+	t.keepAlive = until
+	t.mu.Unlock()
+	t.notify()
+	return until
+}
+
+// setAfter changes sleepAfter on a reload.
+func (t *sleepTimer) setAfter(after time.Duration) {
+	t.mu.Lock()
+	t.after = after
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *sleepTimer) sleepAfter() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.after
+}
+
+// state returns the request that last reset the timer and whether the
+// timer started.
+func (t *sleepTimer) state() (*sleepActivity, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastReset, !t.lastRequest.IsZero()
+}
+
+// in is the time left until the instance goes to sleep.
+func (t *sleepTimer) in(now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	remaining := t.after - now.Sub(t.lastRequest)
+	if kept := t.keepAlive.Sub(now); kept > remaining {
+		remaining = kept
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// resetSleep restarts the sleep timer after a request, unless the request
+// doesn't count as activity: a read with SleepResetWrites, any request with
+// SleepResetNone, or an exempt operation.
+func (h *Handler) resetSleep(ctx context.Context, activity *sleepActivity) {
+	switch {
+	case h.sleepResetOn == SleepResetNone,
+		h.sleepResetOn == SleepResetWrites && !activity.Write,
+		activity.OperationName != "" && h.sleepResetExempt[activity.OperationName]:
+		return
+	}
+	now := time.Now()
+	reset := *activity
+	reset.Time = now.UTC()
+	if trace, ok := tracing.FromContext(ctx); ok {
+		reset.RequestID = trace.RequestID
+	}
+	reset.Caller = Caller(ctx)
+	h.sleep.reset(now, &reset)
+}
+
+// sleepIn is the time left until the instance goes to sleep: sleepAfter
+// after the last request, or later if a keepalive asked for it.
+func (h *Handler) sleepIn() time.Duration {
+	return h.sleep.in(time.Now())
+}
+
+// serveKeepAlive keeps the instance awake for ?for=, at most keepAliveMax,
+// without counting as a request.
+func (h *Handler) serveKeepAlive(w http.ResponseWriter, r *http.Request) {
+	if !h.allowSleepControl(w, r) {
+		return
+	}
+	keep := defaultKeepAlive
+	if value := r.URL.Query().Get("for"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, h.plainTextErrors, http.StatusBadRequest, "BAD_REQUEST", "for must be a positive duration like 300s")
+			return
+		}
+		keep = d
+	}
+	if keep > h.keepAliveMax {
+		keep = h.keepAliveMax
+	}
+	until := h.sleep.keepAliveUntil(time.Now().Add(keep))
+	h.sleepEvents.add(sleepEvent{Time: time.Now().UTC(), Kind: sleepEventKeepAlive, Until: &until})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"until":          until.UTC(),
+		"sleepInSeconds": h.sleepIn().Seconds(),
+	})
+}
+
+// serveSleep puts the instance to sleep now. The server drains the requests
+// in flight before stopping, like after the sleep timeout.
+func (h *Handler) serveSleep(w http.ResponseWriter, r *http.Request) {
+	if !h.allowSleepControl(w, r) {
+		return
+	}
+	select {
+	case h.sleepNow <- struct{}{}:
+	default:
+		// a sleep is already pending
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// allowSleepControl answers requests the sleep endpoints can't serve and
+// reports whether the request may proceed.
+func (h *Handler) allowSleepControl(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return false
+	}
+	if !h.enableSleepMode {
+		writeError(w, h.plainTextErrors, http.StatusConflict, "SLEEP_MODE_DISABLED", "sleep mode is disabled")
+		return false
+	}
+	return true
+}
+
+// preStop refuses new requests for the pre-stop delay once the instance
+// decided to sleep, so the platform's proxy takes it out of rotation before
+// it stops. The decision can't be called off anymore.
+func (h *Handler) preStop() {
+	if h.sleepPreStop <= 0 {
+		return
+	}
+	atomic.StoreInt32(&h.preStopping, 1)
+	slog.Info("Refusing new requests before going to sleep", slog.Duration("preStop", h.sleepPreStop))
+	time.Sleep(h.sleepPreStop)
+}
+
+// stopping reports whether the instance refuses new requests before it
+// stops.
+func (h *Handler) stopping() bool {
+	return atomic.LoadInt32(&h.owner().preStopping) == 1
+}
+
+// refuseStopping answers a request arriving during the pre-stop delay with
+// 503 and the stop header, like fly-replay: elsewhere=true making the Fly.io
+// proxy retry it on another machine.
+func (h *Handler) refuseStopping(w http.ResponseWriter, r *http.Request) {
+	owner := h.owner()
+	if owner.stopHeader != "" {
+		w.Header().Set(owner.stopHeader, owner.stopHeaderValue)
+	}
+	w.Header().Set("Retry-After", "1")
+	h.sink.Count(metricStoppingRejections, 1)
+	if strings.HasPrefix(r.URL.Path, restPrefix) {
+		writeRESTError(w, http.StatusServiceUnavailable, "STOPPING", "the instance is going to sleep, retry shortly")
+		return
+	}
+	writeError(w, h.plainTextErrors, http.StatusServiceUnavailable, "STOPPING", "the instance is going to sleep, retry shortly")
+}
+
+// logSleep records the instance going to sleep, with the request that kept
+// it awake last.
+func (h *Handler) logSleep(kind string) {
+	lastReset, _ := h.sleep.state()
+	h.sleepEvents.add(sleepEvent{Time: time.Now().UTC(), Kind: kind, LastReset: lastReset})
+	h.sink.Count(metricSleepEvents, 1)
+	attrs := []interface{}{slog.String("reason", kind), slog.Duration("sleepAfter", h.sleepAfter())}
+	if lastReset != nil {
+		attrs = append(attrs, slog.String("lastResetBy", lastReset.RequestID), slog.String("lastResetType", lastReset.Type))
+	}
+	slog.Info("Going to sleep", attrs...)
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/report"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// sloBuckets are the time buckets an SLO window is split into, the
+	// oldest dropped as the window slides
+	sloBuckets = 60
+	// sloLatencyBuckets are the latency buckets of a time bucket
+	sloLatencyBuckets = 64
+	// sloMinRequests is how many requests a window needs before its burn
+	// rate alerts, one slow request of a few would otherwise do
+	sloMinRequests = 10
+)
+
+// sloLatencyBounds are the upper bounds of the latency buckets, growing by
+// a quarter from 0.25ms to about five minutes, so the percentiles estimated
+// from them are within a quarter of the real ones.
+var sloLatencyBounds = func() [sloLatencyBuckets]time.Duration {
+	var bounds [sloLatencyBuckets]time.Duration
+	bound := float64(250 * time.Microsecond)
+	for i := range bounds {
+		bounds[i] = time.Duration(bound)
+		bound *= 1.25
+	}
+	return bounds
+}()
+
+// SLO is a latency objective of an operation: Percentile of its requests,
+// like 0.95, are answered within Threshold over the last Window.
+type SLO struct {
+	Operation  string
+	Percentile float64
+	Threshold  time.Duration
+	Window     time.Duration
+}
+
+// slos tracks the latencies of the operations with an SLO and warns when
+// one burns its error budget, the share of requests allowed to be slower
+// than the threshold, faster than BurnRate times the rate that would spend
+// it over the window. A warning fires once until the burn rate drops below
+// BurnRate again. Other operations cost a map lookup.
+type slos struct {
+	byOperation map[string]*sloTracker
+	// names are the operations in the order of the config
+	names    []string
+	burnRate float64
+	reporter *report.Reporter
+	sink     MetricsSink
+}
+
+// sloTracker keeps fixed size histograms of the latencies of an
+// operation, one per time bucket of the window.
+type sloTracker struct {
+	slo   SLO
+	width time.Duration
+
+	mu       sync.Mutex
+	buckets  [sloBuckets]sloBucket
+	alerting bool
+}
+
+type sloBucket struct {
+	// number is the bucket's start divided by the bucket width
+	number    int64
+	total     int64
+	slow      int64
+	latencies [sloLatencyBuckets]int64
+}
+
+// newSLOs returns nil without SLOs. reporter may be nil.
+func newSLOs(objectives []SLO, burnRate float64, reporter *report.Reporter, sink MetricsSink) *slos {
+	if len(objectives) == 0 {
+		return nil
+	}
+	s := &slos{byOperation: map[string]*sloTracker{}, burnRate: burnRate, reporter: reporter, sink: sink}
+	for _, slo := range objectives {
+		width := slo.Window / sloBuckets
+		if width <= 0 {
+			width = 1
+		}
+		s.byOperation[slo.Operation] = &sloTracker{slo: slo, width: width}
+		s.names = append(s.names, slo.Operation)
+	}
+	return s
+}
+
+// observe records a request of the operation that took took.
+func (s *slos) observe(operation string, took time.Duration, now time.Time) {
+	t := s.byOperation[operation]
+	if t == nil {
+		return
+	}
+	burn, fired := t.record(took, now, s.burnRate)
+	if !fired {
+		return
+	}
+	status := t.status(now)
+	rate := strconv.FormatFloat(burn, 'f', 1, 64)
+	s.sink.Count(metricSLOBurnAlerts, 1, "operation", operation)
+	slog.LogAttrs(context.Background(), slog.LevelWarn, "SLO burning its latency budget",
+		slog.String("operation", operation),
+		slog.String("objective", status.Objective),
+		slog.Float64("burnRate", burn),
+		slog.Float64("compliance", status.Compliance),
+		slog.Float64("observedMs", status.ObservedMs))
+	s.reporter.Report(report.Event{
+		Type:    report.EventSLOBurn,
+		Level:   "warning",
+		Message: fmt.Sprintf("%s burns its latency budget %sx faster than %s allows", operation, rate, status.Objective),
+		Extra: map[string]string{
+			"operation":   operation,
+			"objective":   status.Objective,
+			"burn_rate":   rate,
+			"compliance":  strconv.FormatFloat(status.Compliance, 'f', 4, 64),
+			"observed_ms": strconv.FormatFloat(status.ObservedMs, 'f', 1, 64),
+		},
+	})
+}
+
+// record adds a request to the current bucket and returns the burn rate of
+// the window and whether it just crossed burnRate.
+func (t *sloTracker) record(took time.Duration, now time.Time, burnRate float64) (float64, bool) {
+	number := now.UnixNano() / int64(t.width)
+	i := sort.Search(sloLatencyBuckets, func(i int) bool { return took <= sloLatencyBounds[i] })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := &t.buckets[number%sloBuckets]
+	if bucket.number != number {
+		*bucket = sloBucket{number: number}
+	}
+	bucket.total++
+	if took > t.slo.Threshold {
+		bucket.slow++
+	}
+	// requests slower than the last bound only count in the total
+	if i < sloLatencyBuckets {
+		bucket.latencies[i]++
+	}
+	total, slow := t.window(number)
+	burn := burnOf(total, slow, t.slo.Percentile)
+	switch {
+	case burn >= burnRate && total >= sloMinRequests && !t.alerting:
+		t.alerting = true
+		return burn, true
+	case burn < burnRate:
+		t.alerting = false
+	}
+	return burn, false
+}
+
+// window returns the requests of the buckets of the window ending with
+// the bucket number, and those slower than the threshold.
+func (t *sloTracker) window(number int64) (total, slow int64) {
+	for i := range t.buckets {
+		if bucket := &t.buckets[i]; number-bucket.number < sloBuckets {
+			total += bucket.total
+			slow += bucket.slow
+		}
+	}
+	return total, slow
+}
+
+// burnOf is how many times faster than the window allows the slow
+// requests spend the budget of the percentile.
+func burnOf(total, slow int64, percentile float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(slow) / float64(total) / (1 - percentile)
+}
+
+// sloStatus is an SLO in the admin stats.
+type sloStatus struct {
+	Operation string `json:"operation"`
+	// Objective is the SLO as configured, like p95<100ms/1h.
+	Objective     string  `json:"objective"`
+	Requests      int64   `json:"requests"`
+	Slow          int64   `json:"slow"`
+	Compliance    float64 `json:"compliance"`
+	BurnRate      float64 `json:"burnRate"`
+	ObservedMs    float64 `json:"observedMs"`
+	Meeting       bool    `json:"meeting"`
+	Alerting      bool    `json:"alerting"`
+	WindowSeconds float64 `json:"windowSeconds"`
+}
+
+func (t *sloTracker) status(now time.Time) sloStatus {
+	number := now.UnixNano() / int64(t.width)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := sloStatus{
+		Operation:     t.slo.Operation,
+		Objective:     t.slo.objective(),
+		WindowSeconds: t.slo.Window.Seconds(),
+		Compliance:    1,
+		Meeting:       true,
+		Alerting:      t.alerting,
+	}
+	status.Requests, status.Slow = t.window(number)
+	if status.Requests == 0 {
+		return status
+	}
+	status.Compliance = 1 - float64(status.Slow)/float64(status.Requests)
+	status.BurnRate = burnOf(status.Requests, status.Slow, t.slo.Percentile)
+	status.Meeting = status.Compliance >= t.slo.Percentile
+
+	// the observed percentile is the upper bound of the latency bucket it
+	// falls in
+	var latencies [sloLatencyBuckets]int64
+	for i := range t.buckets {
+		if bucket := &t.buckets[i]; number-bucket.number < sloBuckets {
+			for j, n := range bucket.latencies {
+				latencies[j] += n
+			}
+		}
+	}
+	rank := int64(t.slo.Percentile*float64(status.Requests)+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	status.ObservedMs = float64(sloLatencyBounds[sloLatencyBuckets-1].Microseconds()) / 1000
+	var seen int64
+	for i, n := range latencies {
+		if seen += n; seen > rank {
+			status.ObservedMs = float64(sloLatencyBounds[i].Microseconds()) / 1000
+			break
+		}
+	}
+	return status
+}
+
+// objective writes the SLO like it is configured, p95<100ms/1h.
+func (s SLO) objective() string {
+	return fmt.Sprintf("p%s<%s/%s", strconv.FormatFloat(s.Percentile*100, 'f', -1, 64), shortDuration(s.Threshold), shortDuration(s.Window))
+}
+
+// shortDuration writes d without its zero minutes and seconds, 1h rather
+// than 1h0m0s.
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// statuses returns the status of every SLO, in the order of the config.
+func (s *slos) statuses(now time.Time) []sloStatus {
+	if s == nil {
+		return nil
+	}
+	statuses := make([]sloStatus, 0, len(s.names))
+	for _, name := range s.names {
+		statuses = append(statuses, s.byOperation[name].status(now))
+	}
+	return statuses
+}
@@ -0,0 +1,512 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+)
+
+// includeDeletedHeader, or the includeDeleted directive on the operation,
+// runs an operation as written for a caller with the admin scope: reads
+// see the soft deleted rows and deletes delete them.
+const (
+	includeDeletedHeader    = "X-Wunderbase-Include-Deleted"
+	includeDeletedDirective = "includeDeleted"
+)
+
+// defaultSoftDeleteField is the soft delete field without SoftDeleteField.
+const defaultSoftDeleteField = "deletedAt"
+
+// softDeleteActions are the prefixes of the root fields of a model, by what
+// the soft deletes do with them: "unique" turns a findUnique into a
+// findFirst of the rows not deleted, "where" only lets the field see the
+// rows not deleted, and the deletes become updates setting the soft delete
+// field.
+var softDeleteActions = []struct {
+	prefix, action string
+}{
+	{"findUnique", "unique"},
+	{"findFirst", "where"},
+	{"findMany", "where"},
+	{"aggregate", "where"},
+	{"groupBy", "where"},
+	{"updateMany", "where"},
+	{"deleteOne", "deleteOne"},
+	{"deleteMany", "deleteMany"},
+}
+
+// softDelete keeps the deleted rows of some models in the database: their
+// deletes set the soft delete field, a nullable DateTime, to the time of
+// the delete instead, and reads only see the rows where it is null.
+type softDelete struct {
+	models map[string]bool
+	field  string
+}
+
+// softDeleteError is why an operation was refused by the soft deletes.
+type softDeleteError struct {
+	Message string
+}
+
+func (e *softDeleteError) Error() string {
+	return e.Message
+}
+
+func newSoftDelete(models []string, field string) *softDelete {
+	if len(models) == 0 {
+		return nil
+	}
+	if field == "" {
+		field = defaultSoftDeleteField
+	}
+	s := &softDelete{models: map[string]bool{}, field: field}
+	for _, model := range models {
+		s.models[model] = true
+	}
+	return s
+}
+
+// check reports the models the schema doesn't have, or whose soft delete
+// field isn't a nullable DateTime, which would otherwise fail every request
+// on them.
+func (s *softDelete) check(index *schemaIndex) error {
+	var problems []string
+	for model := range s.models {
+		field, ok := index.fields[model][s.field]
+		switch {
+		case index.fields["Query"]["findUnique"+model].typ != model:
+			problems = append(problems, "model "+model+" is not in the schema")
+		case !ok || field.typ != "DateTime" || !strings.Contains(index.fields[model+"WhereInput"][s.field].typ, "Nullable"):
+			problems = append(problems, model+" has no nullable DateTime field "+s.field)
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("wunderbase: soft delete: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// CheckSoftDeleteSchema fails if a soft deleted model isn't in the schema
+// of the query engine or lacks the soft delete field.
+func (h *Handler) CheckSoftDeleteSchema() error {
+	if h.softDelete == nil {
+		return nil
+	}
+	schema, err := h.schema()
+	if err != nil {
+		return fmt.Errorf("wunderbase: soft delete: %w", err)
+	}
+	return h.softDelete.check(schema.index)
+}
+
+// softDeleteRows rewrites the operation of body for the soft deletes,
+// unless a caller with the admin scope includes the deleted rows. The
+// includeDeleted directive is removed, the engine doesn't know it.
+func (h *Handler) softDeleteRows(r *http.Request, body []byte) ([]byte, error) {
+	query, _ := jsonparser.GetString(body, "query")
+	stripped, directive := query, false
+	if bytes.Contains(body, []byte("@")) {
+		stripped, directive = stripDirectives(query, includeDeletedDirective)
+	}
+	if header, _ := strconv.ParseBool(r.Header.Get(includeDeletedHeader)); header || directive {
+		if !containsString(Scopes(r.Context()), adminScope) {
+			return nil, &softDeleteError{"including the soft deleted rows needs the " + adminScope + " scope"}
+		}
+		h.sink.Count(metricIncludeDeleted, 1)
+		if !directive {
+			return body, nil
+		}
+		value, _ := json.Marshal(stripped)
+		// Set may write to the array of its input
+		return jsonparser.Set(append([]byte(nil), body...), value, "query")
+	}
+	schema, err := h.schema()
+	if err != nil {
+		return nil, err
+	}
+	return h.softDelete.rewrite(body, schema.index, time.Now())
+}
+
+// rewrite turns the deletes of soft deleted models in the operation of
+// body into updates setting the soft delete field to now, and merges
+// {<field>: null} into the where argument of the fields reading them: root
+// fields, list relations selected below them, and the relation filters
+// (some, every, none, is, isNot) in any argument, inline or in the
+// variables. Operations that can't be rewritten, like a findUnique with a
+// unique where given as a variable or nested deletes, are refused with a
+// *softDeleteError.
+func (s *softDelete) rewrite(body []byte, index *schemaIndex, now time.Time) ([]byte, error) {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return nil, &softDeleteError{"the request has no query"}
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return nil, &softDeleteError{"the query could not be parsed"}
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 {
+		return nil, &softDeleteError{fmt.Sprintf("operation %q not found", operationName)}
+	}
+	if !doc.OperationDefinitions[op].HasSelections {
+		return body, nil
+	}
+	root := "Query"
+	if doc.OperationDefinitions[op].OperationType == ast.OperationTypeMutation {
+		root = "Mutation"
+	}
+	w := &softDeleteWalk{
+		softDelete: s,
+		doc:        &doc,
+		query:      query,
+		index:      index,
+		notDeleted: "{" + s.field + ": null}",
+		deletedAt:  now.UTC().Format(time.RFC3339Nano),
+		edits:      map[uint32]queryEdit{},
+		visited:    map[string]bool{},
+	}
+	set := doc.OperationDefinitions[op].SelectionSet
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		if doc.Selections[ref].Kind != ast.SelectionKindField {
+			return nil, &softDeleteError{"fragments on the root type can't be rewritten for the soft deletes"}
+		}
+		if err := w.rootField(doc.Selections[ref].Ref, root); err != nil {
+			return nil, err
+		}
+	}
+	variables, err := w.variables(op, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set may write to the array of its input
+	out := append([]byte(nil), body...)
+	if len(w.edits) > 0 {
+		if out, err = jsonparser.Set(out, applyEdits(query, w.edits), "query"); err != nil {
+			return nil, err
+		}
+	}
+	if variables != nil {
+		if out, err = jsonparser.Set(out, variables, "variables"); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// softDeleteWalk rewrites an operation through its root fields, their
+// selections, fragments and argument values.
+type softDeleteWalk struct {
+	*softDelete
+	doc   *ast.Document
+	query string
+	index *schemaIndex
+	// notDeleted is the filter merged into where arguments, deletedAt the
+	// value deletes set
+	notDeleted string
+	deletedAt  string
+	edits      map[uint32]queryEdit
+	visited    map[string]bool
+	// changed reports whether a variable was rewritten
+	changed bool
+}
+
+func (w *softDeleteWalk) rootField(field int, root string) error {
+	doc := w.doc
+	name := doc.FieldNameString(field)
+	action, model := softDeleteAction(name)
+	if w.models[model] {
+		data := "data: {" + w.field + ": {set: " + strconv.Quote(w.deletedAt) + "}}"
+		switch action {
+		case "unique":
+			if !renameUnique(doc, w.query, field, w.edits) {
+				return &softDeleteError{name + " can only be rewritten for the soft deletes of " + model + " with a literal where argument"}
+			}
+			mergeWhere(doc, w.query, w.notDeleted, field, w.edits)
+		case "where":
+			mergeWhere(doc, w.query, w.notDeleted, field, w.edits)
+		case "deleteOne":
+			w.rename(field, "deleteOne", "updateOne")
+			w.addArguments(field, data)
+		case "deleteMany":
+			w.rename(field, "deleteMany", "updateMany")
+			if _, ok := fieldArgument(doc, field, "where"); ok {
+				mergeWhere(doc, w.query, w.notDeleted, field, w.edits)
+				w.addArguments(field, data)
+			} else {
+				w.addArguments(field, "where: "+w.notDeleted+", "+data)
+			}
+		}
+	}
+	def := w.index.fields[root][name]
+	if err := w.arguments(field, def); err != nil {
+		return err
+	}
+	if doc.Fields[field].HasSelections && def.typ != "" {
+		return w.selections(doc.Fields[field].SelectionSet, def.typ)
+	}
+	return nil
+}
+
+// softDeleteAction splits a root field like deleteManyOrder into what the
+// soft deletes do with it and its model.
+func softDeleteAction(name string) (action, model string) {
+	for _, a := range softDeleteActions {
+		if strings.HasPrefix(name, a.prefix) && len(name) > len(a.prefix) {
+			return a.action, strings.TrimSuffix(name[len(a.prefix):], "OrThrow")
+		}
+	}
+	return "", ""
+}
+
+// rename replaces the prefix of the name of a root field, keeping its
+// response key.
+func (w *softDeleteWalk) rename(field int, from, to string) {
+	name := w.doc.Fields[field].Name
+	text := to + strings.TrimPrefix(w.query[name.Start:name.End], from)
+	if !w.doc.FieldAliasIsDefined(field) {
+		text = w.query[name.Start:name.End] + ": " + text
+	}
+	w.edits[name.Start] = queryEdit{end: name.End, text: text}
+}
+
+// addArguments adds arguments in front of the ones of field.
+func (w *softDeleteWalk) addArguments(field int, text string) {
+	f := w.doc.Fields[field]
+	if f.HasArguments && len(f.Arguments.Refs) > 0 {
+		start := w.doc.Arguments[f.Arguments.Refs[0]].Name.Start
+		w.edits[start] = queryEdit{end: start, text: text + ", "}
+		return
+	}
+	w.edits[f.Name.End] = queryEdit{end: f.Name.End, text: "(" + text + ")"}
+}
+
+func (w *softDeleteWalk) selections(set int, typeName string) error {
+	doc := w.doc
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			field := selection.Ref
+			def, ok := w.index.fields[typeName][doc.FieldNameString(field)]
+			if !ok {
+				continue
+			}
+			// list relations take a where argument, single ones can't
+			// be filtered
+			if _, list := def.args["where"]; list && w.models[def.typ] {
+				mergeWhere(doc, w.query, w.notDeleted, field, w.edits)
+			}
+			if err := w.arguments(field, def); err != nil {
+				return err
+			}
+			if doc.Fields[field].HasSelections {
+				if err := w.selections(doc.Fields[field].SelectionSet, def.typ); err != nil {
+					return err
+				}
+			}
+		case ast.SelectionKindInlineFragment:
+			condition := typeName
+			if name := doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment := doc.InlineFragments[selection.Ref]; fragment.HasSelections {
+				if err := w.selections(fragment.SelectionSet, condition); err != nil {
+					return err
+				}
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || w.visited[name] {
+					continue
+				}
+				w.visited[name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					if err := w.selections(doc.FragmentDefinitions[i].SelectionSet, string(doc.FragmentDefinitionTypeName(i))); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (w *softDeleteWalk) arguments(field int, def indexedField) error {
+	for _, arg := range w.doc.Fields[field].Arguments.Refs {
+		if argType, ok := def.args[w.doc.ArgumentNameString(arg)]; ok {
+			if err := w.value(w.doc.ArgumentValue(arg), argType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value rewrites the relation filters in an argument value of the named
+// type typeName. Variables are rewritten by their definition.
+func (w *softDeleteWalk) value(value ast.Value, typeName string) error {
+	doc := w.doc
+	switch value.Kind {
+	case ast.ValueKindObject:
+		for _, ref := range doc.ObjectValues[value.Ref].Refs {
+			name := doc.ObjectFieldNameString(ref)
+			if err := w.nestedDelete(typeName, name); err != nil {
+				return err
+			}
+			field := w.index.fields[typeName][name]
+			fieldValue := doc.ObjectFieldValue(ref)
+			if fieldValue.Kind == ast.ValueKindObject || fieldValue.Kind == ast.ValueKindVariable {
+				var prefix, suffix string
+				switch w.relationFilter(name, field.typ) {
+				case "only":
+					prefix, suffix = "{AND: [", ", "+w.notDeleted+"]}"
+				case "ignore":
+					prefix, suffix = "{OR: [", ", {NOT: "+w.notDeleted+"}]}"
+				}
+				if prefix != "" {
+					start, end := argumentValue(w.query, int(doc.ObjectFields[ref].Name.End))
+					w.edits[uint32(start)] = queryEdit{end: uint32(start), text: prefix}
+					w.edits[uint32(end)] = queryEdit{end: uint32(end), text: suffix}
+				}
+			}
+			if err := w.value(fieldValue, field.typ); err != nil {
+				return err
+			}
+		}
+	case ast.ValueKindList:
+		for _, ref := range doc.ListValues[value.Ref].Refs {
+			if err := w.value(doc.Values[ref], typeName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// relationFilter reports how the value of the field name of an input type
+// is kept to the rows not deleted, if it filters by the rows of a soft
+// deleted model: "only" for some, none, is and isNot, which then only
+// consider the rows not deleted, and "ignore" for every, which ignores the
+// deleted ones.
+func (w *softDeleteWalk) relationFilter(name, fieldType string) string {
+	model := strings.TrimSuffix(fieldType, "WhereInput")
+	if model == fieldType || !w.models[model] {
+		return ""
+	}
+	switch name {
+	case "some", "none", "is", "isNot":
+		return "only"
+	case "every":
+		return "ignore"
+	}
+	return ""
+}
+
+// nestedDelete refuses the nested deletes of a soft deleted model, in the
+// nested update inputs named like PostUpdateManyWithoutAuthorNestedInput.
+func (w *softDeleteWalk) nestedDelete(typeName, name string) error {
+	if (name != "delete" && name != "deleteMany") || !strings.HasSuffix(typeName, "NestedInput") {
+		return nil
+	}
+	for model := range w.models {
+		if strings.HasPrefix(typeName, model+"Update") {
+			return &softDeleteError{"nested deletes of " + model + " can't be soft deleted, set its " + w.field + " instead"}
+		}
+	}
+	return nil
+}
+
+// variables rewrites the relation filters in the default values of the
+// variables of op, and in their values sent with body. It returns the
+// rewritten variables, nil if none changed.
+func (w *softDeleteWalk) variables(op int, body []byte) ([]byte, error) {
+	doc := w.doc
+	var values map[string]interface{}
+	if raw, typ, _, err := jsonparser.Get(body, "variables"); err == nil && typ == jsonparser.Object {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		// numbers are sent as written
+		decoder.UseNumber()
+		if err := decoder.Decode(&values); err != nil {
+			return nil, &softDeleteError{"the variables could not be parsed"}
+		}
+	}
+	changed := false
+	for _, ref := range doc.OperationDefinitions[op].VariableDefinitions.Refs {
+		def := doc.VariableDefinitions[ref]
+		typeName := doc.ResolveTypeNameString(def.Type)
+		if def.DefaultValue.IsDefined {
+			if err := w.value(def.DefaultValue.Value, typeName); err != nil {
+				return nil, err
+			}
+		}
+		name := doc.VariableDefinitionNameString(ref)
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		w.changed = false
+		value, err := w.variable(value, typeName)
+		if err != nil {
+			return nil, err
+		}
+		if w.changed {
+			values[name], changed = value, true
+		}
+	}
+	if !changed {
+		return nil, nil
+	}
+	return json.Marshal(values)
+}
+
+// variable rewrites the relation filters in the JSON value of a variable of
+// the named type typeName.
+func (w *softDeleteWalk) variable(value interface{}, typeName string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, fieldValue := range v {
+			if err := w.nestedDelete(typeName, name); err != nil {
+				return nil, err
+			}
+			field := w.index.fields[typeName][name]
+			fieldValue, err := w.variable(fieldValue, field.typ)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := fieldValue.(map[string]interface{}); ok {
+				notDeleted := map[string]interface{}{w.field: nil}
+				switch w.relationFilter(name, field.typ) {
+				case "only":
+					fieldValue = map[string]interface{}{"AND": []interface{}{fieldValue, notDeleted}}
+					w.changed = true
+				case "ignore":
+					fieldValue = map[string]interface{}{"OR": []interface{}{fieldValue, map[string]interface{}{"NOT": notDeleted}}}
+					w.changed = true
+				}
+			}
+			v[name] = fieldValue
+		}
+	case []interface{}:
+		for i, item := range v {
+			item, err := w.variable(item, typeName)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+	}
+	return value, nil
+}
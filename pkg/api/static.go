@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// staticGzipMaxBytes is the largest file gzipped on the fly, larger
+	// ones are sent as they are
+	staticGzipMaxBytes = 8 << 20
+	// staticGzipCacheBytes caps the gzipped files kept for the next
+	// requests
+	staticGzipCacheBytes = 32 << 20
+	// staticGzipMinBytes is the smallest file worth gzipping
+	staticGzipMinBytes = 1024
+)
+
+// staticFiles serves the files of a directory under a path prefix, the
+// frontend served next to the API.
+type staticFiles struct {
+	// root is the absolute directory with its symlinks resolved
+	root       string
+	prefix     string
+	dotfiles   bool
+	keepsAwake bool
+
+	mu       sync.Mutex
+	gzipped  map[string]gzippedFile
+	gzipSize int64
+}
+
+type gzippedFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// newStaticFiles returns the static files of dir served under prefix,
+// /static/ if empty, nil if dir is empty.
+func newStaticFiles(dir, prefix string, dotfiles, keepsAwake bool) (*staticFiles, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if prefix == "" {
+		prefix = "/static/"
+	}
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("wunderbase: static files: %w", err)
+	}
+	return &staticFiles{
+		root:       root,
+		prefix:     strings.TrimSuffix(prefix, "/"),
+		dotfiles:   dotfiles,
+		keepsAwake: keepsAwake,
+		gzipped:    map[string]gzippedFile{},
+	}, nil
+}
+
+// matches tells if r is a request for a static file: a GET or HEAD under
+// the prefix that isn't a GraphQL request. The routes of the API are
+// checked before.
+func (s *staticFiles) matches(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		return false
+	}
+	return s.prefix == "" || r.URL.Path == s.prefix || strings.HasPrefix(r.URL.Path, s.prefix+"/")
+}
+
+// serve serves the file of the request, the index.html of a directory, or
+// the root index.html for paths without an extension, the routes of a
+// single page application.
+func (s *staticFiles) serve(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, s.prefix))
+	if !s.dotfiles && hasDotSegment(name) {
+		http.NotFound(w, r)
+		return
+	}
+	file, info, ok := s.open(name)
+	if ok && info.IsDir() {
+		file.Close()
+		file, info, ok = s.open(path.Join(name, "index.html"))
+	}
+	if !ok && path.Ext(name) == "" {
+		file, info, ok = s.open("/index.html")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if !ok || info.IsDir() {
+		if ok {
+			file.Close()
+		}
+		w.Header().Del("Cache-Control")
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	if ctype := mime.TypeByExtension(filepath.Ext(info.Name())); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	etag := fmt.Sprintf(`"%x-%x`, info.Size(), info.ModTime().UnixNano())
+	if compressible(w.Header().Get("Content-Type"), info.Size()) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			if data, ok := s.gzip(file, info); ok {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("ETag", etag+`-gzip"`)
+				http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(data))
+				return
+			}
+		}
+	}
+	w.Header().Set("ETag", etag+`"`)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// open opens the file at the slash separated name under the root, refusing
+// files whose symlinks lead out of it.
+func (s *staticFiles) open(name string) (*os.File, os.FileInfo, bool) {
+	if strings.ContainsAny(name, "\\\x00") {
+		return nil, nil, false
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil || (resolved != s.root && !strings.HasPrefix(resolved, s.root+string(filepath.Separator))) {
+		return nil, nil, false
+	}
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, false
+	}
+	return file, info, true
+}
+
+// gzip returns the file gzipped, from the cache while the file is
+// unchanged.
+func (s *staticFiles) gzip(file *os.File, info os.FileInfo) ([]byte, bool) {
+	key := file.Name()
+	s.mu.Lock()
+	cached, ok := s.gzipped[key]
+	s.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.data, true
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := io.Copy(gz, file)
+	if err == nil {
+		err = gz.Close()
+	}
+	if _, seekErr := file.Seek(0, io.SeekStart); err != nil || seekErr != nil {
+		return nil, false
+	}
+	data := buf.Bytes()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.gzipSize -= int64(len(cached.data))
+		delete(s.gzipped, key)
+	}
+	if s.gzipSize+int64(len(data)) <= staticGzipCacheBytes {
+		s.gzipped[key] = gzippedFile{modTime: info.ModTime(), size: info.Size(), data: data}
+		s.gzipSize += int64(len(data))
+	}
+	return data, true
+}
+
+// compressible tells if a file of the content type and size is worth
+// gzipping.
+func compressible(contentType string, size int64) bool {
+	if size < staticGzipMinBytes || size > staticGzipMaxBytes {
+		return false
+	}
+	ctype, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(ctype, "text/"),
+		strings.HasSuffix(ctype, "+json"), strings.HasSuffix(ctype, "+xml"):
+		return true
+	}
+	switch ctype {
+	case "application/javascript", "application/json", "application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";"); strings.TrimSpace(name) == "gzip" {
+			return strings.TrimSpace(params) != "q=0"
+		}
+	}
+	return false
+}
+
+// hasDotSegment tells if a segment of the slash separated name starts with
+// a dot, like .env or .git/config.
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// apiRoute tells if path is served by an enabled endpoint of the API other
+// than GraphQL, which static files don't shadow.
+func (h *Handler) apiRoute(path string) bool {
+	return (h.enableREST && strings.HasPrefix(path, restPrefix)) ||
+		(h.enableCount && (strings.HasPrefix(path, countPrefix) || strings.HasPrefix(path, existsPrefix))) ||
+		(h.enableCDC && path == changesPath) ||
+		(h.enableSchemaViewer && strings.HasPrefix(path, schemaViewerPath)) ||
+		(h.maxUploadFile > 0 && strings.HasPrefix(path, filesPrefix))
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/cdc"
+	"wunderbase/pkg/schedule"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// maxShapes bounds the fingerprints tracked, later ones are not counted
+	maxShapes = 1000
+	// maxSlowQueries is the size of the slow query ring buffer
+	maxSlowQueries = 50
+	defaultTopK    = 20
+)
+
+// shapeStats aggregates the requests sharing a query fingerprint.
+type shapeStats struct {
+	Fingerprint   string  `json:"fingerprint"`
+	OperationName string  `json:"operationName,omitempty"`
+	Type          string  `json:"type"`
+	Count         int64   `json:"count"`
+	TotalMs       float64 `json:"totalMs"`
+	MaxMs         float64 `json:"maxMs"`
+}
+
+// slowQuery is the latest slow request of a fingerprint.
+type slowQuery struct {
+	Fingerprint   string    `json:"fingerprint"`
+	OperationName string    `json:"operationName,omitempty"`
+	Type          string    `json:"type"`
+	RequestID     string    `json:"requestId"`
+	DurationMs    float64   `json:"durationMs"`
+	At            time.Time `json:"at"`
+	// Count is how often the fingerprint was slow while in the buffer.
+	Count int64 `json:"count"`
+}
+
+// queryStats collects per fingerprint statistics for the admin surface.
+type queryStats struct {
+	mu     sync.Mutex
+	shapes map[string]*shapeStats
+	// slow is ordered oldest first and holds each fingerprint at most once
+	slow []slowQuery
+}
+
+func newQueryStats() *queryStats {
+	return &queryStats{shapes: map[string]*shapeStats{}}
+}
+
+func (s *queryStats) record(fingerprint, operationName, kind, requestID string, took time.Duration, slow bool) {
+	ms := float64(took.Microseconds()) / 1000
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shape, ok := s.shapes[fingerprint]
+	if !ok && len(s.shapes) < maxShapes {
+		shape = &shapeStats{Fingerprint: fingerprint, OperationName: operationName, Type: kind}
+		s.shapes[fingerprint] = shape
+	}
+	if shape != nil {
+		shape.Count++
+		shape.TotalMs += ms
+		if ms > shape.MaxMs {
+			shape.MaxMs = ms
+		}
+	}
+
+	if !slow {
+		return
+	}
+	entry := slowQuery{
+		Fingerprint:   fingerprint,
+		OperationName: operationName,
+		Type:          kind,
+		RequestID:     requestID,
+		DurationMs:    ms,
+		At:            time.Now().UTC(),
+		Count:         1,
+	}
+	for i, q := range s.slow {
+		if q.Fingerprint == fingerprint {
+			entry.Count += q.Count
+			s.slow = append(s.slow[:i], s.slow[i+1:]...)
+			break
+		}
+	}
+	if len(s.slow) >= maxSlowQueries {
+		s.slow = s.slow[1:]
+	}
+	s.slow = append(s.slow, entry)
+}
+
+// top returns the k fingerprints with the highest count or total time.
+func (s *queryStats) top(k int, byTime bool) []shapeStats {
+	s.mu.Lock()
+	shapes := make([]shapeStats, 0, len(s.shapes))
+	for _, shape := range s.shapes {
+		shapes = append(shapes, *shape)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(shapes, func(i, j int) bool {
+		if byTime && shapes[i].TotalMs != shapes[j].TotalMs {
+			return shapes[i].TotalMs > shapes[j].TotalMs
+		}
+		if shapes[i].Count != shapes[j].Count {
+			return shapes[i].Count > shapes[j].Count
+		}
+		return shapes[i].Fingerprint < shapes[j].Fingerprint
+	})
+	if len(shapes) > k {
+		shapes = shapes[:k]
+	}
+	return shapes
+}
+
+// slowQueries returns the slow query buffer, newest first.
+func (s *queryStats) slowQueries() []slowQuery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queries := make([]slowQuery, len(s.slow))
+	for i, q := range s.slow {
+		queries[len(s.slow)-1-i] = q
+	}
+	return queries
+}
+
+// adminStats is the JSON served on /admin/stats.
+type adminStats struct {
+	TopByCount  []shapeStats `json:"topByCount"`
+	TopByTime   []shapeStats `json:"topByTime"`
+	SlowQueries []slowQuery  `json:"slowQueries"`
+	// Schedules is the state of the scheduled operations, if any.
+	Schedules []schedule.Status `json:"schedules,omitempty"`
+	// Changes is the head of the change feed, for consumers to measure
+	// their lag.
+	Changes *changesStats `json:"changes,omitempty"`
+	// SleepEvents are the latest keepalives and sleeps, latest first.
+	SleepEvents []sleepEvent `json:"sleepEvents,omitempty"`
+	// Endpoints are the absolute URLs of the endpoints served.
+	Endpoints map[string]string `json:"endpoints"`
+	// Limits are the reads and writes of the quota window, if counted.
+	Limits *quotaStats `json:"limits,omitempty"`
+	// Warmup is the latest warm-up of the query engine, if any ran.
+	Warmup *warmupStats `json:"warmup,omitempty"`
+	// Errors are the GraphQL error codes answered most.
+	Errors *errorStats `json:"errors"`
+	// SLOs are the latency objectives tracked, if any.
+	SLOs []sloStatus `json:"slos,omitempty"`
+	// IndexAdvice are the tables slow queries scan, with index advice.
+	IndexAdvice []indexSuggestion `json:"indexAdvice,omitempty"`
+}
+
+type changesStats struct {
+	Head string `json:"head"`
+}
+
+// serveStats serves the query statistics. ?top=n sets the size of the top
+// tables.
+func (h *Handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	k := defaultTopK
+	if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+		k = n
+	}
+	stats := adminStats{
+		TopByCount:  h.stats.top(k, false),
+		TopByTime:   h.stats.top(k, true),
+		SlowQueries: h.stats.slowQueries(),
+		SleepEvents: h.sleepEvents.list(),
+		Endpoints:   h.endpointURLs(r),
+		Errors:      h.errorRates.stats(k, time.Now()),
+		SLOs:        h.slos.statuses(time.Now()),
+	}
+	if h.quota != nil {
+		stats.Limits = h.quota.stats()
+	}
+	stats.Warmup, _ = h.warmup.Load().(*warmupStats)
+	if h.indexAdvice != nil {
+		stats.IndexAdvice = h.indexAdvice.list()
+	}
+	if h.schedules != nil {
+		stats.Schedules = h.schedules.Status()
+	}
+	if h.enableCDC {
+		if head, err := cdc.Head(r.Context(), h.sqlitePath, h.databaseFile); err != nil {
+			slog.Error("Reading the change feed head", slog.String("error", err.Error()))
+		} else {
+			stats.Changes = &changesStats{Head: strconv.FormatInt(head, 10)}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/report"
+
+	"github.com/buger/jsonparser"
+	"golang.org/x/exp/slog"
+)
+
+// defaultStorageCheckInterval is how often the database file is stat'ed
+// without StorageCheckInterval.
+const defaultStorageCheckInterval = 5 * time.Second
+
+// storageConditionUnavailable names the condition in the verbose health
+// response, for on-call to tell it from a bug of the instance.
+const storageConditionUnavailable = "storage_unavailable"
+
+// storageMarkers are the SQLite errors of a database whose volume went away
+// under it, as the query engine reports them.
+var storageMarkers = [][]byte{
+	[]byte("disk I/O error"),
+	[]byte("database disk image is malformed"),
+}
+
+// storageFailure returns the error of an engine response that failed
+// because the database file can't be read or written.
+func storageFailure(data []byte) (string, bool) {
+	if !bytes.Contains(data, []byte(`"errors"`)) {
+		return "", false
+	}
+	for _, marker := range storageMarkers {
+		if bytes.Contains(data, marker) {
+			message, _ := jsonparser.GetString(data, "errors", "[0]", "error")
+			if message == "" {
+				message = string(marker)
+			}
+			return message, true
+		}
+	}
+	return "", false
+}
+
+// storageGuard tracks whether the volume of the database failed, as told by
+// the I/O errors of the query engine and by stats of the database file.
+type storageGuard struct {
+	path     string
+	interval time.Duration
+	done     chan struct{}
+
+	mu      sync.Mutex
+	failing bool
+	reason  string
+	since   time.Time
+}
+
+func newStorageGuard(path string, interval time.Duration) *storageGuard {
+	if path == "" {
+		return nil
+	}
+	if interval <= 0 {
+		interval = defaultStorageCheckInterval
+	}
+	return &storageGuard{path: path, interval: interval, done: make(chan struct{})}
+}
+
+// fail marks the storage failing and reports whether it wasn't already.
+func (g *storageGuard) fail(reason string, now time.Time) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failing {
+		return false
+	}
+	g.failing, g.reason, g.since = true, reason, now
+	return true
+}
+
+// recover clears the failure and returns how long it lasted.
+func (g *storageGuard) recover(now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failing, g.reason = false, ""
+	return now.Sub(g.since)
+}
+
+func (g *storageGuard) state() (failing bool, reason string, since time.Time) {
+	if g == nil {
+		return false, "", time.Time{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.failing, g.reason, g.since
+}
+
+// storageFailed takes the instance out of rotation and refuses writes after
+// the query engine or a stat of the database file failed with reason.
+func (h *Handler) storageFailed(reason string) {
+	if !h.storage.fail(reason, time.Now()) {
+		return
+	}
+	slog.Error("Database storage failing, refusing writes until the database file is back",
+		slog.String("path", h.storage.path), slog.String("error", reason))
+	h.sink.Count(metricStorageFailures, 1)
+	h.reporter.Report(report.Event{
+		Type:    report.EventStorageFailure,
+		Message: "the volume of the database failed",
+		Extra:   map[string]string{"path": h.storage.path, "error": reason},
+	})
+}
+
+// storageRefuses reports whether a request is refused while the storage
+// fails: writes always, reads unless ReadsOnStorageFailure.
+func (h *Handler) storageRefuses(write bool) bool {
+	failing, _, _ := h.storage.state()
+	return failing && (write || !h.storageReads)
+}
+
+const storageUnavailableMessage = "the database storage is failing, retry shortly"
+
+// runStorageCheck stats the database file every interval, until the handler
+// is closed. A failing storage recovers once the file stats again.
+func (h *Handler) runStorageCheck() {
+	ticker := time.NewTicker(h.storage.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.storage.done:
+			return
+		case <-ticker.C:
+		}
+		if _, err := os.Stat(h.storage.path); err != nil {
+			h.storageFailed("stat database file: " + err.Error())
+			continue
+		}
+		if failing, _, _ := h.storage.state(); failing {
+			h.recoverStorage()
+		}
+	}
+}
+
+// recoverStorage restarts the query engine, which may hold the file of the
+// failed volume open, and serves again once it answers. An engine stopped
+// for being idle opens the file again when it starts.
+func (h *Handler) recoverStorage() {
+	if h.restartEngine != nil && !h.engineStopped() {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultStartWait)
+		defer cancel()
+		if err := h.restartEngine(ctx); err != nil {
+			slog.Error("Restarting the query engine after the database file came back", slog.String("error", err.Error()))
+			return
+		}
+		h.WarmUp(ctx)
+	}
+	took := h.storage.recover(time.Now())
+	slog.Info("Database storage recovered", slog.String("path", h.storage.path), slog.Duration("failedFor", took))
+}
+
+// storageHealth adds the failure of the storage to the database component.
+func (h *Handler) storageHealth(health ComponentHealth) ComponentHealth {
+	failing, reason, since := h.storage.state()
+	if !failing {
+		return health
+	}
+	health.Status = HealthFailing
+	health.Details["condition"] = storageConditionUnavailable
+	health.Details["error"] = reason
+	health.Details["since"] = since.UTC()
+	return health
+}
+
+// writeStorageUnavailable turns a request away while the storage fails.
+func writeStorageUnavailable(w http.ResponseWriter, plain bool) {
+	w.Header().Set("Retry-After", "5")
+	writeError(w, plain, http.StatusServiceUnavailable, "STORAGE_UNAVAILABLE", storageUnavailableMessage)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"wunderbase/pkg/support"
+)
+
+// SupportBundleFunc collects the parts of a support bundle known outside
+// the handler, see support.Collect.
+type SupportBundleFunc func(ctx context.Context, hashNames bool) *support.Bundle
+
+// supportRequests is how many of the latest failed requests a support
+// bundle lists.
+const supportRequests = 100
+
+// serveSupportBundle serves a support bundle for bug reports: what
+// Config.SupportBundle collects, and the slow queries, error counts, failed
+// requests and health of the instance. ?hashNames=true hashes the names of
+// the schema.
+func (h *Handler) serveSupportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, h.plainTextErrors, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed")
+		return
+	}
+	hashNames, _ := strconv.ParseBool(r.URL.Query().Get("hashNames"))
+	bundle := h.supportBundle(r.Context(), hashNames)
+	bundle.AddJSON("instance/slow-queries.json", h.stats.slowQueries())
+	bundle.AddJSON("instance/errors.json", h.errorRates.stats(defaultTopK, time.Now()))
+	bundle.AddJSON("instance/failed-requests.json", h.failedRequests())
+	health, _ := h.verboseHealth(h.probeEngine())
+	bundle.AddJSON("instance/health.json", health)
+	bundle.Secrets = append(bundle.Secrets, h.adminToken)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="wunderbase-support-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	_ = bundle.Write(w)
+}
+
+// failedRequests returns the latest failed requests without their query,
+// variables and caller, which may hold data values and identities.
+func (h *Handler) failedRequests() []recentRequest {
+	if h.recent == nil {
+		return []recentRequest{}
+	}
+	requests := h.recent.list(supportRequests, recentRequest.failed)
+	for i := range requests {
+		requests[i].Query, requests[i].Variables, requests[i].Caller = "", nil, ""
+	}
+	return requests
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// timeoutHintHeader lets a client ask for a shorter deadline than the
+// request timeout, for operations that should fail fast.
+const timeoutHintHeader = "X-Wunderbase-Timeout-Ms"
+
+// defaultRequestTimeout bounds a request to the query engine if no request
+// timeout is configured.
+const defaultRequestTimeout = 5 * time.Second
+
+// timeoutExtension is added to the response extensions when the client sent
+// a timeout hint.
+type timeoutExtension struct {
+	EffectiveMs int64  `json:"effectiveMs"`
+	Warning     string `json:"warning,omitempty"`
+}
+
+type requestTimeoutKey struct{}
+
+// withRequestTimeout sets the deadline of the request to the server's
+// request timeout, or to the client's hint if that is shorter. An invalid
+// hint falls back to the request timeout with a warning rather than failing
+// the request. The extension is nil without a hint.
+func (h *Handler) withRequestTimeout(r *http.Request) (*http.Request, context.CancelFunc, *timeoutExtension) {
+	timeout := h.requestTimeout
+	var extension *timeoutExtension
+	if hint := r.Header.Get(timeoutHintHeader); hint != "" {
+		extension = &timeoutExtension{}
+		ms, err := strconv.ParseInt(hint, 10, 64)
+		switch {
+		case err != nil || ms <= 0:
+			extension.Warning = "invalid " + timeoutHintHeader + " " + strconv.Quote(hint) + ", using the server timeout"
+			h.sink.Count(metricTimeoutHints, 1, "result", "invalid")
+		case time.Duration(ms)*time.Millisecond < timeout:
+			timeout = time.Duration(ms) * time.Millisecond
+			h.sink.Count(metricTimeoutHints, 1, "result", "applied")
+		default:
+			h.sink.Count(metricTimeoutHints, 1, "result", "capped")
+		}
+		extension.EffectiveMs = timeout.Milliseconds()
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	ctx = context.WithValue(ctx, requestTimeoutKey{}, timeout)
+	return r.WithContext(ctx), cancel, extension
+}
+
+// requestTimeout returns the deadline the request was given, 0 if none.
+func requestTimeout(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	return timeout
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// timeTravelPath serves reads of past states of the database, restored
+// from backups.
+const timeTravelPath = "/timetravel"
+
+// SnapshotTimeHeader tells when the backup a time-travel read was served
+// from was written.
+const SnapshotTimeHeader = "X-Wunderbase-Snapshot-Time"
+
+var (
+	// ErrNoSnapshot is returned by Config.TimeTravel when every backup was
+	// written after the requested time.
+	ErrNoSnapshot = errors.New("no backup was written at or before the requested time")
+	// ErrTimeTravelBusy is returned by Config.TimeTravel when as many
+	// time-travel engines run as allowed.
+	ErrTimeTravelBusy = errors.New("too many time-travel reads are running")
+)
+
+// TimeTravelEngine is a read-only query engine serving the database as it
+// was when a backup was written.
+type TimeTravelEngine struct {
+	URL string
+	// Snapshot is when the backup served was written.
+	Snapshot time.Time
+	// Release stops the engine, it must be called once the request is
+	// answered.
+	Release func()
+}
+
+// serveTimeTravel runs the GraphQL query of the body on the backup written
+// closest before the at parameter. It is an admin endpoint: the admin token
+// is required, and the auth rules and the rewrites of other requests don't
+// apply.
+func (h *Handler) serveTimeTravel(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r, h.adminToken, h.plainTextErrors) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "time-travel reads are POST requests")
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, "BAD_REQUEST", "at must be an RFC 3339 time, like 2024-05-01T00:00:00Z")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, "BAD_REQUEST", "the body could not be read")
+		return
+	}
+	op, err := parseOperation(body)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	if op.isMutation() {
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "READ_ONLY", "time-travel reads can't run mutations")
+		return
+	}
+
+	logger := tracing.Logger(r.Context())
+	engine, err := h.timeTravel(r.Context(), at)
+	switch {
+	case errors.Is(err, ErrNoSnapshot):
+		h.sink.Count(metricTimeTravelReads, 1, "result", "no_snapshot")
+		writeGraphQLError(w, http.StatusNotFound, "NO_SNAPSHOT", err.Error())
+		return
+	case errors.Is(err, ErrTimeTravelBusy):
+		h.sink.Count(metricTimeTravelReads, 1, "result", "busy")
+		w.Header().Set("Retry-After", "5")
+		writeGraphQLError(w, http.StatusServiceUnavailable, "TIME_TRAVEL_BUSY", err.Error())
+		return
+	case err != nil:
+		h.sink.Count(metricTimeTravelReads, 1, "result", "failed")
+		logger.Error("Starting a time-travel engine", slog.String("at", at.UTC().Format(time.RFC3339)), slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the backup could not be served")
+		return
+	}
+	defer engine.Release()
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, engine.URL, bytes.NewReader(body))
+	if err != nil {
+		writeGraphQLError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "internal server error")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.sink.Count(metricTimeTravelReads, 1, "result", "failed")
+		logger.Error("Time-travel read", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the time-travel engine didn't answer")
+		return
+	}
+	defer resp.Body.Close()
+	h.sink.Count(metricTimeTravelReads, 1, "result", "served")
+	logger.Info("Time-travel read", slog.String("at", at.UTC().Format(time.RFC3339)),
+		slog.String("snapshot", engine.Snapshot.UTC().Format(time.RFC3339)), slog.String("operation", op.name))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(SnapshotTimeHeader, engine.Snapshot.UTC().Format(time.RFC3339))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
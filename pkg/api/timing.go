@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTiming collects where the time of a request went, for the
+// Server-Timing header. It is only used by the goroutine serving the
+// request.
+type requestTiming struct {
+	start time.Time
+	// engine is the time spent waiting for the query engine, retries
+	// included, queue the time spent waiting for the rate limits and the
+	// write queue
+	engine    time.Duration
+	queue     time.Duration
+	engineHit bool
+}
+
+type timingKey struct{}
+
+// withServerTiming starts the timing of a request, its Server-Timing header
+// is set when the response is written.
+func withServerTiming(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	timing := &requestTiming{start: time.Now()}
+	return &timingWriter{ResponseWriter: w, timing: timing}, r.WithContext(context.WithValue(r.Context(), timingKey{}, timing))
+}
+
+// timingOf returns the timing of the request, nil if Server-Timing is
+// disabled.
+func timingOf(ctx context.Context) *requestTiming {
+	timing, _ := ctx.Value(timingKey{}).(*requestTiming)
+	return timing
+}
+
+// now returns the current time, the zero time without timing so disabled
+// timing costs nothing.
+func (t *requestTiming) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// queued adds the time since start to the queue and returns the current
+// time.
+func (t *requestTiming) queued(start time.Time) time.Time {
+	if t == nil {
+		return start
+	}
+	now := time.Now()
+	t.queue += now.Sub(start)
+	return now
+}
+
+// answered adds the time since start to the engine.
+func (t *requestTiming) answered(start time.Time) {
+	if t == nil {
+		return
+	}
+	t.engine += time.Since(start)
+	t.engineHit = true
+}
+
+// header returns the Server-Timing header: proxy is the time spent in the
+// proxy itself, the whole request without the engine and the queue. Like
+// the rate limit wait metrics, a queue below a millisecond is taking the
+// limits rather than waiting for them and counted as proxy time.
+func (t *requestTiming) header(now time.Time) string {
+	queue := t.queue
+	if queue < time.Millisecond {
+		queue = 0
+	}
+	entries := []string{"proxy;dur=" + formatMs(now.Sub(t.start)-t.engine-queue)}
+	if t.engineHit {
+		entries = append(entries, "engine;dur="+formatMs(t.engine))
+	}
+	if queue > 0 {
+		entries = append(entries, "queue;dur="+formatMs(queue))
+	}
+	return strings.Join(entries, ", ")
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 1, 64)
+}
+
+// timingWriter sets the Server-Timing header before the response header is
+// written.
+type timingWriter struct {
+	http.ResponseWriter
+	timing  *requestTiming
+	written bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.Header().Set("Server-Timing", w.timing.header(time.Now()))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
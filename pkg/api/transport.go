@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEngineMaxIdleConns    = 64
+	defaultEngineIdleConnTimeout = 90 * time.Second
+	defaultEngineConnectBackoff  = 50 * time.Millisecond
+)
+
+// newEngineTransport is the transport of every request to the query engine.
+// The engine is local, so responses aren't compressed and enough idle
+// connections are kept for the request concurrency to reuse them instead of
+// piling up in TIME_WAIT.
+func newEngineTransport(maxIdleConns int, idleConnTimeout time.Duration) *http.Transport {
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultEngineMaxIdleConns
+	}
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultEngineIdleConnTimeout
+	}
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleConnTimeout,
+		DisableCompression:  true,
+	}
+}
+
+// countingTransport counts the connections requests got, new or reused.
+type countingTransport struct {
+	next http.RoundTripper
+	sink MetricsSink
+}
+
+func (t countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.sink.Count(metricEngineConnections, 1, "reused", strconv.FormatBool(info.Reused))
+		},
+	}
+	return t.next.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+}
+
+// drain reads the rest of a response body and closes it, so the connection
+// can be reused.
+func drain(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// doEngine sends req to the query engine. While the engine refuses
+// connections, e.g. while it starts or recovers a large WAL, req is sent
+// again up to connectRetries times, connectBackoff apart. Nothing reached
+// the engine then, so retrying is safe for every request.
+func (h *Handler) doEngine(req *http.Request) (*http.Response, error) {
+	return h.doEngineWith(h.client, req)
+}
+
+// doEngineWith is doEngine with another client, e.g. one without timeout
+// for streamed responses.
+func (h *Handler) doEngineWith(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Do(req)
+		if err == nil || attempt >= h.connectRetries || !isDialError(err) {
+			return resp, err
+		}
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			req.Body = body
+		} else if req.Body != nil && req.Body != http.NoBody {
+			// the body is consumed
+			return nil, err
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-time.After(h.connectBackoff):
+		}
+		h.sink.Count(metricEngineConnectRetries, 1)
+	}
+}
+
+// isDialError reports whether err is a failure to connect.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
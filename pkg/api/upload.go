@@ -0,0 +1,358 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
+)
+
+// filesPrefix is the path prefix of the file downloads:
+// /files/{model}/{id}/{field} serves the Bytes field of a record.
+const filesPrefix = "/files/"
+
+// defaultFileContentType is served for Bytes fields without a configured
+// content type.
+const defaultFileContentType = "application/octet-stream"
+
+// uploadError is why a multipart upload was refused, with its status.
+type uploadError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *uploadError) Error() string {
+	return e.message
+}
+
+func badUpload(format string, args ...interface{}) *uploadError {
+	return &uploadError{http.StatusBadRequest, "BAD_UPLOAD", fmt.Sprintf(format, args...)}
+}
+
+// isUpload reports whether r is a GraphQL multipart request.
+func isUpload(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// readUpload reads a GraphQL multipart request: the operations part, the
+// map part and the files, in that order. Every file is base64 encoded into
+// the variables the map names, which must be Bytes inputs of the operation,
+// and the operations are returned as the JSON body sent to the engine,
+// with the number of files. Batched operations aren't supported.
+func (h *Handler) readUpload(r *http.Request) ([]byte, int, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, 0, badUpload("the multipart body could not be read: %v", err)
+	}
+	var (
+		operations []byte
+		paths      map[string][]string
+		total      int64
+		files      int
+	)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, badUpload("the multipart body could not be read: %v", err)
+		}
+		name := part.FormName()
+		isFile := name != "operations" && name != "map"
+		limit := h.maxUploadTotal - total
+		if isFile && h.maxUploadFile < limit {
+			limit = h.maxUploadFile
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(part, limit+1))
+		part.Close()
+		if err != nil {
+			return nil, 0, badUpload("the multipart body could not be read: %v", err)
+		}
+		if int64(len(data)) > limit {
+			message := fmt.Sprintf("the upload exceeds %d bytes in total", h.maxUploadTotal)
+			if isFile && limit == h.maxUploadFile {
+				message = fmt.Sprintf("the file %s exceeds %d bytes", name, h.maxUploadFile)
+			}
+			return nil, 0, &uploadError{http.StatusRequestEntityTooLarge, "UPLOAD_TOO_LARGE", message}
+		}
+		total += int64(len(data))
+
+		switch {
+		case name == "operations":
+			if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+				return nil, 0, badUpload("operations must be a GraphQL request object, batches aren't supported")
+			}
+			operations = data
+		case name == "map":
+			if operations == nil {
+				return nil, 0, badUpload("the operations part must come before the map")
+			}
+			if err := json.Unmarshal(data, &paths); err != nil {
+				return nil, 0, badUpload("map must be a JSON object of file paths: %v", err)
+			}
+			if err := h.checkUploadTargets(operations, paths); err != nil {
+				return nil, 0, err
+			}
+		default:
+			if paths == nil {
+				return nil, 0, badUpload("the map part must come before the files")
+			}
+			targets, ok := paths[name]
+			if !ok {
+				return nil, 0, badUpload("the file %s isn't in the map", name)
+			}
+			delete(paths, name)
+			encoded, _ := json.Marshal(base64.StdEncoding.EncodeToString(data))
+			for _, path := range targets {
+				if operations, err = setUploadVariable(operations, path, encoded); err != nil {
+					return nil, 0, err
+				}
+			}
+			files++
+		}
+	}
+	if operations == nil || paths == nil {
+		return nil, 0, badUpload("a multipart request needs the operations and map parts")
+	}
+	for name := range paths {
+		return nil, 0, badUpload("the file %s of the map is missing", name)
+	}
+	return operations, files, nil
+}
+
+// setUploadVariable sets the value at path, like variables.data.content, of
+// the operations to encoded. The value must be present, as null.
+func setUploadVariable(operations []byte, path string, encoded []byte) ([]byte, error) {
+	keys := strings.Split(path, ".")
+	for i, key := range keys {
+		if _, err := strconv.Atoi(key); err == nil {
+			keys[i] = "[" + key + "]"
+		}
+	}
+	if _, dataType, _, err := jsonparser.Get(operations, keys...); err != nil || dataType != jsonparser.Null {
+		return nil, badUpload("%s: the mapped value must be null", path)
+	}
+	// Set may write to the array of its input
+	set, err := jsonparser.Set(append([]byte(nil), operations...), encoded, keys...)
+	if err != nil {
+		return nil, badUpload("%s: the file could not be set: %v", path, err)
+	}
+	return set, nil
+}
+
+// checkUploadTargets refuses uploads mapped to variables that aren't Bytes
+// inputs of the operation according to the schema of the engine.
+func (h *Handler) checkUploadTargets(operations []byte, paths map[string][]string) error {
+	schema, err := h.schema()
+	if err != nil {
+		return &uploadError{http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine"}
+	}
+	query, err := jsonparser.GetString(operations, "query")
+	if err != nil {
+		return badUpload("operations has no query")
+	}
+	operationName, _ := jsonparser.GetString(operations, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return badUpload("the query could not be parsed")
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 {
+		return badUpload("operation %q not found", operationName)
+	}
+	for _, targets := range paths {
+		for _, path := range targets {
+			keys := strings.Split(path, ".")
+			if len(keys) < 2 || keys[0] != "variables" {
+				return badUpload("%s: files can only be mapped to variables", path)
+			}
+			if !isBytesInput(&doc, op, keys[1:], schema.inputs) {
+				return badUpload("%s isn't a Bytes input, files can only be uploaded to Bytes fields", path)
+			}
+		}
+	}
+	return nil
+}
+
+// isBytesInput reports whether the variable path, starting with the
+// variable name, leads to a Bytes input through the input objects and
+// lists of its type.
+func isBytesInput(doc *ast.Document, op int, path []string, inputs map[string]map[string]schemaField) bool {
+	var typ schemaField
+	found := false
+	for _, ref := range doc.OperationDefinitions[op].VariableDefinitions.Refs {
+		def := doc.VariableDefinitions[ref]
+		if doc.VariableValueNameString(def.VariableValue.Ref) != path[0] {
+			continue
+		}
+		typ, found = schemaField{typ: doc.ResolveTypeNameString(def.Type)}, true
+		for t := def.Type; t != -1; t = doc.Types[t].OfType {
+			if doc.Types[t].TypeKind == ast.TypeKindList {
+				typ.list = true
+			}
+		}
+	}
+	if !found {
+		return false
+	}
+	for _, key := range path[1:] {
+		if _, err := strconv.Atoi(key); err == nil {
+			if !typ.list {
+				return false
+			}
+			typ.list = false
+			continue
+		}
+		field, ok := inputs[typ.typ][key]
+		if typ.list || !ok {
+			return false
+		}
+		typ = field
+	}
+	return typ.typ == "Bytes" && !typ.list
+}
+
+// schemaInputs indexes the fields of the input types in sdl by type and
+// field name.
+func schemaInputs(sdl []byte) map[string]map[string]schemaField {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil
+	}
+	types := map[string]map[string]schemaField{}
+	for i := range doc.InputObjectTypeDefinitions {
+		fields := map[string]schemaField{}
+		for _, ref := range doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs {
+			def := doc.InputValueDefinitions[ref]
+			field := schemaField{typ: doc.ResolveTypeNameString(def.Type)}
+			for typ := def.Type; typ != -1; typ = doc.Types[typ].OfType {
+				if doc.Types[typ].TypeKind == ast.TypeKindList {
+					field.list = true
+				}
+			}
+			fields[doc.InputValueDefinitionNameString(ref)] = field
+		}
+		types[doc.InputObjectTypeDefinitionNameString(i)] = fields
+	}
+	return types
+}
+
+// serveFile serves the Bytes field of a record, decoded, with the content
+// type configured for the field:
+//
+//	GET /files/{model}/{id}/{field}
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "files are read with GET")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, filesPrefix), "/")
+	if len(parts) != 3 {
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", "files are served on /files/{model}/{id}/{field}")
+		return
+	}
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("files", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return
+	}
+	model, ok := schema.models[parts[0]]
+	if !ok || h.visibility.hides(model.Name, parts[2]) {
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown model %q", parts[0]))
+		return
+	}
+	if _, ok := h.rowFilters[model.Name]; ok {
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", "the row filter of "+model.Name+" only applies to GraphQL requests")
+		return
+	}
+	if h.softDelete != nil && h.softDelete.models[model.Name] {
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", "the soft deletes of "+model.Name+" only apply to GraphQL requests")
+		return
+	}
+	if rules := h.currentAuthRules(); rules != nil {
+		op := &operation{rootFields: []string{"findUnique" + model.Name}}
+		if denied := rules.authorize(r.Context(), op); denied != nil {
+			h.sink.Count(metricAuthRuleDenials, 1)
+			writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", denied.Error())
+			return
+		}
+	}
+	if grants := h.grants(r.Context()); grants != nil && !grants.allows(model.Name, grantRead) {
+		h.sink.Count(metricModelGrantDenials, 1)
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", fmt.Sprintf("reading files of %s needs the grant %s:read", model.Name, model.Name))
+		return
+	}
+	field, ok := model.field(parts[2])
+	if !ok || field.Type != "Bytes" || field.List {
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("%s has no Bytes field %q", model.Name, parts[2]))
+		return
+	}
+	id, err := model.ID.value(parts[1])
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"query": fmt.Sprintf("query($where: %s) { findUnique%s(where: $where) { %s } }",
+			model.args["findUnique"+model.Name]["where"], model.Name, field.Name),
+		"variables": map[string]interface{}{"where": map[string]interface{}{model.ID.Name: id}},
+	})
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, captureErrors: h.recent != nil}
+	w = rec
+	defer func() {
+		took := time.Since(start)
+		h.recordRequest(r.Context(), "file", rec.status, took.Seconds())
+		h.logRequest(r, body, "file", rec, took)
+	}()
+
+	data, err := h.callEngine(r.Context(), body, false)
+	if err != nil {
+		tracing.Logger(r.Context()).Error("files: query engine", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine could not be reached")
+		return
+	}
+	if message, err := jsonparser.GetString(data, "errors", "[0]", "error"); err == nil {
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_ERROR", message)
+		return
+	}
+	encoded, err := jsonparser.GetString(data, "data", "findUnique"+model.Name, field.Name)
+	if err != nil {
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", "record or file not found")
+		return
+	}
+	contentType := h.fileContentTypes[model.Name+"."+field.Name]
+	if contentType == "" {
+		contentType = defaultFileContentType
+	}
+	file, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_ERROR", "the query engine answered a malformed Bytes value")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	// the file is whatever was uploaded, browsers must not guess its type
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.Itoa(len(file)))
+	_, _ = w.Write(file)
+}
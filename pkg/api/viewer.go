@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"wunderbase/pkg/tracing"
+	"wunderbase/pkg/viewer"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"golang.org/x/exp/slog"
+)
+
+// schemaViewerPath serves the viewer page, with the introspection response
+// on <path>.json and model row counts on <path>/count?model=.
+const schemaViewerPath = "/schema/viewer"
+
+// schemaCache is the SDL of the query engine, the introspection response
+// generated from it, its models by name and its fields indexed for the row
+// limit and the uploads. The DMMF is added once it was asked for.
+type schemaCache struct {
+	sdl           []byte
+	version       string
+	dmmf          []byte
+	introspection []byte
+	models        map[string]restModel
+	fields        map[string]map[string]schemaField
+	inputs        map[string]map[string]schemaField
+	// hidden is nil without hidden models and fields
+	hidden *hiddenSchema
+	// index is nil without soft deleted models, model grants and row
+	// filters
+	index *schemaIndex
+	// granted are the introspection responses pruned to the models granted
+	// to callers, by modelGrants.key
+	granted *sync.Map
+}
+
+// schema returns the cached schema, fetching it from the query engine the
+// first time. The schema only changes with a new engine, which Resume
+// starts after a swap and a process after sleeping.
+func (h *Handler) schema() (*schemaCache, error) {
+	if cached, ok := h.schemaCache.Load().(*schemaCache); ok && cached != nil {
+		return cached, nil
+	}
+	resp, err := h.client.Get(h.queryEngineSdlURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch sdl: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch sdl: unexpected status %d", resp.StatusCode)
+	}
+	sdl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read sdl: %w", err)
+	}
+	// clients see the schema without the hidden models and fields
+	served, hidden := sdl, (*hiddenSchema)(nil)
+	if h.visibility != nil {
+		if served, err = h.visibility.prune(sdl); err != nil {
+			return nil, err
+		}
+		if hidden, err = newHiddenSchema(sdl, served); err != nil {
+			return nil, err
+		}
+	}
+	introspection, err := Introspect(served)
+	if err != nil {
+		return nil, err
+	}
+	models, err := parseRESTModels(sdl)
+	if err != nil {
+		return nil, err
+	}
+	cached := &schemaCache{sdl: sdl, version: schemaVersion(served), introspection: introspection, hidden: hidden, models: map[string]restModel{}, fields: schemaFields(sdl), inputs: schemaInputs(sdl), granted: &sync.Map{}}
+	for _, m := range models {
+		cached.models[m.Name] = m
+	}
+	if h.softDelete != nil || h.modelGrants || h.rowFilters != nil {
+		doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+		if report.HasErrors() {
+			return nil, fmt.Errorf("parse sdl: %s", report.Error())
+		}
+		index := indexSchema(&doc)
+		cached.index = &index
+	}
+	h.schemaCache.Store(cached)
+	h.schemaWatchers.publish(cached.version)
+	return cached, nil
+}
+
+// ModelCount returns the number of models of the schema served.
+func (h *Handler) ModelCount() (int, error) {
+	schema, err := h.schema()
+	if err != nil {
+		return 0, err
+	}
+	return len(schema.models), nil
+}
+
+func (h *Handler) serveSchemaViewer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeGraphQLError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "the schema viewer only answers GET")
+		return
+	}
+	switch r.URL.Path {
+	case schemaViewerPath:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(viewer.HTML()))
+	case schemaViewerPath + ".json":
+		schema, err := h.schema()
+		if err != nil {
+			tracing.Logger(r.Context()).Error("schema viewer", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+			return
+		}
+		introspection, err := h.introspection(r.Context(), schema)
+		if err != nil {
+			tracing.Logger(r.Context()).Error("schema viewer", slog.String("error", err.Error()))
+			writeGraphQLError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR", "the schema could not be pruned to the granted models")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(introspection)
+	case schemaViewerPath + "/count":
+		h.serveModelCount(w, r)
+	default:
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+// serveModelCount counts the rows of a model with an aggregate query, which
+// takes from the read limit like any other query.
+func (h *Handler) serveModelCount(w http.ResponseWriter, r *http.Request) {
+	model := r.URL.Query().Get("model")
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("schema viewer", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return
+	}
+	if _, ok := schema.models[model]; !ok || h.visibility.hides(model, "") {
+		writeGraphQLError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown model %q", model))
+		return
+	}
+	if grants := h.grants(r.Context()); grants != nil && !grants.allows(model, grantRead) {
+		h.sink.Count(metricModelGrantDenials, 1)
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN", fmt.Sprintf("counting %s needs the grant %s:read", model, model))
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"query":     fmt.Sprintf("query { aggregate%s { _count { _all } } }", model),
+		"variables": map[string]interface{}{},
+	})
+	data, err := h.callEngine(r.Context(), body, false)
+	if err != nil {
+		tracing.Logger(r.Context()).Error("schema viewer: count", slog.String("model", model), slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the query engine did not answer")
+		return
+	}
+	count, err := jsonparser.GetInt(data, "data", "aggregate"+model, "_count", "_all")
+	if err != nil {
+		message, _ := jsonparser.GetString(data, "errors", "[0]", "error")
+		writeGraphQLError(w, http.StatusBadGateway, "COUNT_FAILED", "counting failed: "+message)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"model": model, "count": count})
+}
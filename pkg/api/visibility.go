@@ -0,0 +1,543 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"wunderbase/pkg/tracing"
+
+	"github.com/buger/jsonparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/ast"
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/astprinter"
+	"golang.org/x/exp/slog"
+)
+
+// visibility is the part of the schema kept from clients by HiddenModels
+// and HiddenFields: the SDL they see is pruned of it, and requests touching
+// it are refused.
+type visibility struct {
+	models map[string]bool
+	// fields are the hidden fields by model
+	fields map[string]map[string]bool
+}
+
+// newVisibility returns nil when nothing is hidden. Fields are Model.field,
+// like WUNDERBASE_HIDDEN_FIELDS requires.
+func newVisibility(models, fields []string) *visibility {
+	if len(models) == 0 && len(fields) == 0 {
+		return nil
+	}
+	v := &visibility{models: map[string]bool{}, fields: map[string]map[string]bool{}}
+	for _, model := range models {
+		v.models[model] = true
+	}
+	for _, field := range fields {
+		model, name, _ := strings.Cut(field, ".")
+		if v.fields[model] == nil {
+			v.fields[model] = map[string]bool{}
+		}
+		v.fields[model][name] = true
+	}
+	return v
+}
+
+// hides reports whether a model, or a field of it if field isn't empty, is
+// hidden.
+func (v *visibility) hides(model, field string) bool {
+	return v != nil && (v.models[model] || field != "" && v.fields[model][field])
+}
+
+// check reports the hidden models and fields the schema doesn't have, which
+// would otherwise go unnoticed until the name is fixed.
+func (v *visibility) check(sdl []byte) error {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	index := indexSchema(&doc)
+	models := map[string]bool{}
+	for _, model := range schemaModels(&doc) {
+		models[model] = true
+	}
+	var unknown []string
+	for model := range v.models {
+		if !models[model] {
+			unknown = append(unknown, "model "+model)
+		}
+	}
+	for model, fields := range v.fields {
+		for field := range fields {
+			if _, ok := index.fields[model][field]; !ok || !models[model] {
+				unknown = append(unknown, "field "+model+"."+field)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("wunderbase: hidden %s not in the schema", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// CheckHiddenSchema fails if a hidden model or field isn't in the schema
+// of the query engine.
+func (h *Handler) CheckHiddenSchema() error {
+	if h.visibility == nil {
+		return nil
+	}
+	schema, err := h.schema()
+	if err != nil {
+		return fmt.Errorf("wunderbase: hidden models and fields: %w", err)
+	}
+	return h.visibility.check(schema.sdl)
+}
+
+// refuseHidden answers 403 FORBIDDEN_FIELD to a request touching a hidden
+// model or field, and to introspection other than the introspection query,
+// which the engine would answer from its whole schema.
+func (h *Handler) refuseHidden(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if introspects(body) {
+		h.sink.Count(metricHiddenFieldRejections, 1)
+		writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN_FIELD", "only the IntrospectionQuery is answered while models or fields are hidden")
+		return true
+	}
+	schema, err := h.schema()
+	if err != nil {
+		tracing.Logger(r.Context()).Error("hidden fields", slog.String("error", err.Error()))
+		writeGraphQLError(w, http.StatusBadGateway, "ENGINE_UNAVAILABLE", "the schema could not be read from the query engine")
+		return true
+	}
+	touched := schema.hidden.touches(body)
+	if touched == "" {
+		return false
+	}
+	h.sink.Count(metricHiddenFieldRejections, 1)
+	writeGraphQLError(w, http.StatusForbidden, "FORBIDDEN_FIELD", fmt.Sprintf("%s is not exposed by this API", touched))
+	return true
+}
+
+// schemaModels returns the models of the query engine's SDL, the object
+// types with a findUnique query.
+func schemaModels(doc *ast.Document) []string {
+	queries := map[string]bool{}
+	for i := range doc.ObjectTypeDefinitions {
+		if doc.ObjectTypeDefinitionNameString(i) != "Query" {
+			continue
+		}
+		for _, ref := range doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs {
+			queries[doc.FieldDefinitionNameString(ref)] = true
+		}
+	}
+	var models []string
+	for i := range doc.ObjectTypeDefinitions {
+		if name := doc.ObjectTypeDefinitionNameString(i); queries["findUnique"+name] {
+			models = append(models, name)
+		}
+	}
+	return models
+}
+
+// modelOf returns the model a type of the SDL was generated for: the model
+// itself, Aggregate<Model> or a type named after it like UserWhereInput or
+// UserScalarFieldEnum. The longest model wins, so UserProfileWhereInput is
+// of UserProfile rather than User. Shared types like IntFilter have none.
+func modelOf(typeName string, models []string) string {
+	var owner string
+	for _, model := range models {
+		name := typeName
+		if strings.TrimPrefix(name, "Aggregate") == model {
+			name = model
+		}
+		if !strings.HasPrefix(name, model) {
+			continue
+		}
+		if rest := name[len(model):]; rest != "" && (rest[0] < 'A' || rest[0] > 'Z') {
+			continue
+		}
+		if len(model) > len(owner) {
+			owner = model
+		}
+	}
+	return owner
+}
+
+// prune returns the SDL without the hidden models and fields. The types
+// generated for a hidden model go with it, as do the hidden fields in the
+// types of their model, like the where and create inputs. What then refers
+// to a removed type goes too: a field returning it or taking it as
+// argument, an input field of it and an input requiring it. Types no
+// longer reachable from the root types are left out last.
+func (v *visibility) prune(sdl []byte) ([]byte, error) {
+	doc, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	models := schemaModels(&doc)
+	removed := map[string]bool{}
+	for _, node := range doc.RootNodes {
+		if name := doc.NodeNameString(node); v.models[modelOf(name, models)] {
+			removed[name] = true
+		}
+	}
+	for i := range doc.ObjectTypeDefinitions {
+		hidden := v.fields[modelOf(doc.ObjectTypeDefinitionNameString(i), models)]
+		refs := &doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs
+		*refs = keepRefs(*refs, func(ref int) bool { return !hidden[doc.FieldDefinitionNameString(ref)] })
+	}
+	for i := range doc.InputObjectTypeDefinitions {
+		hidden := v.fields[modelOf(doc.InputObjectTypeDefinitionNameString(i), models)]
+		refs := &doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs
+		*refs = keepRefs(*refs, func(ref int) bool { return !hidden[doc.InputValueDefinitionNameString(ref)] })
+	}
+	for i := range doc.EnumTypeDefinitions {
+		hidden := v.fields[modelOf(doc.EnumTypeDefinitionNameString(i), models)]
+		refs := &doc.EnumTypeDefinitions[i].EnumValuesDefinition.Refs
+		*refs = keepRefs(*refs, func(ref int) bool { return !hidden[doc.EnumValueDefinitionNameString(ref)] })
+	}
+
+	// removing a type can leave others empty or unusable, until none is
+	for count := -1; count != len(removed); {
+		count = len(removed)
+		for i := range doc.ObjectTypeDefinitions {
+			refs := &doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs
+			*refs = keepRefs(*refs, func(ref int) bool {
+				// a field losing an argument would change what it does,
+				// like deleteMany without its where
+				for _, arg := range doc.FieldDefinitions[ref].ArgumentsDefinition.Refs {
+					if removed[doc.ResolveTypeNameString(doc.InputValueDefinitions[arg].Type)] {
+						return false
+					}
+				}
+				return !removed[doc.ResolveTypeNameString(doc.FieldDefinitions[ref].Type)]
+			})
+			if len(*refs) == 0 {
+				removed[doc.ObjectTypeDefinitionNameString(i)] = true
+			}
+		}
+		for i := range doc.InputObjectTypeDefinitions {
+			refs := &doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs
+			required := false
+			*refs = keepRefs(*refs, func(ref int) bool {
+				typ := doc.InputValueDefinitions[ref].Type
+				if !removed[doc.ResolveTypeNameString(typ)] {
+					return true
+				}
+				required = required || doc.Types[typ].TypeKind == ast.TypeKindNonNull
+				return false
+			})
+			if required || len(*refs) == 0 {
+				removed[doc.InputObjectTypeDefinitionNameString(i)] = true
+			}
+		}
+		for i := range doc.EnumTypeDefinitions {
+			if len(doc.EnumTypeDefinitions[i].EnumValuesDefinition.Refs) == 0 {
+				removed[doc.EnumTypeDefinitionNameString(i)] = true
+			}
+		}
+	}
+
+	reachable := reachableTypes(&doc, removed)
+	kept := doc.RootNodes[:0]
+	for _, node := range doc.RootNodes {
+		switch node.Kind {
+		case ast.NodeKindObjectTypeDefinition, ast.NodeKindInputObjectTypeDefinition,
+			ast.NodeKindEnumTypeDefinition, ast.NodeKindScalarTypeDefinition:
+			if !reachable[doc.NodeNameString(node)] {
+				continue
+			}
+		}
+		kept = append(kept, node)
+	}
+	doc.RootNodes = kept
+	pruned, err := astprinter.PrintStringIndent(&doc, nil, "  ")
+	if err != nil {
+		return nil, fmt.Errorf("print sdl: %w", err)
+	}
+	return []byte(pruned), nil
+}
+
+func keepRefs(refs []int, keep func(ref int) bool) []int {
+	kept := refs[:0]
+	for _, ref := range refs {
+		if keep(ref) {
+			kept = append(kept, ref)
+		}
+	}
+	return kept
+}
+
+// reachableTypes returns the types that are not removed and reachable from
+// the root types through fields, arguments and input fields.
+func reachableTypes(doc *ast.Document, removed map[string]bool) map[string]bool {
+	objects, inputs := map[string]int{}, map[string]int{}
+	for i := range doc.ObjectTypeDefinitions {
+		objects[doc.ObjectTypeDefinitionNameString(i)] = i
+	}
+	for i := range doc.InputObjectTypeDefinitions {
+		inputs[doc.InputObjectTypeDefinitionNameString(i)] = i
+	}
+	reachable := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if reachable[name] || removed[name] {
+			return
+		}
+		reachable[name] = true
+		if i, ok := objects[name]; ok {
+			for _, ref := range doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs {
+				visit(doc.ResolveTypeNameString(doc.FieldDefinitions[ref].Type))
+				for _, arg := range doc.FieldDefinitions[ref].ArgumentsDefinition.Refs {
+					visit(doc.ResolveTypeNameString(doc.InputValueDefinitions[arg].Type))
+				}
+			}
+		}
+		if i, ok := inputs[name]; ok {
+			for _, ref := range doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs {
+				visit(doc.ResolveTypeNameString(doc.InputValueDefinitions[ref].Type))
+			}
+		}
+	}
+	for _, root := range []string{"Query", "Mutation", "Subscription"} {
+		visit(root)
+	}
+	return reachable
+}
+
+// schemaIndex is what checking requests against the hidden models and
+// fields needs of an SDL.
+type schemaIndex struct {
+	// fields of the object and input types, by type and field name
+	fields map[string]map[string]indexedField
+	// enums are the values of the enums by enum
+	enums map[string]map[string]bool
+}
+
+type indexedField struct {
+	// typ is the named type, args the named types of the arguments
+	typ  string
+	args map[string]string
+}
+
+func indexSchema(doc *ast.Document) schemaIndex {
+	index := schemaIndex{fields: map[string]map[string]indexedField{}, enums: map[string]map[string]bool{}}
+	for i := range doc.ObjectTypeDefinitions {
+		fields := map[string]indexedField{}
+		for _, ref := range doc.ObjectTypeDefinitions[i].FieldsDefinition.Refs {
+			field := indexedField{typ: doc.ResolveTypeNameString(doc.FieldDefinitions[ref].Type), args: map[string]string{}}
+			for _, arg := range doc.FieldDefinitions[ref].ArgumentsDefinition.Refs {
+				field.args[doc.InputValueDefinitionNameString(arg)] = doc.ResolveTypeNameString(doc.InputValueDefinitions[arg].Type)
+			}
+			fields[doc.FieldDefinitionNameString(ref)] = field
+		}
+		index.fields[doc.ObjectTypeDefinitionNameString(i)] = fields
+	}
+	for i := range doc.InputObjectTypeDefinitions {
+		fields := map[string]indexedField{}
+		for _, ref := range doc.InputObjectTypeDefinitions[i].InputFieldsDefinition.Refs {
+			fields[doc.InputValueDefinitionNameString(ref)] = indexedField{typ: doc.ResolveTypeNameString(doc.InputValueDefinitions[ref].Type)}
+		}
+		index.fields[doc.InputObjectTypeDefinitionNameString(i)] = fields
+	}
+	for i := range doc.EnumTypeDefinitions {
+		values := map[string]bool{}
+		for _, ref := range doc.EnumTypeDefinitions[i].EnumValuesDefinition.Refs {
+			values[doc.EnumValueDefinitionNameString(ref)] = true
+		}
+		index.enums[doc.EnumTypeDefinitionNameString(i)] = values
+	}
+	return index
+}
+
+// hiddenSchema is the schema as the query engine serves it and as clients
+// see it, cached with the schema.
+type hiddenSchema struct {
+	full, visible schemaIndex
+}
+
+func newHiddenSchema(sdl, pruned []byte) (*hiddenSchema, error) {
+	full, report := astparser.ParseGraphqlDocumentBytes(sdl)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse sdl: %s", report.Error())
+	}
+	visible, report := astparser.ParseGraphqlDocumentBytes(pruned)
+	if report.HasErrors() {
+		return nil, fmt.Errorf("parse pruned sdl: %s", report.Error())
+	}
+	return &hiddenSchema{full: indexSchema(&full), visible: indexSchema(&visible)}, nil
+}
+
+// touches returns the first hidden field, input field or enum value the
+// operation of a request body selects or passes in its arguments, as
+// Type.name, empty if there is none. A body that doesn't parse touches
+// nothing, the engine reports it.
+func (s *hiddenSchema) touches(body []byte) string {
+	query, err := jsonparser.GetString(body, "query")
+	if err != nil {
+		return ""
+	}
+	operationName, _ := jsonparser.GetString(body, "operationName")
+	doc, report := astparser.ParseGraphqlDocumentString(query)
+	if report.HasErrors() {
+		return ""
+	}
+	op := selectOperation(&doc, operationName)
+	if op == -1 || !doc.OperationDefinitions[op].HasSelections {
+		return ""
+	}
+	root := "Query"
+	switch doc.OperationDefinitions[op].OperationType {
+	case ast.OperationTypeMutation:
+		root = "Mutation"
+	case ast.OperationTypeSubscription:
+		root = "Subscription"
+	}
+	variables, _, _, _ := jsonparser.Get(body, "variables")
+	walk := &hiddenWalk{schema: s, doc: &doc, variables: variables, visited: map[string]bool{}}
+	return walk.selections(doc.OperationDefinitions[op].SelectionSet, root)
+}
+
+// hiddenWalk looks for hidden fields through the selections of an
+// operation, its fragments and the values of its arguments.
+type hiddenWalk struct {
+	schema    *hiddenSchema
+	doc       *ast.Document
+	variables []byte
+	visited   map[string]bool
+}
+
+// hidden reports whether the engine's schema has the field of a type the
+// clients' doesn't.
+func (w *hiddenWalk) hidden(typeName, name string) (indexedField, bool) {
+	field, ok := w.schema.full.fields[typeName][name]
+	if !ok {
+		return field, false
+	}
+	_, visible := w.schema.visible.fields[typeName][name]
+	return field, !visible
+}
+
+func (w *hiddenWalk) selections(set int, typeName string) string {
+	doc := w.doc
+	for _, ref := range doc.SelectionSets[set].SelectionRefs {
+		selection := doc.Selections[ref]
+		switch selection.Kind {
+		case ast.SelectionKindField:
+			name := doc.FieldNameString(selection.Ref)
+			field, hidden := w.hidden(typeName, name)
+			if hidden {
+				return typeName + "." + name
+			}
+			for _, arg := range doc.Fields[selection.Ref].Arguments.Refs {
+				if argType, ok := field.args[doc.ArgumentNameString(arg)]; ok {
+					if touched := w.value(doc.ArgumentValue(arg), argType); touched != "" {
+						return touched
+					}
+				}
+			}
+			if doc.Fields[selection.Ref].HasSelections && field.typ != "" {
+				if touched := w.selections(doc.Fields[selection.Ref].SelectionSet, field.typ); touched != "" {
+					return touched
+				}
+			}
+		case ast.SelectionKindInlineFragment:
+			condition := typeName
+			if name := doc.InlineFragmentTypeConditionNameString(selection.Ref); name != "" {
+				condition = name
+			}
+			if fragment := doc.InlineFragments[selection.Ref]; fragment.HasSelections {
+				if touched := w.selections(fragment.SelectionSet, condition); touched != "" {
+					return touched
+				}
+			}
+		case ast.SelectionKindFragmentSpread:
+			name := doc.FragmentSpreadNameString(selection.Ref)
+			for i := range doc.FragmentDefinitions {
+				if doc.FragmentDefinitionNameString(i) != name || w.visited[name] {
+					continue
+				}
+				w.visited[name] = true
+				if doc.FragmentDefinitions[i].HasSelections {
+					if touched := w.selections(doc.FragmentDefinitions[i].SelectionSet, string(doc.FragmentDefinitionTypeName(i))); touched != "" {
+						return touched
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// value walks an argument value of the named type typeName.
+func (w *hiddenWalk) value(value ast.Value, typeName string) string {
+	doc := w.doc
+	switch value.Kind {
+	case ast.ValueKindObject:
+		for _, ref := range doc.ObjectValues[value.Ref].Refs {
+			name := doc.ObjectFieldNameString(ref)
+			field, hidden := w.hidden(typeName, name)
+			if hidden {
+				return typeName + "." + name
+			}
+			if touched := w.value(doc.ObjectFieldValue(ref), field.typ); touched != "" {
+				return touched
+			}
+		}
+	case ast.ValueKindList:
+		for _, ref := range doc.ListValues[value.Ref].Refs {
+			if touched := w.value(doc.Values[ref], typeName); touched != "" {
+				return touched
+			}
+		}
+	case ast.ValueKindEnum:
+		return w.enumValue(typeName, doc.EnumValueNameString(value.Ref))
+	case ast.ValueKindVariable:
+		data, dataType, _, err := jsonparser.Get(w.variables, doc.VariableValueNameString(value.Ref))
+		if err == nil {
+			return w.variable(data, dataType, typeName)
+		}
+	}
+	return ""
+}
+
+// variable walks the JSON value of a variable passed as an argument of the
+// named type typeName.
+func (w *hiddenWalk) variable(data []byte, dataType jsonparser.ValueType, typeName string) string {
+	var touched string
+	switch dataType {
+	case jsonparser.Object:
+		_ = jsonparser.ObjectEach(data, func(key, value []byte, valueType jsonparser.ValueType, _ int) error {
+			field, hidden := w.hidden(typeName, string(key))
+			if hidden {
+				touched = typeName + "." + string(key)
+			} else {
+				touched = w.variable(value, valueType, field.typ)
+			}
+			if touched != "" {
+				return errHiddenTouched
+			}
+			return nil
+		})
+	case jsonparser.Array:
+		_, _ = jsonparser.ArrayEach(data, func(value []byte, valueType jsonparser.ValueType, _ int, _ error) {
+			if touched == "" {
+				touched = w.variable(value, valueType, typeName)
+			}
+		})
+	case jsonparser.String:
+		return w.enumValue(typeName, string(data))
+	}
+	return touched
+}
+
+// errHiddenTouched stops walking the keys of a variable.
+var errHiddenTouched = fmt.Errorf("hidden field touched")
+
+func (w *hiddenWalk) enumValue(enum, value string) string {
+	if w.schema.full.enums[enum][value] && !w.schema.visible.enums[enum][value] {
+		return enum + "." + value
+	}
+	return ""
+}
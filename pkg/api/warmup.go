@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// defaultWarmupQuery touches the database without reading any table.
+const defaultWarmupQuery = `mutation { queryRaw(query: "SELECT 1", parameters: "[]") }`
+
+// warmupStats is the latest warm-up in the admin stats.
+type warmupStats struct {
+	At         time.Time `json:"at"`
+	DurationMs float64   `json:"durationMs"`
+	Runs       int       `json:"runs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// WarmUp sends the warm-up query to the query engine the configured number
+// of times, so the first request after a start doesn't pay for filling the
+// page cache and the engine's preparations. It is called once the engine
+// answers; until it returns the health endpoint fails. A failing warm-up is
+// logged and cut short, it doesn't keep the engine from serving.
+func (h *Handler) WarmUp(ctx context.Context) {
+	if h.warmupRuns <= 0 {
+		return
+	}
+	atomic.StoreInt32(&h.warmingUp, 1)
+	defer atomic.StoreInt32(&h.warmingUp, 0)
+
+	body, _ := json.Marshal(map[string]string{"query": h.warmupQuery})
+	start := time.Now()
+	stats := &warmupStats{At: start.UTC()}
+	for stats.Runs < h.warmupRuns {
+		data, err := h.postEngine(ctx, body)
+		if err == nil && responseErrorCode(data) != "" {
+			err = fmt.Errorf("the query engine answered %s", data)
+		}
+		if err != nil {
+			stats.Error = err.Error()
+			break
+		}
+		stats.Runs++
+	}
+	took := time.Since(start)
+	stats.DurationMs = float64(took.Microseconds()) / 1000
+	h.warmup.Store(stats)
+
+	attrs := []interface{}{slog.Int("runs", stats.Runs), slog.Duration("took", took)}
+	if h.database != "" {
+		attrs = append(attrs, slog.String("database", h.database))
+	}
+	if stats.Error != "" {
+		slog.Warn("Warming up the query engine", append(attrs, slog.String("error", stats.Error))...)
+		return
+	}
+	slog.Info("Query engine warmed up", attrs...)
+}
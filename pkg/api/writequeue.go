@@ -0,0 +1,150 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultWriteQueueTimeout is the longest a write waits in the queue
+// without WriteQueueTimeout.
+const defaultWriteQueueTimeout = 5 * time.Second
+
+// errWriteQueueTimeout is returned for a write that waited for the queue
+// longer than its timeout.
+var errWriteQueueTimeout = errors.New("wunderbase: write queue timeout")
+
+const writeQueueTimeoutMessage = "too many writes are waiting for the database, retry shortly"
+
+// writeQueue lets a fixed number of writes reach the query engine at a
+// time, the others waiting in arrival order. SQLite runs one write at a
+// time anyway, writes sent together only fight over the lock.
+type writeQueue struct {
+	slots   int
+	timeout time.Duration
+
+	mu      sync.Mutex
+	running int
+	// waiting holds a chan struct{} per waiting write, closed when it is
+	// its turn
+	waiting *list.List
+}
+
+func newWriteQueue(slots int, timeout time.Duration) *writeQueue {
+	if slots <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = defaultWriteQueueTimeout
+	}
+	return &writeQueue{slots: slots, timeout: timeout, waiting: list.New()}
+}
+
+// acquire waits for the turn of a write and returns how long it waited. It
+// fails with errWriteQueueTimeout after the timeout of the queue, or the
+// error of ctx once it is done; release must be called after it succeeded.
+func (q *writeQueue) acquire(ctx context.Context) (time.Duration, error) {
+	q.mu.Lock()
+	if q.running < q.slots && q.waiting.Len() == 0 {
+		q.running++
+		q.mu.Unlock()
+		return 0, nil
+	}
+	turn := make(chan struct{})
+	element := q.waiting.PushBack(turn)
+	q.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-turn:
+		return time.Since(start), nil
+	case <-timer.C:
+		err = errWriteQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-turn:
+		// its turn came while giving up, the slot is passed on
+		q.next()
+	default:
+		q.waiting.Remove(element)
+	}
+	return time.Since(start), err
+}
+
+// release ends a write, letting the next one in.
+func (q *writeQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.next()
+}
+
+// next hands the slot of a finished write to the first waiting one. q.mu
+// must be held.
+func (q *writeQueue) next() {
+	front := q.waiting.Front()
+	if front == nil {
+		q.running--
+		return
+	}
+	q.waiting.Remove(front)
+	close(front.Value.(chan struct{}))
+}
+
+// busy is the number of slots taken.
+func (q *writeQueue) busy() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.running
+}
+
+// depth is the number of writes waiting for their turn.
+func (q *writeQueue) depth() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting.Len()
+}
+
+// enqueueWrite waits for the turn of a write in the write queue, if any,
+// and returns the func ending it. Reads aren't coalesced until it ended.
+func (h *Handler) enqueueWrite(ctx context.Context) (func(), error) {
+	if h.writeQueue == nil {
+		h.coalesce.beginWrite()
+		return h.coalesce.endWrite, nil
+	}
+	waited, err := h.writeQueue.acquire(ctx)
+	h.sink.Observe(metricWriteQueueWaitSeconds, waited.Seconds())
+	if errors.Is(err, errWriteQueueTimeout) {
+		h.sink.Count(metricWriteQueueTimeouts, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.coalesce.beginWrite()
+	return func() {
+		h.coalesce.endWrite()
+		h.writeQueue.release()
+	}, nil
+}
+
+// writeWriteQueueTimeout turns away a write that waited too long for its
+// turn.
+func writeWriteQueueTimeout(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeGraphQLError(w, http.StatusServiceUnavailable, "WRITE_QUEUE_TIMEOUT", writeQueueTimeoutMessage)
+}
@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/branch"
+)
+
+// Open streams a backup from a local path, an http(s) url (e.g. a presigned
+// link) or an s3://bucket/key url, decrypting it with keys if it is
+// encrypted.
+func Open(ctx context.Context, source string, keys [][]byte) (io.ReadCloser, error) {
+	raw, err := open(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := Decrypt(raw, keys)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, raw}, nil
+}
+
+func open(ctx context.Context, source string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		bucket, key, err := parseS3URL(source)
+		if err != nil {
+			return nil, err
+		}
+		client, err := newS3Client()
+		if err != nil {
+			return nil, err
+		}
+		return client.Get(ctx, bucket, key)
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("download %s: %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	default:
+		return os.Open(source)
+	}
+}
+
+// Generation identifies the version of a backup source, it changes whenever
+// the source is rewritten.
+type Generation struct {
+	ID string
+	// Modified is when the source was written, zero if the source doesn't
+	// tell.
+	Modified time.Time
+}
+
+// Stat returns the generation of a backup source without downloading it.
+// Remote sources are identified by their ETag, falling back to size and
+// modification time like local files.
+func Stat(ctx context.Context, source string) (Generation, error) {
+	var header http.Header
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		bucket, key, err := parseS3URL(source)
+		if err != nil {
+			return Generation{}, err
+		}
+		client, err := newS3Client()
+		if err != nil {
+			return Generation{}, err
+		}
+		if header, err = client.Head(ctx, bucket, key); err != nil {
+			return Generation{}, err
+		}
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, source, nil)
+		if err != nil {
+			return Generation{}, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return Generation{}, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return Generation{}, fmt.Errorf("stat %s: %s", source, resp.Status)
+		}
+		header = resp.Header
+	default:
+		info, err := os.Stat(source)
+		if err != nil {
+			return Generation{}, err
+		}
+		return Generation{
+			ID:       fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()),
+			Modified: info.ModTime(),
+		}, nil
+	}
+	modified, _ := http.ParseTime(header.Get("Last-Modified"))
+	id := header.Get("ETag")
+	if id == "" {
+		id = header.Get("Content-Length") + "-" + header.Get("Last-Modified")
+	}
+	return Generation{ID: id, Modified: modified}, nil
+}
+
+// Download copies a backup to a local file.
+func Download(ctx context.Context, source, dst string, keys [][]byte) error {
+	src, err := Open(ctx, source, keys)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return fmt.Errorf("download %s: %w", source, err)
+	}
+	return f.Close()
+}
+
+type CreateOptions struct {
+	Database string
+	// Destination is a local path or an s3://bucket/key url.
+	Destination string
+	// Key encrypts the backup when set.
+	Key []byte
+}
+
+// Create snapshots the database and writes it to the destination,
+// encrypting it first when a key is configured.
+func Create(ctx context.Context, opts CreateOptions) error {
+	dir, err := ioutil.TempDir("", "wunderbase-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := filepath.Join(dir, "db.sqlite")
+	if err := branch.Snapshot(opts.Database, snapshot); err != nil {
+		return err
+	}
+	artifact := snapshot
+	if opts.Key != nil {
+		artifact = snapshot + ".enc"
+		if err := encryptFile(snapshot, artifact, opts.Key); err != nil {
+			return fmt.Errorf("encrypt backup: %w", err)
+		}
+	}
+
+	if !strings.HasPrefix(opts.Destination, "s3://") {
+		return copyFile(artifact, opts.Destination)
+	}
+	bucket, key, err := parseS3URL(opts.Destination)
+	if err != nil {
+		return err
+	}
+	client, err := newS3Client()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(artifact)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return client.Put(ctx, bucket, key, f, info.Size())
+}
+
+func encryptFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	w, err := NewEncryptWriter(out, key)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// sqliteQuery runs a statement with the sqlite3 CLI and returns its output.
+func sqliteQuery(ctx context.Context, sqlitePath, database, query string) (string, error) {
+	cmd := exec.CommandContext(ctx, sqlitePath, "-batch", "-noheader", "-readonly", database, query)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
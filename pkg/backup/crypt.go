@@ -0,0 +1,253 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encrypted backups are a header followed by a sequence of AES-256-GCM
+// sealed chunks:
+//
+//	magic (8) | key id (8) | salt (32) | chunk...
+//	chunk: length (4) | sealed data
+//
+// Each backup is sealed with its own key, derived from the configured one
+// and the random salt with HKDF-SHA256, so nonces never repeat across
+// backups. Each chunk's nonce is the chunk counter, and the header and
+// whether the chunk is the final one are authenticated with it, so a
+// changed header and truncation are detected.
+var magic = []byte("WBENC001")
+
+const (
+	chunkSize  = 64 * 1024
+	saltSize   = 32
+	headerSize = 8 + 8 + saltSize
+)
+
+// ErrEncrypted is returned when an encrypted backup is read without keys.
+var ErrEncrypted = errors.New("backup is encrypted, set WUNDERBASE_BACKUP_ENCRYPTION_KEY to restore it")
+
+// ParseKeys parses a comma separated list of 32 byte keys, each encoded as
+// base64 or hex. The first key encrypts, all of them are tried to decrypt
+// so keys can be rotated.
+func ParseKeys(list string) ([][]byte, error) {
+	var keys [][]byte
+	for _, encoded := range strings.Split(list, ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			key, err = base64.StdEncoding.DecodeString(encoded)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("backup encryption key %d must be 32 bytes encoded as hex or base64", len(keys)+1)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:8]
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileKey derives the key of a backup from the configured key and the salt
+// of its header, with HKDF-SHA256 (RFC 5869).
+func fileKey(key, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	// a single block is the 32 bytes of an AES-256 key
+	expand.Write([]byte("wunderbase backup"))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func nonce(counter uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// chunkAAD is the additional data of a chunk: the header of its backup and
+// whether it is the final chunk.
+func chunkAAD(header []byte, last bool) []byte {
+	flag := byte(0)
+	if last {
+		flag = 1
+	}
+	return append(append([]byte{}, header...), flag)
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+}
+
+// NewEncryptWriter encrypts everything written to it with key. Close must be
+// called to write the final chunk.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(fileKey(key, salt))
+	if err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, magic...), keyID(key)...), salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, header: header, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full buffer is only flushed once more data follows, the last
+		// chunk is written on Close
+		if len(e.buf) == cap(e.buf) {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, nonce(e.counter), e.buf, chunkAAD(e.header, last))
+	e.counter++
+	e.buf = e.buf[:0]
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+type decryptReader struct {
+	r    *bufio.Reader
+	aead cipher.AEAD
+	// header is authenticated with the chunks
+	header  []byte
+	counter uint64
+	plain   []byte
+	done    bool
+}
+
+// Decrypt returns a reader yielding the plaintext of r. Unencrypted backups
+// are passed through unchanged, so restoring works with and without keys.
+func Decrypt(r io.Reader, keys [][]byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if start, err := br.Peek(len(magic)); err != nil || !bytes.Equal(start, magic) {
+		return br, nil
+	}
+	header, err := br.Peek(headerSize)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, ErrEncrypted
+	}
+	header = append([]byte{}, header...)
+	id, salt := header[len(magic):len(magic)+8], header[len(magic)+8:]
+	for _, key := range keys {
+		if !bytes.Equal(keyID(key), id) {
+			continue
+		}
+		aead, err := newAEAD(fileKey(key, salt))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(headerSize); err != nil {
+			return nil, err
+		}
+		return &decryptReader{r: br, aead: aead, header: header}, nil
+	}
+	return nil, fmt.Errorf("backup was encrypted with a key that is not in WUNDERBASE_BACKUP_ENCRYPTION_KEY")
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > chunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("encrypted backup is corrupt: chunk of %d bytes", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	n := nonce(d.counter)
+	d.counter++
+	if plain, err := d.aead.Open(nil, n, sealed, chunkAAD(d.header, false)); err == nil {
+		d.plain = plain
+		return nil
+	}
+	plain, err := d.aead.Open(nil, n, sealed, chunkAAD(d.header, true))
+	if err != nil {
+		return fmt.Errorf("decrypt backup: %w", err)
+	}
+	if _, err := d.r.Peek(1); err == nil {
+		return errors.New("encrypted backup is corrupt: data after the final chunk")
+	} else if err != io.EOF {
+		return fmt.Errorf("read backup: %w", err)
+	}
+	d.plain = plain
+	d.done = true
+	return nil
+}
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	require.NoError(t, err)
+	_, err = w.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys, err := ParseKeys("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+
+		r, err := Decrypt(bytes.NewReader(encrypt(t, keys[0], plain)), keys)
+		require.NoError(t, err)
+		got, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, plain, got, "size %d", size)
+	}
+}
+
+func TestDecryptKeyRotation(t *testing.T) {
+	old := bytes.Repeat([]byte{1}, 32)
+	current := bytes.Repeat([]byte{2}, 32)
+	sealed := encrypt(t, old, []byte("hello"))
+
+	r, err := Decrypt(bytes.NewReader(sealed), [][]byte{current, old})
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+
+	_, err = Decrypt(bytes.NewReader(sealed), [][]byte{current})
+	assert.Error(t, err)
+
+	_, err = Decrypt(bytes.NewReader(sealed), nil)
+	assert.Equal(t, ErrEncrypted, err)
+}
+
+func TestDecryptDetectsTruncation(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	sealed := encrypt(t, key, make([]byte, 2*chunkSize+10))
+
+	// drop the final chunk entirely
+	truncated := sealed[:headerSize+2*(4+chunkSize+16)]
+	r, err := Decrypt(bytes.NewReader(truncated), [][]byte{key})
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+}
+
+func TestDecryptPassesPlaintextThrough(t *testing.T) {
+	r, err := Decrypt(bytes.NewReader([]byte("SQLite format 3\x00")), nil)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "SQLite format 3\x00", string(got))
+}
+
+func TestDecryptRejectsCorruption(t *testing.T) {
+	key := bytes.Repeat([]byte{4}, 32)
+	sealed := encrypt(t, key, []byte("hello"))
+	decrypt := func(data []byte) error {
+		r, err := Decrypt(bytes.NewReader(data), [][]byte{key})
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(r)
+		return err
+	}
+	require.NoError(t, decrypt(sealed))
+
+	// the salt is authenticated with the chunks
+	tampered := append([]byte{}, sealed...)
+	tampered[headerSize-1] ^= 1
+	assert.Error(t, decrypt(tampered))
+
+	// a chunk length above the chunk size isn't allocated
+	huge := append([]byte{}, sealed[:headerSize]...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xff)
+	assert.ErrorContains(t, decrypt(huge), "corrupt")
+
+	assert.ErrorContains(t, decrypt(append(append([]byte{}, sealed...), 0)), "after the final chunk")
+}
+
+func TestEncryptDerivesAKeyPerBackup(t *testing.T) {
+	key := bytes.Repeat([]byte{5}, 32)
+	first, second := encrypt(t, key, []byte("hello")), encrypt(t, key, []byte("hello"))
+	assert.Equal(t, first[:headerSize-saltSize], second[:headerSize-saltSize])
+	assert.NotEqual(t, first[headerSize-saltSize:headerSize], second[headerSize-saltSize:headerSize])
+	assert.NotEqual(t, first[headerSize:], second[headerSize:])
+}
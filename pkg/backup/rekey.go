@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RekeyOptions configure Rekey.
+type RekeyOptions struct {
+	// SqlitePath is a sqlite3 CLI built against SQLCipher.
+	SqlitePath string
+	Database   string
+	Key        string
+	NewKey     string
+}
+
+// Rekey changes the key of a database encrypted with SQLCipher with PRAGMA
+// rekey, after copying it next to itself as <database>.pre-rekey-<time>,
+// still encrypted with the old key. It returns the path of the copy. The
+// keys are sent on stdin, never as arguments, and errors never include
+// them.
+func Rekey(ctx context.Context, opts RekeyOptions) (string, error) {
+	if opts.Key == "" || opts.NewKey == "" {
+		return "", errors.New("rekey: the current and the new key are required")
+	}
+	if opts.Key == opts.NewKey {
+		return "", errors.New("rekey: the new key is the current key")
+	}
+	// the WAL is folded into the database so the copy is complete
+	if err := sqlcipher(ctx, opts, opts.Key, "SELECT count(*) FROM sqlite_master;\nPRAGMA wal_checkpoint(TRUNCATE);"); err != nil {
+		return "", fmt.Errorf("rekey: the current key doesn't unlock %s: %w", opts.Database, err)
+	}
+	copied := fmt.Sprintf("%s.pre-rekey-%s", opts.Database, time.Now().UTC().Format("20060102T150405Z"))
+	if err := copyFile(opts.Database, copied); err != nil {
+		return "", fmt.Errorf("rekey: copy the database: %w", err)
+	}
+	if err := os.Chmod(copied, 0600); err != nil {
+		return "", fmt.Errorf("rekey: copy the database: %w", err)
+	}
+	if err := sqlcipher(ctx, opts, opts.Key, "PRAGMA rekey = "+sqlKey(opts.NewKey)+";"); err != nil {
+		return copied, fmt.Errorf("rekey: %w", err)
+	}
+	if err := sqlcipher(ctx, opts, opts.NewKey, "SELECT count(*) FROM sqlite_master;"); err != nil {
+		return copied, fmt.Errorf("rekey: the new key doesn't unlock %s, restore %s: %w", opts.Database, copied, err)
+	}
+	return copied, nil
+}
+
+// sqlcipher runs script on the database unlocked with key.
+func sqlcipher(ctx context.Context, opts RekeyOptions, key, script string) error {
+	cmd := exec.CommandContext(ctx, opts.SqlitePath, "-batch", "-bail", opts.Database)
+	cmd.Stdin = strings.NewReader("PRAGMA key = " + sqlKey(key) + ";\n" + script + "\n")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// the CLI may echo the failing statement
+		redact := strings.NewReplacer(sqlKey(opts.Key), "<redacted>", sqlKey(opts.NewKey), "<redacted>",
+			opts.Key, "<redacted>", opts.NewKey, "<redacted>")
+		return fmt.Errorf("sqlite3: %v: %s", err, redact.Replace(strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+// sqlKey quotes a key for PRAGMA key, raw keys given as x'<hex>' as they
+// are.
+func sqlKey(key string) string {
+	if strings.HasPrefix(key, "x'") && strings.HasSuffix(key, "'") {
+		return `"` + key + `"`
+	}
+	return "'" + strings.ReplaceAll(key, "'", "''") + "'"
+}
@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRekey(t *testing.T) {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	// the fake CLI records its arguments and script, and fails echoing the
+	// script for the key "wrong"
+	sqlite := filepath.Join(dir, "sqlite3")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\nin=$(cat)\necho \"$in\" >> " + calls +
+		"\ncase \"$in\" in *\"key = 'wrong'\"*) echo \"Error: in prepare, $in\"; exit 1;; esac\n"
+	require.NoError(t, os.WriteFile(sqlite, []byte(script), 0755))
+	database := filepath.Join(dir, "data.db")
+	require.NoError(t, os.WriteFile(database, []byte("encrypted"), 0600))
+
+	copied, err := Rekey(context.Background(), RekeyOptions{SqlitePath: sqlite, Database: database, Key: "old secret", NewKey: "new secret"})
+	require.NoError(t, err)
+	data, err := os.ReadFile(copied)
+	require.NoError(t, err)
+	assert.Equal(t, "encrypted", string(data))
+
+	recorded, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Contains(t, string(recorded), "-batch -bail "+database+"\nPRAGMA key = 'old secret';\nPRAGMA rekey = 'new secret';")
+	assert.Contains(t, string(recorded), "PRAGMA key = 'new secret';\nSELECT count(*) FROM sqlite_master;")
+
+	_, err = Rekey(context.Background(), RekeyOptions{SqlitePath: sqlite, Database: database, Key: "wrong", NewKey: "new secret"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the current key doesn't unlock")
+	assert.NotContains(t, err.Error(), "wrong")
+	assert.NotContains(t, err.Error(), "new secret")
+}
+
+func TestSQLKey(t *testing.T) {
+	assert.Equal(t, `'it''s'`, sqlKey("it's"))
+	assert.Equal(t, `"x'2DD29CA8'"`, sqlKey("x'2DD29CA8'"))
+}
@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is a backup and the generation it was written as.
+type Snapshot struct {
+	Source string
+	Generation
+}
+
+// Snapshots lists the backups of sources, oldest first. A local directory
+// stands for the files in it, like a directory backup create writes dated
+// backups into; other sources are single backups. Sources that don't tell
+// when they were written are left out, they can't be placed in time.
+func Snapshots(ctx context.Context, sources []string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	for _, source := range sources {
+		files := []string{source}
+		if !strings.Contains(source, "://") {
+			if info, err := os.Stat(source); err == nil && info.IsDir() {
+				entries, err := ioutil.ReadDir(source)
+				if err != nil {
+					return nil, err
+				}
+				files = files[:0]
+				for _, entry := range entries {
+					if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+						files = append(files, filepath.Join(source, entry.Name()))
+					}
+				}
+			}
+		}
+		for _, file := range files {
+			generation, err := Stat(ctx, file)
+			if err != nil {
+				return nil, fmt.Errorf("stat %s: %w", file, err)
+			}
+			if generation.Modified.IsZero() {
+				continue
+			}
+			snapshots = append(snapshots, Snapshot{Source: file, Generation: generation})
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Modified.Before(snapshots[j].Modified)
+	})
+	return snapshots, nil
+}
+
+// Closest returns the latest of snapshots, as listed by Snapshots, written
+// at or before at: the state of the database at that time as far as the
+// backups know it. It reports false if all were written later.
+func Closest(snapshots []Snapshot, at time.Time) (Snapshot, bool) {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if !snapshots[i].Modified.After(at) {
+			return snapshots[i], true
+		}
+	}
+	return Snapshot{}, false
+}
@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	write := func(path string, modified time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte("backup"), 0644))
+		require.NoError(t, os.Chtimes(path, modified, modified))
+	}
+	backups := filepath.Join(dir, "backups")
+	require.NoError(t, os.Mkdir(backups, 0755))
+	write(filepath.Join(backups, "b.sqlite"), day.Add(48*time.Hour))
+	write(filepath.Join(backups, "a.sqlite"), day)
+	write(filepath.Join(backups, ".partial"), day.Add(time.Hour))
+	single := filepath.Join(dir, "single.sqlite")
+	write(single, day.Add(24*time.Hour))
+
+	snapshots, err := Snapshots(context.Background(), []string{backups, single})
+	require.NoError(t, err)
+	var sources []string
+	for _, snapshot := range snapshots {
+		sources = append(sources, snapshot.Source)
+	}
+	assert.Equal(t, []string{filepath.Join(backups, "a.sqlite"), single, filepath.Join(backups, "b.sqlite")}, sources)
+
+	closest, ok := Closest(snapshots, day.Add(36*time.Hour))
+	require.True(t, ok)
+	assert.Equal(t, single, closest.Source)
+	closest, ok = Closest(snapshots, day)
+	require.True(t, ok)
+	assert.Equal(t, filepath.Join(backups, "a.sqlite"), closest.Source)
+	_, ok = Closest(snapshots, day.Add(-time.Second))
+	assert.False(t, ok)
+
+	_, err = Snapshots(context.Background(), []string{filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
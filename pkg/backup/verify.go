@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"wunderbase/pkg/migrate"
+)
+
+type VerifyOptions struct {
+	// Source is a local path, http(s) url or s3://bucket/key url.
+	Source              string
+	SqlitePath          string
+	MigrationEnginePath string
+	// SchemaPath is the committed schema the backup is checked against.
+	SchemaPath string
+	// Query is an optional statement returning a single number, e.g.
+	// SELECT count(*) FROM User, which must be at least MinResult.
+	Query     string
+	MinResult int64
+	// Keys decrypt encrypted backups.
+	Keys [][]byte
+}
+
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type Report struct {
+	Source string  `json:"source"`
+	Checks []Check `json:"checks"`
+}
+
+func (r *Report) add(name string, ok bool, detail string) {
+	r.Checks = append(r.Checks, Check{Name: name, OK: ok, Detail: detail})
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backup %s\n", r.Source)
+	for _, c := range r.Checks {
+		status := "ok"
+		if !c.OK {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "  %-10s %-4s %s\n", c.Name, status, c.Detail)
+	}
+	return b.String()
+}
+
+// Verify restores a backup into a temporary location and checks that it is
+// usable: the file passes PRAGMA integrity_check, it matches the committed
+// schema, and the optional verification query returns enough rows.
+// Verification stops at the first check that makes the following ones
+// meaningless, e.g. a corrupt file isn't checked for drift.
+func Verify(ctx context.Context, opts VerifyOptions) (*Report, error) {
+	report := &Report{Source: opts.Source}
+
+	dir, err := ioutil.TempDir("", "wunderbase-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	database := filepath.Join(dir, "db.sqlite")
+	if err := Download(ctx, opts.Source, database, opts.Keys); err != nil {
+		report.add("download", false, err.Error())
+		return report, nil
+	}
+	report.add("download", true, "")
+
+	out, err := sqliteQuery(ctx, opts.SqlitePath, database, "PRAGMA integrity_check;")
+	switch {
+	case err != nil:
+		report.add("integrity", false, err.Error())
+		return report, nil
+	case out != "ok":
+		report.add("integrity", false, out)
+		return report, nil
+	}
+	report.add("integrity", true, "")
+
+	if opts.SchemaPath != "" {
+		schemaPath, err := migrate.WriteSchemaForDatabase(opts.SchemaPath, database, dir)
+		if err != nil {
+			return nil, err
+		}
+		drift, summary, err := migrate.Drift(ctx, opts.MigrationEnginePath, schemaPath)
+		switch {
+		case err != nil:
+			report.add("drift", false, err.Error())
+		case drift:
+			report.add("drift", false, summary)
+		default:
+			report.add("drift", true, "")
+		}
+	}
+
+	if opts.Query != "" {
+		out, err := sqliteQuery(ctx, opts.SqlitePath, database, opts.Query)
+		if err != nil {
+			report.add("query", false, err.Error())
+			return report, nil
+		}
+		n, err := strconv.ParseInt(out, 10, 64)
+		switch {
+		case err != nil:
+			report.add("query", false, fmt.Sprintf("expected a number, got %q", out))
+		case n < opts.MinResult:
+			report.add("query", false, fmt.Sprintf("got %d, expected at least %d", n, opts.MinResult))
+		default:
+			report.add("query", true, fmt.Sprintf("got %d", n))
+		}
+	}
+	return report, nil
+}
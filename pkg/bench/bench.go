@@ -0,0 +1,307 @@
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// Options configure a load test.
+type Options struct {
+	// URL receives the GraphQL requests.
+	URL        string
+	Operations []*Operation
+	// Concurrency is the number of requests in flight.
+	Concurrency int
+	Duration    time.Duration
+	// MetricsURL is scraped before and after to tell whether the instance
+	// held requests back for its rate limits. Empty skips it.
+	MetricsURL string
+	Client     *http.Client
+}
+
+// Report summarizes a load test.
+type Report struct {
+	Duration time.Duration
+	Requests int
+	// Errors counts failed requests by GraphQL error code, HTTP status or
+	// TRANSPORT when no response arrived.
+	Errors     map[string]int
+	Operations map[string]int
+	Latency    Percentiles
+	// RateLimitWaits counts requests that waited for the read and write
+	// limits, nil if the metrics couldn't be scraped.
+	RateLimitWaits map[string]float64
+}
+
+// Percentiles of the request latency.
+type Percentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// Throughput returns the requests per second.
+func (r *Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Duration.Seconds()
+}
+
+// Failed returns the number of failed requests.
+func (r *Report) Failed() int {
+	failed := 0
+	for _, n := range r.Errors {
+		failed += n
+	}
+	return failed
+}
+
+// result is the outcome of one request.
+type result struct {
+	operation string
+	latency   time.Duration
+	// code is empty for successful requests
+	code string
+}
+
+// Run drives load against the instance until the duration passed or ctx
+// is done.
+func Run(ctx context.Context, opts Options) (*Report, error) {
+	if len(opts.Operations) == 0 {
+		return nil, fmt.Errorf("no operations")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: opts.Concurrency},
+		}
+	}
+	var before map[string]float64
+	if opts.MetricsURL != "" {
+		before, _ = scrapeRateLimitWaits(ctx, opts.Client, opts.MetricsURL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+	pick := picker(opts.Operations)
+	results := make([][]result, opts.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(i)))
+			for ctx.Err() == nil {
+				op := pick(rnd)
+				r := send(ctx, opts.Client, opts.URL, op)
+				if ctx.Err() != nil && r.code == "TRANSPORT" {
+					// cancelled by the end of the run
+					return
+				}
+				results[i] = append(results[i], r)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report := &Report{
+		Duration:   time.Since(start),
+		Errors:     map[string]int{},
+		Operations: map[string]int{},
+	}
+	var latencies []time.Duration
+	for _, worker := range results {
+		for _, r := range worker {
+			report.Requests++
+			report.Operations[r.operation]++
+			if r.code != "" {
+				report.Errors[r.code]++
+			}
+			latencies = append(latencies, r.latency)
+		}
+	}
+	report.Latency = percentiles(latencies)
+
+	if before != nil {
+		// the run's context is done, scrape with the caller's
+		after, err := scrapeRateLimitWaits(context.Background(), opts.Client, opts.MetricsURL)
+		if err == nil {
+			report.RateLimitWaits = map[string]float64{}
+			for limit, n := range after {
+				report.RateLimitWaits[limit] = n - before[limit]
+			}
+		}
+	}
+	return report, nil
+}
+
+// Seed sends every operation Repeat times, one request at a time, and
+// fails on the first error.
+func Seed(ctx context.Context, url string, ops []*Operation) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, op := range ops {
+		for i := 0; i < op.Repeat; i++ {
+			if r := send(ctx, client, url, op); r.code != "" {
+				return fmt.Errorf("%s: request %d failed with %s", op.Name, i+1, r.code)
+			}
+		}
+	}
+	return nil
+}
+
+// picker chooses operations at random by weight.
+func picker(ops []*Operation) func(*mathrand.Rand) *Operation {
+	total := 0
+	for _, op := range ops {
+		total += op.Weight
+	}
+	return func(rnd *mathrand.Rand) *Operation {
+		n := rnd.Intn(total)
+		for _, op := range ops {
+			if n < op.Weight {
+				return op
+			}
+			n -= op.Weight
+		}
+		return ops[len(ops)-1]
+	}
+}
+
+func send(ctx context.Context, client *http.Client, url string, op *Operation) result {
+	r := result{operation: op.Name}
+	body, err := op.body()
+	if err != nil {
+		r.code = "TEMPLATE"
+		return r
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		r.code = "TRANSPORT"
+		return r
+	}
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		r.latency, r.code = time.Since(start), "TRANSPORT"
+		return r
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	r.latency = time.Since(start)
+	if err != nil {
+		r.code = "TRANSPORT"
+		return r
+	}
+	if code, err := jsonparser.GetString(data, "errors", "[0]", "extensions", "code"); err == nil {
+		r.code = code
+	} else if code, err := jsonparser.GetString(data, "errors", "[0]", "user_facing_error", "error_code"); err == nil {
+		r.code = code
+	} else if _, _, _, err := jsonparser.Get(data, "errors", "[0]"); err == nil {
+		r.code = "GRAPHQL_ERROR"
+	} else if resp.StatusCode >= 300 {
+		r.code = "HTTP_" + strconv.Itoa(resp.StatusCode)
+	}
+	return r
+}
+
+func percentiles(latencies []time.Duration) Percentiles {
+	if len(latencies) == 0 {
+		return Percentiles{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	at := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1))]
+	}
+	return Percentiles{P50: at(.5), P90: at(.9), P99: at(.99), Max: latencies[len(latencies)-1]}
+}
+
+// scrapeRateLimitWaits reads wunderbase_rate_limit_waits_total by limit from
+// the Prometheus text format. Labels other than limit, like database, are
+// summed.
+func scrapeRateLimitWaits(ctx context.Context, client *http.Client, url string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics: %s", resp.Status)
+	}
+	waits := map[string]float64{"read": 0, "write": 0}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "wunderbase_rate_limit_waits_total{") {
+			continue
+		}
+		labels, value, ok := strings.Cut(line[strings.Index(line, "{")+1:], "} ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		for _, label := range strings.Split(labels, ",") {
+			if name, v, _ := strings.Cut(label, "="); name == "limit" {
+				waits[strings.Trim(v, `"`)] += n
+			}
+		}
+	}
+	return waits, scanner.Err()
+}
+
+// Write prints the report for humans.
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "requests:    %d in %s (%.1f/s)\n", r.Requests, r.Duration.Round(time.Millisecond), r.Throughput())
+	fmt.Fprintf(w, "failed:      %d\n", r.Failed())
+	fmt.Fprintf(w, "latency:     p50 %s  p90 %s  p99 %s  max %s\n",
+		r.Latency.P50.Round(time.Microsecond), r.Latency.P90.Round(time.Microsecond),
+		r.Latency.P99.Round(time.Microsecond), r.Latency.Max.Round(time.Microsecond))
+	fmt.Fprintln(w, "operations:")
+	for _, name := range sortedKeys(r.Operations) {
+		fmt.Fprintf(w, "  %-24s %d\n", name, r.Operations[name])
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(w, "errors:")
+		for _, code := range sortedKeys(r.Errors) {
+			fmt.Fprintf(w, "  %-24s %d\n", code, r.Errors[code])
+		}
+	}
+	if r.RateLimitWaits == nil {
+		fmt.Fprintln(w, "rate limits: unknown, the metrics endpoint could not be read")
+		return
+	}
+	fmt.Fprintf(w, "rate limits: read limit hit %d times, write limit hit %d times\n",
+		int(r.RateLimitWaits["read"]), int(r.RateLimitWaits["write"]))
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMix(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "users.graphql"), []byte("query { findManyUser { id } }"), 0644))
+	mix := `
+- name: users
+  queryFile: users.graphql
+  weight: 3
+- name: create
+  query: |
+    mutation ($email: String!, $age: Int!) { createOneUser(data: {email: $email, age: $age}) { id } }
+  variables:
+    email: user-{{seq}}@example.com
+    age: "json:{{randInt 18 18}}"
+    role: admin
+`
+	path := filepath.Join(dir, "mix.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(mix), 0644))
+
+	ops, err := LoadMix(path)
+	require.NoError(t, err)
+	require.Len(t, ops, 2)
+	assert.Equal(t, "query { findManyUser { id } }", ops[0].Query)
+	assert.Equal(t, 3, ops[0].Weight)
+	assert.Equal(t, 1, ops[1].Weight)
+	assert.Equal(t, 1, ops[1].Repeat)
+
+	var first, second struct {
+		Variables map[string]interface{} `json:"variables"`
+	}
+	body, err := ops[1].body()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &first))
+	body, err = ops[1].body()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &second))
+	assert.Equal(t, float64(18), first.Variables["age"])
+	assert.Equal(t, "admin", first.Variables["role"])
+	assert.NotEqual(t, first.Variables["email"], second.Variables["email"])
+
+	_, err = NewOperation("broken", "query { a }", `{"id": "{{nope}}"}`)
+	assert.Error(t, err)
+}
+
+func TestRun(t *testing.T) {
+	var requests, waits int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		var body struct {
+			Query string `json:"query"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		switch {
+		case strings.Contains(body.Query, "fail"):
+			fmt.Fprint(w, `{"errors":[{"message":"unique","user_facing_error":{"error_code":"P2002"}}]}`)
+		case n%5 == 0:
+			atomic.AddInt64(&waits, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `{"data":{"ok":true}}`)
+		}
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE wunderbase_rate_limit_waits_total counter\n")
+		fmt.Fprintf(w, "wunderbase_rate_limit_waits_total{limit=\"read\"} %d\n", atomic.LoadInt64(&waits))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ok, err := NewOperation("ok", "query { ok }", "")
+	require.NoError(t, err)
+	fail, err := NewOperation("fail", "query { fail }", "")
+	require.NoError(t, err)
+
+	report, err := Run(context.Background(), Options{
+		URL:         srv.URL,
+		MetricsURL:  srv.URL + "/metrics",
+		Operations:  []*Operation{ok, fail},
+		Concurrency: 4,
+		Duration:    200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	assert.Greater(t, report.Requests, 0)
+	assert.Greater(t, report.Errors["P2002"], 0)
+	assert.Greater(t, report.Errors["HTTP_503"], 0)
+	assert.Equal(t, report.Requests, report.Operations["ok"]+report.Operations["fail"])
+	assert.LessOrEqual(t, report.Latency.P50, report.Latency.P99)
+	assert.Equal(t, float64(atomic.LoadInt64(&waits)), report.RateLimitWaits["read"])
+	assert.Equal(t, float64(0), report.RateLimitWaits["write"])
+
+	var out strings.Builder
+	report.Write(&out)
+	assert.Contains(t, out.String(), "P2002")
+	assert.Contains(t, out.String(), "rate limits: read limit hit")
+}
@@ -0,0 +1,167 @@
+package bench
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Operation is a GraphQL request of a load mix. Top-level string variables
+// are templates rendered for every request. A template prefixed with json:,
+// like json:{{randInt 1 100}}, renders JSON sent as that value.
+type Operation struct {
+	Name string `yaml:"name"`
+	// Weight is the share of requests sending the operation, 1 if unset.
+	Weight int    `yaml:"weight"`
+	Query  string `yaml:"query"`
+	// QueryFile is read into Query, relative to the mix file.
+	QueryFile string                 `yaml:"queryFile"`
+	Variables map[string]interface{} `yaml:"variables"`
+	// Repeat is how often seeding runs the operation, 1 if unset.
+	Repeat int `yaml:"repeat"`
+
+	templates map[string]*template.Template
+	json      map[string]bool
+}
+
+const jsonPrefix = "json:"
+
+// LoadMix reads a YAML list of operations.
+func LoadMix(path string) ([]*Operation, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ops []*Operation
+	if err := yaml.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("%s: no operations", path)
+	}
+	for i, op := range ops {
+		if op.Name == "" {
+			op.Name = fmt.Sprintf("operation %d", i+1)
+		}
+		if op.QueryFile != "" {
+			file := op.QueryFile
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			query, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", op.Name, err)
+			}
+			op.Query = string(query)
+		}
+		if err := op.prepare(); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// NewOperation returns an operation sending query with variables, a JSON
+// object whose string values are templates.
+func NewOperation(name, query, variables string) (*Operation, error) {
+	op := &Operation{Name: name, Query: query}
+	if variables != "" {
+		if err := json.Unmarshal([]byte(variables), &op.Variables); err != nil {
+			return nil, fmt.Errorf("%s: variables: %w", name, err)
+		}
+	}
+	return op, op.prepare()
+}
+
+func (op *Operation) prepare() error {
+	if op.Query == "" {
+		return fmt.Errorf("%s: query is required", op.Name)
+	}
+	if op.Weight < 0 || op.Repeat < 0 {
+		return fmt.Errorf("%s: weight and repeat must not be negative", op.Name)
+	}
+	if op.Weight == 0 {
+		op.Weight = 1
+	}
+	if op.Repeat == 0 {
+		op.Repeat = 1
+	}
+	op.templates = map[string]*template.Template{}
+	op.json = map[string]bool{}
+	for name, value := range op.Variables {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		t, err := template.New(name).Funcs(templateFuncs).Parse(strings.TrimPrefix(s, jsonPrefix))
+		if err != nil {
+			return fmt.Errorf("%s: variable %s: %w", op.Name, name, err)
+		}
+		op.templates[name] = t
+		op.json[name] = strings.HasPrefix(s, jsonPrefix)
+	}
+	return nil
+}
+
+// body renders the variables and returns the request body.
+func (op *Operation) body() ([]byte, error) {
+	variables := make(map[string]interface{}, len(op.Variables))
+	for name, value := range op.Variables {
+		t, ok := op.templates[name]
+		if !ok {
+			variables[name] = value
+			continue
+		}
+		var out bytes.Buffer
+		if err := t.Execute(&out, nil); err != nil {
+			return nil, fmt.Errorf("%s: variable %s: %w", op.Name, name, err)
+		}
+		if !op.json[name] {
+			variables[name] = out.String()
+			continue
+		}
+		if !json.Valid(out.Bytes()) {
+			return nil, fmt.Errorf("%s: variable %s: rendered invalid JSON %q", op.Name, name, out.String())
+		}
+		variables[name] = json.RawMessage(out.Bytes())
+	}
+	return json.Marshal(map[string]interface{}{"query": op.Query, "variables": variables})
+}
+
+// seq is the counter behind {{seq}}, shared by all operations.
+var seq int64
+
+var templateFuncs = template.FuncMap{
+	"seq": func() int64 { return atomic.AddInt64(&seq, 1) },
+	"randInt": func(min, max int) (int, error) {
+		if max < min {
+			return 0, errors.New("randInt: max is less than min")
+		}
+		return min + mathrand.Intn(max-min+1), nil
+	},
+	"randString": func(n int) string {
+		b := make([]byte, (n+1)/2)
+		_, _ = rand.Read(b)
+		return hex.EncodeToString(b)[:n]
+	},
+	"uuid": func() string {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+	"now": func() string { return time.Now().UTC().Format(time.RFC3339Nano) },
+}
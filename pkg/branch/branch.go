@@ -0,0 +1,171 @@
+package branch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Branch describes a copy of a database created for a preview environment.
+type Branch struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"createdAt"`
+	Size      int64     `json:"size"`
+}
+
+// DatasourceURL is the prisma datasource url pointing at the branch.
+func (b *Branch) DatasourceURL() string {
+	return "file:" + b.Path
+}
+
+// Create takes a consistent snapshot of the database or backup at from and
+// stores it at to. A bare name is placed inside dir. The metadata is kept in
+// dir for copies stored elsewhere too, so every branch can be listed and
+// deleted later.
+func Create(dir, from, to string) (*Branch, error) {
+	if _, err := os.Stat(from); err != nil {
+		return nil, fmt.Errorf("source database: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create branches dir: %w", err)
+	}
+	path := to
+	if !strings.ContainsRune(to, filepath.Separator) {
+		path = filepath.Join(dir, to+".sqlite")
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("branch %s already exists", path)
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if _, err := os.Stat(metadataPath(dir, name)); err == nil {
+		return nil, fmt.Errorf("branch %q already exists in %s", name, dir)
+	}
+
+	if err := Snapshot(from, path); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &Branch{
+		Name:      name,
+		Path:      path,
+		Source:    from,
+		CreatedAt: time.Now().UTC(),
+		Size:      info.Size(),
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(metadataPath(dir, name), data, 0644); err != nil {
+		return nil, fmt.Errorf("write branch metadata: %w", err)
+	}
+	return b, nil
+}
+
+// List returns the branches recorded in dir, oldest first.
+func List(dir string) ([]*Branch, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.branch.json"))
+	if err != nil {
+		return nil, err
+	}
+	branches := make([]*Branch, 0, len(matches))
+	for _, match := range matches {
+		data, err := ioutil.ReadFile(match)
+		if err != nil {
+			return nil, err
+		}
+		var b Branch
+		if err := json.Unmarshal(data, &b); err != nil {
+			return nil, fmt.Errorf("read %s: %w", match, err)
+		}
+		branches = append(branches, &b)
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].CreatedAt.Before(branches[j].CreatedAt)
+	})
+	return branches, nil
+}
+
+// Delete removes a branch in dir together with its metadata and WAL files.
+func Delete(dir, name string) error {
+	branches, err := List(dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range branches {
+		if b.Name != name {
+			continue
+		}
+		for _, path := range []string{b.Path, b.Path + "-wal", b.Path + "-shm", metadataPath(dir, b.Name)} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("branch %q not found in %s", name, dir)
+}
+
+// Snapshot copies a SQLite database. The sqlite3 CLI's online backup is used
+// when available so the copy is consistent even while the source is being
+// written to. Otherwise the database is copied as a file, which is only
+// consistent while nothing has it open, so a database with a WAL, shared
+// memory or rollback journal file is refused.
+func Snapshot(from, to string) error {
+	if sqlite, err := exec.LookPath("sqlite3"); err == nil {
+		out, err := exec.Command(sqlite, from, fmt.Sprintf(".backup '%s'", strings.ReplaceAll(to, "'", "''"))).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("sqlite3 backup: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if _, err := os.Stat(from + suffix); err == nil {
+			return fmt.Errorf("%s is in use, it has a %s file: copying a live database needs the sqlite3 CLI", from, suffix)
+		}
+	}
+	return copyFile(from, to)
+}
+
+// metadataPath is the metadata of the branch name in dir.
+func metadataPath(dir, name string) string {
+	return filepath.Join(dir, name+".branch.json")
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("copy %s: %w", from, err)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
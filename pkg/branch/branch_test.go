@@ -0,0 +1,51 @@
+package branch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBranchesStoredElsewhere(t *testing.T) {
+	// copied as files without the sqlite3 CLI
+	t.Setenv("PATH", "")
+	dir, elsewhere := t.TempDir(), t.TempDir()
+	source := filepath.Join(t.TempDir(), "db.sqlite")
+	require.NoError(t, os.WriteFile(source, []byte("SQLite format 3\x00"), 0644))
+
+	inside, err := Create(dir, source, "inside")
+	require.NoError(t, err)
+	outside, err := Create(dir, source, filepath.Join(elsewhere, "outside.sqlite"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(elsewhere, "outside.sqlite"), outside.Path)
+	_, err = Create(dir, source, filepath.Join(elsewhere, "inside.sqlite"))
+	assert.Error(t, err, "the name is taken")
+
+	branches, err := List(dir)
+	require.NoError(t, err)
+	require.Len(t, branches, 2)
+	assert.Equal(t, []string{inside.Name, outside.Name}, []string{branches[0].Name, branches[1].Name})
+
+	require.NoError(t, Delete(dir, "outside"))
+	_, err = os.Stat(outside.Path)
+	assert.True(t, os.IsNotExist(err))
+	branches, err = List(dir)
+	require.NoError(t, err)
+	assert.Len(t, branches, 1)
+}
+
+func TestSnapshotRefusesLiveDatabasesWithoutSQLite(t *testing.T) {
+	t.Setenv("PATH", "")
+	dir := t.TempDir()
+	source := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, os.WriteFile(source, []byte("SQLite format 3\x00"), 0644))
+	require.NoError(t, os.WriteFile(source+"-wal", nil, 0644))
+
+	err := Snapshot(source, filepath.Join(dir, "copy.sqlite"))
+	assert.ErrorContains(t, err, "sqlite3 CLI")
+	_, err = os.Stat(filepath.Join(dir, "copy.sqlite"))
+	assert.True(t, os.IsNotExist(err))
+}
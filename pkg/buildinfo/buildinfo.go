@@ -0,0 +1,84 @@
+package buildinfo
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Set at build time with
+//
+//	-ldflags "-X wunderbase/pkg/buildinfo.Version=... -X wunderbase/pkg/buildinfo.Commit=... -X wunderbase/pkg/buildinfo.Date=..."
+//
+// Commit and Date fall back to the VCS information go embeds itself.
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+type Info struct {
+	Version                string `json:"version"`
+	Commit                 string `json:"commit"`
+	Date                   string `json:"date"`
+	GoVersion              string `json:"goVersion"`
+	QueryEngineVersion     string `json:"queryEngineVersion,omitempty"`
+	MigrationEngineVersion string `json:"migrationEngineVersion,omitempty"`
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = setting.Value
+				}
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.Date == "" {
+		info.Date = "unknown"
+	}
+	return info
+}
+
+// EngineVersion asks a prisma engine binary for its version. Engines print
+// "<name> <commit hash>", only the hash is returned.
+func EngineVersion(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[len(fields)-1], nil
+}
+
+// WithEngines adds the engine versions, ignoring engines that can't be run.
+func (i Info) WithEngines(ctx context.Context, queryEnginePath, migrationEnginePath string) Info {
+	i.QueryEngineVersion, _ = EngineVersion(ctx, queryEnginePath)
+	i.MigrationEngineVersion, _ = EngineVersion(ctx, migrationEnginePath)
+	return i
+}
@@ -0,0 +1,177 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Table records the changes made to the other tables, filled by triggers.
+// Its AUTOINCREMENT ids are the cursors of the feed.
+const Table = "_wunderbase_changes"
+
+// Change is a row written, as recorded by the triggers.
+type Change struct {
+	Cursor string `json:"cursor"`
+	Model  string `json:"model"`
+	// Op is create, update or delete.
+	Op string `json:"op"`
+	// Key holds the values of the primary key columns, in order.
+	Key []interface{} `json:"key"`
+	At  time.Time     `json:"at"`
+}
+
+// Head returns the cursor of the latest change, 0 if there is none or the
+// changes table doesn't exist.
+func Head(ctx context.Context, sqlitePath, database string) (int64, error) {
+	if _, err := os.Stat(database); os.IsNotExist(err) {
+		return 0, nil
+	}
+	out, err := query(ctx, sqlitePath, database, true, "SELECT name FROM sqlite_master WHERE name = '"+Table+"';")
+	if err != nil {
+		return 0, err
+	}
+	var tables []struct{ Name string }
+	if err := decode(out, &tables); err != nil || len(tables) == 0 {
+		return 0, err
+	}
+	// the sequence rather than the latest row, which may be gone
+	out, err = query(ctx, sqlitePath, database, true, "SELECT seq FROM sqlite_sequence WHERE name = '"+Table+"';")
+	if err != nil {
+		return 0, err
+	}
+	var rows []struct{ Seq int64 }
+	if err := decode(out, &rows); err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	return rows[0].Seq, nil
+}
+
+// Install creates the changes table and the triggers recording changes to
+// every table with a primary key. It is run after each migration, since
+// the migration engine drops objects missing from the Prisma schema and
+// rebuilds altered tables without their triggers. head is the cursor the
+// feed had before migrating; cursors issued after install are greater, so
+// they keep increasing if the table was dropped.
+func Install(ctx context.Context, sqlitePath, database string, head int64) error {
+	out, err := query(ctx, sqlitePath, database, false, `SELECT m.name AS "table", p.name AS "column"
+FROM sqlite_master m JOIN pragma_table_info(m.name) p
+WHERE m.type = 'table' AND p.pk > 0 AND m.name NOT LIKE 'sqlite\_%' ESCAPE '\' AND m.name NOT LIKE '\_%' ESCAPE '\'
+ORDER BY m.name, p.pk;`)
+	if err != nil {
+		return err
+	}
+	var columns []struct{ Table, Column string }
+	if err := decode(out, &columns); err != nil {
+		return err
+	}
+	keys := map[string][]string{}
+	var tables []string
+	for _, c := range columns {
+		if keys[c.Table] == nil {
+			tables = append(tables, c.Table)
+		}
+		keys[c.Table] = append(keys[c.Table], c.Column)
+	}
+
+	var script strings.Builder
+	script.WriteString("BEGIN;\n")
+	fmt.Fprintf(&script, "CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY AUTOINCREMENT, model TEXT NOT NULL, op TEXT NOT NULL, key TEXT NOT NULL, at INTEGER NOT NULL);\n", Table)
+	fmt.Fprintf(&script, "INSERT INTO sqlite_sequence (name, seq) SELECT '%s', 0 WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = '%[1]s');\n", Table)
+	fmt.Fprintf(&script, "UPDATE sqlite_sequence SET seq = max(seq, %d) WHERE name = '%s';\n", head, Table)
+	for _, table := range tables {
+		for _, t := range []struct{ event, op, row string }{
+			{"INSERT", "create", "NEW"},
+			{"UPDATE", "update", "NEW"},
+			{"DELETE", "delete", "OLD"},
+		} {
+			values := make([]string, len(keys[table]))
+			for i, column := range keys[table] {
+				values[i] = t.row + "." + identifier(column)
+			}
+			trigger := identifier("_wunderbase_cdc_" + table + "_" + t.op)
+			fmt.Fprintf(&script, "DROP TRIGGER IF EXISTS %s;\n", trigger)
+			fmt.Fprintf(&script, "CREATE TRIGGER %s AFTER %s ON %s BEGIN INSERT INTO %s (model, op, key, at) VALUES (%s, '%s', json_array(%s), CAST(round((julianday('now') - 2440587.5) * 86400000) AS INTEGER)); END;\n",
+				trigger, t.event, identifier(table), Table, literal(table), t.op, strings.Join(values, ", "))
+		}
+	}
+	script.WriteString("COMMIT;\n")
+
+	cmd := exec.CommandContext(ctx, sqlitePath, "-batch", "-bail", "-cmd", ".timeout 5000", database)
+	cmd.Stdin = strings.NewReader(script.String())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Read returns up to limit changes after the cursor since, oldest first.
+func Read(ctx context.Context, sqlitePath, database string, since int64, limit int) ([]Change, error) {
+	out, err := query(ctx, sqlitePath, database, true,
+		fmt.Sprintf("SELECT id, model, op, key, at FROM %s WHERE id > %d ORDER BY id LIMIT %d;", Table, since, limit))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID    int64
+		Model string
+		Op    string
+		Key   string
+		At    int64
+	}
+	if err := decode(out, &rows); err != nil {
+		return nil, err
+	}
+	changes := make([]Change, 0, len(rows))
+	for _, row := range rows {
+		change := Change{
+			Cursor: strconv.FormatInt(row.ID, 10),
+			Model:  row.Model,
+			Op:     row.Op,
+			At:     time.UnixMilli(row.At).UTC(),
+		}
+		if err := json.Unmarshal([]byte(row.Key), &change.Key); err != nil {
+			return nil, fmt.Errorf("change %d: key: %w", row.ID, err)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// query runs a statement with the sqlite3 CLI and returns its output as a
+// JSON array, empty when there are no rows.
+func query(ctx context.Context, sqlitePath, database string, readonly bool, statement string) ([]byte, error) {
+	args := []string{"-batch", "-json", "-cmd", ".timeout 5000"}
+	if readonly {
+		args = append(args, "-readonly")
+	}
+	out, err := exec.CommandContext(ctx, sqlitePath, append(args, database, statement)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func decode(out []byte, v interface{}) error {
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("sqlite3 output: %w", err)
+	}
+	return nil
+}
+
+func identifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func literal(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,58 @@
+package cdc
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeed(t *testing.T) {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	ctx := context.Background()
+	database := filepath.Join(t.TempDir(), "db.sqlite")
+	exec := func(statement string) {
+		_, err := query(ctx, sqlite, database, false, statement)
+		require.NoError(t, err, statement)
+	}
+	exec(`CREATE TABLE "User" (id INTEGER PRIMARY KEY, email TEXT); CREATE TABLE "Member" ("orgId" TEXT, "userId" INTEGER, PRIMARY KEY ("orgId", "userId")); CREATE TABLE "_prisma_migrations" (id TEXT PRIMARY KEY);`)
+
+	head, err := Head(ctx, sqlite, database)
+	require.NoError(t, err)
+	require.Zero(t, head)
+	require.NoError(t, Install(ctx, sqlite, database, 0))
+	require.NoError(t, Install(ctx, sqlite, database, 0), "install is repeatable")
+
+	exec(`INSERT INTO "User" (id, email) VALUES (1, 'a@example.com'); UPDATE "User" SET email = 'b@example.com' WHERE id = 1; INSERT INTO "Member" VALUES ('acme', 1); DELETE FROM "User"; INSERT INTO "_prisma_migrations" VALUES ('x');`)
+	changes, err := Read(ctx, sqlite, database, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 4)
+	require.Equal(t, "User", changes[0].Model)
+	require.Equal(t, "create", changes[0].Op)
+	require.Equal(t, []interface{}{float64(1)}, changes[0].Key)
+	require.Equal(t, "update", changes[1].Op)
+	require.Equal(t, []interface{}{"acme", float64(1)}, changes[2].Key)
+	require.Equal(t, "delete", changes[3].Op)
+	require.False(t, changes[0].At.IsZero())
+
+	page, err := Read(ctx, sqlite, database, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, []Change{changes[2]}, page)
+
+	// a migration dropping the table must not restart the cursors
+	head, err = Head(ctx, sqlite, database)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, head)
+	exec(`DROP TABLE ` + Table + `;`)
+	require.NoError(t, Install(ctx, sqlite, database, head))
+	exec(`INSERT INTO "User" (id) VALUES (2);`)
+	changes, err = Read(ctx, sqlite, database, head, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	require.Equal(t, "5", changes[0].Cursor)
+}
@@ -0,0 +1,190 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/migrate"
+)
+
+type Options struct {
+	QueryEnginePath       string
+	MigrationEnginePath   string
+	SchemaPath            string
+	MigrationLockFilePath string
+	ListenAddr            string
+	QueryEnginePort       string
+}
+
+type Result struct {
+	Name string `json:"name"`
+	OK   bool   `json:"ok"`
+	// Hard failures prevent wunderbase from starting, soft ones are warnings.
+	Hard   bool   `json:"hard"`
+	Detail string `json:"detail,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// Failed reports whether any hard check failed.
+func Failed(results []Result) bool {
+	for _, r := range results {
+		if !r.OK && r.Hard {
+			return true
+		}
+	}
+	return false
+}
+
+// Run executes every check, it doesn't stop at the first failure so all
+// problems are reported at once.
+func Run(ctx context.Context, opts Options) []Result {
+	results := []Result{
+		checkEngine(ctx, "query engine", opts.QueryEnginePath, "WUNDERBASE_QUERY_ENGINE_PATH"),
+		checkEngine(ctx, "migration engine", opts.MigrationEnginePath, "WUNDERBASE_MIGRATION_ENGINE_PATH"),
+		checkSchema(ctx, opts),
+	}
+	results = append(results, checkDatabaseDir(opts.SchemaPath))
+	results = append(results, checkLockFile(opts.MigrationLockFilePath))
+	results = append(results, checkBind("listen address", opts.ListenAddr, "LISTEN_ADDR"))
+	results = append(results, checkBind("query engine port", net.JoinHostPort("127.0.0.1", opts.QueryEnginePort), "WUNDERBASE_QUERY_ENGINE_PORT"))
+	return results
+}
+
+func checkEngine(ctx context.Context, name, path, env string) Result {
+	r := Result{Name: name, Hard: true}
+	info, err := os.Stat(path)
+	if err != nil {
+		resolved, lookErr := exec.LookPath(path)
+		if lookErr != nil {
+			r.Detail = err.Error()
+			r.Hint = fmt.Sprintf("run install-prisma-linux.sh or install-prisma-darwin.sh, or point %s at the binary", env)
+			return r
+		}
+		path = resolved
+		info, _ = os.Stat(path)
+	}
+	if info != nil && info.Mode()&0111 == 0 {
+		r.Detail = path + " is not executable"
+		r.Hint = "chmod +x " + path
+		return r
+	}
+	version, err := buildinfo.EngineVersion(ctx, path)
+	if err != nil {
+		r.Detail = fmt.Sprintf("%s --version: %v", path, err)
+		r.Hint = "the binary may be built for another platform, download the engine for this OS"
+		return r
+	}
+	r.OK = true
+	r.Detail = version
+	return r
+}
+
+func checkSchema(ctx context.Context, opts Options) Result {
+	r := Result{Name: "schema", Hard: true}
+	if _, err := migrate.DatabaseFilePath(opts.SchemaPath); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "set WUNDERBASE_PRISMA_SCHEMA_FILE to a schema with a sqlite datasource using a file: url"
+		return r
+	}
+	// the engine validates the whole datamodel, skip this when it's missing
+	// since that is reported by the engine check already
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, opts.QueryEnginePath, "--datamodel-path", opts.SchemaPath, "cli", "get-config").CombinedOutput()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			r.Detail = firstLine(string(out))
+			r.Hint = "fix the schema errors reported by the engine"
+			return r
+		}
+	}
+	r.OK = true
+	r.Detail = opts.SchemaPath
+	return r
+}
+
+func checkDatabaseDir(schemaPath string) Result {
+	r := Result{Name: "database directory", Hard: true}
+	database, err := migrate.DatabaseFilePath(schemaPath)
+	if err != nil {
+		r.Detail = "skipped, the schema has no sqlite datasource"
+		return r
+	}
+	dir := filepath.Dir(database)
+	f, err := ioutil.TempFile(dir, ".wunderbase-doctor-")
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = fmt.Sprintf("create %s and make it writable, sqlite also needs to create journal files next to the database", dir)
+		return r
+	}
+	f.Close()
+	os.Remove(f.Name())
+	r.OK = true
+	r.Detail = dir
+	return r
+}
+
+func checkLockFile(path string) Result {
+	r := Result{Name: "migration lock file"}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	switch {
+	case os.IsNotExist(err):
+		// migrate creates it, but only if the directory is writable
+		r.Hard = true
+		probe, err := ioutil.TempFile(filepath.Dir(path), ".wunderbase-doctor-")
+		if err != nil {
+			r.Detail = err.Error()
+			r.Hint = "make the directory of WUNDERBASE_MIGRATION_LOCK_FILE writable"
+			return r
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		r.OK = true
+		r.Detail = path + " doesn't exist yet, migrate will create it"
+		return r
+	case err != nil:
+		r.Hard = true
+		r.Detail = err.Error()
+		r.Hint = "make WUNDERBASE_MIGRATION_LOCK_FILE readable and writable"
+		return r
+	}
+	defer f.Close()
+	if _, err := io.Copy(ioutil.Discard, f); err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	r.OK = true
+	r.Detail = path
+	return r
+}
+
+func checkBind(name, addr, env string) Result {
+	r := Result{Name: name, Hard: true}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = fmt.Sprintf("stop the process using %s or change %s", addr, env)
+		return r
+	}
+	l.Close()
+	r.OK = true
+	r.Detail = addr
+	return r
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,317 @@
+// Package journal keeps an append-only log of the mutations a server
+// answered, so the writes made after a backup can be replayed on the
+// restored database.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// FsyncAlways syncs the journal after every batch of entries written,
+	// FsyncInterval once a second and FsyncNever leaves it to the OS.
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	// OnFullWait makes a mutation wait for room in a full buffer,
+	// OnFullDrop drops its entry and records a gap instead.
+	OnFullWait = "wait"
+	OnFullDrop = "drop"
+
+	// RotateFile is the marker whose change starts a new journal file,
+	// touched when a backup is created.
+	RotateFile = "rotate"
+
+	filePrefix = "journal-"
+	fileSuffix = ".ndjson"
+	// fileTime names the files so they sort by the time they were started
+	fileTime = "20060102T150405.000000000Z"
+	// checkEvery is how often the writer syncs with FsyncInterval and
+	// looks for the rotation marker
+	checkEvery = time.Second
+)
+
+// Entry is a line of the journal: a mutation that succeeded, with the id
+// fields of its response, or a gap of Gap entries dropped because the
+// buffer was full.
+type Entry struct {
+	Time          time.Time       `json:"time"`
+	OperationName string          `json:"operationName,omitempty"`
+	Query         string          `json:"query,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	// IDs are the id fields the mutation returned by root field, an id
+	// or a list of them.
+	IDs map[string]json.RawMessage `json:"ids,omitempty"`
+	Gap int64                      `json:"gap,omitempty"`
+}
+
+// Options configure a Writer.
+type Options struct {
+	// Dir holds the journal files, created if missing.
+	Dir string
+	// Fsync is FsyncAlways, FsyncInterval or FsyncNever.
+	Fsync string
+	// Buffer is the number of entries waiting to be written before
+	// OnFull applies.
+	Buffer int
+	// OnFull is OnFullWait or OnFullDrop.
+	OnFull string
+}
+
+// Writer appends entries to the journal in the background, so mutations
+// don't wait for the disk. A nil Writer discards entries.
+type Writer struct {
+	dir     string
+	fsync   string
+	onFull  string
+	entries chan Entry
+	done    chan struct{}
+	dropped int64
+
+	// mu guards closed, Append holds it for reading while it waits for
+	// room in the buffer
+	mu     sync.RWMutex
+	closed bool
+
+	// file and out are only used by the writer goroutine
+	file    *os.File
+	out     *bufio.Writer
+	started time.Time
+}
+
+// Open starts a Writer on a new file of opts.Dir. It returns nil if Dir is
+// empty.
+func Open(opts Options) (*Writer, error) {
+	if opts.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if opts.Buffer <= 0 {
+		opts.Buffer = 1
+	}
+	w := &Writer{
+		dir:     opts.Dir,
+		fsync:   opts.Fsync,
+		onFull:  opts.OnFull,
+		entries: make(chan Entry, opts.Buffer),
+		done:    make(chan struct{}),
+	}
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Append queues e. If the buffer is full it waits for room, or drops e and
+// returns false with OnFullDrop.
+func (w *Writer) Append(e Entry) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return false
+	}
+	if w.onFull != OnFullDrop {
+		w.entries <- e
+		return true
+	}
+	select {
+	case w.entries <- e:
+		return true
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		return false
+	}
+}
+
+// Depth is the number of entries waiting to be written.
+func (w *Writer) Depth() int {
+	if w == nil {
+		return 0
+	}
+	return len(w.entries)
+}
+
+// Close writes the queued entries, syncs the journal and closes its file.
+func (w *Writer) Close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.entries)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-w.entries:
+			if !ok {
+				w.writeGap()
+				w.flush(w.fsync != FsyncNever)
+				if err := w.file.Close(); err != nil {
+					slog.Error("Closing the mutation journal", slog.String("error", err.Error()))
+				}
+				return
+			}
+			w.writeGap()
+			w.write(e)
+			// a batch ends when the buffer is drained
+			if len(w.entries) == 0 {
+				w.flush(w.fsync == FsyncAlways)
+			}
+		case now := <-ticker.C:
+			w.writeGap()
+			w.flush(w.fsync == FsyncInterval)
+			w.rotate(now)
+		}
+	}
+}
+
+// writeGap records the entries dropped since the last entry written.
+func (w *Writer) writeGap() {
+	if n := atomic.SwapInt64(&w.dropped, 0); n > 0 {
+		w.write(Entry{Time: time.Now().UTC(), Gap: n})
+	}
+}
+
+func (w *Writer) write(e Entry) {
+	line, err := json.Marshal(e)
+	if err == nil {
+		line = append(line, '\n')
+		_, err = w.out.Write(line)
+	}
+	if err != nil {
+		slog.Error("Writing the mutation journal", slog.String("error", err.Error()))
+	}
+}
+
+func (w *Writer) flush(sync bool) {
+	err := w.out.Flush()
+	if err == nil && sync {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		slog.Error("Writing the mutation journal", slog.String("error", err.Error()))
+	}
+}
+
+// rotate starts a new file if the rotation marker changed since the current
+// one was started.
+func (w *Writer) rotate(now time.Time) {
+	info, err := os.Stat(filepath.Join(w.dir, RotateFile))
+	if err != nil || !info.ModTime().After(w.started) {
+		return
+	}
+	w.flush(w.fsync != FsyncNever)
+	if err := w.file.Close(); err != nil {
+		slog.Error("Closing the mutation journal", slog.String("error", err.Error()))
+	}
+	if err := w.open(now); err != nil {
+		slog.Error("Rotating the mutation journal", slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Rotated the mutation journal", slog.String("file", w.file.Name()))
+}
+
+func (w *Writer) open(now time.Time) error {
+	name := filepath.Join(w.dir, filePrefix+now.UTC().Format(fileTime)+fileSuffix)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file, w.out, w.started = file, bufio.NewWriter(file), now
+	return nil
+}
+
+// Rotate makes the writers of the journal in dir start a new file, done when
+// a backup generation is created. It is a no-op if dir is empty.
+func Rotate(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	marker := filepath.Join(dir, RotateFile)
+	now := time.Now()
+	if err := os.Chtimes(marker, now, now); err == nil {
+		return nil
+	}
+	return ioutil.WriteFile(marker, nil, 0644)
+}
+
+// IDs returns the id fields of the root fields of a GraphQL response: the
+// id of an object, the ids of a list of objects. Root fields without one
+// are left out.
+func IDs(response []byte) map[string]json.RawMessage {
+	data, dataType, _, err := jsonparser.Get(response, "data")
+	if err != nil || dataType != jsonparser.Object {
+		return nil
+	}
+	var ids map[string]json.RawMessage
+	_ = jsonparser.ObjectEach(data, func(key, value []byte, valueType jsonparser.ValueType, _ int) error {
+		var id []byte
+		switch valueType {
+		case jsonparser.Object:
+			id = idOf(value)
+		case jsonparser.Array:
+			var list [][]byte
+			_, _ = jsonparser.ArrayEach(value, func(item []byte, itemType jsonparser.ValueType, _ int, _ error) {
+				if itemType == jsonparser.Object {
+					if id := idOf(item); id != nil {
+						list = append(list, id)
+					}
+				}
+			})
+			if list != nil {
+				id = append(append([]byte("["), bytes.Join(list, []byte(","))...), ']')
+			}
+		}
+		if id != nil {
+			if ids == nil {
+				ids = map[string]json.RawMessage{}
+			}
+			ids[string(key)] = id
+		}
+		return nil
+	})
+	return ids
+}
+
+// idOf returns the id field of an object as JSON.
+func idOf(object []byte) []byte {
+	value, valueType, _, err := jsonparser.Get(object, "id")
+	switch {
+	case err != nil:
+		return nil
+	case valueType == jsonparser.String:
+		// the value keeps its escapes, quoting it gives back the JSON
+		return []byte(`"` + string(value) + `"`)
+	}
+	return value
+}
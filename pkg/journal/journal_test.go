@@ -0,0 +1,117 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(Options{Dir: dir, Fsync: FsyncAlways, Buffer: 10, OnFull: OnFullWait})
+	require.NoError(t, err)
+	start := time.Now().UTC()
+	require.True(t, w.Append(Entry{Time: start, Query: "mutation A { createOneUser(data: {}) { id } }", IDs: map[string]json.RawMessage{"createOneUser": json.RawMessage("1")}}))
+	require.True(t, w.Append(Entry{Time: start.Add(time.Millisecond), OperationName: "B", Query: "mutation B { deleteOneUser(where: {id: 1}) { id } }"}))
+
+	// a backup starts a new file
+	require.NoError(t, Rotate(dir))
+	files := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, filePrefix+"*"+fileSuffix))
+		return names
+	}
+	require.Eventually(t, func() bool { return len(files()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, w.Append(Entry{Time: start.Add(2 * time.Millisecond), OperationName: "C", Query: "mutation C { createOneUser(data: {}) { id } }"}))
+	w.Close()
+	require.False(t, w.Append(Entry{Time: start}), "a closed journal takes no entries")
+
+	// a line cut short by a crash is skipped
+	last := files()[1]
+	file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"time":"20`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	records, err := Read(dir, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, json.RawMessage("1"), records[0].IDs["createOneUser"])
+	require.Equal(t, "C", records[2].OperationName)
+	require.Equal(t, last, records[2].File)
+	require.Equal(t, 1, records[2].Line)
+
+	records, err = Read(dir, start)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "B", records[0].OperationName)
+}
+
+func TestIDs(t *testing.T) {
+	ids := IDs([]byte(`{"data":{"createOneUser":{"id":"c\"1","email":"a"},"deleteManyUser":{"count":2},"many":[{"id":3},{"id":4}],"none":null}}`))
+	require.Equal(t, map[string]json.RawMessage{
+		"createOneUser": json.RawMessage(`"c\"1"`),
+		"many":          json.RawMessage(`[3,4]`),
+	}, ids)
+	require.Nil(t, IDs([]byte(`{"errors":[{"message":"boom"}]}`)))
+}
+
+func TestReplay(t *testing.T) {
+	var next int32
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request struct {
+			Query     string          `json:"query"`
+			Variables json.RawMessage `json:"variables"`
+		}
+		require.NoError(t, json.Unmarshal(body, &request))
+		if string(request.Variables) == `{"fail":true}` {
+			_, _ = w.Write([]byte(`{"errors":[{"message":"Unique constraint failed"}]}`))
+			return
+		}
+		fmt.Fprintf(w, `{"data":{"createOneUser":{"id":%d}}}`, atomic.AddInt32(&next, 1))
+	}))
+	defer engine.Close()
+	entry := func(id string) Record {
+		return Record{Entry: Entry{Query: "mutation { createOneUser(data: {}) { id } }", IDs: map[string]json.RawMessage{"createOneUser": json.RawMessage(id)}}, File: "journal", Line: 1}
+	}
+	replay := func(records ...Record) (int, *Divergence) {
+		atomic.StoreInt32(&next, 0)
+		n, err := Replay(context.Background(), http.DefaultClient, engine.URL, records)
+		var divergence *Divergence
+		if err != nil {
+			require.True(t, errors.As(err, &divergence), err.Error())
+		}
+		return n, divergence
+	}
+
+	n, divergence := replay(entry("1"), entry("2"))
+	require.Equal(t, 2, n)
+	require.Nil(t, divergence)
+
+	n, divergence = replay(entry("1"), entry("5"), entry("3"))
+	require.Equal(t, 1, n)
+	require.Equal(t, "createOneUser returned the ids 2, the journal has 5", divergence.Reason)
+
+	failing := entry("2")
+	failing.Variables = json.RawMessage(`{"fail":true}`)
+	n, divergence = replay(entry("1"), failing)
+	require.Equal(t, 1, n)
+	require.Equal(t, "the mutation failed: Unique constraint failed", divergence.Reason)
+
+	gap := Record{Entry: Entry{Gap: 3}}
+	n, divergence = replay(entry("1"), gap, entry("2"))
+	require.Equal(t, 1, n)
+	require.Contains(t, divergence.Error(), "3 mutations were dropped")
+}
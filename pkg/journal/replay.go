@@ -0,0 +1,175 @@
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// Record is an entry read from the journal with where it was read.
+type Record struct {
+	Entry
+	File string
+	Line int
+}
+
+// Read returns the entries of the journal in dir made after since, in the
+// order of their times: the files of two processes overlap while one hands
+// over to the other. A last line cut short by a crash is skipped.
+func Read(dir string, since time.Time) ([]Record, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if name := info.Name(); !info.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, fileSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var records []Record
+	for _, name := range names {
+		read, err := readFile(filepath.Join(dir, name), since)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, read...)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+func readFile(path string, since time.Time) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record
+	in := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			// the writer ends every line, one without a newline was
+			// being written
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := Record{File: path, Line: line}
+		if err := json.Unmarshal(data, &record.Entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if record.Time.After(since) {
+			records = append(records, record)
+		}
+	}
+}
+
+// Divergence is why a replay stopped before the end of the journal.
+type Divergence struct {
+	Record Record
+	Reason string
+}
+
+func (d *Divergence) Error() string {
+	name := d.Record.OperationName
+	if name == "" {
+		name = "mutation"
+	}
+	return fmt.Sprintf("%s:%d: %s of %s: %s", d.Record.File, d.Record.Line, name, d.Record.Time.Format(time.RFC3339Nano), d.Reason)
+}
+
+// Replay sends the mutations of records in order to the GraphQL endpoint
+// url. It stops at the first one that fails or whose response doesn't have
+// the ids the journal recorded, returned as a *Divergence, and at gaps. It
+// returns the number of mutations replayed.
+func Replay(ctx context.Context, client *http.Client, url string, records []Record) (int, error) {
+	for i, record := range records {
+		if record.Gap > 0 {
+			return i, &Divergence{Record: record, Reason: fmt.Sprintf("%d mutations were dropped from the journal here", record.Gap)}
+		}
+		body, err := json.Marshal(struct {
+			OperationName string          `json:"operationName,omitempty"`
+			Query         string          `json:"query"`
+			Variables     json.RawMessage `json:"variables,omitempty"`
+		}{record.OperationName, record.Query, record.Variables})
+		if err != nil {
+			return i, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return i, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			return i, err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return i, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return i, &Divergence{Record: record, Reason: fmt.Sprintf("status %d: %s", resp.StatusCode, bytes.TrimSpace(data))}
+		}
+		if message, err := jsonparser.GetString(data, "errors", "[0]", "message"); err == nil {
+			return i, &Divergence{Record: record, Reason: "the mutation failed: " + message}
+		}
+		if reason := compareIDs(record.IDs, IDs(data)); reason != "" {
+			return i, &Divergence{Record: record, Reason: reason}
+		}
+	}
+	return len(records), nil
+}
+
+// compareIDs describes the first root field whose ids differ, empty if
+// none does.
+func compareIDs(journaled, replayed map[string]json.RawMessage) string {
+	fields := make([]string, 0, len(journaled))
+	for field := range journaled {
+		fields = append(fields, field)
+	}
+	for field := range replayed {
+		if _, ok := journaled[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		want, got := compact(journaled[field]), compact(replayed[field])
+		if want != got {
+			if want == "" {
+				want = "none"
+			}
+			if got == "" {
+				got = "none"
+			}
+			return fmt.Sprintf("%s returned the ids %s, the journal has %s", field, got, want)
+		}
+	}
+	return ""
+}
+
+func compact(raw json.RawMessage) string {
+	var out bytes.Buffer
+	if err := json.Compact(&out, raw); err != nil {
+		return string(raw)
+	}
+	return out.String()
+}
@@ -0,0 +1,51 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wunderbase.log")
+	f, err := OpenFile(path, 1, 2)
+	require.NoError(t, err)
+	defer f.Close()
+	f.maxSize = 100
+
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 10; i++ {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 100)
+		assert.NotEmpty(t, data)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups are kept")
+}
+
+func TestFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wunderbase.log")
+	f, err := OpenFile(path, 0, 0)
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, _ = f.Write([]byte("before\n"))
+	// what logrotate does before signaling
+	require.NoError(t, os.Rename(path, path+".old"))
+	require.NoError(t, f.Reopen())
+	_, _ = f.Write([]byte("after\n"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "after\n", string(data))
+}
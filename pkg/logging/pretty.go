@@ -0,0 +1,216 @@
+// Package logging contains slog handlers: the console handler used during
+// development and the sampling handler for high-volume deployments.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	reset   = "\x1b[0m"
+	dim     = "\x1b[2m"
+	red     = "\x1b[31m"
+	green   = "\x1b[32m"
+	yellow  = "\x1b[33m"
+	magenta = "\x1b[35m"
+	cyan    = "\x1b[36m"
+)
+
+// messageWidth pads messages so the attributes of consecutive lines align.
+const messageWidth = 36
+
+// PrettyOptions configures a PrettyHandler.
+type PrettyOptions struct {
+	// Level is the minimum level logged, Info if nil.
+	Level slog.Leveler
+	// Time prefixes every line with the time of day.
+	Time bool
+	// Color enables ANSI colors.
+	Color bool
+}
+
+// PrettyHandler is a slog.Handler for humans reading logs in a terminal:
+// colored levels, aligned attributes, dimmed query engine output and
+// multi-line values such as stack traces rendered on their own lines.
+type PrettyHandler struct {
+	opts   PrettyOptions
+	mu     *sync.Mutex
+	w      io.Writer
+	attrs  []slog.Attr
+	prefix string
+}
+
+// NewPrettyHandler returns a PrettyHandler writing to w.
+func NewPrettyHandler(w io.Writer, opts PrettyOptions) *PrettyHandler {
+	if opts.Level == nil {
+		opts.Level = slog.LevelInfo
+	}
+	return &PrettyHandler{opts: opts, mu: &sync.Mutex{}, w: w}
+}
+
+func (h *PrettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+func (h *PrettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *PrettyHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+func (h *PrettyHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make([]slog.Attr, 0, len(h.attrs)+r.NumAttrs())
+	attrs = append(attrs, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		a.Key = h.prefix + a.Key
+		attrs = append(attrs, a)
+		return true
+	})
+
+	// the query engine's own output is noise next to wunderbase's logs
+	engine := false
+	for _, a := range attrs {
+		if a.Key == "process" {
+			engine = true
+		}
+	}
+
+	var buf bytes.Buffer
+	if h.opts.Time && !r.Time.IsZero() {
+		h.paint(&buf, dim, r.Time.Format("15:04:05.000"))
+		buf.WriteByte(' ')
+	}
+	h.paint(&buf, levelColor(r.Level), levelLabel(r.Level))
+	buf.WriteByte(' ')
+	if engine {
+		h.paint(&buf, dim, r.Message)
+	} else {
+		buf.WriteString(r.Message)
+	}
+
+	var multiline []slog.Attr
+	if len(attrs) > 0 {
+		if pad := messageWidth - len(r.Message); pad > 0 {
+			buf.WriteString(strings.Repeat(" ", pad))
+		}
+		for _, a := range flatten(attrs) {
+			value := a.Value.Resolve().String()
+			if strings.Contains(value, "\n") {
+				multiline = append(multiline, a)
+				continue
+			}
+			buf.WriteByte(' ')
+			h.paint(&buf, cyan, a.Key+"=")
+			if needsQuoting(value) {
+				value = strconv.Quote(value)
+			}
+			if engine {
+				h.paint(&buf, dim, value)
+			} else {
+				buf.WriteString(value)
+			}
+		}
+	}
+	buf.WriteByte('\n')
+	for _, a := range multiline {
+		buf.WriteString("    ")
+		h.paint(&buf, cyan, a.Key+":")
+		buf.WriteByte('\n')
+		for _, line := range strings.Split(strings.TrimRight(a.Value.Resolve().String(), "\n"), "\n") {
+			buf.WriteString("      ")
+			h.paint(&buf, levelColor(r.Level), line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *PrettyHandler) paint(buf *bytes.Buffer, color, s string) {
+	if !h.opts.Color || color == "" {
+		buf.WriteString(s)
+		return
+	}
+	buf.WriteString(color)
+	buf.WriteString(s)
+	buf.WriteString(reset)
+}
+
+// flatten expands groups into dotted keys.
+func flatten(attrs []slog.Attr) []slog.Attr {
+	var out []slog.Attr
+	for _, a := range attrs {
+		if a.Value.Kind() != slog.KindGroup {
+			if a.Key != "" {
+				out = append(out, a)
+			}
+			continue
+		}
+		for _, g := range flatten(a.Value.Group()) {
+			if a.Key != "" {
+				g.Key = a.Key + "." + g.Key
+			}
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+func levelLabel(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return "ERR"
+	case l >= slog.LevelWarn:
+		return "WRN"
+	case l >= slog.LevelInfo:
+		return "INF"
+	default:
+		return "DBG"
+	}
+}
+
+func levelColor(l slog.Level) string {
+	switch {
+	case l >= slog.LevelError:
+		return red
+	case l >= slog.LevelWarn:
+		return yellow
+	case l >= slog.LevelInfo:
+		return green
+	default:
+		return magenta
+	}
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if r == ' ' || r == '"' || r == '=' || !strconv.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestPrettyHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewPrettyHandler(&buf, PrettyOptions{Level: slog.LevelDebug}))
+
+	logger.Info("Server Listening", "addr", "0.0.0.0:4466")
+	logger.With("process", "query-engine").Debug("engine line")
+	logger.WithGroup("req").Error("request failed", "error", "boom\n\tat main.go:1", "path", "/ a")
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Equal(t, "INF Server Listening"+strings.Repeat(" ", messageWidth-len("Server Listening"))+" addr=0.0.0.0:4466", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "DBG engine line"))
+	assert.Contains(t, lines[2], `req.path="/ a"`)
+	assert.Equal(t, "    req.error:", lines[3])
+	assert.Equal(t, "      boom", lines[4])
+	assert.Equal(t, "      \tat main.go:1", lines[5])
+}
+
+func TestPrettyHandlerColors(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewPrettyHandler(&buf, PrettyOptions{Color: true}))
+
+	logger.Warn("careful")
+	logger.Debug("hidden")
+	logger.Info("engine", "process", "query-engine")
+
+	assert.Contains(t, buf.String(), yellow+"WRN"+reset)
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), dim+"engine"+reset)
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"io"
+	"strings"
+)
+
+// RedactingWriter replaces secrets in everything written to it, so a secret
+// echoed by the query engine or wrapped into an error never reaches the log.
+// Log handlers write a record at a time, a secret split over two writes isn't
+// replaced.
+type RedactingWriter struct {
+	w        io.Writer
+	replacer *strings.Replacer
+}
+
+// NewRedactingWriter returns a writer passing what is written on to w with
+// secrets replaced by <redacted>. Empty secrets are ignored.
+func NewRedactingWriter(w io.Writer, secrets ...string) *RedactingWriter {
+	var pairs []string
+	for _, secret := range secrets {
+		if secret != "" {
+			pairs = append(pairs, secret, "<redacted>")
+		}
+	}
+	return &RedactingWriter{w: w, replacer: strings.NewReplacer(pairs...)}
+}
+
+func (r *RedactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Unwrap returns the writer written to.
+func (r *RedactingWriter) Unwrap() io.Writer {
+	return r.w
+}
+
+// Redact replaces the secrets in s.
+func (r *RedactingWriter) Redact(s string) string {
+	return r.replacer.Replace(s)
+}
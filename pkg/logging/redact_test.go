@@ -0,0 +1,19 @@
+package logging
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewRedactingWriter(&buf, "s3cret key", "s3cret+key", "")
+	logger := slog.New(slog.NewTextHandler(w, nil))
+	logger.Info("Engine started", slog.String("url", "file:/data/db?key=s3cret+key"), slog.String("key", "s3cret key"))
+	assert.NotContains(t, buf.String(), "s3cret")
+	assert.Contains(t, buf.String(), "key=<redacted>")
+	assert.Equal(t, "no secret here", w.Redact("no secret here"))
+}
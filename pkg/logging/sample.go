@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// SamplingHandler keeps only a fraction of the records logged for requests.
+// Records are attributed to a request by their requestId attribute and the
+// decision is derived from it, so either all lines of a request are logged
+// or none. Warnings and errors, records not belonging to a request and the
+// first record of each operationName per minute are always logged. Query
+// engine lines that could not be attributed to a request are sampled at
+// random.
+type SamplingHandler struct {
+	inner     slog.Handler
+	rate      float64
+	requestID string
+	operation string
+	engine    bool
+	seen      *operations
+}
+
+// NewSamplingHandler returns a handler passing a fraction rate of the request
+// records on to inner.
+func NewSamplingHandler(inner slog.Handler, rate float64) *SamplingHandler {
+	return &SamplingHandler{inner: inner, rate: rate, seen: &operations{}}
+}
+
+// Sampled reports whether the lines of the request with requestID are kept
+// at rate.
+func Sampled(requestID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(requestID))
+	// fnv barely mixes the high bits of short inputs differing only at the
+	// end, such as sequential IDs, so finalize it like splitmix64
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11)/(1<<53) < rate
+}
+
+func (h *SamplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *SamplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.keep(r) {
+		return h.inner.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *SamplingHandler) keep(r slog.Record) bool {
+	if r.Level >= slog.LevelWarn {
+		return true
+	}
+	requestID, operation, engine := h.requestID, h.operation, h.engine
+	r.Attrs(func(a slog.Attr) bool {
+		requestID, operation, engine = match(a, requestID, operation, engine)
+		return true
+	})
+	if operation != "" && h.seen.first(operation, r.Time) {
+		return true
+	}
+	if requestID != "" {
+		return Sampled(requestID, h.rate)
+	}
+	if engine {
+		return rand.Float64() < h.rate
+	}
+	return true
+}
+
+func match(a slog.Attr, requestID, operation string, engine bool) (string, string, bool) {
+	switch a.Key {
+	case "requestId":
+		requestID = a.Value.String()
+	case "operationName":
+		operation = a.Value.String()
+	case "process":
+		engine = a.Value.String() == "query-engine"
+	}
+	return requestID, operation, engine
+}
+
+func (h *SamplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.inner = h.inner.WithAttrs(attrs)
+	for _, a := range attrs {
+		c.requestID, c.operation, c.engine = match(a, c.requestID, c.operation, c.engine)
+	}
+	return &c
+}
+
+func (h *SamplingHandler) WithGroup(name string) slog.Handler {
+	c := *h
+	c.inner = h.inner.WithGroup(name)
+	return &c
+}
+
+// operations remembers the operation names seen in the current minute.
+type operations struct {
+	mu     sync.Mutex
+	minute int64
+	names  map[string]struct{}
+}
+
+func (o *operations) first(name string, t time.Time) bool {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	minute := t.Unix() / 60
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if minute != o.minute || o.names == nil {
+		o.minute, o.names = minute, map[string]struct{}{}
+	}
+	if _, ok := o.names[name]; ok {
+		return false
+	}
+	o.names[name] = struct{}{}
+	return true
+}
@@ -0,0 +1,45 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slog"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewSamplingHandler(slog.NewTextHandler(&buf, nil), 0.1))
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		request := logger.With("requestId", id)
+		request.Info("engine call")
+		request.Info("request", "operationName", "Users", "status", 200)
+		lines := len(regexp.MustCompile(`requestId=`+id+`\b`).FindAllString(buf.String(), -1))
+		if Sampled(id, 0.1) {
+			kept++
+			assert.Equal(t, 2, lines, "all lines of a sampled request are kept")
+		} else if i > 0 {
+			assert.Equal(t, 0, lines)
+		}
+	}
+	assert.InDelta(t, 100, kept, 40)
+	assert.Contains(t, buf.String(), "requestId=req-0 operationName=Users", "first Users operation of the minute")
+
+	buf.Reset()
+	logger.With("requestId", "dropped").Error("request failed")
+	logger.Info("Server Listening")
+	assert.Contains(t, buf.String(), "request failed")
+	assert.Contains(t, buf.String(), "Server Listening")
+}
+
+func TestSampled(t *testing.T) {
+	assert.True(t, Sampled("any", 1))
+	assert.False(t, Sampled("any", 0))
+	assert.Equal(t, Sampled("req-1", 0.5), Sampled("req-1", 0.5))
+}
@@ -0,0 +1,271 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry holds metric families and renders them in the Prometheus text
+// exposition format. It is intentionally small: wunderbase only needs
+// counters, gauges and histograms with a handful of labels.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+	fn      func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	// 64-bit atomics first to keep them aligned on 32-bit platforms.
+	value       uint64 // float64 bits
+	count       uint64
+	sum         uint64 // float64 bits
+	counts      []uint64
+	labelValues []string
+	// fn computes the value of a gauge series at scrape time
+	fn func() float64
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			return existing
+		}
+	}
+	f.series = map[string]*series{}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter registers a monotonically increasing counter.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, typ: "counter", labels: labels})}
+}
+
+// Gauge registers a gauge that can go up and down.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(&family{name: name, help: help, typ: "gauge", labels: labels})}
+}
+
+// GaugeFunc registers an unlabelled gauge whose value is computed at scrape time.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&family{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// Histogram registers a histogram with the given upper bucket bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{r.register(&family{name: name, help: help, typ: "histogram", labels: labels, buckets: sorted})}
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if f.typ == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func addFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(addr, old, next) {
+			return
+		}
+	}
+}
+
+type CounterVec struct{ f *family }
+
+type Counter struct{ s *series }
+
+func (c *CounterVec) With(labelValues ...string) Counter {
+	return Counter{c.f.with(labelValues)}
+}
+
+func (c Counter) Inc() { c.Add(1) }
+
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.s.value, v)
+}
+
+type GaugeVec struct{ f *family }
+
+type Gauge struct{ s *series }
+
+func (g *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{g.f.with(labelValues)}
+}
+
+// Reset removes all series, e.g. before setting an info metric whose label
+// values changed.
+func (g *GaugeVec) Reset() {
+	g.f.mu.Lock()
+	g.f.series = map[string]*series{}
+	g.f.mu.Unlock()
+}
+
+// Func computes the value of the series at scrape time, like GaugeFunc does
+// for unlabelled gauges. A later call replaces fn.
+func (g *GaugeVec) Func(fn func() float64, labelValues ...string) {
+	s := g.f.with(labelValues)
+	g.f.mu.Lock()
+	s.fn = fn
+	g.f.mu.Unlock()
+}
+
+func (g Gauge) Set(v float64) { atomic.StoreUint64(&g.s.value, math.Float64bits(v)) }
+
+func (g Gauge) Add(v float64) { addFloat(&g.s.value, v) }
+
+type HistogramVec struct{ f *family }
+
+type Histogram struct {
+	f *family
+	s *series
+}
+
+func (h *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{h.f, h.f.with(labelValues)}
+}
+
+func (h Histogram) Observe(v float64) {
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			atomic.AddUint64(&h.s.counts[i], 1)
+		}
+	}
+	atomic.AddUint64(&h.s.count, 1)
+	addFloat(&h.s.sum, v)
+}
+
+// Write renders all registered metrics in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		if f.fn != nil {
+			fmt.Fprintf(bw, "%s %s\n", f.name, formatFloat(f.fn()))
+			continue
+		}
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.typ != "histogram" {
+				value := math.Float64frombits(atomic.LoadUint64(&s.value))
+				if s.fn != nil {
+					value = s.fn()
+				}
+				fmt.Fprintf(bw, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(value))
+				continue
+			}
+			for i, upper := range f.buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", formatFloat(upper)), atomic.LoadUint64(&s.counts[i]))
+			}
+			count := atomic.LoadUint64(&s.count)
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(math.Float64frombits(atomic.LoadUint64(&s.sum))))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), count)
+		}
+		f.mu.Unlock()
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry on a scrape endpoint.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = r.Write(w)
+	})
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extraName)
+		b.WriteString(`="`)
+		b.WriteString(extraValue)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
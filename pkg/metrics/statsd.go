@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps packets below common MTUs so they aren't fragmented.
+const statsdMaxPacket = 1400
+
+// StatsD sends metrics to a StatsD or DogStatsD agent over UDP. Metrics are
+// queued and sent from a background goroutine; when the queue is full or the
+// socket errors they are dropped, so request handling never blocks on it.
+type StatsD struct {
+	prefix string
+	tags   []string
+	conn   net.Conn
+	queue  chan string
+	done   chan struct{}
+}
+
+// NewStatsD connects to addr. prefix is prepended to every metric name and
+// tags ("key:value") are added to every metric in DogStatsD format.
+func NewStatsD(addr, prefix string, tags []string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		prefix: prefix,
+		tags:   tags,
+		conn:   conn,
+		queue:  make(chan string, 4096),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Count adds value to a counter. tags are alternating keys and values.
+func (s *StatsD) Count(name string, value float64, tags ...string) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "c", tags)
+}
+
+// Observe records a duration or size in a histogram. Values are expected in
+// seconds and sent as milliseconds timings.
+func (s *StatsD) Observe(name string, value float64, tags ...string) {
+	s.send(name, strconv.FormatFloat(value*1000, 'f', 3, 64), "ms", tags)
+}
+
+func (s *StatsD) send(name, value, typ string, tags []string) {
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(typ)
+	sep := "|#"
+	for _, tag := range s.tags {
+		b.WriteString(sep)
+		b.WriteString(tag)
+		sep = ","
+	}
+	for i := 0; i+1 < len(tags); i += 2 {
+		b.WriteString(sep)
+		b.WriteString(tags[i])
+		b.WriteByte(':')
+		b.WriteString(tags[i+1])
+		sep = ","
+	}
+	select {
+	case s.queue <- b.String():
+	default:
+		// drop rather than block the caller
+	}
+}
+
+// run batches queued lines into packets and flushes at least every 100ms.
+func (s *StatsD) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	flush := func() {
+		if buf.Len() > 0 {
+			// errors are ignored, metrics are best effort
+			_, _ = s.conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+	}
+	for {
+		select {
+		case line, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+				flush()
+			}
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(line)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close flushes queued metrics and closes the socket.
+func (s *StatsD) Close() error {
+	close(s.queue)
+	<-s.done
+	return s.conn.Close()
+}
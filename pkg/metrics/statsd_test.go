@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	s, err := NewStatsD(agent.LocalAddr().String(), "app.", []string{"env:test"})
+	require.NoError(t, err)
+	s.Count("requests_total", 1, "type", "query", "code", "200")
+	s.Observe("request_duration_seconds", 0.25, "type", "query")
+	require.NoError(t, s.Close())
+
+	buf := make([]byte, statsdMaxPacket)
+	require.NoError(t, agent.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := agent.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "app.requests_total:1|c|#env:test,type:query,code:200\n"+
+		"app.request_duration_seconds:250.000|ms|#env:test,type:query", string(buf[:n]))
+}
+
+func TestStatsDDropsWhenUnreachable(t *testing.T) {
+	// nothing listens on the port, writes fail and must not block
+	s, err := NewStatsD("127.0.0.1:1", "", nil)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10000; i++ {
+			s.Count("c", 1)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Count blocked")
+	}
+	require.NoError(t, s.Close())
+}
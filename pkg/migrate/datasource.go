@@ -0,0 +1,235 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	datasourceBlock = regexp.MustCompile(`^\s*datasource\s+(\w+)\s*\{`)
+	datasourceField = regexp.MustCompile(`^\s*(\w+)\s*=\s*(.*?)\s*$`)
+	envValue        = regexp.MustCompile(`^env\(\s*"([^"]*)"\s*\)$`)
+)
+
+// Datasource is the datasource block of a Prisma schema.
+type Datasource struct {
+	Name     string
+	Provider string
+	// URL is the url of the block, read from the env var if it is given
+	// as env("NAME").
+	URL string
+	// File is the SQLite file of the url. Relative paths are relative to
+	// the schema file, like prisma does.
+	File string
+	// urlStart and urlEnd are the offsets of the value of url in the
+	// schema, a string or env("NAME")
+	urlStart, urlEnd int
+}
+
+// DatasourceError tells why wunderbase can't serve the datasource of a
+// schema.
+type DatasourceError struct {
+	SchemaPath string
+	// Name and Provider are empty if the schema has no datasource.
+	Name     string
+	Provider string
+	Reason   string
+}
+
+func (e *DatasourceError) Error() string {
+	return e.Reason
+}
+
+// ReadDatasource reads the datasource block of the schema at schemaPath. It
+// fails with a *DatasourceError unless the provider is sqlite and the url a
+// file: url.
+func ReadDatasource(schemaPath string) (Datasource, error) {
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return Datasource{}, err
+	}
+	return ParseDatasource(schema, schemaPath)
+}
+
+// ParseDatasource parses the datasource block of schema, the content of the
+// file at schemaPath, like ReadDatasource.
+func ParseDatasource(schema []byte, schemaPath string) (Datasource, error) {
+	var (
+		ds     Datasource
+		inside bool
+		raw    string
+		offset int
+	)
+	for _, line := range strings.SplitAfter(string(schema), "\n") {
+		start := offset
+		offset += len(line)
+		code := withoutComment(line)
+		if !inside {
+			if match := datasourceBlock.FindStringSubmatch(code); match != nil && ds.Name == "" {
+				ds.Name, inside = match[1], true
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(code), "}") {
+			inside = false
+			continue
+		}
+		match := datasourceField.FindStringSubmatchIndex(code)
+		if match == nil {
+			continue
+		}
+		value := code[match[4]:match[5]]
+		switch code[match[2]:match[3]] {
+		case "provider":
+			ds.Provider = strings.Trim(value, `"`)
+		case "url":
+			raw, ds.urlStart, ds.urlEnd = value, start+match[4], start+match[5]
+		}
+	}
+	fail := func(format string, args ...interface{}) (Datasource, error) {
+		return Datasource{}, &DatasourceError{SchemaPath: schemaPath, Name: ds.Name, Provider: ds.Provider, Reason: fmt.Sprintf(format, args...)}
+	}
+	switch {
+	case ds.Name == "":
+		return fail("%s has no datasource block; wunderbase needs a sqlite datasource", schemaPath)
+	case ds.Provider != "sqlite":
+		return fail("datasource %s uses provider %q; wunderbase only supports sqlite", ds.Name, ds.Provider)
+	}
+	if match := envValue.FindStringSubmatch(raw); match != nil {
+		if ds.URL = os.Getenv(match[1]); ds.URL == "" {
+			return fail("datasource %s reads its url from %s, which is not set", ds.Name, match[1])
+		}
+	} else if len(raw) >= 2 && strings.HasPrefix(raw, `"`) && strings.HasSuffix(raw, `"`) {
+		ds.URL = raw[1 : len(raw)-1]
+	} else {
+		return fail("datasource %s has no url", ds.Name)
+	}
+	// the query may hold the key of an encrypted database
+	path, _, _ := strings.Cut(ds.URL, "?")
+	if !strings.HasPrefix(path, "file:") {
+		return fail("datasource %s has the url %q; wunderbase only supports file: urls", ds.Name, path)
+	}
+	if ds.File = strings.TrimPrefix(path, "file:"); ds.File == "" {
+		return fail("datasource %s has a file: url without a path", ds.Name)
+	}
+	if !filepath.IsAbs(ds.File) {
+		ds.File = filepath.Join(filepath.Dir(schemaPath), ds.File)
+	}
+	return ds, nil
+}
+
+// withoutComment cuts the // comment off a line of a schema.
+func withoutComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '"':
+			quoted = !quoted
+		case line[i] == '\\' && quoted:
+			i++
+		case !quoted && strings.HasPrefix(line[i:], "//"):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// DatabaseFilePath resolves the SQLite file referenced by the schema's
+// datasource. Relative paths are relative to the schema file, like prisma does.
+func DatabaseFilePath(schemaPath string) (string, error) {
+	ds, err := ReadDatasource(schemaPath)
+	if err != nil {
+		return "", err
+	}
+	return ds.File, nil
+}
+
+// withURL returns schema with the url of its datasource replaced by url.
+func (ds Datasource) withURL(schema []byte, rawURL string) []byte {
+	replaced := append([]byte(nil), schema[:ds.urlStart]...)
+	replaced = append(replaced, fmt.Sprintf("%q", rawURL)...)
+	return append(replaced, schema[ds.urlEnd:]...)
+}
+
+// WriteSchemaForDatabase writes a copy of the schema into dir whose
+// datasource points at database instead, and returns the copy's path.
+func WriteSchemaForDatabase(schemaPath, database, dir string) (string, error) {
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return "", err
+	}
+	ds, err := ParseDatasource(schema, schemaPath)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(database)
+	if err != nil {
+		return "", err
+	}
+	rawURL := "file:" + filepath.ToSlash(abs)
+	if _, query, ok := strings.Cut(ds.URL, "?"); ok {
+		rawURL += "?" + query
+	}
+	schema = ds.withURL(schema, rawURL)
+	path := filepath.Join(dir, filepath.Base(schemaPath))
+	if err := ioutil.WriteFile(path, schema, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// KeyParam is the parameter of the datasource url carrying the key of a
+// SQLCipher database, for query and migration engines built against it.
+const KeyParam = "key"
+
+var datasourceQuery = regexp.MustCompile(`(?m)^(\s*url\s*=\s*"file:)([^"?]+)(\?[^"]*)?"`)
+
+// WriteSchemaWithKey writes a copy of the schema into dir whose datasource
+// url carries key, and returns the copy's path. The database path is made
+// absolute, since the copy moved. Only the owner can read the copy, errors
+// never include the key.
+func WriteSchemaWithKey(schemaPath, key, dir string) (string, error) {
+	schema, err := ioutil.ReadFile(schemaPath)
+	if err != nil {
+		return "", err
+	}
+	ds, err := ParseDatasource(schema, schemaPath)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(ds.File)
+	if err != nil {
+		return "", err
+	}
+	_, rawQuery, _ := strings.Cut(ds.URL, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	query.Set(KeyParam, key)
+	schema = ds.withURL(schema, "file:"+filepath.ToSlash(abs)+"?"+query.Encode())
+	path := filepath.Join(dir, filepath.Base(schemaPath))
+	if err := ioutil.WriteFile(path, schema, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// withoutKey removes the key from the datasource url of schema, so the
+// migration lock file never records it.
+func withoutKey(schema string) string {
+	return datasourceQuery.ReplaceAllStringFunc(schema, func(match string) string {
+		parts := datasourceQuery.FindStringSubmatch(match)
+		query, _ := url.ParseQuery(strings.TrimPrefix(parts[3], "?"))
+		if query.Get(KeyParam) == "" {
+			return match
+		}
+		query.Del(KeyParam)
+		if len(query) == 0 {
+			return parts[1] + parts[2] + `"`
+		}
+		return parts[1] + parts[2] + "?" + query.Encode() + `"`
+	})
+}
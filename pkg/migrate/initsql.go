@@ -0,0 +1,204 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// importBatch is the number of statements of a dump imported in a
+// transaction.
+const importBatch = 1000
+
+// Statement is a statement of an SQL script and the line it starts on.
+type Statement struct {
+	SQL  string
+	Line int
+	// keyword is the first word of the statement, upper case
+	keyword string
+}
+
+// controlsTransaction tells if the statement begins or ends a transaction,
+// like the BEGIN TRANSACTION and COMMIT around a sqlite3 .dump.
+func (s Statement) controlsTransaction() bool {
+	switch s.keyword {
+	case "BEGIN", "COMMIT", "END", "ROLLBACK":
+		return true
+	}
+	return false
+}
+
+// SplitStatements splits an SQL script, like the output of the sqlite3
+// .dump command, into its statements. Semicolons in strings, quoted
+// identifiers, comments and the BEGIN ... END body of a trigger don't end a
+// statement. Comments between statements are dropped.
+func SplitStatements(script string) []Statement {
+	var (
+		statements []Statement
+		current    Statement
+		// start is the offset of the current statement, -1 between
+		// statements
+		start = -1
+		line  = 1
+		words int
+		// trigger is set in a CREATE TRIGGER statement, body once its
+		// BEGIN was read, cases counts the CASE expressions of the body
+		// whose END is still to come
+		trigger, body bool
+		cases         int
+	)
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\n':
+			line++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			continue
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end == -1 {
+				end = len(script) - i
+			}
+			// the newline is counted by the next iteration
+			i += end - 1
+			continue
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end == -1 {
+				end = len(script) - i - 2
+			} else {
+				end += 2
+			}
+			line += strings.Count(script[i:i+2+end], "\n")
+			i += 1 + end
+			continue
+		}
+		if start == -1 {
+			start, current = i, Statement{Line: line}
+			words, trigger, body, cases = 0, false, false, 0
+		}
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := i + 1
+			for end < len(script) {
+				if script[end] == closing {
+					// a doubled quote is one quote in the string
+					if closing != ']' && end+1 < len(script) && script[end+1] == closing {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			if end >= len(script) {
+				end = len(script) - 1
+			}
+			line += strings.Count(script[i:end+1], "\n")
+			i = end
+		case isWordByte(c):
+			end := i
+			for end < len(script) && isWordByte(script[end]) {
+				end++
+			}
+			word := strings.ToUpper(script[i:end])
+			i = end - 1
+			if words == 0 {
+				current.keyword = word
+			}
+			if words < 4 && word == "TRIGGER" && current.keyword == "CREATE" {
+				trigger = true
+			}
+			words++
+			switch {
+			case !trigger:
+			case word == "BEGIN" && !body:
+				body = true
+			case word == "CASE" && body:
+				cases++
+			case word == "END" && body && cases > 0:
+				cases--
+			case word == "END" && body:
+				body = false
+			}
+		case c == ';' && !body:
+			current.SQL = script[start : i+1]
+			statements = append(statements, current)
+			start = -1
+		}
+	}
+	if start != -1 {
+		current.SQL = strings.TrimSpace(script[start:]) + "\n;"
+		statements = append(statements, current)
+	}
+	return statements
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+// Import creates database from the SQL dump in file with the sqlite3 CLI,
+// in a transaction per batch of statements. The statements of the dump
+// controlling transactions are dropped. The database is written next to
+// its path and only renamed to it once every statement succeeded, so a
+// failed import leaves no database behind. It returns the number of
+// statements imported.
+func Import(ctx context.Context, sqlitePath, database, file string) (int, error) {
+	script, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	var statements []Statement
+	for _, statement := range SplitStatements(string(script)) {
+		if !statement.controlsTransaction() {
+			statements = append(statements, statement)
+		}
+	}
+	if len(statements) == 0 {
+		return 0, fmt.Errorf("%s has no statements", file)
+	}
+	importing := database + ".init"
+	removeDatabase(importing)
+	for first := 0; first < len(statements); first += importBatch {
+		last := first + importBatch
+		if last > len(statements) {
+			last = len(statements)
+		}
+		var batch strings.Builder
+		batch.WriteString("BEGIN;\n")
+		for _, statement := range statements[first:last] {
+			batch.WriteString(statement.SQL)
+			batch.WriteString("\n")
+		}
+		batch.WriteString("COMMIT;\n")
+		cmd := exec.CommandContext(ctx, sqlitePath, "-batch", "-bail", importing)
+		cmd.Stdin = strings.NewReader(batch.String())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			removeDatabase(importing)
+			return 0, fmt.Errorf("%s: statements of lines %d to %d: sqlite3: %v: %s",
+				file, statements[first].Line, statements[last-1].Line, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.Rename(importing, database); err != nil {
+		removeDatabase(importing)
+		return 0, err
+	}
+	return len(statements), nil
+}
+
+// removeDatabase removes a database and the journals sqlite may have left
+// next to it.
+func removeDatabase(database string) {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		_ = os.Remove(database + suffix)
+	}
+}
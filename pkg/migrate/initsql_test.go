@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const dump = `PRAGMA foreign_keys=OFF;
+BEGIN TRANSACTION;
+-- users; with a semicolon in a comment
+CREATE TABLE "User" (id INTEGER PRIMARY KEY, email TEXT, "na;me" TEXT);
+INSERT INTO "User" VALUES(1,'a@example.com','O''Brien; Jr.');
+/* a block;
+   comment */
+INSERT INTO [User] VALUES(2,'b@example.com',NULL);
+CREATE TABLE Log (msg TEXT);
+CREATE TRIGGER user_log AFTER INSERT ON "User"
+BEGIN
+  INSERT INTO Log VALUES (CASE WHEN NEW.email LIKE '%;%' THEN 'odd' ELSE 'ok' END);
+  INSERT INTO Log VALUES ('second');
+END;
+COMMIT;
+INSERT INTO "User" VALUES(3,'c@example.com','last')`
+
+func TestSplitStatements(t *testing.T) {
+	statements := SplitStatements(dump)
+	var lines []int
+	var sqls []string
+	for _, statement := range statements {
+		lines = append(lines, statement.Line)
+		sqls = append(sqls, statement.SQL)
+	}
+	require.Equal(t, []int{1, 2, 4, 5, 8, 9, 10, 15, 16}, lines)
+	require.Equal(t, `INSERT INTO "User" VALUES(1,'a@example.com','O''Brien; Jr.');`, sqls[3])
+	require.True(t, strings.HasPrefix(sqls[6], "CREATE TRIGGER user_log"))
+	require.True(t, strings.HasSuffix(sqls[6], "('second');\nEND;"))
+	require.True(t, statements[1].controlsTransaction())
+	require.True(t, statements[7].controlsTransaction())
+	require.False(t, statements[6].controlsTransaction())
+	require.Equal(t, "INSERT INTO \"User\" VALUES(3,'c@example.com','last')\n;", sqls[8])
+}
+
+func TestImport(t *testing.T) {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	require.NoError(t, os.WriteFile(file, []byte(dump), 0644))
+	database := filepath.Join(dir, "db.sqlite")
+
+	imported, err := Import(ctx, sqlite, database, file)
+	require.NoError(t, err)
+	require.Equal(t, 7, imported)
+	out, err := exec.Command(sqlite, database, `SELECT count(*) FROM "User"; SELECT count(*) FROM Log;`).CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Equal(t, "3\n2\n", string(out))
+
+	// a failing statement leaves no database behind
+	broken := filepath.Join(dir, "broken.sql")
+	require.NoError(t, os.WriteFile(broken, []byte("CREATE TABLE a (id INTEGER);\n\nINSERT INTO missing VALUES (1);\n"), 0644))
+	_, err = Import(ctx, sqlite, filepath.Join(dir, "broken.sqlite"), broken)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "statements of lines 1 to 3")
+	require.Contains(t, err.Error(), "no such table: missing")
+	_, err = os.Stat(filepath.Join(dir, "broken.sqlite"))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "broken.sqlite.init"))
+	require.True(t, os.IsNotExist(err))
+}
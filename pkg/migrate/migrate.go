@@ -8,16 +8,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"os/exec"
+	"strings"
 	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 type MigrationRequest struct {
-	Id      int                    `json:"id"`
-	Jsonrpc string                 `json:"jsonrpc"`
-	Method  string                 `json:"method"`
-	Params  MigrationRequestParams `json:"params"`
+	Id      int         `json:"id"`
+	Jsonrpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
 }
 
 type MigrationRequestParams struct {
@@ -29,10 +32,14 @@ type MigrationResponse struct {
 	Jsonrpc string                   `json:"jsonrpc"`
 	Result  *MigrationResponseResult `json:"result,omitempty"`
 	Error   *MigrationResponseError  `json:"error,omitempty"`
+	// Printed collects output the engine sent through print requests.
+	Printed []string `json:"-"`
 }
 
 type MigrationResponseResult struct {
 	ExecutedSteps int `json:"executedSteps"`
+	// ExitCode is set by the diff method when called with exitCode: true.
+	ExitCode *int `json:"exitCode,omitempty"`
 }
 
 type MigrationResponseError struct {
@@ -51,115 +58,235 @@ type MigrationResponseErrorDataMeta struct {
 	FullError string `json:"full_error"`
 }
 
-func Database(migrationEnginePath, migrationLockFilePath, schema, schemaPath string) error {
+// Error is a migration engine method answered with an error: the schema was
+// rejected or, if IsPanic, the engine panicked.
+type Error struct {
+	Method    string `json:"method"`
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	IsPanic   bool   `json:"isPanic"`
+	FullError string `json:"fullError,omitempty"`
+}
+
+// newError converts the error of a response to method.
+func newError(method string, resp *MigrationResponseError) *Error {
+	message := resp.Data.Message
+	if message == "" {
+		// the top level message only points at the data
+		message = resp.Message
+	}
+	return &Error{
+		Method:    method,
+		Code:      resp.Code,
+		Message:   message,
+		IsPanic:   resp.Data.IsPanic,
+		FullError: resp.Data.Meta.FullError,
+	}
+}
+
+func (e *Error) Error() string {
+	if e.IsPanic {
+		return fmt.Sprintf("migration engine panicked in %s: %s", e.Method, e.Message)
+	}
+	return fmt.Sprintf("migration %s: %s", e.Method, e.Message)
+}
+
+// LogValue logs the fields of the error instead of its message.
+func (e *Error) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("method", e.Method),
+		slog.Int("code", e.Code),
+		slog.String("message", e.Message),
+		slog.Bool("isPanic", e.IsPanic),
+		slog.String("fullError", e.FullError),
+	)
+}
+
+// LockStatus reports whether the lock file records schema as migrated and
+// when it was last written. A missing lock file doesn't match.
+func LockStatus(migrationLockFilePath, schema string) (matches bool, lastRun time.Time, err error) {
 	h := sha256.New()
-	expected := h.Sum([]byte(schema))
+	expected := h.Sum([]byte(withoutKey(schema)))
+	info, err := os.Stat(migrationLockFilePath)
+	if os.IsNotExist(err) {
+		return false, time.Time{}, nil
+	}
+	if err != nil {
+		return false, time.Time{}, err
+	}
 	lock, err := ioutil.ReadFile(migrationLockFilePath)
 	if err != nil {
+		return false, time.Time{}, err
+	}
+	return bytes.Equal(lock, expected), info.ModTime(), nil
+}
+
+func Database(migrationEnginePath, migrationLockFilePath, schema, schemaPath string) error {
+	h := sha256.New()
+	expected := h.Sum([]byte(withoutKey(schema)))
+	lock, err := ioutil.ReadFile(migrationLockFilePath)
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("read lock file: %v", err)
 	}
 	if bytes.Equal(lock, expected) {
-		log.Println("Migration already executed, skipping")
+		slog.Info("Migration already executed, skipping")
 		return nil
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, migrationEnginePath, "--datamodel", schemaPath)
-	in, err := cmd.StdinPipe()
+	resp, err := call(ctx, migrationEnginePath, schemaPath, "schemaPush", MigrationRequestParams{
+		Force:  true,
+		Schema: schema,
+	})
 	if err != nil {
-		return fmt.Errorf("migration engine std in pipe: %v", err)
+		return err
 	}
-	defer in.Close()
 
-	req := MigrationRequest{
-		Id:      1,
-		Jsonrpc: "2.0",
-		Method:  "schemaPush",
-		Params: MigrationRequestParams{
-			Force:  true,
-			Schema: schema,
-		},
+	if resp.Error == nil {
+		slog.Info("Migration successful, updating lock file")
+		err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
+		if err != nil {
+			return fmt.Errorf("migration write lock file: %v", err)
+		}
+		return nil
 	}
-
-	data, err := json.Marshal(req)
+	migrationErr := newError("schemaPush", resp.Error)
+	slog.Error("Migration failed", slog.Any("error", migrationErr))
+	err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
 	if err != nil {
-		return fmt.Errorf("marshal migration request: %v", err)
+		return fmt.Errorf("migration write lock file: %v", err)
 	}
-	data = append(data, []byte("\n")...)
-	_, err = in.Write(data)
+	return migrationErr
+}
+
+// call sends a single JSON-RPC request to the migration engine and returns
+// its response. The engine is stopped as soon as the response arrived.
+func call(ctx context.Context, migrationEnginePath, schemaPath, method string, params interface{}) (*MigrationResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, migrationEnginePath, "--datamodel", schemaPath)
+	in, err := cmd.StdinPipe()
 	if err != nil {
-		return fmt.Errorf("write data to stdin: %v", err)
+		return nil, fmt.Errorf("migration engine std in pipe: %v", err)
 	}
-
+	defer in.Close()
 	out, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("migration std out pipe: %v", err)
+		return nil, fmt.Errorf("migration std out pipe: %v", err)
 	}
-
-	errs := make(chan error, 1) // Create a buffered error channel
-	cmdDone := make(chan struct{}, 1)
-
-	defer close(errs)
-
-	go func() {
-		defer close(cmdDone)
-		err := cmd.Run()
-		if err != nil && ctx.Err() == nil {
-			errs <- fmt.Errorf("migration engine run: %v", err)
-		}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("migration engine start: %v", err)
+	}
+	defer func() {
+		cancel()
+		_ = cmd.Wait()
 	}()
 
-	var resp MigrationResponse
+	data, err := json.Marshal(MigrationRequest{
+		Id:      1,
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal migration request: %v", err)
+	}
+	data = append(data, '\n')
+	if _, err := in.Write(data); err != nil {
+		return nil, fmt.Errorf("write data to stdin: %v", err)
+	}
+
+	lines := make(chan []byte)
+	readErr := make(chan error, 1)
 	go func() {
-		defer close(errs)
 		r := bufio.NewReader(out)
-		outBuf := &bytes.Buffer{}
 		for {
-			b, err := r.ReadByte()
+			line, err := r.ReadBytes('\n')
 			if err != nil {
-				errs <- fmt.Errorf("migration ReadByte: %v", err)
+				readErr <- err
 				return
 			}
-			err = outBuf.WriteByte(b)
-			if err != nil {
-				errs <- fmt.Errorf("migration writeByte: %v", err)
-				return
-			}
-			if b == '\n' {
-				cancel()
-				err = json.Unmarshal(outBuf.Bytes(), &resp)
-				if err != nil {
-					errs <- fmt.Errorf("migration unmarshal response: %v", err)
-					return
-				}
+			select {
+			case lines <- line:
+			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 
-	// Check if goroutine encountered any errors
-	if err := <-errs; err != nil {
-		return err
+	var printed []string
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("migration engine %s: %v", method, ctx.Err())
+		case err := <-readErr:
+			return nil, fmt.Errorf("migration read response: %v", err)
+		case line := <-lines:
+			var msg engineMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return nil, fmt.Errorf("migration unmarshal response: %v", err)
+			}
+			if msg.Method == "" {
+				var resp MigrationResponse
+				if err := json.Unmarshal(line, &resp); err != nil {
+					return nil, fmt.Errorf("migration unmarshal response: %v", err)
+				}
+				resp.Printed = printed
+				return &resp, nil
+			}
+			// the engine sends human readable output (e.g. the diff summary)
+			// as "print" requests which have to be acknowledged
+			if msg.Method == "print" {
+				printed = append(printed, msg.Params.Content)
+			}
+			if msg.Id != nil {
+				ack := fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":{}}`+"\n", *msg.Id)
+				if _, err := in.Write([]byte(ack)); err != nil {
+					return nil, fmt.Errorf("write data to stdin: %v", err)
+				}
+			}
+		}
 	}
+}
 
-	if resp.Error == nil {
-		log.Println("Migration successful, updating lock file")
-		err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
-		if err != nil {
-			return fmt.Errorf("migration write lock file: %v", err)
-		}
-		return nil
-	} else {
-		pretty, err := json.MarshalIndent(resp, "", "  ")
-		if err != nil {
-			return fmt.Errorf("migration marshal error: %v", err)
-		}
-		log.Printf("Migration failed:\n%s", string(pretty))
-		err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
-		if err != nil {
-			return fmt.Errorf("migration write lock file: %v", err)
-		}
-		return fmt.Errorf("migration failed: %v", string(pretty))
+// engineMessage is a request sent from the engine back to the client.
+type engineMessage struct {
+	Id     *json.RawMessage `json:"id"`
+	Method string           `json:"method"`
+	Params struct {
+		Content string `json:"content"`
+	} `json:"params"`
+}
+
+type diffTarget struct {
+	Tag    string `json:"tag"`
+	Schema string `json:"schema,omitempty"`
+}
+
+type diffParams struct {
+	From     diffTarget `json:"from"`
+	To       diffTarget `json:"to"`
+	Script   bool       `json:"script"`
+	ExitCode bool       `json:"exitCode"`
+}
+
+// Drift compares the database referenced by the schema's datasource with the
+// schema's models. It reports whether they differ, together with the
+// engine's summary of the differences.
+func Drift(ctx context.Context, migrationEnginePath, schemaPath string) (bool, string, error) {
+	resp, err := call(ctx, migrationEnginePath, schemaPath, "diff", diffParams{
+		From:     diffTarget{Tag: "schemaDatasource", Schema: schemaPath},
+		To:       diffTarget{Tag: "schemaDatamodel", Schema: schemaPath},
+		ExitCode: true,
+	})
+	if err != nil {
+		return false, "", err
+	}
+	if resp.Error != nil {
+		return false, "", newError("diff", resp.Error)
 	}
+	summary := strings.TrimSpace(strings.Join(resp.Printed, ""))
+	return resp.Result != nil && resp.Result.ExitCode != nil && *resp.Result.ExitCode == 2, summary, nil
 }
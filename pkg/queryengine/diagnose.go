@@ -0,0 +1,184 @@
+package queryengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// UnsupportedFeatureError is why the query engine refused the schema: it
+// uses a feature the installed engine doesn't know.
+type UnsupportedFeatureError struct {
+	// Feature is what the schema uses, like relationMode or the preview
+	// feature multiSchema.
+	Feature string
+	// MinVersion is the first engine version knowing the feature, empty if
+	// it isn't in the table.
+	MinVersion string
+	// Line is the engine output the feature was recognized by.
+	Line string
+	Err  error
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	msg := "the schema uses " + e.Feature + ", which the query engine doesn't support"
+	if e.MinVersion != "" {
+		msg += ": it needs query engine " + e.MinVersion + " or newer"
+	}
+	msg += ", install a newer engine and point WUNDERBASE_QUERY_ENGINE_PATH at it"
+	if e.Err != nil {
+		msg += " (" + e.Err.Error() + ")"
+	}
+	return msg
+}
+
+func (e *UnsupportedFeatureError) Unwrap() error {
+	return e.Err
+}
+
+// featurePatterns recognize the schema validation errors of engines too old
+// for a feature. The feature is the first submatch, versions maps it to the
+// first engine version supporting it.
+var featurePatterns = []struct {
+	re       *regexp.Regexp
+	feature  func(name string) string
+	versions map[string]string
+}{
+	{
+		re:      regexp.MustCompile(`The preview feature "(\w+)" is not known`),
+		feature: func(name string) string { return "the preview feature " + name },
+		versions: map[string]string{
+			"fullTextSearch":       "2.30.0",
+			"fullTextIndex":        "3.6.0",
+			"multiSchema":          "4.3.0",
+			"extendedWhereUnique":  "4.5.0",
+			"postgresqlExtensions": "4.5.0",
+			"views":                "4.9.0",
+			"driverAdapters":       "5.4.0",
+			"relationJoins":        "5.7.0",
+			"omitApi":              "5.13.0",
+			"prismaSchemaFolder":   "5.15.0",
+			"typedSql":             "5.19.0",
+		},
+	},
+	{
+		re:      regexp.MustCompile(`Property not known: "(\w+)"`),
+		feature: func(name string) string { return "the datasource property " + name },
+		versions: map[string]string{
+			"relationMode": "4.5.0",
+			"schemas":      "4.3.0",
+			"directUrl":    "4.10.0",
+		},
+	},
+	{
+		re:      regexp.MustCompile(`Attribute not known: "@@?(\w+)"`),
+		feature: func(name string) string { return "the attribute @@" + name },
+		versions: map[string]string{
+			"fulltext": "3.6.0",
+			"schema":   "4.3.0",
+		},
+	},
+	{
+		// the block error doesn't name the keyword, the excerpt below it does
+		re:       regexp.MustCompile(`(?s)This block is invalid.*?\|\s*(view)\s+\w+\s*\{`),
+		feature:  func(name string) string { return name + " blocks" },
+		versions: map[string]string{"view": "4.9.0"},
+	},
+}
+
+// Diagnose looks for a feature the engine rejected in its output, nil if
+// the output isn't one of the known validation errors.
+func Diagnose(output string) *UnsupportedFeatureError {
+	output = expandMessages(output)
+	for _, p := range featurePatterns {
+		match := p.re.FindStringSubmatchIndex(output)
+		if match == nil {
+			continue
+		}
+		name := output[match[2]:match[3]]
+		line := output[match[0]:]
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		}
+		return &UnsupportedFeatureError{Feature: p.feature(name), MinVersion: p.versions[name], Line: line}
+	}
+	return nil
+}
+
+// expandMessages replaces the lines the engine logs as JSON by their
+// message, which holds the validation errors with their quotes unescaped.
+func expandMessages(output string) string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var logged struct {
+			Message string `json:"message"`
+			Fields  struct {
+				Message string `json:"message"`
+			} `json:"fields"`
+		}
+		if json.Unmarshal([]byte(line), &logged) != nil {
+			continue
+		}
+		if logged.Message != "" {
+			lines[i] = logged.Message
+		} else if logged.Fields.Message != "" {
+			lines[i] = logged.Fields.Message
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// outputTail keeps the last lines the engine wrote, to diagnose an exit.
+// Adding to a nil tail does nothing.
+type outputTail struct {
+	// size is the lines kept, outputTailLines if 0
+	size  int
+	mu    sync.Mutex
+	lines []string
+}
+
+const outputTailLines = 50
+
+func (t *outputTail) add(line string) {
+	if t == nil {
+		return
+	}
+	size := t.size
+	if size == 0 {
+		size = outputTailLines
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) == size {
+		t.lines = append(t.lines[:0], t.lines[1:]...)
+	}
+	t.lines = append(t.lines, line)
+}
+
+func (t *outputTail) list() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.lines...)
+}
+
+func (t *outputTail) String() string {
+	return strings.Join(t.list(), "\n")
+}
+
+// diagnoseExit returns err, explained by the output if the engine refused a
+// feature of the schema.
+func diagnoseExit(err error, output string) error {
+	if diagnosis := Diagnose(output); diagnosis != nil {
+		diagnosis.Err = err
+		return diagnosis
+	}
+	if err == nil {
+		return fmt.Errorf("query engine exited")
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package queryengine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		output     string
+		feature    string
+		minVersion string
+	}{
+		{"relation_mode_4.4.txt", "the datasource property relationMode", "4.5.0"},
+		{"relation_joins_5.6.txt", "the preview feature relationJoins", "5.7.0"},
+		{"view_block_4.8.txt", "view blocks", "4.9.0"},
+		{"fulltext_index_3.5.txt", "the attribute @@fulltext", "3.6.0"},
+		{"invalid_url.txt", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.output, func(t *testing.T) {
+			output, err := ioutil.ReadFile(filepath.Join("testdata", test.output))
+			require.NoError(t, err)
+			diagnosis := Diagnose(string(output))
+			if test.feature == "" {
+				assert.Nil(t, diagnosis)
+				return
+			}
+			require.NotNil(t, diagnosis)
+			assert.Equal(t, test.feature, diagnosis.Feature)
+			assert.Equal(t, test.minVersion, diagnosis.MinVersion)
+			assert.NotContains(t, diagnosis.Line, "\n")
+		})
+	}
+}
+
+func TestDiagnoseExit(t *testing.T) {
+	output, err := ioutil.ReadFile(filepath.Join("testdata", "relation_mode_4.4.txt"))
+	require.NoError(t, err)
+	exit := &exec.ExitError{}
+	err = diagnoseExit(exit, string(output))
+
+	var unsupported *UnsupportedFeatureError
+	require.True(t, errors.As(err, &unsupported))
+	assert.True(t, errors.Is(err, exit))
+	assert.Contains(t, err.Error(), "relationMode")
+	assert.Contains(t, err.Error(), "4.5.0 or newer")
+	assert.Contains(t, err.Error(), "WUNDERBASE_QUERY_ENGINE_PATH")
+
+	assert.Same(t, exit, diagnoseExit(exit, "listening on 127.0.0.1:4467"))
+	assert.EqualError(t, diagnoseExit(nil, ""), "query engine exited")
+}
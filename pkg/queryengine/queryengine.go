@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -11,20 +12,78 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
+
+	"wunderbase/pkg/tracing"
 
 	"golang.org/x/exp/slog"
 )
 
-func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePort, prismaSchemaFilePath string, production, debug bool) error {
+// Status describes the query engine process started last.
+type Status struct {
+	// State is running, stopped or exited, the latter when the engine quit
+	// on its own.
+	State   string
+	PID     int
+	Started time.Time
+	Err     string
+}
+
+var status struct {
+	sync.Mutex
+	Status
+}
+
+// CurrentStatus returns the status of the query engine process started last.
+func CurrentStatus() Status {
+	status.Lock()
+	defer status.Unlock()
+	return status.Status
+}
+
+func setStatus(s Status) {
+	status.Lock()
+	status.Status = s
+	status.Unlock()
+}
+
+// recentOutput keeps the last lines written by the engines started with Run.
+var recentOutput = &outputTail{size: recentOutputLines}
+
+const recentOutputLines = 500
+
+// RecentOutput returns the last lines written by the query engines started
+// with Run, oldest first, as written: query logs carry their parameters.
+func RecentOutput() []string {
+	return recentOutput.list()
+}
+
+// Run starts the query engine, which is stopped when ctx is done. onCrash,
+// if not nil, is called when the engine exits before that, with an
+// *UnsupportedFeatureError if the engine refused a feature of the schema.
+func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePort, prismaSchemaFilePath string, production, debug bool, onCrash func(err error)) error {
+	return run(ctx, wg, queryEnginePath, queryEnginePort, prismaSchemaFilePath, production, debug, onCrash, setStatus, recentOutput)
+}
+
+// RunUntracked is Run for a throwaway engine next to the one serving the
+// database, like one reading a backup: CurrentStatus keeps reporting the
+// engine started last by Run.
+func RunUntracked(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePort, prismaSchemaFilePath string, production, debug bool, onCrash func(err error)) error {
+	return run(ctx, wg, queryEnginePath, queryEnginePort, prismaSchemaFilePath, production, debug, onCrash, func(Status) {}, nil)
+}
+
+func run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePort, prismaSchemaFilePath string, production, debug bool, onCrash func(err error), setStatus func(Status), recent *outputTail) error {
 	// when start prisma query engine ,
 	// we're not able to listen on the same port,
 	// if last engine instance still alive.
 	// so we must kill the existing engine process before we start new onw.
 
-	args := []string{"--datamodel-path", prismaSchemaFilePath}
+	// the port is always passed, several engines run side by side when
+	// serving more than one database
+	args := []string{"--datamodel-path", prismaSchemaFilePath, "--port", queryEnginePort}
 	if !production {
 		// killExistingPrismaQueryEngineProcess(queryEnginePort)
-		args = append(args, "--enable-playground", "--port", queryEnginePort)
+		args = append(args, "--enable-playground")
 	}
 	if debug {
 		args = append(args, "--debug", "--log-queries")
@@ -37,10 +96,18 @@ func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePo
 	}
 	defer stdout.Close()
 
+	// Wait closes the pipes, so it must only be called once they are drained
+	var output sync.WaitGroup
+	tail := &outputTail{}
+	output.Add(2)
 	go func() {
+		defer output.Done()
 		scanner := bufio.NewScanner(stdout)
 		for scanner.Scan() {
-			slog.InfoCtx(ctx, scanner.Text(), slog.String("process", "query-engine"))
+			tail.add(scanner.Text())
+			recent.add(scanner.Text())
+			observeLine(scanner.Text())
+			slog.InfoCtx(ctx, scanner.Text(), engineAttrs()...)
 		}
 	}()
 
@@ -51,9 +118,12 @@ func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePo
 	defer stderr.Close()
 
 	go func() {
+		defer output.Done()
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
-			slog.ErrorCtx(ctx, scanner.Text(), slog.String("process", "query-engine"))
+			tail.add(scanner.Text())
+			recent.add(scanner.Text())
+			slog.ErrorCtx(ctx, scanner.Text(), engineAttrs()...)
 		}
 	}()
 
@@ -62,12 +132,40 @@ func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePo
 		return fmt.Errorf("error starting Cmd: %w", err)
 	}
 
+	started := Status{State: "running", PID: cmd.Process.Pid, Started: time.Now()}
+	setStatus(started)
+
+	exited := make(chan struct{})
+	go func() {
+		output.Wait()
+		err := cmd.Wait()
+		close(exited)
+		if ctx.Err() != nil {
+			started.State = "stopped"
+			setStatus(started)
+			return
+		}
+		// an engine refusing the schema exits right away, its output says why
+		err = diagnoseExit(err, tail.String())
+		started.State, started.Err = "exited", err.Error()
+		setStatus(started)
+		slog.Error("Query engine crashed", slog.String("error", err.Error()), slog.String("process", "query-engine"))
+		if onCrash != nil {
+			onCrash(err)
+		}
+	}()
+
 	go func() {
 		<-ctx.Done()
 
-		err = cmd.Process.Kill()
-		if err != nil {
-			slog.ErrorCtx(ctx, "killing query engine", err, slog.String("process", "query-engine"))
+		select {
+		case <-exited:
+		default:
+			err = cmd.Process.Kill()
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
+				slog.ErrorCtx(ctx, "killing query engine", err, slog.String("process", "query-engine"))
+			}
+			<-exited
 		}
 		slog.InfoCtx(ctx, "query engine stopped")
 
@@ -76,6 +174,16 @@ func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePo
 	return nil
 }
 
+// engineAttrs tags engine log lines with the trace of the request that most
+// likely caused them.
+func engineAttrs() []interface{} {
+	attrs := []interface{}{slog.String("process", "query-engine")}
+	if t, ok := tracing.Current(); ok {
+		attrs = append(attrs, t.Attrs()...)
+	}
+	return attrs
+}
+
 // reference:https://github.com/wundergraph/wundergraph
 func killExistingPrismaQueryEngineProcess(queryEnginePort string) {
 	var err error
@@ -0,0 +1,65 @@
+package queryengine
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"wunderbase/pkg/tracing"
+)
+
+var observer struct {
+	sync.Mutex
+	fn func(requestID, sql, params string)
+}
+
+// SetQueryObserver registers fn to be called with the SQL statements the
+// query engine logs with --log-queries, and the request that caused them.
+// Statements are only passed on when a single request was in flight, see
+// tracing.Current. nil removes the observer.
+func SetQueryObserver(fn func(requestID, sql, params string)) {
+	observer.Lock()
+	observer.fn = fn
+	observer.Unlock()
+}
+
+func observeLine(line string) {
+	observer.Lock()
+	fn := observer.fn
+	observer.Unlock()
+	if fn == nil {
+		return
+	}
+	sql, params, ok := parseQueryLog(line)
+	if !ok {
+		return
+	}
+	if t, ok := tracing.Current(); ok && t.RequestID != "" {
+		fn(t.RequestID, sql, params)
+	}
+}
+
+// parseQueryLog returns the statement and its parameters of a query log
+// line of the engine, which logs them as JSON with the statement in query
+// or, in older engines, in message.
+func parseQueryLog(line string) (sql, params string, ok bool) {
+	if !strings.HasPrefix(line, "{") || !strings.Contains(line, `"params"`) {
+		return "", "", false
+	}
+	var logged struct {
+		Fields struct {
+			Message  string `json:"message"`
+			Query    string `json:"query"`
+			Params   string `json:"params"`
+			ItemType string `json:"item_type"`
+		} `json:"fields"`
+	}
+	if json.Unmarshal([]byte(line), &logged) != nil || logged.Fields.ItemType != "query" {
+		return "", "", false
+	}
+	sql = logged.Fields.Query
+	if sql == "" {
+		sql = logged.Fields.Message
+	}
+	return sql, logged.Fields.Params, sql != ""
+}
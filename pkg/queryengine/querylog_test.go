@@ -0,0 +1,23 @@
+package queryengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueryLog(t *testing.T) {
+	sql, params, ok := parseQueryLog(`{"timestamp":"2023-01-05T10:00:00.000Z","level":"INFO","fields":{"message":"SELECT 1","item_type":"query","is_query":true,"query":"SELECT ` + "`main`.`User`.`id`" + ` FROM ` + "`main`.`User`" + ` WHERE 1=1 LIMIT ? OFFSET ?","params":"[-1,0]","duration_ms":0},"target":"quaint::connector::metrics"}`)
+	assert.True(t, ok)
+	assert.Equal(t, "SELECT `main`.`User`.`id` FROM `main`.`User` WHERE 1=1 LIMIT ? OFFSET ?", sql)
+	assert.Equal(t, "[-1,0]", params)
+
+	sql, _, ok = parseQueryLog(`{"level":"INFO","fields":{"message":"SELECT 1","item_type":"query","params":"[]"}}`)
+	assert.True(t, ok)
+	assert.Equal(t, "SELECT 1", sql)
+
+	_, _, ok = parseQueryLog(`{"level":"INFO","fields":{"message":"Started query engine http server on http://127.0.0.1:4467"}}`)
+	assert.False(t, ok)
+	_, _, ok = parseQueryLog("listening on 127.0.0.1:4467")
+	assert.False(t, ok)
+}
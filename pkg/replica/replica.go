@@ -0,0 +1,148 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/backup"
+
+	"golang.org/x/exp/slog"
+)
+
+// Swap replaces the served database. It must stop serving from the file,
+// call install to move the new generation in place and serve again.
+type Swap func(install func() error) error
+
+// Refresher keeps the SQLite file of a read replica at the latest generation
+// of its source, a snapshot as written by backup create. New generations are
+// downloaded next to the database and swapped in with a rename.
+type Refresher struct {
+	source   string
+	database string
+	keys     [][]byte
+	interval time.Duration
+
+	mu        sync.Mutex
+	served    backup.Generation
+	latest    backup.Generation
+	latestAt  time.Time // when latest was first seen
+	lastCheck time.Time
+	lastErr   string
+	refreshes int
+}
+
+// New returns a refresher downloading source, decrypted with keys, to
+// database every interval.
+func New(source, database string, keys [][]byte, interval time.Duration) *Refresher {
+	return &Refresher{source: source, database: database, keys: keys, interval: interval}
+}
+
+// Run refreshes the database every interval until ctx is done.
+func (r *Refresher) Run(ctx context.Context, swap Swap) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := r.Refresh(ctx, swap); err != nil && ctx.Err() == nil {
+			slog.Error("Refreshing replica", slog.String("source", r.source), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// Refresh downloads the latest generation if it isn't served yet and swaps
+// it in.
+func (r *Refresher) Refresh(ctx context.Context, swap Swap) (err error) {
+	defer func() {
+		r.mu.Lock()
+		r.lastCheck = time.Now()
+		r.lastErr = ""
+		if err != nil {
+			r.lastErr = err.Error()
+		}
+		r.mu.Unlock()
+	}()
+
+	latest, err := backup.Stat(ctx, r.source)
+	if err != nil {
+		return fmt.Errorf("stat source: %w", err)
+	}
+	r.mu.Lock()
+	if latest.ID != r.latest.ID {
+		r.latest, r.latestAt = latest, time.Now()
+	}
+	current := latest.ID == r.served.ID
+	r.mu.Unlock()
+	if current {
+		return nil
+	}
+
+	download := r.database + ".replica"
+	if err := backup.Download(ctx, r.source, download, r.keys); err != nil {
+		os.Remove(download)
+		return err
+	}
+	install := func() error {
+		if err := os.Rename(download, r.database); err != nil {
+			return err
+		}
+		// the journal files of the previous generation must not be applied
+		// to the new one
+		for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+			if err := os.Remove(r.database + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := swap(install); err != nil {
+		os.Remove(download)
+		return fmt.Errorf("swap database: %w", err)
+	}
+	r.mu.Lock()
+	r.served = latest
+	r.refreshes++
+	r.mu.Unlock()
+	slog.Info("Replica refreshed", slog.String("generation", latest.ID))
+	return nil
+}
+
+// Status describes the state of a replica.
+type Status struct {
+	// Generation is the generation served, empty before the first refresh.
+	Generation string
+	Latest     string
+	// Staleness is how long a newer generation than the one served has
+	// existed, zero when the latest is served.
+	Staleness time.Duration
+	LastCheck time.Time
+	LastError string
+	Refreshes int
+}
+
+// Status returns the current state of the replica.
+func (r *Refresher) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := Status{
+		Generation: r.served.ID,
+		Latest:     r.latest.ID,
+		LastCheck:  r.lastCheck,
+		LastError:  r.lastErr,
+		Refreshes:  r.refreshes,
+	}
+	if r.latest.ID != r.served.ID {
+		since := r.latestAt
+		if !r.latest.Modified.IsZero() && r.latest.Modified.Before(since) {
+			since = r.latest.Modified
+		}
+		status.Staleness = time.Since(since)
+	}
+	return status
+}
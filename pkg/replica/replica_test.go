@@ -0,0 +1,55 @@
+package replica
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefresh(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "snapshot.sqlite")
+	database := filepath.Join(dir, "db.sqlite")
+	require.NoError(t, os.WriteFile(source, []byte("first"), 0644))
+	require.NoError(t, os.WriteFile(database+"-wal", []byte("stale wal"), 0644))
+
+	swaps := 0
+	swap := func(install func() error) error {
+		swaps++
+		return install()
+	}
+	r := New(source, database, nil, time.Minute)
+	require.NoError(t, r.Refresh(context.Background(), swap))
+	data, err := os.ReadFile(database)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(data))
+	require.NoFileExists(t, database+"-wal")
+	status := r.Status()
+	require.NotEmpty(t, status.Generation)
+	require.Zero(t, status.Staleness)
+
+	require.NoError(t, r.Refresh(context.Background(), swap))
+	require.Equal(t, 1, swaps, "an unchanged source is not downloaded again")
+
+	// a newer generation that fails to install leaves the replica stale
+	modified := time.Now().Add(-time.Minute)
+	require.NoError(t, os.WriteFile(source, []byte("second"), 0644))
+	require.NoError(t, os.Chtimes(source, modified, modified))
+	require.Error(t, r.Refresh(context.Background(), func(func() error) error { return os.ErrPermission }))
+	status = r.Status()
+	require.NotEqual(t, status.Latest, status.Generation)
+	require.GreaterOrEqual(t, status.Staleness, time.Minute)
+	require.NotEmpty(t, status.LastError)
+	require.NoFileExists(t, database+".replica")
+
+	require.NoError(t, r.Refresh(context.Background(), swap))
+	data, err = os.ReadFile(database)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(data))
+	require.Zero(t, r.Status().Staleness)
+	require.Empty(t, r.Status().LastError)
+}
@@ -0,0 +1,202 @@
+// Package report sends error events to an external collector, such as a
+// Sentry store endpoint or any webhook accepting JSON.
+package report
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/tracing"
+
+	"golang.org/x/exp/slog"
+)
+
+// Event types reported by wunderbase.
+const (
+	EventPanic           = "panic"
+	EventEngineCrash     = "engine_crash"
+	EventMigrationFailed = "migration_failed"
+	EventLimitWarning    = "limit_warning"
+	EventStorageFailure  = "storage_failure"
+	EventSLOBurn         = "slo_burn"
+)
+
+// Event is an error worth alerting on.
+type Event struct {
+	Type      string
+	Message   string
+	Stack     string
+	RequestID string
+	// Level is the Sentry level, error if empty.
+	Level string
+	// Extra is sent as additional data of the event.
+	Extra map[string]string
+}
+
+// fingerprint groups events that are the same problem.
+func (e Event) fingerprint() string {
+	sum := sha256.Sum256([]byte(e.Type + "\x00" + e.Message))
+	return hex.EncodeToString(sum[:8])
+}
+
+// payload is a Sentry compatible event.
+type payload struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release"`
+	Message     string            `json:"message"`
+	Fingerprint []string          `json:"fingerprint"`
+	Tags        map[string]string `json:"tags"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+// Reporter posts events asynchronously. At most maxPerMinute events are sent
+// per minute and an event with the same fingerprint as one already sent in
+// the current minute is dropped, so a crash loop can't flood the collector.
+// A nil Reporter discards events.
+type Reporter struct {
+	url          string
+	maxPerMinute int
+	info         buildinfo.Info
+	client       *http.Client
+	queue        chan payload
+	done         chan struct{}
+
+	mu     sync.Mutex
+	minute int64
+	sent   int
+	seen   map[string]struct{}
+	closed bool
+}
+
+// New returns a Reporter posting to url. It returns nil if url is empty.
+func New(url string, maxPerMinute int, info buildinfo.Info) *Reporter {
+	if url == "" {
+		return nil
+	}
+	r := &Reporter{
+		url:          url,
+		maxPerMinute: maxPerMinute,
+		info:         info,
+		client:       &http.Client{Timeout: 5 * time.Second},
+		queue:        make(chan payload, 64),
+		done:         make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Report queues e for delivery. It never blocks.
+func (r *Reporter) Report(e Event) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	fingerprint := e.fingerprint()
+	p := payload{
+		EventID:     tracing.NewID(16),
+		Timestamp:   now.UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "wunderbase",
+		Release:     r.info.Version,
+		Message:     e.Message,
+		Fingerprint: []string{fingerprint},
+		Tags: map[string]string{
+			"event_type":   e.Type,
+			"commit":       r.info.Commit,
+			"go_version":   r.info.GoVersion,
+			"query_engine": r.info.QueryEngineVersion,
+		},
+	}
+	if e.RequestID != "" {
+		p.Tags["request_id"] = e.RequestID
+	}
+	if e.Level != "" {
+		p.Level = e.Level
+	}
+	if e.Stack != "" || len(e.Extra) > 0 {
+		p.Extra = map[string]string{}
+		for k, v := range e.Extra {
+			p.Extra[k] = v
+		}
+		if e.Stack != "" {
+			p.Extra["stack"] = e.Stack
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || !r.allow(fingerprint, now) {
+		return
+	}
+	select {
+	case r.queue <- p:
+	default:
+	}
+}
+
+// allow applies the rate limit, r.mu must be held.
+func (r *Reporter) allow(fingerprint string, now time.Time) bool {
+	if minute := now.Unix() / 60; minute != r.minute || r.seen == nil {
+		r.minute, r.sent, r.seen = minute, 0, map[string]struct{}{}
+	}
+	if _, ok := r.seen[fingerprint]; ok || r.sent >= r.maxPerMinute {
+		return false
+	}
+	r.seen[fingerprint] = struct{}{}
+	r.sent++
+	return true
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for p := range r.queue {
+		if err := r.post(p); err != nil {
+			slog.Warn("Sending error report", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (r *Reporter) post(p payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close delivers the queued events, waiting at most timeout.
+func (r *Reporter) Close(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+	}
+}
@@ -0,0 +1,54 @@
+package report
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"wunderbase/pkg/buildinfo"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []payload
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		mu.Lock()
+		received = append(received, p)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	r := New(collector.URL, 2, buildinfo.Info{Version: "v1.2.3", Commit: "abc"})
+	r.Report(Event{Type: EventPanic, Message: "boom", Stack: "main.go:1", RequestID: "req-1"})
+	r.Report(Event{Type: EventPanic, Message: "boom", RequestID: "req-2"})
+	r.Report(Event{Type: EventEngineCrash, Message: "exit status 1"})
+	r.Report(Event{Type: EventMigrationFailed, Message: "over the limit"})
+	r.Close(5 * time.Second)
+	r.Report(Event{Type: EventPanic, Message: "after close"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 2, "duplicate dropped, then rate limited")
+	assert.Equal(t, "boom", received[0].Message)
+	assert.Equal(t, "v1.2.3", received[0].Release)
+	assert.Equal(t, "req-1", received[0].Tags["request_id"])
+	assert.Equal(t, "main.go:1", received[0].Extra["stack"])
+	assert.Equal(t, EventEngineCrash, received[1].Tags["event_type"])
+}
+
+func TestNilReporter(t *testing.T) {
+	r := New("", 10, buildinfo.Info{})
+	assert.Nil(t, r)
+	r.Report(Event{Type: EventPanic})
+	r.Close(time.Second)
+}
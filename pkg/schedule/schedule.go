@@ -0,0 +1,239 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// Entry is a GraphQL operation run on a cron schedule.
+type Entry struct {
+	Name      string                 `yaml:"name"`
+	Cron      string                 `yaml:"cron"`
+	Query     string                 `yaml:"query"`
+	Variables map[string]interface{} `yaml:"variables"`
+	// KeepAwake lets runs reset the sleep timer, which they don't by
+	// default so a schedule doesn't keep an idle instance up.
+	KeepAwake bool `yaml:"keepAwake"`
+	// RateLimited makes runs take from the read and write limits like
+	// requests do, true if unset.
+	RateLimited *bool `yaml:"rateLimited"`
+	// Run, if set, is run instead of a GraphQL operation, for the jobs of
+	// wunderbase itself like verifying backups. Schedules files can't set
+	// it.
+	Run func(ctx context.Context) error `yaml:"-"`
+}
+
+// Limited reports whether runs of the entry count against the limits.
+func (e Entry) Limited() bool {
+	return e.RateLimited == nil || *e.RateLimited
+}
+
+// LoadFile reads the entries from a YAML file holding a list of them.
+func LoadFile(path string) ([]Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Exec runs the operation of an entry. Entries with a Run func are run
+// with it instead.
+type Exec func(ctx context.Context, entry Entry) error
+
+// Scheduler runs entries when their cron expression is due. A run that is
+// due while the previous run of the entry is still executing is skipped.
+type Scheduler struct {
+	entries []*scheduled
+}
+
+type scheduled struct {
+	Entry
+	cron Cron
+
+	mu           sync.Mutex
+	running      bool
+	next         time.Time
+	lastStart    time.Time
+	lastDuration time.Duration
+	lastErr      string
+	runs         int
+	failures     int
+	skipped      int
+}
+
+// New validates entries and returns a scheduler for them.
+func New(entries []Entry) (*Scheduler, error) {
+	s := &Scheduler{}
+	names := map[string]bool{}
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("entry %d: name is required", i+1)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("entry %s: duplicate name", e.Name)
+		}
+		names[e.Name] = true
+		if e.Query == "" && e.Run == nil {
+			return nil, fmt.Errorf("entry %s: query is required", e.Name)
+		}
+		cron, err := ParseCron(e.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: %w", e.Name, err)
+		}
+		if cron.Next(time.Now()).IsZero() {
+			return nil, fmt.Errorf("entry %s: cron %q never matches", e.Name, e.Cron)
+		}
+		s.entries = append(s.entries, &scheduled{Entry: e, cron: cron})
+	}
+	return s, nil
+}
+
+// Run executes due entries with exec until ctx is done and waits for the
+// runs in progress to return.
+func (s *Scheduler) Run(ctx context.Context, exec Exec) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	now := time.Now()
+	for _, e := range s.entries {
+		e.mu.Lock()
+		e.next = e.cron.Next(now)
+		e.mu.Unlock()
+	}
+	for {
+		next := s.next()
+		if next.IsZero() {
+			<-ctx.Done()
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.tick(ctx, time.Now(), exec, &wg)
+	}
+}
+
+// next returns the earliest time an entry is due.
+func (s *Scheduler) next() time.Time {
+	var next time.Time
+	for _, e := range s.entries {
+		e.mu.Lock()
+		if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+			next = e.next
+		}
+		e.mu.Unlock()
+	}
+	return next
+}
+
+// tick starts the entries due at now.
+func (s *Scheduler) tick(ctx context.Context, now time.Time, exec Exec, wg *sync.WaitGroup) {
+	for _, e := range s.entries {
+		e.mu.Lock()
+		if e.next.IsZero() || e.next.After(now) {
+			e.mu.Unlock()
+			continue
+		}
+		e.next = e.cron.Next(now)
+		if e.running {
+			e.skipped++
+			e.mu.Unlock()
+			slog.Warn("Skipping scheduled operation, the previous run is still executing", slog.String("schedule", e.Name))
+			continue
+		}
+		e.running = true
+		e.lastStart = now
+		e.mu.Unlock()
+
+		wg.Add(1)
+		go func(e *scheduled) {
+			defer wg.Done()
+			e.run(ctx, exec)
+		}(e)
+	}
+}
+
+func (e *scheduled) run(ctx context.Context, exec Exec) {
+	if e.Run != nil {
+		exec = func(ctx context.Context, _ Entry) error { return e.Run(ctx) }
+	}
+	start := time.Now()
+	err := exec(ctx, e.Entry)
+	took := time.Since(start)
+
+	e.mu.Lock()
+	e.running = false
+	e.lastDuration = took
+	e.runs++
+	e.lastErr = ""
+	if err != nil {
+		e.failures++
+		e.lastErr = err.Error()
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Scheduled operation failed", slog.String("schedule", e.Name), slog.Duration("duration", took), slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("Scheduled operation succeeded", slog.String("schedule", e.Name), slog.Duration("duration", took))
+}
+
+// Status describes an entry and its last run.
+type Status struct {
+	Name       string     `json:"name"`
+	Cron       string     `json:"cron"`
+	Running    bool       `json:"running"`
+	Next       *time.Time `json:"next,omitempty"`
+	LastRun    *time.Time `json:"lastRun,omitempty"`
+	DurationMs float64    `json:"durationMs,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+	Runs       int        `json:"runs"`
+	Failures   int        `json:"failures"`
+	// Skipped counts the runs skipped because the previous one was still
+	// executing.
+	Skipped int `json:"skipped"`
+}
+
+// Status returns the state of every entry.
+func (s *Scheduler) Status() []Status {
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		e.mu.Lock()
+		status := Status{
+			Name:       e.Name,
+			Cron:       e.Cron,
+			Running:    e.running,
+			DurationMs: float64(e.lastDuration.Microseconds()) / 1000,
+			LastError:  e.lastErr,
+			Runs:       e.runs,
+			Failures:   e.failures,
+			Skipped:    e.skipped,
+		}
+		if !e.next.IsZero() {
+			next := e.next.UTC()
+			status.Next = &next
+		}
+		if !e.lastStart.IsZero() {
+			last := e.lastStart.UTC()
+			status.LastRun = &last
+		}
+		e.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
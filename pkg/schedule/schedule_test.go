@@ -0,0 +1,134 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 10, 7, 30, 0, time.UTC)
+	for _, test := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 15, 0, 0, time.UTC)},
+		{"5 10-12 * * *", time.Date(2024, time.January, 31, 11, 5, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 3 29 feb *", time.Date(2024, time.February, 29, 3, 0, 0, 0, time.UTC)},
+		{"0 0 * * sun", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, time.February, 4, 0, 0, 0, 0, time.UTC)},
+		// restricted day of month and week match either
+		{"0 0 15 * mon", time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+	} {
+		c, err := ParseCron(test.expr)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, test.want, c.Next(from), test.expr)
+	}
+
+	never, err := ParseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	require.True(t, never.Next(from).IsZero())
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * * mon-", "*/0 * * * *", "5-1 * * * *", "@often"} {
+		_, err := ParseCron(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schedules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+- name: expire-sessions
+  cron: "*/5 * * * *"
+  query: |
+    mutation($before: DateTime) {
+      deleteManySession(where: {expires: {lt: $before}}) { count }
+    }
+  variables:
+    before: "2024-01-01T00:00:00Z"
+- name: warm
+  cron: "@hourly"
+  query: "{ findManyUser(take: 1) { id } }"
+  keepAwake: true
+  rateLimited: false
+`), 0644))
+	entries, err := LoadFile(path)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "2024-01-01T00:00:00Z", entries[0].Variables["before"])
+	require.True(t, entries[0].Limited())
+	require.False(t, entries[1].Limited())
+	require.True(t, entries[1].KeepAwake)
+	_, err = New(entries)
+	require.NoError(t, err)
+
+	_, err = New([]Entry{{Name: "a", Cron: "@daily", Query: "{ a }"}, {Name: "a", Cron: "@daily", Query: "{ a }"}})
+	require.Error(t, err)
+	_, err = New([]Entry{{Name: "a", Cron: "0 0 31 2 *", Query: "{ a }"}})
+	require.Error(t, err)
+}
+
+func TestSkipWhileRunning(t *testing.T) {
+	s, err := New([]Entry{{Name: "slow", Cron: "* * * * *", Query: "{ a }"}})
+	require.NoError(t, err)
+	now := time.Now()
+	s.entries[0].next = now
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	exec := func(ctx context.Context, e Entry) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	var wg sync.WaitGroup
+	s.tick(context.Background(), now, exec, &wg)
+	<-started
+	require.True(t, s.Status()[0].Running)
+
+	// due again while the first run executes
+	s.tick(context.Background(), now.Add(time.Minute), exec, &wg)
+	close(release)
+	wg.Wait()
+	require.Len(t, started, 0)
+
+	status := s.Status()[0]
+	require.False(t, status.Running)
+	require.Equal(t, 1, status.Runs)
+	require.Equal(t, 1, status.Skipped)
+	require.NotNil(t, status.LastRun)
+	require.True(t, status.Next.After(now.Add(time.Minute)))
+}
+
+func TestRunFunc(t *testing.T) {
+	_, err := New([]Entry{{Name: "job", Cron: "@daily"}})
+	require.Error(t, err, "an entry needs a query or a Run func")
+
+	ran := 0
+	s, err := New([]Entry{{Name: "job", Cron: "@daily", Run: func(ctx context.Context) error {
+		ran++
+		return errors.New("failed")
+	}}})
+	require.NoError(t, err)
+	now := time.Now()
+	s.entries[0].next = now
+
+	var wg sync.WaitGroup
+	s.tick(context.Background(), now, func(ctx context.Context, e Entry) error {
+		t.Error("entries with a Run func don't run a GraphQL operation")
+		return nil
+	}, &wg)
+	wg.Wait()
+	require.Equal(t, 1, ran)
+	status := s.Status()[0]
+	require.Equal(t, 1, status.Failures)
+	require.Equal(t, "failed", status.LastError)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/backup"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/schedule"
+)
+
+// BackupVerification configures restore tests of the latest backup on a
+// cron schedule, like backup verify does on demand.
+type BackupVerification struct {
+	// Cron is when the latest backup is checked for.
+	Cron string
+	// Sources are the backups the latest is picked from, as listed by
+	// backup.Snapshots.
+	Sources []string
+	// Options configure the checks, Source is set to the latest backup.
+	Options backup.VerifyOptions
+}
+
+// backupVerificationEntry is the name the verification runs under among
+// the schedules.
+const backupVerificationEntry = "backup-verification"
+
+// backupVerifier verifies each new backup once.
+type backupVerifier struct {
+	config BackupVerification
+	verify func(ctx context.Context, opts backup.VerifyOptions) (*backup.Report, error)
+
+	mu sync.Mutex
+	// verified is the generation of the last backup that passed
+	verified     backup.Snapshot
+	lastVerified time.Time
+}
+
+func newBackupVerifier(config BackupVerification) *backupVerifier {
+	return &backupVerifier{config: config, verify: backup.Verify}
+}
+
+func (v *backupVerifier) entry() schedule.Entry {
+	return schedule.Entry{Name: backupVerificationEntry, Cron: v.config.Cron, Run: v.run}
+}
+
+// run verifies the latest backup, unless it passed before. A backup that
+// fails is verified again on the next run.
+func (v *backupVerifier) run(ctx context.Context) error {
+	snapshots, err := backup.Snapshots(ctx, v.config.Sources)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return errors.New("no backups to verify")
+	}
+	latest := snapshots[len(snapshots)-1]
+	v.mu.Lock()
+	verified := v.verified
+	v.mu.Unlock()
+	if latest.Source == verified.Source && latest.ID == verified.ID {
+		return nil
+	}
+
+	opts := v.config.Options
+	opts.Source = latest.Source
+	report, err := v.verify(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", latest.Source, err)
+	}
+	if report.Failed() {
+		var failed []string
+		for _, check := range report.Checks {
+			if !check.OK {
+				failed = append(failed, fmt.Sprintf("%s: %s", check.Name, check.Detail))
+			}
+		}
+		return fmt.Errorf("backup %s failed verification: %s", latest.Source, strings.Join(failed, "; "))
+	}
+	v.mu.Lock()
+	v.verified = latest
+	v.lastVerified = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *backupVerifier) setGauges(registry *metrics.Registry) {
+	registry.GaugeFunc("wunderbase_backup_last_verified_timestamp_seconds", "Unix time the latest backup last passed verification, 0 before any did. It stays put while no new backup is written.",
+		func() float64 {
+			v.mu.Lock()
+			last := v.lastVerified
+			v.mu.Unlock()
+			if last.IsZero() {
+				return 0
+			}
+			return float64(last.UnixNano()) / 1e9
+		})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"wunderbase/pkg/migrate"
+
+	"golang.org/x/exp/slog"
+)
+
+// databaseKeyCheck is the query proving the key unlocks the database: the
+// first read of an encrypted database fails with a wrong key.
+const databaseKeyCheck = `{"query":"mutation { queryRaw(query: \"SELECT count(*) FROM sqlite_master\", parameters: \"[]\") }","variables":{}}`
+
+// useDatabaseKey writes a copy of the schema at schemaPath with the database
+// key into a directory only the owner can read, removed again by Shutdown,
+// and returns the copy's path.
+func (s *Server) useDatabaseKey(schemaPath string) (string, error) {
+	dir, err := ioutil.TempDir("", "wunderbase-key-")
+	if err != nil {
+		return "", err
+	}
+	s.cleanups = append(s.cleanups, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("remove keyed schema", slog.Any("err", err))
+		}
+	})
+	return migrate.WriteSchemaWithKey(schemaPath, s.config.DatabaseKey, dir)
+}
+
+// checkDatabaseKey runs a trivial query on the query engine to tell a
+// database the key doesn't unlock before the server is ready.
+func checkDatabaseKey(ctx context.Context, queryEngineURL, database string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, queryEngineURL, bytes.NewBufferString(databaseKeyCheck))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("wunderbase: check the database key: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Errors []struct {
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("wunderbase: check the database key: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("wunderbase: the database key doesn't unlock %s: %s", database, result.Errors[0].Error)
+	}
+	return nil
+}
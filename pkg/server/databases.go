@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/report"
+
+	"golang.org/x/exp/slog"
+)
+
+// newRouter migrates the databases and returns the router serving them.
+// Each gets a copy of its schema pointing at its SQLite file, a migration
+// lock next to that file and the query engine port QueryEnginePort plus its
+// position in the list. The schema copies are removed on stop.
+func (s *Server) newRouter(ctx context.Context) (*api.Router, error) {
+	config := s.config
+	var firstPort int
+	if config.QueryEnginePort != "" {
+		var err error
+		if firstPort, err = strconv.Atoi(config.QueryEnginePort); err != nil {
+			return nil, startError(StageConfig, "wunderbase: query engine port: %w", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "wunderbase-databases-")
+	if err != nil {
+		return nil, startError(StageStart, "wunderbase: databases: %w", err)
+	}
+	s.cleanups = append(s.cleanups, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("remove database schemas", slog.String("error", err.Error()))
+		}
+	})
+
+	var databases []api.Database
+	for i, spec := range config.Databases {
+		spec, port := spec, strconv.Itoa(firstPort+i)
+		if firstPort == 0 {
+			if port, err = freePort(); err != nil {
+				return nil, startError(StageStart, "wunderbase: database %s: query engine port: %w", spec.Name, err)
+			}
+		}
+		schemaDir := filepath.Join(dir, spec.Name)
+		if err := os.Mkdir(schemaDir, 0755); err != nil {
+			return nil, startError(StageStart, "wunderbase: database %s: %w", spec.Name, err)
+		}
+		schemaPath, err := migrate.WriteSchemaForDatabase(spec.SchemaPath, spec.DatabasePath, schemaDir)
+		if err != nil {
+			return nil, startError(StageStart, "wunderbase: database %s: %w", spec.Name, err)
+		}
+		lockPath := spec.DatabasePath + ".migration.lock"
+		err = Migrate(ctx, MigrateOptions{
+			MigrationEnginePath: config.MigrationEnginePath,
+			SchemaPath:          schemaPath,
+			LockPath:            lockPath,
+			EnableCDC:           config.API.EnableCDC,
+			SqlitePath:          config.API.SqlitePath,
+		})
+		var migrationErr *migrate.Error
+		if err != nil {
+			config.API.Reporter.Report(report.Event{Type: report.EventMigrationFailed, Message: spec.Name + ": " + err.Error()})
+			if !errors.As(err, &migrationErr) {
+				return nil, startError(StageMigrate, "wunderbase: database %s: %w", spec.Name, err)
+			}
+			slog.Error("Serving a database the schema failed to migrate", slog.String("database", spec.Name), slog.Any("migration", migrationErr))
+		}
+
+		handlerConfig := config.API
+		handlerConfig.QueryEngineURL = fmt.Sprintf("http://localhost:%s/", port)
+		handlerConfig.QueryEngineSdlURL = fmt.Sprintf("http://localhost:%s/sdl", port)
+		handlerConfig.QueryEngineDmmfURL = fmt.Sprintf("http://localhost:%s/dmmf", port)
+		handlerConfig.DatabaseFilePath = spec.DatabasePath
+		handlerConfig.HealthChecks = map[string]api.HealthCheck{
+			"migration": migrationHealth(lockPath, schemaPath, &migrationResult{err: migrationErr}),
+		}
+		handlerConfig.MigrationError = migrationErr
+		databases = append(databases, api.Database{
+			Name:   spec.Name,
+			Config: handlerConfig,
+			Start: func(exited func(err error)) (func(), error) {
+				engine := &engineProcess{
+					ctx:        ctx,
+					path:       config.QueryEnginePath,
+					port:       port,
+					schemaPath: schemaPath,
+					production: config.Production,
+					debug:      config.Debug,
+					onCrash: func(err error) {
+						config.API.Reporter.Report(report.Event{Type: report.EventEngineCrash, Message: spec.Name + ": " + err.Error()})
+						exited(err)
+					},
+				}
+				if err := engine.start(); err != nil {
+					return nil, err
+				}
+				return engine.stop, nil
+			},
+		})
+	}
+	slog.Info("Serving databases", slog.Int("count", len(databases)))
+	var sleepAfter time.Duration
+	if config.API.EnableSleepMode {
+		sleepAfter = time.Duration(config.API.SleepAfterSeconds) * time.Second
+	}
+	return api.NewRouter(api.RouterConfig{
+		Databases:       databases,
+		HealthEndpoint:  config.API.HealthEndpoint,
+		MetricsEndpoint: config.API.MetricsEndpoint,
+		Metrics:         config.API.Metrics,
+		AdminToken:      config.API.AdminToken,
+		SleepAfter:      sleepAfter,
+		PlainTextErrors: config.API.PlainTextErrors,
+	}), nil
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/cdc"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/queryengine"
+
+	"golang.org/x/exp/slog"
+)
+
+// engineProcess runs a query engine that can be stopped and started again,
+// as a replica does around swapping its database.
+type engineProcess struct {
+	ctx        context.Context
+	path       string
+	port       string
+	schemaPath string
+	production bool
+	debug      bool
+	onCrash    func(err error)
+
+	mu     sync.Mutex
+	cancel func()
+	wg     *sync.WaitGroup
+	// crashed receives the exit error if the engine started last exits on
+	// its own
+	crashed chan error
+	// parked is set while the engine is stopped for being idle
+	parked bool
+}
+
+func (e *engineProcess) start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ctx, cancel := context.WithCancel(e.ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	crashed := make(chan error, 1)
+	err := queryengine.Run(ctx, wg, e.path, e.port, e.schemaPath, e.production, e.debug, func(err error) {
+		crashed <- err
+		if e.onCrash != nil {
+			e.onCrash(err)
+		}
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	e.cancel, e.wg, e.crashed = cancel, wg, crashed
+	return nil
+}
+
+// exited returns the channel the exit error of the engine started last is
+// sent to if it exits on its own.
+func (e *engineProcess) exited() <-chan error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.crashed
+}
+
+// stop stops the engine and waits for it to exit.
+func (e *engineProcess) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.cancel == nil {
+		return
+	}
+	e.cancel()
+	e.wg.Wait()
+	e.cancel, e.wg = nil, nil
+}
+
+// park stops the engine for being idle, its health stays ok.
+func (e *engineProcess) park() {
+	e.stop()
+	e.mu.Lock()
+	e.parked = true
+	e.mu.Unlock()
+}
+
+// unpark starts the engine stopped by park.
+func (e *engineProcess) unpark() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.parked = false
+	e.mu.Unlock()
+	return nil
+}
+
+// checkpoint moves the WAL of database into the database file once the
+// engine is stopped, so an idle instance leaves a single file behind. It is
+// best effort: the WAL is replayed on the next start anyway.
+func checkpoint(ctx context.Context, sqlitePath, database string) {
+	if sqlitePath == "" || database == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, sqlitePath, "-batch", "-cmd", ".timeout 5000", database, "PRAGMA wal_checkpoint(TRUNCATE);").CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		slog.Debug("Not checkpointing the WAL of the idle database, the sqlite3 CLI is missing", slog.String("sqlite", sqlitePath))
+		return
+	}
+	if err != nil {
+		slog.Warn("Checkpointing the WAL of the idle database", slog.String("error", err.Error()), slog.String("output", strings.TrimSpace(string(out))))
+	}
+}
+
+// WaitForEngine blocks until the query engine answers or ctx is done.
+func WaitForEngine(ctx context.Context, queryEngineURL string) error {
+	return waitForEngine(ctx, queryEngineURL, 50*time.Millisecond, nil)
+}
+
+// waitForEngine probes the query engine every interval until it answers or
+// ctx is done. It fails right away with the error received from exited,
+// an engine refusing the schema doesn't answer until the startup timeout.
+func waitForEngine(ctx context.Context, queryEngineURL string, interval time.Duration, exited <-chan error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-exited:
+			return fmt.Errorf("wunderbase: query engine exited while starting: %w", err)
+		case <-ticker.C:
+		}
+		resp, err := http.Get(queryEngineURL)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+}
+
+// health reports the query engine process, complementing the probe of the
+// handler. An engine parked for being idle is healthy.
+func (e *engineProcess) health() api.ComponentHealth {
+	e.mu.Lock()
+	parked := e.parked
+	e.mu.Unlock()
+	status := queryengine.CurrentStatus()
+	if parked {
+		return api.ComponentHealth{Status: api.HealthOK, Details: map[string]interface{}{"state": "idle"}}
+	}
+	health := api.ComponentHealth{Status: api.HealthOK, Details: map[string]interface{}{
+		"state": status.State,
+		"pid":   status.PID,
+	}}
+	if !status.Started.IsZero() {
+		health.Details["uptimeSeconds"] = time.Since(status.Started).Seconds()
+	}
+	if status.State != "running" {
+		health.Status = api.HealthFailing
+		health.Details["error"] = status.Err
+	}
+	return health
+}
+
+// externalEngineHealth reports a query engine run by another supervisor.
+// Whether it answers is up to the probe of the handler.
+func externalEngineHealth(engineURL string) api.HealthCheck {
+	// the url may carry credentials
+	if u, err := url.Parse(engineURL); err == nil {
+		engineURL = u.Redacted()
+	}
+	return func() api.ComponentHealth {
+		return api.ComponentHealth{Status: api.HealthOK, Details: map[string]interface{}{
+			"managed": "external",
+			"url":     engineURL,
+		}}
+	}
+}
+
+// migrationResult is the error the latest migration was rejected with,
+// replaced by live migrations.
+type migrationResult struct {
+	mu  sync.Mutex
+	err *migrate.Error
+}
+
+func (m *migrationResult) set(err *migrate.Error) {
+	m.mu.Lock()
+	m.err = err
+	m.mu.Unlock()
+}
+
+func (m *migrationResult) get() *migrate.Error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// migrationHealth reports whether the schema served was migrated. It fails
+// if the latest migration failed.
+func migrationHealth(lockPath, schemaPath string, result *migrationResult) api.HealthCheck {
+	return func() api.ComponentHealth {
+		if failed := result.get(); failed != nil {
+			return api.ComponentHealth{Status: api.HealthFailing, Details: map[string]interface{}{"error": failed.Error(), "isPanic": failed.IsPanic}}
+		}
+		schema, err := ioutil.ReadFile(schemaPath)
+		if err != nil {
+			return api.ComponentHealth{Status: api.HealthFailing, Details: map[string]interface{}{"error": err.Error()}}
+		}
+		matches, lastRun, err := migrate.LockStatus(lockPath, string(schema))
+		if err != nil {
+			return api.ComponentHealth{Status: api.HealthFailing, Details: map[string]interface{}{"error": err.Error()}}
+		}
+		health := api.ComponentHealth{Status: api.HealthOK, Details: map[string]interface{}{"lockMatchesSchema": matches}}
+		if !lastRun.IsZero() {
+			health.Details["lastRun"] = lastRun.UTC()
+		}
+		if !matches {
+			// the engine serves the schema, but the database may lag behind
+			health.Status = api.HealthDegraded
+		}
+		return health
+	}
+}
+
+// MigrateOptions configure Migrate.
+type MigrateOptions struct {
+	MigrationEnginePath string
+	SchemaPath          string
+	// LockPath records the last migrated schema, a schema matching it is
+	// not migrated again.
+	LockPath string
+	// EnableCDC installs the change feed table and triggers after
+	// migrating.
+	EnableCDC  bool
+	SqlitePath string
+	// DatabaseKey is passed to the migration engine in the datasource url
+	// of a copy of the schema, removed afterwards.
+	DatabaseKey string
+	// InitSQLFile is an SQL dump the database is created from if it
+	// doesn't exist, before migrating. It can't be combined with
+	// DatabaseKey.
+	InitSQLFile string
+	// ForceInit creates the database from InitSQLFile even if it exists,
+	// after moving it aside.
+	ForceInit bool
+}
+
+// Migrate migrates the database of the schema. The change feed is installed
+// again afterwards, since the migration engine drops what the schema
+// doesn't declare; its cursors keep increasing.
+func Migrate(ctx context.Context, opts MigrateOptions) error {
+	if opts.DatabaseKey != "" {
+		dir, err := ioutil.TempDir("", "wunderbase-key-")
+		if err != nil {
+			return fmt.Errorf("wunderbase: write keyed schema: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		if opts.SchemaPath, err = migrate.WriteSchemaWithKey(opts.SchemaPath, opts.DatabaseKey, dir); err != nil {
+			return fmt.Errorf("wunderbase: write keyed schema: %w", err)
+		}
+	}
+	schema, err := ioutil.ReadFile(opts.SchemaPath)
+	if err != nil {
+		return fmt.Errorf("wunderbase: load prisma schema: %w", err)
+	}
+	ds, err := migrate.ParseDatasource(schema, opts.SchemaPath)
+	if err != nil {
+		return fmt.Errorf("wunderbase: load prisma schema: %w", err)
+	}
+	database := ds.File
+	if opts.InitSQLFile != "" {
+		if err := initDatabase(ctx, opts, database); err != nil {
+			return err
+		}
+	}
+	var head int64
+	if opts.EnableCDC {
+		if head, err = cdc.Head(ctx, opts.SqlitePath, database); err != nil {
+			return fmt.Errorf("wunderbase: read change feed head: %w", err)
+		}
+	}
+	if err := migrate.Database(opts.MigrationEnginePath, opts.LockPath, string(schema), opts.SchemaPath); err != nil {
+		return fmt.Errorf("wunderbase: migrate: %w", err)
+	}
+	if opts.EnableCDC {
+		if err := cdc.Install(ctx, opts.SqlitePath, database, head); err != nil {
+			return fmt.Errorf("wunderbase: install change feed: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkSchemaDrift compares the database with the schema served, like
+// migrate status, and reports the result to h.
+func (s *Server) checkSchemaDrift(h *api.Handler) {
+	start := time.Now()
+	drift, summary, err := migrate.Drift(s.ctx, s.config.MigrationEnginePath, s.schemaPath)
+	if s.ctx.Err() != nil {
+		return
+	}
+	h.SetSchemaDrift(drift, summary, err)
+	switch {
+	case err != nil:
+		slog.Warn("Could not compare the database with the schema", slog.String("error", err.Error()))
+	case drift:
+		slog.Warn("SCHEMA DRIFT: the database differs from the schema, run wunderbase migrate or check where the database came from",
+			slog.String("differences", summary), slog.Bool("writesRefused", s.config.API.RefuseWritesOnSchemaDrift))
+	default:
+		slog.Debug("The database matches the schema", slog.Duration("took", time.Since(start)))
+	}
+}
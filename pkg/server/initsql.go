@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"wunderbase/pkg/migrate"
+
+	"golang.org/x/exp/slog"
+)
+
+// initDatabase creates database, the file of the schema's datasource, from
+// opts.InitSQLFile if it doesn't exist, or over it with opts.ForceInit, and
+// compares it with the schema before it is migrated, warning about the
+// differences the migration is about to change.
+func initDatabase(ctx context.Context, opts MigrateOptions, database string) error {
+	if _, err := os.Stat(database); err == nil {
+		if !opts.ForceInit {
+			slog.Info("The database exists, the init SQL file isn't imported", slog.String("database", database), slog.String("file", opts.InitSQLFile))
+			return nil
+		}
+		moved := fmt.Sprintf("%s.pre-init-%s", database, time.Now().UTC().Format("20060102T150405Z"))
+		for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+			if err := os.Rename(database+suffix, moved+suffix); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("wunderbase: move the database aside: %w", err)
+			}
+		}
+		slog.Warn("Moved the database aside to create it again from the init SQL file", slog.String("database", database), slog.String("movedTo", moved))
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("wunderbase: init database: %w", err)
+	}
+
+	start := time.Now()
+	statements, err := migrate.Import(ctx, opts.SqlitePath, database, opts.InitSQLFile)
+	if err != nil {
+		return fmt.Errorf("wunderbase: init database: %w", err)
+	}
+	slog.Info("Created the database from the init SQL file", slog.String("database", database), slog.String("file", opts.InitSQLFile),
+		slog.Int("statements", statements), slog.Duration("took", time.Since(start)))
+	// the lock file of another database would skip the migration
+	if err := os.Remove(opts.LockPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("wunderbase: remove lock file: %w", err)
+	}
+
+	drift, summary, err := migrate.Drift(ctx, opts.MigrationEnginePath, opts.SchemaPath)
+	switch {
+	case err != nil:
+		slog.Warn("Could not compare the imported database with the schema", slog.String("error", err.Error()))
+	case drift:
+		slog.Warn("The imported database differs from the schema, the migration changes it to match and may drop data the schema doesn't declare",
+			slog.String("differences", summary))
+	default:
+		slog.Info("The imported database matches the schema")
+	}
+	return nil
+}
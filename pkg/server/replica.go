@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/replica"
+)
+
+// replicaRefresher is a refresher with the interval health is judged by.
+type replicaRefresher struct {
+	*replica.Refresher
+	interval time.Duration
+}
+
+// newReplica downloads the latest generation of the replica source to
+// database and returns the refresher keeping it current.
+func newReplica(ctx context.Context, config *Replica, database string) (*replicaRefresher, error) {
+	refresher := replica.New(config.Source, database, config.Keys, config.Refresh)
+	// nothing serves the file yet, it can be replaced right away
+	err := refresher.Refresh(ctx, func(install func() error) error { return install() })
+	if err != nil {
+		return nil, fmt.Errorf("wunderbase: download replica: %w", err)
+	}
+	return &replicaRefresher{Refresher: refresher, interval: config.Refresh}, nil
+}
+
+// replicaSwap pauses the handler and restarts the query engine around
+// installing a new generation, warming it up before serving again. The engine is restarted even if installing
+// failed, to keep serving the previous one.
+func replicaSwap(ctx context.Context, handler *api.Handler, engine *engineProcess, engineURL string) replica.Swap {
+	return func(install func() error) error {
+		handler.Pause()
+		defer handler.Resume()
+		engine.stop()
+		installErr := install()
+		if err := engine.start(); err != nil {
+			return fmt.Errorf("restart query engine: %w", err)
+		}
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		if err := WaitForEngine(ctx, engineURL); err != nil {
+			return fmt.Errorf("query engine not ready: %w", err)
+		}
+		handler.WarmUp(ctx)
+		return installErr
+	}
+}
+
+// health degrades when the replica falls more than three refresh intervals
+// behind or can't reach its source.
+func (r *replicaRefresher) health() api.ComponentHealth {
+	status := r.Status()
+	health := api.ComponentHealth{Status: api.HealthOK, Details: map[string]interface{}{
+		"generation":       status.Generation,
+		"latestGeneration": status.Latest,
+		"stalenessSeconds": status.Staleness.Seconds(),
+		"refreshes":        status.Refreshes,
+		"lastCheck":        status.LastCheck.UTC(),
+	}}
+	if status.LastError != "" {
+		health.Details["error"] = status.LastError
+	}
+	switch {
+	case status.Generation == "":
+		health.Status = api.HealthFailing
+	case status.LastError != "", status.Staleness > 3*r.interval:
+		health.Status = api.HealthDegraded
+	}
+	return health
+}
+
+func (r *replicaRefresher) setGauges(registry *metrics.Registry) {
+	registry.GaugeFunc("wunderbase_replica_staleness_seconds", "Seconds a newer generation of the replica source than the one served has existed, 0 when current.",
+		func() float64 { return r.Status().Staleness.Seconds() })
+	registry.GaugeFunc("wunderbase_replica_last_check_timestamp_seconds", "Unix time of the last check of the replica source.",
+		func() float64 {
+			last := r.Status().LastCheck
+			if last.IsZero() {
+				return 0
+			}
+			return float64(last.UnixNano()) / 1e9
+		})
+}
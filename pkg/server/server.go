@@ -0,0 +1,787 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/branch"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/queryengine"
+	"wunderbase/pkg/report"
+	"wunderbase/pkg/schedule"
+
+	"golang.org/x/exp/slog"
+)
+
+// Config configures a Server. It is a plain struct: reading it from env
+// vars, flags and config files is up to the caller.
+type Config struct {
+	// SchemaPath is the Prisma schema served. Its datasource names the
+	// SQLite file. It is unused when Databases is set.
+	SchemaPath string
+	// Databases are served under /t/{name}/ instead of the schema's
+	// database, each by its own query engine started on demand. They are
+	// always migrated.
+	Databases           []Database
+	QueryEnginePath     string
+	MigrationEnginePath string
+	// QueryEnginePort is the port of the query engine. With Databases the
+	// engines listen on it and the following ports. Empty picks free ports.
+	QueryEnginePort string
+	// ExternalQueryEngineURL is a query engine run by another supervisor,
+	// served instead of starting one. The server only probes it: it isn't
+	// restarted, stopped when idle or for live migrations. It can't be
+	// combined with Databases, Ephemeral, Replica or TimeTravel.
+	ExternalQueryEngineURL string
+	// Listener serves the API if set, otherwise ListenAddr is bound,
+	// 127.0.0.1:0 if empty.
+	Listener   net.Listener
+	ListenAddr string
+	// Migrate migrates the database before serving it.
+	Migrate bool
+	// MigrationLockFilePath records the last migrated schema, next to the
+	// database if empty.
+	MigrationLockFilePath string
+	// Ephemeral serves a temporary copy of the database, removed again by
+	// Shutdown.
+	Ephemeral  bool
+	Production bool
+	Debug      bool
+	// DatabaseKey is the key of a database encrypted with SQLCipher, added
+	// to the datasource url the query and migration engines read. Ready
+	// fails if it doesn't unlock the database. It can't be combined with
+	// Databases.
+	DatabaseKey string
+	// API configures the handler. The server fills in the query engine
+	// URLs, the database file and the health checks. Zero limits and an
+	// empty health endpoint take the defaults of the serve command.
+	API api.Config
+	// Management configures the handler of a second endpoint on the same
+	// query engine, bound to ManagementListenAddr or served on
+	// ManagementListener, like an internal API next to the public one.
+	// The server fills in the query engine URLs and the database file, and
+	// the handler shares the state of the API handler, see api.Config.Shared.
+	// Nil disables it, it can't be combined with Databases.
+	Management           *api.Config
+	ManagementListenAddr string
+	ManagementListener   net.Listener
+	// Replica serves a read-only replica refreshed from a snapshot if set.
+	Replica *Replica
+	// TimeTravel serves reads of past states of the database on backups if
+	// set, it can't be combined with Databases.
+	TimeTravel *TimeTravel
+	// SchemaDriftCheck compares the database with the schema in the
+	// background once Ready, and again after live migrations, with the
+	// migration engine. Differences are logged as a warning and reported by
+	// the handler, see api.Handler.SetSchemaDrift. It is skipped with
+	// Databases.
+	SchemaDriftCheck bool
+	// Schedules are GraphQL operations run on cron schedules.
+	Schedules []schedule.Entry
+	// BackupVerification restore-tests the latest backup on a cron
+	// schedule if set, it runs among the Schedules and can't be combined
+	// with Databases.
+	BackupVerification *BackupVerification
+	// Phase, if set, is called when startup enters a phase. An error
+	// aborts Start.
+	Phase func(name string) error
+}
+
+// Database is a database served next to others.
+type Database struct {
+	Name         string
+	SchemaPath   string
+	DatabasePath string
+}
+
+// Replica configures the read replica mode.
+type Replica struct {
+	// Source is the snapshot written by backup create.
+	Source string
+	// Keys decrypt the snapshot.
+	Keys    [][]byte
+	Refresh time.Duration
+}
+
+// Stage tells which part of starting a server failed.
+type Stage int
+
+const (
+	StageConfig Stage = iota
+	StageListen
+	StageMigrate
+	StageStart
+)
+
+// StartError is returned by Start, so callers can tell a taken port from a
+// failed migration.
+type StartError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *StartError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StartError) Unwrap() error {
+	return e.Err
+}
+
+func startError(stage Stage, format string, args ...interface{}) error {
+	return &StartError{Stage: stage, Err: fmt.Errorf(format, args...)}
+}
+
+// Server runs the query engines and serves the API in process.
+type Server struct {
+	config    Config
+	scheduler *schedule.Scheduler
+
+	listener  net.Listener
+	handler   interface{ Reload(api.Config) }
+	router    *api.Router
+	engine    *engineProcess
+	engineURL string
+	http      *http.Server
+	cancel    func()
+	done      <-chan struct{}
+	// slept is set once the server stopped to sleep, accessed atomically
+	slept int32
+	// management serves the management endpoint, nil without it
+	management         *http.Server
+	managementListener net.Listener
+	// databasePath is the SQLite file served, empty with Databases
+	databasePath string
+	// ctx is done once the server stops, schemaPath is the schema the
+	// engine serves
+	ctx        context.Context
+	schemaPath string
+	// wg tracks the goroutines stopped by cancel
+	wg       sync.WaitGroup
+	cleanups []func()
+}
+
+// New validates config and returns a server that is not started yet.
+func New(config Config) (*Server, error) {
+	if config.SchemaPath == "" && len(config.Databases) == 0 {
+		return nil, errors.New("wunderbase: server: a schema or databases are required")
+	}
+	if config.Ephemeral && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: an ephemeral database can't be combined with several databases")
+	}
+	if config.Replica != nil && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: a replica can't be combined with several databases")
+	}
+	if config.Management != nil && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: a management endpoint can't be combined with several databases")
+	}
+	if config.DatabaseKey != "" && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: a database key can't be combined with several databases")
+	}
+	if config.TimeTravel != nil {
+		if len(config.Databases) > 0 {
+			return nil, errors.New("wunderbase: server: time travel can't be combined with several databases")
+		}
+		if config.TimeTravel.MaxEngines <= 0 || config.TimeTravel.CacheBytes <= 0 {
+			return nil, errors.New("wunderbase: server: time travel needs a maximum of engines and a cache size")
+		}
+	}
+	if config.ExternalQueryEngineURL != "" {
+		switch {
+		case len(config.Databases) > 0:
+			return nil, errors.New("wunderbase: server: an external query engine can't be combined with several databases")
+		case config.Ephemeral:
+			return nil, errors.New("wunderbase: server: an external query engine can't serve an ephemeral database")
+		case config.Replica != nil:
+			return nil, errors.New("wunderbase: server: an external query engine can't be combined with a replica")
+		case config.TimeTravel != nil:
+			return nil, errors.New("wunderbase: server: an external query engine can't be combined with time travel")
+		case config.API.EngineIdleAfter > 0:
+			return nil, errors.New("wunderbase: server: an external query engine isn't stopped when idle")
+		}
+	}
+	if len(config.Schedules) > 0 && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: schedules can't be combined with several databases")
+	}
+	if config.BackupVerification != nil && len(config.Databases) > 0 {
+		return nil, errors.New("wunderbase: server: backup verification can't be combined with several databases")
+	}
+	if config.API.ReadLimitSeconds == 0 {
+		config.API.ReadLimitSeconds = 10000
+	}
+	if config.API.WriteLimitSeconds == 0 {
+		config.API.WriteLimitSeconds = 2000
+	}
+	if config.API.HealthEndpoint == "" {
+		config.API.HealthEndpoint = "/health"
+	}
+	if config.API.Metrics == nil {
+		config.API.Metrics = metrics.NewRegistry()
+	}
+	if config.Phase == nil {
+		config.Phase = func(string) error { return nil }
+	}
+	s := &Server{config: config}
+	entries := config.Schedules
+	if config.BackupVerification != nil {
+		verifier := newBackupVerifier(*config.BackupVerification)
+		verifier.setGauges(config.API.Metrics)
+		entries = append(append([]schedule.Entry(nil), entries...), verifier.entry())
+	}
+	if len(entries) > 0 {
+		scheduler, err := schedule.New(entries)
+		if err != nil {
+			return nil, fmt.Errorf("wunderbase: server: schedules: %w", err)
+		}
+		s.scheduler = scheduler
+	}
+	return s, nil
+}
+
+// Start binds the listener, starts the query engine and serves requests in
+// the background. It doesn't wait for the engine to answer, see Ready. The
+// listener is only served once the handler is built, connections arriving
+// earlier wait in its backlog. The server stops when ctx is done, when it
+// goes to sleep or on Shutdown.
+func (s *Server) Start(ctx context.Context) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.ctx, s.cancel, s.done = ctx, cancel, ctx.Done()
+	defer func() {
+		if err != nil {
+			s.stop()
+		}
+	}()
+	config := s.config
+
+	schemaPath := config.SchemaPath
+	if config.Ephemeral {
+		if err := config.Phase("ephemeral database"); err != nil {
+			return err
+		}
+		if schemaPath, err = s.useEphemeralDatabase(); err != nil {
+			return startError(StageStart, "wunderbase: ephemeral database: %w", err)
+		}
+	}
+	if config.DatabaseKey != "" {
+		if schemaPath, err = s.useDatabaseKey(schemaPath); err != nil {
+			return startError(StageConfig, "wunderbase: database key: %w", err)
+		}
+	}
+
+	if err := config.Phase("listen"); err != nil {
+		return err
+	}
+	// bind before starting the engine so a taken port fails fast
+	s.listener = config.Listener
+	if s.listener == nil {
+		addr := config.ListenAddr
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		if s.listener, err = net.Listen("tcp", addr); err != nil {
+			return startError(StageListen, "wunderbase: listen: %w", err)
+		}
+	}
+	if config.Management != nil {
+		s.managementListener = config.ManagementListener
+		if s.managementListener == nil {
+			addr := config.ManagementListenAddr
+			if addr == "" {
+				addr = "127.0.0.1:0"
+			}
+			if s.managementListener, err = net.Listen("tcp", addr); err != nil {
+				return startError(StageListen, "wunderbase: listen management: %w", err)
+			}
+		}
+	}
+
+	if config.API.IndexAdvice {
+		// the statements the engines log are matched to the slow requests
+		queryengine.SetQueryObserver(api.ObserveQuery)
+	}
+	var handler http.Handler
+	if len(config.Databases) > 0 {
+		if err := config.Phase("migrate databases"); err != nil {
+			return err
+		}
+		if s.router, err = s.newRouter(ctx); err != nil {
+			return err
+		}
+		handler, s.handler = s.router, s.router
+	} else {
+		h, err := s.startEngine(ctx, schemaPath)
+		if err != nil {
+			return err
+		}
+		handler, s.handler = h, h
+	}
+
+	s.http = &http.Server{Handler: handler}
+	if streams, ok := handler.(interface{ CloseStreams() }); ok {
+		s.http.RegisterOnShutdown(streams.CloseStreams)
+	}
+	go func() {
+		if err := s.http.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Serving", slog.String("error", err.Error()))
+			s.cancel()
+		}
+	}()
+	if s.management != nil {
+		go func() {
+			if err := s.management.Serve(s.managementListener); err != nil && err != http.ErrServerClosed {
+				slog.Error("Serving the management endpoint", slog.String("error", err.Error()))
+				s.cancel()
+			}
+		}()
+	}
+	return nil
+}
+
+// startEngine migrates and downloads the database as configured, starts its
+// query engine and returns the handler serving it.
+func (s *Server) startEngine(ctx context.Context, schemaPath string) (*api.Handler, error) {
+	config := s.config
+	databasePath, err := migrate.DatabaseFilePath(schemaPath)
+	if err != nil {
+		return nil, startError(StageConfig, "wunderbase: resolve database path: %w", err)
+	}
+	lockPath := config.MigrationLockFilePath
+	if lockPath == "" {
+		lockPath = databasePath + ".migration.lock"
+	}
+	var migrationErr *migrate.Error
+	if config.Migrate {
+		if err := config.Phase("migrate"); err != nil {
+			return nil, err
+		}
+		err := Migrate(ctx, MigrateOptions{
+			MigrationEnginePath: config.MigrationEnginePath,
+			SchemaPath:          schemaPath,
+			LockPath:            lockPath,
+			EnableCDC:           config.API.EnableCDC,
+			SqlitePath:          config.API.SqlitePath,
+		})
+		if err != nil {
+			config.API.Reporter.Report(report.Event{Type: report.EventMigrationFailed, Message: err.Error()})
+			if !errors.As(err, &migrationErr) {
+				return nil, &StartError{Stage: StageMigrate, Err: err}
+			}
+			// the engine rejected the schema: serve anyway so the error
+			// can be read on /admin/migration
+			slog.Error("Serving a database the schema failed to migrate", slog.Any("migration", migrationErr))
+		}
+	}
+
+	var refresher *replicaRefresher
+	if config.Replica != nil {
+		if err := config.Phase("download replica"); err != nil {
+			return nil, err
+		}
+		if refresher, err = newReplica(ctx, config.Replica, databasePath); err != nil {
+			return nil, &StartError{Stage: StageStart, Err: err}
+		}
+	}
+
+	if config.ExternalQueryEngineURL != "" {
+		s.engineURL = strings.TrimSuffix(config.ExternalQueryEngineURL, "/") + "/"
+	} else {
+		if err := config.Phase("start query engine"); err != nil {
+			return nil, err
+		}
+		port := config.QueryEnginePort
+		if port == "" {
+			if port, err = freePort(); err != nil {
+				return nil, startError(StageStart, "wunderbase: query engine port: %w", err)
+			}
+		}
+		s.engine = &engineProcess{
+			ctx:        ctx,
+			path:       config.QueryEnginePath,
+			port:       port,
+			schemaPath: schemaPath,
+			production: config.Production,
+			debug:      config.Debug,
+			onCrash: func(err error) {
+				config.API.Reporter.Report(report.Event{Type: report.EventEngineCrash, Message: err.Error()})
+			},
+		}
+		if err := s.engine.start(); err != nil {
+			return nil, startError(StageStart, "wunderbase: run query engine: %w", err)
+		}
+		s.engineURL = fmt.Sprintf("http://localhost:%s/", port)
+	}
+
+	handlerConfig := config.API
+	handlerConfig.QueryEngineURL = s.engineURL
+	handlerConfig.QueryEngineSdlURL = s.engineURL + "sdl"
+	handlerConfig.QueryEngineDmmfURL = s.engineURL + "dmmf"
+	handlerConfig.DatabaseFilePath = databasePath
+	s.databasePath, s.schemaPath = databasePath, schemaPath
+	if s.engine != nil {
+		handlerConfig.HealthChecks = map[string]api.HealthCheck{"query_engine": s.engine.health}
+		handlerConfig.RestartEngine = s.restartEngine
+	} else {
+		// the handler probes it like the engines it starts
+		handlerConfig.HealthChecks = map[string]api.HealthCheck{"query_engine": externalEngineHealth(s.engineURL)}
+	}
+	if handlerConfig.EngineIdleAfter > 0 {
+		handlerConfig.StopEngine = func() {
+			s.engine.park()
+			checkpoint(ctx, config.API.SqlitePath, databasePath)
+		}
+		handlerConfig.StartEngine = s.engine.unpark
+	}
+	if refresher != nil {
+		// replicas are not migrated, the primary is
+		handlerConfig.HealthChecks["replica"] = refresher.health
+		handlerConfig.ReplicaStaleness = func() time.Duration { return refresher.Status().Staleness }
+		handlerConfig.ReadOnly = true
+		refresher.setGauges(handlerConfig.Metrics)
+	} else {
+		// the configured schema, not an ephemeral copy
+		result := &migrationResult{err: migrationErr}
+		handlerConfig.HealthChecks["migration"] = migrationHealth(lockPath, config.SchemaPath, result)
+		if s.engine != nil {
+			// an external engine wouldn't read the migrated schema
+			handlerConfig.Migrate = func(ctx context.Context) error {
+				return s.migrateLive(ctx, schemaPath, databasePath, lockPath, result)
+			}
+		}
+	}
+	handlerConfig.MigrationError = migrationErr
+	if config.TimeTravel != nil {
+		traveler, err := s.newTimeTraveler(ctx, schemaPath)
+		if err != nil {
+			return nil, startError(StageStart, "wunderbase: time travel: %w", err)
+		}
+		handlerConfig.TimeTravel = traveler.engine
+	}
+	for name, check := range config.API.HealthChecks {
+		handlerConfig.HealthChecks[name] = check
+	}
+	handlerConfig.Schedules = s.scheduler
+	h := api.NewHandler(handlerConfig, s.sleep)
+	s.cleanups = append(s.cleanups, h.Close)
+	if config.Management != nil {
+		managementConfig := *config.Management
+		managementConfig.QueryEngineURL = handlerConfig.QueryEngineURL
+		managementConfig.QueryEngineSdlURL = handlerConfig.QueryEngineSdlURL
+		managementConfig.QueryEngineDmmfURL = handlerConfig.QueryEngineDmmfURL
+		managementConfig.DatabaseFilePath = databasePath
+		managementConfig.ReadOnly = handlerConfig.ReadOnly
+		managementConfig.Shared = h
+		management := api.NewHandler(managementConfig, s.sleep)
+		s.cleanups = append(s.cleanups, management.Close)
+		s.management = &http.Server{Handler: management}
+	}
+
+	if refresher != nil {
+		s.goRun(func() { refresher.Run(ctx, replicaSwap(ctx, h, s.engine, s.engineURL)) })
+	}
+	if s.scheduler != nil {
+		s.goRun(func() { s.scheduler.Run(ctx, executeScheduled(h)) })
+	}
+	return h, nil
+}
+
+func (s *Server) goRun(f func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+}
+
+// Ready blocks until the query engine answers and is warmed up, or ctx is
+// done. It fails early if the engine exits first, like when it refuses the
+// schema, if the database key doesn't unlock the database, and if the auth
+// rules or the hidden models and fields name models the schema doesn't
+// have. An external query engine is waited for until it answers.
+// Databases served next to others start on their first request, so with
+// Databases it returns right away.
+func (s *Server) Ready(ctx context.Context) error {
+	if s.router != nil {
+		return nil
+	}
+	interval := s.config.API.EngineConnectBackoff
+	if interval <= 0 {
+		interval = 50 * time.Millisecond
+	}
+	var exited <-chan error
+	if s.engine != nil {
+		exited = s.engine.exited()
+	}
+	if err := waitForEngine(ctx, s.engineURL, interval, exited); err != nil {
+		return &StartError{Stage: StageStart, Err: err}
+	}
+	if s.config.DatabaseKey != "" {
+		if err := checkDatabaseKey(ctx, s.engineURL, s.databasePath); err != nil {
+			return &StartError{Stage: StageConfig, Err: err}
+		}
+	}
+	if h, ok := s.handler.(*api.Handler); ok {
+		h.WarmUp(ctx)
+		if err := h.CheckAuthRules(); err != nil {
+			return &StartError{Stage: StageConfig, Err: err}
+		}
+		if err := h.CheckHiddenSchema(); err != nil {
+			return &StartError{Stage: StageConfig, Err: err}
+		}
+		if err := h.CheckSoftDeleteSchema(); err != nil {
+			return &StartError{Stage: StageConfig, Err: err}
+		}
+		if s.config.SchemaDriftCheck {
+			// it can take a while on large schemas, readiness doesn't wait
+			s.goRun(func() { s.checkSchemaDrift(h) })
+		}
+	}
+	return nil
+}
+
+// migrateLive migrates the database while serving, for the migration gate of
+// the handler: the query engine is stopped, the schema migrated and the
+// engine started again, also if the migration failed, to keep serving. An
+// ephemeral or encrypted database gets a fresh copy of the configured schema
+// first, with the database key.
+func (s *Server) migrateLive(ctx context.Context, schemaPath, databasePath, lockPath string, result *migrationResult) error {
+	s.engine.stop()
+	var err error
+	if schemaPath != s.config.SchemaPath {
+		_, err = migrate.WriteSchemaForDatabase(s.config.SchemaPath, databasePath, filepath.Dir(schemaPath))
+	}
+	if err == nil && s.config.DatabaseKey != "" {
+		_, err = migrate.WriteSchemaWithKey(schemaPath, s.config.DatabaseKey, filepath.Dir(schemaPath))
+	}
+	if err == nil {
+		err = Migrate(ctx, MigrateOptions{
+			MigrationEnginePath: s.config.MigrationEnginePath,
+			SchemaPath:          schemaPath,
+			LockPath:            lockPath,
+			EnableCDC:           s.config.API.EnableCDC,
+			SqlitePath:          s.config.API.SqlitePath,
+		})
+	}
+	var failed *migrate.Error
+	if err == nil || errors.As(err, &failed) {
+		result.set(failed)
+	}
+	if err != nil {
+		s.config.API.Reporter.Report(report.Event{Type: report.EventMigrationFailed, Message: err.Error()})
+	}
+
+	if startErr := s.resumeEngine(ctx); startErr != nil {
+		return startErr
+	}
+	if h, ok := s.handler.(*api.Handler); ok && s.config.SchemaDriftCheck {
+		s.goRun(func() { s.checkSchemaDrift(h) })
+	}
+	return err
+}
+
+// restartEngine restarts the query engine, for the handler to reopen the
+// database once its storage recovered.
+func (s *Server) restartEngine(ctx context.Context) error {
+	s.engine.stop()
+	return s.resumeEngine(ctx)
+}
+
+// resumeEngine starts the stopped query engine and waits until it answers.
+func (s *Server) resumeEngine(ctx context.Context) error {
+	if err := s.engine.start(); err != nil {
+		return fmt.Errorf("wunderbase: restart query engine: %w", err)
+	}
+	interval := s.config.API.EngineConnectBackoff
+	if interval <= 0 {
+		interval = 50 * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := waitForEngine(ctx, s.engineURL, interval, s.engine.exited()); err != nil {
+		return fmt.Errorf("wunderbase: query engine not ready after restarting: %w", err)
+	}
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// ManagementAddr returns the address of the management endpoint, empty
+// without it.
+func (s *Server) ManagementAddr() string {
+	if s.managementListener == nil {
+		return ""
+	}
+	return s.managementListener.Addr().String()
+}
+
+// DatabasePath returns the SQLite file of the database served, empty when
+// serving Databases.
+func (s *Server) DatabasePath() string {
+	return s.databasePath
+}
+
+// ModelCount returns the number of models of the schema served, 0 when
+// serving Databases.
+func (s *Server) ModelCount() (int, error) {
+	h, ok := s.handler.(*api.Handler)
+	if !ok {
+		return 0, nil
+	}
+	return h.ModelCount()
+}
+
+// Listener returns the socket requests are accepted on, e.g. to hand it
+// over to a new process.
+func (s *Server) Listener() net.Listener {
+	return s.listener
+}
+
+// GraphQLURL returns the url GraphQL requests are posted to. An unspecified
+// listen address is reached on localhost.
+func (s *Server) GraphQLURL() string {
+	host, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		return "http://" + s.Addr() + "/"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// Done is closed when the server stops, including going to sleep.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Slept reports whether the server stopped because it went to sleep.
+func (s *Server) Slept() bool {
+	return atomic.LoadInt32(&s.slept) == 1
+}
+
+// sleep stops the server once the handler decided to sleep.
+func (s *Server) sleep() {
+	atomic.StoreInt32(&s.slept, 1)
+	s.cancel()
+}
+
+// Reload applies the settings of config that can change while serving:
+// the limits and the sleep timeout.
+func (s *Server) Reload(config api.Config) {
+	s.handler.Reload(config)
+}
+
+// Shutdown stops serving, waiting for requests in flight until ctx is
+// done, then stops the query engines and removes temporary files.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	if s.http != nil {
+		if err = s.http.Shutdown(ctx); err != nil {
+			_ = s.http.Close()
+		}
+	}
+	if s.management != nil {
+		if managementErr := s.management.Shutdown(ctx); managementErr != nil {
+			_ = s.management.Close()
+			if err == nil {
+				err = managementErr
+			}
+		}
+	}
+	s.stop()
+	return err
+}
+
+func (s *Server) stop() {
+	s.cancel()
+	if s.http == nil && s.listener != nil && s.config.Listener == nil {
+		s.listener.Close()
+	}
+	if s.http == nil && s.managementListener != nil && s.config.ManagementListener == nil {
+		s.managementListener.Close()
+	}
+	s.wg.Wait()
+	if s.router != nil {
+		s.router.Close()
+	}
+	if s.engine != nil {
+		s.engine.stop()
+	}
+	for i := len(s.cleanups) - 1; i >= 0; i-- {
+		s.cleanups[i]()
+	}
+	s.cleanups = nil
+}
+
+// useEphemeralDatabase copies the database to a temporary directory and
+// returns the path of a schema pointing at the copy.
+func (s *Server) useEphemeralDatabase() (string, error) {
+	source, err := migrate.DatabaseFilePath(s.config.SchemaPath)
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir("", "wunderbase-ephemeral-")
+	if err != nil {
+		return "", err
+	}
+	s.cleanups = append(s.cleanups, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("remove ephemeral database", slog.Any("err", err))
+		}
+	})
+
+	database := filepath.Join(dir, "db.sqlite")
+	if _, err := os.Stat(source); err == nil {
+		if err := branch.Snapshot(source, database); err != nil {
+			return "", err
+		}
+	}
+	schemaPath, err := migrate.WriteSchemaForDatabase(s.config.SchemaPath, database, dir)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Serving ephemeral database", slog.String("source", source), slog.String("path", database))
+	return schemaPath, nil
+}
+
+// executeScheduled runs the operations of scheduled entries through handler,
+// so they are subject to the same limits as requests.
+func executeScheduled(handler *api.Handler) schedule.Exec {
+	return func(ctx context.Context, entry schedule.Entry) error {
+		body, err := json.Marshal(map[string]interface{}{"query": entry.Query, "variables": entry.Variables})
+		if err != nil {
+			return err
+		}
+		_, err = handler.Execute(ctx, body, api.ExecuteOptions{
+			RateLimited: entry.Limited(),
+			KeepAwake:   entry.KeepAwake,
+		})
+		return err
+	}
+}
+
+// freePort returns a port that was free a moment ago.
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	return port, err
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/backup"
+	"wunderbase/pkg/metrics"
+
+	"github.com/gavv/httpexpect/v2"
+	"github.com/stretchr/testify/require"
+)
+
+const testSchema = `datasource db {
+  provider = "sqlite"
+  url      = "file:./dev.db"
+}
+
+model User {
+  id    Int    @id @default(autoincrement())
+  email String @unique
+}
+`
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{})
+	require.Error(t, err)
+	_, err = New(Config{Databases: []Database{{Name: "a"}}, Ephemeral: true})
+	require.Error(t, err)
+
+	s, err := New(Config{SchemaPath: "schema.prisma"})
+	require.NoError(t, err)
+	require.Equal(t, 10000, s.config.API.ReadLimitSeconds)
+	require.Equal(t, "/health", s.config.API.HealthEndpoint)
+	require.NotNil(t, s.config.API.Metrics)
+}
+
+func TestStartListenError(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer taken.Close()
+
+	var phases []string
+	s, err := New(Config{
+		SchemaPath: "schema.prisma",
+		ListenAddr: taken.Addr().String(),
+		Phase: func(name string) error {
+			phases = append(phases, name)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	err = s.Start(context.Background())
+	var startErr *StartError
+	require.True(t, errors.As(err, &startErr))
+	require.Equal(t, StageListen, startErr.Stage)
+	require.Equal(t, []string{"listen"}, phases)
+}
+
+func TestGraphQLURL(t *testing.T) {
+	l, err := net.Listen("tcp", "0.0.0.0:0")
+	require.NoError(t, err)
+	defer l.Close()
+	s := &Server{listener: l}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	require.Equal(t, "http://localhost:"+port+"/", s.GraphQLURL())
+}
+
+func TestNewForTesting(t *testing.T) {
+	for _, engine := range []string{envOr("WUNDERBASE_QUERY_ENGINE_PATH", "./query-engine"), envOr("WUNDERBASE_MIGRATION_ENGINE_PATH", "./migration-engine")} {
+		if _, err := os.Stat(engine); err != nil {
+			t.Skip("the prisma engines are not installed")
+		}
+	}
+	s := NewForTesting(t, testSchema)
+	e := httpexpect.New(t, s.GraphQLURL())
+	e.POST("").WithHeader("Content-Type", "application/json").
+		WithBytes([]byte(`{"query":"mutation { createOneUser(data: {email: \"a@example.com\"}) { id } }"}`)).
+		Expect().Status(http.StatusOK).JSON().Path("$.data.createOneUser.id").Equal(1)
+}
+
+func TestExternalQueryEngine(t *testing.T) {
+	_, err := New(Config{SchemaPath: "schema.prisma", ExternalQueryEngineURL: "http://engine:4467/", Ephemeral: true})
+	require.Error(t, err)
+
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer engine.Close()
+	schemaPath := filepath.Join(t.TempDir(), "schema.prisma")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(testSchema), 0644))
+	s, err := New(Config{
+		SchemaPath:             schemaPath,
+		QueryEnginePath:        "./missing-query-engine",
+		ExternalQueryEngineURL: engine.URL,
+		API:                    api.Config{AdminToken: "secret"},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.Start(ctx))
+	defer s.Shutdown(context.Background())
+	require.NoError(t, s.Ready(ctx))
+
+	e := httpexpect.New(t, s.GraphQLURL())
+	health := e.GET("/health").WithQuery("verbose", "1").Expect().Status(http.StatusOK).JSON()
+	health.Path("$.components.query_engine.status").Equal("ok")
+	health.Path("$.components.query_engine.details.managed").Equal("external")
+	// the external engine wouldn't read the migrated schema
+	e.POST("/admin/migration").WithHeader("Authorization", "Bearer secret").
+		Expect().Status(http.StatusConflict)
+}
+
+func TestSleep(t *testing.T) {
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer engine.Close()
+	schemaPath := filepath.Join(t.TempDir(), "schema.prisma")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(testSchema), 0644))
+	s, err := New(Config{
+		SchemaPath:             schemaPath,
+		ExternalQueryEngineURL: engine.URL,
+		API:                    api.Config{EnableSleepMode: true, SleepAfterSeconds: 1, ReadLimitSeconds: 100, WriteLimitSeconds: 100},
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, s.Start(ctx))
+	defer s.Shutdown(context.Background())
+	require.NoError(t, s.Ready(ctx))
+	require.False(t, s.Slept())
+
+	// the first request starts the sleep timer
+	httpexpect.New(t, s.GraphQLURL()).GET("/health").Expect().Status(http.StatusOK)
+	select {
+	case <-s.Done():
+	case <-ctx.Done():
+		t.Fatal("didn't sleep")
+	}
+	require.True(t, s.Slept())
+}
+
+func TestSnapshotCache(t *testing.T) {
+	cache := newSnapshotCache(t.TempDir(), 100)
+	var restores []string
+	restore := func(ctx context.Context, snapshot backup.Snapshot, dir string) (string, int64, error) {
+		restores = append(restores, snapshot.Source)
+		if snapshot.Source == "broken" {
+			return "", 0, errors.New("download failed")
+		}
+		return filepath.Join(dir, "schema.prisma"), 60, nil
+	}
+	acquire := func(source string) *cachedSnapshot {
+		entry, err := cache.acquire(context.Background(), backup.Snapshot{Source: source, Generation: backup.Generation{ID: "1"}}, restore)
+		require.NoError(t, err)
+		return entry
+	}
+
+	a := acquire("a")
+	cache.release(acquire("a"))
+	require.Equal(t, []string{"a"}, restores, "restored once")
+	// a is in use, b goes over the size but a stays
+	b := acquire("b")
+	cache.release(b)
+	_, err := os.Stat(a.dir)
+	require.NoError(t, err)
+	require.Equal(t, int64(60), cache.size, "b was removed, a is in use")
+	cache.release(a)
+	acquire("a")
+	require.Equal(t, []string{"a", "b"}, restores, "a stayed cached")
+
+	_, err = cache.acquire(context.Background(), backup.Snapshot{Source: "broken"}, restore)
+	require.Error(t, err)
+	_, err = cache.acquire(context.Background(), backup.Snapshot{Source: "broken"}, restore)
+	require.Error(t, err)
+	require.Equal(t, []string{"a", "b", "broken", "broken"}, restores, "failures aren't cached")
+}
+
+func TestBackupVerification(t *testing.T) {
+	_, err := New(Config{Databases: []Database{{Name: "a"}}, BackupVerification: &BackupVerification{Cron: "@daily"}})
+	require.Error(t, err)
+
+	dir := t.TempDir()
+	older, latest := filepath.Join(dir, "older.sqlite"), filepath.Join(dir, "latest.sqlite")
+	require.NoError(t, os.WriteFile(older, []byte("older"), 0644))
+	require.NoError(t, os.Chtimes(older, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	require.NoError(t, os.WriteFile(latest, []byte("latest"), 0644))
+
+	registry := metrics.NewRegistry()
+	verifier := newBackupVerifier(BackupVerification{Cron: "@daily", Sources: []string{dir}, Options: backup.VerifyOptions{Query: "SELECT 1"}})
+	verifier.setGauges(registry)
+	var verified []string
+	failing := true
+	verifier.verify = func(ctx context.Context, opts backup.VerifyOptions) (*backup.Report, error) {
+		require.Equal(t, "SELECT 1", opts.Query)
+		verified = append(verified, opts.Source)
+		return &backup.Report{Source: opts.Source, Checks: []backup.Check{{Name: "integrity", OK: !failing, Detail: "malformed"}}}, nil
+	}
+	lastVerified := func() string {
+		var out strings.Builder
+		require.NoError(t, registry.Write(&out))
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "wunderbase_backup_last_verified_timestamp_seconds ") {
+				return strings.TrimPrefix(line, "wunderbase_backup_last_verified_timestamp_seconds ")
+			}
+		}
+		return ""
+	}
+
+	require.ErrorContains(t, verifier.run(context.Background()), "integrity: malformed")
+	require.Equal(t, "0", lastVerified())
+	failing = false
+	require.NoError(t, verifier.run(context.Background()))
+	require.NotEqual(t, "0", lastVerified())
+	require.NoError(t, verifier.run(context.Background()))
+	require.Equal(t, []string{latest, latest}, verified, "the latest backup is verified until it passes")
+
+	require.NoError(t, os.WriteFile(older, []byte("newer"), 0644))
+	require.NoError(t, verifier.run(context.Background()))
+	require.Equal(t, []string{latest, latest, older}, verified, "a new backup is verified")
+}
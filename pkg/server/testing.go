@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"wunderbase/pkg/migrate"
+)
+
+// NewForTesting serves schema from a fresh database in a temporary
+// directory and returns the started, ready server. It is shut down when the
+// test ends. The engines are found like the serve command does, at
+// WUNDERBASE_QUERY_ENGINE_PATH and WUNDERBASE_MIGRATION_ENGINE_PATH or in
+// the working directory. options adjust the config before starting.
+func NewForTesting(t testing.TB, schema string, options ...func(*Config)) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "schema.prisma")
+	if err := ioutil.WriteFile(path, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schemaDir := filepath.Join(dir, "schema")
+	if err := os.Mkdir(schemaDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path, err := migrate.WriteSchemaForDatabase(path, filepath.Join(dir, "db.sqlite"), schemaDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		SchemaPath:          path,
+		QueryEnginePath:     envOr("WUNDERBASE_QUERY_ENGINE_PATH", "./query-engine"),
+		MigrationEnginePath: envOr("WUNDERBASE_MIGRATION_ENGINE_PATH", "./migration-engine"),
+		Migrate:             true,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Ready(ctx); err != nil {
+		t.Fatalf("query engine not ready: %v", err)
+	}
+	return s
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/api"
+	"wunderbase/pkg/backup"
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/queryengine"
+
+	"golang.org/x/exp/slog"
+)
+
+// TimeTravel configures the reads of past states of the database, served
+// by throwaway query engines on backups.
+type TimeTravel struct {
+	// Sources are the backups, see backup.Snapshots.
+	Sources []string
+	// Keys decrypt the backups.
+	Keys [][]byte
+	// MaxEngines is how many time-travel engines may run at once, more
+	// reads are refused.
+	MaxEngines int
+	// CacheBytes caps the restored backups kept for the next reads of the
+	// same time, the least recently used are removed first.
+	CacheBytes int64
+}
+
+// timeTravelStartTimeout is how long a time-travel engine may take to
+// answer.
+const timeTravelStartTimeout = 30 * time.Second
+
+// timeTraveler restores backups and starts query engines on them.
+type timeTraveler struct {
+	ctx        context.Context
+	config     *TimeTravel
+	enginePath string
+	// schemaPath is the schema served, its datasource is replaced by the
+	// restored backups
+	schemaPath string
+	production bool
+	debug      bool
+	// engines holds a token per running engine
+	engines chan struct{}
+	cache   *snapshotCache
+}
+
+// newTimeTraveler returns the time traveler of the server, whose restored
+// backups are removed on stop.
+func (s *Server) newTimeTraveler(ctx context.Context, schemaPath string) (*timeTraveler, error) {
+	dir, err := ioutil.TempDir("", "wunderbase-timetravel-")
+	if err != nil {
+		return nil, err
+	}
+	s.cleanups = append(s.cleanups, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Error("remove time-travel snapshots", slog.String("error", err.Error()))
+		}
+	})
+	config := s.config.TimeTravel
+	return &timeTraveler{
+		ctx:        ctx,
+		config:     config,
+		enginePath: s.config.QueryEnginePath,
+		schemaPath: schemaPath,
+		production: s.config.Production,
+		debug:      s.config.Debug,
+		engines:    make(chan struct{}, config.MaxEngines),
+		cache:      newSnapshotCache(dir, config.CacheBytes),
+	}, nil
+}
+
+// engine is api.Config.TimeTravel: it restores the backup written closest
+// before at, unless it is cached, and starts a query engine on it.
+func (t *timeTraveler) engine(ctx context.Context, at time.Time) (_ *api.TimeTravelEngine, err error) {
+	select {
+	case t.engines <- struct{}{}:
+	default:
+		return nil, api.ErrTimeTravelBusy
+	}
+	// teardown undoes what was set up, last first, once the read is
+	// answered or right away if it fails
+	var teardown []func()
+	release := func() {
+		for i := len(teardown) - 1; i >= 0; i-- {
+			teardown[i]()
+		}
+	}
+	teardown = append(teardown, func() { <-t.engines })
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	snapshots, err := backup.Snapshots(ctx, t.config.Sources)
+	if err != nil {
+		return nil, fmt.Errorf("wunderbase: time travel: list backups: %w", err)
+	}
+	snapshot, ok := backup.Closest(snapshots, at)
+	if !ok {
+		return nil, api.ErrNoSnapshot
+	}
+	cached, err := t.cache.acquire(ctx, snapshot, t.restore)
+	if err != nil {
+		return nil, fmt.Errorf("wunderbase: time travel: restore %s: %w", snapshot.Source, err)
+	}
+	teardown = append(teardown, func() { t.cache.release(cached) })
+
+	port, err := freePort()
+	if err != nil {
+		return nil, fmt.Errorf("wunderbase: time travel: query engine port: %w", err)
+	}
+	engineCtx, cancel := context.WithCancel(t.ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	exited := make(chan error, 1)
+	err = queryengine.RunUntracked(engineCtx, wg, t.enginePath, port, cached.schemaPath, t.production, t.debug, func(err error) {
+		exited <- err
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("wunderbase: time travel: run query engine: %w", err)
+	}
+	teardown = append(teardown, func() {
+		cancel()
+		wg.Wait()
+	})
+	url := fmt.Sprintf("http://localhost:%s/", port)
+	waitCtx, cancelWait := context.WithTimeout(ctx, timeTravelStartTimeout)
+	defer cancelWait()
+	if err := waitForEngine(waitCtx, url, 50*time.Millisecond, exited); err != nil {
+		return nil, fmt.Errorf("wunderbase: time travel: %w", err)
+	}
+	slog.Debug("Time-travel engine started", slog.String("snapshot", snapshot.Source), slog.Time("written", snapshot.Modified))
+	return &api.TimeTravelEngine{URL: url, Snapshot: snapshot.Modified, Release: release}, nil
+}
+
+// restore downloads snapshot into dir, read-only, next to a copy of the
+// schema pointing at it. dir is only readable by the owner, the schema may
+// carry the database key.
+func (t *timeTraveler) restore(ctx context.Context, snapshot backup.Snapshot, dir string) (string, int64, error) {
+	database := filepath.Join(dir, "data.db")
+	if err := backup.Download(ctx, snapshot.Source, database, t.config.Keys); err != nil {
+		return "", 0, err
+	}
+	if err := os.Chmod(database, 0400); err != nil {
+		return "", 0, err
+	}
+	info, err := os.Stat(database)
+	if err != nil {
+		return "", 0, err
+	}
+	schemaPath, err := migrate.WriteSchemaForDatabase(t.schemaPath, database, dir)
+	if err != nil {
+		return "", 0, err
+	}
+	return schemaPath, info.Size(), nil
+}
+
+// snapshotCache keeps the restored backups, up to max bytes of them. The
+// backups in use are never removed, so it can go over max while more are.
+type snapshotCache struct {
+	dir string
+	max int64
+
+	mu   sync.Mutex
+	size int64
+	// order has the most recently used backup in front
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedSnapshot struct {
+	key        string
+	dir        string
+	schemaPath string
+	size       int64
+	// refs counts the reads using the backup, the one restoring it
+	// included
+	refs  int
+	ready chan struct{}
+	err   error
+}
+
+func newSnapshotCache(dir string, max int64) *snapshotCache {
+	return &snapshotCache{dir: dir, max: max, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// acquire returns snapshot restored by restore, once: reads of a backup
+// being restored wait for it. The backup must be released after use.
+func (c *snapshotCache) acquire(ctx context.Context, snapshot backup.Snapshot,
+	restore func(ctx context.Context, snapshot backup.Snapshot, dir string) (string, int64, error)) (*cachedSnapshot, error) {
+	sum := sha256.Sum256([]byte(snapshot.Source + "\x00" + snapshot.ID))
+	key := hex.EncodeToString(sum[:8])
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cachedSnapshot)
+		entry.refs++
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			c.release(entry)
+			return nil, ctx.Err()
+		}
+		if entry.err != nil {
+			c.release(entry)
+			return nil, entry.err
+		}
+		return entry, nil
+	}
+	entry := &cachedSnapshot{key: key, dir: filepath.Join(c.dir, key), refs: 1, ready: make(chan struct{})}
+	element := c.order.PushFront(entry)
+	c.entries[key] = element
+	c.mu.Unlock()
+
+	var err error
+	if err = os.Mkdir(entry.dir, 0700); err == nil {
+		entry.schemaPath, entry.size, err = restore(ctx, snapshot, entry.dir)
+	}
+	c.mu.Lock()
+	if err != nil {
+		entry.err = err
+		c.order.Remove(element)
+		delete(c.entries, key)
+		_ = os.RemoveAll(entry.dir)
+	} else {
+		c.size += entry.size
+	}
+	close(entry.ready)
+	c.mu.Unlock()
+	if err != nil {
+		c.release(entry)
+		return nil, err
+	}
+	return entry, nil
+}
+
+// release returns entry to the cache, removing the least recently used
+// backups no read uses while the cache is over its size.
+func (c *snapshotCache) release(entry *cachedSnapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	for element := c.order.Back(); element != nil && c.size > c.max; {
+		prev := element.Prev()
+		if cached := element.Value.(*cachedSnapshot); cached.refs == 0 {
+			c.order.Remove(element)
+			delete(c.entries, cached.key)
+			c.size -= cached.size
+			if err := os.RemoveAll(cached.dir); err != nil {
+				slog.Error("remove time-travel snapshot", slog.String("error", err.Error()))
+			}
+		}
+		element = prev
+	}
+}
@@ -0,0 +1,353 @@
+// Package support collects what a bug report needs into a bundle: the
+// configuration, versions, engine log, migration and database state and the
+// schema. Secrets and data values are redacted by the package, not left to
+// whoever shares the bundle.
+package support
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"wunderbase/pkg/buildinfo"
+	"wunderbase/pkg/migrate"
+)
+
+// File is a file of a bundle.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Bundle is a support bundle being collected.
+type Bundle struct {
+	Files []File
+	// Secrets are replaced in every file when the bundle is written.
+	Secrets []string
+}
+
+// Add adds a file to the bundle.
+func (b *Bundle) Add(name string, data []byte) {
+	b.Files = append(b.Files, File{Name: name, Data: data})
+}
+
+// AddJSON adds v as an indented JSON file, or the error encoding it.
+func (b *Bundle) AddJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		data = []byte(fmt.Sprintf("{\"error\": %q}", err.Error()))
+	}
+	b.Add(name, append(data, '\n'))
+}
+
+// Write writes the bundle as a gzipped tar, with the secrets and the
+// credentials and query strings of urls redacted from every file.
+func (b *Bundle) Write(w io.Writer) error {
+	var pairs []string
+	for _, secret := range b.Secrets {
+		if secret != "" {
+			pairs = append(pairs, secret, redacted)
+		}
+	}
+	replacer := strings.NewReplacer(pairs...)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range b.Files {
+		data := RedactURLs([]byte(replacer.Replace(string(file.Data))))
+		header := &tar.Header{Name: "wunderbase-support/" + file.Name, Mode: 0644, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+const redacted = "<redacted>"
+
+// Options are the parts of a bundle known without a running instance.
+type Options struct {
+	// Config is the effective configuration, with the secret settings
+	// redacted already.
+	Config []byte
+	Build  buildinfo.Info
+	// SchemaPath is the prisma schema, MigrationLockFilePath its lock file.
+	SchemaPath            string
+	MigrationLockFilePath string
+	// SqlitePath is the sqlite3 CLI checking the database, which is skipped
+	// without it and for encrypted databases.
+	SqlitePath string
+	Encrypted  bool
+	// EngineLog are the last lines the query engine wrote, nil if it doesn't
+	// run in this process.
+	EngineLog []string
+	// HashNames replaces the names of the models, enums and fields of the
+	// schema with hashes.
+	HashNames bool
+	Secrets   []string
+}
+
+// Collect collects the bundle. A part that can't be collected holds the
+// reason instead, so a bundle is made whatever is broken.
+func Collect(ctx context.Context, opts Options) *Bundle {
+	b := &Bundle{Secrets: opts.Secrets}
+	b.Add("config.yaml", opts.Config)
+	b.AddJSON("versions.json", opts.Build)
+	if opts.EngineLog != nil {
+		b.Add("engine.log", []byte(strings.Join(RedactEngineLog(opts.EngineLog), "\n")+"\n"))
+	} else {
+		b.Add("engine.log", []byte("the query engine doesn't run in the process that collected this bundle\n"))
+	}
+
+	schema, err := ioutil.ReadFile(opts.SchemaPath)
+	if err != nil {
+		b.AddJSON("migration.json", map[string]string{"error": err.Error()})
+		b.AddJSON("database.json", map[string]string{"error": err.Error()})
+		return b
+	}
+	b.AddJSON("migration.json", migrationState(opts.MigrationLockFilePath, string(schema)))
+	b.AddJSON("database.json", databaseState(ctx, opts))
+	schema = RedactSchema(schema)
+	if opts.HashNames {
+		schema = HashNames(schema)
+	}
+	b.Add("schema.prisma", schema)
+	return b
+}
+
+type migrationInfo struct {
+	LockFile string    `json:"lockFile"`
+	Exists   bool      `json:"exists"`
+	Matches  bool      `json:"matchesSchema"`
+	LastRun  time.Time `json:"lastRun,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func migrationState(lockPath, schema string) migrationInfo {
+	info := migrationInfo{LockFile: lockPath}
+	matches, lastRun, err := migrate.LockStatus(lockPath, schema)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Exists, info.Matches, info.LastRun = !lastRun.IsZero(), matches, lastRun
+	return info
+}
+
+type databaseInfo struct {
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"sizeBytes"`
+	WALBytes  int64     `json:"walBytes"`
+	Modified  time.Time `json:"modified,omitempty"`
+	// QuickCheck is the summary of PRAGMA quick_check, ok if the database
+	// passed it.
+	QuickCheck string `json:"quickCheck"`
+	Error      string `json:"error,omitempty"`
+}
+
+// quickCheckErrors is how many problems PRAGMA quick_check lists at most.
+const quickCheckErrors = 20
+
+func databaseState(ctx context.Context, opts Options) databaseInfo {
+	path, err := migrate.DatabaseFilePath(opts.SchemaPath)
+	if err != nil {
+		return databaseInfo{Error: err.Error()}
+	}
+	info := databaseInfo{Path: path}
+	stat, err := os.Stat(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.SizeBytes, info.Modified = stat.Size(), stat.ModTime()
+	if wal, err := os.Stat(path + "-wal"); err == nil {
+		info.WALBytes = wal.Size()
+	}
+	switch {
+	case opts.Encrypted:
+		info.QuickCheck = "skipped: the database is encrypted"
+	case opts.SqlitePath == "":
+		info.QuickCheck = "skipped: no sqlite3 CLI"
+	default:
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, opts.SqlitePath, "-readonly", "-batch", "-cmd", ".timeout 5000", path,
+			fmt.Sprintf("PRAGMA quick_check(%d);", quickCheckErrors)).CombinedOutput()
+		switch {
+		case errors.Is(err, exec.ErrNotFound):
+			info.QuickCheck = "skipped: no sqlite3 CLI at " + opts.SqlitePath
+		case err != nil:
+			info.QuickCheck = "failed: " + strings.TrimSpace(err.Error()+" "+string(out))
+		default:
+			info.QuickCheck = strings.TrimSpace(string(out))
+		}
+	}
+	return info
+}
+
+var (
+	// urlCredentials matches the user and password of a url
+	urlCredentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s"'@]+@`)
+	// urlQuery matches the query string of a url, which may sign it
+	urlQuery = regexp.MustCompile(`((?:https?|s3|postgres(?:ql)?|mysql)://[^\s"'?]*)\?[^\s"']*`)
+)
+
+// RedactURLs replaces the credentials and the query strings of the urls in
+// data.
+func RedactURLs(data []byte) []byte {
+	data = urlCredentials.ReplaceAll(data, []byte("${1}"+redacted+"@"))
+	return urlQuery.ReplaceAll(data, []byte("${1}?"+redacted))
+}
+
+// RedactEngineLog replaces the parameters of the statements logged by the
+// query engine, the only data values it logs.
+func RedactEngineLog(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, line := range lines {
+		out[i] = line
+		if !strings.HasPrefix(line, "{") || !strings.Contains(line, `"params"`) {
+			continue
+		}
+		var logged map[string]interface{}
+		if json.Unmarshal([]byte(line), &logged) != nil {
+			out[i] = redacted
+			continue
+		}
+		if fields, ok := logged["fields"].(map[string]interface{}); ok {
+			if _, ok := fields["params"]; ok {
+				fields["params"] = redacted
+			}
+		}
+		if _, ok := logged["params"]; ok {
+			logged["params"] = redacted
+		}
+		data, _ := json.Marshal(logged)
+		out[i] = string(data)
+	}
+	return out
+}
+
+// datasourceURL matches the url of a datasource written in the schema,
+// whose parameters may carry a key.
+var datasourceURL = regexp.MustCompile(`(?m)^(\s*url\s*=\s*"[^"?]*)\?[^"]*"`)
+
+// RedactSchema replaces the parameters of the datasource url of a prisma
+// schema.
+func RedactSchema(schema []byte) []byte {
+	return datasourceURL.ReplaceAll(schema, []byte(`${1}?`+redacted+`"`))
+}
+
+var (
+	blockStart = regexp.MustCompile(`^\s*(model|enum|type|view|datasource|generator)\s+(\w+)\s*\{`)
+	identifier = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+	// mapped matches the database names and relation names given as
+	// strings
+	mapped = regexp.MustCompile(`((?:@@?map\(|@relation\(|map:\s*|name:\s*)(?:name:\s*)?)"([^"]*)"`)
+)
+
+// HashNames replaces the names of the models, enums, types and views of a
+// prisma schema, of their fields and enum values and the database names
+// they are mapped to by hashes, consistently, so the schema's shape is kept.
+// Comments are removed, the datasource and generators are kept.
+func HashNames(schema []byte) []byte {
+	lines := strings.Split(string(schema), "\n")
+	names := map[string]bool{}
+	block := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if match := blockStart.FindStringSubmatch(line); match != nil {
+			block = match[1]
+			if block != "datasource" && block != "generator" {
+				names[match[2]] = true
+			}
+			continue
+		}
+		if trimmed == "}" {
+			block = ""
+			continue
+		}
+		if block == "" || block == "datasource" || block == "generator" || strings.HasPrefix(trimmed, "@@") || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if fields := strings.Fields(trimmed); len(fields) > 0 {
+			names[fields[0]] = true
+		}
+	}
+
+	var out []string
+	block = ""
+	for _, line := range lines {
+		if match := blockStart.FindStringSubmatch(line); match != nil {
+			block = match[1]
+		}
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if block != "datasource" && block != "generator" {
+			if i := strings.Index(line, "//"); i >= 0 && !strings.Contains(line[:i], `"`) {
+				line = strings.TrimRight(line[:i], " \t")
+			}
+			line = hashLine(line, names)
+		}
+		if trimmed == "}" {
+			block = ""
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\n"))
+}
+
+// hashLine hashes the names in line outside strings, except attributes,
+// functions and argument names, and the mapped names in strings.
+func hashLine(line string, names map[string]bool) string {
+	line = mapped.ReplaceAllStringFunc(line, func(match string) string {
+		parts := mapped.FindStringSubmatch(match)
+		return parts[1] + `"` + hashName(parts[2]) + `"`
+	})
+	var b strings.Builder
+	inString := false
+	last := 0
+	for _, loc := range identifier.FindAllStringIndex(line, -1) {
+		start, end := loc[0], loc[1]
+		inString = inString != (strings.Count(line[last:start], `"`)%2 == 1)
+		b.WriteString(line[last:start])
+		last = end
+		word := line[start:end]
+		before := byte(' ')
+		if start > 0 {
+			before = line[start-1]
+		}
+		after := strings.TrimLeft(line[end:], " ")
+		if inString || !names[word] || before == '@' || before == '.' || strings.HasPrefix(after, "(") || strings.HasPrefix(after, ":") {
+			b.WriteString(word)
+			continue
+		}
+		b.WriteString(hashName(word))
+	}
+	b.WriteString(line[last:])
+	return b.String()
+}
+
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "n_" + hex.EncodeToString(sum[:4])
+}
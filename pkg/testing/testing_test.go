@@ -26,7 +26,7 @@ func TestWunderBase(t *testing.T) {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	cmd := exec.CommandContext(ctx, "docker", "run", "-p", "4466:4466", "-e", "SLEEP_AFTER_SECONDS=1", "wundergraph/wunderbase")
+	cmd := exec.CommandContext(ctx, "docker", "run", "-p", "4466:4466", "-e", "WUNDERBASE_SLEEP_AFTER_SECONDS=1", "wundergraph/wunderbase")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err := cmd.Start()
@@ -0,0 +1,165 @@
+// Package tracing carries request and W3C trace context IDs through a
+// request so logs, including the query engine's, can be correlated with the
+// caller's traces.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// RequestIDHeader is read from and written to every request.
+const RequestIDHeader = "X-Request-Id"
+
+// Trace identifies a request.
+type Trace struct {
+	RequestID string
+	// TraceID is the W3C trace ID, 32 lowercase hex characters.
+	TraceID string
+	// ParentID is the caller's span ID, empty when no traceparent was sent.
+	ParentID string
+	Sampled  bool
+}
+
+// FromRequest reads the request ID and traceparent header of r. A missing
+// request ID is generated; without a valid traceparent the trace ID is
+// derived from the request ID so local correlation still works.
+func FromRequest(r *http.Request) Trace {
+	t := Trace{RequestID: r.Header.Get(RequestIDHeader)}
+	if t.RequestID == "" || len(t.RequestID) > 128 {
+		t.RequestID = NewID(16)
+	}
+	if traceID, parentID, sampled, ok := ParseTraceparent(r.Header.Get("traceparent")); ok {
+		t.TraceID, t.ParentID, t.Sampled = traceID, parentID, sampled
+		return t
+	}
+	if isHex(t.RequestID, 32) && !allZero(t.RequestID) {
+		t.TraceID = strings.ToLower(t.RequestID)
+	} else {
+		sum := sha256.Sum256([]byte(t.RequestID))
+		t.TraceID = hex.EncodeToString(sum[:16])
+	}
+	return t
+}
+
+// Traceparent returns the header for an upstream call made on behalf of the
+// request, with a new span ID.
+func (t Trace) Traceparent() string {
+	flags := "00"
+	if t.Sampled {
+		flags = "01"
+	}
+	return "00-" + t.TraceID + "-" + NewID(8) + "-" + flags
+}
+
+// Attrs returns the log attributes identifying the request.
+func (t Trace) Attrs() []interface{} {
+	return []interface{}{slog.String("requestId", t.RequestID), slog.String("traceId", t.TraceID)}
+}
+
+// ParseTraceparent parses a version 00 W3C traceparent header.
+func ParseTraceparent(header string) (traceID, parentID string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	// later versions may append fields, version 00 has exactly four
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isHex(version, 2) || version == "ff" || !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(flags, 2) {
+		return "", "", false, false
+	}
+	if allZero(traceID) || allZero(parentID) {
+		return "", "", false, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return traceID, parentID, flagBits[0]&1 == 1, true
+}
+
+// NewID returns n random bytes hex encoded.
+func NewID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func allZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+type traceKey struct{}
+
+// NewContext returns ctx carrying t.
+func NewContext(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// FromContext returns the trace of the request ctx belongs to.
+func FromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(traceKey{}).(Trace)
+	return t, ok
+}
+
+// Logger returns the default logger annotated with the request's IDs.
+func Logger(ctx context.Context) *slog.Logger {
+	if t, ok := FromContext(ctx); ok {
+		return slog.Default().With(t.Attrs()...)
+	}
+	return slog.Default()
+}
+
+var inflight = struct {
+	sync.Mutex
+	traces map[string]Trace
+	counts map[string]int
+}{traces: map[string]Trace{}, counts: map[string]int{}}
+
+// Begin records that the request t is being served by the query engine
+// until the returned func is called.
+func Begin(t Trace) (end func()) {
+	inflight.Lock()
+	inflight.traces[t.RequestID] = t
+	inflight.counts[t.RequestID]++
+	inflight.Unlock()
+	return func() {
+		inflight.Lock()
+		if inflight.counts[t.RequestID]--; inflight.counts[t.RequestID] <= 0 {
+			delete(inflight.traces, t.RequestID)
+			delete(inflight.counts, t.RequestID)
+		}
+		inflight.Unlock()
+	}
+}
+
+// Current returns the only request in flight. The query engine's log lines
+// carry no request context, so a line can only be attributed when a single
+// request could have caused it.
+func Current() (Trace, bool) {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if len(inflight.traces) != 1 {
+		return Trace{}, false
+	}
+	for _, t := range inflight.traces {
+		return t, true
+	}
+	return Trace{}, false
+}
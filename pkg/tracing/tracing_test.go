@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set(RequestIDHeader, "req-1")
+	trace := FromRequest(r)
+	assert.Equal(t, "req-1", trace.RequestID)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", trace.ParentID)
+	assert.True(t, trace.Sampled)
+
+	upstream := trace.Traceparent()
+	assert.True(t, strings.HasPrefix(upstream, "00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+	assert.True(t, strings.HasSuffix(upstream, "-01"))
+	assert.NotContains(t, upstream, trace.ParentID, "upstream calls get their own span")
+}
+
+func TestFromRequestWithoutTraceparent(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	r.Header.Set(RequestIDHeader, "req-1")
+	a, b := FromRequest(r), FromRequest(r)
+	assert.Len(t, a.TraceID, 32)
+	assert.Equal(t, a.TraceID, b.TraceID, "derived from the request ID")
+
+	generated := FromRequest(httptest.NewRequest("POST", "/", nil))
+	assert.Len(t, generated.RequestID, 32)
+	assert.Equal(t, generated.RequestID, generated.TraceID)
+}
+
+func TestCurrent(t *testing.T) {
+	a, b := Trace{RequestID: "a", TraceID: "ta"}, Trace{RequestID: "b", TraceID: "tb"}
+	_, ok := Current()
+	assert.False(t, ok)
+	endA := Begin(a)
+	current, ok := Current()
+	assert.True(t, ok)
+	assert.Equal(t, a, current)
+	endB := Begin(b)
+	_, ok = Current()
+	assert.False(t, ok, "ambiguous with two requests in flight")
+	endA()
+	current, _ = Current()
+	assert.Equal(t, b, current)
+	endB()
+	_, ok = Current()
+	assert.False(t, ok)
+}
@@ -0,0 +1,119 @@
+// Package upgrade hands the listening socket of a running wunderbase over to
+// a new process, so a new binary takes over without refusing connections.
+// The old process starts the new one with the socket and a pipe as extra
+// files, named by environment variables, and keeps serving until the new
+// one writes to the pipe that it is ready.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	envListenFD = "WUNDERBASE_UPGRADE_LISTEN_FD"
+	envReadyFD  = "WUNDERBASE_UPGRADE_READY_FD"
+)
+
+// readyPipe is the pipe Ready reports on, set by Listener.
+var readyPipe *os.File
+
+// Start runs the binary at path with args and the socket of l, and waits
+// until the new process called Ready. It fails if the new process exits or
+// isn't ready within timeout, killing it in the latter case; l keeps
+// serving either way.
+func Start(l net.Listener, path string, args []string, timeout time.Duration) (*os.Process, error) {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("upgrade: can't hand over a %T", l)
+	}
+	socket, err := filer.File()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	defer socket.Close()
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles start at fd 3
+	cmd.ExtraFiles = []*os.File{socket, readyWriter}
+	cmd.Env = append(os.Environ(), envListenFD+"=3", envReadyFD+"=4")
+	err = cmd.Start()
+	// only the new process may hold the write end, so its exit ends the read
+	readyWriter.Close()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: start %s: %w", path, err)
+	}
+	go func() {
+		// reap the process if it exits before this one
+		_ = cmd.Wait()
+	}()
+
+	if err := ready.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		_ = cmd.Process.Kill()
+		return nil, fmt.Errorf("upgrade: %w", err)
+	}
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			_ = cmd.Process.Kill()
+			return nil, fmt.Errorf("upgrade: new process not ready after %s", timeout)
+		}
+		return nil, fmt.Errorf("upgrade: new process exited before it was ready")
+	}
+	return cmd.Process, nil
+}
+
+// Listener returns the socket handed over by the previous process, or nil
+// if the process wasn't started by Start. The environment variables are
+// unset so child processes don't try to adopt the socket too.
+func Listener() (net.Listener, error) {
+	defer os.Unsetenv(envListenFD)
+	defer os.Unsetenv(envReadyFD)
+
+	listenFD, err := strconv.Atoi(os.Getenv(envListenFD))
+	if err != nil {
+		return nil, nil
+	}
+	readyFD, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: %s: %w", envReadyFD, err)
+	}
+	syscall.CloseOnExec(listenFD)
+	syscall.CloseOnExec(readyFD)
+	f := os.NewFile(uintptr(listenFD), "upgrade listener")
+	l, err := net.FileListener(f)
+	// FileListener dups the descriptor
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("upgrade: fd %d: %w", listenFD, err)
+	}
+	readyPipe = os.NewFile(uintptr(readyFD), "upgrade ready")
+	return l, nil
+}
+
+// Ready tells the previous process that this one serves, so it can drain
+// and exit. It does nothing when the process wasn't started by Start.
+func Ready() error {
+	if readyPipe == nil {
+		return nil
+	}
+	defer func() {
+		readyPipe.Close()
+		readyPipe = nil
+	}()
+	if _, err := readyPipe.Write([]byte{1}); err != nil {
+		return fmt.Errorf("upgrade: ready: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package upgrade
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestHelperProcess is the new process started by the tests below.
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv("UPGRADE_TEST_HELPER")
+	if mode == "" {
+		t.Skip("started by the upgrade tests")
+	}
+	l, err := Listener()
+	if err != nil || l == nil {
+		os.Exit(2)
+	}
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(3)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	_, _ = conn.Write([]byte("new"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestStart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	args := []string{"-test.run=^TestHelperProcess$"}
+
+	t.Setenv("UPGRADE_TEST_HELPER", "fail")
+	_, err = Start(l, os.Args[0], args, 10*time.Second)
+	assert.Error(t, err, "the new process exited without being ready")
+
+	t.Setenv("UPGRADE_TEST_HELPER", "serve")
+	process, err := Start(l, os.Args[0], args, 10*time.Second)
+	require.NoError(t, err)
+	assert.NotZero(t, process.Pid)
+
+	// the old process stops accepting, the new one serves the same socket
+	addr := l.Addr().String()
+	l.Close()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	got, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(got))
+}
+
+func TestListenerWithoutUpgrade(t *testing.T) {
+	t.Setenv(envListenFD, "")
+	l, err := Listener()
+	require.NoError(t, err)
+	assert.Nil(t, l)
+	assert.NoError(t, Ready())
+}
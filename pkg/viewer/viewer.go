@@ -0,0 +1,17 @@
+// Package viewer embeds the schema viewer page, which renders the models of
+// the introspection response with their fields, relations and row counts.
+package viewer
+
+import (
+	_ "embed"
+)
+
+//go:embed "viewer.html"
+var html string
+
+// HTML returns the page. It loads the introspection response from
+// viewer.json and the row count of a model from viewer/count?model=,
+// relative to its own url.
+func HTML() string {
+	return html
+}
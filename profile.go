@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"wunderbase/pkg/api"
+
+	"gopkg.in/yaml.v3"
+)
+
+// internalEnvPrefix sets a profile field for the internal endpoint, like
+// WUNDERBASE_INTERNAL_READ_LIMIT_SECONDS for WUNDERBASE_READ_LIMIT_SECONDS.
+const internalEnvPrefix = envPrefix + "INTERNAL_"
+
+// profileSetting is a value of the internal endpoint and where it came from.
+type profileSetting struct {
+	value, source string
+}
+
+// profileFields returns the index of every field tagged profile by its
+// flag name.
+func profileFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("profile") == "true" {
+			fields[t.Field(i).Tag.Get("flag")] = i
+		}
+	}
+	return fields
+}
+
+// parseInternalEnv reads the WUNDERBASE_INTERNAL_ env vars, which must name
+// a profile field, or its _FILE variant for secrets.
+func parseInternalEnv(environment map[string]string, config *config) error {
+	t := reflect.TypeOf(config).Elem()
+	byEnv := map[string]int{}
+	for _, i := range profileFields() {
+		byEnv[t.Field(i).Tag.Get("env")] = i
+		if t.Field(i).Tag.Get("secret") == "true" {
+			byEnv[t.Field(i).Tag.Get("env")+"_FILE"] = i
+		}
+	}
+	for name, value := range environment {
+		if !strings.HasPrefix(name, internalEnvPrefix) {
+			continue
+		}
+		i, ok := byEnv[envPrefix+strings.TrimPrefix(name, internalEnvPrefix)]
+		if !ok {
+			return fmt.Errorf("%s: not a setting of the internal endpoint", name)
+		}
+		source := "env " + name
+		if strings.HasSuffix(name, "_FILE") && !strings.HasSuffix(t.Field(i).Tag.Get("env"), "_FILE") {
+			if _, ok := environment[strings.TrimSuffix(name, "_FILE")]; ok {
+				return fmt.Errorf("%s and %s are both set, use only one", strings.TrimSuffix(name, "_FILE"), name)
+			}
+			var err error
+			if value, err = readSecretFile(value); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			source = "file from env " + name
+		}
+		config.setInternal(t.Field(i).Name, profileSetting{value, source})
+	}
+	return nil
+}
+
+// loadInternalSettings applies the internal section of the config file to
+// the profile fields not set through their internal env var, and returns
+// its unknown keys.
+func loadInternalSettings(section interface{}, config *config) ([]string, error) {
+	settings, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("internal: must be a mapping of settings, got %T", section)
+	}
+	t := reflect.TypeOf(config).Elem()
+	fields := profileFields()
+	var unknown []string
+	for key, value := range settings {
+		i, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, "internal."+key)
+			continue
+		}
+		if _, ok := config.internal[t.Field(i).Name]; ok {
+			continue
+		}
+		config.setInternal(t.Field(i).Name, profileSetting{fmt.Sprint(value), "file internal." + key})
+	}
+	return unknown, nil
+}
+
+func (c *config) setInternal(field string, setting profileSetting) {
+	if c.internal == nil {
+		c.internal = map[string]profileSetting{}
+	}
+	c.internal[field] = setting
+}
+
+// internalProfile returns the configuration of the internal endpoint: the
+// public one with its profile fields replaced by the internal settings.
+// Settings left out are the same as for the public endpoint.
+func (c *config) internalProfile() (*config, error) {
+	profile := *c
+	profile.internal, profile.ManagementListenAddr = nil, ""
+	profile.sources = map[string]string{}
+	for field, source := range c.sources {
+		profile.sources[field] = source
+	}
+	v := reflect.ValueOf(&profile).Elem()
+	names := make([]string, 0, len(c.internal))
+	for field := range c.internal {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		setting := c.internal[field]
+		if err := (fieldValue{v.FieldByName(field)}).Set(setting.value); err != nil {
+			return nil, fmt.Errorf("%s: %w", setting.source, err)
+		}
+		profile.setSource(field, setting.source)
+	}
+	return &profile, nil
+}
+
+// validateInternal reports the problems of the internal endpoint's settings
+// that the public ones don't have.
+func (c *config) validateInternal(errs *validationErrors) {
+	profile, err := c.internalProfile()
+	if err != nil {
+		errs.add("internal endpoint: %v", err)
+		return
+	}
+	public := map[string]bool{}
+	for _, problem := range *errs {
+		public[problem] = true
+	}
+	if err := profile.Validate(); err != nil {
+		for _, problem := range err.(validationErrors) {
+			if !public[problem] {
+				errs.add("internal endpoint: %s", problem)
+			}
+		}
+	}
+}
+
+// withProfile returns the handler config of the public endpoint with the
+// profile fields of profile, for the internal endpoint. The quota counts
+// persisted next to the database are the public endpoint's.
+func withProfile(handlerConfig api.Config, profile *config) api.Config {
+	// validateInternal validated the profile like the public settings
+	handlerConfig.TrustedProxies, _ = parseCIDRs(profile.TrustedProxies)
+	handlerConfig.OperationLimits, _ = parseOperationLimits(profile.OperationLimits)
+	handlerConfig.RowFilters, _ = parseRowFilters(profile.RowFilters)
+	handlerConfig.AuthRules, _ = loadAuthRules(profile.AuthRulesFile)
+
+	handlerConfig.ReadLimitSeconds = profile.ReadLimitSeconds
+	handlerConfig.WriteLimitSeconds = profile.WriteLimitSeconds
+	handlerConfig.ReadQuota = profile.ReadQuota
+	handlerConfig.WriteQuota = profile.WriteQuota
+	handlerConfig.PersistQuota = false
+	handlerConfig.TrustedAuthHeader = profile.TrustedAuthHeader
+	handlerConfig.TrustedScopesHeader = profile.TrustedScopesHeader
+	handlerConfig.AdminToken = profile.AdminToken
+	handlerConfig.EnableREST = profile.EnableREST
+	handlerConfig.EnableSchemaViewer = profile.schemaViewerEnabled()
+	handlerConfig.SafeMutations = profile.safeMutationsEnabled()
+	handlerConfig.DisableIntrospection = !profile.Introspection
+	handlerConfig.DisableRawQueries = !profile.RawQueries
+	handlerConfig.MaxResultRows = profile.MaxResultRows
+	handlerConfig.MaxResultRowsExempt = splitList(profile.MaxResultRowsExempt)
+	handlerConfig.DefaultTake = profile.DefaultTake
+	handlerConfig.DefaultNestedTake = profile.DefaultNestedTake
+	return handlerConfig
+}
+
+// printInternal returns the internal section of the effective
+// configuration for printConfig, nil without internal settings.
+func printInternal(config *config) (*yaml.Node, error) {
+	if len(config.internal) == 0 {
+		return nil, nil
+	}
+	profile, err := config.internalProfile()
+	if err != nil {
+		return nil, err
+	}
+	section := &yaml.Node{Kind: yaml.MappingNode}
+	v := reflect.ValueOf(profile).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if _, ok := config.internal[field.Name]; !ok {
+			continue
+		}
+		value := &yaml.Node{}
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			value.SetString("<redacted>")
+		} else if err := value.Encode(v.Field(i).Interface()); err != nil {
+			return nil, err
+		}
+		value.LineComment = "from " + profile.source(field.Name)
+		section.Content = append(section.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: field.Tag.Get("flag")}, value)
+	}
+	return section, nil
+}
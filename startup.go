@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// startupTracker bounds how long serve may take to become ready. It records
+// the phase in progress so a timeout says where the boot sequence hung.
+type startupTracker struct {
+	timeout time.Duration
+	begin   time.Time
+	timer   *time.Timer
+	abort   func()
+
+	mu       sync.Mutex
+	phase    string
+	phaseAt  time.Time
+	timedOut bool
+	ready    bool
+	failed   error
+}
+
+// startStartup starts the timeout; abort is called when it expires and must
+// tear down what was started so far. A timeout of 0 disables the limit.
+func startStartup(timeout time.Duration, abort func()) *startupTracker {
+	s := &startupTracker{timeout: timeout, begin: time.Now(), abort: abort}
+	if timeout > 0 {
+		s.timer = time.AfterFunc(timeout, func() {
+			s.mu.Lock()
+			if s.ready {
+				s.mu.Unlock()
+				return
+			}
+			s.timedOut = true
+			phase, elapsed := s.phase, time.Since(s.phaseAt)
+			s.mu.Unlock()
+			slog.Error("Startup timed out",
+				slog.String("phase", phase),
+				slog.Duration("phaseElapsed", elapsed.Round(time.Millisecond)),
+				slog.Duration("timeout", timeout))
+			abort()
+		})
+	}
+	return s
+}
+
+// enter marks the start of a phase. It fails if the timeout already expired,
+// so no further phases start after an abort.
+func (s *startupTracker) enter(phase string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timedOut || s.failed != nil {
+		return s.errLocked()
+	}
+	s.phase, s.phaseAt = phase, time.Now()
+	return nil
+}
+
+// done stops the timeout once serve is ready.
+func (s *startupTracker) done() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.ready = true
+	slog.Info("Startup complete", slog.Duration("elapsed", time.Since(s.begin).Round(time.Millisecond)))
+}
+
+// fail aborts the startup with err, for a phase that can't succeed anymore
+// like waiting for a query engine that exited. err carries the exit code.
+func (s *startupTracker) fail(err error) {
+	s.mu.Lock()
+	if s.ready || s.timedOut || s.failed != nil {
+		s.mu.Unlock()
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.failed = err
+	phase := s.phase
+	s.mu.Unlock()
+	slog.Error("Startup failed", slog.String("phase", phase), slog.String("error", err.Error()))
+	s.abort()
+}
+
+// err returns the startup failure if the timeout expired or the startup
+// failed, nil otherwise.
+func (s *startupTracker) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.timedOut && s.failed == nil {
+		return nil
+	}
+	return s.errLocked()
+}
+
+func (s *startupTracker) errLocked() error {
+	if s.failed != nil {
+		return s.failed
+	}
+	return withExitCode(exitStartup, fmt.Errorf("wunderbase: not ready after %s, stuck in phase %q", s.timeout, s.phase))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// processStart is the time Timestamp expands to, the same for every field
+// and on reloads.
+var processStart = time.Now()
+
+// templateData is what the values of the fields tagged template can use,
+// like backups/{{.Hostname}}/{{.Env "FLY_APP_NAME"}}.
+type templateData struct{}
+
+// Hostname is the host name of the machine.
+func (templateData) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+// Env is the value of an environment variable, which must be set.
+func (templateData) Env(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("env var %s is not set", name)
+	}
+	return value, nil
+}
+
+// Timestamp is the start of the process in UTC, like 20060102T150405Z.
+func (templateData) Timestamp() string {
+	return processStart.UTC().Format("20060102T150405Z")
+}
+
+// expandTemplates renders the fields tagged template as text/template with
+// templateData, once env vars, flags and the config file are merged. The
+// source of an expanded field keeps the template it was expanded from.
+func expandTemplates(config *config) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("template") != "true" {
+			continue
+		}
+		raw := v.Field(i).String()
+		if !strings.Contains(raw, "{{") {
+			continue
+		}
+		name := field.Tag.Get("env")
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		var expanded strings.Builder
+		if err := tmpl.Execute(&expanded, templateData{}); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		v.Field(i).SetString(expanded.String())
+		config.setSource(field.Name, config.source(field.Name)+", template "+strconv.Quote(raw))
+	}
+	return nil
+}